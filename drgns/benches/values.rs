@@ -0,0 +1,132 @@
+//! How the size of values weighs on what the engines do most: pushing and
+//! popping them on a stack, and copying lists of them. `Value` holds
+//! builtins by reference, this compares it with the representation it
+//! replaced, which held them inline, see `Inline`.
+//!
+//! ```sh
+//! cargo bench --bench values
+//! ```
+//!
+//! The benchmarks of `drgns bench benches` measure whole scripts on the
+//! current representation, this one both representations side by side.
+
+use std::{
+    hint::black_box,
+    mem::size_of,
+    time::{Duration, Instant},
+};
+
+use drgns::{interpreter::BUILTINS, values::Builtin, Value};
+
+/// The calls of each benchmark timed, after as many to warm up
+const ROUNDS: u32 = 10_000;
+
+/// A value as it was, with the name, arity, function and documentation of
+/// builtins inline, making every value as large as them
+#[derive(Clone)]
+enum Inline {
+    Value(Value),
+    Builtin(Builtin),
+}
+
+/// What the benchmarks need of a representation
+trait Layout: Clone {
+    fn int(i: i64) -> Self;
+    fn builtin(b: &'static Builtin) -> Self;
+    fn int_of(&self) -> i64;
+}
+
+impl Layout for Value {
+    fn int(i: i64) -> Self {
+        Value::Int(i)
+    }
+
+    fn builtin(b: &'static Builtin) -> Self {
+        Value::Builtin(b)
+    }
+
+    fn int_of(&self) -> i64 {
+        match self {
+            Value::Int(i) => *i,
+            _ => 1,
+        }
+    }
+}
+
+impl Layout for Inline {
+    fn int(i: i64) -> Self {
+        Inline::Value(Value::Int(i))
+    }
+
+    fn builtin(b: &'static Builtin) -> Self {
+        Inline::Builtin(b.clone())
+    }
+
+    fn int_of(&self) -> i64 {
+        match self {
+            Inline::Value(Value::Int(i)) => *i,
+            _ => 1,
+        }
+    }
+}
+
+/// a loop of a stack machine: push an operand, pop two, push their sum
+fn stack<V: Layout>() -> i64 {
+    let mut stack: Vec<V> = Vec::with_capacity(16);
+    stack.push(V::int(0));
+    for i in 0..1000 {
+        stack.push(V::int(black_box(i)));
+        let b = stack.pop().map_or(0, |v| v.int_of());
+        let a = stack.pop().map_or(0, |v| v.int_of());
+        stack.push(V::int(a + b));
+    }
+    stack.pop().map_or(0, |v| v.int_of())
+}
+
+/// a list of ints built item by item, then copied and summed
+fn ints<V: Layout>() -> i64 {
+    let items: Vec<V> = (0..1000).map(|i| V::int(black_box(i))).collect();
+    let copy = black_box(items.clone());
+    copy.iter().map(V::int_of).sum()
+}
+
+/// a list of builtins, as passed to `map` and the like, copied
+fn builtins<V: Layout>() -> i64 {
+    let items: Vec<V> = BUILTINS.iter().cycle().take(1000).map(V::builtin).collect();
+    let copy = black_box(items.clone());
+    copy.iter().map(V::int_of).sum()
+}
+
+/// the time of a call
+fn measure(f: fn() -> i64) -> Duration {
+    for _ in 0..ROUNDS {
+        black_box(f());
+    }
+    let start = Instant::now();
+    for _ in 0..ROUNDS {
+        black_box(f());
+    }
+    start.elapsed() / ROUNDS
+}
+
+fn main() {
+    println!(
+        "values take {} bytes, {} with builtins inline\n",
+        size_of::<Value>(),
+        size_of::<Inline>()
+    );
+    let benchmarks: [(&str, fn() -> i64, fn() -> i64); 3] = [
+        ("stack", stack::<Value>, stack::<Inline>),
+        ("ints", ints::<Value>, ints::<Inline>),
+        ("builtins", builtins::<Value>, builtins::<Inline>),
+    ];
+    println!("{:<10} {:>12} {:>12}", "", "by reference", "inline");
+    for (name, by_reference, inline) in benchmarks {
+        let (by_reference, inline) = (measure(by_reference), measure(inline));
+        let change = (inline.as_secs_f64() / by_reference.as_secs_f64() - 1.0) * 100.0;
+        println!(
+            "{:<10} {:>12?} {:>12?}  {:+.1}% inline",
+            name, by_reference, inline, change
+        );
+    }
+}
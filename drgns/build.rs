@@ -0,0 +1,42 @@
+//! Records what drgns is built from, for `drgns version --verbose`: the
+//! commit of the checkout, the compiler and the target. Those it can't tell
+//! are left unset.
+
+use std::{env, path::Path, process::Command};
+
+/// the first line the program writes, if it runs and succeeds
+fn output(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    let text = String::from_utf8(output.stdout).ok()?;
+    let line = text.lines().next()?.trim();
+    (output.status.success() && !line.is_empty()).then(|| line.to_owned())
+}
+
+fn main() {
+    if let Some(commit) = output("git", &["rev-parse", "HEAD"]) {
+        println!("cargo:rustc-env=DRGNS_COMMIT={}", commit);
+    }
+    // the commit changes with what HEAD points to
+    if let Some(dir) = output("git", &["rev-parse", "--absolute-git-dir"]) {
+        for file in ["HEAD", "packed-refs"] {
+            let path = Path::new(&dir).join(file);
+            if path.exists() {
+                println!("cargo:rerun-if-changed={}", path.display());
+            }
+        }
+        if let Some(branch) = output("git", &["symbolic-ref", "-q", "HEAD"]) {
+            println!(
+                "cargo:rerun-if-changed={}",
+                Path::new(&dir).join(branch).display()
+            );
+        }
+    }
+    println!("cargo:rerun-if-changed=build.rs");
+    let rustc = env::var("RUSTC").unwrap_or("rustc".to_owned());
+    if let Some(version) = output(&rustc, &["--version"]) {
+        println!("cargo:rustc-env=DRGNS_RUSTC={}", version);
+    }
+    if let Ok(target) = env::var("TARGET") {
+        println!("cargo:rustc-env=DRGNS_TARGET={}", target);
+    }
+}
@@ -0,0 +1,22 @@
+//! What parses does the same on both engines, see `differential`.
+
+#![no_main]
+
+use std::thread;
+
+use drgns::{differential, Limits};
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|text: &str| {
+    // with the stack the calls of the programs can take
+    let code = text.to_owned();
+    let compared = thread::Builder::new()
+        .stack_size(Limits::default().stack_size())
+        .spawn(move || differential::compare(&code))
+        .expect("the thread starts")
+        .join()
+        .expect("the engines don't panic");
+    if let Err(divergence) = compared {
+        panic!("{}", divergence);
+    }
+});
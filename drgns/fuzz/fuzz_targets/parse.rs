@@ -0,0 +1,18 @@
+//! The parser takes any text, it reports the errors it finds without
+//! panicking, and what parses formats and checks.
+
+#![no_main]
+
+use std::sync::Arc;
+
+use drgns::{checker, formatter, parser, source::Source};
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|text: &str| {
+    let src = Arc::new(Source::from_string(text.to_owned()));
+    let (program, errors) = parser::parse(&src);
+    if errors.is_empty() {
+        let _ = checker::check(&program);
+        let _ = formatter::format(&src);
+    }
+});
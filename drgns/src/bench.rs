@@ -0,0 +1,295 @@
+//! The benchmarks of `drgns bench`.
+//!
+//! Benchmarks are the functions whose names start with `bench_`, in the test
+//! files of `drgns test`. Each runs in an interpreter of its own, after the
+//! statements of its file, and is called in rounds, more times in each, until
+//! the calls of a round take the time asked for. The time of that round and
+//! the values created on it are reported per call, the values as they count
+//! against `--max-values`, leaving out those of the tasks it starts.
+//!
+//! The results can be saved to a JSON file, a baseline later runs are
+//! compared with to catch the changes that made the interpreter slower.
+
+use std::{
+    collections::BTreeMap,
+    time::{Duration, Instant},
+};
+
+use drgns::{
+    error_handler::{DragonError, ErrorCode},
+    interpreter::{
+        interrupt::{self, Reason},
+        limits, Halt,
+    },
+    parser::Program,
+    Interpreter, Value,
+};
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    handle_interrupts, load, report, testing, BenchFlags, Watchdog, INTERRUPTED, INVALID_PROGRAM,
+    RUNTIME_ERROR, SUCCESS,
+};
+
+#[cfg(test)]
+mod test;
+
+const BENCH_PREFIX: &str = "bench_";
+
+/// The most calls of a round, for functions too fast to be timed
+const MAX_RUNS: u64 = 1_000_000_000;
+
+/// What a benchmark measured, in the last of its rounds
+#[derive(Serialize, Deserialize, Debug, Clone, Copy)]
+struct Measure {
+    runs: u64,
+    ns_per_op: f64,
+    allocs_per_op: f64,
+}
+
+/// The measures of a run by benchmark, named `<file>::<function>`
+type Baseline = BTreeMap<String, Measure>;
+
+/// Run the benchmarks of a file, or of the test files in a directory and
+/// those below it, each in an interpreter `interpreter` makes and for at most
+/// `timeout`. Returns the exit status of the process.
+pub fn run(
+    path: &str,
+    flags: &BenchFlags,
+    timeout: Option<Duration>,
+    interpreter: impl Fn() -> Interpreter,
+) -> i32 {
+    let Some(files) = testing::files(path) else {
+        return INVALID_PROGRAM;
+    };
+    let baseline = match &flags.compare {
+        Some(path) => match read_baseline(path) {
+            Some(baseline) => Some(baseline),
+            None => return INVALID_PROGRAM,
+        },
+        None => None,
+    };
+    handle_interrupts();
+    let mut summary = Summary::default();
+    let mut measures = Baseline::new();
+    for file in files {
+        let Some(program) = load(&file) else {
+            summary.broken += 1;
+            continue;
+        };
+        let benchmarks = testing::functions(&program, BENCH_PREFIX);
+        if benchmarks.is_empty() {
+            continue;
+        }
+        println!("{}", file);
+        for name in benchmarks {
+            let _watchdog = timeout.map(Watchdog::start);
+            let outcome = bench(&program, name, flags.bench_time, interpreter());
+            let stopped = interrupt::reason() == Some(Reason::Interrupt);
+            interrupt::clear();
+            match outcome {
+                Ok(measure) => {
+                    let key = format!("{}::{}", file, name);
+                    let compared = baseline
+                        .as_ref()
+                        .map(|b| compare(measure, b.get(&key), flags));
+                    if let Some(Comparison {
+                        regressed: true, ..
+                    }) = compared
+                    {
+                        summary.regressed += 1;
+                    }
+                    let shown = compared.map_or("".to_string(), |c| c.shown);
+                    println!("{}", row(name, measure, &shown));
+                    summary.measured += 1;
+                    measures.insert(key, measure);
+                }
+                Err(e) => {
+                    println!("  {} ... FAILED", name);
+                    report(&[e]);
+                    summary.failed += 1;
+                }
+            }
+            // Ctrl-C stops the whole run, a timeout only the benchmark
+            if stopped {
+                summary.print();
+                return INTERRUPTED;
+            }
+        }
+    }
+    summary.print();
+    if let Some(path) = &flags.save {
+        if !write_baseline(path, &measures) {
+            return RUNTIME_ERROR;
+        }
+    }
+    match summary.failed + summary.broken + summary.regressed {
+        0 => SUCCESS,
+        _ => RUNTIME_ERROR,
+    }
+}
+
+#[derive(Default)]
+struct Summary {
+    measured: usize,
+    failed: usize,
+
+    /// the benchmarks slower than the baseline by more than the threshold
+    regressed: usize,
+
+    /// the files that could not be parsed, whose benchmarks didn't run
+    broken: usize,
+}
+
+impl Summary {
+    fn print(&self) {
+        let result = match self.failed + self.broken + self.regressed {
+            0 => "ok",
+            _ => "FAILED",
+        };
+        print!(
+            "\nbench result: {}. {} measured, {} failed",
+            result, self.measured, self.failed
+        );
+        match self.regressed {
+            0 => {}
+            n => print!(", regressed: {}", n),
+        }
+        match self.broken {
+            0 => println!(),
+            n => println!(", files that could not be parsed: {}", n),
+        }
+    }
+}
+
+/// Run the statements of the file, then the benchmark in rounds until the
+/// calls of one take `time`
+fn bench(
+    program: &Program,
+    name: &str,
+    time: Duration,
+    mut interpreter: Interpreter,
+) -> Result<Measure, DragonError> {
+    let outcome = interpreter.eval(program).and_then(|_| {
+        let function = interpreter
+            .get_global(name)
+            .expect("the file declares the benchmark");
+        measure(&mut interpreter, &function, time)
+    });
+    match outcome {
+        Ok(measure) => Ok(measure),
+        Err(Halt::Error(e)) => Err(e),
+        Err(Halt::Exit(code)) => Err(DragonError::runtime(
+            format!("the benchmark exited with code {}", code),
+            None,
+        )),
+    }
+}
+
+fn measure(
+    interpreter: &mut Interpreter,
+    function: &Value,
+    time: Duration,
+) -> Result<Measure, Halt> {
+    let mut runs = 1;
+    loop {
+        let created = limits::created();
+        let start = Instant::now();
+        for _ in 0..runs {
+            interpreter.call(function, vec![])?;
+        }
+        let elapsed = start.elapsed();
+        if elapsed >= time || runs >= MAX_RUNS {
+            return Ok(Measure {
+                runs,
+                ns_per_op: elapsed.as_nanos() as f64 / runs as f64,
+                allocs_per_op: (limits::created() - created) as f64 / runs as f64,
+            });
+        }
+        // aim past the time from how long the calls took so far, growing the
+        // rounds at most a hundredfold so that one slow call isn't missed
+        let per_run = elapsed.as_nanos().max(1) as f64 / runs as f64;
+        let aimed = (time.as_nanos() as f64 * 1.2 / per_run) as u64;
+        runs = aimed.clamp(runs + 1, runs * 100).min(MAX_RUNS);
+    }
+}
+
+/// The line reporting the measure of a benchmark, then how it compares with
+/// the baseline
+fn row(name: &str, measure: Measure, compared: &str) -> String {
+    format!(
+        "  {:<24} {:>10} runs {:>14.1} ns/op {:>10.1} allocs/op{}",
+        name, measure.runs, measure.ns_per_op, measure.allocs_per_op, compared
+    )
+}
+
+/// How a measure compares with the one of the baseline
+struct Comparison {
+    shown: String,
+    regressed: bool,
+}
+
+fn compare(measure: Measure, baseline: Option<&Measure>, flags: &BenchFlags) -> Comparison {
+    let Some(baseline) = baseline else {
+        return Comparison {
+            shown: "  (not in the baseline)".to_string(),
+            regressed: false,
+        };
+    };
+    let change = |now: f64, then: f64| {
+        if then == 0.0 {
+            if now == 0.0 {
+                0.0
+            } else {
+                f64::INFINITY
+            }
+        } else {
+            (now - then) / then * 100.0
+        }
+    };
+    let time = change(measure.ns_per_op, baseline.ns_per_op);
+    let allocs = change(measure.allocs_per_op, baseline.allocs_per_op);
+    let regressed = time > flags.threshold || allocs > flags.threshold;
+    Comparison {
+        shown: format!(
+            "  {:+.1}% time {:+.1}% allocs{}",
+            time,
+            allocs,
+            if regressed { "  REGRESSED" } else { "" }
+        ),
+        regressed,
+    }
+}
+
+fn read_baseline(path: &str) -> Option<Baseline> {
+    let error = |code, reason: String| {
+        let msg = format!("cannot read the baseline '{}': {}", path, reason);
+        report(&[DragonError::new(code, msg, None)]);
+    };
+    let text = match std::fs::read_to_string(path) {
+        Ok(text) => text,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+            error(ErrorCode::IoNotFound, e.to_string());
+            return None;
+        }
+        Err(e) => {
+            error(ErrorCode::Io, e.to_string());
+            return None;
+        }
+    };
+    serde_json::from_str(&text)
+        .map_err(|e| error(ErrorCode::Io, e.to_string()))
+        .ok()
+}
+
+fn write_baseline(path: &str, measures: &Baseline) -> bool {
+    let json = serde_json::to_string_pretty(measures).expect("measures can be serialized");
+    match std::fs::write(path, json + "\n") {
+        Ok(()) => true,
+        Err(e) => {
+            let msg = format!("cannot write the baseline '{}': {}", path, e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            false
+        }
+    }
+}
@@ -0,0 +1,82 @@
+use std::{fs, time::Duration};
+
+use drgns::{Interpreter, Value};
+
+use super::{compare, measure, row, run, Baseline};
+use crate::{load, test_utils, BenchFlags, SUCCESS};
+
+const BENCH: &str = "mut calls := 0
+function bench_count() -> {
+    calls += 1
+}
+";
+
+fn flags(save: Option<String>, compare: Option<String>) -> BenchFlags {
+    BenchFlags {
+        bench_time: Duration::ZERO,
+        save,
+        compare,
+        threshold: 10.0,
+    }
+}
+
+#[test]
+fn bench_one_round() {
+    let dir = test_utils::project("bench", "round", &[("count_bench.drgns", BENCH)]);
+    let file = dir.join("count_bench.drgns").display().to_string();
+    let program = load(&file).expect("the benchmark parses");
+    let mut interpreter = Interpreter::new();
+    interpreter.eval(&program).expect("the file runs");
+    // a round of one call already takes no time at all
+    let function = interpreter.get_global("bench_count").expect("declared");
+    let once = measure(&mut interpreter, &function, Duration::ZERO).expect("measured");
+    assert_eq!(once.runs, 1);
+    assert_eq!(interpreter.get_global("calls"), Some(Value::Int(1)));
+    assert!(once.ns_per_op >= 0.0);
+
+    let shown = row("bench_count", once, "");
+    assert!(shown.starts_with("  bench_count "), "{}", shown);
+    assert!(shown.contains(" 1 runs "), "{}", shown);
+    assert!(shown.ends_with(" allocs/op"), "{}", shown);
+    assert_eq!(
+        compare(once, None, &flags(None, None)).shown,
+        "  (not in the baseline)"
+    );
+    let same = compare(once, Some(&once), &flags(None, None));
+    assert_eq!(same.shown, "  +0.0% time +0.0% allocs");
+    assert!(!same.regressed);
+    let _ = fs::remove_dir_all(dir);
+}
+
+#[test]
+fn bench_saves_the_baseline() {
+    let dir = test_utils::project("bench", "baseline", &[("count_bench.drgns", BENCH)]);
+    let path = dir.display().to_string();
+    let file = dir.join("count_bench.drgns").display().to_string();
+    let saved = dir.join("base.json").display().to_string();
+    let status = run(
+        &path,
+        &flags(Some(saved.clone()), None),
+        None,
+        Interpreter::new,
+    );
+    assert_eq!(status, SUCCESS);
+    let text = fs::read_to_string(&saved).expect("the baseline is saved");
+    let baseline: Baseline = serde_json::from_str(&text).expect("the baseline reads back");
+    let key = format!("{}::bench_count", file);
+    assert_eq!(baseline.keys().collect::<Vec<_>>(), [&key]);
+    assert_eq!(baseline[&key].runs, 1);
+    let json: serde_json::Value = serde_json::from_str(&text).expect("the baseline is JSON");
+    let mut fields: Vec<_> = json[&key]
+        .as_object()
+        .expect("a measure is an object")
+        .keys()
+        .cloned()
+        .collect();
+    fields.sort();
+    assert_eq!(fields, ["allocs_per_op", "ns_per_op", "runs"]);
+    // and a run compared with it does not fail for lack of measures
+    let status = run(&path, &flags(None, Some(saved)), None, Interpreter::new);
+    assert_eq!(status, SUCCESS);
+    let _ = fs::remove_dir_all(dir);
+}
@@ -0,0 +1,454 @@
+//! Bytecode produced by the compiler and executed by the VM.
+//!
+//! Each function is compiled to its own chunk of instructions. Variables are
+//! resolved ahead of time into one of three kinds of storage:
+//! - slots: local variables that are never captured by a closure
+//! - cells: local variables captured by a closure, they are shared between
+//!   the frame declaring them and the closures capturing them, so they are
+//!   kept on the heap
+//! - globals: variables declared at the top level of a program, looked up by
+//!   name at run-time, so that the REPL can add to them across lines
+
+use std::{fmt::Write, ops::Range, sync::Arc};
+
+use crate::{
+    eh::ErrorCode,
+    parser::{Arity, BinOperator, Import, Pattern, UnOperator},
+    source::{Position, SourceString},
+    values::Value,
+    vm::cache::Caches,
+};
+
+/// A single instruction, the comments describe the effect on the stack
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Op {
+    /// push a constant
+    Constant(u32),
+    None,
+    True,
+    False,
+
+    Pop,
+    /// pop n values
+    PopN(u32),
+    /// pop n values below the top one
+    Slide(u32),
+    /// push copies of the top n values
+    Duplicate(u32),
+
+    /// push the value of a slot
+    GetLocal(u32),
+    /// pop a value into a slot
+    SetLocal(u32),
+    /// replace a cell with a fresh one, holding `none`
+    NewCell(u32),
+    /// pop a value into a fresh cell
+    MakeCell(u32),
+    GetCell(u32),
+    SetCell(u32),
+    /// cells captured from the enclosing function
+    GetFree(u32),
+    SetFree(u32),
+    /// the operand is the index of the name
+    GetGlobal(u32),
+    SetGlobal(u32),
+    DefineGlobal(u32, bool),
+
+    /// push the module with the given import index
+    Import(u32),
+    /// replace a module with its export, the operand is the index of the name
+    Member(u32),
+    /// replace an instance with the value of the field with the given name
+    GetField(u32),
+    /// pop a value and an instance, and store the value in the field
+    SetField(u32),
+    /// with the receiver of a method call on top, push the method with the
+    /// given name below it, or else the function below the receiver if the
+    /// flag is set, or else the global with that name
+    Method(u32, bool),
+
+    Binary(BinOperator),
+    Unary(UnOperator),
+    /// replace the top value with its truthiness
+    ToBool,
+
+    /// pop n values into a new list
+    List(u32),
+    /// pop n pairs of keys and values into a new map
+    Map(u32),
+    /// pop an index and its target, push the item
+    Index,
+    /// pop the step, end, start and target, push the slice
+    Slice,
+    /// pop a value, an index and its target, and store the value
+    SetIndex,
+    /// replace the top value with the iterator a `for` loop goes through
+    Iter,
+    /// with an iterator on top, push its next item, or jump once it is done
+    Iterate(u32),
+    /// with the subject of a `match` on top, push a list of the values bound
+    /// by the pattern with the given index, or jump if it doesn't match
+    Match(u32, u32),
+    /// replace a list of n values with its items
+    Unpack(u32),
+    /// pop the subject of a `match` that no arm matched, and raise an error
+    Unmatched,
+    /// replace the value on top with a list of the values bound by the
+    /// pattern with the given index, or raise an error if it doesn't match
+    Destructure(u32),
+
+    Jump(u32),
+    /// pop the condition and jump if it's falsy
+    JumpIfFalse(u32),
+    JumpIfTrue(u32),
+    /// jump if the top value is `none`, which is left on the stack
+    JumpIfNone(u32),
+    /// jump if the top value is not `none`, which is left on the stack
+    JumpIfNotNone(u32),
+
+    /// push a closure over the function prototype with the given index
+    Closure(u32),
+    /// pop n closures, the methods of the struct with the given index, and
+    /// push the struct
+    Struct(u32, u32),
+    /// pop n closures, the methods of the enum with the given index among
+    /// the structs, and push the enum
+    Enum(u32, u32),
+    /// call the function below the given number of arguments
+    Call(u32),
+    /// call like `Call`, the last arguments are given by the names with the
+    /// given index
+    CallNamed(u32, u32),
+    /// call like `Call`, for calls whose value is returned right away, the
+    /// function called takes over the frame of the caller
+    TailCall(u32),
+    /// a tail call given names like `CallNamed`
+    TailCallNamed(u32, u32),
+    /// pop the arguments and the function like `Call`, and push a task
+    /// running the call
+    Spawn(u32),
+    SpawnNamed(u32, u32),
+    /// jump to the address if the call gave the parameter in the slot an
+    /// argument, over the code computing its default
+    Given(u32, u32),
+    Return,
+    /// suspend the generator running, handing over the top value, and push
+    /// `none` once it is resumed
+    Yield,
+    /// pop the exit code and stop the program
+    Exit,
+    /// raise the error with the given index
+    Fail(u32),
+    /// pop a value and raise it, see `interpreter::thrown`
+    Throw,
+    /// pop a closure, called without arguments once the frame stops running
+    Defer,
+    /// install a handler, until the matching `EndTry` an error unwinds the
+    /// stack to its current height, pushes the error and jumps to the address
+    Try(u32),
+    EndTry,
+}
+
+impl Op {
+    /// the change in the height of the stack after executing the instruction
+    pub fn stack_effect(&self) -> i64 {
+        match self {
+            Op::Constant(_) | Op::None | Op::True | Op::False => 1,
+            Op::Pop => -1,
+            Op::PopN(n) | Op::Slide(n) => -(*n as i64),
+            Op::Duplicate(n) => *n as i64,
+            Op::GetLocal(_) | Op::GetCell(_) | Op::GetFree(_) | Op::GetGlobal(_) => 1,
+            Op::SetLocal(_)
+            | Op::MakeCell(_)
+            | Op::SetCell(_)
+            | Op::SetFree(_)
+            | Op::SetGlobal(_)
+            | Op::DefineGlobal(..) => -1,
+            Op::NewCell(_) => 0,
+            Op::Import(_) => 1,
+            Op::Member(_) | Op::GetField(_) => 0,
+            Op::SetField(_) => -2,
+            Op::Method(_, fallback) => !fallback as i64,
+            Op::Binary(_) => -1,
+            Op::Unary(_) | Op::ToBool => 0,
+            Op::List(n) => 1 - *n as i64,
+            Op::Map(n) => 1 - 2 * *n as i64,
+            Op::Index => -1,
+            Op::Slice | Op::SetIndex => -3,
+            Op::Iter => 0,
+            Op::Iterate(_) => 1,
+            Op::Match(..) => 1,
+            Op::Unpack(n) => *n as i64 - 1,
+            Op::Unmatched => -1,
+            Op::Destructure(_) => 0,
+            Op::Jump(_) => 0,
+            Op::JumpIfFalse(_) | Op::JumpIfTrue(_) => -1,
+            Op::JumpIfNone(_) | Op::JumpIfNotNone(_) => 0,
+            Op::Closure(_) => 1,
+            Op::Struct(_, n) | Op::Enum(_, n) => 1 - *n as i64,
+            Op::Call(argc) | Op::TailCall(argc) | Op::Spawn(argc) => -(*argc as i64),
+            Op::CallNamed(argc, _) | Op::TailCallNamed(argc, _) | Op::SpawnNamed(argc, _) => {
+                -(*argc as i64)
+            }
+            Op::Given(..) => 0,
+            Op::Return | Op::Exit => -1,
+            Op::Yield => 0,
+            Op::Fail(_) => 0,
+            Op::Throw | Op::Defer => -1,
+            Op::Try(_) | Op::EndTry => 0,
+        }
+    }
+}
+
+/// Where a closure finds each of its captured cells in the enclosing frame
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Capture {
+    Cell(u32),
+    Free(u32),
+}
+
+/// Instructions and the data they refer to
+#[derive(Debug, Default)]
+pub struct Chunk {
+    pub code: Vec<Op>,
+
+    /// the source of each instruction, for error reporting
+    pub source_map: SourceMap,
+    pub constants: Vec<Value>,
+    pub names: Vec<Arc<str>>,
+    pub functions: Vec<Arc<Prototype>>,
+    pub imports: Vec<Import>,
+    pub patterns: Vec<Pattern>,
+
+    /// the names of the arguments given by name, of each call giving some
+    pub named: Vec<Vec<Arc<str>>>,
+    pub structs: Vec<Layout>,
+    pub errors: Vec<(ErrorCode, String)>,
+
+    /// what the instructions looking up names found, see `vm::cache`
+    pub caches: Caches,
+}
+
+/// What the `Struct` instruction makes a struct of, besides the closures of
+/// its methods, and the `Enum` instruction an enum
+#[derive(Debug, Default)]
+pub struct Layout {
+    pub name: String,
+    pub fields: Vec<String>,
+    pub methods: Vec<String>,
+
+    /// of an enum, with their fields, `None` for those without parentheses
+    pub variants: Vec<(String, Option<Vec<String>>)>,
+}
+
+/// Where the instructions of a chunk come from, as runs of consecutive
+/// instructions compiled from the same node. Each span keeps its own source,
+/// so instructions moved into another chunk still point at the file they
+/// were written in; passes that add, remove or move instructions must do the
+/// same to the map.
+#[derive(Debug, Default)]
+pub struct SourceMap {
+    /// the first instruction of each run, and its span
+    runs: Vec<(usize, Option<SourceString>)>,
+
+    /// the number of instructions mapped
+    len: usize,
+}
+
+impl SourceMap {
+    /// map the instruction after the last one mapped, `None` for the ones
+    /// no error is reported at
+    pub fn push(&mut self, span: Option<&SourceString>) {
+        if self.runs.last().map(|(_, s)| s.as_ref()) != Some(span) {
+            self.runs.push((self.len, span.cloned()));
+        }
+        self.len += 1;
+    }
+
+    pub fn span(&self, offset: usize) -> Option<&SourceString> {
+        crate::assert_pre_condition!(offset < self.len);
+        let run = self.runs.partition_point(|(start, _)| *start <= offset);
+        self.runs[run - 1].1.as_ref()
+    }
+
+    /// the span of the instruction, or of the closest one before it that has
+    /// one, for pointing at where the code was rather than at an error
+    pub fn nearest_span(&self, offset: usize) -> Option<&SourceString> {
+        crate::assert_pre_condition!(offset < self.len);
+        let run = self.runs.partition_point(|(start, _)| *start <= offset);
+        self.runs[..run].iter().rev().find_map(|(_, s)| s.as_ref())
+    }
+
+    /// the line and column the instruction comes from
+    pub fn position(&self, offset: usize) -> Option<Position> {
+        self.span(offset).map(|s| s.position())
+    }
+
+    /// the ranges of instructions compiled from the same span, in order
+    pub fn runs(&self) -> impl Iterator<Item = (Range<usize>, Option<&SourceString>)> {
+        let ends = self.runs.iter().skip(1).map(|(start, _)| *start);
+        self.runs
+            .iter()
+            .zip(ends.chain([self.len]))
+            .map(|((start, span), end)| (*start..end, span.as_ref()))
+    }
+
+    pub fn len(&self) -> usize {
+        self.len
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len == 0
+    }
+}
+
+/// A compiled function, closures are created from it at run-time
+#[derive(Debug, Default)]
+pub struct Prototype {
+    pub name: String,
+    pub arity: Arity,
+
+    /// of each parameter, `None` for those destructuring their argument
+    pub parameters: Vec<Option<String>>,
+    pub chunk: Chunk,
+    pub slots: usize,
+    pub cells: usize,
+    pub captures: Vec<Capture>,
+
+    /// calls return an iterator suspended at the start of the function
+    pub generator: bool,
+
+    /// of the declaration, and its documentation, for `:doc` in the REPL
+    pub signature: String,
+    pub doc: String,
+}
+
+pub type Cell = Arc<std::sync::RwLock<Value>>;
+
+/// A function value created by the VM
+#[derive(Debug)]
+pub struct Closure {
+    pub prototype: Arc<Prototype>,
+    pub free: Vec<Cell>,
+}
+
+impl Prototype {
+    /// A listing of the instructions of the function, followed by the ones of
+    /// the functions it creates, in the order of their index. Each
+    /// instruction shows its offset, the line it comes from, `|` when it is
+    /// the previous one, its operands and what they refer to.
+    pub fn disassemble(&self) -> String {
+        let mut out = String::new();
+        self.write_listing(&mut out, &self.name)
+            .expect("strings can always be written to");
+        out
+    }
+
+    /// nested functions are named by the path of their indices, since names
+    /// of lambdas are not unique
+    fn write_listing(&self, out: &mut String, path: &str) -> std::fmt::Result {
+        writeln!(out, "== {} ==", path)?;
+        // as a range, when calls can leave parameters out
+        let arity = &self.arity;
+        let most = arity.required + arity.optional;
+        let arity = match (arity.variadic, arity.optional) {
+            (true, _) => format!("{}..", arity.required),
+            (false, 0) => most.to_string(),
+            (false, _) => format!("{}..={}", arity.required, most),
+        };
+        write!(
+            out,
+            "arity {}, slots {}, cells {}",
+            arity, self.slots, self.cells
+        )?;
+        if !self.captures.is_empty() {
+            let captures: Vec<String> = self
+                .captures
+                .iter()
+                .map(|c| match c {
+                    Capture::Cell(i) => format!("cell {}", i),
+                    Capture::Free(i) => format!("free {}", i),
+                })
+                .collect();
+            write!(out, ", captures {}", captures.join(", "))?;
+        }
+        writeln!(out)?;
+        let chunk = &self.chunk;
+        let mut last_line = None;
+        for offset in 0..chunk.code.len() {
+            let line = chunk.source_map.position(offset).map(|p| p.line);
+            let shown = match line {
+                Some(l) if last_line == Some(l) => "|".to_owned(),
+                Some(l) => l.to_string(),
+                None => "-".to_owned(),
+            };
+            last_line = line.or(last_line);
+            writeln!(
+                out,
+                "{:04} {:>5} {}",
+                offset,
+                shown,
+                chunk.instruction(offset)
+            )?;
+        }
+        if !chunk.constants.is_empty() {
+            writeln!(out, "constants:")?;
+            for (i, c) in chunk.constants.iter().enumerate() {
+                writeln!(out, "{:>4} {}", i, c.repr())?;
+            }
+        }
+        for (i, f) in chunk.functions.iter().enumerate() {
+            writeln!(out)?;
+            f.write_listing(out, &format!("{}/{} {}", path, i, f.name))?;
+        }
+        Ok(())
+    }
+}
+
+impl Chunk {
+    /// The instruction at an offset, with what its operands refer to
+    pub fn instruction(&self, offset: usize) -> String {
+        let op = &self.code[offset];
+        let instruction = format!("{:?}", op);
+        match self.describe(op) {
+            Some(d) => format!("{:<24} ; {}", instruction, d),
+            None => instruction,
+        }
+    }
+
+    /// what the operands of an instruction refer to
+    fn describe(&self, op: &Op) -> Option<String> {
+        let name = |i: &u32| self.names[*i as usize].to_string();
+        Some(match op {
+            Op::Constant(i) => self.constants[*i as usize].repr(),
+            Op::GetGlobal(i)
+            | Op::SetGlobal(i)
+            | Op::DefineGlobal(i, _)
+            | Op::Member(i)
+            | Op::GetField(i)
+            | Op::SetField(i)
+            | Op::Method(i, _) => name(i),
+            Op::Import(i) => self.imports[*i as usize].to_string(),
+            Op::Closure(i) => self.functions[*i as usize].name.clone(),
+            Op::Struct(i, _) | Op::Enum(i, _) => self.structs[*i as usize].name.clone(),
+            Op::Match(p, target) => format!("{} else -> {:04}", self.patterns[*p as usize], target),
+            Op::Destructure(p) => self.patterns[*p as usize].to_string(),
+            Op::CallNamed(_, i) | Op::TailCallNamed(_, i) | Op::SpawnNamed(_, i) => {
+                self.named[*i as usize].join(", ")
+            }
+            Op::Given(_, target) => format!("-> {:04}", target),
+            Op::Fail(i) => {
+                let (code, message) = &self.errors[*i as usize];
+                format!("{}: {}", code, message)
+            }
+            Op::Jump(target)
+            | Op::JumpIfFalse(target)
+            | Op::JumpIfTrue(target)
+            | Op::JumpIfNone(target)
+            | Op::JumpIfNotNone(target)
+            | Op::Iterate(target)
+            | Op::Try(target) => format!("-> {:04}", target),
+            _ => return None,
+        })
+    }
+}
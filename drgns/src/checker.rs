@@ -0,0 +1,963 @@
+//! Static analysis, finds mistakes that don't need the program to run.
+//!
+//! The checker resolves names following the same scoping rules as the
+//! interpreter. Function bodies are checked at the end of the scope they are
+//! declared in, since by the time they can be called everything declared in
+//! that scope is visible to them. The same goes for anonymous functions.
+//!
+//! Tools such as the language server use [`analyze`], which also tells what
+//! each name refers to and which names are visible where.
+
+use std::{
+    collections::{HashMap, HashSet},
+    ops::Range,
+    rc::Rc,
+    sync::Arc,
+};
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    interpreter::{self, builtins::VARIABLES, BUILTINS, MODULES},
+    parser::{
+        walk_enum, walk_expression, walk_statement, walk_struct, Arity, BlockExpression,
+        CatchClause, Declaration, Destructuring, EnumDeclaration, Expression, Field,
+        ForInExpression, FunctionDeclaration, Identifier, InterfaceDeclaration, LitExpression,
+        Literal, MatchArm, MatchExpression, NamedArgument, Pattern, Program, Statement,
+        StructDeclaration, Variant, VariantPattern, Visitor,
+    },
+    source::SourceString,
+};
+
+pub mod types;
+
+#[cfg(test)]
+mod test;
+
+/// Check a program, returns all errors and warnings found
+pub fn check(program: &Program) -> Vec<DragonError> {
+    analyze(program).diagnostics
+}
+
+/// Check a program, keeping what was learned about its names
+pub fn analyze(program: &Program) -> Analysis {
+    let mut checker = Checker::new();
+    (checker.methods, checker.enums) = members(program);
+    checker.visit_program(program);
+    let (type_errors, types) = types::infer(program);
+    checker.diagnostics.extend(type_errors);
+    // function bodies are checked out of order
+    checker
+        .diagnostics
+        .sort_by_key(|d| d.span().map(|s| s.start()));
+    for d in &mut checker.declarations {
+        d.t = types.get(&d.name.span.start()).cloned();
+    }
+    Analysis {
+        diagnostics: checker.diagnostics,
+        declarations: checker.declarations,
+        references: checker.references,
+    }
+}
+
+/// What the checker found in a program, for tools
+#[derive(Debug, Clone)]
+pub struct Analysis {
+    pub diagnostics: Vec<DragonError>,
+
+    /// in the order they are checked, builtins are not included
+    pub declarations: Vec<Declared>,
+
+    /// each use of a name, with the index of the declaration it refers to,
+    /// `None` for builtins
+    pub references: Vec<(SourceString, Option<usize>)>,
+}
+
+/// A name declared by a program
+#[derive(Debug, Clone)]
+pub struct Declared {
+    pub name: Identifier,
+
+    /// the node declaring it, such as the whole function or parameter
+    pub span: SourceString,
+    pub mutable: bool,
+
+    /// functions are visible in their whole scope, other names only after
+    /// their declaration
+    pub function: bool,
+
+    /// the range of chars where the name is visible
+    pub scope: Range<usize>,
+
+    /// the inferred type, if it is known
+    pub t: Option<types::Type>,
+}
+
+impl Analysis {
+    /// the declaration of the name at the position, which is either a use
+    /// of the name or the name in its declaration
+    pub fn definition(&self, i: usize) -> Option<&Declared> {
+        let contains = |s: &SourceString| s.start() <= i && i <= s.end();
+        self.references
+            .iter()
+            .find(|(s, _)| contains(s))
+            .and_then(|(_, d)| d.map(|d| &self.declarations[d]))
+            .or_else(|| self.declarations.iter().find(|d| contains(&d.name.span)))
+    }
+
+    /// the declarations visible at the position, one per name, the
+    /// innermost one if it is shadowed
+    pub fn visible(&self, i: usize) -> Vec<&Declared> {
+        let mut visible: Vec<&Declared> = self
+            .declarations
+            .iter()
+            .filter(|d| d.scope.contains(&i) && (d.function || d.name.span.end() <= i))
+            .collect();
+        // innermost scopes start last, later declarations shadow earlier ones
+        visible.sort_by_key(|d| {
+            (
+                std::cmp::Reverse(d.scope.start),
+                std::cmp::Reverse(d.name.span.start()),
+            )
+        });
+        let mut names = vec![];
+        visible.retain(|d| {
+            let new = !names.contains(&&d.name.name);
+            names.push(&d.name.name);
+            new
+        });
+        visible
+    }
+}
+
+#[derive(Debug, Clone)]
+struct Symbol {
+    mutable: bool,
+
+    /// how it is called, if the name is bound to a known function
+    signature: Option<Signature>,
+
+    /// the index of its declaration, `None` for builtins
+    declaration: Option<usize>,
+}
+
+/// The parameters of a function, as calls give them arguments
+#[derive(Debug, Clone)]
+struct Signature {
+    arity: Arity,
+
+    /// of each parameter, `None` for those without one
+    names: Rc<[Option<String>]>,
+}
+
+impl Signature {
+    fn of(f: &FunctionDeclaration) -> Self {
+        let names = f.parameters.iter().map(|p| p.name().map(str::to_owned));
+        Self {
+            arity: f.arity(),
+            names: names.collect(),
+        }
+    }
+
+    /// structs and the variants of enums are called with their fields
+    fn of_fields(fields: &[Field]) -> Self {
+        Self {
+            arity: Arity::exactly(fields.len()),
+            names: fields.iter().map(|f| Some(f.name.name.clone())).collect(),
+        }
+    }
+
+    fn builtin(arity: usize) -> Self {
+        Self {
+            arity: Arity::exactly(arity),
+            names: vec![None; arity].into(),
+        }
+    }
+}
+
+struct Checker {
+    /// innermost scope last
+    scopes: Vec<HashMap<String, Symbol>>,
+
+    /// the ranges of chars the scopes cover, in the same order
+    extents: Vec<Range<usize>>,
+    diagnostics: Vec<DragonError>,
+
+    /// bodies to check at the end of each sequence of statements
+    deferred: Vec<Vec<Arc<FunctionDeclaration>>>,
+    declarations: Vec<Declared>,
+    references: Vec<(SourceString, Option<usize>)>,
+
+    /// the names of the methods of all structs, enums and interfaces, calls
+    /// to them may go to the struct of the receiver rather than to a function
+    /// in scope
+    methods: HashSet<String>,
+
+    /// the enums declared anywhere in the program by name, with their
+    /// variants, enums of other modules are only known at run time
+    enums: HashMap<String, Arc<EnumDeclaration>>,
+}
+
+/// the names of the methods of the structs, enums and interfaces declared
+/// anywhere in the program, and the enums
+fn members(program: &Program) -> (HashSet<String>, HashMap<String, Arc<EnumDeclaration>>) {
+    #[derive(Default)]
+    struct Members(HashSet<String>, HashMap<String, Arc<EnumDeclaration>>);
+
+    impl Visitor for Members {
+        fn visit_statement(&mut self, s: &Statement) {
+            if let Statement::Enum(e) = s {
+                self.1.insert(e.name.name.clone(), e.clone());
+            }
+            walk_statement(self, s);
+        }
+
+        fn visit_struct(&mut self, s: &StructDeclaration) {
+            self.0.extend(s.methods.iter().map(|m| m.name.name.clone()));
+            walk_struct(self, s);
+        }
+
+        fn visit_enum(&mut self, e: &EnumDeclaration) {
+            self.0.extend(e.methods.iter().map(|m| m.name.name.clone()));
+            walk_enum(self, e);
+        }
+
+        fn visit_interface(&mut self, i: &InterfaceDeclaration) {
+            self.0.extend(i.methods.iter().map(|m| m.name.name.clone()));
+        }
+    }
+
+    let mut members = Members::default();
+    members.visit_program(program);
+    (members.0, members.1)
+}
+
+impl Checker {
+    fn new() -> Self {
+        let builtins = BUILTINS
+            .iter()
+            .map(|b| {
+                let symbol = Symbol {
+                    mutable: false,
+                    signature: b.arity.map(Signature::builtin),
+                    declaration: None,
+                };
+                (b.name.to_owned(), symbol)
+            })
+            .chain(
+                MODULES
+                    .iter()
+                    .map(|(name, ..)| *name)
+                    .chain(VARIABLES.iter().copied())
+                    .map(|name| {
+                        let symbol = Symbol {
+                            mutable: false,
+                            signature: None,
+                            declaration: None,
+                        };
+                        (name.to_string(), symbol)
+                    }),
+            )
+            .collect();
+        Self {
+            scopes: vec![builtins],
+            // builtins are visible everywhere
+            extents: vec![Range {
+                start: 0,
+                end: usize::MAX,
+            }],
+            diagnostics: vec![],
+            deferred: vec![],
+            declarations: vec![],
+            references: vec![],
+            methods: HashSet::new(),
+            enums: HashMap::new(),
+        }
+    }
+
+    fn enter(&mut self, extent: &SourceString) {
+        self.scopes.push(HashMap::new());
+        self.extents.push(extent.start()..extent.end());
+    }
+
+    fn leave(&mut self) {
+        self.scopes.pop();
+        self.extents.pop();
+    }
+
+    fn error(&mut self, code: ErrorCode, msg: String, span: &SourceString) {
+        self.report(DragonError::new(code, msg, Some(span.clone())));
+    }
+
+    fn report(&mut self, e: DragonError) {
+        self.diagnostics.push(e);
+    }
+
+    /// the visible name most similar to the given one, if any is close enough
+    fn similar_name(&self, name: &str) -> Option<&str> {
+        let max_distance = (name.chars().count() / 3).max(1);
+        self.scopes
+            .iter()
+            .flat_map(|s| s.keys())
+            .map(|k| (k, strsim::levenshtein(name, k)))
+            .filter(|&(_, d)| d <= max_distance && d < name.chars().count())
+            .min_by_key(|&(_, d)| d)
+            .map(|(k, _)| k.as_str())
+    }
+
+    fn lookup(&self, name: &str) -> Option<&Symbol> {
+        self.scopes.iter().rev().find_map(|s| s.get(name))
+    }
+
+    /// declare a name in the current scope, `node` is what declares it
+    fn declare(
+        &mut self,
+        name: &Identifier,
+        node: &SourceString,
+        mutable: bool,
+        signature: Option<Signature>,
+    ) {
+        let declaration = self.declarations.len();
+        self.declarations.push(Declared {
+            name: name.clone(),
+            span: node.clone(),
+            mutable,
+            // only function statements know their arity
+            function: signature.is_some(),
+            scope: self
+                .extents
+                .last()
+                .expect("there is always a scope")
+                .clone(),
+            t: None,
+        });
+        let scope = self.scopes.last_mut().expect("there is always a scope");
+        let previous = scope.insert(
+            name.name.clone(),
+            Symbol {
+                mutable,
+                signature,
+                declaration: Some(declaration),
+            },
+        );
+        // shadowing builtins is fine, they live in their own scope
+        if let Some(Symbol {
+            declaration: Some(previous),
+            mutable,
+            ..
+        }) = previous
+        {
+            let previous = self.declarations[previous].name.span.clone();
+            let hint = if mutable {
+                "use `=` to assign a new value to it"
+            } else {
+                "declare it with `mut` and use `=` to assign a new value to it"
+            };
+            self.report(
+                DragonError::new(
+                    ErrorCode::DuplicateDeclaration,
+                    format!(
+                        "'{}' is already declared in this scope, at {}",
+                        name.name,
+                        previous.position()
+                    ),
+                    Some(name.span.clone()),
+                )
+                .with_hint(hint),
+            );
+        }
+    }
+
+    fn resolve(&mut self, name: &Identifier) -> Option<Symbol> {
+        let symbol = self.lookup(&name.name).cloned();
+        if let Some(s) = &symbol {
+            self.references.push((name.span.clone(), s.declaration));
+        } else {
+            let mut e = DragonError::new(
+                ErrorCode::UndefinedVariable,
+                format!("undefined variable '{}'", name.name),
+                Some(name.span.clone()),
+            );
+            if let Some(similar) = self.similar_name(&name.name) {
+                e = e.with_hint(format!("did you mean '{}'?", similar));
+            }
+            self.report(e);
+        }
+        symbol
+    }
+
+    /// report calls the parameters of the function can't take, as calling it
+    /// would
+    fn check_call(
+        &mut self,
+        name: &Identifier,
+        found: usize,
+        named: &[NamedArgument],
+        span: &SourceString,
+    ) {
+        let Some(signature) = self.lookup(&name.name).and_then(|s| s.signature.clone()) else {
+            return;
+        };
+        self.check_arguments(&name.name, &signature, found, named, span);
+    }
+
+    fn check_arguments(
+        &mut self,
+        name: &str,
+        signature: &Signature,
+        found: usize,
+        named: &[NamedArgument],
+        span: &SourceString,
+    ) {
+        let named = named
+            .iter()
+            .map(|n| (Arc::from(n.name.name.as_str()), ()))
+            .collect();
+        let names = |i: usize| signature.names.get(i).and_then(|n| n.as_deref());
+        let bound = interpreter::bind(name, signature.arity, vec![(); found], named, names);
+        if let Err(msg) = bound {
+            self.error(ErrorCode::ArityMismatch, msg, span);
+        }
+    }
+
+    /// check a sequence of statements in the current scope
+    fn statements(&mut self, statements: &[Statement]) {
+        let mut diverged = false;
+        let mut warned = false;
+        self.deferred.push(vec![]);
+        for s in statements {
+            // only warn once per sequence
+            if diverged && !warned {
+                self.report(
+                    DragonError::new(
+                        ErrorCode::UnreachableCode,
+                        "unreachable code".to_string(),
+                        Some(s.span()),
+                    )
+                    .into_warning(),
+                );
+                warned = true;
+            }
+            match s {
+                Statement::Function(f) => {
+                    self.declare(&f.name, &f.span, false, Some(Signature::of(f)));
+                    self.defer(f);
+                }
+                // called like a function taking the fields
+                Statement::Struct(s) => {
+                    self.declare(
+                        &s.name,
+                        &s.span,
+                        false,
+                        Some(Signature::of_fields(&s.fields)),
+                    );
+                    self.check_fields(&s.fields, &s.name.name);
+                    for m in &s.methods {
+                        self.defer(m);
+                    }
+                }
+                Statement::Enum(e) => {
+                    self.declare(&e.name, &e.span, false, None);
+                    self.check_variants(e);
+                    for m in &e.methods {
+                        self.defer(m);
+                    }
+                }
+                // a type, not a value, the inference knows its name
+                Statement::Interface(i) => self.check_signatures(i),
+                s => self.visit_statement(s),
+            }
+            diverged |= diverges(s);
+        }
+        for f in self.deferred.pop().expect("pushed above") {
+            self.visit_function(&f);
+        }
+    }
+
+    /// the fields of a struct or of a variant, `of` is its name
+    fn check_fields(&mut self, fields: &[Field], of: &str) {
+        for (i, field) in fields.iter().enumerate() {
+            if let Some(t) = &field.type_annotation {
+                self.visit_type(t);
+            }
+            let name = &field.name;
+            let Some(previous) = fields[..i].iter().find(|f| f.name.name == name.name) else {
+                continue;
+            };
+            let msg = format!(
+                "'{}' is already a field of {}, at {}",
+                name.name,
+                of,
+                previous.name.span.position()
+            );
+            self.error(ErrorCode::DuplicateDeclaration, msg, &name.span);
+        }
+    }
+
+    fn check_variants(&mut self, e: &EnumDeclaration) {
+        for (i, variant) in e.variants.iter().enumerate() {
+            let name = &variant.name;
+            let of = format!("{}::{}", e.name.name, name.name);
+            self.check_fields(variant.fields.as_deref().unwrap_or_default(), &of);
+            let Some(previous) = e.variants[..i].iter().find(|v| v.name.name == name.name) else {
+                continue;
+            };
+            let msg = format!(
+                "'{}' is already a variant of {}, at {}",
+                name.name,
+                e.name.name,
+                previous.name.span.position()
+            );
+            self.error(ErrorCode::DuplicateDeclaration, msg, &name.span);
+        }
+    }
+
+    fn check_signatures(&mut self, i: &InterfaceDeclaration) {
+        for (n, method) in i.methods.iter().enumerate() {
+            let name = &method.name;
+            let Some(previous) = i.methods[..n].iter().find(|m| m.name.name == name.name) else {
+                continue;
+            };
+            let msg = format!(
+                "'{}' is already a method of {}, at {}",
+                name.name,
+                i.name.name,
+                previous.name.span.position()
+            );
+            self.error(ErrorCode::DuplicateDeclaration, msg, &name.span);
+        }
+    }
+
+    /// the variant `Enum::Variant` names, if it is one of an enum of the
+    /// program, reporting it if the enum has no such variant
+    fn variant(&mut self, path: &[Identifier]) -> Option<&Variant> {
+        let [e, name] = path else {
+            return None;
+        };
+        let declared = self.enums.get(&e.name)?.clone();
+        let found = declared
+            .variants
+            .iter()
+            .position(|v| v.name.name == name.name);
+        if found.is_none() {
+            let variants: Vec<&str> = declared
+                .variants
+                .iter()
+                .map(|v| v.name.name.as_str())
+                .collect();
+            self.report(
+                DragonError::new(
+                    ErrorCode::UnknownField,
+                    format!("enum {} has no variant '{}'", e.name, name.name),
+                    Some(name.span.clone()),
+                )
+                .with_hint(format!("its variants are {}", variants.join(", "))),
+            );
+        }
+        let declared = self.enums.get(&e.name)?;
+        Some(&declared.variants[found?])
+    }
+
+    /// resolve the enums the variant patterns name, and report the variants
+    /// they can't match
+    fn check_pattern(&mut self, p: &Pattern) {
+        match p {
+            Pattern::List(l) => l.items.iter().for_each(|p| self.check_pattern(p)),
+            Pattern::Map(m) => m.entries.iter().for_each(|(_, p)| self.check_pattern(p)),
+            Pattern::Variant(v) => {
+                self.resolve(&v.path[0]);
+                let declared = self
+                    .variant(&v.path)
+                    .map(|d| d.fields.as_ref().map(Vec::len));
+                match (declared, &v.fields) {
+                    (Some(None), Some(_)) => {
+                        let msg = format!("{} has no fields, remove the parentheses", v.name());
+                        self.error(ErrorCode::ArityMismatch, msg, &v.span);
+                    }
+                    (Some(Some(n)), Some(fields)) if fields.len() != n => {
+                        let plural = if n == 1 { "" } else { "s" };
+                        let msg = format!(
+                            "{} has {} field{}, the pattern has {}",
+                            v.name(),
+                            n,
+                            plural,
+                            fields.len()
+                        );
+                        self.error(ErrorCode::ArityMismatch, msg, &v.span);
+                    }
+                    _ => {}
+                }
+                v.fields
+                    .iter()
+                    .flatten()
+                    .for_each(|p| self.check_pattern(p));
+            }
+            Pattern::Wildcard(_) | Pattern::Literal(_) | Pattern::Binding(_) => {}
+        }
+    }
+
+    fn defer(&mut self, f: &Arc<FunctionDeclaration>) {
+        match self.deferred.last_mut() {
+            Some(functions) => functions.push(f.clone()),
+            None => self.visit_function(f),
+        }
+    }
+
+    /// warn about arms that are never taken, because an earlier arm matches
+    /// everything they match, and about matches that may not handle every
+    /// value, unless they have an arm for anything, for both booleans or for
+    /// every variant of an enum
+    fn check_arms(&mut self, m: &MatchExpression) {
+        let mut unguarded: Vec<&MatchArm> = vec![];
+        for arm in &m.arms {
+            if let Some(earlier) = unguarded.iter().find(|a| covers(&a.pattern, &arm.pattern)) {
+                self.report(
+                    DragonError::new(
+                        ErrorCode::UnreachableCode,
+                        "unreachable match arm".to_string(),
+                        Some(arm.span.clone()),
+                    )
+                    .with_hint(format!(
+                        "the arm at {} matches every value this one does",
+                        earlier.span.position()
+                    ))
+                    .into_warning(),
+                );
+            }
+            if arm.guard.is_none() {
+                unguarded.push(arm);
+            }
+        }
+        let handles = |b: bool| {
+            unguarded.iter().any(|a| {
+                matches!(
+                    a.pattern,
+                    Pattern::Literal(LitExpression {
+                        value: Literal::Bool(x),
+                        ..
+                    }) if x == b
+                )
+            })
+        };
+        let exhaustive = unguarded.iter().any(|a| a.pattern.is_irrefutable())
+            || (handles(true) && handles(false));
+        if exhaustive {
+            return;
+        }
+        // the variants of the enum the arms match, and those they handle all
+        // values of
+        let variants: Vec<&VariantPattern> = m
+            .arms
+            .iter()
+            .filter_map(|a| match &a.pattern {
+                Pattern::Variant(v) if v.path.len() == 2 => Some(v),
+                _ => None,
+            })
+            .collect();
+        let handled: Vec<&VariantPattern> = unguarded
+            .iter()
+            .filter_map(|a| match &a.pattern {
+                Pattern::Variant(v) if v.fields.iter().flatten().all(Pattern::is_irrefutable) => {
+                    Some(v)
+                }
+                _ => None,
+            })
+            .collect();
+        let declared = variants
+            .first()
+            .filter(|v| variants.iter().all(|o| o.path[0].name == v.path[0].name))
+            .and_then(|v| self.enums.get(&v.path[0].name))
+            .cloned();
+        if let Some(e) = declared {
+            let missing: Vec<String> = e
+                .variants
+                .iter()
+                .map(|v| format!("{}::{}", e.name.name, v.name.name))
+                .filter(|name| !handled.iter().any(|h| h.variant() == *name))
+                .collect();
+            if !missing.is_empty() {
+                self.report(
+                    DragonError::new(
+                        ErrorCode::NonExhaustiveMatch,
+                        format!("match does not handle {}", missing.join(", ")),
+                        Some(m.span.clone()),
+                    )
+                    .with_hint("add an arm for each, or a `_ -> ...` arm for the other values")
+                    .into_warning(),
+                );
+            }
+        } else {
+            self.report(
+                DragonError::new(
+                    ErrorCode::NonExhaustiveMatch,
+                    "match may not handle every value".to_string(),
+                    Some(m.span.clone()),
+                )
+                .with_hint("add a `_ -> ...` arm for the other values")
+                .into_warning(),
+            );
+        }
+    }
+}
+
+/// whether every value matching the specific pattern also matches the
+/// general one
+fn covers(general: &Pattern, specific: &Pattern) -> bool {
+    let all = |general: &[Pattern], specific: &[Pattern]| {
+        general.iter().zip(specific).all(|(g, s)| covers(g, s))
+    };
+    // the items after the rest are compared from the end
+    let all_rev = |general: &[Pattern], specific: &[Pattern]| {
+        general
+            .iter()
+            .rev()
+            .zip(specific.iter().rev())
+            .all(|(g, s)| covers(g, s))
+    };
+    match (general, specific) {
+        (g, _) if g.is_irrefutable() => true,
+        (Pattern::Literal(g), Pattern::Literal(s)) => g.value == s.value,
+        (Pattern::List(g), Pattern::List(s)) => {
+            let ((g_before, g_after), (s_before, s_after)) = (g.split(), s.split());
+            match (&g.rest, &s.rest) {
+                (None, None) => g.items.len() == s.items.len() && all(&g.items, &s.items),
+                (None, Some(_)) => false,
+                (Some(_), None) => {
+                    s.items.len() >= g.items.len()
+                        && all(g_before, &s.items)
+                        && all_rev(g_after, &s.items)
+                }
+                (Some(_), Some(_)) => {
+                    g_before.len() <= s_before.len()
+                        && g_after.len() <= s_after.len()
+                        && all(g_before, s_before)
+                        && all_rev(g_after, s_after)
+                }
+            }
+        }
+        (Pattern::Map(g), Pattern::Map(s)) => g.entries.iter().all(|(key, g)| {
+            s.entries
+                .iter()
+                .any(|(k, s)| k.value == key.value && covers(g, s))
+        }),
+        (Pattern::Variant(g), Pattern::Variant(s)) if g.variant() == s.variant() => {
+            match (&g.fields, &s.fields) {
+                (None, _) => true,
+                (Some(g), None) => g.iter().all(Pattern::is_irrefutable),
+                (Some(g), Some(s)) => g.len() == s.len() && all(g, s),
+            }
+        }
+        _ => false,
+    }
+}
+
+/// whether control never reaches the statement after this one
+fn diverges(s: &Statement) -> bool {
+    matches!(
+        s,
+        Statement::Return(_)
+            | Statement::Break(_)
+            | Statement::Continue(_)
+            | Statement::Exit(_)
+            | Statement::Throw(_)
+    )
+}
+
+impl Visitor for Checker {
+    fn visit_program(&mut self, p: &Program) {
+        self.scopes.push(HashMap::new());
+        self.extents.push(0..p.source.len() + 1);
+        self.statements(&p.statements);
+        self.leave();
+    }
+
+    fn visit_block(&mut self, b: &BlockExpression) {
+        self.enter(&b.span);
+        self.statements(&b.statements);
+        self.leave();
+    }
+
+    /// the error is only visible in the body of the `catch`
+    fn visit_catch(&mut self, c: &CatchClause) {
+        self.enter(&c.body.span);
+        if let Some(name) = &c.name {
+            self.declare(name, &name.span, false, None);
+        }
+        self.visit_block(&c.body);
+        self.leave();
+    }
+
+    /// the item is only visible in the body of the loop
+    fn visit_for_in(&mut self, f: &ForInExpression) {
+        self.visit_expression(&f.iterable);
+        self.check_pattern(&f.binding);
+        self.enter(&f.body.span);
+        for b in f.binding.bindings() {
+            self.declare(b, &b.span, false, None);
+        }
+        self.visit_block(&f.body);
+        self.leave();
+    }
+
+    /// the bindings are only visible in the guard and the value of the arm,
+    /// so functions created there are checked before leaving it
+    fn visit_match_arm(&mut self, a: &MatchArm) {
+        self.check_pattern(&a.pattern);
+        self.enter(&a.span);
+        for b in a.pattern.bindings() {
+            self.declare(b, &b.span, false, None);
+        }
+        self.deferred.push(vec![]);
+        if let Some(g) = &a.guard {
+            self.visit_expression(g);
+        }
+        self.visit_expression(&a.body);
+        for f in self.deferred.pop().expect("pushed above") {
+            self.visit_function(&f);
+        }
+        self.leave();
+    }
+
+    fn visit_statement(&mut self, s: &Statement) {
+        match s {
+            Statement::Import(i) => return self.declare(i.name(), &i.span, false, None),
+            // checked like a lambda, once the names of the block are known
+            Statement::Defer(d) => return self.defer(&d.function),
+            _ => {}
+        }
+        let Statement::Assignment(a) = s else {
+            return walk_statement(self, s);
+        };
+        self.visit_expression(&a.value);
+        let Expression::Variable(target) = &a.target else {
+            return self.visit_expression(&a.target);
+        };
+        if let Some(symbol) = self.resolve(target) {
+            if !symbol.mutable && symbol.declaration.is_some() {
+                self.report(
+                    DragonError::new(
+                        ErrorCode::ImmutableAssignment,
+                        format!(
+                            "cannot assign twice to immutable variable '{}'",
+                            target.name
+                        ),
+                        Some(target.span.clone()),
+                    )
+                    .with_hint(format!("declare it with `mut {} := ...`", target.name)),
+                );
+            }
+        }
+    }
+
+    fn visit_declaration(&mut self, d: &Declaration) {
+        if let Some(t) = &d.type_annotation {
+            self.visit_type(t);
+        }
+        self.visit_expression(&d.value);
+        self.declare(&d.name, &d.span, d.mutable, None);
+    }
+
+    fn visit_destructuring(&mut self, d: &Destructuring) {
+        if let Some(t) = &d.type_annotation {
+            self.visit_type(t);
+        }
+        self.visit_expression(&d.value);
+        self.check_pattern(&d.pattern);
+        for b in d.pattern.bindings() {
+            self.declare(b, &d.span, d.mutable, None);
+        }
+    }
+
+    /// the name is declared by the enclosing scope, this only checks the body
+    fn visit_function(&mut self, f: &FunctionDeclaration) {
+        self.enter(&f.span);
+        // defaults see the parameters before them
+        for p in &f.parameters {
+            if let Some(d) = &p.default {
+                self.visit_expression(d);
+            }
+            self.check_pattern(&p.pattern);
+            for b in p.pattern.bindings() {
+                self.declare(b, &p.span, p.mutable, None);
+            }
+        }
+        self.visit_block(&f.body);
+        self.leave();
+    }
+
+    fn visit_expression(&mut self, e: &Expression) {
+        match e {
+            Expression::Variable(i) => {
+                self.resolve(i);
+            }
+            Expression::Call(c) => {
+                match c.callee.as_ref() {
+                    Expression::Variable(callee) => {
+                        self.check_call(callee, c.arguments.len(), &c.named, &c.span)
+                    }
+                    Expression::Member(m) => {
+                        self.visit_expression(&m.module);
+                        let fields = match m.module.as_ref() {
+                            Expression::Variable(e) => self
+                                .variant(&[e.clone(), m.name.clone()])
+                                .map(|v| (v.fields.clone(), format!("{}::{}", e.name, v.name))),
+                            _ => None,
+                        };
+                        if let Some((Some(fields), name)) = fields {
+                            let signature = Signature::of_fields(&fields);
+                            self.check_arguments(
+                                &name,
+                                &signature,
+                                c.arguments.len(),
+                                &c.named,
+                                &c.span,
+                            );
+                        }
+                        for a in &c.arguments {
+                            self.visit_expression(a);
+                        }
+                        for n in &c.named {
+                            self.visit_expression(&n.value);
+                        }
+                        return;
+                    }
+                    _ => {}
+                }
+                walk_expression(self, e);
+            }
+            // the receiver may be an instance with such a method, which are
+            // only known at run time
+            Expression::Method(m) if self.methods.contains(&m.name.name) => {
+                if let Some(s) = self.lookup(&m.name.name) {
+                    self.references.push((m.name.span.clone(), s.declaration));
+                }
+                walk_expression(self, e);
+            }
+            Expression::Method(m) => {
+                if self.resolve(&m.name).is_some() {
+                    self.check_call(&m.name, m.arguments.len() + 1, &m.named, &m.span);
+                }
+                self.visit_expression(&m.receiver);
+                for a in &m.arguments {
+                    self.visit_expression(a);
+                }
+                for n in &m.named {
+                    self.visit_expression(&n.value);
+                }
+            }
+            Expression::Lambda(l) => self.defer(&l.function),
+            // exports are only known once the module is loaded, variants of
+            // enums are known
+            Expression::Member(m) => {
+                self.visit_expression(&m.module);
+                if let Expression::Variable(e) = m.module.as_ref() {
+                    self.variant(&[e.clone(), m.name.clone()]);
+                }
+            }
+            Expression::Match(m) => {
+                self.check_arms(m);
+                walk_expression(self, e);
+            }
+            e => walk_expression(self, e),
+        }
+    }
+}
@@ -0,0 +1,479 @@
+use std::sync::Arc;
+
+use crate::{parser::parse, source::Source};
+
+use super::{analyze, check};
+
+/// the messages of all diagnostics, warnings are prefixed with "warning: "
+fn diagnostics(s: &str) -> Vec<String> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    check(&program)
+        .iter()
+        .map(|d| match d.is_warning() {
+            true => format!("warning: {}", d.message()),
+            false => d.message().to_string(),
+        })
+        .collect()
+}
+
+#[test]
+fn check_valid_programs() {
+    let empty: Vec<String> = vec![];
+    assert_eq!(diagnostics("x := 1\nprint(x)"), empty);
+    assert_eq!(diagnostics("mut x := 1\nx += 1"), empty);
+    assert_eq!(diagnostics("x := 1\n{ x := 2 }"), empty);
+    assert_eq!(diagnostics("print := 1"), empty);
+    assert_eq!(diagnostics("function f(n) -> { n.f() }"), empty);
+    // functions can use anything declared in the same scope
+    assert_eq!(
+        diagnostics("function f() -> { g() }\nfunction g() -> { y }\ny := 1"),
+        empty
+    );
+}
+
+#[test]
+fn check_undefined_variables() {
+    assert_eq!(diagnostics("x + 1"), vec!["undefined variable 'x'"]);
+    assert_eq!(diagnostics("{ x := 1 }\nx"), vec!["undefined variable 'x'"]);
+    assert_eq!(diagnostics("x = 1"), vec!["undefined variable 'x'"]);
+    assert_eq!(diagnostics("x := x"), vec!["undefined variable 'x'"]);
+    assert_eq!(diagnostics("1.f()"), vec!["undefined variable 'f'"]);
+    assert_eq!(
+        diagnostics("function f(a) -> { b }"),
+        vec!["undefined variable 'b'"]
+    );
+    // the error is only visible inside the catch
+    assert_eq!(
+        diagnostics("try { } catch e { e }\ne"),
+        vec!["undefined variable 'e'"]
+    );
+}
+
+#[test]
+fn check_arity() {
+    assert_eq!(
+        diagnostics("function f(a, b) -> { }\nf(1)"),
+        vec!["function 'f' expects 2 arguments, found 1"]
+    );
+    assert_eq!(
+        diagnostics("function f(a) -> { }\n1.f(2)"),
+        vec!["function 'f' expects 1 argument, found 2"]
+    );
+}
+
+#[test]
+fn check_declarations() {
+    assert_eq!(
+        diagnostics("x := 1\nx := 2"),
+        vec!["'x' is already declared in this scope, at 1:1"]
+    );
+    assert_eq!(
+        diagnostics("function f() -> { }\nf := 1"),
+        vec!["'f' is already declared in this scope, at 1:10"]
+    );
+    assert_eq!(
+        diagnostics("x := 1\nx = 2"),
+        vec!["cannot assign twice to immutable variable 'x'"]
+    );
+}
+
+#[test]
+fn check_unreachable_code() {
+    assert_eq!(
+        diagnostics("function f() -> { return 1\n2\n3 }"),
+        vec!["warning: unreachable code"]
+    );
+    assert_eq!(
+        diagnostics("for { break\nprint(1) }"),
+        vec!["warning: unreachable code"]
+    );
+    assert_eq!(
+        diagnostics("exit 0\nprint(1)"),
+        vec!["warning: unreachable code"]
+    );
+}
+
+#[test]
+fn check_match() {
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        diagnostics("x := 1\nmatch x { [a, ..] -> a, n if n > 0 -> n, _ -> x }"),
+        empty
+    );
+    assert_eq!(diagnostics("match true { true -> 1, false -> 0 }"), empty);
+    // the bindings are only visible in their arm
+    assert_eq!(
+        diagnostics("match 1 { n -> () -> n }\nn"),
+        vec!["undefined variable 'n'"]
+    );
+    assert_eq!(
+        diagnostics("match 1 { _ -> 1, 2 -> 2 }"),
+        vec!["warning: unreachable match arm"]
+    );
+    assert_eq!(
+        diagnostics("match [] { [1, ..] -> 1, [1, 2] -> 2, {\"a\": 1} -> 3, {\"a\": 1, ^b: 2} -> 4, _ -> 5 }"),
+        vec![
+            "warning: unreachable match arm",
+            "warning: unreachable match arm"
+        ]
+    );
+    assert_eq!(
+        diagnostics("match 1 { 1 -> 1, n if n > 1 -> n }"),
+        vec!["warning: match may not handle every value"]
+    );
+}
+
+#[test]
+fn check_destructuring() {
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        diagnostics(
+            "[a, ..b] := [1]\nfunction f({k}, [x]) -> { k + x }\nfor [y] in [[a]] { f(b, y) }"
+        ),
+        empty
+    );
+    assert_eq!(
+        diagnostics("[a, a] := [1, 2]\n{k} := {}\nk = 1"),
+        vec![
+            "'a' is already declared in this scope, at 1:2",
+            "cannot assign twice to immutable variable 'k'"
+        ]
+    );
+    // on the types annotated, and those inferred from them
+    assert_eq!(
+        diagnostics(concat!(
+            "n: int = 1\n[a] := n\n",
+            "function f({k}: list[int], [1.5]: list[int]) -> { k }\n",
+            "for [c] in \"text\" { c }"
+        )),
+        vec![
+            "cannot destructure int with a list pattern",
+            "cannot destructure list[int] with a map pattern",
+            "1.5 never matches a value of type int",
+            "cannot destructure string with a list pattern"
+        ]
+    );
+}
+
+#[test]
+fn check_parameters() {
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        diagnostics(concat!(
+            "function f(a, b = a, ..rest) -> { [a, b, rest] }\n",
+            "f(1)\nf(1, 2, 3, 4)\nf(b = 2, a = 1)\n",
+            "struct P { x, y }\nP(y = 1, x = 2)"
+        )),
+        empty
+    );
+    assert_eq!(
+        diagnostics(concat!(
+            "function f(a, b = 1) -> { a }\n",
+            "f()\nf(1, 2, 3)\nf(1, a = 2)\nf(c = 1)\nf(b = 1)\n",
+            "function g(..xs) -> { xs }\ng(xs = 1)"
+        )),
+        vec![
+            "function 'f' expects 1 to 2 arguments, found 0",
+            "function 'f' expects 1 to 2 arguments, found 3",
+            "argument 'a' of function 'f' is given twice",
+            "function 'f' has no parameter named 'c'",
+            "function 'f' is missing the argument 'a'",
+            "'xs' of function 'g' is variadic, it cannot be given by name"
+        ]
+    );
+    // defaults are checked against the annotation, and the variadic
+    // parameter is a list of it
+    assert_eq!(
+        diagnostics("function f(n: int = \"one\", ..xs: int) -> { xs + 1 }"),
+        vec![
+            "expected int, found string",
+            "unsupported operand types for +: list[int] and int"
+        ]
+    );
+}
+
+#[test]
+fn check_null_safety() {
+    // the types are narrowed to the values that are not `none`
+    assert_eq!(
+        diagnostics(concat!(
+            "struct P { x: int }\n",
+            "function f(p: P | none, n: int | none) -> {\n",
+            "  a: int = n ?? 0\n  b: int = p?.x ?? 0\n  c: none = none?.x\n",
+            "  d: int = n\n  e: int = p?.x\n  p?.y\n}"
+        )),
+        vec![
+            "expected int, found int | none",
+            "expected int, found int | none",
+            "P has no field 'y'"
+        ]
+    );
+}
+
+#[test]
+fn check_enums() {
+    let shape = "enum Shape { Circle(r: float), Rect(w, h), Dot }\n";
+    let with_shape = |src: &str| diagnostics(&format!("{}{}", shape, src));
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        with_shape(concat!(
+            "function area(s) -> {\n  match s {\n",
+            "    Shape::Circle(r) -> 3.14 * r * r\n    Shape::Rect(w, h) -> w * h\n",
+            "    Shape::Dot -> 0\n  }\n}\n",
+            "s: Shape = Shape::Rect(1, 2)\narea(Shape::Circle(r = 1.0))"
+        )),
+        empty
+    );
+    // the arms of a match must handle every variant, unless they have one
+    // for anything
+    assert_eq!(
+        with_shape(concat!(
+            "s := Shape::Dot\n",
+            "match s { Shape::Circle(_) -> 1\nShape::Rect(1, h) -> h\nShape::Dot if true -> 0 }\n",
+            "match s { Shape::Circle -> 1\nShape::Circle(r) -> r\n_ -> 0 }"
+        )),
+        vec![
+            "warning: match does not handle Shape::Rect, Shape::Dot",
+            "warning: unreachable match arm"
+        ]
+    );
+    assert_eq!(
+        with_shape(concat!(
+            "Shape::Square\nShape::Rect(1)\n",
+            "match Shape::Dot { Shape::Circle(a, b) -> a\nShape::Dot(x) -> x\n_ -> 0 }\n",
+            "c: float = Shape::Circle(\"big\")\nn: int = Shape::Dot"
+        )),
+        vec![
+            "enum Shape has no variant 'Square'",
+            "function 'Shape::Rect' expects 2 arguments, found 1",
+            "Shape::Circle has 1 field, the pattern has 2",
+            "Shape::Dot has no fields, remove the parentheses",
+            "expected float, found Shape",
+            "expected float, found string",
+            "expected int, found Shape"
+        ]
+    );
+    assert_eq!(
+        diagnostics("enum E { A(x, x), B, B }"),
+        vec![
+            "'x' is already a field of E::A, at 1:12",
+            "'B' is already a variant of E, at 1:19"
+        ]
+    );
+}
+
+#[test]
+fn check_interfaces() {
+    let shapes = concat!(
+        "interface Shape {\n  function area(self) -> float\n",
+        "  function scaled(self, by: float) -> Shape\n}\n",
+        "struct Circle {\n  r: float\n  function area(self) -> float { 3.14 * self.r * self.r }\n",
+        "  function scaled(self, by: float) -> Circle { Circle(self.r * by) }\n}\n",
+        "function describe(s: Shape) -> string { \"${s.scaled(2.0).area()}\" }\n",
+    );
+    let with_shapes = |src: &str| diagnostics(&format!("{}{}", shapes, src));
+    let empty: Vec<String> = vec![];
+    // structs and enums have the methods of an interface without saying so,
+    // and so do other interfaces requiring them
+    assert_eq!(
+        with_shapes(concat!(
+            "interface Round { function area(self) -> float\nfunction scaled(self, by: float) -> Round }\n",
+            "function round(r: Round) -> Shape { r }\n",
+            "describe(Circle(1.0))\nshapes: list[Shape] = [Circle(1.0), Circle(2.0)]"
+        )),
+        empty
+    );
+    assert_eq!(
+        with_shapes(concat!(
+            "struct Square {\n  side: float\n  function area(self) -> string { \"big\" }\n}\n",
+            "struct Point { x, y }\n",
+            "describe(Square(2.0))\ndescribe(Point(1, 2))\ndescribe(3)\n",
+            "function radius(s: Shape) -> { s.r }"
+        )),
+        vec![
+            "expected Shape, found Square",
+            "expected Shape, found Point",
+            "expected Shape, found int",
+            "Shape has no field 'r'"
+        ]
+    );
+    assert_eq!(
+        with_shapes(
+            "interface Shape {}\ninterface I { function f(self)\nfunction f(self) }\nx: Sized = 1"
+        ),
+        vec![
+            "'Shape' is already declared in this scope, at 1:11",
+            "'f' is already a method of I, at 12:24",
+            "unknown type 'Sized'"
+        ]
+    );
+}
+
+#[test]
+fn check_hints() {
+    let src = Arc::new(Source::from_string("length := 1\nlenght".to_string()));
+    let diagnostics = check(&parse(&src).0);
+    assert_eq!(diagnostics[0].hint(), Some("did you mean 'length'?"));
+}
+
+#[test]
+fn check_reports_all_errors() {
+    assert_eq!(diagnostics("a\nb\nc").len(), 3);
+}
+
+#[test]
+fn check_types() {
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        diagnostics("x: int | none = 1\ny: float = 2\nz: list[int] = []"),
+        empty
+    );
+    assert_eq!(
+        diagnostics("x: int = \"a\""),
+        vec!["expected int, found string"]
+    );
+    assert_eq!(
+        diagnostics("function f(a: int) -> string { \"a\" }\nf(1.5)"),
+        vec!["expected int, found float"]
+    );
+    assert_eq!(
+        diagnostics("function f() -> int { return none }"),
+        vec!["expected int, found none"]
+    );
+    assert_eq!(
+        diagnostics("x := 1 + \"a\"\nfor c in 1 { }"),
+        vec![
+            "unsupported operand types for +: int and string",
+            "cannot iterate over int"
+        ]
+    );
+    assert_eq!(diagnostics("x: pair = 1"), vec!["unknown type 'pair'"]);
+    assert_eq!(
+        diagnostics(
+            "b: bytes = b\"ab\"\nn: int = b[0]\nc: bytes = b[1:] ++ b\nfor i in b { i + 1 }"
+        ),
+        empty
+    );
+    assert_eq!(
+        diagnostics("b := b\"ab\"\nb ++ \"c\"\ns: string = b[0]\nb < \"a\""),
+        vec![
+            "unsupported operand types for ++: bytes and string",
+            "expected string, found int",
+            "cannot compare bytes with string"
+        ]
+    );
+    // functions are iterators
+    assert!(diagnostics("function f() -> { ^done }\nfor x in f { }").is_empty());
+}
+
+#[test]
+fn check_structs() {
+    let point = "struct Point {\nx: int\ny\nfunction norm(self) -> { self.x * self.x }\n}\n";
+    let with_point = |src: &str| diagnostics(&format!("{}{}", point, src));
+    let empty: Vec<String> = vec![];
+    assert_eq!(
+        with_point("p := Point(1, \"a\")\nn: int = p.norm()\np.y = [1]"),
+        empty
+    );
+    assert_eq!(
+        with_point("p := Point(\"a\", 2)"),
+        vec!["expected int, found string"]
+    );
+    assert_eq!(
+        with_point("function f(p: Point) -> { p.z }"),
+        vec!["Point has no field 'z'"]
+    );
+    assert_eq!(
+        with_point("p: Point = 1\ns: string = Point(1, 2).x"),
+        vec!["expected Point, found int", "expected string, found int"]
+    );
+    assert_eq!(
+        with_point("Point(1)"),
+        vec!["function 'Point' expects 2 arguments, found 1"]
+    );
+    // methods of structs are not names in scope
+    assert_eq!(with_point("Point(1, 2).norm()"), empty);
+    // operators are overloaded by methods
+    assert_eq!(
+        with_point("struct N { function add(self, o: N) -> int { 1 } }\nn: int = N() + N()"),
+        empty
+    );
+    assert_eq!(
+        with_point("struct N { function add(self, o: N) -> int { 1 } }\nn := N() + 1"),
+        vec!["expected N, found int"]
+    );
+    assert_eq!(
+        with_point("Point(1, 2) * 2"),
+        vec!["unsupported operand types for *: Point and int"]
+    );
+    assert_eq!(
+        diagnostics("struct P { x, x }"),
+        vec!["'x' is already a field of P, at 1:12"]
+    );
+}
+
+#[test]
+fn check_inferred_types() {
+    let empty: Vec<String> = vec![];
+    // unannotated functions are generic in what they don't constrain
+    assert_eq!(
+        diagnostics("function id(x) -> { x }\na: int = id(1)\nb: string = id(\"b\")"),
+        empty
+    );
+    assert_eq!(
+        diagnostics("function f(x) -> { if x { return 1 }\n\"a\" }\ny: int = f(true)"),
+        vec!["expected int, found int | string"]
+    );
+    assert_eq!(
+        diagnostics("function apply(f, x) -> { f(x) }\nn: string = apply(len, [])"),
+        vec!["expected string, found int"]
+    );
+    assert_eq!(
+        diagnostics("m := {\"a\": [1]}\nfor k in m { n: int = k }"),
+        vec!["expected int, found string"]
+    );
+    // values of unknown types and mutable variables are dynamic
+    assert_eq!(
+        diagnostics("mut x := 1\nx = \"a\"\nfunction f(y) -> { y + 1 }\ns: string = f(1)"),
+        empty
+    );
+}
+
+#[test]
+fn analyze_names() {
+    let s = "function f(a: int) -> int { a + 1 }\nx := f(2)\n{ y := x }\n";
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let analysis = analyze(&parse(&src).0);
+    assert!(analysis.diagnostics.is_empty());
+    let at = |needle: &str, nth: usize| s.match_indices(needle).nth(nth).expect("in the source").0;
+    // uses lead to their declaration, declarations to themselves
+    let declared = |i| analysis.definition(i).map(|d| d.name.span.start());
+    assert_eq!(declared(at("a", 1)), Some(at("a", 0)));
+    assert_eq!(declared(at("f", 2)), Some(at("f", 1)));
+    assert_eq!(declared(at("x", 0)), Some(at("x", 0)));
+    assert_eq!(declared(at("1", 0)), None);
+    let t = |i| {
+        analysis
+            .definition(i)
+            .and_then(|d| d.t.clone())
+            .map(|t| t.to_string())
+    };
+    assert_eq!(t(at("x", 1)).as_deref(), Some("int"));
+    assert_eq!(t(at("f", 1)).as_deref(), Some("function(int) -> int"));
+    let visible = |i| {
+        let mut names: Vec<String> = analysis
+            .visible(i)
+            .iter()
+            .map(|d| d.name.name.clone())
+            .collect();
+        names.sort();
+        names
+    };
+    // functions are visible before their declaration, variables after it
+    assert_eq!(visible(0), ["f"]);
+    assert_eq!(visible(at("a +", 0)), ["a", "f"]);
+    assert_eq!(visible(at("}", 1)), ["f", "x", "y"]);
+    assert_eq!(visible(s.len()), ["f", "x"]);
+}
@@ -0,0 +1,1660 @@
+//! Gradual type inference, finds values used where they can't be.
+//!
+//! Types come from annotations where there are some, and are inferred
+//! otherwise by unification, in the style of Hindley-Milner: the parameters
+//! of a function start as type variables, the body constrains them, and
+//! whatever is left unconstrained makes the function generic. Anything the
+//! inference can't tell is `any`, which is compatible with every type, so
+//! code without annotations is only reported when it would fail whatever the
+//! values turn out to be. Mutable variables without an annotation are `any`
+//! too, since they may be assigned values of another type later.
+
+use std::{collections::HashMap, fmt::Display};
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    interpreter::{builtins::VARIABLES, BUILTINS, MODULES},
+    parser::{
+        Arity, Assignment, BinOperator, BlockExpression, EnumDeclaration, Expression,
+        FieldExpression, FunctionDeclaration, Identifier, Index, InterfaceDeclaration, Literal,
+        NamedArgument, Parameter, Pattern, Program, Statement, StructDeclaration, TypeExpression,
+        UnOperator,
+    },
+    source::SourceString,
+    values::{self, Builtin},
+};
+
+/// Infer the types of a program, returns the type errors found
+pub fn check(program: &Program) -> Vec<DragonError> {
+    infer(program).0
+}
+
+/// Infer the types of a program, returns the type errors found and the type
+/// of each declared name, by the start of the name in its declaration
+pub fn infer(program: &Program) -> (Vec<DragonError>, HashMap<usize, Type>) {
+    let mut inference = Inference::new();
+    inference.statements(&program.statements);
+    let types = inference
+        .declared
+        .iter()
+        .map(|(&i, t)| (i, inference.zonk(t)))
+        .collect();
+    (inference.diagnostics, types)
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum Type {
+    /// compatible with every type, for values only known at run time
+    Any,
+
+    /// the type of expressions that never produce a value, such as `return`
+    Never,
+    None,
+    Bool,
+    Int,
+    Float,
+    String,
+    Symbol,
+    Bytes,
+    List(Box<Type>),
+    Map(Box<Type>, Box<Type>),
+
+    /// the parameters are `None` if they are not known, as for `function`
+    Function(Option<Vec<Type>>, Box<Type>),
+    Module,
+    File,
+    Regex,
+    Task,
+    Channel,
+    Mutex,
+    WaitGroup,
+    Atomic,
+    StringBuilder,
+    Error,
+
+    /// an instance of the struct with the name, structs are told apart by
+    /// name only, the values of an enum are those of the struct named after
+    /// it, whatever their variant
+    Struct(String),
+
+    /// the enum with the name itself, whose members are its variants
+    Enum(String),
+
+    /// a value of any type having the methods of the interface with the
+    /// name, see `Inference::conforms`
+    Interface(String),
+
+    /// a value of any of the types, there are always at least two
+    Union(Vec<Type>),
+
+    /// a type still to be inferred
+    Var(usize),
+}
+
+impl Type {
+    /// the types it is made of
+    fn children(&self) -> Vec<&Type> {
+        match self {
+            Self::List(t) => vec![t],
+            Self::Map(k, v) => vec![k, v],
+            Self::Function(params, r) => params.iter().flatten().chain([r.as_ref()]).collect(),
+            Self::Union(ts) => ts.iter().collect(),
+            _ => vec![],
+        }
+    }
+
+    /// whether it is a single type known to the inference
+    fn is_known(&self) -> bool {
+        !matches!(
+            self,
+            Self::Any | Self::Never | Self::Union(_) | Self::Var(_)
+        )
+    }
+
+    fn is_numeric(&self) -> bool {
+        matches!(self, Self::Int | Self::Float)
+    }
+}
+
+/// variables are shown as `any`, as that is what they stand for until
+/// something constrains them
+impl Display for Type {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let join = |ts: &[Type], sep: &str| {
+            ts.iter()
+                .map(|t| t.to_string())
+                .collect::<Vec<_>>()
+                .join(sep)
+        };
+        match self {
+            Self::Any | Self::Var(_) => write!(f, "any"),
+            Self::Never => write!(f, "never"),
+            Self::None => write!(f, "none"),
+            Self::Bool => write!(f, "bool"),
+            Self::Int => write!(f, "int"),
+            Self::Float => write!(f, "float"),
+            Self::String => write!(f, "string"),
+            Self::Symbol => write!(f, "symbol"),
+            Self::Bytes => write!(f, "bytes"),
+            Self::List(t) => write!(f, "list[{}]", t),
+            Self::Map(k, v) => write!(f, "map[{}, {}]", k, v),
+            Self::Function(None, _) => write!(f, "function"),
+            Self::Function(Some(params), r) => {
+                write!(f, "function({}) -> {}", join(params, ", "), r)
+            }
+            Self::Module => write!(f, "module"),
+            Self::File => write!(f, "file"),
+            Self::Regex => write!(f, "regex"),
+            Self::Task => write!(f, "task"),
+            Self::Channel => write!(f, "channel"),
+            Self::Mutex => write!(f, "mutex"),
+            Self::WaitGroup => write!(f, "wait_group"),
+            Self::Atomic => write!(f, "atomic"),
+            Self::StringBuilder => write!(f, "string_builder"),
+            Self::Error => write!(f, "error"),
+            Self::Struct(name) => write!(f, "{}", name),
+            Self::Enum(_) => write!(f, "enum"),
+            Self::Interface(name) => write!(f, "{}", name),
+            Self::Union(ts) => write!(f, "{}", join(ts, " | ")),
+        }
+    }
+}
+
+/// The type of an annotation, names that are not types are reported and
+/// taken to be `any`. `declared` is the type named by a name the program
+/// declares, such as a struct, whose name is the type of its instances.
+pub fn annotation(
+    t: &TypeExpression,
+    declared: &dyn Fn(&str) -> Option<Type>,
+    errors: &mut Vec<DragonError>,
+) -> Type {
+    let mut error = |msg: String, span: SourceString| {
+        errors.push(DragonError::new(ErrorCode::UnknownType, msg, Some(span)));
+        Type::Any
+    };
+    match t {
+        TypeExpression::Name(i) => match i.name.as_str() {
+            "any" => Type::Any,
+            "never" => Type::Never,
+            "none" => Type::None,
+            "bool" => Type::Bool,
+            "int" => Type::Int,
+            "float" => Type::Float,
+            "string" => Type::String,
+            "symbol" => Type::Symbol,
+            "bytes" => Type::Bytes,
+            "list" => Type::List(Box::new(Type::Any)),
+            "map" => Type::Map(Box::new(Type::Any), Box::new(Type::Any)),
+            "function" => Type::Function(None, Box::new(Type::Any)),
+            "module" => Type::Module,
+            "file" => Type::File,
+            "regex" => Type::Regex,
+            "task" => Type::Task,
+            "channel" => Type::Channel,
+            "mutex" => Type::Mutex,
+            "wait_group" => Type::WaitGroup,
+            "atomic" => Type::Atomic,
+            "string_builder" => Type::StringBuilder,
+            "error" => Type::Error,
+            name => match declared(name) {
+                Some(t) => t,
+                None => error(format!("unknown type '{}'", name), i.span.clone()),
+            },
+        },
+        TypeExpression::Generic(i, arguments, span) => {
+            let expected = match i.name.as_str() {
+                "list" => 1,
+                "map" => 2,
+                name => return error(format!("type '{}' takes no arguments", name), span.clone()),
+            };
+            if arguments.len() != expected {
+                return error(
+                    format!(
+                        "type '{}' expects {} argument{}, found {}",
+                        i.name,
+                        expected,
+                        if expected == 1 { "" } else { "s" },
+                        arguments.len()
+                    ),
+                    span.clone(),
+                );
+            }
+            let mut arguments = arguments
+                .iter()
+                .map(|a| Box::new(annotation(a, declared, errors)));
+            match (arguments.next(), arguments.next()) {
+                (Some(t), None) => Type::List(t),
+                (Some(k), Some(v)) => Type::Map(k, v),
+                _ => unreachable!("the number of arguments is checked above"),
+            }
+        }
+        TypeExpression::Union(ts, _) => {
+            let mut members = vec![];
+            for t in ts {
+                let flat = match annotation(t, declared, errors) {
+                    Type::Any => return Type::Any,
+                    Type::Union(ts) => ts,
+                    t => vec![t],
+                };
+                for t in flat {
+                    if !members.contains(&t) {
+                        members.push(t);
+                    }
+                }
+            }
+            match members.len() {
+                1 => members.remove(0),
+                _ => Type::Union(members),
+            }
+        }
+        TypeExpression::Tuple(_, span) => error(
+            "tuple types are not supported yet".to_string(),
+            span.clone(),
+        ),
+    }
+}
+
+/// whether calls give the function as many arguments as it has parameters,
+/// function types of the others leave out their parameters
+fn exact(f: &FunctionDeclaration) -> bool {
+    f.arity() == Arity::exactly(f.parameters.len())
+}
+
+/// the type of a method with the type of the receiver as its first parameter
+fn with_receiver(method: &Type, receiver: &Type) -> Type {
+    match method {
+        Type::Function(Some(parameters), result) if !parameters.is_empty() => {
+            let mut parameters = parameters.clone();
+            parameters[0] = receiver.clone();
+            Type::Function(Some(parameters), result.clone())
+        }
+        t => t.clone(),
+    }
+}
+
+fn literal(l: &Literal) -> Type {
+    match l {
+        Literal::None => Type::None,
+        Literal::Bool(_) => Type::Bool,
+        Literal::Int(_) => Type::Int,
+        Literal::Float(_) => Type::Float,
+        Literal::String(_) => Type::String,
+        Literal::Symbol(_) => Type::Symbol,
+        Literal::Bytes(_) => Type::Bytes,
+    }
+}
+
+/// the type of a builtin function, the arguments of most are only checked at
+/// run time
+fn builtin(b: &Builtin) -> Type {
+    let result = match b.name {
+        "chan" => Type::Channel,
+        "done" | "try_send" => Type::Bool,
+        "len" | "byte_len" => Type::Int,
+        "inspect" => Type::String,
+        "keys" | "values" => Type::List(Box::new(Type::Any)),
+        "assert" | "assert_eq" | "expect_snapshot" | "print" | "print!" => Type::None,
+        _ => Type::Any,
+    };
+    let parameters = b.arity.map(|n| vec![Type::Any; n]);
+    Type::Function(parameters, Box::new(result))
+}
+
+/// A type that may be generic in some of its variables, each use of a
+/// generic name gets fresh variables in their place
+#[derive(Debug, Clone)]
+struct Scheme {
+    generic: Vec<usize>,
+    t: Type,
+}
+
+impl From<Type> for Scheme {
+    fn from(t: Type) -> Self {
+        Self { generic: vec![], t }
+    }
+}
+
+#[derive(Debug, Clone)]
+struct Variable {
+    /// the type it was unified with, if any
+    binding: Option<Type>,
+
+    /// the number of functions enclosing the one it was created in, only
+    /// variables created inside a function can be generic in it
+    level: usize,
+}
+
+/// The values a function returns
+enum Returns {
+    /// those of the type in its signature
+    Declared(Type),
+
+    /// the types returned so far, without an annotation a function may
+    /// return values of different types
+    Inferred(Vec<Type>),
+}
+
+/// What is known of a struct declared by the program
+#[derive(Debug, Clone, Default)]
+struct StructType {
+    /// in the order they are declared, unannotated ones are `any`. Those of
+    /// an enum are the fields of all its variants.
+    fields: Vec<(String, Type)>,
+    methods: HashMap<String, Scheme>,
+}
+
+struct Inference {
+    /// innermost scope last
+    scopes: Vec<HashMap<String, Scheme>>,
+
+    /// by name, like the types of their instances
+    structs: HashMap<String, StructType>,
+
+    /// the types of the fields of the variants of each enum, by name, `None`
+    /// for variants without fields
+    variants: HashMap<String, HashMap<String, Option<Vec<Type>>>>,
+
+    /// the methods of each interface, by name, with the types of their
+    /// annotations
+    interfaces: HashMap<String, Vec<(String, Type)>>,
+
+    /// the types being checked to have the methods of an interface, which
+    /// they are assumed to have where its methods mention the interface
+    conforming: Vec<(String, Type)>,
+    variables: Vec<Variable>,
+    level: usize,
+
+    /// what the functions being inferred return, innermost last
+    returns: Vec<Returns>,
+    diagnostics: Vec<DragonError>,
+
+    /// the type of each declared name, by the start of its declaration
+    declared: HashMap<usize, Type>,
+}
+
+impl Inference {
+    fn new() -> Self {
+        let list_of_strings = Type::List(Box::new(Type::String));
+        let builtins = BUILTINS
+            .iter()
+            .map(|b| (b.name.to_owned(), builtin(b).into()))
+            .chain(
+                MODULES
+                    .iter()
+                    .map(|(name, ..)| (name.to_string(), Type::Module.into())),
+            )
+            .chain(VARIABLES.iter().map(|name| {
+                let t = match *name {
+                    "args" => list_of_strings.clone(),
+                    _ => Type::Any,
+                };
+                (name.to_string(), t.into())
+            }))
+            .collect();
+        Self {
+            scopes: vec![builtins],
+            structs: HashMap::new(),
+            variants: HashMap::new(),
+            interfaces: HashMap::new(),
+            conforming: vec![],
+            variables: vec![],
+            level: 0,
+            returns: vec![],
+            diagnostics: vec![],
+            declared: HashMap::new(),
+        }
+    }
+
+    fn error(&mut self, msg: String, span: &SourceString) {
+        self.diagnostics.push(DragonError::new(
+            ErrorCode::TypeMismatch,
+            msg,
+            Some(span.clone()),
+        ));
+    }
+
+    /// the type the name of a struct, an enum or an interface stands for in
+    /// annotations
+    fn named(&self, name: &str) -> Option<Type> {
+        if self.structs.contains_key(name) {
+            Some(Type::Struct(name.to_owned()))
+        } else if self.interfaces.contains_key(name) {
+            Some(Type::Interface(name.to_owned()))
+        } else {
+            None
+        }
+    }
+
+    fn annotation(&mut self, t: &TypeExpression) -> Type {
+        let mut errors = vec![];
+        let t = annotation(t, &|name| self.named(name), &mut errors);
+        self.diagnostics.extend(errors);
+        t
+    }
+
+    /// the type of an annotation, reporting nothing, for declarations that
+    /// are annotated again when they are inferred
+    fn declared(&self, t: &Option<TypeExpression>) -> Type {
+        match t {
+            Some(t) => annotation(t, &|name| self.named(name), &mut vec![]),
+            None => Type::Any,
+        }
+    }
+
+    fn define(&mut self, name: &Identifier, scheme: Scheme) {
+        self.declared.insert(name.span.start(), scheme.t.clone());
+        let scope = self.scopes.last_mut().expect("there is always a scope");
+        scope.insert(name.name.clone(), scheme);
+    }
+
+    /// the type of a use of the name, `any` if it is undefined since the
+    /// checker reports that
+    fn lookup(&mut self, name: &str) -> Type {
+        match self.scopes.iter().rev().find_map(|s| s.get(name)).cloned() {
+            Some(scheme) => self.instantiate(&scheme),
+            None => Type::Any,
+        }
+    }
+
+    fn scoped<T>(&mut self, f: impl FnOnce(&mut Self) -> T) -> T {
+        self.scopes.push(HashMap::new());
+        let result = f(self);
+        self.scopes.pop();
+        result
+    }
+
+    fn fresh(&mut self) -> Type {
+        self.variables.push(Variable {
+            binding: None,
+            level: self.level,
+        });
+        Type::Var(self.variables.len() - 1)
+    }
+
+    /// follow the bindings of variables, only at the top of the type
+    fn resolve(&self, t: &Type) -> Type {
+        match t {
+            Type::Var(v) => match &self.variables[*v].binding {
+                Some(b) => self.resolve(b),
+                None => t.clone(),
+            },
+            t => t.clone(),
+        }
+    }
+
+    /// the type with every bound variable replaced by its binding
+    fn zonk(&self, t: &Type) -> Type {
+        self.map(&self.resolve(t), &mut |_| None)
+    }
+
+    /// rebuild a resolved type, replacing the variables for which the
+    /// function returns a type
+    fn map(&self, t: &Type, f: &mut impl FnMut(usize) -> Option<Type>) -> Type {
+        let mut map = |t: &Type| Box::new(self.map(&self.resolve(t), f));
+        match t {
+            Type::Var(v) => f(*v).unwrap_or(Type::Var(*v)),
+            Type::List(t) => Type::List(map(t)),
+            Type::Map(k, v) => {
+                let k = map(k);
+                Type::Map(k, map(v))
+            }
+            Type::Function(params, r) => {
+                let params = params
+                    .as_ref()
+                    .map(|ps| ps.iter().map(|p| *map(p)).collect());
+                Type::Function(params, map(r))
+            }
+            Type::Union(ts) => Type::Union(ts.iter().map(|t| *map(t)).collect()),
+            t => t.clone(),
+        }
+    }
+
+    /// the unbound variables in the type
+    fn free(&self, t: &Type, found: &mut Vec<usize>) {
+        match self.resolve(t) {
+            Type::Var(v) => {
+                if !found.contains(&v) {
+                    found.push(v);
+                }
+            }
+            t => {
+                for c in t.children() {
+                    self.free(c, found);
+                }
+            }
+        }
+    }
+
+    /// make the variables created inside the function being left generic,
+    /// unless something outside of it constrained them
+    fn generalize(&self, t: Type) -> Scheme {
+        let mut free = vec![];
+        self.free(&t, &mut free);
+        free.retain(|&v| self.variables[v].level > self.level);
+        Scheme { generic: free, t }
+    }
+
+    fn instantiate(&mut self, scheme: &Scheme) -> Type {
+        if scheme.generic.is_empty() {
+            return scheme.t.clone();
+        }
+        let fresh: Vec<(usize, Type)> = scheme.generic.iter().map(|&v| (v, self.fresh())).collect();
+        self.map(&self.resolve(&scheme.t), &mut |v| {
+            fresh.iter().find(|(g, _)| *g == v).map(|(_, t)| t.clone())
+        })
+    }
+
+    fn bind(&mut self, v: usize, t: &Type) -> bool {
+        let mut free = vec![];
+        self.free(t, &mut free);
+        // a recursive type, such as a list containing itself, can't be
+        // written down, so the variable is left as `any`
+        if free.contains(&v) {
+            return true;
+        }
+        let level = self.variables[v].level;
+        for f in free {
+            let variable = &mut self.variables[f];
+            variable.level = variable.level.min(level);
+        }
+        self.variables[v].binding = Some(t.clone());
+        true
+    }
+
+    /// whether a value of the found type can be used where the expected one
+    /// is, binding variables to make them match
+    fn unify(&mut self, expected: &Type, found: &Type) -> bool {
+        let (expected, found) = (self.resolve(expected), self.resolve(found));
+        match (&expected, &found) {
+            (Type::Any, _) | (_, Type::Any) | (_, Type::Never) => true,
+            (Type::Var(a), Type::Var(b)) if a == b => true,
+            (Type::Var(v), t) | (t, Type::Var(v)) => self.bind(*v, t),
+            (Type::Float, Type::Int) => true,
+            (Type::Union(ts), Type::Union(fs)) => {
+                fs.iter().all(|f| ts.iter().any(|t| self.attempt(t, f)))
+            }
+            (_, Type::Union(fs)) => fs.iter().all(|f| self.unify(&expected, f)),
+            (Type::Union(ts), f) => ts.iter().any(|t| self.attempt(t, f)),
+            (Type::List(e), Type::List(f)) => self.unify(e, f),
+            (Type::Map(ek, ev), Type::Map(fk, fv)) => self.unify(ek, fk) && self.unify(ev, fv),
+            (Type::Interface(i), f) if expected != found => self.conforms(i, f).is_ok(),
+            (Type::Function(ep, er), Type::Function(fp, fr)) => {
+                // the function found is called with the arguments of the
+                // expected one
+                let parameters = match (ep, fp) {
+                    (Some(ep), Some(fp)) => {
+                        ep.len() == fp.len() && ep.iter().zip(fp).all(|(e, f)| self.unify(f, e))
+                    }
+                    _ => true,
+                };
+                parameters && self.unify(er, fr)
+            }
+            (e, f) => e == f,
+        }
+    }
+
+    /// unify, leaving the variables as they were if the types don't match
+    fn attempt(&mut self, expected: &Type, found: &Type) -> bool {
+        let snapshot = self.variables.clone();
+        let matches = self.unify(expected, found);
+        if !matches {
+            self.variables = snapshot;
+        }
+        matches
+    }
+
+    fn expect(&mut self, expected: &Type, found: &Type, span: &SourceString) {
+        if !self.attempt(expected, found) {
+            let msg = format!(
+                "expected {}, found {}",
+                self.zonk(expected),
+                self.zonk(found)
+            );
+            let mut e = DragonError::new(ErrorCode::TypeMismatch, msg, Some(span.clone()));
+            // why the value doesn't have the methods the interface requires
+            if let (Type::Interface(i), found) = (self.resolve(expected), self.resolve(found)) {
+                if let (true, Err(why)) = (found.is_known(), self.conforms(&i, &found)) {
+                    e = e.with_hint(why);
+                }
+            }
+            self.diagnostics.push(e);
+        }
+    }
+
+    /// Why values of the type can't be used where the interface is expected,
+    /// if they can't. Those of a struct or an enum can if it declares methods
+    /// with the names of those of the interface, taking the same number of
+    /// arguments, of the types of its parameters, and returning a value of
+    /// the type it returns. The receiver is the parameter left out. Those of
+    /// another interface can if it requires such methods.
+    fn conforms(&mut self, interface: &str, found: &Type) -> Result<(), String> {
+        let assumed = (interface.to_owned(), found.clone());
+        let Some(required) = self.interfaces.get(interface).cloned() else {
+            return Ok(());
+        };
+        if self.conforming.contains(&assumed) {
+            return Ok(());
+        }
+        self.conforming.push(assumed);
+        let mut conforms = Ok(());
+        for (name, expected) in required {
+            let Some(method) = self.method(found, Some(&name)) else {
+                conforms = Err(format!("{} has no method '{}'", found, name));
+                break;
+            };
+            let expected = with_receiver(&expected, found);
+            if !self.attempt(&expected, &method) {
+                conforms = Err(format!(
+                    "its method '{}' is {}, {} requires {}",
+                    name,
+                    self.zonk(&method),
+                    interface,
+                    self.zonk(&expected)
+                ));
+                break;
+            }
+        }
+        self.conforming.pop();
+        conforms
+    }
+
+    /// the type of a value of one of the types, `any` if one of them is a
+    /// variable that the others don't match
+    fn union(&self, types: impl IntoIterator<Item = Type>) -> Type {
+        let mut members = vec![];
+        for t in types {
+            let flat = match self.zonk(&t) {
+                Type::Union(ts) => ts,
+                Type::Never => vec![],
+                Type::Any => return Type::Any,
+                t => vec![t],
+            };
+            for t in flat {
+                if !members.contains(&t) {
+                    members.push(t);
+                }
+            }
+        }
+        match members.len() {
+            0 => Type::Never,
+            1 => members.remove(0),
+            _ if members.iter().any(|t| matches!(t, Type::Var(_))) => Type::Any,
+            _ => Type::Union(members),
+        }
+    }
+
+    /// the type of the values of the type that are not `none`, and whether
+    /// it has some that are
+    fn without_none(&self, t: &Type) -> (Type, bool) {
+        match self.resolve(t) {
+            Type::None => (Type::Never, true),
+            Type::Union(ts) if ts.contains(&Type::None) => (
+                self.union(ts.into_iter().filter(|t| *t != Type::None)),
+                true,
+            ),
+            t => (t, false),
+        }
+    }
+
+    /// the value is the one of the last statement
+    fn statements(&mut self, statements: &[Statement]) -> Type {
+        // structs, enums and interfaces can be named by annotations anywhere
+        // in their scope
+        let mut types: HashMap<&str, &Identifier> = HashMap::new();
+        for s in statements {
+            let name = match s {
+                Statement::Struct(s) => &s.name,
+                Statement::Enum(e) => &e.name,
+                Statement::Interface(i) => &i.name,
+                _ => continue,
+            };
+            match s {
+                Statement::Interface(_) => {
+                    self.interfaces.insert(name.name.clone(), vec![]);
+                }
+                _ => {
+                    self.structs
+                        .insert(name.name.clone(), StructType::default());
+                }
+            }
+            // the checker reports the names of structs and enums declared
+            // twice, interfaces are not values so it doesn't know them
+            if let Some(previous) = types.insert(&name.name, name) {
+                if matches!(s, Statement::Interface(_)) || self.interfaces.contains_key(&name.name)
+                {
+                    let msg = format!(
+                        "'{}' is already declared in this scope, at {}",
+                        name.name,
+                        previous.span.position()
+                    );
+                    self.diagnostics.push(DragonError::new(
+                        ErrorCode::DuplicateDeclaration,
+                        msg,
+                        Some(name.span.clone()),
+                    ));
+                }
+            }
+        }
+        // functions can be called before they are declared, with the types
+        // of their annotations until then
+        for s in statements {
+            match s {
+                Statement::Function(f) => {
+                    let t = self.signature(f, None);
+                    self.define(&f.name, t.into());
+                }
+                Statement::Struct(s) => self.predeclare(s),
+                Statement::Enum(e) => self.predeclare_enum(e),
+                Statement::Interface(i) => self.predeclare_interface(i),
+                _ => {}
+            }
+        }
+        let mut last = Type::None;
+        for s in statements {
+            last = self.statement(s);
+        }
+        last
+    }
+
+    /// the type of a function from its annotations
+    fn signature(&self, f: &FunctionDeclaration, receiver: Option<&Type>) -> Type {
+        match exact(f) {
+            true => self.signature_of(&f.parameters, &f.return_type, receiver),
+            false => Type::Function(None, Box::new(self.declared(&f.return_type))),
+        }
+    }
+
+    /// the type of a function taking as many arguments as it has parameters
+    fn signature_of(
+        &self,
+        parameters: &[Parameter],
+        return_type: &Option<TypeExpression>,
+        receiver: Option<&Type>,
+    ) -> Type {
+        let result = self.declared(return_type);
+        let parameters = parameters
+            .iter()
+            .enumerate()
+            .map(|(i, p)| match receiver {
+                Some(t) if i == 0 && p.type_annotation.is_none() => t.clone(),
+                _ => self.declared(&p.type_annotation),
+            })
+            .collect();
+        Type::Function(Some(parameters), Box::new(result))
+    }
+
+    /// the fields of a struct, its methods with the types of their
+    /// annotations, and its constructor
+    fn predeclare(&mut self, s: &StructDeclaration) {
+        let instance = Type::Struct(s.name.name.clone());
+        let fields: Vec<(String, Type)> = s
+            .fields
+            .iter()
+            .map(|f| (f.name.name.clone(), self.declared(&f.type_annotation)))
+            .collect();
+        let methods = s
+            .methods
+            .iter()
+            .map(|m| {
+                (
+                    m.name.name.clone(),
+                    self.signature(m, Some(&instance)).into(),
+                )
+            })
+            .collect();
+        let parameters = fields.iter().map(|(_, t)| t.clone()).collect();
+        let constructor = Type::Function(Some(parameters), Box::new(instance));
+        self.structs
+            .insert(s.name.name.clone(), StructType { fields, methods });
+        self.define(&s.name, constructor.into());
+    }
+
+    /// the fields of the variants of an enum and its methods, like those of
+    /// a struct
+    fn predeclare_enum(&mut self, e: &EnumDeclaration) {
+        let instance = Type::Struct(e.name.name.clone());
+        let mut fields: Vec<(String, Type)> = vec![];
+        let mut variants = HashMap::new();
+        for v in &e.variants {
+            let types = v.fields.as_ref().map(|declared| {
+                declared
+                    .iter()
+                    .map(|f| {
+                        let t = self.declared(&f.type_annotation);
+                        match fields.iter_mut().find(|(name, _)| *name == f.name.name) {
+                            Some((_, other)) => *other = self.union([other.clone(), t.clone()]),
+                            None => fields.push((f.name.name.clone(), t.clone())),
+                        }
+                        t
+                    })
+                    .collect()
+            });
+            variants.insert(v.name.name.clone(), types);
+        }
+        let methods = e
+            .methods
+            .iter()
+            .map(|m| {
+                (
+                    m.name.name.clone(),
+                    self.signature(m, Some(&instance)).into(),
+                )
+            })
+            .collect();
+        self.structs
+            .insert(e.name.name.clone(), StructType { fields, methods });
+        self.variants.insert(e.name.name.clone(), variants);
+        self.define(&e.name, Type::Enum(e.name.name.clone()).into());
+    }
+
+    /// the methods an interface requires, the receiver of those without an
+    /// annotation for it is a value of the interface
+    fn predeclare_interface(&mut self, i: &InterfaceDeclaration) {
+        let receiver = Type::Interface(i.name.name.clone());
+        let methods = i
+            .methods
+            .iter()
+            .map(|m| {
+                let t = match m.arity() == Arity::exactly(m.parameters.len()) {
+                    true => self.signature_of(&m.parameters, &m.return_type, Some(&receiver)),
+                    false => Type::Function(None, Box::new(self.declared(&m.return_type))),
+                };
+                (m.name.name.clone(), t)
+            })
+            .collect();
+        self.interfaces.insert(i.name.name.clone(), methods);
+    }
+
+    /// the types of the fields of the variant the pattern names, if it is
+    /// one of an enum of the program
+    fn variant_fields(&self, path: &[Identifier]) -> Option<&Option<Vec<Type>>> {
+        let [e, v] = path else {
+            return None;
+        };
+        self.variants.get(&e.name)?.get(&v.name)
+    }
+
+    fn statement(&mut self, s: &Statement) -> Type {
+        match s {
+            Statement::Declaration(d) => {
+                let value = self.expression(&d.value);
+                let scheme = match &d.type_annotation {
+                    Some(t) => {
+                        let declared = self.annotation(t);
+                        self.expect(&declared, &value, &d.value.span());
+                        declared.into()
+                    }
+                    None if d.mutable => Type::Any.into(),
+                    // only functions are generic, other values, such as an
+                    // empty list, are changed by their uses
+                    None if matches!(d.value, Expression::Lambda(_)) => self.generalize(value),
+                    None => value.into(),
+                };
+                self.define(&d.name, scheme);
+                Type::None
+            }
+            Statement::Destructuring(d) => {
+                let value = self.expression(&d.value);
+                let value = match &d.type_annotation {
+                    Some(t) => {
+                        let declared = self.annotation(t);
+                        self.expect(&declared, &value, &d.value.span());
+                        declared
+                    }
+                    None if d.mutable => Type::Any,
+                    None => value,
+                };
+                self.destructure(&d.pattern, &value);
+                Type::None
+            }
+            Statement::Function(f) => {
+                let t = self.function(f, true, None);
+                let scheme = self.generalize(t);
+                self.define(&f.name, scheme);
+                Type::None
+            }
+            Statement::Struct(s) => {
+                // for unknown types
+                for f in &s.fields {
+                    if let Some(t) = &f.type_annotation {
+                        self.annotation(t);
+                    }
+                }
+                let instance = Type::Struct(s.name.name.clone());
+                for m in &s.methods {
+                    let t = self.function(m, false, Some(&instance));
+                    let scheme = self.generalize(t);
+                    if let Some(declared) = self.structs.get_mut(&s.name.name) {
+                        declared.methods.insert(m.name.name.clone(), scheme);
+                    }
+                }
+                Type::None
+            }
+            Statement::Enum(e) => {
+                for f in e.variants.iter().flat_map(|v| v.fields.iter().flatten()) {
+                    if let Some(t) = &f.type_annotation {
+                        self.annotation(t);
+                    }
+                }
+                let instance = Type::Struct(e.name.name.clone());
+                for m in &e.methods {
+                    let t = self.function(m, false, Some(&instance));
+                    let scheme = self.generalize(t);
+                    if let Some(declared) = self.structs.get_mut(&e.name.name) {
+                        declared.methods.insert(m.name.name.clone(), scheme);
+                    }
+                }
+                Type::None
+            }
+            // for unknown types
+            Statement::Interface(i) => {
+                let annotations = i.methods.iter().flat_map(|m| {
+                    let parameters = m.parameters.iter().map(|p| &p.type_annotation);
+                    parameters.chain([&m.return_type])
+                });
+                for t in annotations.flatten() {
+                    self.annotation(t);
+                }
+                Type::None
+            }
+            Statement::Assignment(a) => {
+                let value = self.expression(&a.value);
+                if let Some(t) = self.set_index(a, &value) {
+                    return t;
+                }
+                let target = self.expression(&a.target);
+                let value = match a.op.bin_operator() {
+                    Some(op) => self.binary(op, &target, &value, &a.span),
+                    None => value,
+                };
+                self.expect(&target, &value, &a.value.span());
+                Type::None
+            }
+            Statement::Expression(e) => self.expression(e),
+            Statement::Exit(e) => {
+                self.expression(&e.code);
+                Type::Never
+            }
+            Statement::Throw(t) => {
+                self.expression(&t.value);
+                Type::Never
+            }
+            Statement::Defer(d) => {
+                self.function(&d.function, false, None);
+                Type::None
+            }
+            Statement::Import(i) => {
+                self.define(i.name(), Type::Module.into());
+                Type::None
+            }
+            Statement::Return(r) => {
+                let value = match &r.value {
+                    Some(v) => self.expression(v),
+                    None => Type::None,
+                };
+                let span = r.value.as_ref().map_or(r.span.clone(), |v| v.span());
+                match self.returns.last_mut() {
+                    Some(Returns::Declared(expected)) => {
+                        let expected = expected.clone();
+                        self.expect(&expected, &value, &span);
+                    }
+                    Some(Returns::Inferred(types)) => types.push(value),
+                    None => {}
+                }
+                Type::Never
+            }
+            Statement::Yield(y) => {
+                if let Some(v) = &y.value {
+                    self.expression(v);
+                }
+                Type::None
+            }
+            Statement::Break(b) => {
+                if let Some(v) = &b.value {
+                    self.expression(v);
+                }
+                Type::Never
+            }
+            Statement::Continue(c) => {
+                if let Some(v) = &c.value {
+                    self.expression(v);
+                }
+                Type::Never
+            }
+        }
+    }
+
+    /// infer the body of a function, the type is not generalized yet. The
+    /// first parameter of a method is its receiver, of the type given.
+    fn function(
+        &mut self,
+        f: &FunctionDeclaration,
+        recursive: bool,
+        receiver: Option<&Type>,
+    ) -> Type {
+        self.level += 1;
+        let parameters: Vec<Type> = f
+            .parameters
+            .iter()
+            .enumerate()
+            .map(|(i, p)| {
+                let t = match (&p.type_annotation, receiver) {
+                    (Some(t), _) => self.annotation(t),
+                    (None, Some(t)) if i == 0 => t.clone(),
+                    (None, _) => self.fresh(),
+                };
+                // the annotation is the type of each of the arguments
+                match p.variadic {
+                    true => Type::List(Box::new(t)),
+                    false => t,
+                }
+            })
+            .collect();
+        let result = match &f.return_type {
+            Some(t) => self.annotation(t),
+            None => self.fresh(),
+        };
+        let t = match exact(f) {
+            true => Type::Function(Some(parameters.clone()), Box::new(result.clone())),
+            false => Type::Function(None, Box::new(result.clone())),
+        };
+        self.scoped(|this| {
+            if recursive {
+                this.define(&f.name, t.clone().into());
+            }
+            for (p, t) in f.parameters.iter().zip(parameters) {
+                if let Some(d) = &p.default {
+                    let default = this.expression(d);
+                    // unless annotated, arguments of other types can be
+                    // given in its place
+                    if p.type_annotation.is_some() {
+                        this.expect(&t, &default, &d.span());
+                    }
+                }
+                this.destructure(&p.pattern, &t);
+            }
+            this.returns.push(match f.return_type {
+                Some(_) => Returns::Declared(result.clone()),
+                None => Returns::Inferred(vec![]),
+            });
+            let body = this.block(&f.body);
+            match this.returns.pop().expect("pushed above") {
+                // calling a generator returns an iterator, not what it
+                // returns, iterators are left to run time
+                _ if f.generator => {}
+                Returns::Declared(_) => {
+                    let span = match f.body.statements.last() {
+                        Some(s) => s.span(),
+                        None => f.body.span.clone(),
+                    };
+                    this.expect(&result, &body, &span);
+                }
+                Returns::Inferred(mut types) => {
+                    types.push(body);
+                    let returned = this.union(types);
+                    this.unify(&result, &returned);
+                }
+            }
+        });
+        self.level -= 1;
+        t
+    }
+
+    fn block(&mut self, b: &BlockExpression) -> Type {
+        self.scoped(|this| this.statements(&b.statements))
+    }
+
+    fn expression(&mut self, e: &Expression) -> Type {
+        match e {
+            Expression::Literal(l) => literal(&l.value),
+            Expression::Variable(v) => self.lookup(&v.name),
+            Expression::Group(g) => self.expression(&g.inner),
+            Expression::Unary(u) => {
+                let operand = self.expression(&u.rhs);
+                let operand = self.resolve(&operand);
+                if let Some(method) = self.method(&operand, values::unary_operator(u.op)) {
+                    let result = self.call(&method, vec![(operand, u.rhs.span())], &u.span);
+                    return match u.op {
+                        UnOperator::Str => Type::String,
+                        _ => result,
+                    };
+                }
+                let result = match u.op {
+                    UnOperator::Not => return Type::Bool,
+                    UnOperator::Str => return Type::String,
+                    UnOperator::Neg if operand.is_numeric() => return operand,
+                    UnOperator::Neg => Type::Any,
+                    UnOperator::BitNot => Type::Int,
+                };
+                if operand.is_known() && operand != Type::Int {
+                    let msg = format!("unsupported operand type for {}: {}", u.op, operand);
+                    self.error(msg, &u.span);
+                }
+                result
+            }
+            Expression::Binary(b) => {
+                let lhs = self.expression(&b.lhs);
+                let rhs = self.expression(&b.rhs);
+                self.binary(b.op, &lhs, &rhs, &b.span)
+            }
+            Expression::Call(c) => {
+                let callee = self.expression(&c.callee);
+                let arguments: Vec<(Type, SourceString)> = c
+                    .arguments
+                    .iter()
+                    .map(|a| (self.expression(a), a.span()))
+                    .collect();
+                match c.named.is_empty() {
+                    true => self.call(&callee, arguments, &c.span),
+                    false => self.call_named(&callee, &c.named),
+                }
+            }
+            Expression::Method(m) => {
+                let mut arguments: Vec<(Type, SourceString)> = [m.receiver.as_ref()]
+                    .into_iter()
+                    .chain(&m.arguments)
+                    .map(|a| (self.expression(a), a.span()))
+                    .collect();
+                // with `?.`, the call is only made on receivers that aren't
+                // `none`, which is the value otherwise
+                let mut nullable = false;
+                if m.optional {
+                    (arguments[0].0, nullable) = self.without_none(&arguments[0].0);
+                    if arguments[0].0 == Type::Never {
+                        return Type::None;
+                    }
+                }
+                let callee = match self.method(&arguments[0].0, Some(&m.name.name)) {
+                    Some(method) => method,
+                    None => self.lookup(&m.name.name),
+                };
+                let result = match m.named.is_empty() {
+                    true => self.call(&callee, arguments, &m.span),
+                    false => self.call_named(&callee, &m.named),
+                };
+                match nullable {
+                    true => self.union([result, Type::None]),
+                    false => result,
+                }
+            }
+            Expression::Field(f) => self.field(f),
+            // exports are only known once the module is loaded, variants
+            // with fields are called with them
+            Expression::Member(m) => match self.expression(&m.module) {
+                Type::Enum(e) => {
+                    let instance = Type::Struct(e.clone());
+                    match self.variants.get(&e).and_then(|v| v.get(&m.name.name)) {
+                        Some(Some(fields)) => {
+                            Type::Function(Some(fields.clone()), Box::new(instance))
+                        }
+                        Some(None) => instance,
+                        // reported by the checker
+                        None => Type::Any,
+                    }
+                }
+                _ => Type::Any,
+            },
+            Expression::Lambda(l) => self.function(&l.function, false, None),
+            Expression::List(l) => {
+                let items: Vec<Type> = l.items.iter().map(|i| self.expression(i)).collect();
+                let item = match items.is_empty() {
+                    true => self.fresh(),
+                    false => self.union(items),
+                };
+                Type::List(Box::new(item))
+            }
+            Expression::Map(m) => {
+                let (keys, values): (Vec<Type>, Vec<Type>) = m
+                    .entries
+                    .iter()
+                    .map(|(k, v)| (self.expression(k), self.expression(v)))
+                    .unzip();
+                let (k, v) = match keys.is_empty() {
+                    true => (self.fresh(), self.fresh()),
+                    false => (self.union(keys), self.union(values)),
+                };
+                Type::Map(Box::new(k), Box::new(v))
+            }
+            Expression::Index(i) => {
+                let target = self.expression(&i.target);
+                let target = self.resolve(&target);
+                match &i.index {
+                    Index::Single(index) => {
+                        let index_type = self.expression(index);
+                        if let Some(method) = self.method(&target, Some(values::INDEX)) {
+                            let arguments =
+                                vec![(target, i.target.span()), (index_type, index.span())];
+                            return self.call(&method, arguments, &i.span);
+                        }
+                        match target {
+                            Type::List(item) => {
+                                self.expect(&Type::Int, &index_type, &index.span());
+                                *item
+                            }
+                            Type::String => {
+                                self.expect(&Type::Int, &index_type, &index.span());
+                                Type::String
+                            }
+                            Type::Bytes => {
+                                self.expect(&Type::Int, &index_type, &index.span());
+                                Type::Int
+                            }
+                            // missing keys are `none`
+                            Type::Map(k, v) => {
+                                self.expect(&k, &index_type, &index.span());
+                                self.union([*v, Type::None])
+                            }
+                            t if t.is_known() => {
+                                self.error(format!("{} is not indexable", t), &i.span);
+                                Type::Any
+                            }
+                            _ => Type::Any,
+                        }
+                    }
+                    Index::Slice { start, end, step } => {
+                        let bound = Type::Union(vec![Type::Int, Type::None]);
+                        for part in [start, end, step].into_iter().flatten() {
+                            let t = self.expression(part);
+                            self.expect(&bound, &t, &part.span());
+                        }
+                        match target {
+                            t @ (Type::List(_) | Type::String | Type::Bytes) => t,
+                            t if t.is_known() => {
+                                self.error(format!("cannot slice {}", t), &i.span);
+                                Type::Any
+                            }
+                            _ => Type::Any,
+                        }
+                    }
+                }
+            }
+            Expression::Block(b) => self.block(b),
+            Expression::If(i) => {
+                let mut branches = vec![];
+                for (condition, body) in &i.branches {
+                    self.expression(condition);
+                    branches.push(self.block(body));
+                }
+                branches.push(match &i.otherwise {
+                    Some(b) => self.block(b),
+                    None => Type::None,
+                });
+                self.union(branches)
+            }
+            // the value is the one of a `break`
+            Expression::For(f) => {
+                if let Some(c) = &f.condition {
+                    self.expression(c);
+                }
+                self.block(&f.body);
+                Type::Any
+            }
+            Expression::ForIn(f) => {
+                let iterable = self.expression(&f.iterable);
+                let item = match self.resolve(&iterable) {
+                    Type::List(item) => *item,
+                    Type::String => Type::String,
+                    Type::Bytes => Type::Int,
+                    Type::Map(k, _) => *k,
+                    // functions are iterators, returning the items
+                    Type::Function(..) => Type::Any,
+                    t if t.is_known() => {
+                        self.error(format!("cannot iterate over {}", t), &f.iterable.span());
+                        Type::Any
+                    }
+                    _ => Type::Any,
+                };
+                self.scoped(|this| {
+                    this.destructure(&f.binding, &item);
+                    this.block(&f.body);
+                });
+                Type::Any
+            }
+            Expression::Match(m) => {
+                let subject = self.expression(&m.subject);
+                let arms: Vec<Type> = m
+                    .arms
+                    .iter()
+                    .map(|a| {
+                        self.scoped(|this| {
+                            this.pattern(&a.pattern, &subject);
+                            if let Some(g) = &a.guard {
+                                this.expression(g);
+                            }
+                            this.expression(&a.body)
+                        })
+                    })
+                    .collect();
+                self.union(arms)
+            }
+            Expression::Try(t) => {
+                let mut types = vec![self.block(&t.body)];
+                if let Some(c) = &t.catch {
+                    types.push(self.scoped(|this| {
+                        if let Some(name) = &c.name {
+                            this.define(name, Type::Any.into());
+                        }
+                        this.block(&c.body)
+                    }));
+                }
+                if let Some(f) = &t.finally {
+                    self.block(f);
+                }
+                self.union(types)
+            }
+            Expression::Spawn(s) => {
+                self.expression(&s.call);
+                Type::Task
+            }
+        }
+    }
+
+    /// `target[index] = value` for a struct overloading it, returns `None`
+    /// for other assignments
+    fn set_index(&mut self, a: &Assignment, value: &Type) -> Option<Type> {
+        let Expression::Index(i) = &a.target else {
+            return None;
+        };
+        let (Index::Single(index), None) = (&i.index, a.op.bin_operator()) else {
+            return None;
+        };
+        let target = self.expression(&i.target);
+        let method = self.method(&target, Some(values::SET_INDEX))?;
+        let arguments = vec![
+            (target, i.target.span()),
+            (self.expression(index), index.span()),
+            (value.clone(), a.value.span()),
+        ];
+        self.call(&method, arguments, &i.span);
+        Some(Type::None)
+    }
+
+    /// the type of the method with the name, if the type is a struct or an
+    /// interface having one
+    fn method(&mut self, t: &Type, name: Option<&str>) -> Option<Type> {
+        let scheme = match self.resolve(t) {
+            Type::Struct(s) => self.structs.get(&s)?.methods.get(name?)?.clone(),
+            Type::Interface(i) => {
+                let methods = self.interfaces.get(&i)?;
+                let (_, t) = methods.iter().find(|(m, _)| Some(m.as_str()) == name)?;
+                t.clone().into()
+            }
+            _ => return None,
+        };
+        Some(self.instantiate(&scheme))
+    }
+
+    /// the type of the field, reports fields the target can never have.
+    /// With `?.`, the field is of the target if it isn't `none`.
+    fn field(&mut self, f: &FieldExpression) -> Type {
+        let target = self.expression(&f.target);
+        let (target, nullable) = match f.optional {
+            true => self.without_none(&target),
+            false => (self.resolve(&target), false),
+        };
+        if nullable {
+            if target == Type::Never {
+                return Type::None;
+            }
+            let field = self.field_of(&target, f);
+            return self.union([field, Type::None]);
+        }
+        self.field_of(&target, f)
+    }
+
+    fn field_of(&mut self, target: &Type, f: &FieldExpression) -> Type {
+        let field = match target {
+            Type::Struct(name) => self.structs.get(name).map(|s| {
+                s.fields
+                    .iter()
+                    .find(|(field, _)| *field == f.name.name)
+                    .map(|(_, t)| t.clone())
+            }),
+            t if t.is_known() => Some(None),
+            _ => None,
+        };
+        match field {
+            Some(Some(t)) => t,
+            Some(None) => {
+                self.diagnostics.push(DragonError::new(
+                    ErrorCode::UnknownField,
+                    values::no_field(&target.to_string(), &f.name.name),
+                    Some(f.name.span.clone()),
+                ));
+                Type::Any
+            }
+            None => Type::Any,
+        }
+    }
+
+    /// define the bindings of a pattern that the value must match, reporting
+    /// the parts of it that no value of the type can match
+    fn destructure(&mut self, p: &Pattern, t: &Type) {
+        self.impossible(p, t);
+        self.pattern(p, t);
+    }
+
+    fn impossible(&mut self, p: &Pattern, t: &Type) {
+        let t = self.resolve(t);
+        match (p, &t) {
+            (Pattern::List(l), Type::List(item)) => {
+                for p in &l.items {
+                    self.impossible(p, item);
+                }
+            }
+            (Pattern::Map(m), Type::Map(_, value)) => {
+                for (_, p) in &m.entries {
+                    self.impossible(p, value);
+                }
+            }
+            (Pattern::List(_) | Pattern::Map(_), t) if t.is_known() => {
+                let kind = match p {
+                    Pattern::List(_) => "list",
+                    _ => "map",
+                };
+                let msg = format!("cannot destructure {} with a {} pattern", t, kind);
+                self.error(msg, &p.span());
+            }
+            (Pattern::Literal(l), t) if t.is_known() && !self.attempt(t, &literal(&l.value)) => {
+                let msg = format!("{} never matches a value of type {}", l.span, t);
+                self.error(msg, &l.span);
+            }
+            (Pattern::Variant(v), Type::Struct(name))
+                if v.path.len() == 2 && v.path[0].name == *name =>
+            {
+                let fields = self.variant_fields(&v.path).cloned().flatten();
+                for (p, t) in v.fields.iter().flatten().zip(fields.iter().flatten()) {
+                    self.impossible(p, t);
+                }
+            }
+            (Pattern::Variant(v), t) if t.is_known() && v.path.len() == 2 => {
+                let msg = format!("{} never matches a value of type {}", v.name(), t);
+                self.error(msg, &v.span);
+            }
+            _ => {}
+        }
+    }
+
+    /// define the bindings of the pattern, with the types of the parts of
+    /// the subject they are bound to
+    fn pattern(&mut self, p: &Pattern, subject: &Type) {
+        match p {
+            Pattern::Binding(i) => self.define(i, subject.clone().into()),
+            Pattern::List(l) => {
+                let item = match self.resolve(subject) {
+                    Type::List(item) => *item,
+                    _ => Type::Any,
+                };
+                for i in &l.items {
+                    self.pattern(i, &item);
+                }
+                if let Some(b) = l.rest.as_ref().and_then(|r| r.binding.as_ref()) {
+                    self.define(b, Type::List(Box::new(item)).into());
+                }
+            }
+            Pattern::Map(m) => {
+                let value = match self.resolve(subject) {
+                    Type::Map(_, value) => *value,
+                    _ => Type::Any,
+                };
+                for (_, p) in &m.entries {
+                    self.pattern(p, &value);
+                }
+            }
+            Pattern::Variant(v) => {
+                let fields = self.variant_fields(&v.path).cloned().flatten();
+                for (i, p) in v.fields.iter().flatten().enumerate() {
+                    let t = fields.as_ref().and_then(|f| f.get(i).cloned());
+                    self.pattern(p, &t.unwrap_or(Type::Any));
+                }
+            }
+            Pattern::Wildcard(_) | Pattern::Literal(_) => {}
+        }
+    }
+
+    /// the type of the result of calling a value of the type, a variable
+    /// becomes a function taking the arguments
+    fn call(
+        &mut self,
+        callee: &Type,
+        arguments: Vec<(Type, SourceString)>,
+        span: &SourceString,
+    ) -> Type {
+        match self.resolve(callee) {
+            // a wrong number of arguments is reported by the checker
+            Type::Function(Some(parameters), result) if parameters.len() == arguments.len() => {
+                for (p, (a, span)) in parameters.iter().zip(&arguments) {
+                    self.expect(p, a, span);
+                }
+                *result
+            }
+            Type::Function(_, result) => *result,
+            Type::Var(v) => {
+                let result = self.fresh();
+                let parameters = arguments.into_iter().map(|(a, _)| a).collect();
+                let t = Type::Function(Some(parameters), Box::new(result.clone()));
+                self.bind(v, &t);
+                result
+            }
+            t if t.is_known() => {
+                self.error(format!("{} is not callable", t), span);
+                Type::Any
+            }
+            _ => Type::Any,
+        }
+    }
+
+    /// the type of the result of a call giving arguments by name, the
+    /// parameters they go to are left to the checker
+    fn call_named(&mut self, callee: &Type, named: &[NamedArgument]) -> Type {
+        for n in named {
+            self.expression(&n.value);
+        }
+        match self.resolve(callee) {
+            Type::Function(_, result) => *result,
+            _ => Type::Any,
+        }
+    }
+
+    /// the type of the result of the operator, reports operands it can never
+    /// be applied to
+    fn binary(&mut self, op: BinOperator, lhs: &Type, rhs: &Type, span: &SourceString) -> Type {
+        use BinOperator as Op;
+        let (lhs, rhs) = (self.resolve(lhs), self.resolve(rhs));
+        if let Some(method) = self.method(&lhs, values::operator(op)) {
+            let arguments = vec![(lhs, span.clone()), (rhs, span.clone())];
+            let result = self.call(&method, arguments, span);
+            return match op {
+                Op::Ne => Type::Bool,
+                _ => result,
+            };
+        }
+        // the operand on the left may be an instance overloading it
+        if !lhs.is_known()
+            && matches!(rhs, Type::Struct(_) | Type::Interface(_))
+            && values::operator(op).is_some()
+        {
+            return Type::Any;
+        }
+        let known = lhs.is_known() && rhs.is_known();
+        // whether the given operand types are valid, operands that aren't
+        // known are assumed to be
+        let supports = |valid: fn(&Type) -> bool| {
+            (!lhs.is_known() || valid(&lhs)) && (!rhs.is_known() || valid(&rhs))
+        };
+        let (valid, result) = match op {
+            Op::Eq | Op::Ne | Op::And | Op::Or | Op::Xor => (true, Type::Bool),
+            // narrowed to the values on the left that are not `none`
+            Op::Coalesce => {
+                let present = self.without_none(&lhs).0;
+                return self.union([present, rhs]);
+            }
+            Op::Lt | Op::Le | Op::Gt | Op::Ge => {
+                let comparable = !known
+                    || (lhs.is_numeric() && rhs.is_numeric())
+                    || (lhs == Type::String && rhs == Type::String)
+                    || (lhs == Type::Bytes && rhs == Type::Bytes);
+                if !comparable {
+                    let msg = format!("cannot compare {} with {}", lhs, rhs);
+                    self.error(msg, span);
+                }
+                return Type::Bool;
+            }
+            Op::In => {
+                let valid = match &rhs {
+                    Type::List(_) | Type::Map(_, _) => true,
+                    Type::String => !lhs.is_known() || lhs == Type::String,
+                    Type::Bytes => !lhs.is_known() || matches!(lhs, Type::Int | Type::Bytes),
+                    t => !t.is_known(),
+                };
+                if !valid {
+                    // the same order as the error at run time
+                    let msg = format!("unsupported operand types for in: {} and {}", rhs, lhs);
+                    self.error(msg, span);
+                }
+                return Type::Bool;
+            }
+            Op::Pow | Op::Mul | Op::Div | Op::Mod | Op::Add | Op::Sub => {
+                let result = match (&lhs, &rhs) {
+                    (Type::Int, Type::Int) => Type::Int,
+                    (Type::Float, _) | (_, Type::Float) => Type::Float,
+                    _ => Type::Any,
+                };
+                (supports(Type::is_numeric), result)
+            }
+            Op::Concat => match (&lhs, &rhs) {
+                (Type::String, Type::String) => (true, Type::String),
+                (Type::Bytes, Type::Bytes) => (true, Type::Bytes),
+                (Type::List(a), Type::List(b)) => {
+                    let item = self.union([*a.clone(), *b.clone()]);
+                    (true, Type::List(Box::new(item)))
+                }
+                (t, u) if t.is_known() && u.is_known() => (false, Type::Any),
+                (Type::String, _) | (_, Type::String) => {
+                    (supports(|t| *t == Type::String), Type::String)
+                }
+                (Type::List(_), _) | (_, Type::List(_)) => (
+                    supports(|t| matches!(t, Type::List(_))),
+                    Type::List(Box::new(Type::Any)),
+                ),
+                (Type::Bytes, _) | (_, Type::Bytes) => {
+                    (supports(|t| *t == Type::Bytes), Type::Bytes)
+                }
+                (t, u) => (!t.is_known() && !u.is_known(), Type::Any),
+            },
+            Op::BitAnd | Op::BitOr | Op::BitXor | Op::Shl | Op::Lsr | Op::Asr => {
+                (supports(|t| *t == Type::Int), Type::Int)
+            }
+        };
+        if !valid {
+            let msg = format!(
+                "unsupported operand types for {}: {} and {}",
+                op,
+                self.zonk(&lhs),
+                self.zonk(&rhs)
+            );
+            self.error(msg, span);
+        }
+        result
+    }
+}
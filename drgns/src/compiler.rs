@@ -0,0 +1,1225 @@
+//! Lowers the AST to bytecode, see `bytecode` for the format.
+//!
+//! Every statement leaves exactly one value on the stack, the value of a
+//! sequence of statements is the one of the last statement. This keeps the
+//! height of the stack known at compile time, which `break` and `continue`
+//! rely on to discard the values of the expressions they jump out of.
+
+use std::{
+    borrow::Cow,
+    collections::HashSet,
+    sync::{
+        atomic::{AtomicU8, Ordering},
+        Arc,
+    },
+};
+
+use crate::{
+    bytecode::{Capture, Layout, Op, Prototype},
+    doc,
+    eh::ErrorCode,
+    interpreter,
+    parser::{
+        Arity, Assignment, BinOperator, BlockExpression, CatchClause, Expression, FieldExpression,
+        ForExpression, ForInExpression, FunctionDeclaration, Identifier, IfExpression, Index,
+        IndexExpression, Literal, MatchExpression, NamedArgument, Pattern, Program, Statement,
+        TryExpression,
+    },
+    source::SourceString,
+};
+
+mod optimizer;
+mod resolver;
+
+/// How much programs are optimized as they are compiled
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum OptLevel {
+    /// compile programs as they are written, for debugging
+    #[default]
+    #[value(name = "0")]
+    None,
+    /// fold constants, drop the code that can't run and the instructions
+    /// that do nothing, see `optimizer`
+    #[value(name = "1")]
+    Basic,
+}
+
+/// the level `compile` optimizes at, by its variant
+static OPT_LEVEL: AtomicU8 = AtomicU8::new(OptLevel::None as u8);
+
+/// Optimize the programs `compile` compiles from now on, in all threads,
+/// including the modules they import
+pub fn set_opt_level(level: OptLevel) {
+    OPT_LEVEL.store(level as u8, Ordering::Relaxed);
+}
+
+pub fn opt_level() -> OptLevel {
+    match OPT_LEVEL.load(Ordering::Relaxed) {
+        0 => OptLevel::None,
+        _ => OptLevel::Basic,
+    }
+}
+
+/// Compile a program to the prototype of a function taking no arguments,
+/// optimized at the level `set_opt_level` set, none unless it was called
+pub fn compile(program: &Program) -> Arc<Prototype> {
+    compile_at(program, opt_level())
+}
+
+/// Compile a program optimized at the level
+pub fn compile_at(program: &Program, level: OptLevel) -> Arc<Prototype> {
+    let program = match level {
+        OptLevel::None => Cow::Borrowed(program),
+        OptLevel::Basic => Cow::Owned(optimizer::optimize(program)),
+    };
+    let mut compiler = Compiler {
+        captured: resolver::captured(&program),
+        functions: vec![FunctionState::new("<script>", Arity::exactly(0))],
+        deferred: vec![],
+        level,
+    };
+    compiler.statements(&program.statements);
+    compiler.emit(Op::Return, None);
+    let script = compiler
+        .functions
+        .pop()
+        .expect("the script is always compiled");
+    Arc::new(script.finish(level))
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Storage {
+    Slot(u32),
+    Cell(u32),
+}
+
+#[derive(Debug)]
+struct Local {
+    name: String,
+    storage: Storage,
+    mutable: bool,
+    scope: usize,
+}
+
+/// Where a name was found
+#[derive(Debug, Clone, Copy)]
+enum Variable {
+    Slot(u32),
+    Cell(u32),
+    Free(u32),
+    Global,
+}
+
+#[derive(Debug, PartialEq)]
+enum TargetKind {
+    Loop,
+    Block,
+}
+
+/// Something `break` or `continue` can jump out of
+#[derive(Debug)]
+struct Target {
+    kind: TargetKind,
+
+    /// the height of the stack before entering it
+    depth: i64,
+
+    /// where `continue` jumps to
+    start: usize,
+
+    /// the jumps to patch once the end is known
+    breaks: Vec<usize>,
+}
+
+/// A `try` whose handler is installed at the instruction being compiled
+#[derive(Debug, Clone)]
+struct Handler {
+    /// run when jumping out of the `try`
+    finally: Option<BlockExpression>,
+
+    /// the number of targets enclosing it
+    targets: usize,
+}
+
+/// The function being compiled, together with its own scopes
+struct FunctionState {
+    proto: Prototype,
+    locals: Vec<Local>,
+    scope: usize,
+
+    /// names of the captured cells and their mutability
+    free: Vec<(String, bool)>,
+    targets: Vec<Target>,
+    handlers: Vec<Handler>,
+
+    /// the height of the stack at the current instruction
+    depth: i64,
+
+    /// cells created at the start of the block declaring them, by declaration
+    pending: Vec<(usize, u32)>,
+}
+
+impl FunctionState {
+    fn new(name: &str, arity: Arity) -> Self {
+        Self {
+            proto: Prototype {
+                name: name.to_owned(),
+                arity,
+                slots: arity.parameters(),
+                ..Default::default()
+            },
+            locals: vec![],
+            scope: 0,
+            free: vec![],
+            targets: vec![],
+            handlers: vec![],
+            depth: 0,
+            pending: vec![],
+        }
+    }
+
+    fn finish(mut self, level: OptLevel) -> Prototype {
+        if level == OptLevel::Basic {
+            optimizer::peephole(&mut self.proto.chunk);
+        }
+        // generators run in frames of their own, that calls can't take over
+        if !self.proto.generator {
+            tail_calls(&mut self.proto.chunk.code);
+        }
+        self.proto
+    }
+}
+
+/// Turn the calls whose value is returned right away into tail calls, so
+/// that recursion in tail position runs in constant space. Jumps are followed,
+/// and so are slides, since returning discards the values below the top one.
+fn tail_calls(code: &mut [Op]) {
+    for i in 0..code.len() {
+        let tail = match code[i] {
+            Op::Call(argc) => Op::TailCall(argc),
+            Op::CallNamed(argc, names) => Op::TailCallNamed(argc, names),
+            _ => continue,
+        };
+        let mut next = i + 1;
+        // jumps can't loop here, but the bound costs nothing
+        for _ in 0..code.len() {
+            match code.get(next) {
+                Some(Op::Jump(t)) => next = *t as usize,
+                Some(Op::Slide(_)) => next += 1,
+                _ => break,
+            }
+        }
+        if code.get(next) == Some(&Op::Return) {
+            code[i] = tail;
+        }
+    }
+}
+
+struct Compiler {
+    captured: HashSet<usize>,
+
+    /// innermost function last
+    functions: Vec<FunctionState>,
+
+    /// functions to compile at the end of each sequence of statements being
+    /// compiled, with the index of their prototype
+    deferred: Vec<Vec<(Arc<FunctionDeclaration>, usize)>>,
+    level: OptLevel,
+}
+
+impl Compiler {
+    fn current(&mut self) -> &mut FunctionState {
+        self.functions
+            .last_mut()
+            .expect("there is always a function being compiled")
+    }
+
+    fn emit(&mut self, op: Op, span: Option<&SourceString>) -> usize {
+        let f = self.current();
+        f.depth += op.stack_effect();
+        f.proto.chunk.code.push(op);
+        f.proto.chunk.source_map.push(span);
+        f.proto.chunk.code.len() - 1
+    }
+
+    fn here(&mut self) -> usize {
+        self.current().proto.chunk.code.len()
+    }
+
+    fn depth(&mut self) -> i64 {
+        self.current().depth
+    }
+
+    fn set_depth(&mut self, depth: i64) {
+        self.current().depth = depth;
+    }
+
+    /// point the jump at the given index to the next instruction
+    fn patch(&mut self, jump: usize) {
+        let target = self.here() as u32;
+        match optimizer::target_mut(&mut self.current().proto.chunk.code[jump]) {
+            Some(t) => *t = target,
+            None => crate::assert_unreachable!(),
+        }
+    }
+
+    fn constant(&mut self, value: crate::values::Value) -> u32 {
+        let constants = &mut self.current().proto.chunk.constants;
+        constants.push(value);
+        (constants.len() - 1) as u32
+    }
+
+    fn name(&mut self, name: &str) -> u32 {
+        let names = &mut self.current().proto.chunk.names;
+        match names.iter().position(|n| n.as_ref() == name) {
+            Some(i) => i as u32,
+            None => {
+                names.push(crate::values::intern(name));
+                (names.len() - 1) as u32
+            }
+        }
+    }
+
+    /// raise an error at run-time, errors found while compiling are left to
+    /// the checker, so that both engines behave the same
+    fn fail(&mut self, code: ErrorCode, msg: String, span: &SourceString) {
+        let errors = &mut self.current().proto.chunk.errors;
+        errors.push((code, msg));
+        let i = (errors.len() - 1) as u32;
+        self.emit(Op::Fail(i), Some(span));
+    }
+
+    fn new_slot(&mut self) -> u32 {
+        let f = self.current();
+        f.proto.slots += 1;
+        (f.proto.slots - 1) as u32
+    }
+
+    fn new_cell(&mut self) -> u32 {
+        let f = self.current();
+        f.proto.cells += 1;
+        (f.proto.cells - 1) as u32
+    }
+
+    /// globals are the declarations at the top level of the script
+    fn is_global_scope(&self) -> bool {
+        self.functions.len() == 1 && self.functions[0].scope == 0
+    }
+
+    /// start a scope declaring the given statements, captured variables get
+    /// a fresh cell each time the scope is entered
+    fn begin_scope(&mut self, statements: &[Statement]) {
+        self.current().scope += 1;
+        for s in statements {
+            let names = match s {
+                Statement::Declaration(d) => vec![&d.name],
+                Statement::Destructuring(d) => d.pattern.bindings(),
+                Statement::Function(f) => vec![&f.name],
+                Statement::Struct(s) => vec![&s.name],
+                Statement::Enum(e) => vec![&e.name],
+                Statement::Import(i) => vec![i.name()],
+                _ => continue,
+            };
+            for name in names {
+                self.fresh_cell(name);
+            }
+        }
+    }
+
+    /// give the declaration a fresh cell if it is captured, `define` then
+    /// stores its value in it
+    fn fresh_cell(&mut self, name: &Identifier) {
+        let key = resolver::key(name);
+        if self.captured.contains(&key) {
+            let cell = self.new_cell();
+            self.current().pending.push((key, cell));
+            self.emit(Op::NewCell(cell), None);
+        }
+    }
+
+    fn end_scope(&mut self) {
+        let f = self.current();
+        f.scope -= 1;
+        let scope = f.scope;
+        f.locals.retain(|l| l.scope <= scope);
+    }
+
+    /// bind the parts of the value on top of the stack to new variables, the
+    /// names of the pattern, raising an error if it doesn't match
+    fn destructure(&mut self, pattern: &Pattern, mutable: bool) {
+        if let Pattern::Binding(name) = pattern {
+            return self.define(name, mutable);
+        }
+        let patterns = &mut self.current().proto.chunk.patterns;
+        patterns.push(pattern.clone());
+        let index = (patterns.len() - 1) as u32;
+        self.emit(Op::Destructure(index), Some(&pattern.span()));
+        let bindings = pattern.bindings();
+        self.emit(Op::Unpack(bindings.len() as u32), None);
+        for b in bindings.iter().rev() {
+            self.define(b, mutable);
+        }
+    }
+
+    /// bind the value on top of the stack to a new variable
+    fn define(&mut self, name: &Identifier, mutable: bool) {
+        if self.is_global_scope() {
+            let n = self.name(&name.name);
+            self.emit(Op::DefineGlobal(n, mutable), Some(&name.span));
+            return;
+        }
+        let key = resolver::key(name);
+        let pending = self
+            .current()
+            .pending
+            .iter()
+            .rev()
+            .find(|(k, _)| *k == key)
+            .copied();
+        let storage = match pending {
+            Some((_, cell)) => {
+                self.emit(Op::SetCell(cell), Some(&name.span));
+                Storage::Cell(cell)
+            }
+            None => {
+                let slot = self.new_slot();
+                self.emit(Op::SetLocal(slot), Some(&name.span));
+                Storage::Slot(slot)
+            }
+        };
+        let f = self.current();
+        let scope = f.scope;
+        f.locals.push(Local {
+            name: name.name.clone(),
+            storage,
+            mutable,
+            scope,
+        });
+    }
+
+    fn resolve(&mut self, name: &str) -> (Variable, bool) {
+        let level = self.functions.len() - 1;
+        self.resolve_in(level, name)
+            .unwrap_or((Variable::Global, true))
+    }
+
+    /// find the name in the function at the given level, capturing it from
+    /// the enclosing functions if needed
+    fn resolve_in(&mut self, level: usize, name: &str) -> Option<(Variable, bool)> {
+        let f = &self.functions[level];
+        if let Some(l) = f.locals.iter().rev().find(|l| l.name == name) {
+            let variable = match l.storage {
+                Storage::Slot(s) => Variable::Slot(s),
+                Storage::Cell(c) => Variable::Cell(c),
+            };
+            return Some((variable, l.mutable));
+        }
+        if let Some(i) = f.free.iter().position(|(n, _)| n == name) {
+            return Some((Variable::Free(i as u32), f.free[i].1));
+        }
+        if level == 0 {
+            return None;
+        }
+        let (variable, mutable) = self.resolve_in(level - 1, name)?;
+        let capture = match variable {
+            Variable::Cell(c) => Capture::Cell(c),
+            Variable::Free(i) => Capture::Free(i),
+            // the resolver makes every captured variable a cell
+            Variable::Slot(_) | Variable::Global => crate::assert_unreachable!(),
+        };
+        let f = &mut self.functions[level];
+        f.free.push((name.to_owned(), mutable));
+        f.proto.captures.push(capture);
+        Some((Variable::Free((f.free.len() - 1) as u32), mutable))
+    }
+
+    fn get(&mut self, name: &Identifier) {
+        let op = match self.resolve(&name.name).0 {
+            Variable::Slot(s) => Op::GetLocal(s),
+            Variable::Cell(c) => Op::GetCell(c),
+            Variable::Free(i) => Op::GetFree(i),
+            Variable::Global => Op::GetGlobal(self.name(&name.name)),
+        };
+        self.emit(op, Some(&name.span));
+    }
+
+    /// compile a sequence of statements, function bodies are compiled last so
+    /// that they can refer to everything declared in the sequence
+    fn statements(&mut self, statements: &[Statement]) {
+        if statements.is_empty() {
+            self.emit(Op::None, None);
+            return;
+        }
+        self.deferred.push(vec![]);
+        for (i, s) in statements.iter().enumerate() {
+            if i > 0 {
+                self.emit(Op::Pop, None);
+            }
+            let depth = self.depth();
+            match s {
+                Statement::Function(f) => {
+                    self.closure(f);
+                    self.define(&f.name, false);
+                    self.emit(Op::None, None);
+                }
+                Statement::Struct(s) => {
+                    for m in &s.methods {
+                        self.closure(m);
+                    }
+                    let layout = Layout {
+                        name: s.name.name.clone(),
+                        fields: s.fields.iter().map(|f| f.name.name.clone()).collect(),
+                        methods: s.methods.iter().map(|m| m.name.name.clone()).collect(),
+                        variants: vec![],
+                    };
+                    let structs = &mut self.current().proto.chunk.structs;
+                    structs.push(layout);
+                    let index = (structs.len() - 1) as u32;
+                    let methods = s.methods.len() as u32;
+                    self.emit(Op::Struct(index, methods), Some(&s.name.span));
+                    self.define(&s.name, false);
+                    self.emit(Op::None, None);
+                }
+                Statement::Enum(e) => {
+                    for m in &e.methods {
+                        self.closure(m);
+                    }
+                    let variants = e.variants.iter().map(|v| {
+                        let fields = v.fields.as_ref();
+                        let names = fields.map(|f| f.iter().map(|f| f.name.name.clone()).collect());
+                        (v.name.name.clone(), names)
+                    });
+                    let layout = Layout {
+                        name: e.name.name.clone(),
+                        fields: vec![],
+                        methods: e.methods.iter().map(|m| m.name.name.clone()).collect(),
+                        variants: variants.collect(),
+                    };
+                    let structs = &mut self.current().proto.chunk.structs;
+                    structs.push(layout);
+                    let index = (structs.len() - 1) as u32;
+                    let methods = e.methods.len() as u32;
+                    self.emit(Op::Enum(index, methods), Some(&e.name.span));
+                    self.define(&e.name, false);
+                    self.emit(Op::None, None);
+                }
+                s => self.statement(s),
+            }
+            // statements that jump away leave nothing behind, but the code
+            // following them expects a value
+            self.set_depth(depth + 1);
+        }
+        self.compile_deferred();
+    }
+
+    /// compile the bodies of the functions deferred since the last push
+    fn compile_deferred(&mut self) {
+        let functions = self.deferred.pop().expect("pushed by the caller");
+        for (f, index) in functions {
+            let prototype = self.function(&f);
+            self.current().proto.chunk.functions[index] = Arc::new(prototype);
+        }
+    }
+
+    /// push a closure over the function, its body is compiled at the end of
+    /// the current sequence of statements
+    fn closure(&mut self, f: &Arc<FunctionDeclaration>) {
+        let index = {
+            let functions = &mut self.current().proto.chunk.functions;
+            functions.push(Arc::default());
+            functions.len() - 1
+        };
+        self.emit(Op::Closure(index as u32), Some(&f.span));
+        self.deferred
+            .last_mut()
+            .expect("expressions are always in a sequence of statements")
+            .push((f.clone(), index));
+    }
+
+    fn statement(&mut self, s: &Statement) {
+        match s {
+            Statement::Declaration(d) => {
+                self.expression(&d.value);
+                self.define(&d.name, d.mutable);
+                self.emit(Op::None, None);
+            }
+            Statement::Destructuring(d) => {
+                self.expression(&d.value);
+                self.destructure(&d.pattern, d.mutable);
+                self.emit(Op::None, None);
+            }
+            // handled by `statements`
+            Statement::Function(_) | Statement::Struct(_) | Statement::Enum(_) => {
+                crate::assert_unreachable!()
+            }
+            Statement::Assignment(a) => self.assignment(a),
+            Statement::Expression(e) => self.expression(e),
+            Statement::Exit(e) => {
+                self.expression(&e.code);
+                self.emit(Op::Exit, Some(&e.code.span()));
+            }
+            Statement::Throw(t) => {
+                self.expression(&t.value);
+                self.emit(Op::Throw, Some(&t.span));
+            }
+            Statement::Defer(d) => {
+                if self.functions.len() == 1 {
+                    self.escaped("defer outside of a function", &d.span);
+                } else {
+                    self.closure(&d.function);
+                    self.emit(Op::Defer, Some(&d.span));
+                }
+                self.emit(Op::None, None);
+            }
+            Statement::Import(i) => {
+                let imports = &mut self.current().proto.chunk.imports;
+                imports.push(i.clone());
+                let index = (imports.len() - 1) as u32;
+                self.emit(Op::Import(index), Some(&i.span));
+                self.define(i.name(), false);
+                self.emit(Op::None, None);
+            }
+            // only a type, for the checker
+            Statement::Interface(_) => {
+                self.emit(Op::None, None);
+            }
+            Statement::Return(r) => {
+                self.optional(&r.value);
+                self.leave(0);
+                if self.functions.len() == 1 {
+                    self.escaped("return outside of a function", &r.span);
+                } else {
+                    self.emit(Op::Return, Some(&r.span));
+                }
+            }
+            Statement::Yield(y) => {
+                self.optional(&y.value);
+                if self.functions.len() == 1 {
+                    self.escaped("yield outside of a function", &y.span);
+                } else {
+                    self.emit(Op::Yield, Some(&y.span));
+                }
+            }
+            Statement::Break(b) => {
+                self.optional(&b.value);
+                let targets = self.current().targets.len();
+                self.leave(targets);
+                let Some(depth) = self.current().targets.last().map(|t| t.depth) else {
+                    return self.escaped("break outside of a loop or block", &b.span);
+                };
+                let n = self.depth() - 1 - depth;
+                self.emit(Op::Slide(n as u32), Some(&b.span));
+                let jump = self.emit(Op::Jump(0), Some(&b.span));
+                let target = self.current().targets.last_mut().expect("checked above");
+                target.breaks.push(jump);
+            }
+            Statement::Continue(c) => {
+                self.optional(&c.value);
+                self.emit(Op::Pop, None);
+                let target = self
+                    .current()
+                    .targets
+                    .iter()
+                    .rposition(|t| t.kind == TargetKind::Loop);
+                self.leave(target.map_or(0, |i| i + 1));
+                let Some((depth, start)) = target.map(|i| {
+                    let t = &self.current().targets[i];
+                    (t.depth, t.start)
+                }) else {
+                    return self.escaped("continue outside of a loop", &c.span);
+                };
+                let n = self.depth() - depth;
+                self.emit(Op::PopN(n as u32), Some(&c.span));
+                self.emit(Op::Jump(start as u32), Some(&c.span));
+            }
+        }
+    }
+
+    /// uninstall the handlers of the `try` expressions enclosed by the given
+    /// number of targets, running their `finally` blocks, before jumping out
+    /// of them
+    fn leave(&mut self, targets: usize) {
+        let handlers = self.current().handlers.clone();
+        for (i, h) in handlers.iter().enumerate().rev() {
+            if h.targets < targets {
+                break;
+            }
+            self.emit(Op::EndTry, None);
+            if let Some(f) = &h.finally {
+                // jumps out of the `finally` block only leave the outer ones
+                self.current().handlers.truncate(i);
+                self.block(f);
+                self.emit(Op::Pop, None);
+            }
+        }
+        self.current().handlers = handlers;
+    }
+
+    fn escaped(&mut self, msg: &str, span: &SourceString) {
+        self.fail(ErrorCode::Runtime, msg.to_string(), span);
+    }
+
+    fn optional(&mut self, e: &Option<Expression>) {
+        match e {
+            Some(e) => self.expression(e),
+            None => {
+                self.emit(Op::None, None);
+            }
+        }
+    }
+
+    fn assignment(&mut self, a: &Assignment) {
+        let target = match &a.target {
+            Expression::Variable(target) => target,
+            Expression::Index(i) => return self.index_assignment(i, a),
+            Expression::Field(f) => return self.field_assignment(f, a),
+            _ => crate::assert_unreachable!(),
+        };
+        let (variable, mutable) = self.resolve(&target.name);
+        match a.op.bin_operator() {
+            Some(op) => {
+                self.get(target);
+                self.expression(&a.value);
+                self.emit(Op::Binary(op), Some(&a.span));
+            }
+            None => self.expression(&a.value),
+        }
+        if !mutable {
+            self.fail(
+                ErrorCode::ImmutableAssignment,
+                format!(
+                    "cannot assign twice to immutable variable '{}'",
+                    target.name
+                ),
+                &target.span,
+            );
+            self.emit(Op::Pop, None);
+        } else {
+            let op = match variable {
+                Variable::Slot(s) => Op::SetLocal(s),
+                Variable::Cell(c) => Op::SetCell(c),
+                Variable::Free(i) => Op::SetFree(i),
+                Variable::Global => Op::SetGlobal(self.name(&target.name)),
+            };
+            self.emit(op, Some(&target.span));
+        }
+        self.emit(Op::None, None);
+    }
+
+    /// the target and index are evaluated once, compound assignments keep a
+    /// copy of both to read the current item
+    fn index_assignment(&mut self, i: &IndexExpression, a: &Assignment) {
+        let Index::Single(index) = &i.index else {
+            crate::assert_unreachable!();
+        };
+        self.expression(&i.target);
+        self.expression(index);
+        match a.op.bin_operator() {
+            Some(op) => {
+                self.emit(Op::Duplicate(2), None);
+                self.emit(Op::Index, Some(&i.span));
+                self.expression(&a.value);
+                self.emit(Op::Binary(op), Some(&a.span));
+            }
+            None => self.expression(&a.value),
+        }
+        self.emit(Op::SetIndex, Some(&i.span));
+        self.emit(Op::None, None);
+    }
+
+    /// like `index_assignment`, for the field of an instance
+    fn field_assignment(&mut self, f: &FieldExpression, a: &Assignment) {
+        self.expression(&f.target);
+        let name = self.name(&f.name.name);
+        match a.op.bin_operator() {
+            Some(op) => {
+                self.emit(Op::Duplicate(1), None);
+                self.emit(Op::GetField(name), Some(&f.name.span));
+                self.expression(&a.value);
+                self.emit(Op::Binary(op), Some(&a.span));
+            }
+            None => self.expression(&a.value),
+        }
+        self.emit(Op::SetField(name), Some(&f.name.span));
+        self.emit(Op::None, None);
+    }
+
+    fn expression(&mut self, e: &Expression) {
+        match e {
+            Expression::Binary(be) if be.op.is_short_circuit() => {
+                self.expression(&be.lhs);
+                let short = match be.op {
+                    BinOperator::And => self.emit(Op::JumpIfFalse(0), None),
+                    _ => self.emit(Op::JumpIfTrue(0), None),
+                };
+                let depth = self.depth();
+                self.expression(&be.rhs);
+                self.emit(Op::ToBool, None);
+                let end = self.emit(Op::Jump(0), None);
+                self.set_depth(depth);
+                self.patch(short);
+                match be.op {
+                    BinOperator::And => self.emit(Op::False, None),
+                    _ => self.emit(Op::True, None),
+                };
+                self.patch(end);
+            }
+            Expression::Binary(be) if be.op == BinOperator::Coalesce => {
+                self.expression(&be.lhs);
+                let given = self.emit(Op::JumpIfNotNone(0), None);
+                self.emit(Op::Pop, None);
+                self.expression(&be.rhs);
+                self.patch(given);
+            }
+            Expression::Binary(be) => {
+                self.expression(&be.lhs);
+                self.expression(&be.rhs);
+                self.emit(Op::Binary(be.op), Some(&be.span));
+            }
+            Expression::Unary(ue) => {
+                self.expression(&ue.rhs);
+                self.emit(Op::Unary(ue.op), Some(&ue.span));
+            }
+            Expression::Literal(le) => {
+                let op = match &le.value {
+                    Literal::None => Op::None,
+                    Literal::Bool(true) => Op::True,
+                    Literal::Bool(false) => Op::False,
+                    l => Op::Constant(self.constant(interpreter::literal(l))),
+                };
+                self.emit(op, Some(&le.span));
+            }
+            Expression::Variable(i) => self.get(i),
+            Expression::Group(g) => self.expression(&g.inner),
+            Expression::Call(_) | Expression::Method(_) => {
+                let (argc, named, span, skip) = self.call(e);
+                let op = match named {
+                    Some(i) => Op::CallNamed(argc, i),
+                    None => Op::Call(argc),
+                };
+                self.emit(op, Some(span));
+                if let Some((jump, fallback)) = skip {
+                    self.skipped(jump, fallback);
+                }
+            }
+            Expression::Field(f) => {
+                self.expression(&f.target);
+                let skip = f.optional.then(|| self.emit(Op::JumpIfNone(0), None));
+                let name = self.name(&f.name.name);
+                self.emit(Op::GetField(name), Some(&f.name.span));
+                if let Some(jump) = skip {
+                    self.patch(jump);
+                }
+            }
+            Expression::Member(m) => {
+                self.expression(&m.module);
+                let name = self.name(&m.name.name);
+                self.emit(Op::Member(name), Some(&m.name.span));
+            }
+            Expression::Lambda(l) => self.closure(&l.function),
+            Expression::List(l) => {
+                for item in &l.items {
+                    self.expression(item);
+                }
+                self.emit(Op::List(l.items.len() as u32), Some(&l.span));
+            }
+            Expression::Map(m) => {
+                for (k, v) in &m.entries {
+                    self.expression(k);
+                    self.expression(v);
+                }
+                self.emit(Op::Map(m.entries.len() as u32), Some(&m.span));
+            }
+            Expression::Index(i) => {
+                self.expression(&i.target);
+                match &i.index {
+                    Index::Single(index) => {
+                        self.expression(index);
+                        self.emit(Op::Index, Some(&i.span));
+                    }
+                    Index::Slice { start, end, step } => {
+                        for part in [start, end, step] {
+                            match part {
+                                Some(e) => self.expression(e),
+                                None => {
+                                    self.emit(Op::None, None);
+                                }
+                            }
+                        }
+                        self.emit(Op::Slice, Some(&i.span));
+                    }
+                }
+            }
+            // a bare block can be broken out of with a value
+            Expression::Block(b) => {
+                let target = Target {
+                    kind: TargetKind::Block,
+                    depth: self.depth(),
+                    start: self.here(),
+                    breaks: vec![],
+                };
+                self.current().targets.push(target);
+                self.block(b);
+                let target = self.current().targets.pop().expect("pushed above");
+                for jump in target.breaks {
+                    self.patch(jump);
+                }
+            }
+            Expression::If(i) => self.if_expression(i),
+            Expression::For(f) => self.for_expression(f),
+            Expression::ForIn(f) => self.for_in_expression(f),
+            Expression::Match(m) => self.match_expression(m),
+            Expression::Try(t) => self.try_expression(t),
+            Expression::Spawn(s) => {
+                let (argc, named, span, _) = self.call(&s.call);
+                let op = match named {
+                    Some(i) => Op::SpawnNamed(argc, i),
+                    None => Op::Spawn(argc),
+                };
+                self.emit(op, Some(span));
+            }
+        }
+    }
+
+    /// push what a call or a method call calls and its arguments, returns how
+    /// many arguments there are, the index of the names of those given by
+    /// name if there are some, and where the call is. For a method call with
+    /// `?.`, it also returns the jump over the call taken if the receiver is
+    /// `none`, and whether the function to fall back on is below it.
+    fn call<'a>(
+        &mut self,
+        e: &'a Expression,
+    ) -> (u32, Option<u32>, &'a SourceString, Option<(usize, bool)>) {
+        match e {
+            Expression::Call(c) => {
+                self.expression(&c.callee);
+                for a in &c.arguments {
+                    self.expression(a);
+                }
+                let named = self.named(&c.named);
+                let argc = c.arguments.len() + c.named.len();
+                (argc as u32, named, &c.span, None)
+            }
+            Expression::Method(m) => {
+                // globals are only looked up if the receiver has no such
+                // method, as they may not be defined
+                let fallback = !matches!(self.resolve(&m.name.name).0, Variable::Global);
+                if fallback {
+                    self.get(&m.name);
+                }
+                self.expression(&m.receiver);
+                let skip = m
+                    .optional
+                    .then(|| (self.emit(Op::JumpIfNone(0), None), fallback));
+                let name = self.name(&m.name.name);
+                self.emit(Op::Method(name, fallback), Some(&m.name.span));
+                for a in &m.arguments {
+                    self.expression(a);
+                }
+                let named = self.named(&m.named);
+                let argc = m.arguments.len() + m.named.len() + 1;
+                (argc as u32, named, &m.span, skip)
+            }
+            _ => crate::assert_unreachable!(),
+        }
+    }
+
+    /// land the jump over a call with `?.`, the value is the `none` it
+    /// jumps with, above the function to fall back on if there is one
+    fn skipped(&mut self, jump: usize, fallback: bool) {
+        if !fallback {
+            self.patch(jump);
+            return;
+        }
+        let depth = self.depth();
+        let end = self.emit(Op::Jump(0), None);
+        self.set_depth(depth + 1);
+        self.patch(jump);
+        self.emit(Op::Slide(1), None);
+        self.patch(end);
+    }
+
+    /// push the arguments given by name, returns the index of their names
+    fn named(&mut self, named: &[NamedArgument]) -> Option<u32> {
+        if named.is_empty() {
+            return None;
+        }
+        for n in named {
+            self.expression(&n.value);
+        }
+        let names = named
+            .iter()
+            .map(|n| crate::values::intern(&n.name.name))
+            .collect();
+        let chunk = &mut self.current().proto.chunk;
+        chunk.named.push(names);
+        Some((chunk.named.len() - 1) as u32)
+    }
+
+    fn block(&mut self, b: &BlockExpression) {
+        if b.statements.is_empty() {
+            // the block is its value, and where a loop of nothing but it is
+            // stopped
+            self.emit(Op::None, Some(&b.span));
+            return;
+        }
+        self.begin_scope(&b.statements);
+        self.statements(&b.statements);
+        self.end_scope();
+    }
+
+    fn if_expression(&mut self, i: &IfExpression) {
+        let mut ends = vec![];
+        for (condition, body) in &i.branches {
+            self.expression(condition);
+            let next = self.emit(Op::JumpIfFalse(0), None);
+            let depth = self.depth();
+            self.block(body);
+            ends.push(self.emit(Op::Jump(0), None));
+            self.set_depth(depth);
+            self.patch(next);
+        }
+        match &i.otherwise {
+            Some(b) => self.block(b),
+            None => {
+                self.emit(Op::None, None);
+            }
+        }
+        for jump in ends {
+            self.patch(jump);
+        }
+    }
+
+    fn for_expression(&mut self, f: &ForExpression) {
+        let depth = self.depth();
+        let start = self.here();
+        let exit = f.condition.as_ref().map(|c| {
+            self.expression(c);
+            self.emit(Op::JumpIfFalse(0), None)
+        });
+        self.current().targets.push(Target {
+            kind: TargetKind::Loop,
+            depth,
+            start,
+            breaks: vec![],
+        });
+        self.block(&f.body);
+        self.emit(Op::Pop, None);
+        self.emit(Op::Jump(start as u32), None);
+        let target = self.current().targets.pop().expect("pushed above");
+        if let Some(exit) = exit {
+            self.patch(exit);
+        }
+        self.emit(Op::None, None);
+        for jump in target.breaks {
+            self.patch(jump);
+        }
+    }
+
+    /// The list and the position in it stay on the stack while looping, so
+    /// `break` and `continue` leave them there and the end of the loop drops
+    /// them below its value.
+    fn for_in_expression(&mut self, f: &ForInExpression) {
+        self.expression(&f.iterable);
+        self.emit(Op::Iter, Some(&f.iterable.span()));
+        let depth = self.depth();
+        let start = self.emit(Op::Iterate(0), Some(&f.iterable.span()));
+        self.current().targets.push(Target {
+            kind: TargetKind::Loop,
+            depth,
+            start,
+            breaks: vec![],
+        });
+        // the item is bound in its own scope, around the one of the body
+        self.current().scope += 1;
+        for b in f.binding.bindings() {
+            self.fresh_cell(b);
+        }
+        self.destructure(&f.binding, false);
+        self.block(&f.body);
+        self.end_scope();
+        self.emit(Op::Pop, None);
+        self.emit(Op::Jump(start as u32), None);
+        let target = self.current().targets.pop().expect("pushed above");
+        self.set_depth(depth);
+        self.patch(start);
+        self.emit(Op::None, None);
+        for jump in target.breaks {
+            self.patch(jump);
+        }
+        self.emit(Op::Slide(1), None);
+    }
+
+    /// The subject stays on the stack while trying the arms, the end of the
+    /// match drops it below the value of the arm taken.
+    fn match_expression(&mut self, m: &MatchExpression) {
+        self.expression(&m.subject);
+        let depth = self.depth();
+        let mut ends = vec![];
+        for arm in &m.arms {
+            let patterns = &mut self.current().proto.chunk.patterns;
+            patterns.push(arm.pattern.clone());
+            let index = (patterns.len() - 1) as u32;
+            let mut next = vec![self.emit(Op::Match(index, 0), Some(&arm.pattern.span()))];
+            let bindings = arm.pattern.bindings();
+            self.emit(Op::Unpack(bindings.len() as u32), None);
+            // the bindings are in their own scope, around the one of the body
+            self.current().scope += 1;
+            for b in bindings.iter().rev() {
+                self.fresh_cell(b);
+                self.define(b, false);
+            }
+            // functions created in the arm are compiled while its bindings
+            // are in scope
+            self.deferred.push(vec![]);
+            if let Some(g) = &arm.guard {
+                self.expression(g);
+                next.push(self.emit(Op::JumpIfFalse(0), None));
+            }
+            match &arm.body {
+                Expression::Block(b) => self.block(b),
+                e => self.expression(e),
+            }
+            self.compile_deferred();
+            self.end_scope();
+            ends.push(self.emit(Op::Jump(0), None));
+            self.set_depth(depth);
+            for jump in next {
+                self.patch(jump);
+            }
+        }
+        self.emit(Op::Unmatched, Some(&m.span));
+        self.set_depth(depth + 1);
+        for jump in ends {
+            self.patch(jump);
+        }
+        self.emit(Op::Slide(1), None);
+    }
+
+    /// the handler of a `try`, returns the instruction to patch with the
+    /// address of the code handling the error
+    fn install(&mut self, t: &TryExpression) -> usize {
+        let handler = Handler {
+            finally: t.finally.clone(),
+            targets: self.current().targets.len(),
+        };
+        self.current().handlers.push(handler);
+        self.emit(Op::Try(0), Some(&t.span))
+    }
+
+    fn uninstall(&mut self) {
+        self.current().handlers.pop();
+        self.emit(Op::EndTry, None);
+    }
+
+    fn try_expression(&mut self, t: &TryExpression) {
+        let depth = self.depth();
+        let mut handler = self.install(t);
+        self.block(&t.body);
+        self.uninstall();
+        let mut ends = vec![];
+        if let Some(c) = &t.catch {
+            ends.push(self.emit(Op::Jump(0), None));
+            self.patch(handler);
+            self.set_depth(depth + 1);
+            if t.finally.is_none() {
+                self.catch_clause(c);
+                for jump in ends {
+                    self.patch(jump);
+                }
+                return;
+            }
+            // errors thrown by the `catch` block still run the `finally` one
+            handler = self.install(t);
+            self.catch_clause(c);
+            self.uninstall();
+        }
+        let finally = t
+            .finally
+            .as_ref()
+            .expect("the parser rejects a try without catch and finally");
+        ends.push(self.emit(Op::Jump(0), None));
+        self.patch(handler);
+        self.set_depth(depth + 1);
+        // the error is on top of the stack, throw it again once done
+        self.block(finally);
+        self.emit(Op::Pop, None);
+        self.emit(Op::Throw, None);
+        self.set_depth(depth + 1);
+        for jump in ends {
+            self.patch(jump);
+        }
+        self.block(finally);
+        self.emit(Op::Pop, None);
+    }
+
+    /// bind the error on top of the stack, and handle it
+    fn catch_clause(&mut self, c: &CatchClause) {
+        self.current().scope += 1;
+        match &c.name {
+            Some(name) => {
+                self.fresh_cell(name);
+                self.define(name, false);
+            }
+            None => {
+                self.emit(Op::Pop, None);
+            }
+        }
+        self.block(&c.body);
+        self.end_scope();
+    }
+
+    /// compile the body of a function declared in the current function
+    fn function(&mut self, f: &FunctionDeclaration) -> Prototype {
+        self.functions
+            .push(FunctionState::new(&f.name.name, f.arity()));
+        self.current().proto.generator = f.generator;
+        self.current().proto.signature = doc::function_signature(f);
+        self.current().proto.doc = f.doc.clone();
+        self.current().proto.parameters = f
+            .parameters
+            .iter()
+            .map(|p| p.name().map(str::to_owned))
+            .collect();
+        // parameters live in their own scope, around the one of the body
+        self.current().scope += 1;
+        for (i, p) in f.parameters.iter().enumerate() {
+            // computed in the scope of the parameters before it
+            if let Some(default) = &p.default {
+                let given = self.emit(Op::Given(i as u32, 0), None);
+                self.expression(default);
+                self.emit(Op::SetLocal(i as u32), None);
+                self.patch(given);
+            }
+            let Pattern::Binding(name) = &p.pattern else {
+                for b in p.pattern.bindings() {
+                    self.fresh_cell(b);
+                }
+                self.emit(Op::GetLocal(i as u32), None);
+                self.destructure(&p.pattern, p.mutable);
+                continue;
+            };
+            let storage = if self.captured.contains(&resolver::key(name)) {
+                let cell = self.new_cell();
+                self.emit(Op::GetLocal(i as u32), None);
+                self.emit(Op::MakeCell(cell), None);
+                Storage::Cell(cell)
+            } else {
+                Storage::Slot(i as u32)
+            };
+            let scope = self.current().scope;
+            self.current().locals.push(Local {
+                name: name.name.clone(),
+                storage,
+                mutable: p.mutable,
+                scope,
+            });
+        }
+        self.block(&f.body);
+        self.emit(Op::Return, None);
+        self.functions
+            .pop()
+            .expect("pushed at the start of the function")
+            .finish(self.level)
+    }
+}
@@ -0,0 +1,389 @@
+//! The optimizations of `OptLevel::Basic`, made on the tree before it is
+//! compiled and on the instructions of each function after.
+//!
+//! On the tree, operators applied to literals are folded into the literal
+//! they evaluate to, and so are the conditions of `if` branches, dropping
+//! the branches that can't be taken. The statements of a block after a
+//! `return`, `throw`, `exit`, `break` or `continue` are dropped, unless one
+//! of them declares a name, which the code before it may refer to.
+//!
+//! Values of any type may reach an operator, and those of structs may
+//! overload it, so the operators themselves can't be replaced by cheaper
+//! ones. On the instructions, the `none` each statement leaves behind is no
+//! longer pushed only to be popped, negated conditions jump the other way
+//! rather than negating, and jumps to jumps go straight to where the last
+//! one goes.
+//!
+//! Each of these keeps what the program does and the errors it raises, only
+//! the instructions that could never raise one are removed. The tree-walker
+//! runs programs as they are written.
+
+use std::sync::Arc;
+
+use crate::{
+    bytecode::{Chunk, Op, SourceMap},
+    interpreter,
+    parser::{
+        BinOperator, BlockExpression, Expression, FunctionDeclaration, IfExpression, Index,
+        LitExpression, Literal, Program, Statement, UnOperator,
+    },
+    values::{self, Value},
+};
+
+/// Powers are folded up to this exponent, larger ones make big ints, which
+/// aren't literals, and may take long to compute for code that never runs
+const MAX_FOLDED_EXPONENT: i64 = 64;
+
+/// The program with its constant expressions folded and the statements
+/// that can't run dropped
+pub fn optimize(program: &Program) -> Program {
+    let mut program = program.clone();
+    statements(&mut program.statements);
+    program
+}
+
+fn statements(statements: &mut Vec<Statement>) {
+    for s in statements.iter_mut() {
+        statement(s);
+    }
+    let end = statements.iter().position(|s| {
+        matches!(
+            s,
+            Statement::Return(_)
+                | Statement::Throw(_)
+                | Statement::Exit(_)
+                | Statement::Break(_)
+                | Statement::Continue(_)
+        )
+    });
+    if let Some(end) = end {
+        let declares = statements[end + 1..].iter().any(|s| {
+            matches!(
+                s,
+                Statement::Declaration(_)
+                    | Statement::Destructuring(_)
+                    | Statement::Function(_)
+                    | Statement::Struct(_)
+                    | Statement::Enum(_)
+                    | Statement::Import(_)
+            )
+        });
+        if !declares {
+            statements.truncate(end + 1);
+        }
+    }
+}
+
+fn statement(s: &mut Statement) {
+    match s {
+        Statement::Declaration(d) => expression(&mut d.value),
+        Statement::Destructuring(d) => expression(&mut d.value),
+        Statement::Function(f) => function(Arc::make_mut(f)),
+        Statement::Struct(s) => {
+            for m in &mut Arc::make_mut(s).methods {
+                function(Arc::make_mut(m));
+            }
+        }
+        Statement::Enum(e) => {
+            for m in &mut Arc::make_mut(e).methods {
+                function(Arc::make_mut(m));
+            }
+        }
+        Statement::Assignment(a) => {
+            expression(&mut a.target);
+            expression(&mut a.value);
+        }
+        Statement::Expression(e) => expression(e),
+        Statement::Exit(e) => expression(&mut e.code),
+        Statement::Throw(t) => expression(&mut t.value),
+        Statement::Defer(d) => function(Arc::make_mut(&mut d.function)),
+        Statement::Import(_) | Statement::Interface(_) => {}
+        Statement::Return(r) => optional(&mut r.value),
+        Statement::Yield(y) => optional(&mut y.value),
+        Statement::Break(b) => optional(&mut b.value),
+        Statement::Continue(c) => optional(&mut c.value),
+    }
+}
+
+fn function(f: &mut FunctionDeclaration) {
+    for p in &mut f.parameters {
+        optional(&mut p.default);
+    }
+    block(&mut f.body);
+}
+
+fn block(b: &mut BlockExpression) {
+    statements(&mut b.statements);
+}
+
+fn optional(e: &mut Option<Expression>) {
+    if let Some(e) = e {
+        expression(e);
+    }
+}
+
+fn expression(e: &mut Expression) {
+    match e {
+        Expression::Binary(be) => {
+            expression(&mut be.lhs);
+            expression(&mut be.rhs);
+        }
+        Expression::Unary(ue) => expression(&mut ue.rhs),
+        Expression::Literal(_) | Expression::Variable(_) => {}
+        Expression::Group(g) => expression(&mut g.inner),
+        Expression::Call(c) => {
+            expression(&mut c.callee);
+            c.arguments.iter_mut().for_each(expression);
+            c.named.iter_mut().for_each(|n| expression(&mut n.value));
+        }
+        Expression::Method(m) => {
+            expression(&mut m.receiver);
+            m.arguments.iter_mut().for_each(expression);
+            m.named.iter_mut().for_each(|n| expression(&mut n.value));
+        }
+        Expression::Field(f) => expression(&mut f.target),
+        Expression::Member(m) => expression(&mut m.module),
+        Expression::Lambda(l) => function(Arc::make_mut(&mut l.function)),
+        Expression::List(l) => l.items.iter_mut().for_each(expression),
+        Expression::Map(m) => {
+            for (k, v) in &mut m.entries {
+                expression(k);
+                expression(v);
+            }
+        }
+        Expression::Index(i) => {
+            expression(&mut i.target);
+            match &mut i.index {
+                Index::Single(index) => expression(index),
+                Index::Slice { start, end, step } => {
+                    for part in [start, end, step].into_iter().flatten() {
+                        expression(part);
+                    }
+                }
+            }
+        }
+        Expression::Block(b) => block(b),
+        Expression::If(i) => if_expression(i),
+        Expression::For(f) => {
+            if let Some(c) = &mut f.condition {
+                expression(c);
+            }
+            block(&mut f.body);
+        }
+        Expression::ForIn(f) => {
+            expression(&mut f.iterable);
+            block(&mut f.body);
+        }
+        Expression::Match(m) => {
+            expression(&mut m.subject);
+            for arm in &mut m.arms {
+                optional(&mut arm.guard);
+                expression(&mut arm.body);
+            }
+        }
+        Expression::Try(t) => {
+            block(&mut t.body);
+            if let Some(c) = &mut t.catch {
+                block(&mut c.body);
+            }
+            if let Some(f) = &mut t.finally {
+                block(f);
+            }
+        }
+        Expression::Spawn(s) => expression(&mut s.call),
+    }
+    if let Some(value) = fold(e) {
+        *e = Expression::Literal(LitExpression {
+            value,
+            span: e.span(),
+        });
+    }
+}
+
+/// the literal an expression whose operands were folded evaluates to, if
+/// it is one and evaluating it can't fail
+fn fold(e: &Expression) -> Option<Literal> {
+    match e {
+        Expression::Group(g) => literal(&g.inner),
+        Expression::Unary(ue) => {
+            let rhs = constant(&ue.rhs)?;
+            literal_of(values::unary(ue.op, rhs).ok()?)
+        }
+        Expression::Binary(be) if be.op.is_short_circuit() => {
+            let lhs = constant(&be.lhs)?.is_truthy();
+            // `and` stops at a falsy operand and `or` at a truthy one,
+            // otherwise the value is whether the other one is truthy
+            match (be.op, lhs) {
+                (BinOperator::And, false) | (BinOperator::Or, true) => Some(Literal::Bool(lhs)),
+                _ => Some(Literal::Bool(constant(&be.rhs)?.is_truthy())),
+            }
+        }
+        // the value on the right is only needed if the one on the left is
+        // `none`
+        Expression::Binary(be) if be.op == BinOperator::Coalesce => match constant(&be.lhs)? {
+            Value::None => literal(&be.rhs),
+            lhs => literal_of(lhs),
+        },
+        Expression::Binary(be) => {
+            let (lhs, rhs) = (constant(&be.lhs)?, constant(&be.rhs)?);
+            if be.op == BinOperator::Pow && !small_exponent(&rhs) {
+                return None;
+            }
+            literal_of(values::binary(be.op, lhs, rhs).ok()?)
+        }
+        _ => None,
+    }
+}
+
+/// the value of a literal expression
+fn constant(e: &Expression) -> Option<Value> {
+    match e {
+        Expression::Literal(l) => Some(interpreter::literal(&l.value)),
+        _ => None,
+    }
+}
+
+fn literal(e: &Expression) -> Option<Literal> {
+    match e {
+        Expression::Literal(l) => Some(l.value.clone()),
+        _ => None,
+    }
+}
+
+fn small_exponent(exponent: &Value) -> bool {
+    match exponent {
+        Value::Int(n) => *n <= MAX_FOLDED_EXPONENT,
+        _ => true,
+    }
+}
+
+/// the literal of a value, for the types literals can be written in
+fn literal_of(value: Value) -> Option<Literal> {
+    Some(match value {
+        Value::None => Literal::None,
+        Value::Bool(b) => Literal::Bool(b),
+        Value::Int(i) => Literal::Int(i),
+        Value::Float(x) => Literal::Float(x),
+        Value::String(s) => Literal::String(s.to_string()),
+        Value::Symbol(s) => Literal::Symbol(s.to_string()),
+        Value::Bytes(b) => Literal::Bytes(b.to_vec()),
+        _ => return None,
+    })
+}
+
+/// drop the branches whose condition is a literal that doesn't hold, and
+/// the ones after a branch whose condition does, which becomes the `else`
+fn if_expression(i: &mut IfExpression) {
+    for (condition, body) in &mut i.branches {
+        expression(condition);
+        block(body);
+    }
+    if let Some(b) = &mut i.otherwise {
+        block(b);
+    }
+    let mut branches = vec![];
+    for (condition, body) in std::mem::take(&mut i.branches) {
+        match constant(&condition).map(|c| c.is_truthy()) {
+            Some(false) => {}
+            Some(true) => {
+                i.otherwise = Some(body);
+                break;
+            }
+            None => branches.push((condition, body)),
+        }
+    }
+    i.branches = branches;
+}
+
+/// Rewrite the instructions of a chunk into fewer that do the same, see the
+/// module documentation
+pub fn peephole(chunk: &mut Chunk) {
+    let code = &chunk.code;
+    let n = code.len();
+    let spans: Vec<_> = (0..n).map(|i| chunk.source_map.span(i).cloned()).collect();
+    let mut targeted = vec![false; n + 1];
+    for op in code {
+        if let Some(t) = target(op) {
+            targeted[t as usize] = true;
+        }
+    }
+
+    // the new offset of each instruction, those removed are moved to the
+    // next one kept, which does what they did from there on
+    let mut moved = vec![0; n + 1];
+    let mut kept = Vec::with_capacity(n);
+    let mut i = 0;
+    while i < n {
+        moved[i] = kept.len();
+        match (code[i], code.get(i + 1)) {
+            (Op::None, Some(Op::Pop)) if spans[i].is_none() && !targeted[i + 1] => {
+                moved[i + 1] = kept.len();
+                i += 2;
+            }
+            (Op::Unary(UnOperator::Not), Some(&jump)) if !targeted[i + 1] => {
+                let flipped = match jump {
+                    Op::JumpIfFalse(t) => Op::JumpIfTrue(t),
+                    Op::JumpIfTrue(t) => Op::JumpIfFalse(t),
+                    _ => {
+                        kept.push((code[i], i));
+                        i += 1;
+                        continue;
+                    }
+                };
+                moved[i + 1] = kept.len();
+                kept.push((flipped, i));
+                i += 2;
+            }
+            (op, _) => {
+                kept.push((op, i));
+                i += 1;
+            }
+        }
+    }
+    moved[n] = kept.len();
+
+    let mut source_map = SourceMap::default();
+    let mut compacted = Vec::with_capacity(kept.len());
+    for (mut op, from) in kept {
+        if let Some(t) = target_mut(&mut op) {
+            *t = moved[threaded(code, *t as usize)] as u32;
+        }
+        compacted.push(op);
+        source_map.push(spans[from].as_ref());
+    }
+    chunk.code = compacted;
+    chunk.source_map = source_map;
+}
+
+/// where a jump to the offset ends up, following the jumps it lands on
+fn threaded(code: &[Op], mut offset: usize) -> usize {
+    // jumps to themselves are loops that never end, the bound stops there
+    for _ in 0..code.len() {
+        match code.get(offset) {
+            Some(Op::Jump(t)) if *t as usize != offset => offset = *t as usize,
+            _ => break,
+        }
+    }
+    offset
+}
+
+/// the offset an instruction may jump to
+fn target(op: &Op) -> Option<u32> {
+    let mut op = *op;
+    target_mut(&mut op).map(|t| *t)
+}
+
+pub(super) fn target_mut(op: &mut Op) -> Option<&mut u32> {
+    match op {
+        Op::Jump(t)
+        | Op::JumpIfFalse(t)
+        | Op::JumpIfTrue(t)
+        | Op::JumpIfNone(t)
+        | Op::JumpIfNotNone(t)
+        | Op::Try(t)
+        | Op::Iterate(t)
+        | Op::Match(_, t)
+        | Op::Given(_, t) => Some(t),
+        _ => None,
+    }
+}
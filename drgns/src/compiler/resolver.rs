@@ -0,0 +1,213 @@
+//! Finds the declarations captured by closures, ahead of compilation.
+//!
+//! Names are resolved the same way as in the checker: function bodies are
+//! resolved at the end of the scope declaring them. Declarations at the top
+//! level of the program are globals, which are never captured.
+
+use std::{
+    collections::{HashMap, HashSet},
+    sync::Arc,
+};
+
+use crate::parser::{
+    walk_expression, walk_statement, BlockExpression, CatchClause, Declaration, Destructuring,
+    Expression, ForInExpression, FunctionDeclaration, Identifier, MatchArm, Program, Statement,
+    Visitor,
+};
+
+/// the keys of the captured declarations, see `key`
+pub fn captured(program: &Program) -> HashSet<usize> {
+    let mut resolver = Resolver::default();
+    resolver.visit_program(program);
+    resolver.captured
+}
+
+/// declarations are identified by where their name starts
+pub fn key(name: &Identifier) -> usize {
+    name.span.start()
+}
+
+struct Scope {
+    names: HashMap<String, usize>,
+
+    /// how deeply nested in functions the scope is
+    function: usize,
+}
+
+#[derive(Default)]
+struct Resolver {
+    scopes: Vec<Scope>,
+    function: usize,
+    captured: HashSet<usize>,
+
+    /// bodies to resolve at the end of each sequence of statements
+    deferred: Vec<Vec<Arc<FunctionDeclaration>>>,
+}
+
+impl Resolver {
+    fn begin_scope(&mut self) {
+        self.scopes.push(Scope {
+            names: HashMap::new(),
+            function: self.function,
+        });
+    }
+
+    fn declare(&mut self, name: &Identifier) {
+        if let Some(scope) = self.scopes.last_mut() {
+            scope.names.insert(name.name.clone(), key(name));
+        }
+    }
+
+    fn resolve(&mut self, name: &Identifier) {
+        let found = self
+            .scopes
+            .iter()
+            .rev()
+            .find_map(|s| Some((*s.names.get(&name.name)?, s.function)));
+        if let Some((key, function)) = found {
+            if function < self.function {
+                self.captured.insert(key);
+            }
+        }
+    }
+
+    fn statements(&mut self, statements: &[Statement]) {
+        self.deferred.push(vec![]);
+        for s in statements {
+            match s {
+                Statement::Function(f) => {
+                    self.declare(&f.name);
+                    self.defer(f);
+                }
+                Statement::Struct(s) => {
+                    self.declare(&s.name);
+                    for m in &s.methods {
+                        self.defer(m);
+                    }
+                }
+                Statement::Enum(e) => {
+                    self.declare(&e.name);
+                    for m in &e.methods {
+                        self.defer(m);
+                    }
+                }
+                s => self.visit_statement(s),
+            }
+        }
+        for f in self.deferred.pop().expect("pushed above") {
+            self.visit_function(&f);
+        }
+    }
+
+    fn defer(&mut self, f: &Arc<FunctionDeclaration>) {
+        match self.deferred.last_mut() {
+            Some(functions) => functions.push(f.clone()),
+            None => self.visit_function(f),
+        }
+    }
+}
+
+impl Visitor for Resolver {
+    /// the top level is not a scope, as it only declares globals
+    fn visit_program(&mut self, p: &Program) {
+        self.statements(&p.statements);
+    }
+
+    fn visit_block(&mut self, b: &BlockExpression) {
+        self.begin_scope();
+        self.statements(&b.statements);
+        self.scopes.pop();
+    }
+
+    fn visit_catch(&mut self, c: &CatchClause) {
+        self.begin_scope();
+        if let Some(name) = &c.name {
+            self.declare(name);
+        }
+        self.visit_block(&c.body);
+        self.scopes.pop();
+    }
+
+    fn visit_for_in(&mut self, f: &ForInExpression) {
+        self.visit_expression(&f.iterable);
+        self.begin_scope();
+        for b in f.binding.bindings() {
+            self.declare(b);
+        }
+        self.visit_block(&f.body);
+        self.scopes.pop();
+    }
+
+    fn visit_match_arm(&mut self, a: &MatchArm) {
+        self.begin_scope();
+        for b in a.pattern.bindings() {
+            self.declare(b);
+        }
+        // functions created in the arm are resolved while its bindings are
+        // in scope
+        self.deferred.push(vec![]);
+        if let Some(g) = &a.guard {
+            self.visit_expression(g);
+        }
+        self.visit_expression(&a.body);
+        for f in self.deferred.pop().expect("pushed above") {
+            self.visit_function(&f);
+        }
+        self.scopes.pop();
+    }
+
+    fn visit_statement(&mut self, s: &Statement) {
+        match s {
+            Statement::Assignment(a) => {
+                match &a.target {
+                    Expression::Variable(target) => self.resolve(target),
+                    target => self.visit_expression(target),
+                }
+                self.visit_expression(&a.value);
+            }
+            Statement::Import(i) => self.declare(i.name()),
+            Statement::Defer(d) => self.defer(&d.function),
+            s => walk_statement(self, s),
+        }
+    }
+
+    fn visit_declaration(&mut self, d: &Declaration) {
+        self.visit_expression(&d.value);
+        self.declare(&d.name);
+    }
+
+    fn visit_destructuring(&mut self, d: &Destructuring) {
+        self.visit_expression(&d.value);
+        for b in d.pattern.bindings() {
+            self.declare(b);
+        }
+    }
+
+    fn visit_function(&mut self, f: &FunctionDeclaration) {
+        self.function += 1;
+        self.begin_scope();
+        for p in &f.parameters {
+            if let Some(d) = &p.default {
+                self.visit_expression(d);
+            }
+            for b in p.pattern.bindings() {
+                self.declare(b);
+            }
+        }
+        self.visit_block(&f.body);
+        self.scopes.pop();
+        self.function -= 1;
+    }
+
+    fn visit_expression(&mut self, e: &Expression) {
+        match e {
+            Expression::Variable(i) => self.resolve(i),
+            Expression::Method(m) => {
+                self.resolve(&m.name);
+                walk_expression(self, e);
+            }
+            Expression::Lambda(l) => self.defer(&l.function),
+            e => walk_expression(self, e),
+        }
+    }
+}
@@ -0,0 +1,190 @@
+//! The coverage reports of `drgns test --coverage`, showing the lines of
+//! code the tests ran, and the ones they didn't. They are written in the
+//! lcov format most editors and CI services read, or as a page of HTML when
+//! the file written ends with `.html`.
+//!
+//! The report covers the scripts below the directory of the tests, and the
+//! other files they ran, leaving the test files out.
+
+use std::{
+    collections::BTreeMap,
+    fmt::Write,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use drgns::{
+    error_handler::{DragonError, ErrorCode},
+    interpreter::coverage::{self, Lines},
+    parser,
+    source::{self, Source},
+};
+
+use crate::{report, testing};
+
+/// The lines of a file that can be run, and how many times each was
+struct Covered {
+    path: String,
+    source: Arc<Source>,
+    lines: Lines,
+}
+
+impl Covered {
+    fn hit(&self) -> usize {
+        self.lines.values().filter(|&&n| n > 0).count()
+    }
+}
+
+/// Write the report of the lines run so far, for the tests at `path`, to
+/// `output`. Returns whether it could be written.
+pub fn write(path: &str, output: &str) -> bool {
+    let files = covered(path);
+    let text = match output.ends_with(".html") {
+        true => html(&files),
+        false => lcov(&files),
+    };
+    if let Err(e) = std::fs::write(output, text) {
+        let msg = format!("cannot write the coverage report '{}': {}", output, e);
+        report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+        return false;
+    }
+    let (found, hit) = totals(&files);
+    println!(
+        "coverage: {} of {} lines, {}, written to {}",
+        hit,
+        found,
+        percent(hit, found),
+        output
+    );
+    true
+}
+
+/// the files of the report in the order of their paths, each once however
+/// it was named
+fn covered(path: &str) -> Vec<Covered> {
+    let mut run: BTreeMap<PathBuf, (String, Lines)> = BTreeMap::new();
+    let mut add = |file: String, lines: Lines| {
+        let key = Path::new(&file)
+            .canonicalize()
+            .unwrap_or(file.clone().into());
+        let (_, all) = run.entry(key).or_insert((file, Lines::new()));
+        for (line, n) in lines {
+            *all.entry(line).or_default() += n;
+        }
+    };
+    for (file, lines) in coverage::take() {
+        add(file, lines);
+    }
+    if Path::new(path).is_dir() {
+        for file in testing::scripts(Path::new(path)) {
+            add(file, Lines::new());
+        }
+    }
+
+    let mut files = vec![];
+    for (file, run) in run.into_values() {
+        if file.ends_with(testing::FILE_SUFFIX) {
+            continue;
+        }
+        let Ok(source) = source::load(&file) else {
+            log::warn!("cannot read '{}' for the coverage report", file);
+            continue;
+        };
+        let (program, _) = parser::parse(&source);
+        let lines = coverage::executable(&program)
+            .into_iter()
+            .map(|line| (line, run.get(&line).copied().unwrap_or(0)))
+            .collect();
+        files.push(Covered {
+            path: file,
+            source,
+            lines,
+        });
+    }
+    files
+}
+
+fn totals(files: &[Covered]) -> (usize, usize) {
+    files.iter().fold((0, 0), |(found, hit), f| {
+        (found + f.lines.len(), hit + f.hit())
+    })
+}
+
+fn percent(hit: usize, found: usize) -> String {
+    match found {
+        0 => "100.0%".to_string(),
+        _ => format!("{:.1}%", hit as f64 * 100.0 / found as f64),
+    }
+}
+
+/// the report in the lcov format, a record of the lines of each file
+fn lcov(files: &[Covered]) -> String {
+    let mut out = String::new();
+    for f in files {
+        let _ = writeln!(out, "TN:\nSF:{}", f.path);
+        for (line, count) in &f.lines {
+            let _ = writeln!(out, "DA:{},{}", line, count);
+        }
+        let _ = writeln!(out, "LF:{}\nLH:{}\nend_of_record", f.lines.len(), f.hit());
+    }
+    out
+}
+
+/// the report as a page listing the files, then the code of each with the
+/// lines that ran in green and the ones that didn't in red
+fn html(files: &[Covered]) -> String {
+    let (found, hit) = totals(files);
+    let mut out = String::from(
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Coverage</title>\n<style>\n\
+         body { font-family: sans-serif; }\n\
+         td { padding: 0 1em 0 0; }\n\
+         pre { line-height: 1.3; }\n\
+         .run { background: #dfd; }\n\
+         .missed { background: #fdd; }\n\
+         .count { color: #888; }\n\
+         </style>\n</head>\n<body>\n",
+    );
+    let _ = writeln!(
+        out,
+        "<h1>Coverage: {} of {} lines, {}</h1>\n<table>",
+        hit,
+        found,
+        percent(hit, found)
+    );
+    for (i, f) in files.iter().enumerate() {
+        let _ = writeln!(
+            out,
+            "<tr><td><a href=\"#file-{}\">{}</a></td><td>{}</td></tr>",
+            i,
+            escape(&f.path),
+            percent(f.hit(), f.lines.len())
+        );
+    }
+    out.push_str("</table>\n");
+    for (i, f) in files.iter().enumerate() {
+        let _ = writeln!(out, "<h2 id=\"file-{}\">{}</h2>\n<pre>", i, escape(&f.path));
+        for line in 1..=f.source.line_count() {
+            let text = escape(&f.source.line(line).unwrap_or_default());
+            let (class, count) = match f.lines.get(&line) {
+                Some(0) => (" class=\"missed\"", "0".to_string()),
+                Some(n) => (" class=\"run\"", n.to_string()),
+                None => ("", "".to_string()),
+            };
+            let _ = writeln!(
+                out,
+                "<span{}><span class=\"count\">{:>5} {:>7}</span> {}</span>",
+                class, line, count, text
+            );
+        }
+        out.push_str("</pre>\n");
+    }
+    out.push_str("</body>\n</html>\n");
+    out
+}
+
+fn escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
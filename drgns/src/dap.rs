@@ -0,0 +1,803 @@
+//! The debug adapter, `drgns dap`, lets editors debug scripts with the Debug
+//! Adapter Protocol, over the standard input and output.
+//!
+//! Scripts run on the tree-walker, in a single thread, and stop like in
+//! `drgns debug`. Requests about a stopped program that come while it runs
+//! wait until it stops. Since the standard output carries the protocol,
+//! what scripts print is sent to the client as output events.
+
+use std::{
+    cell::RefCell,
+    collections::{HashMap, VecDeque},
+    io::{self, Write},
+    path::PathBuf,
+    rc::Rc,
+    sync::{
+        mpsc::{self, Receiver},
+        Arc, Mutex,
+    },
+    thread,
+};
+
+use drgns::{
+    diagnostics,
+    interpreter::{builtins, Env, Halt, Hook, Interpreter},
+    parser::{self, Program, Statement},
+    source::{self, Source, SourceString},
+    Value,
+};
+use serde_json::{json, Value as Json};
+
+use crate::{
+    debug::{Mode, Stops},
+    lsp::{read_message, write_message},
+};
+
+/// scripts run in a single thread
+const THREAD: i64 = 1;
+
+/// Serve a client until it disconnects, returns the exit status of the
+/// script, or a failure if the client went away without disconnecting
+pub fn run() -> i32 {
+    let (sender, requests) = mpsc::channel();
+    thread::spawn(move || {
+        let mut input = io::stdin().lock();
+        loop {
+            match read_message(&mut input) {
+                Ok(Some(request)) => {
+                    if sender.send(request).is_err() {
+                        return;
+                    }
+                }
+                Ok(None) => return,
+                Err(e) => log::error!("invalid message: {}", e),
+            }
+        }
+    });
+    let client = Client::new(Box::new(io::stdout()));
+    let output = client.clone();
+    builtins::set_output(move |line| {
+        output.event(
+            "output",
+            json!({ "category": "stdout", "output": format!("{}\n", line) }),
+        )
+    });
+    let output = client.clone();
+    builtins::set_log_output(move |line| {
+        output.event(
+            "output",
+            json!({ "category": "stderr", "output": format!("{}\n", line) }),
+        )
+    });
+    serve(client, requests)
+}
+
+/// The writing half of the connection, shared with the output of scripts
+#[derive(Clone)]
+struct Client(Arc<Mutex<Connection>>);
+
+struct Connection {
+    output: Box<dyn Write + Send>,
+
+    /// the sequence number of the last message sent
+    seq: i64,
+}
+
+impl Client {
+    fn new(output: Box<dyn Write + Send>) -> Self {
+        Self(Arc::new(Mutex::new(Connection { output, seq: 0 })))
+    }
+
+    fn send(&self, mut message: Json) {
+        let mut connection = self.0.lock().unwrap_or_else(|e| e.into_inner());
+        connection.seq += 1;
+        message["seq"] = json!(connection.seq);
+        if let Err(e) = write_message(&mut connection.output, &message) {
+            log::error!("cannot write to the client: {}", e);
+        }
+    }
+
+    fn event(&self, event: &str, body: Json) {
+        self.send(json!({ "type": "event", "event": event, "body": body }));
+    }
+
+    fn respond(&self, request: &Json, result: Result<Json, String>) {
+        let mut response = json!({
+            "type": "response",
+            "request_seq": request["seq"],
+            "command": request["command"],
+            "success": result.is_ok(),
+        });
+        match result {
+            Ok(body) => response["body"] = body,
+            Err(message) => response["message"] = json!(message),
+        }
+        self.send(response);
+    }
+}
+
+/// What a `variablesReference` stands for, until the program runs again
+enum Reference {
+    /// the variables of scopes, innermost first
+    Scopes(Vec<Env>),
+
+    /// the items of a list or the entries of a map
+    Value(Value),
+}
+
+/// What a request asks for after it was handled, while the program is
+/// stopped
+enum Resume {
+    Stay,
+    Run(Mode),
+    Quit,
+}
+
+struct Session {
+    client: Client,
+    requests: Receiver<Json>,
+
+    /// requests about a stopped program that came while it ran
+    pending: VecDeque<Json>,
+
+    /// the lines of the breakpoints of each file
+    breakpoints: HashMap<PathBuf, Vec<usize>>,
+    stops: Stops,
+
+    /// why the program stops next, when it isn't at a breakpoint
+    reason: &'static str,
+
+    /// the scope of the last statement run at each depth of calls
+    scopes: Vec<Env>,
+    references: Vec<Reference>,
+
+    /// the client asked to disconnect, rather than to end the script
+    disconnected: bool,
+}
+
+/// Handle requests until the client disconnects
+fn serve(client: Client, requests: Receiver<Json>) -> i32 {
+    let session = Rc::new(RefCell::new(Session {
+        client: client.clone(),
+        requests,
+        pending: VecDeque::new(),
+        breakpoints: HashMap::new(),
+        stops: Stops::new(),
+        reason: "entry",
+        scopes: vec![],
+        references: vec![],
+        disconnected: false,
+    }));
+    let mut launched = None;
+    let mut status = 0;
+    loop {
+        let Ok(request) = session.borrow().requests.recv() else {
+            return 1;
+        };
+        match request["command"].as_str().unwrap_or_default() {
+            "initialize" => {
+                let capabilities = json!({
+                    "supportsConfigurationDoneRequest": true,
+                    "supportsEvaluateForHovers": true,
+                    "supportsTerminateRequest": true,
+                });
+                client.respond(&request, Ok(capabilities));
+                client.event("initialized", json!({}));
+            }
+            "launch" => {
+                let result = launch(&client, &request["arguments"]);
+                let response = result.as_ref().map(|_| json!({})).map_err(Clone::clone);
+                launched = result.ok();
+                client.respond(&request, response);
+            }
+            "configurationDone" => {
+                client.respond(&request, Ok(json!({})));
+                let Some((program, stop_on_entry)) = launched.take() else {
+                    continue;
+                };
+                status = debug(&session, &program, stop_on_entry);
+                if session.borrow().disconnected {
+                    return status;
+                }
+                client.event("exited", json!({ "exitCode": status }));
+                client.event("terminated", json!({}));
+            }
+            "disconnect" => {
+                client.respond(&request, Ok(json!({})));
+                return status;
+            }
+            _ => session.borrow_mut().common(&request),
+        }
+    }
+}
+
+/// load the program to debug, and whether to stop before its first
+/// statement
+fn launch(client: &Client, arguments: &Json) -> Result<(Program, bool), String> {
+    let Some(path) = arguments["program"].as_str() else {
+        return Err("the 'program' to debug is missing".to_owned());
+    };
+    if let Some(args) = arguments["args"].as_array() {
+        let args = args.iter().filter_map(|a| a.as_str()).map(str::to_owned);
+        builtins::set_args(args.collect());
+    }
+    let src = source::load(path).map_err(|e| format!("cannot read '{}': {}", path, e))?;
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        for e in &errors {
+            let output = diagnostics::render(e);
+            client.event("output", json!({ "category": "stderr", "output": output }));
+        }
+        return Err(format!("'{}' has syntax errors", path));
+    }
+    let stop_on_entry = arguments["stopOnEntry"].as_bool().unwrap_or(false);
+    Ok((program, stop_on_entry))
+}
+
+/// run the program with the session as its hook, returns its exit status
+fn debug(session: &Rc<RefCell<Session>>, program: &Program, stop_on_entry: bool) -> i32 {
+    session.borrow_mut().stops.mode = match stop_on_entry {
+        true => Mode::Step,
+        false => Mode::Continue,
+    };
+    let mut interpreter = Interpreter::new();
+    interpreter.set_hook(Box::new(Adapter(session.clone())));
+    match interpreter.eval(program) {
+        Ok(_) => 0,
+        Err(Halt::Exit(code)) => code,
+        Err(Halt::Error(e)) => {
+            let output = diagnostics::render(&e);
+            let client = &session.borrow().client;
+            client.event("output", json!({ "category": "stderr", "output": output }));
+            1
+        }
+    }
+}
+
+/// the session, shared between the interpreter and `serve`
+struct Adapter(Rc<RefCell<Session>>);
+
+impl Hook for Adapter {
+    fn statement(
+        &mut self,
+        interpreter: &mut Interpreter,
+        statement: &Statement,
+        env: &Env,
+    ) -> Result<(), Halt> {
+        self.0.borrow_mut().statement(interpreter, statement, env)
+    }
+}
+
+impl Session {
+    fn statement(
+        &mut self,
+        interpreter: &mut Interpreter,
+        statement: &Statement,
+        env: &Env,
+    ) -> Result<(), Halt> {
+        let depth = interpreter.frames().len();
+        self.scopes.truncate(depth);
+        self.scopes.resize(depth, env.clone());
+        self.scopes.push(env.clone());
+        while let Ok(request) = self.requests.try_recv() {
+            self.while_running(request)?;
+        }
+        let span = statement.span();
+        let at_breakpoint = self.at_breakpoint(&span);
+        let continuing = self.stops.mode == Mode::Continue;
+        if !self.stops.check(&span, depth, at_breakpoint) {
+            return Ok(());
+        }
+        let reason = match continuing {
+            true => "breakpoint",
+            false => self.reason,
+        };
+        self.references.clear();
+        self.client.event(
+            "stopped",
+            json!({ "reason": reason, "threadId": THREAD, "allThreadsStopped": true }),
+        );
+        loop {
+            let request = match self.pending.pop_front() {
+                Some(request) => request,
+                // the client went away
+                None => match self.requests.recv() {
+                    Ok(request) => request,
+                    Err(_) => return Err(Halt::Exit(0)),
+                },
+            };
+            match self.while_stopped(&request, interpreter, &span) {
+                Resume::Stay => {}
+                Resume::Run(mode) => {
+                    self.stops.mode = mode;
+                    self.reason = "step";
+                    return Ok(());
+                }
+                Resume::Quit => return Err(Halt::Exit(0)),
+            }
+        }
+    }
+
+    fn at_breakpoint(&self, span: &SourceString) -> bool {
+        let Some(file) = span.file() else {
+            return false;
+        };
+        let line = span.position().line;
+        self.breakpoints
+            .get(&canonical(file))
+            .is_some_and(|lines| lines.contains(&line))
+    }
+
+    fn while_running(&mut self, request: Json) -> Result<(), Halt> {
+        match request["command"].as_str().unwrap_or_default() {
+            "pause" => {
+                self.client.respond(&request, Ok(json!({})));
+                self.stops.mode = Mode::Step;
+                self.reason = "pause";
+            }
+            "disconnect" | "terminate" => {
+                self.client.respond(&request, Ok(json!({})));
+                self.disconnected = request["command"] == "disconnect";
+                return Err(Halt::Exit(0));
+            }
+            "stackTrace" | "scopes" | "variables" | "evaluate" | "continue" | "next" | "stepIn"
+            | "stepOut" => self.pending.push_back(request),
+            _ => self.common(&request),
+        }
+        Ok(())
+    }
+
+    fn while_stopped(
+        &mut self,
+        request: &Json,
+        interpreter: &mut Interpreter,
+        span: &SourceString,
+    ) -> Resume {
+        let depth = interpreter.frames().len();
+        let arguments = &request["arguments"];
+        let run = |mode| Resume::Run(mode);
+        let (result, resume) = match request["command"].as_str().unwrap_or_default() {
+            "continue" => (
+                Ok(json!({ "allThreadsContinued": true })),
+                run(Mode::Continue),
+            ),
+            "next" => (Ok(json!({})), run(Mode::Next(depth))),
+            "stepIn" => (Ok(json!({})), run(Mode::Step)),
+            "stepOut" => (Ok(json!({})), run(Mode::Out(depth))),
+            "pause" => (Ok(json!({})), Resume::Stay),
+            "disconnect" | "terminate" => {
+                self.disconnected = request["command"] == "disconnect";
+                (Ok(json!({})), Resume::Quit)
+            }
+            "stackTrace" => (Ok(stack_trace(interpreter, span)), Resume::Stay),
+            "scopes" => (self.scopes_of(arguments, interpreter), Resume::Stay),
+            "variables" => (self.variables(arguments), Resume::Stay),
+            "evaluate" => (self.evaluate(arguments, interpreter), Resume::Stay),
+            _ => {
+                self.common(request);
+                return Resume::Stay;
+            }
+        };
+        self.client.respond(request, result);
+        resume
+    }
+
+    /// requests answered the same whether the program runs or not
+    fn common(&mut self, request: &Json) {
+        let arguments = &request["arguments"];
+        let result = match request["command"].as_str().unwrap_or_default() {
+            "setBreakpoints" => {
+                let path = arguments["source"]["path"].as_str().unwrap_or_default();
+                let lines: Vec<usize> = arguments["breakpoints"]
+                    .as_array()
+                    .into_iter()
+                    .flatten()
+                    .filter_map(|b| b["line"].as_u64())
+                    .map(|l| l as usize)
+                    .collect();
+                let verified: Vec<Json> = lines
+                    .iter()
+                    .map(|l| json!({ "verified": true, "line": l }))
+                    .collect();
+                self.breakpoints.insert(canonical(path), lines);
+                Ok(json!({ "breakpoints": verified }))
+            }
+            "setExceptionBreakpoints" => Ok(json!({})),
+            "threads" => Ok(json!({ "threads": [{ "id": THREAD, "name": "main" }] })),
+            "stackTrace" | "scopes" | "variables" | "evaluate" | "continue" | "next" | "stepIn"
+            | "stepOut" | "pause" => Err("the program is not running".to_owned()),
+            command => Err(format!("unsupported request '{}'", command)),
+        };
+        self.client.respond(request, result);
+    }
+
+    /// the scope of a frame, by its id
+    fn frame_scope(&self, frame: &Json, interpreter: &Interpreter) -> Option<Env> {
+        let depth = interpreter.frames().len();
+        let frame = frame.as_u64().unwrap_or(0) as usize;
+        self.scopes.get(depth.checked_sub(frame)?).cloned()
+    }
+
+    fn scopes_of(&mut self, arguments: &Json, interpreter: &Interpreter) -> Result<Json, String> {
+        let Some(env) = self.frame_scope(&arguments["frameId"], interpreter) else {
+            return Err("no such frame".to_owned());
+        };
+        let globals = interpreter.globals();
+        let mut locals = vec![];
+        let mut scope = Some(&env);
+        while let Some(s) = scope.filter(|s| !Arc::ptr_eq(s, globals)) {
+            locals.push(s.clone());
+            scope = s.parent();
+        }
+        let mut scopes = vec![];
+        if !locals.is_empty() {
+            let reference = self.reference(Reference::Scopes(locals));
+            scopes.push(
+                json!({ "name": "Locals", "variablesReference": reference, "expensive": false }),
+            );
+        }
+        let reference = self.reference(Reference::Scopes(vec![globals.clone()]));
+        scopes.push(
+            json!({ "name": "Globals", "variablesReference": reference, "expensive": false }),
+        );
+        Ok(json!({ "scopes": scopes }))
+    }
+
+    fn reference(&mut self, reference: Reference) -> usize {
+        self.references.push(reference);
+        self.references.len()
+    }
+
+    fn variables(&mut self, arguments: &Json) -> Result<Json, String> {
+        let id = arguments["variablesReference"].as_u64().unwrap_or(0) as usize;
+        let named: Vec<(String, Value)> =
+            match id.checked_sub(1).and_then(|i| self.references.get(i)) {
+                None => return Err("no such variables".to_owned()),
+                Some(Reference::Scopes(scopes)) => {
+                    let mut named: Vec<(String, Value)> = vec![];
+                    for scope in scopes {
+                        for name in scope.names() {
+                            // inner scopes shadow outer ones
+                            if named.iter().all(|(n, _)| *n != name) {
+                                let value = scope.get(&name).unwrap_or(Value::None);
+                                named.push((name, value));
+                            }
+                        }
+                    }
+                    named
+                }
+                Some(Reference::Value(Value::List(l))) => {
+                    let items = l.read().unwrap_or_else(|e| e.into_inner());
+                    items
+                        .iter()
+                        .enumerate()
+                        .map(|(i, v)| (i.to_string(), v.clone()))
+                        .collect()
+                }
+                Some(Reference::Value(Value::Map(m))) => {
+                    let entries = m.read().unwrap_or_else(|e| e.into_inner());
+                    entries
+                        .iter()
+                        .map(|(k, v)| (Value::from(k.clone()).repr(), v.clone()))
+                        .collect()
+                }
+                Some(Reference::Value(_)) => vec![],
+            };
+        let variables: Vec<Json> = named
+            .into_iter()
+            .map(|(name, value)| {
+                let mut variable = self.describe(&value);
+                variable["name"] = json!(name);
+                variable
+            })
+            .collect();
+        Ok(json!({ "variables": variables }))
+    }
+
+    /// the representation and type of a value, lists and maps can be
+    /// expanded
+    fn describe(&mut self, value: &Value) -> Json {
+        let expandable = match value {
+            Value::List(l) => !l.read().unwrap_or_else(|e| e.into_inner()).is_empty(),
+            Value::Map(m) => !m.read().unwrap_or_else(|e| e.into_inner()).is_empty(),
+            _ => false,
+        };
+        let reference = match expandable {
+            true => self.reference(Reference::Value(value.clone())),
+            false => 0,
+        };
+        json!({ "value": value.repr(), "type": value.type_name(), "variablesReference": reference })
+    }
+
+    fn evaluate(
+        &mut self,
+        arguments: &Json,
+        interpreter: &mut Interpreter,
+    ) -> Result<Json, String> {
+        let env = match &arguments["frameId"] {
+            Json::Null => interpreter.globals().clone(),
+            frame => self
+                .frame_scope(frame, interpreter)
+                .ok_or_else(|| "no such frame".to_owned())?,
+        };
+        let code = arguments["expression"].as_str().unwrap_or_default();
+        let src = Arc::new(Source::from_string(code.to_owned()));
+        let (program, errors) = parser::parse(&src);
+        if let Some(e) = errors.first() {
+            return Err(e.message().to_owned());
+        }
+        match interpreter.eval_in(&program, &env) {
+            Ok(value) => {
+                let mut result = self.describe(&value);
+                // evaluations call the representation a result
+                if let Some(fields) = result.as_object_mut() {
+                    let repr = fields.remove("value").unwrap_or_default();
+                    fields.insert("result".to_owned(), repr);
+                }
+                Ok(result)
+            }
+            Err(Halt::Error(e)) => Err(e.message().to_owned()),
+            Err(Halt::Exit(code)) => Err(format!("the code would exit with {}", code)),
+        }
+    }
+}
+
+/// the frames innermost first, the function stopped in runs the statement,
+/// the others the call of the next one
+fn stack_trace(interpreter: &Interpreter, span: &SourceString) -> Json {
+    let calls = interpreter.frames();
+    let functions = calls
+        .iter()
+        .rev()
+        .map(|f| f.function.as_str())
+        .chain(["<script>"]);
+    let locations = [span]
+        .into_iter()
+        .chain(calls.iter().rev().map(|f| &f.call));
+    let frames: Vec<Json> = functions
+        .zip(locations)
+        .enumerate()
+        .map(|(id, (function, at))| {
+            let position = at.position();
+            let path = at.file().unwrap_or_default();
+            json!({
+                "id": id,
+                "name": function,
+                "line": position.line,
+                "column": position.column,
+                "source": { "name": at.source().name(), "path": path },
+            })
+        })
+        .collect();
+    json!({ "stackFrames": frames, "totalFrames": calls.len() + 1 })
+}
+
+/// files are told apart by their canonical path, when they have one
+fn canonical(path: &str) -> PathBuf {
+    std::fs::canonicalize(path).unwrap_or_else(|_| PathBuf::from(path))
+}
+
+#[cfg(test)]
+mod test {
+    use std::{
+        io::Write,
+        sync::{mpsc, Arc, Mutex},
+    };
+
+    use serde_json::{json, Value as Json};
+
+    use crate::{lsp::read_message, test_utils};
+
+    use super::{serve, Client};
+
+    /// an output the test can read after giving it to the session
+    #[derive(Clone, Default)]
+    struct Shared(Arc<Mutex<Vec<u8>>>);
+
+    impl Write for Shared {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().expect("not poisoned").write(buf)
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    const SCRIPT: &str = "\
+function double(x) -> {
+    y := [x, x]
+    y[0] * 2
+}
+a := 1
+b := double(a)
+";
+
+    /// serve the requests, all sent up front, and return the messages sent
+    /// back and the exit status
+    fn session(script_name: &str, requests: Vec<Json>) -> (Vec<Json>, i32) {
+        let dir = test_utils::directory("dap", script_name);
+        let path = dir.join(script_name);
+        std::fs::write(&path, SCRIPT).expect("the temporary directory is writable");
+        let path = path.to_string_lossy().to_string();
+        let (sender, receiver) = mpsc::channel();
+        let requests = [
+            json!({ "command": "initialize", "arguments": {} }),
+            json!({ "command": "launch", "arguments": { "program": path } }),
+            json!({
+                "command": "setBreakpoints",
+                "arguments": { "source": { "path": path }, "breakpoints": [{ "line": 2 }] },
+            }),
+            json!({ "command": "configurationDone" }),
+        ]
+        .into_iter()
+        .chain(requests);
+        for (seq, mut r) in requests.enumerate() {
+            r["seq"] = json!(seq + 1);
+            r["type"] = json!("request");
+            sender.send(r).expect("the session is listening");
+        }
+        drop(sender);
+        let output = Shared::default();
+        let status = serve(Client::new(Box::new(output.clone())), receiver);
+        let bytes = output.0.lock().expect("not poisoned").clone();
+        let mut input = bytes.as_slice();
+        let mut messages = vec![];
+        while let Some(m) = read_message(&mut input).expect("valid messages") {
+            messages.push(m);
+        }
+        let _ = std::fs::remove_dir_all(dir);
+        (messages, status)
+    }
+
+    fn response<'a>(messages: &'a [Json], command: &str) -> &'a Json {
+        messages
+            .iter()
+            .find(|m| m["type"] == "response" && m["command"] == command)
+            .unwrap_or_else(|| panic!("no response to {} in {:?}", command, messages))
+    }
+
+    fn events<'a>(messages: &'a [Json], event: &str) -> Vec<&'a Json> {
+        messages.iter().filter(|m| m["event"] == event).collect()
+    }
+
+    #[test]
+    fn stop_at_breakpoints_and_inspect() {
+        let (messages, status) = session(
+            "dap_breakpoints.drgns",
+            vec![
+                json!({ "command": "threads" }),
+                json!({ "command": "stackTrace", "arguments": { "threadId": 1 } }),
+                json!({ "command": "scopes", "arguments": { "frameId": 0 } }),
+                json!({ "command": "variables", "arguments": { "variablesReference": 1 } }),
+                json!({ "command": "evaluate", "arguments": { "expression": "x * 10", "frameId": 0 } }),
+                json!({ "command": "evaluate", "arguments": { "expression": "nope", "frameId": 0 } }),
+                json!({ "command": "next", "arguments": { "threadId": 1 } }),
+                json!({ "command": "variables", "arguments": { "variablesReference": 1 } }),
+                json!({ "command": "scopes", "arguments": { "frameId": 0 } }),
+                json!({ "command": "variables", "arguments": { "variablesReference": 1 } }),
+                json!({ "command": "variables", "arguments": { "variablesReference": 3 } }),
+                json!({ "command": "continue", "arguments": { "threadId": 1 } }),
+            ],
+        );
+        // the requests ran out without a disconnect
+        assert_eq!(status, 1);
+        assert_eq!(
+            response(&messages, "initialize")["body"]["supportsConfigurationDoneRequest"],
+            true
+        );
+        assert_eq!(events(&messages, "initialized").len(), 1);
+        assert_eq!(response(&messages, "launch")["success"], true);
+        assert_eq!(
+            response(&messages, "setBreakpoints")["body"]["breakpoints"],
+            json!([{ "verified": true, "line": 2 }])
+        );
+        assert_eq!(
+            response(&messages, "threads")["body"]["threads"],
+            json!([{ "id": 1, "name": "main" }])
+        );
+
+        let stopped = events(&messages, "stopped");
+        assert_eq!(stopped.len(), 2);
+        assert_eq!(stopped[0]["body"]["reason"], "breakpoint");
+        assert_eq!(stopped[1]["body"]["reason"], "step");
+
+        let frames = &response(&messages, "stackTrace")["body"]["stackFrames"];
+        let frames: Vec<(&str, u64)> = frames
+            .as_array()
+            .expect("a list of frames")
+            .iter()
+            .map(|f| {
+                (
+                    f["name"].as_str().unwrap_or_default(),
+                    f["line"].as_u64().unwrap_or(0),
+                )
+            })
+            .collect();
+        assert_eq!(frames, [("double", 2), ("<script>", 6)]);
+
+        let scopes = &response(&messages, "scopes")["body"]["scopes"];
+        assert_eq!(scopes[0]["name"], "Locals");
+        assert_eq!(scopes[1]["name"], "Globals");
+
+        let variables: Vec<&Json> = messages
+            .iter()
+            .filter(|m| m["command"] == "variables")
+            .map(|m| &m["body"]["variables"])
+            .collect();
+        assert_eq!(
+            variables[0],
+            &json!([{ "name": "x", "value": "1", "type": "int", "variablesReference": 0 }])
+        );
+        // references only last until the program runs again
+        assert_eq!(
+            messages
+                .iter()
+                .filter(|m| m["command"] == "variables")
+                .nth(1)
+                .map(|m| &m["success"]),
+            Some(&json!(false))
+        );
+        // the body of a function is a scope inside the one of its parameters
+        assert_eq!(
+            variables[2],
+            &json!([
+                { "name": "y", "value": "[1, 1]", "type": "list", "variablesReference": 3 },
+                { "name": "x", "value": "1", "type": "int", "variablesReference": 0 },
+            ])
+        );
+        assert_eq!(
+            variables[3],
+            &json!([
+                { "name": "0", "value": "1", "type": "int", "variablesReference": 0 },
+                { "name": "1", "value": "1", "type": "int", "variablesReference": 0 },
+            ])
+        );
+
+        let evaluated: Vec<&Json> = messages
+            .iter()
+            .filter(|m| m["command"] == "evaluate")
+            .collect();
+        assert_eq!(evaluated[0]["body"]["result"], "10");
+        assert_eq!(evaluated[1]["success"], false);
+        assert_eq!(evaluated[1]["message"], "undefined variable 'nope'");
+
+        assert_eq!(events(&messages, "exited")[0]["body"]["exitCode"], 0);
+        assert_eq!(events(&messages, "terminated").len(), 1);
+        // every message is numbered in order
+        let seqs: Vec<u64> = messages.iter().filter_map(|m| m["seq"].as_u64()).collect();
+        assert_eq!(seqs, (1..=messages.len() as u64).collect::<Vec<_>>());
+    }
+
+    #[test]
+    fn disconnect_while_stopped() {
+        let (messages, status) = session(
+            "dap_disconnect.drgns",
+            vec![json!({ "command": "disconnect", "arguments": {} })],
+        );
+        assert_eq!(status, 0);
+        assert_eq!(response(&messages, "disconnect")["success"], true);
+        assert!(events(&messages, "terminated").is_empty());
+    }
+
+    #[test]
+    fn launch_errors() {
+        let (sender, receiver) = mpsc::channel();
+        let launch = json!({
+            "seq": 1,
+            "type": "request",
+            "command": "launch",
+            "arguments": { "program": "/no/such/file.drgns" },
+        });
+        sender.send(launch).expect("the session is listening");
+        drop(sender);
+        let output = Shared::default();
+        assert_eq!(serve(Client::new(Box::new(output.clone())), receiver), 1);
+        let bytes = output.0.lock().expect("not poisoned").clone();
+        let response = read_message(&mut bytes.as_slice())
+            .expect("a valid message")
+            .expect("a response");
+        assert_eq!(response["success"], false);
+        assert_eq!(response["request_seq"], 1);
+    }
+}
@@ -0,0 +1,487 @@
+//! The debugger, `drgns debug`, runs a script on the tree-walker and stops
+//! before its statements, so that the user can look around.
+//!
+//! It stops before the first statement, then wherever the last command
+//! says: at the next statement with `step`, at the next one in the same
+//! function or a caller with `next`, at the next one in a caller with
+//! `finish`, or at a breakpoint with `continue`. A
+//! breakpoint stops at the outermost statement starting on its line. While
+//! stopped, commands set breakpoints, show the calls being run and
+//! evaluate code in the scope of the statement about to run. Imported
+//! modules run without stopping.
+
+use std::{
+    io::{BufRead, Write},
+    path::Path,
+    sync::Arc,
+};
+
+use drgns::{
+    diagnostics,
+    interpreter::{Env, Halt, Hook, Interpreter},
+    parser::{self, Statement},
+    source::{Source, SourceString},
+    Value,
+};
+
+const PROMPT: &str = "(drgns) ";
+
+const HELP: &str = "\
+commands, they can be abbreviated to their first letter:
+  step              run until the next statement
+  next              run until the next statement in this function or a caller
+  finish            run until the function returns
+  continue          run until a breakpoint
+  break [FILE:]LINE stop at a line, of the script without a file
+  break             list the breakpoints
+  delete N          remove the breakpoint with the given number
+  backtrace         show the calls being run, innermost first (also `bt`)
+  print CODE        evaluate code where the program stopped
+  list              show the lines around the next statement
+  quit              stop the program
+an empty line repeats the last command";
+
+/// how far to run before stopping again
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Mode {
+    Step,
+    /// stop at a depth of calls no greater than this one
+    Next(usize),
+    /// stop at a depth of calls smaller than this one
+    Out(usize),
+    Continue,
+}
+
+/// Decides where to stop, for this debugger and the debug adapter
+pub struct Stops {
+    pub mode: Mode,
+
+    /// the statement last stopped at, and the depth of calls it ran at
+    stopped: Option<(SourceString, usize)>,
+}
+
+impl Stops {
+    pub fn new() -> Self {
+        Self {
+            mode: Mode::Step,
+            stopped: None,
+        }
+    }
+
+    /// whether to stop before a statement running at the given depth of
+    /// calls, given whether a breakpoint is set on the line it starts on
+    pub fn check(&mut self, span: &SourceString, depth: usize, at_breakpoint: bool) -> bool {
+        let line = span.position().line;
+        // statements nested in the one stopped at, on the same line, are
+        // part of it, unless they run in another call
+        let nested = self.stopped.as_ref().is_some_and(|(s, d)| {
+            *d == depth
+                && s.file() == span.file()
+                && s.position().line == line
+                && s.start() < span.start()
+                && span.end() <= s.end()
+        });
+        let stop = match self.mode {
+            Mode::Step => true,
+            Mode::Next(d) if depth <= d => true,
+            Mode::Out(d) if depth < d => true,
+            _ => at_breakpoint && !nested,
+        };
+        if stop {
+            self.stopped = Some((span.clone(), depth));
+        }
+        stop
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct Breakpoint {
+    file: String,
+    line: usize,
+}
+
+/// What a command asks for after it ran
+enum Resume {
+    Stay,
+    Run(Mode),
+    Quit,
+}
+
+pub struct Debugger<R, W> {
+    input: R,
+    output: W,
+
+    /// the path of the script, for breakpoints without a file
+    script: String,
+    breakpoints: Vec<Breakpoint>,
+    stops: Stops,
+    last_command: String,
+}
+
+impl<R: BufRead, W: Write> Debugger<R, W> {
+    pub fn new(input: R, output: W, script: &str) -> Self {
+        Self {
+            input,
+            output,
+            script: script.to_owned(),
+            breakpoints: vec![],
+            stops: Stops::new(),
+            last_command: String::new(),
+        }
+    }
+
+    fn at_breakpoint(&self, span: &SourceString) -> bool {
+        let line = span.position().line;
+        let file = span.file().unwrap_or_default();
+        self.breakpoints
+            .iter()
+            .any(|b| b.line == line && Path::new(file).ends_with(&b.file))
+    }
+
+    /// show where the program stopped
+    fn show(&mut self, interpreter: &Interpreter, span: &SourceString) {
+        let function = interpreter
+            .frames()
+            .last()
+            .map_or("<script>", |f| f.function.as_str());
+        let position = span.position();
+        let text = span.source().line(position.line).unwrap_or_default();
+        let _ = writeln!(self.output, "{} in {}", span.location(), function);
+        let _ = writeln!(self.output, "{} | {}", position.line, text);
+    }
+
+    fn prompt(&mut self) -> Option<String> {
+        let _ = write!(self.output, "{}", PROMPT);
+        let _ = self.output.flush();
+        let mut line = String::new();
+        match self.input.read_line(&mut line) {
+            Ok(0) | Err(_) => None,
+            Ok(_) => Some(line.trim().to_owned()),
+        }
+    }
+
+    fn execute(
+        &mut self,
+        command: &str,
+        interpreter: &mut Interpreter,
+        span: &SourceString,
+        env: &Env,
+    ) -> Resume {
+        let (name, argument) = command
+            .split_once(char::is_whitespace)
+            .map_or((command, ""), |(n, a)| (n, a.trim()));
+        let depth = interpreter.frames().len();
+        match name {
+            "s" | "step" => return Resume::Run(Mode::Step),
+            "n" | "next" => return Resume::Run(Mode::Next(depth)),
+            "f" | "finish" => return Resume::Run(Mode::Out(depth)),
+            "c" | "continue" => return Resume::Run(Mode::Continue),
+            "q" | "quit" => return Resume::Quit,
+            "b" | "break" if argument.is_empty() => {
+                for (i, b) in self.breakpoints.iter().enumerate() {
+                    let _ = writeln!(self.output, "{}: {}:{}", i + 1, b.file, b.line);
+                }
+            }
+            "b" | "break" => match self.breakpoint(argument) {
+                Some(b) => {
+                    let _ = writeln!(
+                        self.output,
+                        "breakpoint {} at {}:{}",
+                        self.breakpoints.len() + 1,
+                        b.file,
+                        b.line
+                    );
+                    self.breakpoints.push(b);
+                }
+                None => {
+                    let _ = writeln!(self.output, "expected a LINE or FILE:LINE");
+                }
+            },
+            "d" | "delete" => match argument.parse::<usize>() {
+                Ok(n) if (1..=self.breakpoints.len()).contains(&n) => {
+                    self.breakpoints.remove(n - 1);
+                }
+                _ => {
+                    let _ = writeln!(self.output, "no breakpoint '{}'", argument);
+                }
+            },
+            "bt" | "backtrace" => self.backtrace(interpreter, span),
+            "p" | "print" => self.print(argument, interpreter, env),
+            "l" | "list" => {
+                let line = span.position().line;
+                let source = span.source();
+                for l in line.saturating_sub(2).max(1)..=line + 2 {
+                    if let Some(text) = source.line(l) {
+                        let marker = if l == line { ">" } else { " " };
+                        let _ = writeln!(self.output, "{} {:>4} | {}", marker, l, text);
+                    }
+                }
+            }
+            "h" | "help" => {
+                let _ = writeln!(self.output, "{}", HELP);
+            }
+            _ => {
+                let _ = writeln!(self.output, "unknown command '{}', try 'help'", name);
+            }
+        }
+        Resume::Stay
+    }
+
+    fn breakpoint(&self, argument: &str) -> Option<Breakpoint> {
+        let (file, line) = match argument.rsplit_once(':') {
+            Some((file, line)) => (file.to_owned(), line),
+            None => (self.script.clone(), argument),
+        };
+        match line.parse() {
+            Ok(line) if line > 0 && !file.is_empty() => Some(Breakpoint { file, line }),
+            _ => None,
+        }
+    }
+
+    /// the function stopped in runs the statement, the others the call of
+    /// the next one
+    fn backtrace(&mut self, interpreter: &Interpreter, span: &SourceString) {
+        let frames = interpreter.frames();
+        let functions = frames
+            .iter()
+            .rev()
+            .map(|f| f.function.as_str())
+            .chain(["<script>"]);
+        let locations = [span]
+            .into_iter()
+            .chain(frames.iter().rev().map(|f| &f.call));
+        for (i, (function, at)) in functions.zip(locations).enumerate() {
+            let _ = writeln!(self.output, "#{} {} at {}", i, function, at.location());
+        }
+    }
+
+    fn print(&mut self, code: &str, interpreter: &mut Interpreter, env: &Env) {
+        let src = Arc::new(Source::from_string(code.to_owned()));
+        let (program, errors) = parser::parse(&src);
+        let errors = match interpreter.eval_in(&program, env) {
+            _ if !errors.is_empty() => errors,
+            Ok(Value::None) => vec![],
+            Ok(v) => {
+                let _ = writeln!(self.output, "{}", v.inspect());
+                vec![]
+            }
+            Err(Halt::Error(e)) => vec![e],
+            Err(Halt::Exit(code)) => {
+                let _ = writeln!(self.output, "the code would exit with {}", code);
+                vec![]
+            }
+        };
+        for e in errors {
+            let _ = write!(self.output, "{}", diagnostics::render(&e));
+        }
+    }
+}
+
+impl<R: BufRead, W: Write> Hook for Debugger<R, W> {
+    fn statement(
+        &mut self,
+        interpreter: &mut Interpreter,
+        statement: &Statement,
+        env: &Env,
+    ) -> Result<(), Halt> {
+        let span = statement.span();
+        let at_breakpoint = self.at_breakpoint(&span);
+        if !self
+            .stops
+            .check(&span, interpreter.frames().len(), at_breakpoint)
+        {
+            return Ok(());
+        }
+        self.show(interpreter, &span);
+        loop {
+            // the end of the input stops the program, like `quit`
+            let Some(mut command) = self.prompt() else {
+                return Err(Halt::Exit(0));
+            };
+            if command.is_empty() {
+                command = self.last_command.clone();
+            } else {
+                self.last_command = command.clone();
+            }
+            match self.execute(&command, interpreter, &span, env) {
+                Resume::Stay => {}
+                Resume::Run(mode) => {
+                    self.stops.mode = mode;
+                    return Ok(());
+                }
+                Resume::Quit => return Err(Halt::Exit(0)),
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::{
+        cell::RefCell,
+        io::{Cursor, Write},
+        rc::Rc,
+        sync::Arc,
+    };
+
+    use drgns::{interpreter::Interpreter, parser, source::Source};
+
+    use super::Debugger;
+
+    /// an output the test can read after giving it to the interpreter
+    #[derive(Clone, Default)]
+    struct Shared(Rc<RefCell<Vec<u8>>>);
+
+    impl Write for Shared {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.borrow_mut().write(buf)
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    const SCRIPT: &str = "\
+function double(x) -> {
+    y := x * 2
+    y
+}
+a := 1
+b := double(a)
+print(b)
+";
+
+    /// run the script with the commands, one per line, and return what the
+    /// debugger printed, without the prompts
+    fn debug_script(path: &str, script: &str, commands: &str) -> String {
+        let src = Arc::new(Source::new(Some(path.to_string()), script.to_string()));
+        let (program, _) = parser::parse(&src);
+        let output = Shared::default();
+        let debugger = Debugger::new(
+            Cursor::new(commands.to_string()),
+            output.clone(),
+            "main.drgns",
+        );
+        let mut interpreter = Interpreter::new();
+        interpreter.set_hook(Box::new(debugger));
+        let _ = interpreter.eval(&program);
+        let printed = String::from_utf8(output.0.borrow().clone()).expect("the output is text");
+        printed.replace(super::PROMPT, "")
+    }
+
+    fn debug(commands: &str) -> String {
+        debug_script("dir/main.drgns", SCRIPT, commands)
+    }
+
+    /// where the debugger stopped
+    fn stops(output: &str) -> Vec<&str> {
+        output
+            .lines()
+            .filter(|l| l.contains(".drgns:") && l.contains(" in "))
+            .collect()
+    }
+
+    #[test]
+    fn stop_at_breakpoints() {
+        let output = debug("break 2\nc\nbt\np x + 10\nc\n");
+        assert_eq!(
+            output,
+            "\
+dir/main.drgns:1:1 in <script>
+1 | function double(x) -> {
+breakpoint 1 at main.drgns:2
+dir/main.drgns:2:5 in double
+2 |     y := x * 2
+#0 double at dir/main.drgns:2:5
+#1 <script> at dir/main.drgns:6:6
+11
+"
+        );
+    }
+
+    #[test]
+    fn step_and_next() {
+        let output = debug("n\nn\nn\ns\ns\n\n");
+        assert_eq!(
+            stops(&output),
+            [
+                "dir/main.drgns:1:1 in <script>",
+                "dir/main.drgns:5:1 in <script>",
+                "dir/main.drgns:6:1 in <script>",
+                "dir/main.drgns:7:1 in <script>",
+            ]
+        );
+        // stepping goes into calls, an empty line repeats the last command
+        let output = debug("n\nn\ns\ns\n\nq\n");
+        assert_eq!(
+            stops(&output),
+            [
+                "dir/main.drgns:1:1 in <script>",
+                "dir/main.drgns:5:1 in <script>",
+                "dir/main.drgns:6:1 in <script>",
+                "dir/main.drgns:2:5 in double",
+                "dir/main.drgns:3:5 in double",
+                "dir/main.drgns:7:1 in <script>",
+            ]
+        );
+        // finishing runs until the function returns to its caller
+        let output = debug("n\nn\ns\nf\nq\n");
+        assert_eq!(
+            stops(&output),
+            [
+                "dir/main.drgns:1:1 in <script>",
+                "dir/main.drgns:5:1 in <script>",
+                "dir/main.drgns:6:1 in <script>",
+                "dir/main.drgns:2:5 in double",
+                "dir/main.drgns:7:1 in <script>",
+            ]
+        );
+    }
+
+    #[test]
+    fn stop_once_per_line() {
+        let script = "function f(n) -> { for i in [n, n] { i } }\nf(1)\nf(2)\n";
+        let output = debug_script("main.drgns", script, "b 1\nc\np n\nc\np n\nc\n");
+        // the statements of the loop are part of the one stopped at in each
+        // call, the body of the function is not part of its declaration
+        assert_eq!(
+            stops(&output),
+            [
+                "main.drgns:1:1 in <script>",
+                "main.drgns:1:20 in f",
+                "main.drgns:1:20 in f",
+            ]
+        );
+        assert!(output.contains("\n1\n"), "{}", output);
+        assert!(output.contains("\n2\n"), "{}", output);
+    }
+
+    #[test]
+    fn commands() {
+        let output = debug("b 3\nb other.drgns:4\nb x\nd 1\nb\nl\np nope\nfrobnicate\nq\n");
+        assert!(
+            output.contains("breakpoint 2 at other.drgns:4\n"),
+            "{}",
+            output
+        );
+        assert!(
+            output.contains("expected a LINE or FILE:LINE\n"),
+            "{}",
+            output
+        );
+        assert!(output.contains("\n1: other.drgns:4\n"), "{}", output);
+        assert!(
+            output.contains(">    1 | function double(x) -> {\n"),
+            "{}",
+            output
+        );
+        assert!(output.contains("     3 |     y\n"), "{}", output);
+        assert!(output.contains("undefined variable 'nope'"), "{}", output);
+        assert!(
+            output.contains("unknown command 'frobnicate'"),
+            "{}",
+            output
+        );
+    }
+}
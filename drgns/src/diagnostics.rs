@@ -0,0 +1,518 @@
+//! Human readable rendering of errors and warnings, in the same style as
+//! rustc:
+//!
+//! ```text
+//! error[E03001]: undefined variable 'lenght'
+//!  --> script.drgns:2:7
+//!   |
+//! 2 | print(lenght)
+//!   |       ^^^^^^
+//!   |
+//!   = hint: did you mean 'length'?
+//! ```
+//!
+//! Every error goes through here, no matter if it was found by the lexer, the
+//! parser, the checker or at run-time. Errors raised inside functions end
+//! with the calls they propagated out of:
+//!
+//! ```text
+//!   = stack, innermost first:
+//!       inner at script.drgns:1:24
+//!       outer at script.drgns:2:24
+//!       <script> at script.drgns:3:1
+//! ```
+//!
+//! On a terminal the severity, the carets and the gutter are colored as
+//! rustc colors them, unless `NO_COLOR` is set or `--color` says otherwise,
+//! see `colored`.
+//!
+//! With `--format=json` each diagnostic is written as a JSON object on its
+//! own line instead, for editors and CI annotations, see `json`.
+
+use std::{
+    fmt::Write,
+    io::{self, IsTerminal},
+    iter,
+    sync::OnceLock,
+};
+
+use serde_json::{json, Value};
+
+use crate::{eh::DragonError, lint::Fix, source::Source};
+
+const TAB_WIDTH: usize = 4;
+
+/// set to anything but nothing, turns the colors off, see https://no-color.org
+pub const NO_COLOR: &str = "NO_COLOR";
+
+/// When diagnostics are colored
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum ColorChoice {
+    /// when writing to a terminal, unless `NO_COLOR` is set or it is dumb
+    #[default]
+    Auto,
+    Always,
+    Never,
+}
+
+impl ColorChoice {
+    /// whether the standard error is colored
+    fn enabled(self) -> bool {
+        match self {
+            Self::Always => true,
+            Self::Never => false,
+            Self::Auto => {
+                let no_color = std::env::var_os(NO_COLOR).is_some_and(|v| !v.is_empty());
+                let dumb = std::env::var_os("TERM").is_some_and(|t| t == "dumb");
+                std::io::stderr().is_terminal() && !no_color && !dumb
+            }
+        }
+    }
+}
+
+static COLORED: OnceLock<bool> = OnceLock::new();
+
+/// Set whether `DragonError::report` colors diagnostics, before the first
+/// one is reported, later calls are ignored
+pub fn set_color(choice: ColorChoice) {
+    let _ = COLORED.set(choice.enabled());
+}
+
+/// Whether the diagnostics written to the standard error are colored, as
+/// `ColorChoice::Auto` would unless they were set to be
+pub fn colored() -> bool {
+    *COLORED.get_or_init(|| ColorChoice::Auto.enabled())
+}
+
+/// How diagnostics are written
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Format {
+    /// as rustc writes them, see `render`
+    #[default]
+    Human,
+
+    /// as a JSON object per line, see `json`
+    Json,
+}
+
+static FORMAT: OnceLock<Format> = OnceLock::new();
+
+/// Set how `report` writes diagnostics, before the first one is reported,
+/// later calls are ignored
+pub fn set_format(format: Format) {
+    let _ = FORMAT.set(format);
+}
+
+pub fn format() -> Format {
+    *FORMAT.get_or_init(Format::default)
+}
+
+/// Write a diagnostic to the standard error in the format set, with the
+/// fixes it has, which only JSON shows
+pub fn report(e: &DragonError, fixes: &[Fix]) -> io::Result<()> {
+    let text = match (format(), colored()) {
+        (Format::Json, _) => format!("{}\n", json(e, fixes)),
+        (Format::Human, true) => render_colored(e),
+        (Format::Human, false) => render(e),
+    };
+    io::Write::write_all(&mut io::stderr().lock(), text.as_bytes())
+}
+
+/// The escape codes of the parts of a diagnostic, none for plain text
+struct Style {
+    color: bool,
+
+    /// of the severity and the carets, red for errors and yellow for warnings
+    severity: &'static str,
+}
+
+const BOLD: &str = "1";
+const BLUE: &str = "1;34";
+
+impl Style {
+    fn paint(&self, code: &str, text: &str) -> String {
+        match self.color {
+            true => format!("\x1b[{}m{}\x1b[0m", code, text),
+            false => text.to_owned(),
+        }
+    }
+}
+
+/// The diagnostic as plain text
+pub fn render(e: &DragonError) -> String {
+    write(e, false)
+}
+
+/// The diagnostic with escape codes coloring it, for terminals
+pub fn render_colored(e: &DragonError) -> String {
+    write(e, true)
+}
+
+fn write(e: &DragonError, color: bool) -> String {
+    let mut out = String::new();
+    let (severity, code) = match e.is_warning() {
+        true => ("warning", "1;33"),
+        false => ("error", "1;31"),
+    };
+    let style = Style {
+        color,
+        severity: code,
+    };
+    let header = format!("{}[{}]", severity, e.code());
+    // writing to a String cannot fail
+    let _ = writeln!(
+        out,
+        "{}{}",
+        style.paint(style.severity, &header),
+        style.paint(BOLD, &format!(": {}", e.message()))
+    );
+
+    let Some(span) = e.span() else {
+        if let Some(hint) = e.hint() {
+            write_hint(&mut out, &style, "", hint);
+        }
+        render_trace(&mut out, &style, "", e);
+        return out;
+    };
+
+    let start = span.position();
+    let end = span.end_position();
+    let gutter = " ".repeat(start.line.to_string().len());
+    let bar = style.paint(BLUE, "|");
+    let arrow = style.paint(BLUE, "-->");
+    let _ = writeln!(
+        out,
+        "{}{} {}:{}",
+        gutter,
+        arrow,
+        span.source().name(),
+        start
+    );
+    let _ = writeln!(out, "{} {}", gutter, bar);
+
+    let line = span.source().line(start.line).unwrap_or_default();
+    let (text, from) = expand_tabs(&line, start.column);
+    // spans covering several lines are underlined up to the end of the first
+    let to = if end.line == start.line {
+        expand_tabs(&line, end.column).1
+    } else {
+        text.chars().count() + 1
+    };
+    let number = style.paint(BLUE, &start.line.to_string());
+    let _ = writeln!(out, "{} {} {}", number, bar, text);
+    let carets = "^".repeat(to.saturating_sub(from).max(1));
+    let _ = writeln!(
+        out,
+        "{} {} {}{}",
+        gutter,
+        bar,
+        " ".repeat(from - 1),
+        style.paint(style.severity, &carets)
+    );
+
+    if let Some(hint) = e.hint() {
+        let _ = writeln!(out, "{} {}", gutter, bar);
+        write_hint(&mut out, &style, &gutter, hint);
+    }
+    render_trace(&mut out, &style, &gutter, e);
+    out
+}
+
+fn write_hint(out: &mut String, style: &Style, gutter: &str, hint: &str) {
+    let equals = style.paint(BLUE, "=");
+    let _ = writeln!(
+        out,
+        "{} {} {}: {}",
+        gutter,
+        equals,
+        style.paint(BOLD, "hint"),
+        hint
+    );
+}
+
+/// where each function on the way out was running, the function an error
+/// was raised in is where it was raised, the others where they called the
+/// next one. Runs of the same line, from recursion, are shown once. When the
+/// host called the outermost function, there is no script calling it.
+fn render_trace(out: &mut String, style: &Style, gutter: &str, e: &DragonError) {
+    if e.trace().is_empty() {
+        return;
+    }
+    let _ = writeln!(out, "{} {}", gutter, style.paint(BLUE, "|"));
+    let equals = style.paint(BLUE, "=");
+    let _ = writeln!(out, "{} {} stack, innermost first:", gutter, equals);
+    let functions = e
+        .trace()
+        .iter()
+        .map(|f| f.function.as_str())
+        .chain(["<script>"]);
+    let locations = iter::once(e.span()).chain(e.trace().iter().map(|f| f.call.as_ref()));
+    let frames: Vec<String> = functions
+        .zip(locations)
+        .filter(|(function, at)| *function != "<script>" || at.is_some())
+        .map(|(function, at)| match at {
+            Some(at) => format!("{} at {}", function, at.location()),
+            None => function.to_owned(),
+        })
+        .collect();
+    let mut i = 0;
+    while i < frames.len() {
+        let repeated = frames[i..].iter().take_while(|f| **f == frames[i]).count();
+        let _ = writeln!(out, "{}     {}", gutter, frames[i]);
+        if repeated > 1 {
+            let _ = writeln!(
+                out,
+                "{}     [the line above is repeated {} more times]",
+                gutter,
+                repeated - 1
+            );
+        }
+        i += repeated;
+    }
+}
+
+/// The diagnostic as a JSON object, with the file and the range it is
+/// about, `null` if it is about no code, and the fixes replacing the text in
+/// their range. Lines and columns count from 1, offsets in chars from 0.
+///
+/// ```json
+/// {
+///   "file": "script.drgns",
+///   "range": {
+///     "start": { "line": 2, "column": 7, "offset": 13 },
+///     "end": { "line": 2, "column": 13, "offset": 19 }
+///   },
+///   "severity": "error",
+///   "code": "E03001",
+///   "message": "undefined variable 'lenght'",
+///   "hint": "did you mean 'length'?",
+///   "fixes": []
+/// }
+/// ```
+pub fn json(e: &DragonError, fixes: &[Fix]) -> Value {
+    let position = |source: &Source, i: usize| {
+        let p = source.position(i);
+        json!({ "line": p.line, "column": p.column, "offset": p.offset })
+    };
+    let range = |source: &Source, start: usize, end: usize| json!({ "start": position(source, start), "end": position(source, end) });
+    let (file, span, fixes) = match e.span() {
+        Some(span) => {
+            let source = span.source();
+            let fixes: Vec<Value> = fixes
+                .iter()
+                .map(|f| {
+                    let range = range(source, f.range.start, f.range.end);
+                    json!({ "range": range, "text": f.text })
+                })
+                .collect();
+            let span = range(source, span.start(), span.end());
+            (Value::from(source.name()), span, fixes)
+        }
+        None => (Value::Null, Value::Null, vec![]),
+    };
+    json!({
+        "file": file,
+        "range": span,
+        "severity": if e.is_warning() { "warning" } else { "error" },
+        "code": e.code().to_string(),
+        "message": e.message(),
+        "hint": e.hint(),
+        "fixes": fixes,
+    })
+}
+
+/// replace tabs with spaces, so that the carets line up with the text, also
+/// returns the column translated to the expanded text
+fn expand_tabs(line: &str, column: usize) -> (String, usize) {
+    let mut text = String::with_capacity(line.len());
+    let mut translated = None;
+    for (i, c) in line.chars().enumerate() {
+        if i + 1 == column {
+            translated = Some(text.chars().count() + 1);
+        }
+        match c {
+            '\t' => text.push_str(&" ".repeat(TAB_WIDTH)),
+            c => text.push(c),
+        }
+    }
+    let column = translated.unwrap_or_else(|| text.chars().count() + column - line.chars().count());
+    (text, column)
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+
+    use crate::{
+        eh::{DragonError, ErrorCode},
+        source::{Source, SourceString},
+    };
+
+    // the function and the macro of serde_json
+    use super::{json, render, render_colored, ColorChoice, NO_COLOR};
+    use crate::lint::Fix;
+
+    fn span(src: &str, start: usize, end: usize) -> SourceString {
+        let source = Arc::new(Source::new(Some("test.drgns".to_string()), src.to_string()));
+        SourceString::new(&source, start..end)
+    }
+
+    #[test]
+    fn render_excerpt() {
+        let e = DragonError::new(
+            ErrorCode::UndefinedVariable,
+            "undefined variable 'lenght'".to_string(),
+            Some(span("x := 1\nprint(lenght)\n", 13, 19)),
+        )
+        .with_hint("did you mean 'length'?");
+        assert_eq!(
+            render(&e),
+            concat!(
+                "error[E03001]: undefined variable 'lenght'\n",
+                " --> test.drgns:2:7\n",
+                "  |\n",
+                "2 | print(lenght)\n",
+                "  |       ^^^^^^\n",
+                "  |\n",
+                "  = hint: did you mean 'length'?\n",
+            )
+        );
+    }
+
+    #[test]
+    fn render_warning_without_span() {
+        let e = DragonError::new(ErrorCode::Generic, "oops".to_string(), None).into_warning();
+        assert_eq!(render(&e), "warning[E00001]: oops\n");
+    }
+
+    #[test]
+    fn render_tabs_and_empty_spans() {
+        let e = DragonError::new(
+            ErrorCode::UnexpectedEndOfInput,
+            "unexpected end of input".to_string(),
+            Some(span("\tx +", 4, 4)),
+        );
+        assert_eq!(
+            render(&e),
+            concat!(
+                "error[E02008]: unexpected end of input\n",
+                " --> test.drgns:1:5\n",
+                "  |\n",
+                "1 |     x +\n",
+                "  |        ^\n",
+            )
+        );
+    }
+
+    #[test]
+    fn render_stack() {
+        let src = "function inner(x) -> { x + true }\nfunction outer(y) -> { inner(y) }\nouter(1)";
+        let at = |needle: &str| {
+            let start = src.find(needle).expect("in the source");
+            span(src, start, start + needle.len())
+        };
+        let e = DragonError::new(
+            ErrorCode::Runtime,
+            "unsupported operand types for +: int and bool".to_string(),
+            Some(at("x + true")),
+        )
+        .with_frame("inner", Some(at("inner(y)")))
+        .with_frame("outer", Some(at("outer(1)")));
+        assert!(render(&e).ends_with(concat!(
+            "  |                        ^^^^^^^^\n",
+            "  |\n",
+            "  = stack, innermost first:\n",
+            "      inner at test.drgns:1:24\n",
+            "      outer at test.drgns:2:24\n",
+            "      <script> at test.drgns:3:1\n",
+        )));
+
+        let mut deep = DragonError::new(ErrorCode::Runtime, "deep".to_string(), None);
+        for _ in 0..3 {
+            deep = deep.with_frame("f", Some(at("inner(y)")));
+        }
+        assert_eq!(
+            render(&deep),
+            concat!(
+                "error[E04001]: deep\n",
+                " |\n",
+                " = stack, innermost first:\n",
+                "     f\n",
+                "     f at test.drgns:2:24\n",
+                "     [the line above is repeated 1 more times]\n",
+                "     <script> at test.drgns:2:24\n",
+            )
+        );
+    }
+
+    #[test]
+    fn render_multiline_span() {
+        let e = DragonError::new(
+            ErrorCode::Syntax,
+            "bad".to_string(),
+            Some(span("{ a\nb }", 0, 7)),
+        );
+        assert!(render(&e).contains("1 | { a\n  | ^^^\n"));
+    }
+
+    #[test]
+    fn render_colors() {
+        let e = DragonError::new(
+            ErrorCode::Generic,
+            "oops".to_string(),
+            Some(span("x := 1", 0, 1)),
+        )
+        .into_warning()
+        .with_hint("rename it");
+        assert_eq!(
+            render_colored(&e),
+            concat!(
+                "\x1b[1;33mwarning[E00001]\x1b[0m\x1b[1m: oops\x1b[0m\n",
+                " \x1b[1;34m-->\x1b[0m test.drgns:1:1\n",
+                "  \x1b[1;34m|\x1b[0m\n",
+                "\x1b[1;34m1\x1b[0m \x1b[1;34m|\x1b[0m x := 1\n",
+                "  \x1b[1;34m|\x1b[0m \x1b[1;33m^\x1b[0m\n",
+                "  \x1b[1;34m|\x1b[0m\n",
+                "  \x1b[1;34m=\x1b[0m \x1b[1mhint\x1b[0m: rename it\n",
+            )
+        );
+        std::env::set_var(NO_COLOR, "1");
+        assert!(!ColorChoice::Auto.enabled());
+        assert!(ColorChoice::Always.enabled());
+        std::env::remove_var(NO_COLOR);
+        assert!(!ColorChoice::Never.enabled());
+    }
+
+    #[test]
+    fn render_json() {
+        let e = DragonError::new(
+            ErrorCode::UnusedVariable,
+            "'x' is never used".to_string(),
+            Some(span("print(1)\nx := 1", 9, 10)),
+        )
+        .into_warning();
+        let fix = Fix {
+            range: 9..15,
+            text: String::new(),
+        };
+        let position =
+            |line, column, offset| json!({ "line": line, "column": column, "offset": offset });
+        assert_eq!(
+            json(&e, &[fix]),
+            json!({
+                "file": "test.drgns",
+                "range": { "start": position(2, 1, 9), "end": position(2, 2, 10) },
+                "severity": "warning",
+                "code": "E07001",
+                "message": "'x' is never used",
+                "hint": null,
+                "fixes": [{
+                    "range": { "start": position(2, 1, 9), "end": position(2, 7, 15) },
+                    "text": "",
+                }],
+            })
+        );
+        let e = DragonError::new(ErrorCode::Generic, "oops".to_string(), None);
+        assert_eq!(json(&e, &[])["range"], json!(null));
+    }
+}
@@ -0,0 +1,458 @@
+//! Differential testing of the engines: a program must do the same on the
+//! tree-walker and on the VM, down to what it prints and the error it stops
+//! with. `compare` runs a program on both, and `program` writes a random
+//! one from a seed, so that a divergence is replayed from its seed alone.
+//!
+//! The tests of the module compare the programs of many seeds, more with
+//! `DRGNS_DIFFERENTIAL_SEEDS` set to how many, and the fuzz targets in
+//! `fuzz/` compare the programs a fuzzer writes.
+//!
+//! The programs run deterministically, so that drawing random numbers or
+//! reading the clock does the same on both, and for a second at most, so
+//! that sleeping doesn't hang the fuzzer. The engines count their steps
+//! differently, so programs one of them stopped for going over a limit
+//! aren't compared, and neither is what they logged.
+
+use std::{
+    fmt::{self, Display},
+    time::Duration,
+};
+
+use rand::{rngs::StdRng, seq::IndexedRandom, Rng, SeedableRng};
+
+use crate::{
+    eh::ErrorCode,
+    playground::{self, Outcome},
+    Engine, Interpreter, Limits, Sandbox,
+};
+
+#[cfg(test)]
+mod test;
+
+/// The steps each engine may take, before the program isn't compared
+const STEPS: u64 = 1_000_000;
+
+/// How long each engine may run for, sleeping included
+const TIME: Duration = Duration::from_secs(1);
+
+/// Where the engines went apart on a program
+#[derive(Debug, Clone, PartialEq)]
+pub struct Divergence {
+    pub code: String,
+    pub walker: Outcome,
+    pub vm: Outcome,
+}
+
+impl Display for Divergence {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "the engines disagree on:\n{}", self.code)?;
+        for (engine, outcome) in [("tree-walker", &self.walker), ("VM", &self.vm)] {
+            writeln!(f, "{}:", engine)?;
+            writeln!(f, "  value: {:?}", outcome.value)?;
+            writeln!(f, "  stdout: {:?}", outcome.stdout)?;
+            writeln!(f, "  status: {}", outcome.status)?;
+            for d in summary(outcome) {
+                writeln!(f, "  error: {}", d)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Run the program on both engines, in a sandbox and deterministically, and
+/// tell whether they did the same
+pub fn compare(code: &str) -> Result<(), Divergence> {
+    let run = |engine| {
+        let mut interpreter = Interpreter::with_engine(engine);
+        interpreter.set_sandbox(Sandbox::new());
+        interpreter.set_deterministic();
+        interpreter.set_limits(Limits {
+            steps: Some(STEPS),
+            time: Some(TIME),
+            ..Limits::default()
+        });
+        playground::run(&mut interpreter, code)
+    };
+    let (walker, vm) = (run(Engine::Walk), run(Engine::Vm));
+    let limited = |o: &Outcome| {
+        let code = ErrorCode::LimitExceeded.to_string();
+        o.diagnostics.iter().any(|d| d["code"] == code.as_str())
+    };
+    let same = |a: &Outcome, b: &Outcome| {
+        (&a.value, &a.stdout, a.status, summary(a)) == (&b.value, &b.stdout, b.status, summary(b))
+    };
+    match limited(&walker) || limited(&vm) || same(&walker, &vm) {
+        true => Ok(()),
+        false => Err(Divergence {
+            code: code.to_owned(),
+            walker,
+            vm,
+        }),
+    }
+}
+
+/// the code, the message and the position of each error
+fn summary(outcome: &Outcome) -> Vec<String> {
+    outcome
+        .diagnostics
+        .iter()
+        .map(|d| {
+            let start = &d["range"]["start"];
+            format!(
+                "{} {} at {}:{}",
+                d["code"], d["message"], start["line"], start["column"]
+            )
+        })
+        .collect()
+}
+
+/// A random program, the same for the same seed. Its values mostly have
+/// the types the operations expect, so that it gets somewhere, but not
+/// always, for the errors to be compared too.
+pub fn program(seed: u64) -> String {
+    let mut g = Generator {
+        rng: StdRng::seed_from_u64(seed),
+        scopes: vec![vec![]],
+        functions: vec![],
+        next: 0,
+        depth: 0,
+        out: String::new(),
+    };
+    g.program();
+    g.out
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Kind {
+    Int,
+    Bool,
+    Str,
+    /// of ints
+    List,
+}
+
+const KINDS: [Kind; 4] = [Kind::Int, Kind::Bool, Kind::Str, Kind::List];
+
+const WORDS: [&str; 5] = ["", "a", "dragon", "é", "two words"];
+
+struct Variable {
+    name: String,
+    kind: Kind,
+    mutable: bool,
+}
+
+struct Generator {
+    rng: StdRng,
+
+    /// the variables of each block, innermost last
+    scopes: Vec<Vec<Variable>>,
+
+    /// the functions declared and how many parameters they have, they take
+    /// and return ints
+    functions: Vec<(String, usize)>,
+
+    /// the number of the next name
+    next: usize,
+
+    /// how deep the blocks nest
+    depth: usize,
+
+    out: String,
+}
+
+/// how deep blocks and expressions nest at most
+const MAX_DEPTH: usize = 3;
+
+impl Generator {
+    fn program(&mut self) {
+        for _ in 0..self.rng.random_range(0..3) {
+            self.function();
+        }
+        for _ in 0..self.rng.random_range(3..12) {
+            self.statement();
+        }
+        let kind = self.kind();
+        let value = self.expression(kind, 0);
+        self.line(&value);
+    }
+
+    fn name(&mut self, prefix: &str) -> String {
+        self.next += 1;
+        format!("{}{}", prefix, self.next)
+    }
+
+    fn kind(&mut self) -> Kind {
+        KINDS[self.rng.random_range(0..KINDS.len())]
+    }
+
+    fn line(&mut self, text: &str) {
+        self.out.push_str(&"    ".repeat(self.depth));
+        self.out.push_str(text);
+        self.out.push('\n');
+    }
+
+    fn declare(&mut self, name: &str, kind: Kind, mutable: bool) {
+        let variable = Variable {
+            name: name.to_owned(),
+            kind,
+            mutable,
+        };
+        if let Some(scope) = self.scopes.last_mut() {
+            scope.push(variable);
+        }
+    }
+
+    /// `function f1(a2, a3) -> { ... }`, seeing only its parameters and the
+    /// functions before it
+    fn function(&mut self) {
+        let name = self.name("f");
+        let parameters: Vec<String> = (0..self.rng.random_range(0..3))
+            .map(|_| self.name("a"))
+            .collect();
+        self.line(&format!(
+            "function {}({}) -> {{",
+            name,
+            parameters.join(", ")
+        ));
+        let outer = std::mem::replace(&mut self.scopes, vec![vec![]]);
+        for p in &parameters {
+            self.declare(p, Kind::Int, false);
+        }
+        self.depth += 1;
+        for _ in 0..self.rng.random_range(0..3) {
+            self.statement();
+        }
+        let result = self.expression(Kind::Int, 1);
+        self.line(&result);
+        self.depth -= 1;
+        self.line("}");
+        self.scopes = outer;
+        self.functions.push((name, parameters.len()));
+    }
+
+    /// the statements of a block, a line each, in a scope of their own with
+    /// the variable the block declares
+    fn body(&mut self, declared: Option<(&str, Kind)>) {
+        self.scopes.push(vec![]);
+        if let Some((name, kind)) = declared {
+            self.declare(name, kind, false);
+        }
+        self.depth += 1;
+        for _ in 0..self.rng.random_range(1..4) {
+            self.statement();
+        }
+        self.depth -= 1;
+        self.scopes.pop();
+    }
+
+    fn statement(&mut self) {
+        let nested = self.depth < MAX_DEPTH;
+        match self.rng.random_range(0..10) {
+            0..=2 => {
+                let kind = self.kind();
+                let mutable = self.rng.random_bool(0.5);
+                let value = self.expression(kind, 0);
+                let name = self.name("x");
+                let keyword = if mutable { "mut " } else { "" };
+                self.line(&format!("{}{} := {}", keyword, name, value));
+                self.declare(&name, kind, mutable);
+            }
+            3 | 4 => self.assignment(),
+            5 => {
+                let arguments: Vec<String> = (0..self.rng.random_range(1..3))
+                    .map(|_| {
+                        let kind = self.kind();
+                        self.expression(kind, 0)
+                    })
+                    .collect();
+                self.line(&format!("print({})", arguments.join(", ")));
+            }
+            6 if nested => {
+                let condition = self.expression(Kind::Bool, 0);
+                self.line(&format!("if {} {{", condition));
+                self.body(None);
+                if self.rng.random_bool(0.5) {
+                    let other = self.expression(Kind::Bool, 0);
+                    self.line(&format!("}} elif {} {{", other));
+                    self.body(None);
+                }
+                if self.rng.random_bool(0.5) {
+                    self.line("} else {");
+                    self.body(None);
+                }
+                self.line("}");
+            }
+            7 if nested => {
+                let name = self.name("i");
+                // not over a variable, which the loop could push to
+                let items = match self.rng.random_bool(0.7) {
+                    true => format!("range({})", self.rng.random_range(0..6)),
+                    false => {
+                        let items: Vec<String> = (0..self.rng.random_range(0..4))
+                            .map(|_| self.expression(Kind::Int, 2))
+                            .collect();
+                        format!("[{}]", items.join(", "))
+                    }
+                };
+                self.line(&format!("for {} in {} {{", name, items));
+                self.body(Some((&name, Kind::Int)));
+                self.line("}");
+            }
+            8 if nested => {
+                self.line("try {");
+                self.body(None);
+                self.line("} catch e {");
+                self.body(None);
+                self.line("}");
+            }
+            _ => {
+                let kind = self.kind();
+                let value = self.expression(kind, 0);
+                self.line(&value);
+            }
+        }
+    }
+
+    fn assignment(&mut self) {
+        let mutable: Vec<(String, Kind)> = self
+            .scopes
+            .iter()
+            .flatten()
+            .filter(|v| v.mutable)
+            .map(|v| (v.name.clone(), v.kind))
+            .collect();
+        let Some((name, kind)) = mutable.choose(&mut self.rng).cloned() else {
+            return;
+        };
+        let line = match (kind, self.rng.random_range(0..3)) {
+            (Kind::Int, 0) => format!("{} += {}", name, self.expression(Kind::Int, 1)),
+            (Kind::Int, 1) => format!("{} -= {}", name, self.expression(Kind::Int, 1)),
+            (Kind::List, 0) => format!("{}.push({})", name, self.expression(Kind::Int, 1)),
+            (Kind::List, 1) => {
+                let index = self.expression(Kind::Int, 2);
+                let value = self.expression(Kind::Int, 1);
+                format!("{}[{}] = {}", name, index, value)
+            }
+            (kind, _) => format!("{} = {}", name, self.expression(kind, 0)),
+        };
+        self.line(&line);
+    }
+
+    fn expression(&mut self, kind: Kind, depth: usize) -> String {
+        // now and then, a value of another type than the one expected
+        let kind = match self.rng.random_ratio(1, 30) {
+            true => self.kind(),
+            false => kind,
+        };
+        if depth >= MAX_DEPTH || self.rng.random_bool(0.35) {
+            return self.atom(kind);
+        }
+        let d = depth + 1;
+        match kind {
+            Kind::Int => match self.rng.random_range(0..10) {
+                0..=4 => {
+                    let operator = ["+", "-", "*", "/", "%"][self.rng.random_range(0..5)];
+                    let (a, b) = (self.expression(kind, d), self.expression(kind, d));
+                    format!("({} {} {})", a, operator, b)
+                }
+                5 => format!("(-{})", self.expression(kind, d)),
+                6 => match self.rng.random_bool(0.5) {
+                    true => format!("len({})", self.expression(Kind::List, d)),
+                    false => format!("len({})", self.expression(Kind::Str, d)),
+                },
+                7 => {
+                    let list = self.expression(Kind::List, d);
+                    format!("{}[{}]", list, self.expression(kind, d))
+                }
+                8 => self.conditional(kind, d),
+                _ => match self.functions.choose(&mut self.rng).cloned() {
+                    Some((name, count)) => {
+                        let arguments: Vec<String> =
+                            (0..count).map(|_| self.expression(kind, d)).collect();
+                        format!("{}({})", name, arguments.join(", "))
+                    }
+                    None => self.atom(kind),
+                },
+            },
+            Kind::Bool => match self.rng.random_range(0..6) {
+                0 | 1 => {
+                    let operator = ["<", "<=", "==", "!=", ">"][self.rng.random_range(0..5)];
+                    let (a, b) = (self.expression(Kind::Int, d), self.expression(Kind::Int, d));
+                    format!("({} {} {})", a, operator, b)
+                }
+                2 => format!("not {}", self.expression(kind, d)),
+                3 | 4 => {
+                    let operator = ["and", "or"][self.rng.random_range(0..2)];
+                    let (a, b) = (self.expression(kind, d), self.expression(kind, d));
+                    format!("({} {} {})", a, operator, b)
+                }
+                _ => {
+                    let (a, b) = (self.expression(Kind::Str, d), self.expression(Kind::Str, d));
+                    format!("({} == {})", a, b)
+                }
+            },
+            Kind::Str => match self.rng.random_range(0..4) {
+                0 => {
+                    let (a, b) = (self.expression(kind, d), self.expression(kind, d));
+                    format!("({} ++ {})", a, b)
+                }
+                // only a name or a literal, quotes don't nest in strings
+                1 => format!("\"<${{{}}}>\"", self.atom(Kind::Int)),
+                2 => {
+                    let s = self.expression(kind, d);
+                    let (a, b) = (self.expression(Kind::Int, d), self.expression(Kind::Int, d));
+                    format!("{}[{}:{}]", s, a, b)
+                }
+                _ => self.conditional(kind, d),
+            },
+            Kind::List => match self.rng.random_range(0..3) {
+                0 => {
+                    let items: Vec<String> = (0..self.rng.random_range(0..4))
+                        .map(|_| self.expression(Kind::Int, d))
+                        .collect();
+                    format!("[{}]", items.join(", "))
+                }
+                1 => {
+                    let (a, b) = (self.expression(kind, d), self.expression(kind, d));
+                    format!("({} ++ {})", a, b)
+                }
+                _ => {
+                    let list = self.expression(kind, d);
+                    format!("{}[{}:]", list, self.expression(Kind::Int, d))
+                }
+            },
+        }
+    }
+
+    fn conditional(&mut self, kind: Kind, depth: usize) -> String {
+        let condition = self.expression(Kind::Bool, depth);
+        let (a, b) = (self.expression(kind, depth), self.expression(kind, depth));
+        format!("(if {} {{ {} }} else {{ {} }})", condition, a, b)
+    }
+
+    /// a variable of the kind, or a literal
+    fn atom(&mut self, kind: Kind) -> String {
+        let visible: Vec<String> = self
+            .scopes
+            .iter()
+            .flatten()
+            .filter(|v| v.kind == kind)
+            .map(|v| v.name.clone())
+            .collect();
+        if let Some(name) = visible
+            .choose(&mut self.rng)
+            .filter(|_| self.rng.random_bool(0.6))
+        {
+            return name.clone();
+        }
+        match kind {
+            Kind::Int => self.rng.random_range(0..20).to_string(),
+            Kind::Bool => self.rng.random_bool(0.5).to_string(),
+            Kind::Str => format!("{:?}", WORDS[self.rng.random_range(0..WORDS.len())]),
+            Kind::List => match self.rng.random_bool(0.3) {
+                true => "[]".to_owned(),
+                false => "[1, 2, 3]".to_owned(),
+            },
+        }
+    }
+}
@@ -0,0 +1,79 @@
+use std::sync::Arc;
+
+use crate::{parser::parse, playground::Outcome, source::Source};
+
+use super::{compare, program, Divergence};
+
+/// how many seeds are compared, unless `DRGNS_DIFFERENTIAL_SEEDS` is set
+const SEEDS: u64 = 200;
+
+#[test]
+fn differential_programs() {
+    for seed in 0..50 {
+        let code = program(seed);
+        assert_eq!(code, program(seed), "seed {} writes another program", seed);
+        let (_, errors) = parse(&Arc::new(Source::from_string(code.clone())));
+        assert!(
+            errors.is_empty(),
+            "the program of seed {} doesn't parse:\n{}{:?}",
+            seed,
+            code,
+            errors
+        );
+    }
+    assert_ne!(program(0), program(1));
+}
+
+#[test]
+fn differential_engines_agree() {
+    let seeds = std::env::var("DRGNS_DIFFERENTIAL_SEEDS")
+        .ok()
+        .and_then(|n| n.parse().ok())
+        .unwrap_or(SEEDS);
+    for seed in 0..seeds {
+        if let Err(divergence) = compare(&program(seed)) {
+            panic!("seed {}: {}", seed, divergence);
+        }
+    }
+}
+
+#[test]
+fn differential_compare() {
+    assert_eq!(compare("print(1)\n[1, 2]"), Ok(()));
+    // errors, and the code that doesn't parse, are compared too
+    assert_eq!(compare("print(1)\n1 / 0"), Ok(()));
+    assert_eq!(compare("x := ("), Ok(()));
+    // the steps of the engines differ
+    assert_eq!(compare("for {}"), Ok(()));
+    // and nothing reaches outside
+    assert_eq!(compare("fs::read(\"Cargo.toml\")"), Ok(()));
+    // random numbers and the clocks are the same on both engines
+    assert_eq!(
+        compare("print(random::int(0, 1000000), random::float(), random::token(8))"),
+        Ok(())
+    );
+    assert_eq!(compare("print(time::now(), time::monotonic())"), Ok(()));
+    // and sleeping stops with the limit on time
+    assert_eq!(compare("time::sleep(1e9)\nprint(1)"), Ok(()));
+
+    let outcome = |stdout: &str| Outcome {
+        value: None,
+        stdout: stdout.to_owned(),
+        stderr: String::new(),
+        diagnostics: vec![],
+        status: 0,
+    };
+    let divergence = Divergence {
+        code: "print(1)\n".to_owned(),
+        walker: outcome("1\n"),
+        vm: outcome("2\n"),
+    };
+    assert_eq!(
+        divergence.to_string(),
+        concat!(
+            "the engines disagree on:\nprint(1)\n\n",
+            "tree-walker:\n  value: None\n  stdout: \"1\\n\"\n  status: 0\n",
+            "VM:\n  value: None\n  stdout: \"2\\n\"\n  status: 0\n",
+        )
+    );
+}
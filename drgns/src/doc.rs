@@ -0,0 +1,732 @@
+//! The documentation of scripts, which `drgns doc` writes.
+//!
+//! Comments starting with `///` document the function or the struct declared
+//! on the lines right below them, or the field or the method of a struct.
+//! Those starting with `//!` before the first statement document the module,
+//! as does a block of `///` comments there that a blank line keeps apart from
+//! the statement. Their text is Markdown.
+//!
+//! Each module gets a page with the signatures of what it exports, the names
+//! starting with `_` are private, and links to the pages of the modules it
+//! imports. `` `json::parse` `` in a comment links to `parse` on the page of
+//! the module imported as `json`, and `` `parse` `` or `` `Point.norm` `` to
+//! the ones of the same module.
+//!
+//! The code blocks of the comments are examples, unless their language is
+//! other than `drgns`. The test runner runs them after the statements of
+//! their file, as it does tests, see `examples`.
+
+use std::{collections::HashSet, path::Path, sync::Arc};
+
+use crate::{
+    parser::{
+        Comment, Comments, EnumDeclaration, Field, FunctionDeclaration, Identifier,
+        InterfaceDeclaration, Parameter, Program, Statement, StructDeclaration, TypeExpression,
+    },
+    source::{Source, SourceString},
+};
+
+#[cfg(test)]
+mod test;
+
+/// What pages are written as
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Format {
+    #[default]
+    Markdown,
+    Html,
+}
+
+impl Format {
+    pub fn extension(self) -> &'static str {
+        match self {
+            Format::Markdown => "md",
+            Format::Html => "html",
+        }
+    }
+}
+
+/// The documentation of a file
+#[derive(Debug, Clone)]
+pub struct Module {
+    /// such as `lib::math` for `lib/math.drgns`, relative to the root of the
+    /// documentation
+    pub name: String,
+    pub doc: String,
+
+    /// the name each module imported is bound to, and its own name
+    pub imports: Vec<(String, String)>,
+    pub items: Vec<Item>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Kind {
+    Function,
+    Struct,
+    Enum,
+    Interface,
+    Field,
+    Variant,
+    Method,
+}
+
+/// Something a module exports, or a member of a struct, an enum or an
+/// interface
+#[derive(Debug, Clone)]
+pub struct Item {
+    pub kind: Kind,
+    pub name: String,
+
+    /// as it is declared, such as `function area(w: float, h: float)`
+    pub signature: String,
+    pub doc: String,
+
+    /// the fields and the methods of a struct, the variants and the methods
+    /// of an enum, the methods of an interface
+    pub members: Vec<Item>,
+}
+
+/// An example in a comment, it runs as the source of a file with the same
+/// lines as the one it is in, where all but its code are blank, so that its
+/// errors point into the comment
+#[derive(Debug, Clone)]
+pub struct Example {
+    /// what the comment documents, the module for its own comments
+    pub item: String,
+
+    /// of its first line of code
+    pub line: usize,
+    pub source: Arc<Source>,
+}
+
+/// a line of a comment, without the `///`, and where its text starts
+#[derive(Debug, Clone)]
+struct Line {
+    text: String,
+    line: usize,
+    column: usize,
+}
+
+/// The module name for a file relative to the root of the documentation,
+/// `lib::math` for `lib/math.drgns`
+pub fn module_name(relative: &Path) -> String {
+    let path = relative.with_extension("");
+    let parts: Vec<String> = path
+        .components()
+        .map(|c| c.as_os_str().to_string_lossy().into_owned())
+        .collect();
+    parts.join("::")
+}
+
+/// The documentation of the program of a module
+pub fn module(program: &Program, name: &str) -> Module {
+    let mut parent: Vec<&str> = name.split("::").collect();
+    parent.pop();
+    let imports = program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Import(i) => {
+                let path = parent
+                    .iter()
+                    .copied()
+                    .chain(i.path.iter().map(|p| p.name.as_str()));
+                Some((i.name().name.clone(), path.collect::<Vec<_>>().join("::")))
+            }
+            _ => None,
+        })
+        .collect();
+    let items = program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Function(f) if !f.name.name.starts_with('_') => {
+                Some(function(f, Kind::Function))
+            }
+            Statement::Struct(s) if !s.name.name.starts_with('_') => Some(structure(program, s)),
+            Statement::Enum(e) if !e.name.name.starts_with('_') => Some(enumeration(program, e)),
+            Statement::Interface(i) if !i.name.name.starts_with('_') => Some(interface(program, i)),
+            _ => None,
+        })
+        .collect();
+    Module {
+        name: name.to_owned(),
+        doc: text(&module_lines(program)),
+        imports,
+        items,
+    }
+}
+
+/// The examples of the comments of a program, in the order of the source
+pub fn examples(program: &Program) -> Vec<Example> {
+    let mut blocks = vec![("module".to_owned(), module_lines(program))];
+    for s in &program.statements {
+        match s {
+            Statement::Function(f) => {
+                blocks.push((f.name.name.clone(), doc_lines(&program.comments, &f.span)))
+            }
+            Statement::Struct(s) => {
+                blocks.push((s.name.name.clone(), doc_lines(&program.comments, &s.span)));
+                for field in &s.fields {
+                    let name = format!("{}.{}", s.name.name, field.name.name);
+                    blocks.push((name, doc_lines(&program.comments, &field.span)));
+                }
+                for m in &s.methods {
+                    let name = format!("{}.{}", s.name.name, m.name.name);
+                    blocks.push((name, doc_lines(&program.comments, &m.span)));
+                }
+            }
+            Statement::Enum(e) => {
+                blocks.push((e.name.name.clone(), doc_lines(&program.comments, &e.span)));
+                for v in &e.variants {
+                    let name = format!("{}::{}", e.name.name, v.name.name);
+                    blocks.push((name, doc_lines(&program.comments, &v.span)));
+                }
+                for m in &e.methods {
+                    let name = format!("{}.{}", e.name.name, m.name.name);
+                    blocks.push((name, doc_lines(&program.comments, &m.span)));
+                }
+            }
+            Statement::Interface(i) => {
+                blocks.push((i.name.name.clone(), doc_lines(&program.comments, &i.span)));
+                for m in &i.methods {
+                    let name = format!("{}.{}", i.name.name, m.name.name);
+                    blocks.push((name, doc_lines(&program.comments, &m.span)));
+                }
+            }
+            _ => {}
+        }
+    }
+    let path = program.source.path().map(str::to_owned);
+    let mut examples = vec![];
+    for (item, lines) in blocks {
+        for code in code_blocks(&lines) {
+            let Some(first) = code.first() else {
+                continue;
+            };
+            let mut text = String::new();
+            let mut line = 1;
+            for l in &code {
+                text.push_str(&"\n".repeat(l.line - line));
+                text.push_str(&" ".repeat(l.column - 1));
+                text.push_str(&l.text);
+                line = l.line;
+            }
+            examples.push(Example {
+                item: item.clone(),
+                line: first.line,
+                source: Arc::new(Source::new(path.clone(), text)),
+            });
+        }
+    }
+    examples
+}
+
+fn function(f: &FunctionDeclaration, kind: Kind) -> Item {
+    Item {
+        kind,
+        name: f.name.name.clone(),
+        signature: function_signature(f),
+        doc: f.doc.clone(),
+        members: vec![],
+    }
+}
+
+/// The signature of a function as it is documented, see `signature`
+pub fn function_signature(f: &FunctionDeclaration) -> String {
+    signature(&f.name, &f.parameters, &f.return_type)
+}
+
+/// `function name(parameters) -> type`, without the body
+fn signature(
+    name: &Identifier,
+    parameters: &[Parameter],
+    return_type: &Option<TypeExpression>,
+) -> String {
+    let parameters: Vec<String> = parameters.iter().map(|p| p.to_string()).collect();
+    let mut signature = format!("function {}({})", name.name, parameters.join(", "));
+    if let Some(t) = return_type {
+        signature.push_str(&format!(" -> {}", t));
+    }
+    signature
+}
+
+fn structure(program: &Program, s: &StructDeclaration) -> Item {
+    let fields = s.fields.iter().map(|field| Item {
+        kind: Kind::Field,
+        name: field.name.name.clone(),
+        signature: field.to_string(),
+        doc: text(&doc_lines(&program.comments, &field.span)),
+        members: vec![],
+    });
+    let methods = s
+        .methods
+        .iter()
+        .filter(|m| !m.name.name.starts_with('_'))
+        .map(|m| function(m, Kind::Method));
+    let members: Vec<Item> = fields.chain(methods).collect();
+    Item {
+        kind: Kind::Struct,
+        name: s.name.name.clone(),
+        signature: declaration("struct", &s.name.name, &members),
+        doc: text(&doc_lines(&program.comments, &s.span)),
+        members,
+    }
+}
+
+fn enumeration(program: &Program, e: &EnumDeclaration) -> Item {
+    let variants = e.variants.iter().map(|v| {
+        let mut signature = v.name.name.clone();
+        if let Some(fields) = &v.fields {
+            let fields: Vec<String> = fields.iter().map(Field::to_string).collect();
+            signature.push_str(&format!("({})", fields.join(", ")));
+        }
+        Item {
+            kind: Kind::Variant,
+            name: v.name.name.clone(),
+            signature,
+            doc: text(&doc_lines(&program.comments, &v.span)),
+            members: vec![],
+        }
+    });
+    let methods = e
+        .methods
+        .iter()
+        .filter(|m| !m.name.name.starts_with('_'))
+        .map(|m| function(m, Kind::Method));
+    let members: Vec<Item> = variants.chain(methods).collect();
+    Item {
+        kind: Kind::Enum,
+        name: e.name.name.clone(),
+        signature: declaration("enum", &e.name.name, &members),
+        doc: text(&doc_lines(&program.comments, &e.span)),
+        members,
+    }
+}
+
+fn interface(program: &Program, i: &InterfaceDeclaration) -> Item {
+    let methods = i.methods.iter().map(|m| Item {
+        kind: Kind::Method,
+        name: m.name.name.clone(),
+        signature: signature(&m.name, &m.parameters, &m.return_type),
+        doc: text(&doc_lines(&program.comments, &m.span)),
+        members: vec![],
+    });
+    let members: Vec<Item> = methods.collect();
+    Item {
+        kind: Kind::Interface,
+        name: i.name.name.clone(),
+        signature: declaration("interface", &i.name.name, &members),
+        doc: text(&doc_lines(&program.comments, &i.span)),
+        members,
+    }
+}
+
+/// the declaration of a struct, an enum or an interface, with the
+/// signatures of its members one per line
+fn declaration(keyword: &str, name: &str, members: &[Item]) -> String {
+    let body: Vec<String> = members
+        .iter()
+        .map(|m| format!("    {}", m.signature))
+        .collect();
+    match body.is_empty() {
+        true => format!("{} {} {{}}", keyword, name),
+        false => format!("{} {} {{\n{}\n}}", keyword, name, body.join("\n")),
+    }
+}
+
+/// the text of a comment of a block of comments, without its delimiter
+fn line(c: &Comment, prefix: &str) -> Option<Line> {
+    let text = c.span.to_string();
+    let rest = text.strip_prefix(prefix)?;
+    // `////` is a line of slashes, not documentation
+    if c.trailing || prefix == "///" && rest.starts_with('/') {
+        return None;
+    }
+    let start = c.span.position();
+    let (rest, skipped) = match rest.strip_prefix(' ') {
+        Some(rest) => (rest, 1),
+        None => (rest, 0),
+    };
+    Some(Line {
+        text: rest.trim_end().to_owned(),
+        line: start.line,
+        column: start.column + prefix.len() + skipped,
+    })
+}
+
+/// The text of the `///` comments on the lines right above a node, the
+/// parser attaches it to the functions it declares, so that it can be read
+/// from them when they run
+pub fn comment(comments: &Comments, node: &SourceString) -> String {
+    text(&doc_lines(comments, node))
+}
+
+/// the `///` comments on the lines right above the node
+fn doc_lines(comments: &Comments, node: &SourceString) -> Vec<Line> {
+    let mut lines = vec![];
+    let mut above = node.position().line;
+    for c in comments.leading(node).iter().rev() {
+        match line(c, "///") {
+            Some(l) if l.line + 1 == above => {
+                above = l.line;
+                lines.push(l);
+            }
+            _ => break,
+        }
+    }
+    lines.reverse();
+    lines
+}
+
+/// the comments documenting the module, the `//!` ones before the first
+/// statement and the `///` ones there documenting nothing else
+fn module_lines(program: &Program) -> Vec<Line> {
+    let offset = match program.statements.first() {
+        Some(s) => s.span().start(),
+        None => program.source.len(),
+    };
+    let attached: HashSet<usize> = match program.statements.first() {
+        Some(s) => doc_lines(&program.comments, &s.span())
+            .iter()
+            .map(|l| l.line)
+            .collect(),
+        None => HashSet::new(),
+    };
+    let comments = program.comments.before(offset);
+    let inner: Vec<Line> = comments.iter().filter_map(|c| line(c, "//!")).collect();
+    if !inner.is_empty() {
+        return inner;
+    }
+    comments
+        .iter()
+        .filter_map(|c| line(c, "///"))
+        .filter(|l| !attached.contains(&l.line))
+        .collect()
+}
+
+/// the text of the lines, the lines missing in between are blank
+fn text(lines: &[Line]) -> String {
+    let mut text = String::new();
+    let mut previous = None;
+    for l in lines {
+        if let Some(p) = previous {
+            text.push_str(&"\n".repeat(l.line - p));
+        }
+        text.push_str(&l.text);
+        previous = Some(l.line);
+    }
+    text
+}
+
+/// the lines of code of each code block left to run, in the order of the
+/// comments
+fn code_blocks(lines: &[Line]) -> Vec<Vec<Line>> {
+    let mut blocks = vec![];
+    let mut block: Option<(bool, Vec<Line>)> = None;
+    for l in lines {
+        let fence = l.text.trim_start().strip_prefix("```");
+        match (&mut block, fence) {
+            (None, Some(language)) => {
+                let language = language.trim();
+                block = Some((language.is_empty() || language == "drgns", vec![]));
+            }
+            (Some(_), Some(_)) => {
+                if let Some((true, code)) = block.take() {
+                    blocks.push(code);
+                }
+            }
+            (Some((_, code)), None) => code.push(l.clone()),
+            (None, None) => {}
+        }
+    }
+    blocks
+}
+
+/// The page of a module, in the format, `modules` are all those documented,
+/// for the links to them
+pub fn page(module: &Module, modules: &[Module], format: Format) -> String {
+    let markdown = markdown(module, modules, format.extension());
+    match format {
+        Format::Markdown => markdown,
+        Format::Html => html(&module.name, &markdown),
+    }
+}
+
+/// The page listing the modules documented
+pub fn index(modules: &[Module], format: Format) -> String {
+    let mut text = String::from("# Modules\n\n");
+    for m in modules {
+        let link = format!("{}.{}", m.name.replace("::", "/"), format.extension());
+        text.push_str(&format!("- [`{}`]({})", m.name, link));
+        if let Some(summary) = m.doc.split("\n\n").next().filter(|s| !s.is_empty()) {
+            text.push_str(&format!(": {}", summary.replace('\n', " ")));
+        }
+        text.push('\n');
+    }
+    match format {
+        Format::Markdown => text,
+        Format::Html => html("Modules", &text),
+    }
+}
+
+fn markdown(module: &Module, modules: &[Module], extension: &str) -> String {
+    let links = Links {
+        module,
+        modules,
+        extension,
+    };
+    let mut page = format!("# `{}`\n", module.name);
+    if !module.doc.is_empty() {
+        page.push_str(&format!("\n{}\n", links.resolve(&module.doc)));
+    }
+    if !module.imports.is_empty() {
+        page.push_str("\n## Imports\n\n");
+        for (_, name) in &module.imports {
+            match links.page(name) {
+                Some(link) => page.push_str(&format!("- [`{}`]({})\n", name, link)),
+                None => page.push_str(&format!("- `{}`\n", name)),
+            }
+        }
+    }
+    for (kind, title) in [
+        (Kind::Struct, "Structs"),
+        (Kind::Enum, "Enums"),
+        (Kind::Interface, "Interfaces"),
+        (Kind::Function, "Functions"),
+    ] {
+        let items: Vec<&Item> = module.items.iter().filter(|i| i.kind == kind).collect();
+        if items.is_empty() {
+            continue;
+        }
+        page.push_str(&format!("\n## {}\n", title));
+        for item in items {
+            page.push_str(&format!("\n### `{}`\n\n", item.name));
+            page.push_str(&format!("```drgns\n{}\n```\n", item.signature));
+            if !item.doc.is_empty() {
+                page.push_str(&format!("\n{}\n", links.resolve(&item.doc)));
+            }
+            for member in item.members.iter().filter(|m| !m.doc.is_empty()) {
+                let name = match member.kind {
+                    Kind::Variant => format!("{}::{}", item.name, member.name),
+                    _ => format!("{}.{}", item.name, member.name),
+                };
+                page.push_str(&format!("\n#### `{}`\n\n", name));
+                if member.kind == Kind::Method {
+                    page.push_str(&format!("```drgns\n{}\n```\n\n", member.signature));
+                }
+                page.push_str(&format!("{}\n", links.resolve(&member.doc)));
+            }
+        }
+    }
+    page
+}
+
+/// Links from the page of a module to the others
+struct Links<'a> {
+    module: &'a Module,
+    modules: &'a [Module],
+    extension: &'a str,
+}
+
+impl Links<'_> {
+    /// the link to the page of a module, relative to this one
+    fn page(&self, name: &str) -> Option<String> {
+        self.modules.iter().find(|m| m.name == name)?;
+        let from: Vec<&str> = self.module.name.split("::").collect();
+        let to: Vec<&str> = name.split("::").collect();
+        let (from_dirs, to_dirs) = (&from[..from.len() - 1], &to[..to.len() - 1]);
+        let common = from_dirs
+            .iter()
+            .zip(to_dirs)
+            .take_while(|(a, b)| a == b)
+            .count();
+        let mut parts = vec![".."; from_dirs.len() - common];
+        parts.extend(&to[common..]);
+        Some(format!("{}.{}", parts.join("/"), self.extension))
+    }
+
+    /// the link to an item, `name`, `Struct.member` or `module::name`
+    fn item(&self, reference: &str) -> Option<String> {
+        let (page, module, name) = match reference.rsplit_once("::") {
+            Some((alias, name)) => {
+                let (_, imported) = self.module.imports.iter().find(|(a, _)| a == alias)?;
+                let module = self.modules.iter().find(|m| m.name == *imported)?;
+                (self.page(imported)?, module, name)
+            }
+            None => (String::new(), self.module, reference),
+        };
+        let (first, member) = match name.split_once('.') {
+            Some((first, member)) => (first, Some(member)),
+            None => (name, None),
+        };
+        let item = module.items.iter().find(|i| i.name == first)?;
+        if let Some(member) = member {
+            item.members
+                .iter()
+                .find(|m| m.name == member && !m.doc.is_empty())?;
+        }
+        Some(format!("{}#{}", page, anchor(name)))
+    }
+
+    /// the text with the references in its inline code linked, the code
+    /// blocks are left as they are
+    fn resolve(&self, text: &str) -> String {
+        let mut fenced = false;
+        let lines: Vec<String> = text
+            .lines()
+            .map(|l| {
+                if l.trim_start().starts_with("```") {
+                    fenced = !fenced;
+                    return l.to_owned();
+                }
+                match fenced {
+                    true => l.to_owned(),
+                    false => self.link_code(l),
+                }
+            })
+            .collect();
+        lines.join("\n")
+    }
+
+    fn link_code(&self, line: &str) -> String {
+        let parts: Vec<&str> = line.split('`').collect();
+        // closed only if there is an even number of backticks
+        if parts.len().is_multiple_of(2) {
+            return line.to_owned();
+        }
+        let mut linked = String::new();
+        for (i, part) in parts.iter().enumerate() {
+            match (i % 2, self.item(part)) {
+                (0, _) => linked.push_str(part),
+                (_, Some(link)) => linked.push_str(&format!("[`{}`]({})", part, link)),
+                (_, None) => linked.push_str(&format!("`{}`", part)),
+            }
+        }
+        linked
+    }
+}
+
+/// the anchor of a heading, as GitHub makes them, `pointnorm` for
+/// `Point.norm`
+fn anchor(heading: &str) -> String {
+    heading
+        .chars()
+        .filter_map(|c| match c {
+            ' ' => Some('-'),
+            c if c.is_alphanumeric() || c == '-' || c == '_' => Some(c.to_ascii_lowercase()),
+            _ => None,
+        })
+        .collect()
+}
+
+/// A page of HTML with the Markdown the pages are written in, headings,
+/// lists, code blocks, inline code and links
+fn html(title: &str, markdown: &str) -> String {
+    let mut body = String::new();
+    let mut paragraph: Vec<String> = vec![];
+    let mut list = false;
+    let mut code: Option<String> = None;
+    let flush = |body: &mut String, paragraph: &mut Vec<String>| {
+        if !paragraph.is_empty() {
+            body.push_str(&format!("<p>{}</p>\n", paragraph.join(" ")));
+            paragraph.clear();
+        }
+    };
+    for line in markdown.lines() {
+        if let Some(c) = &mut code {
+            if line.trim_start().starts_with("```") {
+                body.push_str(&format!("<pre><code>{}</code></pre>\n", c));
+                code = None;
+            } else {
+                c.push_str(&escape(line));
+                c.push('\n');
+            }
+            continue;
+        }
+        let item = line.strip_prefix("- ");
+        if list && item.is_none() {
+            body.push_str("</ul>\n");
+            list = false;
+        }
+        if line.trim_start().starts_with("```") {
+            flush(&mut body, &mut paragraph);
+            code = Some(String::new());
+        } else if let Some(item) = item {
+            flush(&mut body, &mut paragraph);
+            if !list {
+                body.push_str("<ul>\n");
+                list = true;
+            }
+            body.push_str(&format!("<li>{}</li>\n", inline(item)));
+        } else if line.starts_with('#') {
+            flush(&mut body, &mut paragraph);
+            let level = line.chars().take_while(|c| *c == '#').count();
+            let heading = line[level..].trim();
+            let id = anchor(&heading.replace('`', ""));
+            body.push_str(&format!(
+                "<h{0} id=\"{1}\">{2}</h{0}>\n",
+                level,
+                id,
+                inline(heading)
+            ));
+        } else if line.trim().is_empty() {
+            flush(&mut body, &mut paragraph);
+        } else {
+            paragraph.push(inline(line));
+        }
+    }
+    flush(&mut body, &mut paragraph);
+    if list {
+        body.push_str("</ul>\n");
+    }
+    if let Some(c) = code {
+        body.push_str(&format!("<pre><code>{}</code></pre>\n", c));
+    }
+    format!(
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>{}</title>\n</head>\n<body>\n{}</body>\n</html>\n",
+        escape(title),
+        body
+    )
+}
+
+/// inline code and links, the rest escaped
+fn inline(text: &str) -> String {
+    let mut html = String::new();
+    let mut rest = text;
+    while !rest.is_empty() {
+        if let Some(after) = rest.strip_prefix('`') {
+            if let Some(end) = after.find('`') {
+                html.push_str(&format!("<code>{}</code>", escape(&after[..end])));
+                rest = &after[end + 1..];
+                continue;
+            }
+        }
+        if let Some(after) = rest.strip_prefix('[') {
+            let link = after.find("](").and_then(|i| {
+                let end = after[i..].find(')')? + i;
+                Some((&after[..i], &after[i + 2..end], &after[end + 1..]))
+            });
+            if let Some((label, url, after)) = link {
+                html.push_str(&format!(
+                    "<a href=\"{}\">{}</a>",
+                    escape(url),
+                    inline(label)
+                ));
+                rest = after;
+                continue;
+            }
+        }
+        let c = rest.chars().next().expect("the text isn't empty");
+        html.push_str(&escape(&c.to_string()));
+        rest = &rest[c.len_utf8()..];
+    }
+    html
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
@@ -0,0 +1,135 @@
+use std::sync::Arc;
+
+use crate::{
+    parser::{parse, Program},
+    source::Source,
+};
+
+use super::*;
+
+fn program(path: &str, s: &str) -> Program {
+    let source = Arc::new(Source::new(Some(path.to_owned()), s.to_owned()));
+    let (program, errors) = parse(&source);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    program
+}
+
+const GEOMETRY: &str = "\
+//! Shapes and their areas.
+//!
+//! See `area` and `Point.norm`.
+
+import lib::units
+
+/// The area of a rectangle, in `units::meters`
+///
+/// ```
+/// assert(area(2, 3) == 6)
+/// ```
+function area(w: float, h: float) -> float {
+    w * h
+}
+
+//// not documentation
+function _helper() -> { none }
+
+/// A point
+struct Point {
+    /// from the left
+    x: float,
+    y
+
+    /// The distance from the origin
+    function norm(self) -> float { (self.x ** 2 + self.y ** 2) ** 0.5 }
+}
+";
+
+const UNITS: &str = "\
+/// Units of measure.
+
+/// Meters, in meters
+function meters(x) -> { x }
+
+/// ```python
+/// print('not drgns')
+/// ```
+function feet(x) -> { x * 0.3048 }
+";
+
+fn modules() -> Vec<Module> {
+    vec![
+        module(&program("geometry.drgns", GEOMETRY), "geometry"),
+        module(&program("lib/units.drgns", UNITS), "lib::units"),
+    ]
+}
+
+#[test]
+fn comments_document_the_items_below_them() {
+    let modules = modules();
+    let geometry = &modules[0];
+    assert_eq!(
+        geometry.doc,
+        "Shapes and their areas.\n\nSee `area` and `Point.norm`."
+    );
+    assert_eq!(
+        geometry.imports,
+        [("units".to_owned(), "lib::units".to_owned())]
+    );
+    let names: Vec<&str> = geometry.items.iter().map(|i| i.name.as_str()).collect();
+    assert_eq!(names, ["area", "Point"]);
+    let area = &geometry.items[0];
+    assert_eq!(area.signature, "function area(w: float, h: float) -> float");
+    assert!(area
+        .doc
+        .starts_with("The area of a rectangle, in `units::meters`\n\n```\n"));
+    let point = &geometry.items[1];
+    assert_eq!(
+        point.signature,
+        "struct Point {\n    x: float\n    y\n    function norm(self) -> float\n}"
+    );
+    let docs: Vec<&str> = point.members.iter().map(|m| m.doc.as_str()).collect();
+    assert_eq!(docs, ["from the left", "", "The distance from the origin"]);
+
+    // a block of comments kept apart from the first item documents the
+    // module
+    let units = &modules[1];
+    assert_eq!(units.doc, "Units of measure.");
+    assert_eq!(units.items[0].doc, "Meters, in meters");
+}
+
+#[test]
+fn pages_link_to_the_items_they_mention() {
+    let modules = modules();
+    let page = page(&modules[0], &modules, Format::Markdown);
+    assert!(page.starts_with("# `geometry`\n\nShapes and their areas."));
+    assert!(page.contains("See [`area`](#area) and [`Point.norm`](#pointnorm)."));
+    assert!(page.contains("- [`lib::units`](lib/units.md)\n"));
+    assert!(page.contains("in [`units::meters`](lib/units.md#meters)"));
+    assert!(page.contains("#### `Point.norm`\n\n```drgns\nfunction norm(self) -> float\n```"));
+
+    let units = super::page(&modules[1], &modules, Format::Html);
+    assert!(units.contains("<h3 id=\"meters\"><code>meters</code></h3>"));
+    assert!(units.contains("<pre><code>print('not drgns')\n</code></pre>"));
+    let index = index(&modules, Format::Markdown);
+    assert_eq!(
+        index,
+        "# Modules\n\n- [`geometry`](geometry.md): Shapes and their areas.\n\
+         - [`lib::units`](lib/units.md): Units of measure.\n"
+    );
+}
+
+#[test]
+fn examples_keep_the_lines_of_their_comments() {
+    let examples = examples(&program("geometry.drgns", GEOMETRY));
+    assert_eq!(examples.len(), 1);
+    let example = &examples[0];
+    assert_eq!((example.item.as_str(), example.line), ("area", 10));
+    assert_eq!(example.source.path(), Some("geometry.drgns"));
+    assert_eq!(
+        example.source.line(10).as_deref(),
+        Some("    assert(area(2, 3) == 6)")
+    );
+    assert_eq!(example.source.line_count(), 10);
+    assert!(super::examples(&program("lib/units.drgns", UNITS)).is_empty());
+    assert_eq!(module_name(Path::new("lib/units.drgns")), "lib::units");
+}
@@ -0,0 +1,318 @@
+//! The embedding API, a single entry point to either engine.
+
+use std::{fmt::Display, sync::Arc};
+
+use crate::{
+    compiler,
+    eh::{DragonError, ErrorCode},
+    interpreter::{
+        self, deterministic,
+        io::{self, Io},
+        limits::{self, Limits},
+        sandbox::{self, Sandbox},
+        Env, Halt,
+    },
+    modules::{Bundle, Module},
+    parser::{self, Program},
+    source::Source,
+    values::{Native, Value},
+    vm::Vm,
+};
+
+mod bind;
+pub use bind::*;
+#[cfg(test)]
+mod test;
+
+/// Which engine runs the scripts, both behave the same
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Engine {
+    /// compile to bytecode and run it on the virtual machine
+    #[default]
+    Vm,
+    /// evaluate the syntax tree directly
+    Walk,
+}
+
+/// Why `Interpreter::eval_string` failed
+#[derive(Debug)]
+pub enum EvalError {
+    /// the source doesn't parse, all errors found are reported
+    Syntax(Vec<DragonError>),
+    Runtime(DragonError),
+
+    /// the script ran `exit` with the code
+    Exit(i32),
+}
+
+impl Display for EvalError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Syntax(errors) => {
+                let messages: Vec<&str> = errors.iter().map(|e| e.message()).collect();
+                write!(f, "{}", messages.join("\n"))
+            }
+            Self::Runtime(e) => write!(f, "{}", e),
+            Self::Exit(code) => write!(f, "the script exited with code {}", code),
+        }
+    }
+}
+
+impl std::error::Error for EvalError {}
+
+impl From<Halt> for EvalError {
+    fn from(h: Halt) -> Self {
+        match h {
+            Halt::Exit(code) => Self::Exit(code),
+            Halt::Error(e) => Self::Runtime(e),
+        }
+    }
+}
+
+/// Runs scripts on the chosen engine, the globals persist across
+/// evaluations, so that each script can build on the previous ones.
+pub struct Interpreter {
+    backend: Backend,
+    limits: Option<Limits>,
+    sandbox: Option<Sandbox>,
+    io: Option<Arc<dyn Io>>,
+    deterministic: bool,
+}
+
+enum Backend {
+    Vm(Vm),
+    Walk(interpreter::Interpreter),
+}
+
+impl Default for Interpreter {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Interpreter {
+    pub fn new() -> Self {
+        Self::with_engine(Engine::default())
+    }
+
+    pub fn with_engine(engine: Engine) -> Self {
+        let backend = match engine {
+            Engine::Vm => Backend::Vm(Vm::new()),
+            Engine::Walk => Backend::Walk(interpreter::Interpreter::new()),
+        };
+        Self {
+            backend,
+            limits: None,
+            sandbox: None,
+            io: None,
+            deterministic: false,
+        }
+    }
+
+    pub fn engine(&self) -> Engine {
+        match self.backend {
+            Backend::Vm(_) => Engine::Vm,
+            Backend::Walk(_) => Engine::Walk,
+        }
+    }
+
+    /// Hold each evaluation to limits on its steps, the values it creates,
+    /// how deep its calls nest and how long it runs, see `Limits`. Scripts run on the thread
+    /// calling `eval`, which needs `Limits::stack_size` of stack for calls to
+    /// nest as deep as the limits allow.
+    pub fn set_limits(&mut self, limits: Limits) {
+        self.limits = Some(limits);
+    }
+
+    pub fn limits(&self) -> Limits {
+        self.limits.unwrap_or_default()
+    }
+
+    /// Run each evaluation in a sandbox, where the functions of the
+    /// standard library that reach outside of the interpreter fail unless
+    /// the sandbox allows their capability. The functions the host
+    /// registers are not held to it.
+    pub fn set_sandbox(&mut self, sandbox: Sandbox) {
+        self.sandbox = Some(sandbox);
+    }
+
+    /// the sandbox evaluations run in, `None` if they aren't sandboxed
+    pub fn sandbox(&self) -> Option<Sandbox> {
+        self.sandbox
+    }
+
+    /// Send what each evaluation prints and logs to the `Io` rather than to
+    /// the standard output and error, such as a `io::Captured` to show it
+    /// once it is done
+    pub fn set_io(&mut self, io: Arc<dyn Io>) {
+        self.io = Some(io);
+    }
+
+    /// Make each evaluation the same as the first run of a script would be,
+    /// see `builtins::set_deterministic`, without making the evaluations of
+    /// the other interpreters deterministic
+    pub fn set_deterministic(&mut self) {
+        self.deterministic = true;
+    }
+
+    /// a deterministic run from the start for an evaluation, if they are
+    fn deterministic_run(&self) -> Option<deterministic::Installed> {
+        self.deterministic
+            .then(|| deterministic::install(Some(deterministic::start())))
+    }
+
+    /// Evaluate a parsed program, the value is the one of the last statement
+    pub fn eval(&mut self, program: &Program) -> Result<Value, Halt> {
+        let _limits = self.limits.map(limits::enforce);
+        let _sandbox = sandbox::enforce(self.sandbox);
+        let _io = io::install(self.io.clone());
+        let _run = self.deterministic_run();
+        let value = match &mut self.backend {
+            Backend::Vm(vm) => vm.run(compiler::compile(program)),
+            Backend::Walk(interpreter) => interpreter.eval(program),
+        }?;
+        // the value of the last step may be over the limit too
+        limits::check()
+            .map_err(|msg| Halt::Error(DragonError::new(ErrorCode::LimitExceeded, msg, None)))?;
+        Ok(value)
+    }
+
+    /// Run the program of a bundle, see `modules::bundle`, which only the
+    /// VM can do as the bundle holds no source
+    pub fn eval_bundle(&mut self, bundle: &Arc<Bundle>) -> Result<Value, Halt> {
+        let _limits = self.limits.map(limits::enforce);
+        let _sandbox = sandbox::enforce(self.sandbox);
+        let _io = io::install(self.io.clone());
+        let _run = self.deterministic_run();
+        let value = match &mut self.backend {
+            Backend::Vm(vm) => vm.run_bundle(bundle.clone()),
+            Backend::Walk(_) => Err(Halt::Error(DragonError::new(
+                ErrorCode::Generic,
+                "bundles run on the VM, not with `--engine walk`".to_owned(),
+                None,
+            ))),
+        }?;
+        limits::check()
+            .map_err(|msg| Halt::Error(DragonError::new(ErrorCode::LimitExceeded, msg, None)))?;
+        Ok(value)
+    }
+
+    /// Call a function the scripts declared, such as one `get_global`
+    /// returns, held to the limits and the sandbox as evaluations are
+    pub fn call(&mut self, function: &Value, arguments: Vec<Value>) -> Result<Value, Halt> {
+        let _limits = self.limits.map(limits::enforce);
+        let _sandbox = sandbox::enforce(self.sandbox);
+        let _io = io::install(self.io.clone());
+        let _run = self.deterministic_run();
+        match (&mut self.backend, function) {
+            (Backend::Vm(vm), Value::Closure(c)) => vm.call_function(c.clone(), arguments),
+            (Backend::Walk(interpreter), Value::Function(f)) => {
+                interpreter.call_function(f.clone(), arguments)
+            }
+            (_, v) => Err(Halt::Error(DragonError::runtime(
+                format!("{} is not a function of the scripts", v.type_name()),
+                None,
+            ))),
+        }
+    }
+
+    /// Parse and evaluate the source, imports are resolved relative to the
+    /// working directory
+    pub fn eval_string(&mut self, src: &str) -> Result<Value, EvalError> {
+        let src = Arc::new(Source::from_string(src.to_owned()));
+        let (program, errors) = parser::parse(&src);
+        if !errors.is_empty() {
+            return Err(EvalError::Syntax(errors));
+        }
+        Ok(self.eval(&program)?)
+    }
+
+    /// Make a Rust function callable by scripts, the arguments are converted
+    /// to the types of its parameters and the result back to a value, see
+    /// `FromValue` and `IntoValue`
+    pub fn register_func<Args, F: NativeFn<Args>>(&mut self, name: &str, function: F) {
+        let owned = name.to_owned();
+        self.register_raw(name, Some(F::ARITY), move |args| {
+            function.call(&owned, args)
+        });
+    }
+
+    /// Make a function working on values callable by scripts, with `None`
+    /// as arity it takes any number of arguments. An `Err` is raised as a
+    /// run-time error with the message, which scripts can catch.
+    pub fn register_raw(
+        &mut self,
+        name: &str,
+        arity: Option<usize>,
+        function: impl Fn(&[Value]) -> Result<Value, String> + Send + Sync + 'static,
+    ) {
+        let native = Native {
+            name: name.to_owned(),
+            arity,
+            function: Box::new(function),
+        };
+        self.set_global(name, Value::Native(Arc::new(native)));
+    }
+
+    /// the value of a global, builtins included
+    pub fn get_global(&self, name: &str) -> Option<Value> {
+        self.globals().get(name)
+    }
+
+    /// Declare a global, replacing any previous one with the same name.
+    /// Like a declaration without `mut`, scripts cannot assign to it.
+    pub fn set_global(&mut self, name: &str, value: Value) {
+        self.globals().define(name, value, false);
+    }
+
+    /// the names of the globals declared by scripts or the host, sorted,
+    /// builtins are not included
+    pub fn global_names(&self) -> Vec<String> {
+        self.globals().names()
+    }
+
+    /// Evaluate a module the scripts imported again, from its file now, and
+    /// bind the globals holding it to the new one. Imports of it evaluated
+    /// next get the new one too, but the modules importing it before and the
+    /// values taken from it, such as its functions, keep the old one. The
+    /// modules it imports are not evaluated again.
+    pub fn reload(&mut self, module: &Arc<Module>) -> Result<Arc<Module>, Halt> {
+        let _limits = self.limits.map(limits::enforce);
+        let _sandbox = sandbox::enforce(self.sandbox);
+        let _io = io::install(self.io.clone());
+        let _run = self.deterministic_run();
+        let loader = match &self.backend {
+            Backend::Vm(vm) => vm.loader(),
+            Backend::Walk(interpreter) => interpreter.loader(),
+        };
+        let reloaded = loader.reload(module)?;
+        for name in self.global_names() {
+            let Some(binding) = self.globals().binding(&name) else {
+                continue;
+            };
+            if matches!(binding.get(), Value::Module(m) if Arc::ptr_eq(&m, module)) {
+                let value = Value::Module(reloaded.clone());
+                self.globals().define(&name, value, binding.is_mutable());
+            }
+        }
+        Ok(reloaded)
+    }
+
+    /// Forget all globals, including the registered functions, as if the
+    /// interpreter was just created, the limits, the sandbox and the `Io`
+    /// stay
+    pub fn reset(&mut self) {
+        let (limits, sandbox, io) = (self.limits, self.sandbox, self.io.take());
+        *self = Self::with_engine(self.engine());
+        self.limits = limits;
+        self.sandbox = sandbox;
+        self.io = io;
+    }
+
+    fn globals(&self) -> &Env {
+        match &self.backend {
+            Backend::Vm(vm) => vm.globals(),
+            Backend::Walk(interpreter) => interpreter.globals(),
+        }
+    }
+}
@@ -0,0 +1,312 @@
+//! Conversions between values and Rust types, so that plain Rust functions
+//! can be registered with `Interpreter::register_func`.
+//!
+//! Host types, such as structs, can be passed to and from scripts by
+//! implementing `FromValue` and `IntoValue` for them.
+
+use std::{
+    collections::{BTreeMap, HashMap},
+    sync::Arc,
+};
+
+use crate::values::{BigInt, Key, Value};
+
+/// A Rust type that arguments can be converted to
+pub trait FromValue: Sized {
+    /// what the value must be, as shown in errors, such as `"an int"`
+    fn expected() -> String;
+
+    /// `None` if the value cannot be converted
+    fn from_value(value: &Value) -> Option<Self>;
+}
+
+/// A Rust type that can be returned to scripts, an `Err` is raised as a
+/// run-time error
+pub trait IntoValue {
+    fn into_value(self) -> Result<Value, String>;
+}
+
+impl FromValue for Value {
+    fn expected() -> String {
+        "any value".to_string()
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        Some(value.clone())
+    }
+}
+
+impl FromValue for bool {
+    fn expected() -> String {
+        "a bool".to_string()
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        match value {
+            Value::Bool(b) => Some(*b),
+            _ => None,
+        }
+    }
+}
+
+impl FromValue for i64 {
+    fn expected() -> String {
+        "an int".to_string()
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        match value {
+            Value::Int(i) => Some(*i),
+            _ => None,
+        }
+    }
+}
+
+macro_rules! from_int {
+    ($($t:ty),*) => {$(
+        impl FromValue for $t {
+            fn expected() -> String {
+                format!("an int that fits in {}", stringify!($t))
+            }
+
+            fn from_value(value: &Value) -> Option<Self> {
+                match value {
+                    Value::Int(i) => <$t>::try_from(*i).ok(),
+                    Value::BigInt(i) => i.to_i128().and_then(|i| <$t>::try_from(i).ok()),
+                    _ => None,
+                }
+            }
+        }
+    )*};
+}
+
+from_int!(i8, i16, i32, u8, u16, u32, u64, usize);
+
+/// ints are accepted too, as in arithmetic
+impl FromValue for f64 {
+    fn expected() -> String {
+        "a float".to_string()
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        match value {
+            Value::Float(x) => Some(*x),
+            Value::Int(i) => Some(*i as f64),
+            Value::BigInt(i) => Some(i.to_f64()),
+            _ => None,
+        }
+    }
+}
+
+impl FromValue for String {
+    fn expected() -> String {
+        "a string".to_string()
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        match value {
+            Value::String(s) => Some(s.to_string()),
+            _ => None,
+        }
+    }
+}
+
+/// the list is copied, changes made by the host are not seen by the script
+impl<T: FromValue> FromValue for Vec<T> {
+    fn expected() -> String {
+        format!("a list where each item is {}", T::expected())
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        let Value::List(items) = value else {
+            return None;
+        };
+        let items = items.read().unwrap_or_else(|e| e.into_inner());
+        items.iter().map(T::from_value).collect()
+    }
+}
+
+/// the map is copied like lists are, all its keys must be strings
+impl<T: FromValue> FromValue for HashMap<String, T> {
+    fn expected() -> String {
+        format!("a map from strings to {}", T::expected())
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        let Value::Map(entries) = value else {
+            return None;
+        };
+        let entries = entries.read().unwrap_or_else(|e| e.into_inner());
+        entries
+            .iter()
+            .map(|(k, v)| match k {
+                Key::String(k) => Some((k.to_string(), T::from_value(v)?)),
+                _ => None,
+            })
+            .collect()
+    }
+}
+
+/// `none` becomes `None`
+impl<T: FromValue> FromValue for Option<T> {
+    fn expected() -> String {
+        format!("{} or none", T::expected())
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        match value {
+            Value::None => Some(None),
+            v => T::from_value(v).map(Some),
+        }
+    }
+}
+
+impl IntoValue for Value {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(self)
+    }
+}
+
+impl IntoValue for () {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::None)
+    }
+}
+
+impl IntoValue for bool {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::Bool(self))
+    }
+}
+
+/// the ones past the largest `i64` are big ints
+macro_rules! into_int {
+    ($($t:ty),*) => {$(
+        impl IntoValue for $t {
+            fn into_value(self) -> Result<Value, String> {
+                Ok(match i64::try_from(self) {
+                    Ok(i) => Value::Int(i),
+                    Err(_) => Value::from(BigInt::from(self as i128)),
+                })
+            }
+        }
+    )*};
+}
+
+into_int!(i8, i16, i32, i64, u8, u16, u32, u64, usize);
+
+impl IntoValue for f64 {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::Float(self))
+    }
+}
+
+impl IntoValue for f32 {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::Float(self.into()))
+    }
+}
+
+impl IntoValue for String {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::String(self.into()))
+    }
+}
+
+impl IntoValue for &str {
+    fn into_value(self) -> Result<Value, String> {
+        Ok(Value::String(Arc::from(self)))
+    }
+}
+
+/// the entries are sorted by key, so that scripts see them in a stable order
+impl<T: IntoValue> IntoValue for HashMap<String, T> {
+    fn into_value(self) -> Result<Value, String> {
+        self.into_iter().collect::<BTreeMap<_, _>>().into_value()
+    }
+}
+
+impl<T: IntoValue> IntoValue for BTreeMap<String, T> {
+    fn into_value(self) -> Result<Value, String> {
+        let entries = self
+            .into_iter()
+            .map(|(k, v)| Ok((Key::String(k.into()), v.into_value()?)))
+            .collect::<Result<_, String>>()?;
+        Ok(Value::map(entries))
+    }
+}
+
+impl<T: IntoValue> IntoValue for Vec<T> {
+    fn into_value(self) -> Result<Value, String> {
+        let items = self
+            .into_iter()
+            .map(T::into_value)
+            .collect::<Result<_, _>>()?;
+        Ok(Value::list(items))
+    }
+}
+
+impl<T: IntoValue> IntoValue for Option<T> {
+    fn into_value(self) -> Result<Value, String> {
+        match self {
+            Some(v) => v.into_value(),
+            None => Ok(Value::None),
+        }
+    }
+}
+
+/// the error becomes the message of the run-time error
+impl<T: IntoValue, E: std::fmt::Display> IntoValue for Result<T, E> {
+    fn into_value(self) -> Result<Value, String> {
+        self.map_err(|e| e.to_string())?.into_value()
+    }
+}
+
+/// A Rust function whose parameters implement `FromValue` and whose result
+/// implements `IntoValue`, `Args` is the tuple of its parameter types
+pub trait NativeFn<Args>: Send + Sync + 'static {
+    const ARITY: usize;
+
+    /// convert the arguments and call the function, the name is used in
+    /// conversion errors
+    fn call(&self, name: &str, args: &[Value]) -> Result<Value, String>;
+}
+
+/// the argument at the given index, converted
+fn argument<T: FromValue>(name: &str, args: &[Value], i: usize) -> Result<T, String> {
+    T::from_value(&args[i]).ok_or_else(|| {
+        format!(
+            "{} expects {} as argument {}, found {}",
+            name,
+            T::expected(),
+            i + 1,
+            args[i].type_name()
+        )
+    })
+}
+
+macro_rules! native_fn {
+    ($arity:literal $(, $t:ident $i:literal)*) => {
+        impl<Func, R, $($t),*> NativeFn<($($t,)*)> for Func
+        where
+            Func: Fn($($t),*) -> R + Send + Sync + 'static,
+            R: IntoValue,
+            $($t: FromValue,)*
+        {
+            const ARITY: usize = $arity;
+
+            #[allow(unused_variables)]
+            fn call(&self, name: &str, args: &[Value]) -> Result<Value, String> {
+                self($(argument::<$t>(name, args, $i)?),*).into_value()
+            }
+        }
+    };
+}
+
+native_fn!(0);
+native_fn!(1, A 0);
+native_fn!(2, A 0, B 1);
+native_fn!(3, A 0, B 1, C 2);
+native_fn!(4, A 0, B 1, C 2, D 3);
+native_fn!(5, A 0, B 1, C 2, D 3, E 4);
+native_fn!(6, A 0, B 1, C 2, D 3, E 4, F 5);
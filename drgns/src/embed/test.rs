@@ -0,0 +1,340 @@
+use std::{
+    collections::HashMap,
+    sync::{
+        atomic::{AtomicI64, Ordering},
+        Arc,
+    },
+};
+
+use crate::{
+    eh::ErrorCode,
+    interpreter::{io::Captured, Halt},
+    parser::parse,
+    source::Source,
+    test_utils,
+    values::Value,
+    Capability, Limits, Sandbox,
+};
+
+use super::{Engine, EvalError, Interpreter};
+
+/// every test runs on both engines
+fn interpreters() -> [Interpreter; 2] {
+    [
+        Interpreter::with_engine(Engine::Vm),
+        Interpreter::with_engine(Engine::Walk),
+    ]
+}
+
+#[test]
+fn embed_eval_string() {
+    for mut i in interpreters() {
+        assert_eq!(i.eval_string("1 + 2").ok(), Some(Value::Int(3)));
+        // globals persist across evaluations
+        i.eval_string("x := 20").expect("the declaration is valid");
+        assert_eq!(i.eval_string("x + 1").ok(), Some(Value::Int(21)));
+        assert_eq!(i.get_global("x"), Some(Value::Int(20)));
+        assert_eq!(i.get_global("y"), None);
+    }
+}
+
+#[test]
+fn embed_call() {
+    for mut i in interpreters() {
+        i.eval_string("function add(a, b) -> { a + b }\nfunction half(n) -> { 10 / n }")
+            .expect("the declarations are valid");
+        let add = i.get_global("add").expect("add is declared");
+        let sum = i.call(&add, vec![Value::Int(1), Value::Int(2)]);
+        assert_eq!(sum.ok(), Some(Value::Int(3)));
+
+        // nothing called the function but the host
+        let half = i.get_global("half").expect("half is declared");
+        match i.call(&half, vec![Value::Int(0)]) {
+            Err(Halt::Error(e)) => {
+                assert_eq!(e.message(), "division by zero");
+                let trace: Vec<_> = e.trace().iter().map(|f| f.call.is_some()).collect();
+                assert_eq!(trace, [false]);
+            }
+            r => panic!("expected a run-time error, found {:?}", r),
+        }
+        assert!(i.call(&half, vec![]).is_err());
+        assert!(i.call(&Value::Int(1), vec![]).is_err());
+    }
+}
+
+#[test]
+fn embed_errors() {
+    for mut i in interpreters() {
+        match i.eval_string("1 +\n)") {
+            Err(EvalError::Syntax(errors)) => assert!(!errors.is_empty()),
+            r => panic!("expected a syntax error, found {:?}", r),
+        }
+        match i.eval_string("1 / 0") {
+            Err(EvalError::Runtime(e)) => assert_eq!(e.message(), "division by zero"),
+            r => panic!("expected a run-time error, found {:?}", r),
+        }
+        assert!(matches!(i.eval_string("exit 4"), Err(EvalError::Exit(4))));
+    }
+}
+
+#[test]
+fn embed_host_values() {
+    for mut i in interpreters() {
+        i.set_global("name", Value::from("dragon"));
+        assert_eq!(
+            i.eval_string("name ++ \"!\"").ok(),
+            Some(Value::from("dragon!"))
+        );
+        assert!(i.eval_string("name = \"x\"").is_err());
+    }
+}
+
+#[test]
+fn embed_register_func() {
+    for mut i in interpreters() {
+        let calls = Arc::new(AtomicI64::new(0));
+        let counter = calls.clone();
+        i.register_raw("count", Some(0), move |_| {
+            Ok(Value::Int(counter.fetch_add(1, Ordering::Relaxed) + 1))
+        });
+        i.register_raw("fail", None, |args| {
+            Err(format!("failed with {}", args.len()))
+        });
+        assert_eq!(i.eval_string("count()\ncount()").ok(), Some(Value::Int(2)));
+        assert_eq!(calls.load(Ordering::Relaxed), 2);
+        assert_eq!(
+            i.eval_string("try { fail(1, 2) } catch e { errors::message(e) }")
+                .ok(),
+            Some(Value::from("failed with 2"))
+        );
+        match i.eval_string("count(1)") {
+            Err(EvalError::Runtime(e)) => {
+                assert_eq!(e.message(), "function 'count' expects 0 arguments, found 1")
+            }
+            r => panic!("expected an arity error, found {:?}", r),
+        }
+    }
+}
+
+#[test]
+fn embed_bind() {
+    for mut i in interpreters() {
+        i.register_func("double", |x: i64| x * 2);
+        i.register_func("mean", |xs: Vec<f64>| {
+            xs.iter().sum::<f64>() / xs.len() as f64
+        });
+        i.register_func("greet", |name: String, times: Option<usize>| {
+            format!("hi {}", name).repeat(times.unwrap_or(1))
+        });
+        i.register_func("split", |s: String| {
+            s.split(',').map(str::to_owned).collect::<Vec<_>>()
+        });
+        i.register_func("parse", |s: String| s.parse::<i64>());
+        i.register_func("nothing", || ());
+        assert_eq!(i.eval_string("double(21)").ok(), Some(Value::Int(42)));
+        i.register_func("ints", || vec![1, 2, 6]);
+        // ints are accepted where floats are expected
+        assert_eq!(i.eval_string("mean(ints())").ok(), Some(Value::Float(3.0)));
+        assert_eq!(i.eval_string("nothing()").ok(), Some(Value::None));
+        assert_eq!(
+            i.eval_string("greet(\"a\", none) ++ greet(\"b\", 2)").ok(),
+            Some(Value::from("hi ahi bhi b"))
+        );
+        assert_eq!(
+            i.eval_string("split(\"x,y\")").ok(),
+            Some(Value::list(vec![Value::from("x"), Value::from("y")]))
+        );
+        i.register_func("total", |m: HashMap<String, i64>| m.values().sum::<i64>());
+        i.register_func("counts", || {
+            HashMap::from([("b".to_string(), 2), ("a".to_string(), 1)])
+        });
+        assert_eq!(
+            i.eval_string("total(counts()) == 3 and keys(counts()) == [\"a\", \"b\"]")
+                .ok(),
+            Some(Value::Bool(true))
+        );
+        let mut message = |s: &str| match i.eval_string(s) {
+            Err(EvalError::Runtime(e)) => e.message().to_string(),
+            r => panic!("expected {:?} to fail, found {:?}", s, r),
+        };
+        assert_eq!(
+            message("double(\"x\")"),
+            "double expects an int as argument 1, found string"
+        );
+        assert_eq!(
+            message("greet(\"a\", -1)"),
+            "greet expects an int that fits in usize or none as argument 2, found int"
+        );
+        assert_eq!(
+            message("mean(split(\"x\"))"),
+            "mean expects a list where each item is a float as argument 1, found list"
+        );
+        assert_eq!(message("parse(\"x\")"), "invalid digit found in string");
+        assert_eq!(
+            message("double(1, 2)"),
+            "function 'double' expects 1 argument, found 2"
+        );
+    }
+}
+
+#[test]
+fn embed_limits() {
+    for mut i in interpreters() {
+        i.set_limits(Limits {
+            steps: Some(10_000),
+            values: Some(1_000),
+            depth: 20,
+            time: None,
+        });
+        let mut fails = |s: &str| match i.eval_string(s) {
+            Err(EvalError::Runtime(e)) => {
+                assert_eq!(e.code(), ErrorCode::LimitExceeded);
+                e.message().to_string()
+            }
+            r => panic!("expected {:?} to fail, found {:?}", s, r),
+        };
+        assert_eq!(
+            fails("mut n := 0\nfor { n += 1 }"),
+            "the script took more than 10000 steps"
+        );
+        assert_eq!(
+            fails("mut xs := []\nfor _ in range(2000) { xs.push(1) }"),
+            "the script created more than 1000 values"
+        );
+        assert_eq!(
+            fails("strings::pad_end(\"x\", 100000)"),
+            "the script created more than 1000 values"
+        );
+        assert_eq!(
+            fails("function f(n) -> { 1 + f(n + 1) }\nf(0)"),
+            "calls are nested more than 20 deep"
+        );
+
+        // tasks count against the limits of the evaluation spawning them
+        assert_eq!(
+            fails("(spawn (() -> { for {} })()).await()"),
+            "the script took more than 10000 steps"
+        );
+
+        // the counts start over with each evaluation, and going too deep can
+        // be recovered from
+        let deep = "function f(n) -> { if n == 0 { 0 } else { 1 + f(n - 1) } }
+try { f(100) } catch e { f(10) }";
+        assert_eq!(i.eval_string(deep).ok(), Some(Value::Int(10)));
+        i.reset();
+        assert_eq!(i.limits().depth, 20);
+    }
+}
+
+#[test]
+fn embed_sandbox() {
+    for mut i in interpreters() {
+        i.set_sandbox(Sandbox::new().allow(Capability::Env));
+        let mut fails = |s: &str| match i.eval_string(s) {
+            Err(EvalError::Runtime(e)) => e.message().to_string(),
+            r => panic!("expected {:?} to fail, found {:?}", s, r),
+        };
+        assert_eq!(
+            fails("fs::read(\"Cargo.toml\")"),
+            "fs::read is not allowed in the sandbox, it needs the fs capability"
+        );
+        assert_eq!(
+            fails("os::run(\"true\")"),
+            "os::run is not allowed in the sandbox, it needs the process capability"
+        );
+        assert_eq!(
+            fails("http::get(\"http://localhost\")"),
+            "http::get is not allowed in the sandbox, it needs the net capability"
+        );
+        assert_eq!(
+            fails("(spawn (() -> os::chdir(\"..\"))()).await()"),
+            "os::chdir is not allowed in the sandbox, it needs the fs capability"
+        );
+
+        // what the sandbox allows, and what touches nothing outside, works
+        let allowed =
+            "try { fs::exists(\".\") } catch e { len(env()) > 0 and fs::join(\"a\") == \"a\" }";
+        assert_eq!(i.eval_string(allowed).ok(), Some(Value::Bool(true)));
+        i.reset();
+        assert_eq!(i.sandbox(), Some(Sandbox::new().allow(Capability::Env)));
+    }
+    // the sandbox only holds while its interpreter runs
+    let mut i = Interpreter::new();
+    assert_eq!(
+        i.eval_string("fs::exists(\".\")").ok(),
+        Some(Value::Bool(true))
+    );
+}
+
+#[test]
+fn embed_io() {
+    for mut i in interpreters() {
+        let captured = Arc::new(Captured::new());
+        i.set_io(captured.clone());
+        let src = "print(1, \"a\"); log::warn(\"careful\"); (spawn (() -> print(2))()).await()";
+        i.eval_string(src).expect("the script is valid");
+        assert_eq!(captured.stdout(), "1 a\n2\n");
+        assert!(captured.stderr().trim_end().ends_with("careful"));
+
+        // the `Io` stays across resets, and the lines add up
+        i.reset();
+        i.eval_string("print(3)").expect("the script is valid");
+        assert_eq!(captured.stdout(), "1 a\n2\n3\n");
+    }
+}
+
+#[test]
+fn embed_reload() {
+    let dir = test_utils::directory("embed", "reload");
+    for (n, mut i) in interpreters().into_iter().enumerate() {
+        let lib = dir.join(format!("lib{}.drgns", n));
+        std::fs::write(&lib, "n := 1\nfunction f() -> { n }").expect("the module is written");
+        let main = format!(
+            "import lib{}\nmut m := lib{}\nfunction g() -> {{ m::n }}",
+            n, n
+        );
+        let src = Arc::new(Source::new(
+            Some(dir.join("main.drgns").display().to_string()),
+            main,
+        ));
+        let (program, errors) = parse(&src);
+        assert!(errors.is_empty(), "unexpected parse errors");
+        i.eval(&program).expect("the module is imported");
+        i.eval_string("old := m::n").expect("the module exports n");
+
+        std::fs::write(&lib, "n := 2\nfunction f() -> { n }").expect("the module is written");
+        let Some(Value::Module(module)) = i.get_global("m") else {
+            panic!("m holds the module");
+        };
+        let reloaded = i.reload(&module).expect("the module is reloaded");
+        assert_eq!(reloaded.get("n"), Some(Value::Int(2)));
+        // both globals holding it, and the functions using them, see it
+        let name = format!("lib{}::n + m::n + g()", n);
+        assert_eq!(i.eval_string(&name).ok(), Some(Value::Int(6)));
+        // the values taken before keep the old one
+        assert_eq!(i.get_global("old"), Some(Value::Int(1)));
+        i.eval_string("m = 1").expect("m stays mutable");
+
+        std::fs::write(&lib, "n :=").expect("the module is written");
+        assert!(i.reload(&reloaded).is_err());
+        assert_eq!(
+            i.eval_string(&format!("lib{}::n", n)).ok(),
+            Some(Value::Int(2))
+        );
+    }
+    let Some(Value::Module(math)) = Interpreter::new().get_global("math") else {
+        panic!("math is a native module");
+    };
+    let e = Interpreter::new()
+        .reload(&math)
+        .map(|_| ())
+        .map_err(|h| match h {
+            Halt::Error(e) => e.message().to_string(),
+            Halt::Exit(_) => panic!("reloading doesn't exit"),
+        });
+    assert_eq!(
+        e,
+        Err("'math' is a native module, it has no file".to_owned())
+    );
+    let _ = std::fs::remove_dir_all(dir);
+}
@@ -1,8 +1,7 @@
 //! Error reporting module, keeps track of all errors during compilation.
 //!
-//! Note that lints as not supported yet, these are all hard-coded errors,
-//! whereas lints can be disabled or enabled by the user. Perhaps in the
-//! future we will have lint reporting.
+//! Lints are reported with the same errors, but unlike the others they can
+//! be disabled or made errors by the user, see `lint`.
 //!
 //! ## Code Ranges
 //! Each error has a code, but equivalent errors of different severities,
@@ -13,6 +12,14 @@
 //!     - `00001`: generic error
 //! - range `01xxx`: I/O errors
 //! - range `02xxx`: syntax errors
+//! - range `03xxx`: semantic errors, found by the checker. The interpreter
+//!   reports the same codes when it finds them at run-time
+//! - range `04xxx`: other run-time errors
+//! - range `05xxx`: errors loading modules
+//! - range `06xxx`: errors managing packages, in their manifests, lockfiles
+//!   or repositories
+//! - range `07xxx`: lints, one code per rule
+//!     - `07000`: the configuration of the linter is invalid
 //!
 //! ## Error Severities
 //! - warn:  the program will compile, but will likey fail at run-time or if
@@ -33,66 +40,260 @@ use std::{
     },
 };
 
-use ariadne::{Label, Report, Source};
-
 use thiserror::Error;
 
-use crate::{
-    lexer::TokenType,
-    source::{SourceArena, SourceView},
-};
+use crate::{lexer::TokenType, source::SourceString};
+
+/// The code of each kind of error, see the module documentation for ranges
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+#[repr(u32)]
+pub enum ErrorCode {
+    Generic = 00001,
+
+    Io = 01000,
+    IoNotFound = 01001,
+
+    UnexpectedChar = 02001,
+    UnclosedDelimiter = 02002,
+    UnmatchedDelimiter = 02003,
+    InvalidEscape = 02004,
+    IntTooLarge = 02005,
+    Syntax = 02006,
+    UnexpectedToken = 02007,
+    UnexpectedEndOfInput = 02008,
+    UnterminatedString = 02009,
+    UnterminatedComment = 02010,
+    ExpectedExpression = 02011,
+    InvalidAssignment = 02012,
+
+    UndefinedVariable = 03001,
+    ArityMismatch = 03002,
+    DuplicateDeclaration = 03003,
+    ImmutableAssignment = 03004,
+    UnreachableCode = 03005,
+    NonExhaustiveMatch = 03006,
+    TypeMismatch = 03007,
+    UnknownType = 03008,
+    UnknownField = 03009,
+
+    Runtime = 04001,
+    Interrupted = 04002,
+    LimitExceeded = 04003,
+
+    ModuleNotFound = 05001,
+    ImportCycle = 05002,
+    MissingExport = 05003,
+
+    Package = 06001,
+
+    Lint = 07000,
+    UnusedVariable = 07001,
+    Shadowing = 07002,
+    FloatEquality = 07003,
+    LongFunction = 07004,
+    Naming = 07005,
+    NilComparison = 07006,
+    TrailingComma = 07007,
+}
 
-#[derive(Debug, Clone)]
-#[repr(u16)]
-enum ErrorType {
-    SyntaxError = 0x1,
-    SemanticError = 0x2,
+impl ErrorCode {
+    /// the code with the number shown after the `E`, such as `ErrorCode::Io`
+    /// for 1000
+    pub fn from_number(number: u32) -> Option<Self> {
+        [
+            Self::Generic,
+            Self::Io,
+            Self::IoNotFound,
+            Self::UnexpectedChar,
+            Self::UnclosedDelimiter,
+            Self::UnmatchedDelimiter,
+            Self::InvalidEscape,
+            Self::IntTooLarge,
+            Self::Syntax,
+            Self::UnexpectedToken,
+            Self::UnexpectedEndOfInput,
+            Self::UnterminatedString,
+            Self::UnterminatedComment,
+            Self::ExpectedExpression,
+            Self::InvalidAssignment,
+            Self::UndefinedVariable,
+            Self::ArityMismatch,
+            Self::DuplicateDeclaration,
+            Self::ImmutableAssignment,
+            Self::UnreachableCode,
+            Self::NonExhaustiveMatch,
+            Self::TypeMismatch,
+            Self::UnknownType,
+            Self::UnknownField,
+            Self::Runtime,
+            Self::Interrupted,
+            Self::LimitExceeded,
+            Self::ModuleNotFound,
+            Self::ImportCycle,
+            Self::MissingExport,
+            Self::Package,
+            Self::Lint,
+            Self::UnusedVariable,
+            Self::Shadowing,
+            Self::FloatEquality,
+            Self::LongFunction,
+            Self::Naming,
+            Self::NilComparison,
+            Self::TrailingComma,
+        ]
+        .into_iter()
+        .find(|code| *code as u32 == number)
+    }
 }
 
-#[derive(Error, Debug)]
+impl std::fmt::Display for ErrorCode {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "E{:05}", *self as u32)
+    }
+}
+
+#[derive(Error, Debug, Clone)]
 #[error("{msg}")]
 pub struct DragonError {
     msg: String,
-    ty: ErrorType,
-    span: Option<SourceView>,
+    code: ErrorCode,
+    span: Option<SourceString>,
+
+    /// a suggestion on how to fix the error
+    hint: Option<String>,
+
+    /// warnings are reported, but don't stop compilation
+    warning: bool,
+
+    /// the calls a run-time error propagated out of, innermost first
+    trace: Vec<TraceFrame>,
+}
+
+/// A call that a run-time error propagated out of
+#[derive(Debug, Clone)]
+pub struct TraceFrame {
+    /// the name of the function that was called
+    pub function: String,
+
+    /// where it was called from
+    pub call: Option<SourceString>,
 }
 
 impl DragonError {
-    fn report(&self, src: String) -> Result<(), std::io::Error> {
-        let mut rep = Report::build(ariadne::ReportKind::Error, (), 12)
-            .with_code(self.ty.clone() as u16)
-            .with_message(self.msg.clone());
-        if let Some(span) = self.span.clone() {
-            rep = rep.with_label(Label::new(span.span.clone()).with_message("here"));
-        } else {
-            rep = rep.with_label(Label::new(src.len()..src.len()).with_message("here"));
+    pub fn new(code: ErrorCode, msg: String, span: Option<SourceString>) -> Self {
+        Self {
+            msg,
+            code,
+            span,
+            hint: None,
+            warning: false,
+            trace: vec![],
         }
-        rep.finish().eprint(Source::from(src))
+    }
+
+    pub fn runtime(msg: String, span: Option<SourceString>) -> Self {
+        Self::new(ErrorCode::Runtime, msg, span)
+    }
+
+    pub fn with_hint(self, hint: impl Into<String>) -> Self {
+        Self {
+            hint: Some(hint.into()),
+            ..self
+        }
+    }
+
+    pub fn into_warning(self) -> Self {
+        Self {
+            warning: true,
+            ..self
+        }
+    }
+
+    /// record that the error propagated out of a call to the function
+    pub fn with_frame(mut self, function: &str, call: Option<SourceString>) -> Self {
+        self.trace.push(TraceFrame {
+            function: function.to_owned(),
+            call,
+        });
+        self
+    }
+
+    pub fn is_warning(&self) -> bool {
+        self.warning
+    }
+
+    pub fn code(&self) -> ErrorCode {
+        self.code
+    }
+
+    pub fn message(&self) -> &str {
+        &self.msg
+    }
+
+    pub fn span(&self) -> Option<&SourceString> {
+        self.span.as_ref()
+    }
+
+    pub fn hint(&self) -> Option<&str> {
+        self.hint.as_deref()
+    }
+
+    pub fn trace(&self) -> &[TraceFrame] {
+        &self.trace
+    }
+
+    pub fn report(&self) -> Result<(), std::io::Error> {
+        crate::diagnostics::report(self, &[])
     }
 }
 
 pub struct ErrorHandler {
     had_error: AtomicBool,
-    src: Rc<SourceArena>,
     errors: Cell<Vec<DragonError>>,
     warnings: Cell<Vec<DragonError>>,
 }
 
+impl Default for ErrorHandler {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
 impl ErrorHandler {
-    pub fn new(src: &Rc<SourceArena>) -> Self {
+    pub fn new() -> Self {
         Self {
             had_error: AtomicBool::new(false),
-            src: src.clone(),
             errors: Cell::new(vec![]),
             warnings: Cell::new(vec![]),
         }
     }
 
+    pub fn had_error(&self) -> bool {
+        self.had_error.load(Ordering::Relaxed)
+    }
+
     pub fn report_all(self: &Rc<Self>) {
         let inner = self.errors.take();
         for e in inner.iter() {
-            e.report(self.src.to_string()).unwrap();
+            e.report().unwrap_or_else(|_| {
+                crate::internal_error!("stderr cannot be written to");
+            });
         }
+        self.had_error.store(false, Ordering::Relaxed);
+    }
+
+    /// how many errors were collected and not taken yet
+    pub fn error_count(&self) -> usize {
+        let errors = self.errors.take();
+        let count = errors.len();
+        self.errors.set(errors);
+        count
+    }
+
+    /// Take all collected errors without reporting them.
+    pub fn take_errors(&self) -> Vec<DragonError> {
+        self.had_error.store(false, Ordering::Relaxed);
+        self.errors.take()
     }
 
     fn push_error(self: Rc<Self>, err: DragonError) {
@@ -102,58 +303,129 @@ impl ErrorHandler {
         self.errors.set(errors);
     }
 
-    pub fn syntax_error(self: Rc<Self>, span: SourceView, msg: String) {
-        self.push_error(DragonError {
-            msg,
-            ty: ErrorType::SyntaxError,
-            span: Some(span),
-        });
+    pub fn syntax_error(self: Rc<Self>, span: SourceString, msg: String) {
+        self.push_error(DragonError::new(ErrorCode::Syntax, msg, Some(span)));
     }
 
-    pub fn unexpected_char(self: Rc<Self>, span: SourceView, c: char) {
+    pub fn unexpected_char(self: Rc<Self>, span: SourceString, c: char) {
         log::trace!("unexpected_char");
-        self.push_error(DragonError {
-            msg: format!("unexpected character: '{}'", c),
-            ty: ErrorType::SyntaxError,
-            span: Some(span),
-        });
+        self.push_error(DragonError::new(
+            ErrorCode::UnexpectedChar,
+            format!("unexpected character: '{}'", c),
+            Some(span),
+        ));
     }
 
     pub fn unexpected_token(
         self: Rc<Self>,
-        span: SourceView,
+        span: SourceString,
         expected: &[TokenType],
         got: TokenType,
     ) {
-        self.push_error(DragonError {
-            msg: format!("unexpected token: {}, expected one of {:?}", got, expected),
-            ty: ErrorType::SyntaxError,
-            span: Some(span),
-        });
+        let expected: Vec<String> = expected.iter().map(|t| t.describe()).collect();
+        let expected = match expected.split_last() {
+            Some((last, [])) => last.clone(),
+            Some((last, rest)) => format!("{} or {}", rest.join(", "), last),
+            None => "nothing".to_string(),
+        };
+        self.push_error(DragonError::new(
+            ErrorCode::UnexpectedToken,
+            format!("expected {}, found {}", expected, got.describe()),
+            Some(span),
+        ));
     }
 
-    pub fn unexpected_end_of_input(self: Rc<Self>) {
-        self.push_error(DragonError {
-            msg: "unexpected end of input".to_string(),
-            ty: ErrorType::SyntaxError,
-            span: None,
-        });
+    pub fn unexpected_end_of_input(self: Rc<Self>, span: Option<SourceString>) {
+        self.push_error(DragonError::new(
+            ErrorCode::UnexpectedEndOfInput,
+            "unexpected end of input".to_string(),
+            span,
+        ));
     }
 
-    pub fn expect_expression(self: Rc<Self>, span: Option<SourceView>) {
-        self.push_error(DragonError {
-            msg: "expected expression".to_string(),
-            ty: ErrorType::SyntaxError,
-            span,
-        });
+    pub fn unterminated_string(self: Rc<Self>, span: SourceString) {
+        self.push_error(
+            DragonError::new(
+                ErrorCode::UnterminatedString,
+                "unterminated string literal".to_string(),
+                Some(span),
+            )
+            .with_hint("add a closing quote at the end of the string"),
+        );
+    }
+
+    pub fn unterminated_comment(self: Rc<Self>, span: SourceString) {
+        self.push_error(
+            DragonError::new(
+                ErrorCode::UnterminatedComment,
+                "unterminated block comment".to_string(),
+                Some(span),
+            )
+            .with_hint("block comments nest, each `/*` needs its own `*/`"),
+        );
+    }
+
+    pub fn unclosed_delimiter(self: Rc<Self>, span: SourceString, c: char) {
+        self.push_error(DragonError::new(
+            ErrorCode::UnclosedDelimiter,
+            format!("missing closing delimiter for '{}'", c),
+            Some(span),
+        ));
+    }
+
+    pub fn unmatched_delimiter(self: Rc<Self>, span: SourceString, c: char) {
+        self.push_error(DragonError::new(
+            ErrorCode::UnmatchedDelimiter,
+            format!(
+                "unexpected closing delimiter '{}' with no matching opening",
+                c
+            ),
+            Some(span),
+        ));
+    }
+
+    pub fn invalid_escape(self: Rc<Self>, span: SourceString, msg: String) {
+        self.push_error(
+            DragonError::new(ErrorCode::InvalidEscape, msg, Some(span))
+                .with_hint("use a raw string such as 'C:\\dir' to avoid escaping"),
+        );
+    }
+
+    pub fn invalid_bytes_escape(self: Rc<Self>, span: SourceString, msg: String) {
+        self.push_error(
+            DragonError::new(ErrorCode::InvalidEscape, msg, Some(span))
+                .with_hint("bytes literals hold ASCII characters and escapes such as '\\xff'"),
+        );
     }
 
-    pub fn int_parse_error(self: Rc<Self>, span: Option<SourceView>) {
-        self.push_error(DragonError {
-            msg: "integer literal is too large".to_string(),
-            ty: ErrorType::SemanticError,
+    pub fn invalid_assignment(self: Rc<Self>, span: SourceString) {
+        self.push_error(
+            DragonError::new(
+                ErrorCode::InvalidAssignment,
+                "cannot assign to this expression".to_string(),
+                Some(span),
+            )
+            .with_hint("only variables can be assigned to, use `==` for comparisons"),
+        );
+    }
+
+    pub fn expect_expression(self: Rc<Self>, span: Option<SourceString>) {
+        self.push_error(DragonError::new(
+            ErrorCode::ExpectedExpression,
+            "expected expression".to_string(),
             span,
-        })
+        ));
+    }
+
+    pub fn int_parse_error(self: Rc<Self>, span: Option<SourceString>) {
+        self.push_error(
+            DragonError::new(
+                ErrorCode::IntTooLarge,
+                "integer literal is too large".to_string(),
+                span,
+            )
+            .with_hint(format!("the largest int is {}", i64::MAX)),
+        )
     }
 }
 
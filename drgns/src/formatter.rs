@@ -0,0 +1,754 @@
+//! Pretty printing of programs as canonical source, for `drgns fmt`.
+//!
+//! The printer works on the syntax tree, so most of the layout of the source
+//! is discarded: statements go on their own lines, indented by four spaces,
+//! with at most one blank line between them. Some choices of the author are
+//! kept, lists, maps and arguments starting on a new line stay one per line,
+//! blocks and matches written on one line stay on one line. Literals and
+//! interpolated strings are printed as they are written.
+//!
+//! Comments leading a statement, arm or item are printed on their own lines
+//! before it, trailing ones at the end of the line where the code they follow
+//! is printed.
+
+use std::{collections::VecDeque, ops::Range, rc::Rc, sync::Arc};
+
+use crate::{
+    eh::{DragonError, ErrorHandler},
+    lexer::{Lexer, TokenType as TT},
+    parser::{
+        self, BlockExpression, Comment, Expression, Field, FunctionDeclaration, Identifier, Index,
+        MatchArm, MatchExpression, MethodSignature, NamedArgument, Parameter, Statement,
+        UnOperator, Variant,
+    },
+    source::{Reader, Source, SourceString},
+};
+
+#[cfg(test)]
+mod test;
+
+const INDENT: &str = "    ";
+
+/// What the body of a struct, an enum or an interface declares
+enum Member<'a> {
+    Field(&'a Field),
+    Variant(&'a Variant),
+    Method(&'a FunctionDeclaration),
+    Signature(&'a MethodSignature),
+}
+
+impl Member<'_> {
+    fn span(&self) -> SourceString {
+        match self {
+            Member::Field(f) => f.span.clone(),
+            Member::Variant(v) => v.span.clone(),
+            Member::Method(m) => m.span.clone(),
+            Member::Signature(m) => m.span.clone(),
+        }
+    }
+}
+
+/// An argument of a call, those given by name come last
+enum Argument<'a> {
+    Positional(&'a Expression),
+    Named(&'a NamedArgument),
+}
+
+impl Argument<'_> {
+    fn span(&self) -> SourceString {
+        match self {
+            Argument::Positional(e) => e.span(),
+            Argument::Named(n) => n.span.clone(),
+        }
+    }
+}
+
+/// Format a whole source, fails with the syntax errors if it doesn't parse
+pub fn format(src: &Arc<Source>) -> Result<String, Vec<DragonError>> {
+    let (program, errors) = parser::parse(src);
+    if !errors.is_empty() {
+        return Err(errors);
+    }
+    let mut printer = Printer::new(src, program.comments.iter().cloned().collect());
+    printer.statements(&program.statements);
+    printer.comments_before(src.len());
+    if !printer.out.is_empty() {
+        printer.out.push('\n');
+    }
+    Ok(printer.out)
+}
+
+/// The changes from the old text to the new one, as a unified diff of their
+/// lines. Empty if they have the same lines.
+pub fn diff(path: &str, old: &str, new: &str) -> String {
+    const CONTEXT: usize = 3;
+    let (a, b): (Vec<&str>, Vec<&str>) = (old.lines().collect(), new.lines().collect());
+    // the length of the longest common subsequence of the lines from i and j
+    let mut common = vec![vec![0_usize; b.len() + 1]; a.len() + 1];
+    for i in (0..a.len()).rev() {
+        for j in (0..b.len()).rev() {
+            common[i][j] = match a[i] == b[j] {
+                true => common[i + 1][j + 1] + 1,
+                false => common[i + 1][j].max(common[i][j + 1]),
+            };
+        }
+    }
+    // each line with its prefix, and the number of old and new lines before
+    let mut edits = vec![];
+    let (mut i, mut j) = (0, 0);
+    while i < a.len() || j < b.len() {
+        let (prefix, line) = if i < a.len() && j < b.len() && a[i] == b[j] {
+            (' ', a[i])
+        } else if i < a.len() && (j == b.len() || common[i + 1][j] >= common[i][j + 1]) {
+            ('-', a[i])
+        } else {
+            ('+', b[j])
+        };
+        edits.push((prefix, line, i, j));
+        match prefix {
+            ' ' => (i, j) = (i + 1, j + 1),
+            '+' => j += 1,
+            _ => i += 1,
+        }
+    }
+    let changes: Vec<usize> = (0..edits.len()).filter(|&k| edits[k].0 != ' ').collect();
+    let Some(&first) = changes.first() else {
+        return String::new();
+    };
+    let mut out = format!("--- {}\n+++ {}\n", path, path);
+    let mut hunk = first.saturating_sub(CONTEXT)..first + 1;
+    for &k in &changes[1..] {
+        // changes close enough share their context
+        if k - hunk.end < 2 * CONTEXT {
+            hunk.end = k + 1;
+        } else {
+            write_hunk(&mut out, &edits, hunk);
+            hunk = k - CONTEXT..k + 1;
+        }
+    }
+    write_hunk(&mut out, &edits, hunk);
+    out
+}
+
+fn write_hunk(out: &mut String, edits: &[(char, &str, usize, usize)], hunk: Range<usize>) {
+    let hunk = hunk.start..(hunk.end + 3).min(edits.len());
+    let edits = &edits[hunk];
+    let old = edits.iter().filter(|e| e.0 != '+').count();
+    let new = edits.iter().filter(|e| e.0 != '-').count();
+    // an empty range starts at the line before it
+    let start = |before: usize, len: usize| if len == 0 { before } else { before + 1 };
+    out.push_str(&format!(
+        "@@ -{},{} +{},{} @@\n",
+        start(edits[0].2, old),
+        old,
+        start(edits[0].3, new),
+        new
+    ));
+    for (prefix, line, _, _) in edits {
+        out.push_str(&format!("{}{}\n", prefix, line));
+    }
+}
+
+struct Printer {
+    source: Arc<Source>,
+    out: String,
+    depth: usize,
+
+    /// the comments not printed yet, in order
+    comments: VecDeque<Comment>,
+
+    /// the ranges of the interpolated strings, which are printed as they are
+    /// written since the tree only has their desugared form
+    interpolations: Vec<Range<usize>>,
+
+    /// the line of the source where the last thing printed ends, `None` at
+    /// the start of a block
+    last_line: Option<usize>,
+}
+
+impl Printer {
+    fn new(src: &Arc<Source>, comments: VecDeque<Comment>) -> Self {
+        let eh = Rc::new(ErrorHandler::new());
+        let mut interpolations = vec![];
+        let mut open = vec![];
+        for t in Lexer::new(Reader::new(src), &eh) {
+            match t.token_type {
+                TT::InterpolationStart => open.push(t.lexeme.start()),
+                TT::InterpolationEnd => {
+                    // only the outermost string matters when they nest
+                    if let Some(start) = open.pop().filter(|_| open.is_empty()) {
+                        interpolations.push(start..t.lexeme.end());
+                    }
+                }
+                _ => {}
+            }
+        }
+        Self {
+            source: src.clone(),
+            out: String::new(),
+            depth: 0,
+            comments,
+            interpolations,
+            last_line: None,
+        }
+    }
+
+    fn write(&mut self, s: &str) {
+        self.out.push_str(s);
+    }
+
+    fn line(&self, i: usize) -> usize {
+        self.source.position(i).line
+    }
+
+    /// the line of the last character of the span
+    fn end_line(&self, span: &SourceString) -> usize {
+        self.line(span.end().saturating_sub(1))
+    }
+
+    fn one_line(&self, span: &SourceString) -> bool {
+        self.line(span.start()) == self.end_line(span)
+    }
+
+    /// whether a comment not printed yet starts before the position
+    fn has_comment_before(&self, i: usize) -> bool {
+        self.comments.front().is_some_and(|c| c.span.start() < i)
+    }
+
+    /// start a new line for something starting at the position of the
+    /// source, keeping a blank line before it if there is one in the source
+    fn begin_line(&mut self, start: usize) {
+        let line = self.line(start);
+        if !self.out.is_empty() {
+            self.out.push('\n');
+            if self.last_line.is_some_and(|l| line > l + 1) {
+                self.out.push('\n');
+            }
+        }
+        self.out.push_str(&INDENT.repeat(self.depth));
+    }
+
+    /// print the comments before the position, each on its own line
+    fn comments_before(&mut self, i: usize) {
+        while self.has_comment_before(i) {
+            let c = self.comments.pop_front().expect("checked above").span;
+            self.begin_line(c.start());
+            self.write(c.to_string().trim_end());
+            self.last_line = Some(self.end_line(&c));
+        }
+    }
+
+    /// print the trailing comments up to the line where the last thing
+    /// printed ends, the code they follow may have been joined with it
+    fn trailing_comments(&mut self) {
+        while let Some(Comment { span: c, .. }) = self
+            .comments
+            .front()
+            .filter(|c| {
+                c.trailing
+                    && self
+                        .last_line
+                        .is_some_and(|l| self.line(c.span.start()) <= l)
+            })
+            .cloned()
+        {
+            self.comments.pop_front();
+            self.write(" ");
+            self.write(c.to_string().trim_end());
+            self.last_line = Some(self.end_line(&c));
+        }
+    }
+
+    /// after an opening delimiter on the line of the position, print the
+    /// comments trailing it
+    fn opened(&mut self, open: usize) {
+        self.last_line = Some(self.line(open));
+        self.trailing_comments();
+        self.last_line = None;
+    }
+
+    /// print things on their own lines, with their comments, at one more
+    /// level of indentation, then the closing delimiter on its own line
+    fn lines<T>(
+        &mut self,
+        items: &[T],
+        span: impl Fn(&T) -> SourceString,
+        mut print: impl FnMut(&mut Self, &T),
+        separator: &str,
+        (open, close): (usize, (&str, usize)),
+    ) {
+        self.depth += 1;
+        self.opened(open);
+        for item in items {
+            let span = span(item);
+            self.comments_before(span.start());
+            self.begin_line(span.start());
+            print(self, item);
+            self.write(separator);
+            self.last_line = Some(self.end_line(&span));
+            self.trailing_comments();
+        }
+        self.comments_before(close.1);
+        self.depth -= 1;
+        self.out.push('\n');
+        self.out.push_str(&INDENT.repeat(self.depth));
+        self.write(close.0);
+    }
+
+    /// print things separated by commas, one per line if the first one is
+    /// on a line after the start of the source
+    fn items<T>(
+        &mut self,
+        (open, close): (&str, &str),
+        items: &[T],
+        span: impl Fn(&T) -> SourceString,
+        mut print: impl FnMut(&mut Self, &T),
+        start: usize,
+        end: usize,
+    ) {
+        self.write(open);
+        let multiline = items
+            .first()
+            .is_some_and(|i| self.line(span(i).start()) > self.line(start));
+        if multiline {
+            return self.lines(items, span, print, ",", (start, (close, end)));
+        }
+        for (i, item) in items.iter().enumerate() {
+            if i > 0 {
+                self.write(", ");
+            }
+            print(self, item);
+        }
+        self.write(close);
+    }
+
+    fn statements(&mut self, statements: &[Statement]) {
+        for s in statements {
+            let span = s.span();
+            self.comments_before(span.start());
+            self.begin_line(span.start());
+            self.statement(s);
+            self.last_line = Some(self.end_line(&span));
+            self.trailing_comments();
+        }
+    }
+
+    fn statement(&mut self, s: &Statement) {
+        match s {
+            Statement::Declaration(d) => {
+                if d.mutable {
+                    self.write("mut ");
+                }
+                self.write(&d.name.name);
+                match &d.type_annotation {
+                    Some(t) => self.write(&format!(": {} = ", t)),
+                    None => self.write(" := "),
+                }
+                self.expression(&d.value);
+            }
+            Statement::Destructuring(d) => {
+                if d.mutable {
+                    self.write("mut ");
+                }
+                self.write(&d.pattern.written());
+                match &d.type_annotation {
+                    Some(t) => self.write(&format!(": {} = ", t)),
+                    None => self.write(" := "),
+                }
+                self.expression(&d.value);
+            }
+            Statement::Function(f) => {
+                self.write("function ");
+                self.write(&f.name.name);
+                self.function(f);
+            }
+            Statement::Struct(s) => {
+                let mut members: Vec<Member> = s.fields.iter().map(Member::Field).collect();
+                members.extend(s.methods.iter().map(|m| Member::Method(m)));
+                self.declare("struct", &s.name, members, &s.span);
+            }
+            Statement::Enum(e) => {
+                let mut members: Vec<Member> = e.variants.iter().map(Member::Variant).collect();
+                members.extend(e.methods.iter().map(|m| Member::Method(m)));
+                self.declare("enum", &e.name, members, &e.span);
+            }
+            Statement::Interface(i) => {
+                let members = i.methods.iter().map(Member::Signature).collect();
+                self.declare("interface", &i.name, members, &i.span);
+            }
+            Statement::Assignment(a) => {
+                self.expression(&a.target);
+                self.write(&format!(" {} ", a.op));
+                self.expression(&a.value);
+            }
+            Statement::Expression(e) => self.expression(e),
+            Statement::Exit(e) => {
+                self.write("exit ");
+                self.expression(&e.code);
+            }
+            Statement::Throw(t) => {
+                self.write("throw ");
+                self.expression(&t.value);
+            }
+            Statement::Defer(d) => {
+                self.write("defer ");
+                self.statement(d.value());
+            }
+            Statement::Import(i) => {
+                let path: Vec<&str> = i.path.iter().map(|p| p.name.as_str()).collect();
+                self.write(&format!("import {}", path.join("::")));
+            }
+            Statement::Return(r) => self.keyword("return", &r.value),
+            Statement::Yield(y) => self.keyword("yield", &y.value),
+            Statement::Break(b) => self.keyword("break", &b.value),
+            Statement::Continue(c) => self.keyword("continue", &c.value),
+        }
+    }
+
+    fn keyword(&mut self, keyword: &str, value: &Option<Expression>) {
+        self.write(keyword);
+        if let Some(v) = value {
+            self.write(" ");
+            self.expression(v);
+        }
+    }
+
+    /// the parameters, return type and body, after the name if any
+    fn function(&mut self, f: &FunctionDeclaration) {
+        self.parameters(&f.parameters);
+        self.write(" -> ");
+        if let Some(t) = &f.return_type {
+            self.write(&format!("{} ", t));
+        }
+        // the body of a lambda can be a single statement without braces
+        match self.source.get(f.body.span.start()) {
+            Some('{') => self.block(&f.body),
+            _ => f.body.statements.iter().for_each(|s| self.statement(s)),
+        }
+    }
+
+    fn parameters(&mut self, parameters: &[Parameter]) {
+        self.write("(");
+        for (i, p) in parameters.iter().enumerate() {
+            if i > 0 {
+                self.write(", ");
+            }
+            self.parameter(p);
+        }
+        self.write(")");
+    }
+
+    fn parameter(&mut self, p: &Parameter) {
+        if p.mutable {
+            self.write("mut ");
+        }
+        if p.variadic {
+            self.write("..");
+        }
+        self.write(&p.pattern.written());
+        if let Some(t) = &p.type_annotation {
+            self.write(&format!(": {}", t));
+        }
+        if let Some(d) = &p.default {
+            self.write(" = ");
+            self.expression(d);
+        }
+    }
+
+    /// a struct, an enum or an interface, its members one per line, in the
+    /// order they are written
+    fn declare(
+        &mut self,
+        keyword: &str,
+        name: &Identifier,
+        mut members: Vec<Member>,
+        span: &SourceString,
+    ) {
+        self.write(&format!("{} {} {{", keyword, name.name));
+        members.sort_by_key(|m| m.span().start());
+        if members.is_empty() && !self.has_comment_before(span.end()) {
+            return self.write("}");
+        }
+        let print = |p: &mut Self, m: &Member| match m {
+            Member::Field(f) => p.write(&f.to_string()),
+            Member::Variant(v) => {
+                p.write(&v.name.name);
+                if let Some(fields) = &v.fields {
+                    let fields: Vec<String> = fields.iter().map(Field::to_string).collect();
+                    p.write(&format!("({})", fields.join(", ")));
+                }
+            }
+            Member::Method(m) => {
+                p.write("function ");
+                p.write(&m.name.name);
+                p.function(m);
+            }
+            Member::Signature(m) => {
+                p.write("function ");
+                p.write(&m.name.name);
+                p.parameters(&m.parameters);
+                if let Some(t) = &m.return_type {
+                    p.write(&format!(" -> {}", t));
+                }
+            }
+        };
+        let open = name.span.end();
+        self.lines(&members, Member::span, print, "", (open, ("}", span.end())));
+    }
+
+    fn block(&mut self, b: &BlockExpression) {
+        let end = b.span.end();
+        let inline = self.one_line(&b.span) && !self.has_comment_before(end);
+        match b.statements.as_slice() {
+            [] if inline => self.write("{}"),
+            [s] if inline => {
+                self.write("{ ");
+                self.statement(s);
+                self.write(" }");
+            }
+            statements => {
+                self.write("{");
+                self.depth += 1;
+                self.opened(b.span.start());
+                self.statements(statements);
+                self.comments_before(end);
+                self.depth -= 1;
+                self.out.push('\n');
+                self.out.push_str(&INDENT.repeat(self.depth));
+                self.write("}");
+            }
+        }
+    }
+
+    /// the range of the interpolated string the span is part of, if any
+    fn interpolation(&self, span: &SourceString) -> Option<Range<usize>> {
+        self.interpolations
+            .iter()
+            .find(|r| r.start <= span.start() && span.end() <= r.end)
+            .cloned()
+    }
+
+    fn expression(&mut self, e: &Expression) {
+        if let Some(r) = self.interpolation(&e.span()) {
+            let text = self.source.slice(r);
+            return self.write(&text);
+        }
+        match e {
+            Expression::Literal(l) => self.write(&l.span.to_string()),
+            Expression::Variable(v) => self.write(&v.name),
+            Expression::Group(g) => {
+                self.write("(");
+                self.expression(&g.inner);
+                self.write(")");
+            }
+            Expression::Unary(u) => {
+                match u.op {
+                    UnOperator::Neg => self.write("-"),
+                    UnOperator::Not => self.write("not "),
+                    UnOperator::BitNot => self.write("lnot "),
+                    // only interpolated strings have it, and they are
+                    // printed as they are written
+                    UnOperator::Str => crate::assert_unreachable!(),
+                }
+                self.expression(&u.rhs);
+            }
+            Expression::Binary(b) => {
+                self.expression(&b.lhs);
+                self.write(&format!(" {} ", b.op));
+                self.expression(&b.rhs);
+            }
+            Expression::Call(c) if c.piped => {
+                let (first, rest) = c
+                    .arguments
+                    .split_first()
+                    .expect("the value piped is the first argument");
+                self.expression(first);
+                // pipelines written one step a line stay so
+                if self.line(c.callee.span().start()) > self.end_line(&first.span()) {
+                    self.write(" |>\n");
+                    self.out.push_str(&INDENT.repeat(self.depth + 1));
+                } else {
+                    self.write(" |> ");
+                }
+                self.expression(&c.callee);
+                self.arguments(rest, &c.named, c.callee.span().end(), c.span.end());
+            }
+            Expression::Call(c) => {
+                self.expression(&c.callee);
+                let open = c.callee.span().end();
+                self.arguments(&c.arguments, &c.named, open, c.span.end());
+            }
+            Expression::Method(m) => {
+                self.expression(&m.receiver);
+                self.write(if m.optional { "?." } else { "." });
+                self.write(&m.name.name);
+                self.arguments(&m.arguments, &m.named, m.name.span.end(), m.span.end());
+            }
+            Expression::Field(f) => {
+                self.expression(&f.target);
+                self.write(if f.optional { "?." } else { "." });
+                self.write(&f.name.name);
+            }
+            Expression::Member(m) => {
+                self.expression(&m.module);
+                self.write("::");
+                self.write(&m.name.name);
+            }
+            Expression::Lambda(l) => self.function(&l.function),
+            Expression::List(l) => self.items(
+                ("[", "]"),
+                &l.items,
+                |i| i.span(),
+                |p, i| p.expression(i),
+                l.span.start(),
+                l.span.end(),
+            ),
+            Expression::Map(m) => self.items(
+                ("{", "}"),
+                &m.entries,
+                |(k, v)| k.span().to(&v.span()),
+                |p, (k, v)| {
+                    p.expression(k);
+                    p.write(": ");
+                    p.expression(v);
+                },
+                m.span.start(),
+                m.span.end(),
+            ),
+            Expression::Index(i) => {
+                self.expression(&i.target);
+                self.write("[");
+                match &i.index {
+                    Index::Single(index) => self.expression(index),
+                    Index::Slice { start, end, step } => {
+                        let part = |p: &mut Self, e: &Option<Box<Expression>>| {
+                            if let Some(e) = e {
+                                p.expression(e);
+                            }
+                        };
+                        part(self, start);
+                        self.write(":");
+                        part(self, end);
+                        if step.is_some() {
+                            self.write(":");
+                            part(self, step);
+                        }
+                    }
+                }
+                self.write("]");
+            }
+            Expression::Block(b) => self.block(b),
+            Expression::If(i) => {
+                for (n, (condition, body)) in i.branches.iter().enumerate() {
+                    self.write(if n == 0 { "if " } else { " elif " });
+                    self.expression(condition);
+                    self.write(" ");
+                    self.block(body);
+                }
+                if let Some(b) = &i.otherwise {
+                    self.write(" else ");
+                    self.block(b);
+                }
+            }
+            Expression::For(f) => {
+                self.write("for ");
+                if let Some(c) = &f.condition {
+                    self.expression(c);
+                    self.write(" ");
+                }
+                self.block(&f.body);
+            }
+            Expression::ForIn(f) => {
+                self.write(&format!("for {} in ", f.binding.written()));
+                self.expression(&f.iterable);
+                self.write(" ");
+                self.block(&f.body);
+            }
+            Expression::Match(m) => self.match_expression(m),
+            Expression::Try(t) => {
+                self.write("try ");
+                self.block(&t.body);
+                if let Some(c) = &t.catch {
+                    self.write(" catch ");
+                    if let Some(name) = &c.name {
+                        self.write(&format!("{} ", name.name));
+                    }
+                    self.block(&c.body);
+                }
+                if let Some(f) = &t.finally {
+                    self.write(" finally ");
+                    self.block(f);
+                }
+            }
+            Expression::Spawn(s) => {
+                self.write("spawn ");
+                self.expression(&s.call);
+            }
+        }
+    }
+
+    /// the arguments of a call, `open` is where the target of the call ends
+    fn arguments(
+        &mut self,
+        arguments: &[Expression],
+        named: &[NamedArgument],
+        open: usize,
+        end: usize,
+    ) {
+        let arguments: Vec<Argument> = (arguments.iter().map(Argument::Positional))
+            .chain(named.iter().map(Argument::Named))
+            .collect();
+        self.items(
+            ("(", ")"),
+            &arguments,
+            Argument::span,
+            |p, a| match a {
+                Argument::Positional(e) => p.expression(e),
+                Argument::Named(n) => {
+                    p.write(&format!("{} = ", n.name.name));
+                    p.expression(&n.value);
+                }
+            },
+            open,
+            end,
+        );
+    }
+
+    fn match_expression(&mut self, m: &MatchExpression) {
+        self.write("match ");
+        self.expression(&m.subject);
+        let end = m.span.end();
+        if m.arms.is_empty() {
+            return self.write(" {}");
+        }
+        if self.one_line(&m.span) && !self.has_comment_before(end) {
+            self.write(" { ");
+            for (i, arm) in m.arms.iter().enumerate() {
+                if i > 0 {
+                    self.write(", ");
+                }
+                self.arm(arm);
+            }
+            return self.write(" }");
+        }
+        self.write(" {");
+        let open = m.subject.span().end();
+        self.lines(
+            &m.arms,
+            |a| a.span.clone(),
+            Self::arm,
+            "",
+            (open, ("}", end)),
+        );
+    }
+
+    fn arm(&mut self, a: &MatchArm) {
+        self.write(&a.pattern.written());
+        if let Some(g) = &a.guard {
+            self.write(" if ");
+            self.expression(g);
+        }
+        self.write(" -> ");
+        self.expression(&a.body);
+    }
+}
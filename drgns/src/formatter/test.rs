@@ -0,0 +1,141 @@
+use std::sync::Arc;
+
+use crate::{parser::parse, source::Source};
+
+use super::{diff, format};
+
+fn fmt(s: &str) -> String {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    format(&src).unwrap_or_else(|e| panic!("cannot format {:?}: {:?}", s, e))
+}
+
+/// the syntax tree of a program, as s-expressions
+fn sexp(s: &str) -> String {
+    let (program, errors) = parse(&Arc::new(Source::from_string(s.to_string())));
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    program.to_string()
+}
+
+const PROGRAMS: &[&str] = &[
+    "x:=1+2*3;print(x)",
+    "mut   total: int = 0\nfor i in [1,2,3] { total+=i }",
+    "function fib(n: int) -> int {\n  if n<2 {n} else {fib(n-1)+fib(n-2)}\n}",
+    "f := (x) -> x * 2\ng := (a, b) -> { a ++ b }",
+    "m := {\"a\": 1, ^b: [1, 2]}\nm[\"a\"] = m[^b][1:]",
+    "match v { [first, ..rest] if first > 0 -> rest, {\"k\": _} -> 1, _ -> none }",
+    "try { throw \"no\" } catch e { print(e) } finally { exit 1 }",
+    "function f(file) -> {\n  defer   fs::close(file)\n  defer { n+=1 }\n}",
+    "import std::math\nfor { break (math::pi) }",
+    "name := \"world\"\nprint(\"hello ${name}, ${1 + 2}!\")",
+    "if a { 1 } elif not b { -2 } else { lnot 3 }",
+    "xs := [\n  1,\n  2\n]\nprint(\n  xs.len()\n)",
+    "struct P { x: int, y\nfunction m(self) -> { self.x } }\np := P(1, 2)\np.x += p.m()",
+    "t := spawn   f( 1 )\nprint((spawn xs.len()).await())",
+    "n := xs|>filter(p) |>\n  len()",
+    "[a,..rest]:= xs\nfunction f({k},mut [h,.._]) -> { for {x} in k { h+=x } }",
+    "function f(a,b:int=1,..rest) -> { g(a,by=b) }\nP(y=1,x=2)",
+    "n := a?.b?.c()??d.e",
+    "interface Shape { function area(self)->float\nfunction scale(self,by:float) }",
+    "enum Shape { Circle(r:float),Rect(w,h)\nDot\nfunction f(self) -> { match self { Shape::Rect(w,_) -> w\n_ -> 0 } } }",
+];
+
+#[test]
+fn format_preserves_programs() {
+    for p in PROGRAMS {
+        let formatted = fmt(p);
+        assert_eq!(sexp(&formatted), sexp(p), "formatted as {:?}", formatted);
+    }
+}
+
+#[test]
+fn format_is_idempotent() {
+    for p in PROGRAMS {
+        let formatted = fmt(p);
+        assert_eq!(fmt(&formatted), formatted);
+    }
+}
+
+#[test]
+fn format_layout() {
+    assert_eq!(fmt(""), "");
+    assert_eq!(fmt("x:=1;y:=2"), "x := 1\ny := 2\n");
+    assert_eq!(fmt("a: list[int]=[1,2]"), "a: list[int] = [1, 2]\n");
+    assert_eq!(
+        fmt("function f(x) -> {\nx\n\n\n\nx}"),
+        "function f(x) -> {\n    x\n\n    x\n}\n"
+    );
+    assert_eq!(fmt("if x {print(x)}"), "if x { print(x) }\n");
+    assert_eq!(fmt("if x {\nprint(x)}"), "if x {\n    print(x)\n}\n");
+    assert_eq!(fmt("f := (x) ->  x+1"), "f := (x) -> x + 1\n");
+    assert_eq!(fmt("xs := [\n1, 2]"), "xs := [\n    1,\n    2,\n]\n");
+    assert_eq!(
+        fmt("match x {\n1 -> \"one\"\n_ -> \"many\"}"),
+        "match x {\n    1 -> \"one\"\n    _ -> \"many\"\n}\n"
+    );
+    assert_eq!(
+        fmt("struct P {x, y: int\nfunction m(self)->{self.x}}"),
+        "struct P {\n    x\n    y: int\n    function m(self) -> { self.x }\n}\n"
+    );
+    assert_eq!(
+        fmt("n := xs|>filter(p)|>\nlen( )"),
+        "n := xs |> filter(p) |>\n    len()\n"
+    );
+    assert_eq!(
+        fmt("mut {x,\"y\" :[y,..]}:map= m"),
+        "mut {x, \"y\": [y, ..]}: map = m\n"
+    );
+    // literals keep how they are written
+    assert_eq!(fmt("x := 0x1F + 1_000"), "x := 0x1F + 1_000\n");
+    assert_eq!(
+        fmt("print(\"${ a  +b } and ${\"${c}\"}\")"),
+        "print(\"${ a  +b } and ${\"${c}\"}\")\n"
+    );
+}
+
+#[test]
+fn format_keeps_comments() {
+    assert_eq!(
+        fmt("// header\n\nx := 1 // one\n/* two */ y := 2"),
+        "// header\n\nx := 1 // one\n/* two */\ny := 2\n"
+    );
+    assert_eq!(
+        fmt("function f() -> {\n  // nothing yet\n}"),
+        "function f() -> {\n    // nothing yet\n}\n"
+    );
+    assert_eq!(
+        fmt("xs := [\n  1, // first\n  // last\n  2,\n]\n// the end"),
+        "xs := [\n    1, // first\n    // last\n    2,\n]\n// the end\n"
+    );
+    assert_eq!(fmt("if x { y } // why\nz"), "if x { y } // why\nz\n");
+    assert_eq!(
+        fmt("for { // forever\n  x\n}"),
+        "for { // forever\n    x\n}\n"
+    );
+    // joined lines keep the comments at their end
+    assert_eq!(fmt("f(a, // first\n  b)"), "f(a, b) // first\n");
+}
+
+#[test]
+fn format_rejects_syntax_errors() {
+    let src = Arc::new(Source::from_string("x := (".to_string()));
+    assert!(format(&src).is_err());
+}
+
+#[test]
+fn diff_lines() {
+    assert_eq!(diff("a", "x\ny\n", "x\ny\n"), "");
+    assert_eq!(
+        diff("a.drgns", "1\n2\n3\n", "1\n4\n3\n"),
+        "--- a.drgns\n+++ a.drgns\n@@ -1,3 +1,3 @@\n 1\n-2\n+4\n 3\n"
+    );
+    let old: Vec<String> = (1..=20).map(|i| i.to_string()).collect();
+    let mut new = old.clone();
+    new[1] = "two".to_string();
+    new.remove(17);
+    assert_eq!(
+        diff("f", &old.join("\n"), &new.join("\n")),
+        "--- f\n+++ f\n\
+         @@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n\
+         @@ -15,6 +15,5 @@\n 15\n 16\n 17\n-18\n 19\n 20\n"
+    );
+}
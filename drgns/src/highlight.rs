@@ -0,0 +1,189 @@
+//! Classification of the tokens of a source for syntax highlighting, for
+//! `drgns tokens` and editors.
+//!
+//! Most tokens are classified by their type alone. Identifiers are told
+//! apart with the checker: names of functions, including builtins, methods
+//! and the functions of builtin modules, and names of types in annotations. Sources
+//! with syntax errors are classified as far as they parse. Code being typed
+//! is classified with the lexer alone, see `tokens`.
+
+use std::{collections::HashMap, fmt::Display, rc::Rc, sync::Arc};
+
+use crate::{
+    checker::{self, types::Type, Declared},
+    eh::ErrorHandler,
+    interpreter::{BUILTINS, MODULES},
+    lexer::{tt_2_kw, Lexer, TokenType as TT},
+    parser::{self, walk_expression, Expression, TypeExpression, Visitor},
+    source::{Reader, Source, SourceString},
+};
+
+#[cfg(test)]
+mod test;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Class {
+    Keyword,
+    String,
+    Number,
+    Symbol,
+    Operator,
+    Punctuation,
+    Identifier,
+    Function,
+    Type,
+    Comment,
+}
+
+impl Display for Class {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::Keyword => "keyword",
+            Self::String => "string",
+            Self::Number => "number",
+            Self::Symbol => "symbol",
+            Self::Operator => "operator",
+            Self::Punctuation => "punctuation",
+            Self::Identifier => "identifier",
+            Self::Function => "function",
+            Self::Type => "type",
+            Self::Comment => "comment",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// A token and how it should be highlighted
+#[derive(Debug, Clone)]
+pub struct Highlight {
+    pub class: Class,
+    pub span: SourceString,
+}
+
+/// Classify the tokens of a source, in order, without whitespace
+pub fn highlight(src: &Arc<Source>) -> Vec<Highlight> {
+    let (program, _) = parser::parse(src);
+    let analysis = checker::analyze(&program);
+    let mut names = Names::default();
+    names.visit_program(&program);
+    let is_function = |d: &Declared| d.function || matches!(d.t, Some(Type::Function(..)));
+    for d in analysis.declarations.iter().filter(|d| is_function(d)) {
+        names.classes.insert(d.name.span.start(), Class::Function);
+    }
+    for (span, d) in &analysis.references {
+        let function = match d {
+            Some(d) => is_function(&analysis.declarations[*d]),
+            None => BUILTINS.iter().any(|b| b.name == span.to_string()),
+        };
+        if function {
+            names.classes.insert(span.start(), Class::Function);
+        }
+    }
+    // the errors were already found by the parser
+    let eh = Rc::new(ErrorHandler::new());
+    Lexer::new(Reader::new(src), &eh)
+        .filter_map(|t| {
+            let class = match t.token_type {
+                TT::Identifier => *names
+                    .classes
+                    .get(&t.lexeme.start())
+                    .unwrap_or(&Class::Identifier),
+                tt => class(tt)?,
+            };
+            Some(Highlight {
+                class,
+                span: t.lexeme,
+            })
+        })
+        .collect()
+}
+
+/// Classify the tokens of a source by their type alone, without parsing it,
+/// which is fast enough to do again as code is typed. All identifiers are
+/// `Class::Identifier`.
+pub fn tokens(src: &Arc<Source>) -> Vec<Highlight> {
+    let eh = Rc::new(ErrorHandler::new());
+    Lexer::new(Reader::new(src), &eh)
+        .filter_map(|t| {
+            let class = match t.token_type {
+                TT::Identifier => Class::Identifier,
+                tt => class(tt)?,
+            };
+            Some(Highlight {
+                class,
+                span: t.lexeme,
+            })
+        })
+        .collect()
+}
+
+/// the class of tokens other than identifiers, `None` for whitespace
+fn class(tt: TT) -> Option<Class> {
+    Some(match tt {
+        TT::StringLit
+        | TT::RawStringLit
+        | TT::BytesLit
+        | TT::InterpolationStart
+        | TT::InterpolationMiddle
+        | TT::InterpolationEnd => Class::String,
+        TT::IntLit | TT::FloatLit => Class::Number,
+        TT::SymbolLit => Class::Symbol,
+        TT::Comment => Class::Comment,
+        TT::Semicolon
+        | TT::LeftParen
+        | TT::RightParen
+        | TT::LeftBracket
+        | TT::RightBracket
+        | TT::LeftBrace
+        | TT::RightBrace
+        | TT::Comma => Class::Punctuation,
+        TT::NewLine | TT::Ignore | TT::Unknown => return None,
+        tt if tt_2_kw(tt).is_some() => Class::Keyword,
+        _ => Class::Operator,
+    })
+}
+
+/// the classes of the identifiers the analysis doesn't know about, by their
+/// start
+#[derive(Default)]
+struct Names {
+    classes: HashMap<usize, Class>,
+}
+
+impl Visitor for Names {
+    fn visit_expression(&mut self, e: &Expression) {
+        if let Expression::Method(m) = e {
+            self.classes.insert(m.name.span.start(), Class::Function);
+        }
+        // the exports of builtin modules are known without loading them
+        if let Expression::Member(m) = e {
+            if let Expression::Variable(module) = m.module.as_ref() {
+                let exported = MODULES
+                    .iter()
+                    .find(|(name, ..)| *name == module.name)
+                    .is_some_and(|(_, functions, ..)| {
+                        functions.iter().any(|f| f.name == m.name.name)
+                    });
+                if exported {
+                    self.classes.insert(m.name.span.start(), Class::Function);
+                }
+            }
+        }
+        walk_expression(self, e)
+    }
+
+    fn visit_type(&mut self, t: &TypeExpression) {
+        match t {
+            TypeExpression::Name(i) => {
+                self.classes.insert(i.span.start(), Class::Type);
+            }
+            TypeExpression::Generic(i, arguments, _) => {
+                self.classes.insert(i.span.start(), Class::Type);
+                arguments.iter().for_each(|a| self.visit_type(a));
+            }
+            TypeExpression::Union(ts, _) | TypeExpression::Tuple(ts, _) => {
+                ts.iter().for_each(|t| self.visit_type(t))
+            }
+        }
+    }
+}
@@ -0,0 +1,96 @@
+use std::sync::Arc;
+
+use crate::source::Source;
+
+use super::{highlight, tokens};
+
+/// each token with its class
+fn classes(s: &str) -> Vec<(String, String)> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    highlight(&src)
+        .into_iter()
+        .map(|h| (h.span.to_string(), h.class.to_string()))
+        .collect()
+}
+
+fn pairs(expected: &[(&str, &str)]) -> Vec<(String, String)> {
+    expected
+        .iter()
+        .map(|(t, c)| (t.to_string(), c.to_string()))
+        .collect()
+}
+
+#[test]
+fn highlight_tokens() {
+    assert_eq!(
+        classes("x := [1, 2.5] // list\nif not x { ^a }"),
+        pairs(&[
+            ("x", "identifier"),
+            (":=", "operator"),
+            ("[", "punctuation"),
+            ("1", "number"),
+            (",", "punctuation"),
+            ("2.5", "number"),
+            ("]", "punctuation"),
+            ("// list", "comment"),
+            ("if", "keyword"),
+            ("not", "keyword"),
+            ("x", "identifier"),
+            ("{", "punctuation"),
+            ("^a", "symbol"),
+            ("}", "punctuation"),
+        ])
+    );
+    assert_eq!(
+        classes("\"a ${b} c\""),
+        pairs(&[
+            ("\"a ${", "string"),
+            ("b", "identifier"),
+            ("} c\"", "string")
+        ])
+    );
+}
+
+#[test]
+fn highlight_names() {
+    let highlighted = classes(
+        "function f(n: list[int]) -> int { n.len() }\ng := (x) -> x\nprint(f([1]), g, strings::contains(s, 'a'), y)",
+    );
+    let class_of = |name: &str| -> Vec<&str> {
+        highlighted
+            .iter()
+            .filter(|(t, _)| t == name)
+            .map(|(_, c)| c.as_str())
+            .collect()
+    };
+    assert_eq!(class_of("f"), ["function", "function"]);
+    assert_eq!(class_of("g"), ["function", "function"]);
+    assert_eq!(class_of("n"), ["identifier", "identifier"]);
+    assert_eq!(class_of("list"), ["type"]);
+    assert_eq!(class_of("int"), ["type", "type"]);
+    assert_eq!(class_of("len"), ["function"]);
+    assert_eq!(class_of("print"), ["function"]);
+    assert_eq!(class_of("contains"), ["function"]);
+    assert_eq!(class_of("strings"), ["identifier"]);
+    assert_eq!(class_of("y"), ["identifier"]);
+}
+
+#[test]
+fn tokens_of_code_being_typed() {
+    let src = Arc::new(Source::from_string("print(f(1), \"a".to_string()));
+    let classes: Vec<(String, String)> = tokens(&src)
+        .into_iter()
+        .map(|h| (h.span.to_string(), h.class.to_string()))
+        .collect();
+    assert_eq!(
+        classes[..6],
+        pairs(&[
+            ("print", "identifier"),
+            ("(", "punctuation"),
+            ("f", "identifier"),
+            ("(", "punctuation"),
+            ("1", "number"),
+            (")", "punctuation"),
+        ])
+    );
+}
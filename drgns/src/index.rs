@@ -0,0 +1,400 @@
+//! The symbols of a project, for `drgns refs` and the language server.
+//!
+//! For each script of the project, the index holds the names declared at its
+//! top level and the uses of such names, those of the script itself and
+//! those of the modules it imports, as `module::name`. The names declared in
+//! functions and blocks are left to the checker, they can only be used in
+//! the script declaring them.
+//!
+//! The index is kept in a file of the cache directory, one per project, with
+//! a hash of the text of each script, so that opening it again only parses
+//! the scripts that changed since. A file that can't be read, or was written
+//! by another version of drgns, is built again and overwritten.
+
+use std::{
+    collections::{BTreeMap, HashMap, HashSet},
+    fmt::Display,
+    fs,
+    hash::{DefaultHasher, Hash, Hasher},
+    io,
+    ops::Range,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    checker::{self, Analysis},
+    doc, modules,
+    parser::{
+        self, walk_expression, walk_statement, Expression, Import, Program, Statement, Visitor,
+    },
+    source::{self, Source, SourceString},
+};
+
+#[cfg(test)]
+mod test;
+
+/// The version of what the file of an index holds, which changes whenever
+/// what is indexed does
+const FORMAT: u32 = 2;
+
+/// The symbols of the scripts in a directory and those below it
+pub struct Index {
+    root: PathBuf,
+
+    /// the file the index is kept in, `None` if it is only kept in memory
+    file: Option<PathBuf>,
+    scripts: BTreeMap<PathBuf, Script>,
+}
+
+/// what the file of an index holds
+#[derive(Serialize, Deserialize)]
+struct Stored {
+    version: String,
+    format: u32,
+    scripts: BTreeMap<PathBuf, Script>,
+}
+
+/// The symbols a script declares and the ones it uses
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Script {
+    /// of the text the script was indexed from
+    hash: u64,
+    symbols: Vec<Symbol>,
+    references: Vec<Reference>,
+}
+
+/// A name declared at the top level of a script
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Symbol {
+    pub name: String,
+    pub kind: Kind,
+
+    /// the path of the module declaring it from the root of the project, as
+    /// it is imported, `a::b` for `a/b.drgns`
+    pub module: String,
+
+    /// of the name in its declaration
+    pub location: Location,
+
+    /// whether importing the module gives it, unless its name starts with `_`
+    pub exported: bool,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub enum Kind {
+    Function,
+    Struct,
+    Enum,
+    Variable,
+}
+
+impl Display for Kind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let kind = match self {
+            Kind::Function => "function",
+            Kind::Struct => "struct",
+            Kind::Enum => "enum",
+            Kind::Variable => "variable",
+        };
+        write!(f, "{}", kind)
+    }
+}
+
+/// Where a name is in a script
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Location {
+    /// absolute
+    pub path: PathBuf,
+
+    /// the char indices of the name
+    pub range: Range<usize>,
+
+    /// of the first char, from 1
+    pub line: usize,
+    pub column: usize,
+}
+
+/// A use of a symbol
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+struct Reference {
+    /// the script declaring the symbol, and its name
+    path: PathBuf,
+    name: String,
+    location: Location,
+}
+
+impl Index {
+    /// The index of the scripts in the directory and those below it, kept in
+    /// a file of `cache` if it is given. The scripts that changed since it
+    /// was last kept are indexed again, and the file written.
+    pub fn open(root: &Path, cache: Option<&Path>) -> Self {
+        let root = std::path::absolute(root).unwrap_or_else(|_| root.to_path_buf());
+        let file = cache.map(|dir| dir.join(format!("index-{:016x}.json", hash(&root))));
+        let scripts = file
+            .as_ref()
+            .and_then(|f| fs::read(f).ok())
+            .and_then(|bytes| serde_json::from_slice::<Stored>(&bytes).ok())
+            .filter(|s| s.version == env!("CARGO_PKG_VERSION") && s.format == FORMAT)
+            .map(|s| s.scripts)
+            .unwrap_or_default();
+        let mut index = Self {
+            root,
+            file,
+            scripts,
+        };
+        index.update();
+        if let Err(e) = index.save() {
+            log::warn!("cannot keep the index of '{}': {}", index.root.display(), e);
+        }
+        index
+    }
+
+    /// Index the scripts changed since they were indexed, and those added,
+    /// and forget the ones removed
+    pub fn update(&mut self) {
+        let mut found = vec![];
+        scripts(&self.root, &mut found);
+        let kept: HashSet<&PathBuf> = found.iter().collect();
+        self.scripts.retain(|path, _| kept.contains(path));
+        for path in found {
+            self.update_script(&path);
+        }
+    }
+
+    /// Index the script at the path again if its text changed, or forget it
+    /// if it is gone
+    pub fn update_script(&mut self, path: &Path) {
+        let Ok(text) = source::read_to_string(path) else {
+            self.scripts.remove(path);
+            return;
+        };
+        if self
+            .scripts
+            .get(path)
+            .is_some_and(|s| s.hash == hash(&text))
+        {
+            return;
+        }
+        let source = Arc::new(Source::new(Some(path.display().to_string()), text));
+        let program = parser::parse(&source).0;
+        self.add(&program, &checker::analyze(&program));
+    }
+
+    /// Index a program with what the checker found in it, in place of the
+    /// text of its file, such as a document being edited. Its source must
+    /// have an absolute path.
+    pub fn add(&mut self, program: &Program, analysis: &Analysis) {
+        let Some(path) = program.source.path().map(PathBuf::from) else {
+            return;
+        };
+        let relative = path.strip_prefix(&self.root).unwrap_or(&path);
+        let script = script(program, analysis, &doc::module_name(relative));
+        self.scripts.insert(path, script);
+    }
+
+    /// Write the index to its file, if it has one
+    pub fn save(&self) -> io::Result<()> {
+        let Some(file) = &self.file else {
+            return Ok(());
+        };
+        let stored = Stored {
+            version: env!("CARGO_PKG_VERSION").to_owned(),
+            format: FORMAT,
+            scripts: self.scripts.clone(),
+        };
+        let bytes = serde_json::to_vec(&stored)?;
+        // runs at the same time never read half of the file
+        let partial = file.with_extension(format!("{}.partial", std::process::id()));
+        if let Some(dir) = file.parent() {
+            fs::create_dir_all(dir)?;
+        }
+        fs::write(&partial, bytes)?;
+        fs::rename(&partial, file).inspect_err(|_| {
+            let _ = fs::remove_file(&partial);
+        })
+    }
+
+    /// The symbols named `name`, or `module::name` for the one of a module
+    pub fn definitions(&self, name: &str) -> Vec<&Symbol> {
+        let (module, name) = match name.rsplit_once("::") {
+            Some((module, name)) => (Some(module), name),
+            None => (None, name),
+        };
+        self.symbols()
+            .filter(|s| s.name == name && module.is_none_or(|m| s.module == m))
+            .collect()
+    }
+
+    /// The symbols whose names contain the query, whatever their case
+    pub fn search(&self, query: &str) -> Vec<&Symbol> {
+        let query = query.to_lowercase();
+        self.symbols()
+            .filter(|s| s.name.to_lowercase().contains(&query))
+            .collect()
+    }
+
+    /// The uses of a symbol, in the order of their scripts, its declaration
+    /// left out
+    pub fn references(&self, symbol: &Symbol) -> Vec<&Location> {
+        self.scripts
+            .values()
+            .flat_map(|s| &s.references)
+            .filter(|r| r.path == symbol.location.path && r.name == symbol.name)
+            .map(|r| &r.location)
+            .collect()
+    }
+
+    /// The symbol declared or used at the char index of the script
+    pub fn at(&self, path: &Path, i: usize) -> Option<&Symbol> {
+        let script = self.scripts.get(path)?;
+        let contains = |l: &Location| l.range.start <= i && i <= l.range.end;
+        if let Some(s) = script.symbols.iter().find(|s| contains(&s.location)) {
+            return Some(s);
+        }
+        let r = script.references.iter().find(|r| contains(&r.location))?;
+        let declaring = self.scripts.get(&r.path)?;
+        declaring.symbols.iter().find(|s| s.name == r.name)
+    }
+
+    fn symbols(&self) -> impl Iterator<Item = &Symbol> {
+        self.scripts.values().flat_map(|s| &s.symbols)
+    }
+}
+
+/// what the index keeps of a program
+fn script(program: &Program, analysis: &Analysis, module: &str) -> Script {
+    let path = PathBuf::from(program.source.path().unwrap_or_default());
+    let kinds: HashMap<usize, Kind> = program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Function(f) => Some((f.name.span.start(), Kind::Function)),
+            Statement::Struct(s) => Some((s.name.span.start(), Kind::Struct)),
+            Statement::Enum(e) => Some((e.name.span.start(), Kind::Enum)),
+            _ => None,
+        })
+        .collect();
+    // imports can be anywhere, and so can the uses of their modules
+    let mut uses = Uses::default();
+    uses.visit_program(program);
+    let imports: HashMap<usize, &Import> = uses
+        .imports
+        .iter()
+        .map(|i| (i.name().span.start(), i))
+        .collect();
+
+    let global = 0..program.source.len() + 1;
+    let location = |span: &SourceString| {
+        let p = span.position();
+        Location {
+            path: path.clone(),
+            range: span.start()..span.end(),
+            line: p.line,
+            column: p.column,
+        }
+    };
+    let symbols = analysis
+        .declarations
+        .iter()
+        .filter(|d| d.scope == global && !imports.contains_key(&d.name.span.start()))
+        .map(|d| Symbol {
+            name: d.name.name.clone(),
+            kind: *kinds.get(&d.name.span.start()).unwrap_or(&Kind::Variable),
+            module: module.to_owned(),
+            location: location(&d.name.span),
+            exported: !d.name.name.starts_with('_'),
+        })
+        .collect();
+    let declared = |span: &SourceString| {
+        analysis
+            .references
+            .iter()
+            .find(|(s, _)| s.start() == span.start())
+            .and_then(|(_, d)| d.map(|d| &analysis.declarations[d]))
+    };
+    let mut references: Vec<Reference> = analysis
+        .references
+        .iter()
+        .filter_map(|(span, d)| {
+            let d = &analysis.declarations[(*d)?];
+            let symbol = d.scope == global && !imports.contains_key(&d.name.span.start());
+            symbol.then(|| Reference {
+                path: path.clone(),
+                name: d.name.name.clone(),
+                location: location(span),
+            })
+        })
+        .collect();
+    for (module, name) in &uses.members {
+        let Some(import) = declared(module).and_then(|d| imports.get(&d.name.span.start())) else {
+            continue;
+        };
+        let file = modules::file(import);
+        if file.is_file() {
+            references.push(Reference {
+                path: std::path::absolute(&file).unwrap_or(file),
+                name: name.name.clone(),
+                location: location(&name.span),
+            });
+        }
+    }
+    references.sort_by_key(|r| r.location.range.start);
+    Script {
+        hash: hash(&program.source.slice(0..program.source.len())),
+        symbols,
+        references,
+    }
+}
+
+/// the imports of a program and its uses of the exports of modules,
+/// `module::name`, with the span of the module
+#[derive(Default)]
+struct Uses {
+    imports: Vec<Import>,
+    members: Vec<(SourceString, parser::Identifier)>,
+}
+
+impl Visitor for Uses {
+    fn visit_statement(&mut self, s: &Statement) {
+        if let Statement::Import(i) = s {
+            self.imports.push(i.clone());
+        }
+        walk_statement(self, s);
+    }
+
+    fn visit_expression(&mut self, e: &Expression) {
+        if let Expression::Member(m) = e {
+            if let Expression::Variable(module) = m.module.as_ref() {
+                self.members.push((module.span.clone(), m.name.clone()));
+            }
+        }
+        walk_expression(self, e);
+    }
+}
+
+fn hash(value: &(impl Hash + ?Sized)) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    value.hash(&mut hasher);
+    hasher.finish()
+}
+
+/// the scripts in a directory and those below it, absolute, hidden
+/// directories are left out
+fn scripts(dir: &Path, found: &mut Vec<PathBuf>) {
+    let Ok(entries) = dir.read_dir() else {
+        log::warn!("cannot index the scripts in '{}'", dir.display());
+        return;
+    };
+    let extension = format!(".{}", modules::EXTENSION);
+    for path in entries.filter_map(|e| e.ok()).map(|e| e.path()) {
+        let name = path.file_name().map_or("".into(), |n| n.to_string_lossy());
+        if path.is_dir() && !name.starts_with('.') {
+            scripts(&path, found);
+        } else if name.ends_with(&extension) {
+            found.push(path);
+        }
+    }
+}
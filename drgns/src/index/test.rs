@@ -0,0 +1,92 @@
+use std::{fs, path::PathBuf};
+
+use super::{Index, Kind};
+use crate::test_utils;
+
+/// `file:line:column` of each location, relative to the directory
+fn places<'a>(
+    dir: &PathBuf,
+    locations: impl IntoIterator<Item = &'a super::Location>,
+) -> Vec<String> {
+    locations
+        .into_iter()
+        .map(|l| {
+            let path = l.path.strip_prefix(dir).unwrap_or(&l.path);
+            format!("{}:{}:{}", path.display(), l.line, l.column)
+        })
+        .collect()
+}
+
+#[test]
+fn references_across_modules() {
+    let dir = test_utils::project(
+        "index",
+        "references",
+        &[
+            (
+                "main.drgns",
+                "import lib::shapes\nfunction area() -> {\n  shapes::square(shapes::side)\n}\nprint(area())",
+            ),
+            (
+                "lib/shapes.drgns",
+                "side := 2\nfunction square(x) -> { x * x }\nstruct _Hidden {}\nsquare(side)\n",
+            ),
+            // the same name in another module is another symbol
+            ("other.drgns", "function square(x) -> { x }\nsquare(1)"),
+        ],
+    );
+    let index = Index::open(&dir, None);
+
+    let squares = index.definitions("square");
+    assert_eq!(squares.len(), 2);
+    let square = index.definitions("lib::shapes::square");
+    assert_eq!(square.len(), 1);
+    let square = square[0];
+    assert_eq!(square.kind, Kind::Function);
+    assert_eq!(places(&dir, [&square.location]), ["lib/shapes.drgns:2:10"]);
+    assert_eq!(
+        places(&dir, index.references(square)),
+        ["lib/shapes.drgns:4:1", "main.drgns:3:11"]
+    );
+    let side = index.definitions("side");
+    assert_eq!(
+        places(&dir, index.references(side[0])),
+        ["lib/shapes.drgns:4:8", "main.drgns:3:26"]
+    );
+
+    let hidden = index.definitions("_Hidden");
+    assert_eq!((hidden[0].kind, hidden[0].exported), (Kind::Struct, false));
+    // locals and imports are not symbols
+    assert!(index.definitions("x").is_empty());
+    assert!(index.definitions("shapes").is_empty());
+    let names: Vec<&str> = index.search("A").iter().map(|s| s.name.as_str()).collect();
+    assert_eq!(names, ["square", "area", "square"]);
+
+    // the use in `main`, of `square`, is of the symbol declared in `shapes`
+    let main = dir.join("main.drgns");
+    let at = index.at(&main, 50).expect("a symbol at the use");
+    assert_eq!(at, square);
+    let _ = fs::remove_dir_all(dir);
+}
+
+#[test]
+fn kept_in_the_cache() {
+    let dir = test_utils::project("index", "kept", &[("a.drgns", "a := 1\nprint(a)")]);
+    let cache = dir.join(".cache");
+    let index = Index::open(&dir, Some(&cache));
+    assert_eq!(index.definitions("a").len(), 1);
+    let kept = fs::read_dir(&cache).expect("the index is written").count();
+    assert_eq!(kept, 1);
+
+    // the scripts changed, added or removed since are indexed again
+    fs::write(dir.join("a.drgns"), "b := 1").expect("the file is written");
+    fs::write(dir.join("c.drgns"), "c := 1").expect("the file is written");
+    let index = Index::open(&dir, Some(&cache));
+    assert!(index.definitions("a").is_empty());
+    assert_eq!(index.definitions("b").len(), 1);
+    assert_eq!(index.definitions("c").len(), 1);
+    fs::remove_file(dir.join("c.drgns")).expect("the file is removed");
+    let index = Index::open(&dir, Some(&cache));
+    assert!(index.definitions("c").is_empty());
+    let _ = fs::remove_dir_all(dir);
+}
@@ -0,0 +1,1346 @@
+//! Tree-walking interpreter, evaluates the AST directly.
+
+use std::sync::Arc;
+
+use indexmap::IndexMap;
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    modules::{self, Loader},
+    parser::{
+        Arity, Assignment, BinOperator, BlockExpression, Expression, FieldExpression,
+        ForExpression, ForInExpression, Identifier, IfExpression, Index, IndexExpression, Literal,
+        MatchExpression, MethodExpression, NamedArgument, Pattern, Program, Rest, SpawnExpression,
+        Statement, TryExpression, UnOperator,
+    },
+    source::{Source, SourceString},
+    values::{self, Enum, Function, Instance, Iter, Key, Struct, Task, Value},
+};
+
+pub mod builtins;
+pub use builtins::{BUILTINS, MODULES};
+pub mod coverage;
+pub mod deterministic;
+mod environment;
+pub use environment::*;
+mod generator;
+pub mod interrupt;
+pub mod io;
+pub mod limits;
+pub mod profile;
+pub mod sandbox;
+pub mod trace;
+
+#[cfg(test)]
+mod test;
+
+/// Why evaluation of a program stopped early
+#[derive(Debug, Clone)]
+pub enum Halt {
+    /// the script ran `exit`
+    Exit(i32),
+    Error(DragonError),
+}
+
+/// Non-local control flow, propagated through `Err` until it is handled
+#[derive(Debug)]
+enum Unwind {
+    Break(Value, SourceString),
+    Continue(SourceString),
+    Return(Value, SourceString),
+    Halt(Halt),
+}
+
+type Eval<T = Value> = Result<T, Unwind>;
+
+/// What an expression in tail position evaluates to, see `Interpreter::tail`
+enum Tail {
+    Value(Value),
+
+    /// a call left to the function the expression returns from, with its
+    /// arguments and where it is made
+    Call(Value, Vec<Value>, Vec<(Arc<str>, Value)>, SourceString),
+}
+
+fn error<T>(msg: impl Into<String>, span: &SourceString) -> Eval<T> {
+    coded_error(ErrorCode::Runtime, msg, span)
+}
+
+/// for errors that the checker can also find ahead of time
+fn coded_error<T>(code: ErrorCode, msg: impl Into<String>, span: &SourceString) -> Eval<T> {
+    Err(Unwind::Halt(Halt::Error(DragonError::new(
+        code,
+        msg.into(),
+        Some(span.clone()),
+    ))))
+}
+
+fn undefined<T>(name: &Identifier) -> Eval<T> {
+    coded_error(
+        ErrorCode::UndefinedVariable,
+        format!("undefined variable '{}'", name.name),
+        &name.span,
+    )
+}
+
+/// Evaluate a program in a fresh interpreter
+pub fn eval(program: &Program) -> Result<Value, Halt> {
+    Interpreter::new().eval(program)
+}
+
+/// Evaluate the source of an imported module, see `modules::Evaluator`
+fn module(source: &Arc<Source>, loader: &Arc<Loader>) -> Result<Env, Halt> {
+    let program = modules::parse(source)?;
+    let mut interpreter = Interpreter::with_loader(loader.clone());
+    interpreter.eval(&program)?;
+    Ok(interpreter.globals)
+}
+
+/// Interpreter state, the global environment persists across evaluations, so
+/// that the REPL can build on previous lines.
+pub struct Interpreter {
+    globals: Env,
+    loader: Arc<Loader>,
+
+    /// the calls of functions being run, innermost last
+    frames: Vec<Frame>,
+
+    /// the code deferred by each function being run, innermost last, see
+    /// `Interpreter::function`
+    deferred: Vec<Vec<Arc<Function>>>,
+    hook: Option<Box<dyn Hook>>,
+
+    /// where `yield` hands its items, on the threads running generators
+    yielder: Option<generator::Yielder>,
+}
+
+/// A call of a function declared in the program
+#[derive(Debug, Clone)]
+pub struct Frame {
+    pub function: String,
+
+    /// where it was called from
+    pub call: SourceString,
+}
+
+/// Called before each statement runs, such as by a debugger, see
+/// `Interpreter::set_hook`. The hook can evaluate code in the scope of the
+/// statement, statements run that way don't call it again. Returning an
+/// error stops the program with it.
+pub trait Hook {
+    fn statement(
+        &mut self,
+        interpreter: &mut Interpreter,
+        statement: &Statement,
+        env: &Env,
+    ) -> Result<(), Halt>;
+}
+
+impl Default for Interpreter {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Interpreter {
+    pub fn new() -> Self {
+        Self::with_loader(Loader::new(module))
+    }
+
+    /// share the modules loaded by another interpreter
+    pub fn with_loader(loader: Arc<Loader>) -> Self {
+        // builtins live in their own scope, so that the globals only hold
+        // what the program declares
+        let builtins = Environment::global();
+        builtins::register(&builtins);
+        Self {
+            globals: Environment::child(&builtins),
+            loader,
+            frames: vec![],
+            deferred: vec![],
+            hook: None,
+            yielder: None,
+        }
+    }
+
+    pub fn globals(&self) -> &Env {
+        &self.globals
+    }
+
+    /// the modules loaded by the scripts evaluated
+    pub fn loader(&self) -> &Arc<Loader> {
+        &self.loader
+    }
+
+    /// the calls being run, innermost last, empty at the top level
+    pub fn frames(&self) -> &[Frame] {
+        &self.frames
+    }
+
+    /// call the hook before each statement of the program, it isn't called
+    /// for the programs of imported modules, which run in interpreters of
+    /// their own
+    pub fn set_hook(&mut self, hook: Box<dyn Hook>) {
+        self.hook = Some(hook);
+    }
+
+    /// Evaluate all statements, the value is the one of the last statement.
+    pub fn eval(&mut self, program: &Program) -> Result<Value, Halt> {
+        let env = self.globals.clone();
+        self.eval_in(program, &env)
+    }
+
+    /// Evaluate all statements in the given scope, such as the one of the
+    /// statement a hook is called for
+    pub fn eval_in(&mut self, program: &Program, env: &Env) -> Result<Value, Halt> {
+        let mut last = Value::None;
+        for s in &program.statements {
+            last = match self.statement(s, env) {
+                Ok(v) => v,
+                Err(Unwind::Halt(h)) => return Err(h),
+                Err(Unwind::Break(_, span)) => {
+                    return Err(escaped("break outside of a loop or block", span))
+                }
+                Err(Unwind::Continue(span)) => {
+                    return Err(escaped("continue outside of a loop", span))
+                }
+                Err(Unwind::Return(_, span)) => {
+                    return Err(escaped("return outside of a function", span))
+                }
+            };
+        }
+        Ok(last)
+    }
+
+    fn statement(&mut self, s: &Statement, env: &Env) -> Eval {
+        if coverage::enabled() {
+            coverage::hit(&s.span());
+        }
+        if trace::current().is_some() {
+            trace::statement(&s.span());
+        }
+        self.hook(s, env)?;
+        self.execute(s, env)
+    }
+
+    fn hook(&mut self, s: &Statement, env: &Env) -> Eval<()> {
+        // taken out while it runs, so that what it evaluates doesn't call it
+        if let Some(mut hook) = self.hook.take() {
+            let result = hook.statement(self, s, env);
+            self.hook = Some(hook);
+            result.map_err(Unwind::Halt)?;
+        }
+        Ok(())
+    }
+
+    /// run a statement, without calling the hook
+    fn execute(&mut self, s: &Statement, env: &Env) -> Eval {
+        match s {
+            Statement::Declaration(d) => {
+                let value = self.expression(&d.value, env)?;
+                env.define(&d.name.name, value, d.mutable);
+                Ok(Value::None)
+            }
+            Statement::Destructuring(d) => {
+                let value = self.expression(&d.value, env)?;
+                define(env, &d.pattern, value, d.mutable)?;
+                Ok(Value::None)
+            }
+            Statement::Function(f) => {
+                let function = Function {
+                    declaration: f.clone(),
+                    closure: env.clone(),
+                };
+                env.define(&f.name.name, Value::Function(Arc::new(function)), false);
+                Ok(Value::None)
+            }
+            Statement::Struct(s) => {
+                let methods = s.methods.iter().map(|m| {
+                    let function = Function {
+                        declaration: m.clone(),
+                        closure: env.clone(),
+                    };
+                    (m.name.name.clone(), Value::Function(Arc::new(function)))
+                });
+                let declared = Struct::new(
+                    s.name.name.clone(),
+                    s.fields.iter().map(|f| f.name.name.clone()).collect(),
+                    methods.collect(),
+                );
+                env.define(&s.name.name, Value::Struct(Arc::new(declared)), false);
+                Ok(Value::None)
+            }
+            Statement::Enum(e) => {
+                let methods = e.methods.iter().map(|m| {
+                    let function = Function {
+                        declaration: m.clone(),
+                        closure: env.clone(),
+                    };
+                    (m.name.name.clone(), Value::Function(Arc::new(function)))
+                });
+                let variants = e.variants.iter().map(|v| {
+                    let fields = v.fields.as_ref();
+                    let names = fields.map(|f| f.iter().map(|f| f.name.name.clone()).collect());
+                    (v.name.name.clone(), names)
+                });
+                let declared =
+                    Enum::new(e.name.name.clone(), variants.collect(), methods.collect());
+                env.define(&e.name.name, Value::Enum(Arc::new(declared)), false);
+                Ok(Value::None)
+            }
+            // only a type, for the checker
+            Statement::Interface(_) => Ok(Value::None),
+            Statement::Assignment(a) => self.assignment(a, env),
+            Statement::Expression(e) => self.expression(e, env),
+            Statement::Exit(e) => match exit_code(self.expression(&e.code, env)?) {
+                Ok(code) => Err(Unwind::Halt(Halt::Exit(code))),
+                Err(msg) => error(msg, &e.code.span()),
+            },
+            Statement::Throw(t) => {
+                let value = self.expression(&t.value, env)?;
+                let e = thrown(value, Some(t.span.clone()));
+                Err(Unwind::Halt(Halt::Error(e)))
+            }
+            Statement::Defer(d) => {
+                let Some(deferred) = self.deferred.last_mut() else {
+                    let halt = escaped("defer outside of a function", d.span.clone());
+                    return Err(Unwind::Halt(halt));
+                };
+                deferred.push(Arc::new(Function {
+                    declaration: d.function.clone(),
+                    closure: env.clone(),
+                }));
+                Ok(Value::None)
+            }
+            Statement::Import(i) => {
+                let module = self.loader.import(i).map_err(Unwind::Halt)?;
+                env.define(&i.name().name, module, false);
+                Ok(Value::None)
+            }
+            Statement::Return(r) => {
+                let value = self.optional(&r.value, env)?;
+                Err(Unwind::Return(value, r.span.clone()))
+            }
+            Statement::Yield(y) => {
+                let item = self.optional(&y.value, env)?;
+                let Some(yielder) = &self.yielder else {
+                    let halt = escaped("yield outside of a function", y.span.clone());
+                    return Err(Unwind::Halt(halt));
+                };
+                yielder.give(item).map_err(Unwind::Halt)?;
+                Ok(Value::None)
+            }
+            Statement::Break(b) => {
+                let value = self.optional(&b.value, env)?;
+                Err(Unwind::Break(value, b.span.clone()))
+            }
+            Statement::Continue(c) => {
+                self.optional(&c.value, env)?;
+                Err(Unwind::Continue(c.span.clone()))
+            }
+        }
+    }
+
+    fn optional(&mut self, e: &Option<Expression>, env: &Env) -> Eval {
+        match e {
+            Some(e) => self.expression(e, env),
+            None => Ok(Value::None),
+        }
+    }
+
+    fn assignment(&mut self, a: &Assignment, env: &Env) -> Eval {
+        let target = match &a.target {
+            Expression::Variable(target) => target,
+            Expression::Index(i) => return self.index_assignment(i, a, env),
+            Expression::Field(f) => return self.field_assignment(f, a, env),
+            _ => crate::assert_unreachable!(),
+        };
+        let value = match a.op.bin_operator() {
+            Some(op) => {
+                let Some(current) = env.get(&target.name) else {
+                    return undefined(target);
+                };
+                let value = self.expression(&a.value, env)?;
+                self.binary(op, current, value, &a.span)?
+            }
+            None => self.expression(&a.value, env)?,
+        };
+        match env.assign(&target.name, value) {
+            Ok(()) => Ok(Value::None),
+            Err(AssignError::Undefined) => undefined(target),
+            Err(AssignError::Immutable) => coded_error(
+                ErrorCode::ImmutableAssignment,
+                format!(
+                    "cannot assign twice to immutable variable '{}'",
+                    target.name
+                ),
+                &target.span,
+            ),
+        }
+    }
+
+    /// `target[index] = value`, the target and index are evaluated once, even
+    /// in compound assignments
+    fn index_assignment(&mut self, i: &IndexExpression, a: &Assignment, env: &Env) -> Eval {
+        let Index::Single(index) = &i.index else {
+            crate::assert_unreachable!();
+        };
+        let target = self.expression(&i.target, env)?;
+        let index = self.expression(index, env)?;
+        let value = match a.op.bin_operator() {
+            Some(op) => {
+                let current = self.index(target.clone(), index.clone(), &i.span)?;
+                let value = self.expression(&a.value, env)?;
+                self.binary(op, current, value, &a.span)?
+            }
+            None => self.expression(&a.value, env)?,
+        };
+        if let Some(method) = values::method(&target, values::SET_INDEX) {
+            self.call(method, vec![target, index, value], &i.span)?;
+            return Ok(Value::None);
+        }
+        values::set_index(&target, &index, value).or_else(|msg| error(msg, &i.span))?;
+        Ok(Value::None)
+    }
+
+    /// `target.name = value`, the target is evaluated once
+    fn field_assignment(&mut self, f: &FieldExpression, a: &Assignment, env: &Env) -> Eval {
+        let target = self.expression(&f.target, env)?;
+        let value = match a.op.bin_operator() {
+            Some(op) => {
+                let current = self.field(&target, &f.name)?;
+                let value = self.expression(&a.value, env)?;
+                self.binary(op, current, value, &a.span)?
+            }
+            None => self.expression(&a.value, env)?,
+        };
+        values::set_field(&target, &f.name.name, value)
+            .or_else(|msg| coded_error(ErrorCode::UnknownField, msg, &f.name.span))?;
+        Ok(Value::None)
+    }
+
+    /// apply a binary operator, with the method overloading it if the
+    /// operand on the left has one
+    fn binary(&mut self, op: BinOperator, lhs: Value, rhs: Value, span: &SourceString) -> Eval {
+        let Some(method) = values::overload(op, &lhs) else {
+            return values::binary(op, lhs, rhs).or_else(|msg| error(msg, span));
+        };
+        let result = self.call(method, vec![lhs, rhs], span)?;
+        Ok(match op {
+            BinOperator::Ne => Value::Bool(!result.is_truthy()),
+            _ => result,
+        })
+    }
+
+    fn unary(&mut self, op: UnOperator, rhs: Value, span: &SourceString) -> Eval {
+        let Some(method) = values::unary_overload(op, &rhs) else {
+            return values::unary(op, rhs).or_else(|msg| error(msg, span));
+        };
+        let result = self.call(method, vec![rhs], span)?;
+        match op {
+            // interpolation makes a string of whatever `to_string` returns
+            UnOperator::Str => values::unary(op, result).or_else(|msg| error(msg, span)),
+            _ => Ok(result),
+        }
+    }
+
+    fn index(&mut self, target: Value, index: Value, span: &SourceString) -> Eval {
+        match values::method(&target, values::INDEX) {
+            Some(method) => self.call(method, vec![target, index], span),
+            None => values::index(&target, &index).or_else(|msg| error(msg, span)),
+        }
+    }
+
+    fn field(&mut self, target: &Value, name: &Identifier) -> Eval {
+        values::field(target, &name.name)
+            .or_else(|msg| coded_error(ErrorCode::UnknownField, msg, &name.span))
+    }
+
+    /// Take a step of the script, unless it is interrupted or over its
+    /// limits. Each expression is one, and so is each iteration of a loop,
+    /// which may have none.
+    fn step(&self, span: &SourceString) -> Eval<()> {
+        if coverage::enabled() {
+            coverage::hit(span);
+        }
+        if interrupt::pending() {
+            return Err(Unwind::Halt(Halt::Error(interrupt::error(Some(
+                span.clone(),
+            )))));
+        }
+        limits::step().or_else(|msg| coded_error(ErrorCode::LimitExceeded, msg, span))
+    }
+
+    fn expression(&mut self, e: &Expression, env: &Env) -> Eval {
+        self.step(&e.span())?;
+        match e {
+            Expression::Binary(be) if be.op == BinOperator::And => {
+                let lhs = self.expression(&be.lhs, env)?;
+                if !lhs.is_truthy() {
+                    return Ok(Value::Bool(false));
+                }
+                Ok(Value::Bool(self.expression(&be.rhs, env)?.is_truthy()))
+            }
+            Expression::Binary(be) if be.op == BinOperator::Or => {
+                let lhs = self.expression(&be.lhs, env)?;
+                if lhs.is_truthy() {
+                    return Ok(Value::Bool(true));
+                }
+                Ok(Value::Bool(self.expression(&be.rhs, env)?.is_truthy()))
+            }
+            Expression::Binary(be) if be.op == BinOperator::Coalesce => {
+                match self.expression(&be.lhs, env)? {
+                    Value::None => self.expression(&be.rhs, env),
+                    lhs => Ok(lhs),
+                }
+            }
+            Expression::Binary(be) => {
+                let lhs = self.expression(&be.lhs, env)?;
+                let rhs = self.expression(&be.rhs, env)?;
+                self.binary(be.op, lhs, rhs, &be.span)
+            }
+            Expression::Unary(ue) => {
+                let rhs = self.expression(&ue.rhs, env)?;
+                self.unary(ue.op, rhs, &ue.span)
+            }
+            Expression::Literal(le) => Ok(literal(&le.value)),
+            Expression::Variable(i) => match env.get(&i.name) {
+                Some(v) => Ok(v),
+                None => undefined(i),
+            },
+            Expression::Group(g) => self.expression(&g.inner, env),
+            Expression::Call(c) => {
+                let callee = self.expression(&c.callee, env)?;
+                let arguments = self.arguments(&c.arguments, env)?;
+                let named = self.named(&c.named, env)?;
+                self.call_named(callee, arguments, named, &c.span)
+            }
+            Expression::Method(m) => {
+                let Some((callee, arguments)) = self.method(m, env)? else {
+                    return Ok(Value::None);
+                };
+                let named = self.named(&m.named, env)?;
+                self.call_named(callee, arguments, named, &m.span)
+            }
+            Expression::Field(f) => match self.expression(&f.target, env)? {
+                Value::None if f.optional => Ok(Value::None),
+                target => self.field(&target, &f.name),
+            },
+            Expression::Member(m) => {
+                let module = self.expression(&m.module, env)?;
+                modules::member(module, &m.name.name, Some(m.name.span.clone()))
+                    .map_err(|e| Unwind::Halt(Halt::Error(e)))
+            }
+            Expression::Lambda(l) => {
+                let function = Function {
+                    declaration: l.function.clone(),
+                    closure: env.clone(),
+                };
+                Ok(Value::Function(Arc::new(function)))
+            }
+            Expression::List(l) => Ok(Value::list(self.arguments(&l.items, env)?)),
+            Expression::Map(m) => {
+                let mut entries = IndexMap::with_capacity(m.entries.len());
+                for (k, v) in &m.entries {
+                    let key = self.expression(k, env)?;
+                    let value = self.expression(v, env)?;
+                    let key = Key::try_from(&key).or_else(|msg| error(msg, &m.span))?;
+                    entries.insert(key, value);
+                }
+                Ok(Value::map(entries))
+            }
+            Expression::Index(i) => self.index_expression(i, env),
+            // a bare block can be broken out of with a value
+            Expression::Block(b) => match self.block(b, env) {
+                Err(Unwind::Break(v, _)) => Ok(v),
+                r => r,
+            },
+            Expression::If(i) => self.if_expression(i, env),
+            Expression::For(f) => self.for_expression(f, env),
+            Expression::ForIn(f) => self.for_in_expression(f, env),
+            Expression::Match(m) => self.match_expression(m, env),
+            Expression::Try(t) => self.try_expression(t, env),
+            Expression::Spawn(s) => self.spawn(s, env),
+        }
+    }
+
+    /// the function `receiver.name(...)` calls and its arguments, a method of
+    /// the receiver or else the function in scope
+    /// `None` if the call has `?.` and the receiver is `none`, so that it is
+    /// not made
+    fn method(&mut self, m: &MethodExpression, env: &Env) -> Eval<Option<(Value, Vec<Value>)>> {
+        let receiver = self.expression(&m.receiver, env)?;
+        if m.optional && matches!(receiver, Value::None) {
+            return Ok(None);
+        }
+        let callee = match values::method(&receiver, &m.name.name) {
+            Some(method) => method,
+            None => match env.get(&m.name.name) {
+                Some(f) => f,
+                None => return undefined(&m.name),
+            },
+        };
+        let mut arguments = vec![receiver];
+        arguments.extend(self.arguments(&m.arguments, env)?);
+        Ok(Some((callee, arguments)))
+    }
+
+    /// start the call on a task, run by an interpreter of its own over the
+    /// same modules
+    fn spawn(&mut self, s: &SpawnExpression, env: &Env) -> Eval {
+        let (callee, arguments, named, span) = match s.call.as_ref() {
+            Expression::Call(c) => {
+                let callee = self.expression(&c.callee, env)?;
+                let arguments = self.arguments(&c.arguments, env)?;
+                (
+                    callee,
+                    arguments,
+                    self.named(&c.named, env)?,
+                    c.span.clone(),
+                )
+            }
+            Expression::Method(m) => {
+                let Some((callee, arguments)) = self.method(m, env)? else {
+                    // the parser leaves out calls with `?.`
+                    crate::assert_unreachable!()
+                };
+                (
+                    callee,
+                    arguments,
+                    self.named(&m.named, env)?,
+                    m.span.clone(),
+                )
+            }
+            _ => crate::assert_unreachable!(),
+        };
+        let loader = self.loader.clone();
+        let task = Task::spawn(move || {
+            let mut interpreter = Interpreter::with_loader(loader);
+            match interpreter.call_named(callee, arguments, named, &span) {
+                Ok(v) => Ok(v),
+                Err(Unwind::Halt(h)) => Err(h),
+                // `function` turns the others into errors
+                Err(_) => crate::assert_unreachable!(),
+            }
+        });
+        task.map(Value::Task).or_else(|msg| error(msg, &s.span))
+    }
+
+    fn arguments(&mut self, arguments: &[Expression], env: &Env) -> Eval<Vec<Value>> {
+        arguments.iter().map(|a| self.expression(a, env)).collect()
+    }
+
+    fn named(&mut self, named: &[NamedArgument], env: &Env) -> Eval<Vec<(Arc<str>, Value)>> {
+        named
+            .iter()
+            .map(|n| {
+                Ok((
+                    Arc::from(n.name.name.as_str()),
+                    self.expression(&n.value, env)?,
+                ))
+            })
+            .collect()
+    }
+
+    /// evaluate the statements in a new scope, the value is the one of the
+    /// last statement
+    fn block(&mut self, b: &BlockExpression, env: &Env) -> Eval {
+        let env = Environment::child(env);
+        let mut last = Value::None;
+        for s in &b.statements {
+            last = self.statement(s, &env)?;
+        }
+        Ok(last)
+    }
+
+    /// Evaluate an expression whose value the function running returns, the
+    /// calls it ends with are left to the function, so that they can take
+    /// over its frame
+    fn tail(&mut self, e: &Expression, env: &Env) -> Eval<Tail> {
+        match e {
+            Expression::Call(c) => {
+                let callee = self.expression(&c.callee, env)?;
+                let arguments = self.arguments(&c.arguments, env)?;
+                let named = self.named(&c.named, env)?;
+                Ok(Tail::Call(callee, arguments, named, c.span.clone()))
+            }
+            Expression::Method(m) => {
+                let Some((callee, arguments)) = self.method(m, env)? else {
+                    return Ok(Tail::Value(Value::None));
+                };
+                let named = self.named(&m.named, env)?;
+                Ok(Tail::Call(callee, arguments, named, m.span.clone()))
+            }
+            Expression::Group(g) => self.tail(&g.inner, env),
+            Expression::Block(b) => match self.tail_block(b, env) {
+                Err(Unwind::Break(v, _)) => Ok(Tail::Value(v)),
+                r => r,
+            },
+            Expression::If(i) => match self.branch(i, env)? {
+                Some(b) => self.tail_block(b, env),
+                None => Ok(Tail::Value(Value::None)),
+            },
+            Expression::Match(m) => {
+                let (env, body) = self.arm(m, env)?;
+                match body {
+                    Expression::Block(b) => self.tail_block(b, &env),
+                    e => self.tail(e, &env),
+                }
+            }
+            e => self.expression(e, env).map(Tail::Value),
+        }
+    }
+
+    /// like `block`, with the last statement in tail position
+    fn tail_block(&mut self, b: &BlockExpression, env: &Env) -> Eval<Tail> {
+        let env = Environment::child(env);
+        let Some((last, rest)) = b.statements.split_last() else {
+            return Ok(Tail::Value(Value::None));
+        };
+        for s in rest {
+            self.statement(s, &env)?;
+        }
+        if trace::current().is_some() {
+            trace::statement(&last.span());
+        }
+        self.hook(last, &env)?;
+        match last {
+            Statement::Expression(e) => self.tail(e, &env),
+            Statement::Return(r) if r.value.is_some() => {
+                let value = r.value.as_ref().expect("checked by the guard");
+                self.tail(value, &env)
+            }
+            s => self.execute(s, &env).map(Tail::Value),
+        }
+    }
+
+    fn if_expression(&mut self, i: &IfExpression, env: &Env) -> Eval {
+        match self.branch(i, env)? {
+            Some(b) => self.block(b, env),
+            None => Ok(Value::None),
+        }
+    }
+
+    /// the block of the first branch whose condition holds, or the one of
+    /// `else`
+    fn branch<'a>(&mut self, i: &'a IfExpression, env: &Env) -> Eval<Option<&'a BlockExpression>> {
+        for (condition, body) in &i.branches {
+            if self.expression(condition, env)?.is_truthy() {
+                return Ok(Some(body));
+            }
+        }
+        Ok(i.otherwise.as_ref())
+    }
+
+    fn for_expression(&mut self, f: &ForExpression, env: &Env) -> Eval {
+        loop {
+            self.step(&f.span)?;
+            if let Some(c) = &f.condition {
+                if !self.expression(c, env)?.is_truthy() {
+                    return Ok(Value::None);
+                }
+            }
+            match self.block(&f.body, env) {
+                Ok(_) | Err(Unwind::Continue(_)) => {}
+                Err(Unwind::Break(v, _)) => return Ok(v),
+                Err(u) => return Err(u),
+            }
+        }
+    }
+
+    fn for_in_expression(&mut self, f: &ForInExpression, env: &Env) -> Eval {
+        let iterable = self.expression(&f.iterable, env)?;
+        let span = f.iterable.span();
+        let items = values::iterable(iterable).or_else(|msg| error(msg, &span))?;
+        while let Some(item) = self.next(&items, &span)? {
+            self.step(&f.span)?;
+            let env = Environment::child(env);
+            define(&env, &f.binding, item, false)?;
+            match self.block(&f.body, &env) {
+                Ok(_) | Err(Unwind::Continue(_)) => {}
+                Err(Unwind::Break(v, _)) => return Ok(v),
+                Err(u) => return Err(u),
+            }
+        }
+        Ok(Value::None)
+    }
+
+    /// step an iterator, the functions it goes through are called from the
+    /// given span
+    fn next(&mut self, iterator: &Iter, span: &SourceString) -> Eval<Option<Value>> {
+        let mut call = |f: &Value| match self.call(f.clone(), vec![], span) {
+            Ok(v) => Ok(v),
+            Err(Unwind::Halt(h)) => Err(h),
+            // calls turn break, continue and return into values or errors
+            Err(_) => crate::assert_unreachable!(),
+        };
+        iterator.next(&mut call).map_err(Unwind::Halt)
+    }
+
+    fn index_expression(&mut self, i: &IndexExpression, env: &Env) -> Eval {
+        let target = self.expression(&i.target, env)?;
+        let result = match &i.index {
+            Index::Single(index) => {
+                let index = self.expression(index, env)?;
+                return self.index(target, index, &i.span);
+            }
+            Index::Slice { start, end, step } => {
+                let mut part = |e: &Option<Box<Expression>>| match e {
+                    Some(e) => self.expression(e, env),
+                    None => Ok(Value::None),
+                };
+                let (start, end, step) = (part(start)?, part(end)?, part(step)?);
+                values::slice(&target, start, end, step)
+            }
+        };
+        result.or_else(|msg| error(msg, &i.span))
+    }
+
+    /// the bindings of each arm live in their own scope, shared by its guard
+    /// and its value
+    fn match_expression(&mut self, m: &MatchExpression, env: &Env) -> Eval {
+        let (env, body) = self.arm(m, env)?;
+        // unlike a bare block, the block of an arm can't be broken out of
+        match body {
+            Expression::Block(b) => self.block(b, &env),
+            e => self.expression(e, &env),
+        }
+    }
+
+    /// the scope of the first arm that matches, and its value
+    fn arm<'a>(&mut self, m: &'a MatchExpression, env: &Env) -> Eval<(Env, &'a Expression)> {
+        let subject = self.expression(&m.subject, env)?;
+        for arm in &m.arms {
+            let mut bound = vec![];
+            if !destructure(&arm.pattern, &subject, &mut bound) {
+                continue;
+            }
+            let env = Environment::child(env);
+            for (name, value) in arm.pattern.bindings().into_iter().zip(bound) {
+                env.define(&name.name, value, false);
+            }
+            if let Some(g) = &arm.guard {
+                if !self.expression(g, &env)?.is_truthy() {
+                    continue;
+                }
+            }
+            return Ok((env, &arm.body));
+        }
+        error(unmatched(&subject), &m.span)
+    }
+
+    fn try_expression(&mut self, t: &TryExpression, env: &Env) -> Eval {
+        let mut result = self.block(&t.body, env);
+        if let Some(c) = &t.catch {
+            match result {
+                Err(Unwind::Halt(Halt::Error(e))) if !interrupt::is_interrupt(&e) => {
+                    let env = Environment::child(env);
+                    if let Some(name) = &c.name {
+                        env.define(&name.name, Value::Error(Arc::new(e)), false);
+                    }
+                    result = self.block(&c.body, &env);
+                }
+                r => result = r,
+            }
+        }
+        if let Some(f) = &t.finally {
+            // `exit` and interrupts stop the program right away
+            let stopped = match &result {
+                Err(Unwind::Halt(Halt::Exit(_))) => true,
+                Err(Unwind::Halt(Halt::Error(e))) => interrupt::is_interrupt(e),
+                _ => false,
+            };
+            if !stopped {
+                self.block(f, env)?;
+            }
+        }
+        result
+    }
+
+    fn call(&mut self, callee: Value, arguments: Vec<Value>, span: &SourceString) -> Eval {
+        self.call_named(callee, arguments, vec![], span)
+    }
+
+    /// call with arguments given by name too, after the others, only
+    /// functions of the scripts and structs have names for their parameters
+    fn call_named(
+        &mut self,
+        callee: Value,
+        arguments: Vec<Value>,
+        named: Vec<(Arc<str>, Value)>,
+        span: &SourceString,
+    ) -> Eval {
+        let unnamed = match &callee {
+            Value::Builtin(b) => Some(b.name),
+            Value::Native(n) => Some(n.name.as_str()),
+            Value::Iterator(_) => Some("iterator"),
+            _ => None,
+        };
+        if let (Some(function), Some((name, _))) = (unnamed, named.first()) {
+            return coded_error(
+                ErrorCode::ArityMismatch,
+                unknown_parameter(function, name),
+                span,
+            );
+        }
+        match callee {
+            // instances are printed as their `to_string` shows them
+            Value::Builtin(b) if matches!(b.name, "print" | "print!") => {
+                let arguments = arguments
+                    .into_iter()
+                    .map(|a| match values::unary_overload(UnOperator::Str, &a) {
+                        Some(_) => self.unary(UnOperator::Str, a, span),
+                        None => Ok(a),
+                    })
+                    .collect::<Eval<Vec<Value>>>()?;
+                (b.function)(&arguments).or_else(|msg| error(msg, span))
+            }
+            Value::Builtin(b) if matches!(b.name, "await" | "result") => {
+                check_arity(b.name, 1, arguments.len(), span)?;
+                builtins::awaited(b.name, &arguments)
+                    .or_else(|msg| error(msg, span))?
+                    .map_err(Unwind::Halt)
+            }
+            // instances are compared as their `eq` compares them
+            Value::Builtin(b) if b.name == "assert_eq" => {
+                let method = arguments
+                    .first()
+                    .and_then(|a| values::overload(BinOperator::Eq, a));
+                let equal = match (method, arguments.get(..2)) {
+                    (Some(method), Some(compared)) => {
+                        Some(self.call(method, compared.to_vec(), span)?.is_truthy())
+                    }
+                    _ => None,
+                };
+                builtins::assert_equal(&arguments, equal).or_else(|msg| error(msg, span))
+            }
+            Value::Builtin(b) if b.name == "assert_raises" => {
+                check_arity(b.name, 1, arguments.len(), span)?;
+                let outcome = match self.call(arguments[0].clone(), vec![], span) {
+                    Ok(v) => Ok(v),
+                    Err(Unwind::Halt(h)) => Err(h),
+                    Err(u) => return Err(u),
+                };
+                builtins::raised(outcome)
+                    .or_else(|msg| error(msg, span))?
+                    .map_err(Unwind::Halt)
+            }
+            Value::Builtin(b) => {
+                if let Some(arity) = b.arity {
+                    check_arity(b.name, arity, arguments.len(), span)?;
+                }
+                (b.function)(&arguments).or_else(|msg| error(msg, span))
+            }
+            Value::Native(n) => {
+                if let Some(arity) = n.arity {
+                    check_arity(&n.name, arity, arguments.len(), span)?;
+                }
+                (n.function)(&arguments).or_else(|msg| error(msg, span))
+            }
+            Value::Iterator(i) => {
+                check_arity("iterator", 0, arguments.len(), span)?;
+                Ok(self.next(&i, span)?.unwrap_or_else(values::done))
+            }
+            // the fields can be given by name
+            Value::Struct(s) => {
+                let arity = Arity::exactly(s.fields.len());
+                let names = |i: usize| s.fields.get(i).map(String::as_str);
+                let fields = bind_values(&s.name, arity, arguments, named, names)
+                    .or_else(|msg| coded_error(ErrorCode::ArityMismatch, msg, span))?;
+                let fields = fields.into_iter().flatten().collect();
+                Ok(Value::Instance(Instance::new(s, fields)))
+            }
+            Value::Function(f) if f.declaration.generator => {
+                let arguments = bound(&f, arguments, named, span)?;
+                let loader = self.loader.clone();
+                let thread = generator::Thread::new(f, arguments, loader, span.clone());
+                Ok(Value::Iterator(Iter::generator(Box::new(thread))))
+            }
+            Value::Function(f) => self.enter(f, arguments, named, span, Some(span)),
+            v => error(format!("{} is not callable", v.type_name()), span),
+        }
+    }
+
+    /// Call a function of the scripts from outside of them, as the host does
+    pub fn call_function(
+        &mut self,
+        f: Arc<Function>,
+        arguments: Vec<Value>,
+    ) -> Result<Value, Halt> {
+        let span = f.declaration.name.span.clone();
+        let result = match f.declaration.generator {
+            true => self.call(Value::Function(f), arguments, &span),
+            false => self.enter(f, arguments, vec![], &span, None),
+        };
+        result.map_err(|u| match u {
+            Unwind::Halt(h) => h,
+            // `function` turns the others into errors
+            _ => crate::assert_unreachable!(),
+        })
+    }
+
+    /// Run a call to a function, `call` is where it was called, `None` when
+    /// the host called it, and `span` what errors before it starts point at
+    fn enter(
+        &mut self,
+        f: Arc<Function>,
+        arguments: Vec<Value>,
+        named: Vec<(Arc<str>, Value)>,
+        span: &SourceString,
+        call: Option<&SourceString>,
+    ) -> Eval {
+        let declaration = &f.declaration;
+        let arguments = bound(&f, arguments, named, span)?;
+        let _nested = match limits::enter(&declaration.name.name) {
+            Ok(nested) => nested,
+            Err(msg) => return coded_error(ErrorCode::LimitExceeded, msg, span),
+        };
+        self.frames.push(Frame {
+            function: declaration.name.name.clone(),
+            call: call.unwrap_or(span).clone(),
+        });
+        let result = self.function(f.clone(), arguments);
+        self.frames.pop();
+        result.map_err(|u| match u {
+            Unwind::Halt(Halt::Error(e)) => Unwind::Halt(Halt::Error(
+                e.with_frame(&declaration.name.name, call.cloned()),
+            )),
+            u => u,
+        })
+    }
+
+    /// Run the body of a function, then the code it deferred. Calls in tail
+    /// position take over its frame instead of nesting, unless it deferred
+    /// code, which must run after them. The frames they replace are left out
+    /// of the stack of errors: the function running is shown as called where
+    /// the last tail call was made.
+    fn function(&mut self, f: Arc<Function>, arguments: Vec<Option<Value>>) -> Eval {
+        self.deferred.push(vec![]);
+        let result = self.body(f, arguments);
+        let deferred = self.deferred.pop().expect("pushed above");
+        self.undefer(deferred, result)
+    }
+
+    /// the parameters left out of the call are bound to their defaults, in
+    /// the scope of the parameters before them
+    fn body(&mut self, mut f: Arc<Function>, mut arguments: Vec<Option<Value>>) -> Eval {
+        let mut tail_call = None;
+        loop {
+            let declaration = f.declaration.clone();
+            let env = Environment::child(&f.closure);
+            let defined = (declaration.parameters.iter().zip(arguments)).try_for_each(|(p, a)| {
+                let value = match (a, &p.default) {
+                    (Some(v), _) => v,
+                    (None, Some(default)) => self.expression(default, &env)?,
+                    (None, None) => crate::assert_unreachable!(),
+                };
+                define(&env, &p.pattern, value, p.mutable)
+            });
+            let result = match defined.and_then(|()| self.tail_block(&declaration.body, &env)) {
+                Ok(Tail::Value(v)) => Ok(v),
+                Ok(Tail::Call(Value::Function(g), next, named, at))
+                    if !g.declaration.generator
+                        && self.deferred.last().is_some_and(Vec::is_empty) =>
+                {
+                    match bound(&g, next, named, &at) {
+                        Ok(next) => {
+                            if let Some(frame) = self.frames.last_mut() {
+                                frame.function = g.declaration.name.name.clone();
+                                frame.call = at.clone();
+                            }
+                            profile::replace(&g.declaration.name.name);
+                            trace::replace(&g.declaration.name.name);
+                            f = g;
+                            arguments = next;
+                            tail_call = Some(at);
+                            continue;
+                        }
+                        Err(u) => Err(u),
+                    }
+                }
+                Ok(Tail::Call(callee, arguments, named, at)) => {
+                    self.call_named(callee, arguments, named, &at)
+                }
+                Err(u) => Err(u),
+            };
+            let halt = match result {
+                Ok(v) | Err(Unwind::Return(v, _)) => return Ok(v),
+                Err(Unwind::Break(_, span)) => escaped("break outside of a loop or block", span),
+                Err(Unwind::Continue(span)) => escaped("continue outside of a loop", span),
+                Err(Unwind::Halt(h)) => h,
+            };
+            return Err(Unwind::Halt(match (halt, tail_call) {
+                (Halt::Error(e), Some(at)) => {
+                    Halt::Error(e.with_frame(&declaration.name.name, Some(at)))
+                }
+                (h, _) => h,
+            }));
+        }
+    }
+
+    /// Run the code deferred by a function, last deferred first, whether it
+    /// returned or raised an error. An error raised by the code replaces
+    /// the outcome of the function, `exit` and interrupts skip what is left.
+    fn undefer(&mut self, deferred: Vec<Arc<Function>>, mut result: Eval) -> Eval {
+        for f in deferred.into_iter().rev() {
+            let stopped = match &result {
+                Err(Unwind::Halt(Halt::Exit(_))) => true,
+                Err(Unwind::Halt(Halt::Error(e))) => interrupt::is_interrupt(e),
+                _ => false,
+            };
+            if stopped {
+                break;
+            }
+            let span = f.declaration.span.clone();
+            if let Err(u) = self.enter(f, vec![], vec![], &span, None) {
+                result = Err(u);
+            }
+        }
+        result
+    }
+}
+
+fn check_arity(name: &str, expected: usize, found: usize, span: &SourceString) -> Eval<()> {
+    if expected == found {
+        return Ok(());
+    }
+    coded_error(
+        ErrorCode::ArityMismatch,
+        arity_message(name, Arity::exactly(expected), found),
+        span,
+    )
+}
+
+/// the arguments of a call to a function of the scripts, see `bind_values`
+fn bound(
+    f: &Function,
+    arguments: Vec<Value>,
+    named: Vec<(Arc<str>, Value)>,
+    span: &SourceString,
+) -> Eval<Vec<Option<Value>>> {
+    let declaration = &f.declaration;
+    let names = |i: usize| declaration.parameters[i].name();
+    bind_values(
+        &declaration.name.name,
+        declaration.arity(),
+        arguments,
+        named,
+        names,
+    )
+    .or_else(|msg| coded_error(ErrorCode::ArityMismatch, msg, span))
+}
+
+pub fn arity_message(name: &str, expected: Arity, found: usize) -> String {
+    format!("function '{}' expects {}, found {}", name, expected, found)
+}
+
+pub fn unknown_parameter(function: &str, name: &str) -> String {
+    format!("function '{}' has no parameter named '{}'", function, name)
+}
+
+/// Bind the arguments of a call to the parameters of a function, those
+/// given by name going to the parameter `names` gives that name to. The
+/// argument of each parameter but a variadic one, `None` for those left to
+/// their default, then the arguments given by position past them, or why
+/// the call doesn't match the parameters.
+pub fn bind<'a, T>(
+    function: &str,
+    arity: Arity,
+    mut arguments: Vec<T>,
+    named: Vec<(Arc<str>, T)>,
+    names: impl Fn(usize) -> Option<&'a str>,
+) -> Result<(Vec<Option<T>>, Vec<T>), String> {
+    let fixed = arity.required + arity.optional;
+    let found = arguments.len() + named.len();
+    if arguments.len() > fixed && !arity.variadic {
+        return Err(arity_message(function, arity, found));
+    }
+    let rest = arguments.split_off(arguments.len().min(fixed));
+    let mut bound: Vec<Option<T>> = arguments.into_iter().map(Some).collect();
+    bound.resize_with(fixed, || None);
+    let by_name = !named.is_empty();
+    for (name, value) in named {
+        match (0..arity.parameters()).find(|&i| names(i) == Some(&name)) {
+            Some(i) if i == fixed => {
+                return Err(format!(
+                    "'{}' of function '{}' is variadic, it cannot be given by name",
+                    name, function
+                ))
+            }
+            Some(i) if bound[i].is_some() => {
+                return Err(format!(
+                    "argument '{}' of function '{}' is given twice",
+                    name, function
+                ))
+            }
+            Some(i) => bound[i] = Some(value),
+            None => return Err(unknown_parameter(function, &name)),
+        }
+    }
+    match bound[..arity.required].iter().position(Option::is_none) {
+        Some(i) => Err(match names(i) {
+            Some(name) if by_name => {
+                format!("function '{}' is missing the argument '{}'", function, name)
+            }
+            _ => arity_message(function, arity, found),
+        }),
+        None => Ok((bound, rest)),
+    }
+}
+
+/// `bind` for the values of a call, those of a variadic parameter as a list
+pub fn bind_values<'a>(
+    function: &str,
+    arity: Arity,
+    arguments: Vec<Value>,
+    named: Vec<(Arc<str>, Value)>,
+    names: impl Fn(usize) -> Option<&'a str>,
+) -> Result<Vec<Option<Value>>, String> {
+    let (mut bound, rest) = bind(function, arity, arguments, named, names)?;
+    if arity.variadic {
+        bound.push(Some(Value::list(rest)));
+    }
+    Ok(bound)
+}
+
+/// the error raised by `throw`, errors are thrown again as they are, other
+/// values become the message of a new error
+pub fn thrown(value: Value, span: Option<SourceString>) -> DragonError {
+    match value {
+        Value::Error(e) => (*e).clone(),
+        Value::String(s) => DragonError::runtime(s.to_string(), span),
+        v => DragonError::runtime(
+            format!("can only throw errors and strings, found {}", v.type_name()),
+            span,
+        ),
+    }
+}
+
+/// the status of `exit`, which must fit in the exit status of a process
+pub fn exit_code(value: Value) -> Result<i32, String> {
+    match value {
+        Value::Int(code @ 0..=255) => Ok(code as i32),
+        v @ (Value::Int(_) | Value::BigInt(_)) => {
+            Err(format!("exit code must be between 0 and 255, found {}", v))
+        }
+        v => Err(format!("exit code must be an int, found {}", v.type_name())),
+    }
+}
+
+fn escaped(msg: &str, span: SourceString) -> Halt {
+    Halt::Error(DragonError::runtime(msg.to_string(), Some(span)))
+}
+
+pub fn literal(l: &Literal) -> Value {
+    match l {
+        Literal::None => Value::None,
+        Literal::Bool(b) => Value::Bool(*b),
+        Literal::Int(i) => Value::Int(*i),
+        Literal::Float(x) => Value::Float(*x),
+        Literal::String(s) => Value::String(values::intern(s)),
+        Literal::Symbol(s) => Value::symbol(s),
+        Literal::Bytes(b) => Value::from(b.as_slice()),
+    }
+}
+
+/// Whether the value matches the pattern, the values it binds are pushed in
+/// the order of `Pattern::bindings`. Some may be pushed before finding out
+/// that the value doesn't match.
+pub fn destructure(pattern: &Pattern, value: &Value, bound: &mut Vec<Value>) -> bool {
+    match pattern {
+        Pattern::Wildcard(_) => true,
+        Pattern::Literal(l) => literal(&l.value) == *value,
+        Pattern::Binding(_) => {
+            bound.push(value.clone());
+            true
+        }
+        Pattern::List(l) => {
+            let Value::List(items) = value else {
+                return false;
+            };
+            let items = items.read().unwrap_or_else(|e| e.into_inner());
+            let (before, after) = l.split();
+            let fits = match l.rest {
+                Some(_) => items.len() >= before.len() + after.len(),
+                None => items.len() == before.len(),
+            };
+            if !fits {
+                return false;
+            }
+            let tail = items.len() - after.len();
+            if !before
+                .iter()
+                .zip(items.iter())
+                .all(|(p, v)| destructure(p, v, bound))
+            {
+                return false;
+            }
+            if let Some(Rest {
+                binding: Some(_), ..
+            }) = l.rest
+            {
+                bound.push(Value::list(items[before.len()..tail].to_vec()));
+            }
+            after
+                .iter()
+                .zip(items[tail..].iter())
+                .all(|(p, v)| destructure(p, v, bound))
+        }
+        Pattern::Map(m) => {
+            let Value::Map(entries) = value else {
+                return false;
+            };
+            let entries = entries.read().unwrap_or_else(|e| e.into_inner());
+            m.entries.iter().all(|(k, p)| {
+                let Ok(key) = Key::try_from(&literal(&k.value)) else {
+                    return false;
+                };
+                entries.get(&key).is_some_and(|v| destructure(p, v, bound))
+            })
+        }
+        Pattern::Variant(v) => {
+            let Value::Instance(i) = value else {
+                return false;
+            };
+            if !i.of.is_variant() || i.of.name != v.variant() {
+                return false;
+            }
+            let Some(patterns) = &v.fields else {
+                return true;
+            };
+            let fields = i.fields();
+            patterns.len() == fields.len()
+                && patterns
+                    .iter()
+                    .zip(fields.iter())
+                    .all(|(p, v)| destructure(p, v, bound))
+        }
+    }
+}
+
+/// the error when no arm of a `match` matches its subject
+pub fn unmatched(subject: &Value) -> String {
+    format!("no arm of the match matches {}", subject.repr())
+}
+
+/// define the names of the pattern, bound to the parts of the value they
+/// match, raising an error if it doesn't match
+fn define(env: &Env, pattern: &Pattern, value: Value, mutable: bool) -> Eval<()> {
+    if let Pattern::Binding(name) = pattern {
+        env.define(&name.name, value, mutable);
+        return Ok(());
+    }
+    let mut bound = vec![];
+    if !destructure(pattern, &value, &mut bound) {
+        return error(undestructured(pattern, &value), &pattern.span());
+    }
+    for (name, value) in pattern.bindings().into_iter().zip(bound) {
+        env.define(&name.name, value, mutable);
+    }
+    Ok(())
+}
+
+/// the error when a value doesn't match the pattern declaring its parts
+pub fn undestructured(pattern: &Pattern, value: &Value) -> String {
+    format!("{} does not match {}", value.repr(), pattern.written())
+}
@@ -0,0 +1,776 @@
+use std::{
+    sync::{Arc, OnceLock},
+    time::Duration,
+};
+
+use itertools::Itertools;
+
+use crate::{
+    modules::Module,
+    values::{self, Builtin, Channel, Iter, Key, Map, Task, Value},
+};
+
+use super::{
+    deterministic, interrupt, io, limits,
+    sandbox::{self, Capability},
+    Env, Halt,
+};
+
+mod bytes;
+mod errors;
+pub mod fs;
+mod http;
+mod json;
+pub mod logging;
+mod math;
+mod os;
+mod random;
+mod regex;
+pub mod snapshots;
+pub mod strings;
+pub mod sync;
+mod time;
+
+pub const BUILTINS: &[Builtin] = &[
+    Builtin {
+        name: "assert",
+        arity: None,
+        function: assert,
+        parameters: "condition, message = none",
+        doc: "fails unless the condition is truthy",
+    },
+    Builtin {
+        name: "assert_eq",
+        arity: None,
+        function: assert_eq,
+        parameters: "actual, expected, message = none",
+        doc: "fails unless the values are equal, showing both",
+    },
+    Builtin {
+        name: "assert_raises",
+        arity: Some(1),
+        function: assert_raises,
+        parameters: "function",
+        doc: "calls the function, fails unless it raises an error, and returns the error",
+    },
+    Builtin {
+        name: "expect_snapshot",
+        arity: Some(2),
+        function: snapshots::expect,
+        parameters: "name, value",
+        doc: "compares the value with the snapshot stored under the name for the test file, `drgns test --update` writes it instead",
+    },
+    Builtin {
+        name: "await",
+        arity: Some(1),
+        function: await_task,
+        parameters: "task",
+        doc: "what the task returned, once it finishes, raising the error it stopped with",
+    },
+    Builtin {
+        name: "byte_len",
+        arity: Some(1),
+        function: byte_len,
+        parameters: "s",
+        doc: "the number of bytes of a string in UTF-8, where `len` counts its characters",
+    },
+    Builtin {
+        name: "chan",
+        arity: None,
+        function: chan,
+        parameters: "capacity = 0",
+        doc: "a new channel holding up to `capacity` items",
+    },
+    Builtin {
+        name: "close",
+        arity: Some(1),
+        function: close,
+        parameters: "channel",
+        doc: "closes the channel, receivers get `^done` once it is empty",
+    },
+    Builtin {
+        name: "done",
+        arity: Some(1),
+        function: done,
+        parameters: "task",
+        doc: "whether the task has finished, without waiting for it",
+    },
+    Builtin {
+        name: "env",
+        arity: None,
+        function: env,
+        parameters: "name = none",
+        doc: "the value of an environment variable, or `none` if it is not set, without a name the sorted names of all of them",
+    },
+    Builtin {
+        name: "enumerate",
+        arity: Some(1),
+        function: enumerate,
+        parameters: "items",
+        doc: "an iterator over `[index, item]` pairs of anything a `for` loop can go through",
+    },
+    Builtin {
+        name: "delete",
+        arity: Some(2),
+        function: delete,
+        parameters: "map, key",
+        doc: "removes a key from a map, returns its value, or `none` if it was missing",
+    },
+    Builtin {
+        name: "inspect",
+        arity: Some(1),
+        function: inspect,
+        parameters: "value",
+        doc: "the value as the REPL shows it, strings are quoted and containers spread over lines",
+    },
+    Builtin {
+        name: "keys",
+        arity: Some(1),
+        function: keys,
+        parameters: "map",
+        doc: "the keys of a map as a list, in insertion order",
+    },
+    Builtin {
+        name: "len",
+        arity: Some(1),
+        function: len,
+        parameters: "value",
+        doc: "the number of items of a list or entries of a map, of characters of a string or a string builder, or of bytes",
+    },
+    Builtin {
+        name: "merge",
+        arity: None,
+        function: merge,
+        parameters: "..maps",
+        doc: "a new map with the entries of all the maps, later maps take precedence",
+    },
+    Builtin {
+        name: "pop",
+        arity: Some(1),
+        function: pop,
+        parameters: "list",
+        doc: "removes the last item of a list and returns it",
+    },
+    Builtin {
+        name: "print",
+        arity: None,
+        function: print,
+        parameters: "..values",
+        doc: "prints the values separated by spaces, followed by a newline",
+    },
+    Builtin {
+        name: "print!",
+        arity: None,
+        function: print,
+        parameters: "..values",
+        doc: "prints the values separated by spaces, followed by a newline",
+    },
+    Builtin {
+        name: "push",
+        arity: Some(2),
+        function: push,
+        parameters: "target, item",
+        doc: "adds an item at the end of a list, or a string at the end of a string builder, in place",
+    },
+    Builtin {
+        name: "range",
+        arity: None,
+        function: range,
+        parameters: "start = 0, end, step = 1",
+        doc: "an iterator over the ints from `start` up to but not including `end`, `range(end)` starts at 0",
+    },
+    Builtin {
+        name: "recv",
+        arity: Some(1),
+        function: recv,
+        parameters: "channel",
+        doc: "the next item of a channel, waiting for one, `^done` once it is closed and empty",
+    },
+    Builtin {
+        name: "result",
+        arity: Some(1),
+        function: result,
+        parameters: "task",
+        doc: "what the task returned, or the error it stopped with as a value, once it finishes",
+    },
+    Builtin {
+        name: "select",
+        arity: None,
+        function: select,
+        parameters: "channels, timeout = none",
+        doc: "waits for the first of a list of channels to have an item, returns `[index, item]`, or `none` once the timeout in seconds passes",
+    },
+    Builtin {
+        name: "send",
+        arity: Some(2),
+        function: send,
+        parameters: "channel, item",
+        doc: "sends an item along a channel, waiting for room in it",
+    },
+    Builtin {
+        name: "try_recv",
+        arity: Some(1),
+        function: try_recv,
+        parameters: "channel",
+        doc: "the next item of a channel without waiting, `^empty` if there is none",
+    },
+    Builtin {
+        name: "try_send",
+        arity: Some(2),
+        function: try_send,
+        parameters: "channel, item",
+        doc: "sends an item if it can be without waiting, returns whether it was sent",
+    },
+    Builtin {
+        name: "values",
+        arity: Some(1),
+        function: values,
+        parameters: "map",
+        doc: "the values of a map as a list, in the order of their keys",
+    },
+];
+
+/// The name of a module implemented by the interpreter, its functions, its
+/// constants and what it is for
+pub type NativeModule = (
+    &'static str,
+    &'static [Builtin],
+    &'static [(&'static str, f64)],
+    &'static str,
+);
+
+/// Modules implemented by the interpreter, they are always in scope
+pub const MODULES: &[NativeModule] = &[
+    (
+        "bytes",
+        bytes::FUNCTIONS,
+        &[],
+        "converting binary data to and from text",
+    ),
+    (
+        "errors",
+        errors::FUNCTIONS,
+        &[],
+        "inspects the errors caught by `try`",
+    ),
+    ("fs", fs::FUNCTIONS, &[], "access to files and directories"),
+    ("http", http::FUNCTIONS, &[], "a client for HTTP and HTTPS"),
+    ("json", json::FUNCTIONS, &[], "reads and writes JSON text"),
+    (
+        "log",
+        logging::FUNCTIONS,
+        &[],
+        "messages for whoever runs a script about what it does",
+    ),
+    (
+        "math",
+        math::FUNCTIONS,
+        math::CONSTANTS,
+        "functions on numbers",
+    ),
+    (
+        "os",
+        os::FUNCTIONS,
+        &[],
+        "processes and the system the script runs on",
+    ),
+    ("random", random::FUNCTIONS, &[], "random numbers and picks"),
+    ("regex", regex::FUNCTIONS, &[], "regular expressions"),
+    ("strings", strings::FUNCTIONS, &[], "common text operations"),
+    (
+        "sync",
+        sync::FUNCTIONS,
+        &[],
+        "for tasks sharing values to coordinate",
+    ),
+    (
+        "time",
+        time::FUNCTIONS,
+        time::CONSTANTS,
+        "clocks, dates and durations",
+    ),
+];
+
+/// Builtins that are values rather than functions
+pub const VARIABLES: &[&str] = &["args"];
+
+/// the arguments passed to the script, set once at startup
+static ARGS: OnceLock<Vec<String>> = OnceLock::new();
+
+type Output = Box<dyn Fn(&str) + Send + Sync>;
+
+/// where `print` writes its lines without an `Io` for the thread, the
+/// standard output if it isn't set
+static OUTPUT: OnceLock<Output> = OnceLock::new();
+
+/// Send the lines written by `print` somewhere else than the standard
+/// output, such as to an editor, only the first call has an effect
+pub fn set_output(output: impl Fn(&str) + Send + Sync + 'static) {
+    if OUTPUT.set(Box::new(output)).is_err() {
+        log::warn!("the output of scripts was already set");
+    }
+}
+
+/// where the `log` module writes its lines without an `Io` for the thread,
+/// the standard error if it isn't set
+static LOG_OUTPUT: OnceLock<Output> = OnceLock::new();
+
+/// Send the lines written by the `log` module somewhere else than the
+/// standard error, only the first call has an effect
+pub fn set_log_output(output: impl Fn(&str) + Send + Sync + 'static) {
+    if LOG_OUTPUT.set(Box::new(output)).is_err() {
+        log::warn!("the log output of scripts was already set");
+    }
+}
+
+/// Set the `args` seen by every script, only the first call has an effect,
+/// so it must happen before any interpreter is created
+pub fn set_args(args: Vec<String>) {
+    if ARGS.set(args).is_err() {
+        log::warn!("the script arguments were already set");
+    }
+}
+
+/// Make each run of a script the same as the last, for test suites and
+/// cached builds: the random generator starts from the same seed, the clocks
+/// start at the Unix epoch and only move as scripts sleep, and the local
+/// time zone is UTC. It holds for every script from then on, and each call
+/// starts the generator and the clocks over, as in a new run, see
+/// `deterministic`.
+pub fn set_deterministic() {
+    deterministic::start_process();
+}
+
+/// define all builtin functions and modules in the given environment
+pub fn register(env: &Env) {
+    let args = ARGS.get().map_or(&[][..], |a| a.as_slice());
+    let args = Value::list(args.iter().map(|a| Value::from(a.as_str())).collect());
+    env.define("args", args, false);
+    for b in BUILTINS {
+        env.define(b.name, Value::Builtin(b), false);
+    }
+    for (name, functions, constants, _) in MODULES {
+        let module = Module::native(name, functions, constants);
+        env.define(name, Value::Module(Arc::new(module)), false);
+    }
+}
+
+/// the argument at the given index, which must be a string
+fn string<'a>(function: &str, args: &'a [Value], i: usize) -> Result<&'a str, String> {
+    match &args[i] {
+        Value::String(s) => Ok(s),
+        v => Err(argument_error(function, "a string", i, v)),
+    }
+}
+
+/// the argument at the given index, which must be bytes
+fn bytes<'a>(function: &str, args: &'a [Value], i: usize) -> Result<&'a [u8], String> {
+    match &args[i] {
+        Value::Bytes(b) => Ok(b),
+        v => Err(argument_error(function, "bytes", i, v)),
+    }
+}
+
+fn int(function: &str, args: &[Value], i: usize) -> Result<i64, String> {
+    match &args[i] {
+        Value::Int(n) => Ok(*n),
+        v => Err(argument_error(function, "an int of at most 64 bits", i, v)),
+    }
+}
+
+/// the argument at the given index as a float, which must be a number
+fn number(function: &str, args: &[Value], i: usize) -> Result<f64, String> {
+    match &args[i] {
+        Value::Int(n) => Ok(*n as f64),
+        Value::BigInt(n) => Ok(n.to_f64()),
+        Value::Float(x) => Ok(*x),
+        v => Err(argument_error(function, "a number", i, v)),
+    }
+}
+
+/// the required arguments, and optionally one more
+fn check_count(function: &str, args: &[Value], required: usize) -> Result<(), String> {
+    match args.len() == required || args.len() == required + 1 {
+        true => Ok(()),
+        false => Err(format!(
+            "{} expects {} or {} arguments, found {}",
+            function,
+            required,
+            required + 1,
+            args.len()
+        )),
+    }
+}
+
+fn argument_error(function: &str, expected: &str, i: usize, found: &Value) -> String {
+    format!(
+        "{} expects {} as argument {}, found {}",
+        function,
+        expected,
+        i + 1,
+        found.type_name()
+    )
+}
+
+/// print the arguments separated by spaces, followed by a newline
+fn print(args: &[Value]) -> Result<Value, String> {
+    let line = args.iter().join(" ");
+    match (io::current(), OUTPUT.get()) {
+        (Some(io), _) => io.print(&line),
+        (None, Some(output)) => output(&line),
+        (None, None) => println!("{}", line),
+    }
+    Ok(Value::None)
+}
+
+/// the value as the REPL shows it, strings are quoted, and containers are
+/// spread over lines when they don't fit on one
+fn inspect(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(args[0].inspect().as_str()))
+}
+
+/// `env(name)` is the value of an environment variable, or `none` if it is
+/// not set, `env()` lists the names of all of them, sorted
+fn env(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("env", Capability::Env)?;
+    match args.len() {
+        0 => {
+            let mut names: Vec<String> = std::env::vars_os()
+                .map(|(k, _)| k.to_string_lossy().into_owned())
+                .collect();
+            names.sort();
+            Ok(Value::list(
+                names.iter().map(|n| Value::from(n.as_str())).collect(),
+            ))
+        }
+        1 => {
+            let name = string("env", args, 0)?;
+            Ok(std::env::var_os(name)
+                .map_or(Value::None, |v| Value::from(v.to_string_lossy().as_ref())))
+        }
+        n => Err(format!("env expects 0 or 1 arguments, found {}", n)),
+    }
+}
+
+/// the number of items of a list or entries of a map, of characters of a
+/// string or a string builder, or of bytes
+fn len(args: &[Value]) -> Result<Value, String> {
+    let len = match &args[0] {
+        Value::List(l) => l.read().unwrap_or_else(|e| e.into_inner()).len(),
+        Value::Map(m) => m.read().unwrap_or_else(|e| e.into_inner()).len(),
+        Value::String(s) => s.chars().count(),
+        Value::Bytes(b) => b.len(),
+        Value::StringBuilder(b) => b.text().chars().count(),
+        v => {
+            return Err(argument_error(
+                "len",
+                "a list, a map, a string, bytes or a string builder",
+                0,
+                v,
+            ))
+        }
+    };
+    Ok(Value::Int(len as i64))
+}
+
+/// the number of bytes of a string in UTF-8, where `len` counts its
+/// characters
+fn byte_len(args: &[Value]) -> Result<Value, String> {
+    let s = string("byte_len", args, 0)?;
+    Ok(Value::Int(s.len() as i64))
+}
+
+/// add an item at the end of a list, or a string at the end of a string
+/// builder, in place
+fn push(args: &[Value]) -> Result<Value, String> {
+    match &args[0] {
+        Value::List(l) => {
+            let mut items = l.write().unwrap_or_else(|e| e.into_inner());
+            items.push(args[1].clone());
+            limits::allocate(1);
+        }
+        Value::StringBuilder(b) => {
+            let text = string("push", args, 1)?;
+            b.text().push_str(text);
+            limits::allocate(limits::string_values(text.len()));
+        }
+        v => return Err(argument_error("push", "a list or a string builder", 0, v)),
+    }
+    Ok(Value::None)
+}
+
+/// remove the last item of a list and return it
+fn pop(args: &[Value]) -> Result<Value, String> {
+    let Value::List(l) = &args[0] else {
+        return Err(argument_error("pop", "a list", 0, &args[0]));
+    };
+    let mut items = l.write().unwrap_or_else(|e| e.into_inner());
+    items
+        .pop()
+        .ok_or_else(|| "pop expects a list that is not empty".to_string())
+}
+
+fn map<'a>(function: &str, args: &'a [Value], i: usize) -> Result<&'a Map, String> {
+    match &args[i] {
+        Value::Map(m) => Ok(m),
+        v => Err(argument_error(function, "a map", i, v)),
+    }
+}
+
+/// the keys of a map as a list, in insertion order
+fn keys(args: &[Value]) -> Result<Value, String> {
+    let entries = map("keys", args, 0)?
+        .read()
+        .unwrap_or_else(|e| e.into_inner());
+    Ok(Value::list(
+        entries.keys().map(|k| Value::from(k.clone())).collect(),
+    ))
+}
+
+/// the values of a map as a list, in the order of their keys
+fn values(args: &[Value]) -> Result<Value, String> {
+    let entries = map("values", args, 0)?
+        .read()
+        .unwrap_or_else(|e| e.into_inner());
+    Ok(Value::list(entries.values().cloned().collect()))
+}
+
+/// a new map with the entries of all the maps, later maps take precedence
+fn merge(args: &[Value]) -> Result<Value, String> {
+    if args.is_empty() {
+        return Err("merge expects at least 1 argument, found 0".to_string());
+    }
+    let mut merged = indexmap::IndexMap::new();
+    for i in 0..args.len() {
+        let entries = map("merge", args, i)?
+            .read()
+            .unwrap_or_else(|e| e.into_inner());
+        merged.extend(entries.iter().map(|(k, v)| (k.clone(), v.clone())));
+    }
+    Ok(Value::map(merged))
+}
+
+/// remove a key from a map, returns its value, or `none` if it was missing
+fn delete(args: &[Value]) -> Result<Value, String> {
+    let key = Key::try_from(&args[1])?;
+    let mut entries = map("delete", args, 0)?
+        .write()
+        .unwrap_or_else(|e| e.into_inner());
+    Ok(entries.shift_remove(&key).unwrap_or(Value::None))
+}
+
+/// `range(end)`, `range(start, end)` or `range(start, end, step)`, an
+/// iterator over the ints from `start`, or 0, up to but not including `end`
+fn range(args: &[Value]) -> Result<Value, String> {
+    if args.is_empty() || args.len() > 3 {
+        return Err(format!(
+            "range expects 1 to 3 arguments, found {}",
+            args.len()
+        ));
+    }
+    let ints = (0..args.len())
+        .map(|i| int("range", args, i))
+        .collect::<Result<Vec<i64>, String>>()?;
+    let (start, end, step) = match ints[..] {
+        [end] => (0, end, 1),
+        [start, end] => (start, end, 1),
+        [start, end, step, ..] => (start, end, step),
+        [] => crate::assert_unreachable!(),
+    };
+    Ok(Value::Iterator(Iter::range(start, end, step)?))
+}
+
+/// an iterator over `[index, item]` pairs of the items of anything a `for`
+/// loop can go through
+fn enumerate(args: &[Value]) -> Result<Value, String> {
+    let items = values::iterable(args[0].clone())
+        .map_err(|_| argument_error("enumerate", "something to iterate over", 0, &args[0]))?;
+    Ok(Value::Iterator(Iter::enumerate(items)))
+}
+
+fn task<'a>(function: &str, args: &'a [Value], i: usize) -> Result<&'a Arc<Task>, String> {
+    match &args[i] {
+        Value::Task(t) => Ok(t),
+        v => Err(argument_error(function, "a task", i, v)),
+    }
+}
+
+/// `assert(condition)` or `assert(condition, message)`, fails unless the
+/// condition is truthy
+fn assert(args: &[Value]) -> Result<Value, String> {
+    check_count("assert", args, 1)?;
+    match (args[0].is_truthy(), args.get(1)) {
+        (true, _) => Ok(Value::None),
+        (false, None) => Err("assertion failed".to_string()),
+        (false, Some(message)) => Err(format!("assertion failed: {}", message)),
+    }
+}
+
+/// `assert_eq(actual, expected)` or `assert_eq(actual, expected, message)`
+fn assert_eq(args: &[Value]) -> Result<Value, String> {
+    assert_equal(args, None)
+}
+
+/// Fail `assert_eq` unless its values are equal. The engines call this with
+/// whether they are when the first overloads `eq`, `None` compares them as
+/// `==` does otherwise.
+pub fn assert_equal(args: &[Value], equal: Option<bool>) -> Result<Value, String> {
+    check_count("assert_eq", args, 2)?;
+    let (actual, expected) = (&args[0], &args[1]);
+    if equal.unwrap_or_else(|| actual == expected) {
+        return Ok(Value::None);
+    }
+    let found = format!("expected {}, found {}", expected.repr(), actual.repr());
+    Err(match args.get(2) {
+        Some(message) => format!("assertion failed: {}, {}", message, found),
+        None => format!("assertion failed: {}", found),
+    })
+}
+
+/// the engines call the function given to `assert_raises` themselves
+fn assert_raises(args: &[Value]) -> Result<Value, String> {
+    Err(format!(
+        "assert_raises cannot call {} here",
+        args[0].type_name()
+    ))
+}
+
+/// What `assert_raises` returns once the engine called its function: the
+/// error it raised, as a value. It fails if the function raised none, and
+/// the stops an error doesn't cover, an interrupt or `exit`, go through.
+pub fn raised(outcome: Result<Value, Halt>) -> Result<Result<Value, Halt>, String> {
+    match outcome {
+        Ok(v) => Err(format!(
+            "assertion failed: expected an error, the function returned {}",
+            v.repr()
+        )),
+        Err(Halt::Error(e)) if !interrupt::is_interrupt(&e) => Ok(Ok(Value::Error(Arc::new(e)))),
+        outcome => Ok(outcome),
+    }
+}
+
+/// Wait for the task given to `await` or `result` to finish. The engines
+/// call this rather than the builtins, so that the error the task stopped
+/// with is raised again as it was, with its own code and calls, and so that
+/// a task that ran `exit` stops the program once it is awaited.
+pub fn awaited(function: &str, args: &[Value]) -> Result<Result<Value, Halt>, String> {
+    let outcome = task(function, args, 0)?.join();
+    Ok(match (function, outcome) {
+        ("result", Err(Halt::Error(e))) if !interrupt::is_interrupt(&e) => {
+            Ok(Value::Error(Arc::new(e)))
+        }
+        (_, outcome) => outcome,
+    })
+}
+
+fn joined(function: &str, args: &[Value]) -> Result<Value, String> {
+    awaited(function, args)?.map_err(|h| match h {
+        Halt::Error(e) => e.message().to_string(),
+        Halt::Exit(code) => format!("the task exited with code {}", code),
+    })
+}
+
+/// what the task returned, once it finishes
+fn await_task(args: &[Value]) -> Result<Value, String> {
+    joined("await", args)
+}
+
+/// what the task returned, or the error it stopped with as a value rather
+/// than raised, once it finishes
+fn result(args: &[Value]) -> Result<Value, String> {
+    joined("result", args)
+}
+
+/// whether the task has finished, without waiting for it
+fn done(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::Bool(task("done", args, 0)?.is_done()))
+}
+
+fn channel<'a>(function: &str, args: &'a [Value], i: usize) -> Result<&'a Arc<Channel>, String> {
+    match &args[i] {
+        Value::Channel(c) => Ok(c),
+        v => Err(argument_error(function, "a channel", i, v)),
+    }
+}
+
+/// `chan()` or `chan(capacity)`, a new channel holding up to `capacity`
+/// items, 0 by default
+fn chan(args: &[Value]) -> Result<Value, String> {
+    check_count("chan", args, 0)?;
+    let capacity = match args.first() {
+        Some(_) => int("chan", args, 0)?,
+        None => 0,
+    };
+    let capacity = usize::try_from(capacity)
+        .map_err(|_| format!("chan expects a capacity of at least 0, found {}", capacity))?;
+    Ok(Value::Channel(Channel::new(capacity)))
+}
+
+/// send an item along a channel, waiting for room in it, or for a receiver
+/// to take it if the channel has no capacity
+fn send(args: &[Value]) -> Result<Value, String> {
+    channel("send", args, 0)?.send(args[1].clone())?;
+    Ok(Value::None)
+}
+
+/// send an item if it can be without waiting, returns whether it was sent
+fn try_send(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::Bool(
+        channel("try_send", args, 0)?.try_send(args[1].clone())?,
+    ))
+}
+
+/// the next item of a channel, waiting for one, `^done` once it is closed
+/// and empty
+fn recv(args: &[Value]) -> Result<Value, String> {
+    Ok(channel("recv", args, 0)?.recv())
+}
+
+/// the next item of a channel without waiting, `^empty` if there is none
+fn try_recv(args: &[Value]) -> Result<Value, String> {
+    Ok(channel("try_recv", args, 0)?.try_recv())
+}
+
+fn close(args: &[Value]) -> Result<Value, String> {
+    channel("close", args, 0)?.close()?;
+    Ok(Value::None)
+}
+
+/// `select(channels)` or `select(channels, timeout)`, waits for the first of
+/// a list of channels to have an item, and returns `[index, item]`, or
+/// `none` once the timeout in seconds passes
+fn select(args: &[Value]) -> Result<Value, String> {
+    check_count("select", args, 1)?;
+    let Value::List(l) = &args[0] else {
+        return Err(argument_error("select", "a list of channels", 0, &args[0]));
+    };
+    let channels = l
+        .read()
+        .unwrap_or_else(|e| e.into_inner())
+        .iter()
+        .map(|c| match c {
+            Value::Channel(c) => Ok(c.clone()),
+            v => Err(format!(
+                "select expects a list of channels, found {} in it",
+                v.type_name()
+            )),
+        })
+        .collect::<Result<Vec<_>, _>>()?;
+    if channels.is_empty() {
+        return Err("select expects at least one channel".to_string());
+    }
+    let timeout = match args.get(1) {
+        Some(_) => {
+            let seconds = number("select", args, 1)?;
+            Some(
+                Duration::try_from_secs_f64(seconds)
+                    .map_err(|_| format!("select cannot wait for {} seconds", seconds))?,
+            )
+        }
+        None => None,
+    };
+    Ok(match values::select(&channels, timeout) {
+        Some((i, item)) => Value::list(vec![Value::Int(i as i64), item]),
+        None => Value::None,
+    })
+}
@@ -0,0 +1,168 @@
+//! The `bytes` module, converting binary data to and from text.
+//!
+//! The encodings are `"utf-8"`, the default, `"hex"` and `"base64"`.
+//! `bytes::encode` makes the bytes that a text stands for in the encoding,
+//! and `bytes::decode` writes bytes as text in it: in UTF-8 the text is made
+//! of the characters the bytes encode, in hex and base64 it spells out the
+//! bytes themselves.
+
+use crate::values::{Builtin, Value};
+
+use super::{argument_error, bytes, check_count, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "decode",
+        arity: None,
+        function: decode,
+        parameters: "b, encoding = \"utf-8\"",
+        doc: "the bytes written as text in `\"utf-8\"`, `\"hex\"` or `\"base64\"`",
+    },
+    Builtin {
+        name: "encode",
+        arity: None,
+        function: encode,
+        parameters: "text, encoding = \"utf-8\"",
+        doc: "the bytes the text stands for in `\"utf-8\"`, `\"hex\"` or `\"base64\"`",
+    },
+    Builtin {
+        name: "of",
+        arity: Some(1),
+        function: of,
+        parameters: "ints",
+        doc: "the bytes with the values of a list of ints from 0 to 255",
+    },
+];
+
+const BASE64: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+#[derive(Clone, Copy)]
+enum Encoding {
+    Utf8,
+    Hex,
+    Base64,
+}
+
+/// the encoding given after the `required` arguments, or UTF-8
+fn encoding(function: &str, args: &[Value], required: usize) -> Result<Encoding, String> {
+    check_count(function, args, required)?;
+    if args.len() == required {
+        return Ok(Encoding::Utf8);
+    }
+    match string(function, args, required)? {
+        "utf-8" => Ok(Encoding::Utf8),
+        "hex" => Ok(Encoding::Hex),
+        "base64" => Ok(Encoding::Base64),
+        e => Err(format!(
+            "{} expects the encoding \"utf-8\", \"hex\" or \"base64\", found {:?}",
+            function, e
+        )),
+    }
+}
+
+/// `bytes::encode(text, encoding)`, the bytes the text stands for
+fn encode(args: &[Value]) -> Result<Value, String> {
+    let encoding = encoding("bytes::encode", args, 1)?;
+    let text = string("bytes::encode", args, 0)?;
+    let b = match encoding {
+        Encoding::Utf8 => text.as_bytes().to_vec(),
+        Encoding::Hex => from_hex(text)?,
+        Encoding::Base64 => from_base64(text)?,
+    };
+    Ok(Value::from(b.as_slice()))
+}
+
+/// `bytes::decode(b, encoding)`, the bytes written as text
+fn decode(args: &[Value]) -> Result<Value, String> {
+    let encoding = encoding("bytes::decode", args, 1)?;
+    let b = bytes("bytes::decode", args, 0)?;
+    let text = match encoding {
+        Encoding::Utf8 => match std::str::from_utf8(b) {
+            Ok(text) => text.to_owned(),
+            Err(e) => {
+                return Err(format!(
+                    "the bytes are not valid UTF-8 text, from byte {}",
+                    e.valid_up_to()
+                ))
+            }
+        },
+        Encoding::Hex => b.iter().map(|b| format!("{:02x}", b)).collect(),
+        Encoding::Base64 => to_base64(b),
+    };
+    Ok(Value::from(text.as_str()))
+}
+
+/// `bytes::of(ints)`, the bytes with the values of a list of ints
+fn of(args: &[Value]) -> Result<Value, String> {
+    let Value::List(l) = &args[0] else {
+        return Err(argument_error("bytes::of", "a list", 0, &args[0]));
+    };
+    let items = l.read().unwrap_or_else(|e| e.into_inner());
+    let b = items
+        .iter()
+        .map(|item| match item {
+            Value::Int(i) => u8::try_from(*i).ok(),
+            _ => None,
+        })
+        .collect::<Option<Vec<u8>>>()
+        .ok_or_else(|| "bytes::of expects ints from 0 to 255".to_string())?;
+    Ok(Value::from(b.as_slice()))
+}
+
+fn from_hex(text: &str) -> Result<Vec<u8>, String> {
+    let digits = text.as_bytes();
+    if digits.len() % 2 == 1 {
+        return Err("hex text must have an even number of digits".to_string());
+    }
+    digits
+        .chunks(2)
+        .map(|pair| {
+            let digit = |d: u8| (d as char).to_digit(16);
+            match (digit(pair[0]), digit(pair[1])) {
+                (Some(high), Some(low)) => Ok((high * 16 + low) as u8),
+                _ => Err(format!(
+                    "invalid hex digits {:?}",
+                    String::from_utf8_lossy(pair)
+                )),
+            }
+        })
+        .collect()
+}
+
+/// base64 with padding, as in RFC 4648
+fn to_base64(b: &[u8]) -> String {
+    let mut text = String::with_capacity(b.len().div_ceil(3) * 4);
+    for chunk in b.chunks(3) {
+        let n = chunk
+            .iter()
+            .enumerate()
+            .fold(0u32, |n, (i, &b)| n | ((b as u32) << (16 - 8 * i)));
+        for i in 0..4 {
+            match i <= chunk.len() {
+                true => text.push(BASE64[((n >> (18 - 6 * i)) & 63) as usize] as char),
+                false => text.push('='),
+            }
+        }
+    }
+    text
+}
+
+/// the padding may be left out
+fn from_base64(text: &str) -> Result<Vec<u8>, String> {
+    let digits = text.trim_end_matches('=').as_bytes();
+    if digits.len() % 4 == 1 || text.len() - digits.len() > 2 {
+        return Err("invalid length of base64 text".to_string());
+    }
+    let mut b = Vec::with_capacity(digits.len() * 3 / 4);
+    for chunk in digits.chunks(4) {
+        let mut n = 0u32;
+        for (i, &d) in chunk.iter().enumerate() {
+            let Some(value) = BASE64.iter().position(|&c| c == d) else {
+                return Err(format!("invalid base64 digit {:?}", d as char));
+            };
+            n |= (value as u32) << (18 - 6 * i);
+        }
+        b.extend(n.to_be_bytes()[1..chunk.len()].iter());
+    }
+    Ok(b)
+}
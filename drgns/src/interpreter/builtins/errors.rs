@@ -0,0 +1,66 @@
+//! The `errors` module, inspects the errors caught by `try`.
+
+use crate::{
+    eh::DragonError,
+    values::{Builtin, Value},
+};
+
+use super::argument_error;
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "code",
+        arity: Some(1),
+        function: code,
+        parameters: "error",
+        doc: "the code of the error, such as `\"E04001\"`",
+    },
+    Builtin {
+        name: "message",
+        arity: Some(1),
+        function: message,
+        parameters: "error",
+        doc: "the message of the error, without its location",
+    },
+    Builtin {
+        name: "trace",
+        arity: Some(1),
+        function: trace,
+        parameters: "error",
+        doc: "the calls the error propagated out of, innermost first",
+    },
+];
+
+fn error<'a>(function: &str, args: &'a [Value]) -> Result<&'a DragonError, String> {
+    match &args[0] {
+        Value::Error(e) => Ok(e),
+        v => Err(argument_error(function, "an error", 0, v)),
+    }
+}
+
+fn message(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(error("errors::message", args)?.message()))
+}
+
+/// the code of the error, such as `"E04001"`
+fn code(args: &[Value]) -> Result<Value, String> {
+    let code = error("errors::code", args)?.code();
+    Ok(Value::from(code.to_string().as_str()))
+}
+
+/// the calls the error propagated out of, innermost first, such as
+/// `"'f' called at main.drgns:3:1"`
+fn trace(args: &[Value]) -> Result<Value, String> {
+    let frames = error("errors::trace", args)?
+        .trace()
+        .iter()
+        .map(|f| {
+            let frame = match &f.call {
+                Some(call) => format!("'{}' called at {}", f.function, call.location()),
+                None => format!("'{}'", f.function),
+            };
+            Value::from(frame.as_str())
+        })
+        .collect();
+    Ok(Value::list(frames))
+}
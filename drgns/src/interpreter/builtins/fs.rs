@@ -0,0 +1,278 @@
+//! The `fs` module, access to files and directories.
+//!
+//! Functions taking a file accept either a file opened with `fs::open` or a
+//! path, in which case the file is opened just for the call. Failures are
+//! reported as run-time errors, never as crashes of the interpreter.
+
+use std::{
+    fs::OpenOptions,
+    io::{self, Read, Write},
+    path::PathBuf,
+    sync::{Arc, Mutex},
+};
+
+use crate::{
+    interpreter::sandbox::{self, Capability},
+    values::{Builtin, Value},
+};
+
+use super::{argument_error, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "append",
+        arity: Some(2),
+        function: append,
+        parameters: "file, data",
+        doc: "writes at the end of a file, creating it if need be",
+    },
+    Builtin {
+        name: "close",
+        arity: Some(1),
+        function: close,
+        parameters: "file",
+        doc: "closes a file opened with `fs::open`",
+    },
+    Builtin {
+        name: "exists",
+        arity: Some(1),
+        function: exists,
+        parameters: "path",
+        doc: "whether there is a file or a directory at the path",
+    },
+    Builtin {
+        name: "is_dir",
+        arity: Some(1),
+        function: is_dir,
+        parameters: "path",
+        doc: "whether the path is a directory",
+    },
+    Builtin {
+        name: "join",
+        arity: None,
+        function: join,
+        parameters: "..paths",
+        doc: "joins paths with the separator of the platform",
+    },
+    Builtin {
+        name: "list",
+        arity: Some(1),
+        function: list,
+        parameters: "path",
+        doc: "the names of the entries of a directory, sorted",
+    },
+    Builtin {
+        name: "open",
+        arity: Some(2),
+        function: open,
+        parameters: "path, mode",
+        doc: "opens a file to read, `\"r\"`, write, `\"w\"`, or append to, `\"a\"`",
+    },
+    Builtin {
+        name: "read",
+        arity: Some(1),
+        function: read,
+        parameters: "file",
+        doc: "the rest of the file as a string",
+    },
+    Builtin {
+        name: "read_bytes",
+        arity: Some(1),
+        function: read_bytes,
+        parameters: "file",
+        doc: "the rest of the file as bytes, as they are",
+    },
+    Builtin {
+        name: "write",
+        arity: Some(2),
+        function: write,
+        parameters: "file, data",
+        doc: "writes to a file, writing to a path replaces its contents",
+    },
+];
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Mode {
+    Read,
+    Write,
+    Append,
+}
+
+/// A file opened by a script, it stays open until closed or dropped
+#[derive(Debug)]
+pub struct File {
+    pub path: String,
+    pub mode: Mode,
+
+    /// `None` once closed
+    handle: Mutex<Option<std::fs::File>>,
+}
+
+impl File {
+    fn with_handle<T>(
+        &self,
+        f: impl FnOnce(&mut std::fs::File) -> io::Result<T>,
+    ) -> Result<T, String> {
+        let mut handle = self.handle.lock().unwrap_or_else(|e| e.into_inner());
+        match handle.as_mut() {
+            Some(h) => f(h).map_err(|e| io_error("cannot access", &self.path, e)),
+            None => Err(format!("file '{}' is closed", self.path)),
+        }
+    }
+}
+
+/// a human readable description of the error, without the OS error code
+pub(super) fn io_error(action: &str, path: &str, e: io::Error) -> String {
+    let reason = match e.kind() {
+        io::ErrorKind::NotFound => "no such file or directory".to_string(),
+        io::ErrorKind::PermissionDenied => "permission denied".to_string(),
+        io::ErrorKind::AlreadyExists => "it already exists".to_string(),
+        io::ErrorKind::InvalidData => "it is not valid UTF-8 text".to_string(),
+        _ => e.to_string(),
+    };
+    format!("{} '{}': {}", action, path, reason)
+}
+
+fn open_file(path: &str, mode: Mode) -> Result<File, String> {
+    let mut options = OpenOptions::new();
+    match mode {
+        Mode::Read => options.read(true),
+        Mode::Write => options.write(true).create(true).truncate(true),
+        Mode::Append => options.append(true).create(true),
+    };
+    let handle = options
+        .open(path)
+        .map_err(|e| io_error("cannot open", path, e))?;
+    Ok(File {
+        path: path.to_owned(),
+        mode,
+        handle: Mutex::new(Some(handle)),
+    })
+}
+
+/// the file argument, opening it if a path was given
+fn file(function: &str, args: &[Value], mode: Mode) -> Result<Arc<File>, String> {
+    let file = match &args[0] {
+        Value::File(f) => f.clone(),
+        Value::String(path) => {
+            sandbox::require(function, Capability::Fs)?;
+            Arc::new(open_file(path, mode)?)
+        }
+        v => return Err(argument_error(function, "a file or a path", 0, v)),
+    };
+    let allowed = match mode {
+        Mode::Read => file.mode == Mode::Read,
+        Mode::Write | Mode::Append => file.mode != Mode::Read,
+    };
+    if !allowed {
+        let action = match mode {
+            Mode::Read => "reading",
+            Mode::Write | Mode::Append => "writing",
+        };
+        return Err(format!(
+            "file '{}' was not opened for {}",
+            file.path, action
+        ));
+    }
+    Ok(file)
+}
+
+/// `fs::open(path, mode)`, the mode is `"r"`, `"w"` or `"a"`
+fn open(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("fs::open", Capability::Fs)?;
+    let path = string("fs::open", args, 0)?;
+    let mode = match string("fs::open", args, 1)? {
+        "r" => Mode::Read,
+        "w" => Mode::Write,
+        "a" => Mode::Append,
+        m => {
+            return Err(format!(
+                "fs::open expects the mode \"r\", \"w\" or \"a\", found {:?}",
+                m
+            ))
+        }
+    };
+    Ok(Value::File(Arc::new(open_file(path, mode)?)))
+}
+
+fn close(args: &[Value]) -> Result<Value, String> {
+    let Value::File(f) = &args[0] else {
+        return Err(argument_error("fs::close", "a file", 0, &args[0]));
+    };
+    f.handle.lock().unwrap_or_else(|e| e.into_inner()).take();
+    Ok(Value::None)
+}
+
+/// the rest of the file as a string
+fn read(args: &[Value]) -> Result<Value, String> {
+    let file = file("fs::read", args, Mode::Read)?;
+    let mut text = String::new();
+    file.with_handle(|h| h.read_to_string(&mut text))?;
+    Ok(Value::from(text.as_str()))
+}
+
+/// the rest of the file as bytes, as they are
+fn read_bytes(args: &[Value]) -> Result<Value, String> {
+    let file = file("fs::read_bytes", args, Mode::Read)?;
+    let mut b = vec![];
+    file.with_handle(|h| h.read_to_end(&mut b))?;
+    Ok(Value::from(b.as_slice()))
+}
+
+/// writes text or bytes
+fn write_text(function: &str, args: &[Value], mode: Mode) -> Result<Value, String> {
+    let file = file(function, args, mode)?;
+    let data = match &args[1] {
+        Value::String(s) => s.as_bytes(),
+        Value::Bytes(b) => b,
+        v => return Err(argument_error(function, "a string or bytes", 1, v)),
+    };
+    file.with_handle(|h| h.write_all(data))?;
+    Ok(Value::None)
+}
+
+/// `fs::write(file, data)`, writing to a path replaces its contents
+fn write(args: &[Value]) -> Result<Value, String> {
+    write_text("fs::write", args, Mode::Write)
+}
+
+fn append(args: &[Value]) -> Result<Value, String> {
+    write_text("fs::append", args, Mode::Append)
+}
+
+fn exists(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("fs::exists", Capability::Fs)?;
+    let path = string("fs::exists", args, 0)?;
+    Ok(Value::Bool(std::path::Path::new(path).exists()))
+}
+
+fn is_dir(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("fs::is_dir", Capability::Fs)?;
+    let path = string("fs::is_dir", args, 0)?;
+    Ok(Value::Bool(std::path::Path::new(path).is_dir()))
+}
+
+/// the names of the entries of a directory, sorted
+fn list(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("fs::list", Capability::Fs)?;
+    let path = string("fs::list", args, 0)?;
+    let entries = std::fs::read_dir(path).map_err(|e| io_error("cannot list", path, e))?;
+    let mut names = vec![];
+    for entry in entries {
+        let entry = entry.map_err(|e| io_error("cannot list", path, e))?;
+        names.push(entry.file_name().to_string_lossy().into_owned());
+    }
+    names.sort();
+    Ok(Value::list(
+        names.iter().map(|n| Value::from(n.as_str())).collect(),
+    ))
+}
+
+/// join paths with the separator of the platform
+fn join(args: &[Value]) -> Result<Value, String> {
+    let mut path = PathBuf::new();
+    for i in 0..args.len() {
+        path.push(string("fs::join", args, i)?);
+    }
+    Ok(Value::from(path.to_string_lossy().as_ref()))
+}
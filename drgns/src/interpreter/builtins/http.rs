@@ -0,0 +1,261 @@
+//! The `http` module, a client for HTTP and HTTPS.
+//!
+//! Each function sends a request and waits for the whole response, which is
+//! an instance of the struct `Response`, with the fields:
+//! - `status`: the status code, responses are returned whatever it is,
+//!   only failing to get one is an error
+//! - `headers`: a map of the header names, in lowercase, to their values,
+//!   those sent more than once are joined with `, `
+//! - `body`: a string, or a list of the bytes if it isn't valid UTF-8
+//!
+//! The last argument can be a map of options:
+//! - `headers`: a map of header names to the values to send
+//! - `body`: a string to send
+//! - `json`: a value to send as JSON, with the matching content type
+//! - `timeout`: the seconds to wait for the response before failing, 30 if
+//!   not given
+//!
+//! The WebAssembly build has no client, browsers only send requests that
+//! scripts can't wait for, each function fails there.
+
+use std::{
+    sync::{Arc, OnceLock},
+    time::Duration,
+};
+
+use indexmap::IndexMap;
+#[cfg(not(target_arch = "wasm32"))]
+use reqwest::blocking::Client;
+
+use crate::{
+    interpreter::sandbox::{self, Capability},
+    values::{Builtin, Instance, Key, Map, Struct, Value},
+};
+
+use super::{argument_error, check_count, json, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "get",
+        arity: None,
+        function: get,
+        parameters: "url, options = {}",
+        doc: "sends a GET request and returns the `Response`",
+    },
+    Builtin {
+        name: "json",
+        arity: Some(1),
+        function: json,
+        parameters: "response",
+        doc: "the body of a response, read as JSON",
+    },
+    Builtin {
+        name: "post",
+        arity: None,
+        function: post,
+        parameters: "url, body, options = {}",
+        doc: "sends a POST request with the string as its body and returns the `Response`",
+    },
+    Builtin {
+        name: "request",
+        arity: None,
+        function: request,
+        parameters: "method, url, options = {}",
+        doc: "sends a request with any method, such as `\"PUT\"`, and returns the `Response`",
+    },
+];
+
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// the struct of all responses, so that they are of the same type
+fn response_struct() -> Arc<Struct> {
+    static RESPONSE: OnceLock<Arc<Struct>> = OnceLock::new();
+    RESPONSE
+        .get_or_init(|| {
+            Arc::new(Struct::new(
+                "Response".to_owned(),
+                ["status", "headers", "body"].map(String::from).to_vec(),
+                IndexMap::new(),
+            ))
+        })
+        .clone()
+}
+
+/// `get(url)` or `get(url, options)`
+fn get(args: &[Value]) -> Result<Value, String> {
+    check_count("http::get", args, 1)?;
+    let url = string("http::get", args, 0)?;
+    let options = Options::new("http::get", args, 1)?;
+    send("http::get", "GET", url, options)
+}
+
+/// `post(url, body)` or `post(url, body, options)`, the body is a string
+fn post(args: &[Value]) -> Result<Value, String> {
+    check_count("http::post", args, 2)?;
+    let url = string("http::post", args, 0)?;
+    let body = string("http::post", args, 1)?;
+    let mut options = Options::new("http::post", args, 2)?;
+    options.body = Some(body.to_owned());
+    send("http::post", "POST", url, options)
+}
+
+/// `request(method, url)` or `request(method, url, options)`, with any
+/// method, such as `"PUT"` or `"DELETE"`
+fn request(args: &[Value]) -> Result<Value, String> {
+    check_count("http::request", args, 2)?;
+    let method = string("http::request", args, 0)?;
+    let url = string("http::request", args, 1)?;
+    let options = Options::new("http::request", args, 2)?;
+    send("http::request", method, url, options)
+}
+
+/// the body of a response, read as JSON
+fn json(args: &[Value]) -> Result<Value, String> {
+    let body = match &args[0] {
+        Value::Instance(i) if Arc::ptr_eq(&i.of, &response_struct()) => i.fields()[2].clone(),
+        v => return Err(argument_error("http::json", "a response", 0, v)),
+    };
+    let Value::String(body) = body else {
+        return Err("http::json expects a response whose body is text".to_string());
+    };
+    json::read(&body).map_err(|e| format!("http::json found invalid JSON: {}", e))
+}
+
+struct Options {
+    headers: Vec<(String, String)>,
+    body: Option<String>,
+    timeout: Duration,
+}
+
+impl Options {
+    /// the options at the given index, if they were passed
+    fn new(function: &str, args: &[Value], i: usize) -> Result<Self, String> {
+        let mut options = Options {
+            headers: vec![],
+            body: None,
+            timeout: DEFAULT_TIMEOUT,
+        };
+        let Some(value) = args.get(i) else {
+            return Ok(options);
+        };
+        let Value::Map(m) = value else {
+            return Err(argument_error(function, "a map of options", i, value));
+        };
+        let wrong = |name: &str, expected: &str, found: &Value| {
+            format!(
+                "{} expects the {} option to be {}, found {}",
+                function,
+                name,
+                expected,
+                found.type_name()
+            )
+        };
+        for (key, value) in m.read().unwrap_or_else(|e| e.into_inner()).iter() {
+            let name = match key {
+                Key::String(name) => name.as_ref(),
+                _ => "",
+            };
+            match (name, value) {
+                ("headers", Value::Map(headers)) => {
+                    options.headers.extend(header_list(function, headers)?)
+                }
+                ("headers", v) => return Err(wrong(name, "a map", v)),
+                ("body", Value::String(body)) => options.body = Some(body.to_string()),
+                ("body", v) => return Err(wrong(name, "a string", v)),
+                ("json", value) => {
+                    let body = json::write(value)
+                        .map_err(|e| format!("{} cannot send the json option: {}", function, e))?;
+                    options
+                        .headers
+                        .push(("content-type".to_owned(), "application/json".to_owned()));
+                    options.body = Some(body);
+                }
+                ("timeout", v) => {
+                    let seconds = match v {
+                        Value::Int(i) => *i as f64,
+                        Value::Float(x) => *x,
+                        v => return Err(wrong(name, "a number", v)),
+                    };
+                    options.timeout = Duration::try_from_secs_f64(seconds)
+                        .map_err(|_| wrong(name, "0 seconds or more", v))?;
+                }
+                _ => {
+                    return Err(format!(
+                        "{} has no option {}",
+                        function,
+                        Value::from(key.clone()).repr()
+                    ))
+                }
+            }
+        }
+        Ok(options)
+    }
+}
+
+#[cfg(target_arch = "wasm32")]
+fn send(function: &str, _: &str, _: &str, _: Options) -> Result<Value, String> {
+    sandbox::require(function, Capability::Net)?;
+    Err(format!("{} is not available in the browser", function))
+}
+
+#[cfg(not(target_arch = "wasm32"))]
+fn send(function: &str, method: &str, url: &str, options: Options) -> Result<Value, String> {
+    sandbox::require(function, Capability::Net)?;
+    let failed = |e: reqwest::Error| format!("{} failed: {}", function, e);
+    let method = reqwest::Method::from_bytes(method.to_uppercase().as_bytes()).map_err(|_| {
+        format!(
+            "{} cannot send a request with the method {}",
+            function, method
+        )
+    })?;
+    let client = Client::builder()
+        .timeout(options.timeout)
+        .build()
+        .map_err(failed)?;
+    let mut request = client.request(method, url);
+    for (name, value) in options.headers {
+        request = request.header(name, value);
+    }
+    if let Some(body) = options.body {
+        request = request.body(body);
+    }
+    let response = request.send().map_err(failed)?;
+
+    let status = Value::Int(response.status().as_u16() as i64);
+    let mut headers: IndexMap<Key, Value> = IndexMap::new();
+    for (name, value) in response.headers() {
+        let value = String::from_utf8_lossy(value.as_bytes());
+        let key = Key::String(name.as_str().into());
+        let joined = match headers.get(&key) {
+            Some(previous) => format!("{}, {}", previous, value),
+            None => value.into_owned(),
+        };
+        headers.insert(key, Value::from(joined.as_str()));
+    }
+    let bytes = response.bytes().map_err(failed)?;
+    let body = match std::str::from_utf8(&bytes) {
+        Ok(text) => Value::from(text),
+        Err(_) => Value::list(bytes.iter().map(|b| Value::Int(*b as i64)).collect()),
+    };
+    Ok(Value::Instance(Instance::new(
+        response_struct(),
+        vec![status, Value::map(headers), body],
+    )))
+}
+
+/// the names and values of the headers to send, which must be strings
+fn header_list(function: &str, headers: &Map) -> Result<Vec<(String, String)>, String> {
+    let headers = headers.read().unwrap_or_else(|e| e.into_inner());
+    headers
+        .iter()
+        .map(|(k, v)| match (k, v) {
+            (Key::String(k), Value::String(v)) => Ok((k.to_string(), v.to_string())),
+            _ => Err(format!(
+                "{} expects headers that are strings, found {} for {}",
+                function,
+                v.type_name(),
+                Value::from(k.clone())
+            )),
+        })
+        .collect()
+}
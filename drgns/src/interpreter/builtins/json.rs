@@ -0,0 +1,221 @@
+//! The `json` module, reads and writes JSON text.
+//!
+//! Objects are maps with string keys, in the order they are written in,
+//! arrays are lists and `null` is `none`. Numbers are ints when they are
+//! written without a fraction or an exponent, floats otherwise.
+//!
+//! Writing goes the other way around. Map keys that are ints or symbols
+//! become strings, so do symbols, and instances are written as objects of
+//! their fields. Other values, like functions, have no JSON form.
+
+use std::fmt;
+
+use indexmap::IndexMap;
+use serde::{
+    de::{MapAccess, SeqAccess, Visitor},
+    ser::{Error, SerializeMap, SerializeSeq},
+    Deserialize, Deserializer, Serialize, Serializer,
+};
+
+use crate::values::{BigInt, Builtin, Key, Value};
+
+use super::{argument_error, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "parse",
+        arity: Some(1),
+        function: parse,
+        parameters: "text",
+        doc: "the value JSON text stands for",
+    },
+    Builtin {
+        name: "stringify",
+        arity: None,
+        function: stringify,
+        parameters: "value, indent = none",
+        doc: "the value as JSON, on one line, or with each item on its own line indented by that many spaces",
+    },
+];
+
+/// how deep `stringify` goes into lists, maps and instances, so that a list
+/// containing itself is an error rather than a crash
+const MAX_DEPTH: usize = 128;
+
+/// the value written in JSON, which other modules read too
+pub(super) fn read(text: &str) -> Result<Value, serde_json::Error> {
+    serde_json::from_str::<Parsed>(text).map(|p| p.0)
+}
+
+/// the value as JSON on one line
+pub(super) fn write(value: &Value) -> Result<String, serde_json::Error> {
+    serde_json::to_string(&Json { value, depth: 0 })
+}
+
+fn parse(args: &[Value]) -> Result<Value, String> {
+    let text = string("json::parse", args, 0)?;
+    read(text).map_err(|e| format!("json::parse found invalid JSON: {}", e))
+}
+
+/// `stringify(value)` writes it on one line, `stringify(value, indent)` puts
+/// each item on its own line, indented by that many spaces per level
+fn stringify(args: &[Value]) -> Result<Value, String> {
+    if !(1..=2).contains(&args.len()) {
+        return Err(format!(
+            "json::stringify expects 1 or 2 arguments, found {}",
+            args.len()
+        ));
+    }
+    let text = match args.get(1) {
+        None | Some(Value::None) => write(&args[0]),
+        Some(Value::Int(n @ 0..=64)) => {
+            let json = Json {
+                value: &args[0],
+                depth: 0,
+            };
+            let indent = " ".repeat(*n as usize);
+            let formatter = serde_json::ser::PrettyFormatter::with_indent(indent.as_bytes());
+            let mut out = vec![];
+            let mut serializer = serde_json::Serializer::with_formatter(&mut out, formatter);
+            json.serialize(&mut serializer)
+                .map(|_| String::from_utf8(out).expect("JSON is always valid UTF-8"))
+        }
+        Some(v) => {
+            return Err(argument_error(
+                "json::stringify",
+                "an indent between 0 and 64",
+                1,
+                v,
+            ))
+        }
+    };
+    text.map(|t| Value::from(t.as_str()))
+        .map_err(|e| format!("json::stringify {}", e))
+}
+
+/// a value read from JSON
+struct Parsed(Value);
+
+impl<'de> Deserialize<'de> for Parsed {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        deserializer.deserialize_any(ParsedVisitor).map(Parsed)
+    }
+}
+
+struct ParsedVisitor;
+
+impl<'de> Visitor<'de> for ParsedVisitor {
+    type Value = Value;
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "a JSON value")
+    }
+
+    fn visit_unit<E>(self) -> Result<Value, E> {
+        Ok(Value::None)
+    }
+
+    fn visit_bool<E>(self, b: bool) -> Result<Value, E> {
+        Ok(Value::Bool(b))
+    }
+
+    fn visit_i64<E>(self, i: i64) -> Result<Value, E> {
+        Ok(Value::Int(i))
+    }
+
+    fn visit_u64<E>(self, i: u64) -> Result<Value, E> {
+        Ok(Value::from(BigInt::from(i as i128)))
+    }
+
+    fn visit_f64<E>(self, x: f64) -> Result<Value, E> {
+        Ok(Value::Float(x))
+    }
+
+    fn visit_str<E>(self, s: &str) -> Result<Value, E> {
+        Ok(Value::from(s))
+    }
+
+    fn visit_seq<A: SeqAccess<'de>>(self, mut seq: A) -> Result<Value, A::Error> {
+        let mut items = vec![];
+        while let Some(Parsed(item)) = seq.next_element()? {
+            items.push(item);
+        }
+        Ok(Value::list(items))
+    }
+
+    fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<Value, A::Error> {
+        let mut entries = IndexMap::new();
+        while let Some((key, Parsed(value))) = map.next_entry::<String, Parsed>()? {
+            entries.insert(Key::String(key.into()), value);
+        }
+        Ok(Value::map(entries))
+    }
+}
+
+/// a value to write as JSON, at some depth in the one passed to `stringify`
+struct Json<'a> {
+    value: &'a Value,
+    depth: usize,
+}
+
+impl Json<'_> {
+    fn item<'a>(&self, value: &'a Value) -> Json<'a> {
+        Json {
+            value,
+            depth: self.depth + 1,
+        }
+    }
+}
+
+impl Serialize for Json<'_> {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        if self.depth > MAX_DEPTH {
+            return Err(S::Error::custom(format!(
+                "cannot nest values more than {} levels deep, does a list contain itself?",
+                MAX_DEPTH
+            )));
+        }
+        match self.value {
+            Value::None => serializer.serialize_unit(),
+            Value::Bool(b) => serializer.serialize_bool(*b),
+            Value::Int(i) => serializer.serialize_i64(*i),
+            Value::BigInt(i) => match i.to_i128() {
+                Some(i) => serializer.serialize_i128(i),
+                None => Err(S::Error::custom("cannot write ints of more than 128 bits")),
+            },
+            Value::Float(x) if x.is_finite() => serializer.serialize_f64(*x),
+            Value::Float(x) => Err(S::Error::custom(format!("cannot write {:?}", x))),
+            Value::String(s) | Value::Symbol(s) => serializer.serialize_str(s),
+            Value::List(l) => {
+                let items = l.read().unwrap_or_else(|e| e.into_inner());
+                let mut seq = serializer.serialize_seq(Some(items.len()))?;
+                for item in items.iter() {
+                    seq.serialize_element(&self.item(item))?;
+                }
+                seq.end()
+            }
+            Value::Map(m) => {
+                let entries = m.read().unwrap_or_else(|e| e.into_inner());
+                let mut map = serializer.serialize_map(Some(entries.len()))?;
+                for (key, value) in entries.iter() {
+                    let key = match key {
+                        Key::String(s) | Key::Symbol(s) => s.to_string(),
+                        Key::Int(i) => i.to_string(),
+                        Key::BigInt(i) => i.to_string(),
+                    };
+                    map.serialize_entry(&key, &self.item(value))?;
+                }
+                map.end()
+            }
+            Value::Instance(i) => {
+                let fields = i.fields();
+                let mut map = serializer.serialize_map(Some(fields.len()))?;
+                for (name, value) in i.of.fields.iter().zip(fields.iter()) {
+                    map.serialize_entry(name, &self.item(value))?;
+                }
+                map.end()
+            }
+            v => Err(S::Error::custom(format!("cannot write {}", v.type_name()))),
+        }
+    }
+}
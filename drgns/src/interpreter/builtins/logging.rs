@@ -0,0 +1,236 @@
+//! The `log` module, messages for whoever runs a script about what it does.
+//!
+//! `log::info("copied", {"files": 3})` writes a line to the standard error,
+//! with the time in UTC and the level of the message, then the message and
+//! its fields, if a map of them is given:
+//!
+//! ```txt
+//! 2024-05-17T09:30:15.123Z INFO  copied files=3
+//! ```
+//!
+//! The time is the one of `time::now`, so it is the same in every
+//! deterministic run.
+//!
+//! Messages below the minimum level are dropped, it is `info` unless the
+//! `--log-level` flag or the `DRGNS_LOG_LEVEL` environment variable say
+//! otherwise, and `log::set_level` changes it while the script runs. With
+//! `DRGNS_LOG_FORMAT=json`, or after `log::set_format("json")`, each line is
+//! rather a JSON object, with the keys `time`, `level` and `message` first
+//! and the fields after them.
+
+use std::sync::{Mutex, MutexGuard, OnceLock};
+
+use chrono::SecondsFormat;
+use indexmap::IndexMap;
+
+use crate::{
+    interpreter::io,
+    values::{Builtin, Key, Value},
+};
+
+use super::{argument_error, check_count, json, string, time, LOG_OUTPUT};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "debug",
+        arity: None,
+        function: debug,
+        parameters: "message, fields = {}",
+        doc: "logs a message at the `debug` level",
+    },
+    Builtin {
+        name: "error",
+        arity: None,
+        function: error,
+        parameters: "message, fields = {}",
+        doc: "logs a message at the `error` level",
+    },
+    Builtin {
+        name: "info",
+        arity: None,
+        function: info,
+        parameters: "message, fields = {}",
+        doc: "logs a message at the `info` level",
+    },
+    Builtin {
+        name: "level",
+        arity: Some(0),
+        function: level,
+        parameters: "",
+        doc: "the minimum level of the messages written, as a string",
+    },
+    Builtin {
+        name: "set_format",
+        arity: Some(1),
+        function: set_format,
+        parameters: "format",
+        doc: "writes lines as `\"text\"` or as `\"json\"` objects",
+    },
+    Builtin {
+        name: "set_level",
+        arity: Some(1),
+        function: set_level,
+        parameters: "level",
+        doc: "drops the messages below a level, `\"debug\"`, `\"info\"`, `\"warn\"` or `\"error\"`",
+    },
+    Builtin {
+        name: "warn",
+        arity: None,
+        function: warn,
+        parameters: "message, fields = {}",
+        doc: "logs a message at the `warn` level",
+    },
+];
+
+const LEVEL_VARIABLE: &str = "DRGNS_LOG_LEVEL";
+const FORMAT_VARIABLE: &str = "DRGNS_LOG_FORMAT";
+
+/// How important a message is, from the least to the most
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Level {
+    Debug,
+    Info,
+    Warn,
+    Error,
+}
+
+impl Level {
+    const ALL: [Level; 4] = [Level::Debug, Level::Info, Level::Warn, Level::Error];
+
+    fn name(self) -> &'static str {
+        match self {
+            Level::Debug => "debug",
+            Level::Info => "info",
+            Level::Warn => "warn",
+            Level::Error => "error",
+        }
+    }
+
+    fn parse(name: &str) -> Option<Level> {
+        Level::ALL.into_iter().find(|l| l.name() == name)
+    }
+}
+
+struct Settings {
+    level: Level,
+    json: bool,
+}
+
+/// the settings of the whole process, read from the environment first
+fn settings() -> MutexGuard<'static, Settings> {
+    static SETTINGS: OnceLock<Mutex<Settings>> = OnceLock::new();
+    SETTINGS
+        .get_or_init(|| {
+            let variable = |name| std::env::var(name).ok().filter(|v| !v.is_empty());
+            let level = variable(LEVEL_VARIABLE).map_or(Level::Info, |name| {
+                Level::parse(&name.to_lowercase()).unwrap_or_else(|| {
+                    log::warn!("{} has an unknown level '{}'", LEVEL_VARIABLE, name);
+                    Level::Info
+                })
+            });
+            let json = variable(FORMAT_VARIABLE).is_some_and(|f| f.eq_ignore_ascii_case("json"));
+            Mutex::new(Settings { level, json })
+        })
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+}
+
+/// Set the minimum level of the messages scripts write, over the one of the
+/// environment, as the `--log-level` flag does
+pub fn set_minimum_level(level: Level) {
+    settings().level = level;
+}
+
+fn debug(args: &[Value]) -> Result<Value, String> {
+    write("log::debug", Level::Debug, args)
+}
+
+fn info(args: &[Value]) -> Result<Value, String> {
+    write("log::info", Level::Info, args)
+}
+
+fn warn(args: &[Value]) -> Result<Value, String> {
+    write("log::warn", Level::Warn, args)
+}
+
+fn error(args: &[Value]) -> Result<Value, String> {
+    write("log::error", Level::Error, args)
+}
+
+/// the minimum level, as a string
+fn level(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(settings().level.name()))
+}
+
+fn set_level(args: &[Value]) -> Result<Value, String> {
+    let name = string("log::set_level", args, 0)?;
+    let level = Level::parse(name).ok_or_else(|| {
+        format!(
+            "log::set_level expects \"debug\", \"info\", \"warn\" or \"error\", found {:?}",
+            name
+        )
+    })?;
+    set_minimum_level(level);
+    Ok(Value::None)
+}
+
+/// `"text"` or `"json"`
+fn set_format(args: &[Value]) -> Result<Value, String> {
+    settings().json = match string("log::set_format", args, 0)? {
+        "text" => false,
+        "json" => true,
+        format => {
+            return Err(format!(
+                "log::set_format expects \"text\" or \"json\", found {:?}",
+                format
+            ))
+        }
+    };
+    Ok(Value::None)
+}
+
+/// write the message if it is at the minimum level or above it
+fn write(function: &str, level: Level, args: &[Value]) -> Result<Value, String> {
+    check_count(function, args, 1)?;
+    let fields = match args.get(1) {
+        None => IndexMap::new(),
+        Some(Value::Map(m)) => m.read().unwrap_or_else(|e| e.into_inner()).clone(),
+        Some(v) => return Err(argument_error(function, "a map of fields", 1, v)),
+    };
+    let json = {
+        let settings = settings();
+        if level < settings.level {
+            return Ok(Value::None);
+        }
+        settings.json
+    };
+    let time = time::clock().to_rfc3339_opts(SecondsFormat::Millis, true);
+    let message = args[0].to_string();
+    let line = match json {
+        true => {
+            let mut object = IndexMap::new();
+            let mut put = |k: &str, v: Value| object.insert(Key::String(k.into()), v);
+            put("time", Value::from(time.as_str()));
+            put("level", Value::from(level.name()));
+            put("message", Value::from(message.as_str()));
+            for (k, v) in fields {
+                object.entry(k).or_insert(v);
+            }
+            json::write(&Value::map(object))
+                .map_err(|e| format!("{} cannot write the fields as JSON: {}", function, e))?
+        }
+        false => {
+            let mut line = format!("{} {:<5} {}", time, level.name().to_uppercase(), message);
+            for (k, v) in fields {
+                line.push_str(&format!(" {}={}", Value::from(k), v.repr()));
+            }
+            line
+        }
+    };
+    match (io::current(), LOG_OUTPUT.get()) {
+        (Some(io), _) => io.log(&line),
+        (None, Some(output)) => output(&line),
+        (None, None) => eprintln!("{}", line),
+    }
+    Ok(Value::None)
+}
@@ -0,0 +1,267 @@
+//! The `math` module, functions on numbers.
+//!
+//! Ints and floats can be passed wherever a number is expected. Functions
+//! whose result is rarely an integer, like `sqrt` or `sin`, always return a
+//! float, following IEEE rules: `math::sqrt(-1)` is NaN rather than an error.
+//! The others keep ints exact: `abs`, `min`, `max` and `pow` return an int
+//! for ints, like the operators, and `floor`, `ceil` and `round` turn floats
+//! into ints, big ones if need be.
+
+use std::{cmp::Ordering, f64::consts};
+
+use crate::{
+    parser::BinOperator,
+    values::{self, BigInt, Builtin, Value},
+};
+
+use super::number;
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "abs",
+        arity: Some(1),
+        function: abs,
+        parameters: "x",
+        doc: "the absolute value, an int for ints",
+    },
+    Builtin {
+        name: "acos",
+        arity: Some(1),
+        function: acos,
+        parameters: "x",
+        doc: "the arc cosine, in radians",
+    },
+    Builtin {
+        name: "asin",
+        arity: Some(1),
+        function: asin,
+        parameters: "x",
+        doc: "the arc sine, in radians",
+    },
+    Builtin {
+        name: "atan",
+        arity: Some(1),
+        function: atan,
+        parameters: "x",
+        doc: "the arc tangent, in radians",
+    },
+    Builtin {
+        name: "atan2",
+        arity: Some(2),
+        function: atan2,
+        parameters: "y, x",
+        doc: "the angle of the point `(x, y)`, in radians",
+    },
+    Builtin {
+        name: "ceil",
+        arity: Some(1),
+        function: ceil,
+        parameters: "x",
+        doc: "the smallest int at least `x`",
+    },
+    Builtin {
+        name: "cos",
+        arity: Some(1),
+        function: cos,
+        parameters: "x",
+        doc: "the cosine of an angle in radians",
+    },
+    Builtin {
+        name: "exp",
+        arity: Some(1),
+        function: exp,
+        parameters: "x",
+        doc: "`e` to the power of `x`",
+    },
+    Builtin {
+        name: "floor",
+        arity: Some(1),
+        function: floor,
+        parameters: "x",
+        doc: "the largest int at most `x`",
+    },
+    Builtin {
+        name: "log",
+        arity: None,
+        function: log,
+        parameters: "x, base = e",
+        doc: "the logarithm of `x` in the base, the natural one by default",
+    },
+    Builtin {
+        name: "max",
+        arity: None,
+        function: max,
+        parameters: "..numbers",
+        doc: "the largest of the numbers",
+    },
+    Builtin {
+        name: "min",
+        arity: None,
+        function: min,
+        parameters: "..numbers",
+        doc: "the smallest of the numbers",
+    },
+    Builtin {
+        name: "pow",
+        arity: Some(2),
+        function: pow,
+        parameters: "x, y",
+        doc: "`x ** y`, so ints to a non-negative int power stay ints",
+    },
+    Builtin {
+        name: "round",
+        arity: Some(1),
+        function: round,
+        parameters: "x",
+        doc: "the nearest int, halfway cases away from zero",
+    },
+    Builtin {
+        name: "sin",
+        arity: Some(1),
+        function: sin,
+        parameters: "x",
+        doc: "the sine of an angle in radians",
+    },
+    Builtin {
+        name: "sqrt",
+        arity: Some(1),
+        function: sqrt,
+        parameters: "x",
+        doc: "the square root, NaN for negative numbers",
+    },
+    Builtin {
+        name: "tan",
+        arity: Some(1),
+        function: tan,
+        parameters: "x",
+        doc: "the tangent of an angle in radians",
+    },
+];
+
+pub const CONSTANTS: &[(&str, f64)] = &[("e", consts::E), ("pi", consts::PI)];
+
+fn float(function: &str, args: &[Value], f: fn(f64) -> f64) -> Result<Value, String> {
+    Ok(Value::Float(f(number(function, args, 0)?)))
+}
+
+fn sqrt(args: &[Value]) -> Result<Value, String> {
+    float("math::sqrt", args, f64::sqrt)
+}
+
+fn exp(args: &[Value]) -> Result<Value, String> {
+    float("math::exp", args, f64::exp)
+}
+
+/// `log(x)` is the natural logarithm, `log(x, base)` the one in that base
+fn log(args: &[Value]) -> Result<Value, String> {
+    match args.len() {
+        1 => float("math::log", args, f64::ln),
+        2 => {
+            let x = number("math::log", args, 0)?;
+            let base = number("math::log", args, 1)?;
+            Ok(Value::Float(x.log(base)))
+        }
+        n => Err(format!("math::log expects 1 or 2 arguments, found {}", n)),
+    }
+}
+
+fn sin(args: &[Value]) -> Result<Value, String> {
+    float("math::sin", args, f64::sin)
+}
+
+fn cos(args: &[Value]) -> Result<Value, String> {
+    float("math::cos", args, f64::cos)
+}
+
+fn tan(args: &[Value]) -> Result<Value, String> {
+    float("math::tan", args, f64::tan)
+}
+
+fn asin(args: &[Value]) -> Result<Value, String> {
+    float("math::asin", args, f64::asin)
+}
+
+fn acos(args: &[Value]) -> Result<Value, String> {
+    float("math::acos", args, f64::acos)
+}
+
+fn atan(args: &[Value]) -> Result<Value, String> {
+    float("math::atan", args, f64::atan)
+}
+
+/// the angle of the point `(x, y)`, taking `y` first
+fn atan2(args: &[Value]) -> Result<Value, String> {
+    let y = number("math::atan2", args, 0)?;
+    let x = number("math::atan2", args, 1)?;
+    Ok(Value::Float(y.atan2(x)))
+}
+
+/// `x ** y`, so ints to a non-negative int power stay ints
+fn pow(args: &[Value]) -> Result<Value, String> {
+    number("math::pow", args, 0)?;
+    number("math::pow", args, 1)?;
+    values::binary(BinOperator::Pow, args[0].clone(), args[1].clone())
+}
+
+fn abs(args: &[Value]) -> Result<Value, String> {
+    match &args[0] {
+        Value::Float(x) => Ok(Value::Float(x.abs())),
+        v => {
+            number("math::abs", args, 0)?;
+            match v.compare(&Value::Int(0))? {
+                Ordering::Less => v.clone().neg(),
+                _ => Ok(v.clone()),
+            }
+        }
+    }
+}
+
+/// floats rounded by the function, as an int, ints are already whole
+fn whole(function: &str, args: &[Value], f: fn(f64) -> f64) -> Result<Value, String> {
+    let x = match &args[0] {
+        Value::Float(x) => f(*x),
+        v => {
+            number(function, args, 0)?;
+            return Ok(v.clone());
+        }
+    };
+    BigInt::from_f64(x)
+        .map(Value::from)
+        .ok_or_else(|| format!("{} cannot turn {:?} into an int", function, x))
+}
+
+fn floor(args: &[Value]) -> Result<Value, String> {
+    whole("math::floor", args, f64::floor)
+}
+
+fn ceil(args: &[Value]) -> Result<Value, String> {
+    whole("math::ceil", args, f64::ceil)
+}
+
+/// to the nearest int, halfway cases away from zero
+fn round(args: &[Value]) -> Result<Value, String> {
+    whole("math::round", args, f64::round)
+}
+
+/// the first of the numbers that is ordered before the others
+fn extremum(function: &str, args: &[Value], wanted: Ordering) -> Result<Value, String> {
+    if args.is_empty() {
+        return Err(format!("{} expects at least 1 argument, found 0", function));
+    }
+    let mut best = &args[0];
+    for i in 0..args.len() {
+        number(function, args, i)?;
+        if args[i].compare(best)? == wanted {
+            best = &args[i];
+        }
+    }
+    Ok(best.clone())
+}
+
+fn min(args: &[Value]) -> Result<Value, String> {
+    extremum("math::min", args, Ordering::Less)
+}
+
+fn max(args: &[Value]) -> Result<Value, String> {
+    extremum("math::max", args, Ordering::Greater)
+}
@@ -0,0 +1,299 @@
+//! The `os` module, processes and the system the script runs on.
+//!
+//! `os::run` starts a program and waits for it to finish, its result is an
+//! instance of the struct `Output`, with the fields:
+//! - `code`: the exit code, a run that fails is not an error, `none` when
+//!   the program was stopped by a signal
+//! - `stdout` and `stderr`: what the program wrote, as strings, or lists of
+//!   the bytes if they aren't valid UTF-8
+//!
+//! The program is found in the `PATH` and gets its arguments as they are,
+//! nothing goes through a shell: run `os::run("sh", ["-c", line])` for
+//! pipes and globs. The last argument can be a map of options:
+//! - `dir`: the working directory of the program
+//! - `env`: a map of environment variables to set for the program, on top of
+//!   those of the script
+//! - `input`: a string written to the standard input of the program
+//!
+//! Environment variables are read with the builtin `env`.
+
+use std::{
+    io::Write,
+    process::{Command, Stdio},
+    sync::{Arc, OnceLock},
+};
+
+use indexmap::IndexMap;
+
+use crate::{
+    interpreter::sandbox::{self, Capability},
+    values::{Builtin, Instance, Key, Struct, Value},
+};
+
+use super::{argument_error, fs::io_error, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "arch",
+        arity: Some(0),
+        function: arch,
+        parameters: "",
+        doc: "the architecture of the processor, such as `\"x86_64\"`",
+    },
+    Builtin {
+        name: "chdir",
+        arity: Some(1),
+        function: chdir,
+        parameters: "path",
+        doc: "changes the working directory, for the rest of the script",
+    },
+    Builtin {
+        name: "cwd",
+        arity: Some(0),
+        function: cwd,
+        parameters: "",
+        doc: "the working directory, which relative paths start from",
+    },
+    Builtin {
+        name: "name",
+        arity: Some(0),
+        function: name,
+        parameters: "",
+        doc: "the operating system, such as `\"linux\"`, `\"macos\"` or `\"windows\"`",
+    },
+    Builtin {
+        name: "pid",
+        arity: Some(0),
+        function: pid,
+        parameters: "",
+        doc: "the id of the process running the script",
+    },
+    Builtin {
+        name: "run",
+        arity: None,
+        function: run,
+        parameters: "program, arguments = [], options = {}",
+        doc: "runs a program with a list of arguments, waits for it and returns its `Output`",
+    },
+    Builtin {
+        name: "set_env",
+        arity: Some(2),
+        function: set_env,
+        parameters: "name, value",
+        doc: "sets an environment variable, for the script and the programs it runs",
+    },
+    Builtin {
+        name: "unset_env",
+        arity: Some(1),
+        function: unset_env,
+        parameters: "name",
+        doc: "removes an environment variable, for the script and the programs it runs",
+    },
+];
+
+/// the struct of the results of `run`
+fn output_struct() -> Arc<Struct> {
+    static OUTPUT: OnceLock<Arc<Struct>> = OnceLock::new();
+    OUTPUT
+        .get_or_init(|| {
+            Arc::new(Struct::new(
+                "Output".to_owned(),
+                ["code", "stdout", "stderr"].map(String::from).to_vec(),
+                IndexMap::new(),
+            ))
+        })
+        .clone()
+}
+
+/// the operating system, such as `"linux"`, `"macos"` or `"windows"`
+fn name(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(std::env::consts::OS))
+}
+
+/// the architecture of the processor, such as `"x86_64"` or `"aarch64"`
+fn arch(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(std::env::consts::ARCH))
+}
+
+/// the id of the process running the script
+fn pid(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::Int(std::process::id() as i64))
+}
+
+/// the working directory, which relative paths start from
+fn cwd(_: &[Value]) -> Result<Value, String> {
+    sandbox::require("os::cwd", Capability::Fs)?;
+    let dir = std::env::current_dir().map_err(|e| io_error("os::cwd cannot read", ".", e))?;
+    Ok(Value::from(dir.to_string_lossy().as_ref()))
+}
+
+/// change the working directory, for the rest of the script
+fn chdir(args: &[Value]) -> Result<Value, String> {
+    sandbox::require("os::chdir", Capability::Fs)?;
+    let path = string("os::chdir", args, 0)?;
+    std::env::set_current_dir(path).map_err(|e| io_error("os::chdir cannot enter", path, e))?;
+    Ok(Value::None)
+}
+
+/// the name of an environment variable, which the OS can't take if it is
+/// empty or contains `=` or a nul character
+fn env_name<'a>(function: &str, args: &'a [Value]) -> Result<&'a str, String> {
+    sandbox::require(function, Capability::Env)?;
+    let name = string(function, args, 0)?;
+    match name.is_empty() || name.contains(['=', '\0']) {
+        true => Err(format!(
+            "{} cannot use {:?} as the name of a variable",
+            function, name
+        )),
+        false => Ok(name),
+    }
+}
+
+/// set an environment variable, for the script and the programs it runs
+fn set_env(args: &[Value]) -> Result<Value, String> {
+    let name = env_name("os::set_env", args)?;
+    let value = string("os::set_env", args, 1)?;
+    if value.contains('\0') {
+        return Err("os::set_env cannot set a value containing a nul character".to_string());
+    }
+    std::env::set_var(name, value);
+    Ok(Value::None)
+}
+
+fn unset_env(args: &[Value]) -> Result<Value, String> {
+    let name = env_name("os::unset_env", args)?;
+    std::env::remove_var(name);
+    Ok(Value::None)
+}
+
+/// `run(program)`, `run(program, arguments)` or `run(program, arguments,
+/// options)`, the arguments are a list of strings
+fn run(args: &[Value]) -> Result<Value, String> {
+    if !(1..=3).contains(&args.len()) {
+        return Err(format!(
+            "os::run expects 1 to 3 arguments, found {}",
+            args.len()
+        ));
+    }
+    sandbox::require("os::run", Capability::Process)?;
+    let program = string("os::run", args, 0)?;
+    let mut command = Command::new(program);
+    match args.get(1) {
+        None => {}
+        Some(Value::List(l)) => {
+            for item in l.read().unwrap_or_else(|e| e.into_inner()).iter() {
+                match item {
+                    Value::String(s) => command.arg(s.as_ref()),
+                    v => {
+                        return Err(format!(
+                            "os::run expects arguments that are strings, found {}",
+                            v.type_name()
+                        ))
+                    }
+                };
+            }
+        }
+        Some(v) => return Err(argument_error("os::run", "a list of arguments", 1, v)),
+    }
+    let input = match args.get(2) {
+        Some(options) => self::options(&mut command, options)?,
+        None => None,
+    };
+
+    command
+        .stdin(match input {
+            Some(_) => Stdio::piped(),
+            None => Stdio::null(),
+        })
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped());
+    let mut child = command
+        .spawn()
+        .map_err(|e| io_error("os::run cannot run", program, e))?;
+    // written from another thread, the program could otherwise wait for its
+    // output to be read while the script waits for its input to be
+    let writer = input.zip(child.stdin.take()).map(|(input, mut stdin)| {
+        std::thread::spawn(move || {
+            // the program may exit without reading all of it
+            let _ = stdin.write_all(input.as_bytes());
+        })
+    });
+    let output = child
+        .wait_with_output()
+        .map_err(|e| io_error("os::run cannot wait for", program, e))?;
+    if let Some(writer) = writer {
+        let _ = writer.join();
+    }
+
+    let text = |bytes: Vec<u8>| match String::from_utf8(bytes) {
+        Ok(text) => Value::from(text.as_str()),
+        Err(e) => Value::list(
+            e.into_bytes()
+                .into_iter()
+                .map(|b| Value::Int(b as i64))
+                .collect(),
+        ),
+    };
+    let code = output
+        .status
+        .code()
+        .map_or(Value::None, |c| Value::Int(c as i64));
+    Ok(Value::Instance(Instance::new(
+        output_struct(),
+        vec![code, text(output.stdout), text(output.stderr)],
+    )))
+}
+
+/// apply the options to the command, and return the input to write
+fn options(command: &mut Command, options: &Value) -> Result<Option<String>, String> {
+    let Value::Map(m) = options else {
+        return Err(argument_error("os::run", "a map of options", 2, options));
+    };
+    let wrong = |name: &str, expected: &str, found: &Value| {
+        format!(
+            "os::run expects the {} option to be {}, found {}",
+            name,
+            expected,
+            found.type_name()
+        )
+    };
+    let mut input = None;
+    for (key, value) in m.read().unwrap_or_else(|e| e.into_inner()).iter() {
+        let name = match key {
+            Key::String(name) => name.as_ref(),
+            _ => "",
+        };
+        match (name, value) {
+            ("dir", Value::String(dir)) => {
+                command.current_dir(dir.as_ref());
+            }
+            ("dir", v) => return Err(wrong(name, "a string", v)),
+            ("env", Value::Map(vars)) => {
+                for (k, v) in vars.read().unwrap_or_else(|e| e.into_inner()).iter() {
+                    match (k, v) {
+                        (Key::String(k), Value::String(v)) => {
+                            command.env(k.as_ref(), v.as_ref());
+                        }
+                        _ => {
+                            return Err(format!(
+                                "os::run expects environment variables that are strings, found {} for {}",
+                                v.type_name(),
+                                Value::from(k.clone())
+                            ))
+                        }
+                    }
+                }
+            }
+            ("env", v) => return Err(wrong(name, "a map", v)),
+            ("input", Value::String(s)) => input = Some(s.to_string()),
+            ("input", v) => return Err(wrong(name, "a string", v)),
+            _ => {
+                return Err(format!(
+                    "os::run has no option {}",
+                    Value::from(key.clone()).repr()
+                ))
+            }
+        }
+    }
+    Ok(input)
+}
@@ -0,0 +1,219 @@
+//! The `random` module, random numbers and picks.
+//!
+//! Most functions draw from one generator, shared by the whole script,
+//! which starts from a random seed. `random::seed(n)` restarts it from `n`,
+//! so that the numbers that follow, and a run that depends on them, can be
+//! repeated. That generator is fast but predictable: `bytes` and `token`
+//! rather read the secure source of the operating system, as is needed for
+//! passwords or session keys, and are never affected by `seed`.
+//!
+//! In a deterministic run, the generator starts from the same seed every
+//! time, and `bytes` and `token` draw from it too, so they are not secure.
+
+use std::sync::{Mutex, OnceLock};
+
+use rand::{rngs::OsRng, rngs::StdRng, seq::SliceRandom, Rng, SeedableRng, TryRngCore};
+
+use crate::{
+    interpreter::deterministic,
+    values::{Builtin, Value},
+};
+
+use super::{argument_error, int, number};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "bytes",
+        arity: Some(1),
+        function: bytes,
+        parameters: "count",
+        doc: "a list of that many secure bytes, ints from 0 to 255",
+    },
+    Builtin {
+        name: "choice",
+        arity: Some(1),
+        function: choice,
+        parameters: "list",
+        doc: "an item of the list",
+    },
+    Builtin {
+        name: "float",
+        arity: None,
+        function: float,
+        parameters: "low = 0, high = 1",
+        doc: "a float from `low` up to but not including `high`",
+    },
+    Builtin {
+        name: "int",
+        arity: None,
+        function: integer,
+        parameters: "low = 0, high",
+        doc: "an int from `low` up to but not including `high`, like `range`",
+    },
+    Builtin {
+        name: "sample",
+        arity: Some(2),
+        function: sample,
+        parameters: "list, count",
+        doc: "`count` items of the list, each at most once, in a random order",
+    },
+    Builtin {
+        name: "seed",
+        arity: Some(1),
+        function: seed,
+        parameters: "n",
+        doc: "restarts the generator from a seed, so that the numbers that follow repeat",
+    },
+    Builtin {
+        name: "shuffle",
+        arity: Some(1),
+        function: shuffle,
+        parameters: "list",
+        doc: "puts the items of the list in a random order, in place",
+    },
+    Builtin {
+        name: "token",
+        arity: Some(1),
+        function: token,
+        parameters: "count",
+        doc: "that many secure bytes written in hexadecimal",
+    },
+];
+
+/// the most bytes `bytes` and `token` return at once
+const MAX_BYTES: i64 = 1 << 20;
+
+/// Draw from the generator of the deterministic run, or of the process
+fn draw<T>(f: impl FnOnce(&mut StdRng) -> T) -> T {
+    if let Some(run) = deterministic::current() {
+        return f(&mut run.generator());
+    }
+    static GENERATOR: OnceLock<Mutex<StdRng>> = OnceLock::new();
+    let generator = GENERATOR.get_or_init(|| Mutex::new(StdRng::from_os_rng()));
+    f(&mut generator.lock().unwrap_or_else(|e| e.into_inner()))
+}
+
+fn seed(args: &[Value]) -> Result<Value, String> {
+    let seed = int("random::seed", args, 0)?;
+    draw(|g| *g = StdRng::seed_from_u64(seed as u64));
+    Ok(Value::None)
+}
+
+/// `float()` is between 0 and 1, `float(low, high)` between `low` and
+/// `high`, never `high` itself
+fn float(args: &[Value]) -> Result<Value, String> {
+    let (low, high) = match args.len() {
+        0 => (0.0, 1.0),
+        2 => (
+            number("random::float", args, 0)?,
+            number("random::float", args, 1)?,
+        ),
+        n => {
+            return Err(format!(
+                "random::float expects 0 or 2 arguments, found {}",
+                n
+            ))
+        }
+    };
+    if low >= high || !(high - low).is_finite() {
+        return Err(format!(
+            "random::float expects a low bound under the high one, found {:?} and {:?}",
+            low, high
+        ));
+    }
+    Ok(Value::Float(draw(|g| g.random_range(low..high))))
+}
+
+/// `int(high)` is from 0 to `high`, `int(low, high)` from `low` to `high`,
+/// never `high` itself, like `range`
+fn integer(args: &[Value]) -> Result<Value, String> {
+    let (low, high) = match args.len() {
+        1 => (0, int("random::int", args, 0)?),
+        2 => (int("random::int", args, 0)?, int("random::int", args, 1)?),
+        n => return Err(format!("random::int expects 1 or 2 arguments, found {}", n)),
+    };
+    if low >= high {
+        return Err(format!(
+            "random::int expects a low bound under the high one, found {} and {}",
+            low, high
+        ));
+    }
+    Ok(Value::Int(draw(|g| g.random_range(low..high))))
+}
+
+fn items(function: &str, args: &[Value]) -> Result<Vec<Value>, String> {
+    match &args[0] {
+        Value::List(l) => Ok(l.read().unwrap_or_else(|e| e.into_inner()).clone()),
+        v => Err(argument_error(function, "a list", 0, v)),
+    }
+}
+
+/// an item of the list
+fn choice(args: &[Value]) -> Result<Value, String> {
+    let items = items("random::choice", args)?;
+    let i = match items.len() {
+        0 => return Err("random::choice expects a list that is not empty".to_string()),
+        n => draw(|g| g.random_range(0..n)),
+    };
+    Ok(items[i].clone())
+}
+
+/// `count` items of the list, each at most once, in a random order
+fn sample(args: &[Value]) -> Result<Value, String> {
+    let mut items = items("random::sample", args)?;
+    let count = int("random::sample", args, 1)?;
+    if count < 0 || count as usize > items.len() {
+        return Err(format!(
+            "random::sample cannot take {} items from a list of {}",
+            count,
+            items.len()
+        ));
+    }
+    let picked = draw(|g| items.partial_shuffle(g, count as usize).0.to_vec());
+    Ok(Value::list(picked))
+}
+
+/// put the items of the list in a random order, in place
+fn shuffle(args: &[Value]) -> Result<Value, String> {
+    let Value::List(l) = &args[0] else {
+        return Err(argument_error("random::shuffle", "a list", 0, &args[0]));
+    };
+    let mut items = l.write().unwrap_or_else(|e| e.into_inner());
+    draw(|g| items.shuffle(g));
+    Ok(Value::None)
+}
+
+/// `count` bytes from the secure source
+fn secure_bytes(function: &str, args: &[Value]) -> Result<Vec<u8>, String> {
+    let count = int(function, args, 0)?;
+    if !(0..=MAX_BYTES).contains(&count) {
+        return Err(format!(
+            "{} expects between 0 and {} bytes, found {}",
+            function, MAX_BYTES, count
+        ));
+    }
+    let mut bytes = vec![0; count as usize];
+    if let Some(run) = deterministic::current() {
+        run.generator().fill(&mut bytes[..]);
+        return Ok(bytes);
+    }
+    OsRng
+        .try_fill_bytes(&mut bytes)
+        .map_err(|e| format!("{} cannot read the secure source: {}", function, e))?;
+    Ok(bytes)
+}
+
+/// a list of that many secure bytes, ints from 0 to 255
+fn bytes(args: &[Value]) -> Result<Value, String> {
+    let bytes = secure_bytes("random::bytes", args)?;
+    Ok(Value::list(
+        bytes.into_iter().map(|b| Value::Int(b as i64)).collect(),
+    ))
+}
+
+/// that many secure bytes written in hexadecimal, a string twice as long
+fn token(args: &[Value]) -> Result<Value, String> {
+    let bytes = secure_bytes("random::token", args)?;
+    let hex: String = bytes.iter().map(|b| format!("{:02x}", b)).collect();
+    Ok(Value::from(hex.as_str()))
+}
@@ -0,0 +1,127 @@
+//! The `regex` module, regular expressions.
+//!
+//! `regex::compile` returns a pattern, a value that can be stored and passed
+//! around like any other. The other functions take either a pattern or a
+//! string, which is then compiled just for the call, so scripts matching the
+//! same expression again and again had better compile it once.
+//!
+//! A match is a map of what each group captured: the key `0` is the text of
+//! the whole match, the ints from `1` are the groups in the order they open,
+//! and named groups are under their name too. Groups that took no part in
+//! the match are `none`.
+
+use std::sync::Arc;
+
+use indexmap::IndexMap;
+use regex::{Captures, Regex};
+
+use crate::values::{Builtin, Key, Value};
+
+use super::{argument_error, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "compile",
+        arity: Some(1),
+        function: compile,
+        parameters: "pattern",
+        doc: "a pattern to match with, compiled once",
+    },
+    Builtin {
+        name: "find",
+        arity: Some(2),
+        function: find,
+        parameters: "pattern, s",
+        doc: "the first match, a map of what each group captured, or `none`",
+    },
+    Builtin {
+        name: "find_all",
+        arity: Some(2),
+        function: find_all,
+        parameters: "pattern, s",
+        doc: "all the matches that don't overlap, from left to right",
+    },
+    Builtin {
+        name: "matches",
+        arity: Some(2),
+        function: matches,
+        parameters: "pattern, s",
+        doc: "whether the string contains a match",
+    },
+    Builtin {
+        name: "replace",
+        arity: Some(3),
+        function: replace,
+        parameters: "pattern, s, replacement",
+        doc: "replaces every match, `$1` or `${name}` in the replacement stand for what the group captured",
+    },
+];
+
+fn new(pattern: &str) -> Result<Regex, String> {
+    Regex::new(pattern).map_err(|e| format!("invalid regular expression: {}", e))
+}
+
+/// the argument at the given index, a pattern or a string to compile
+fn pattern(function: &str, args: &[Value], i: usize) -> Result<Arc<Regex>, String> {
+    match &args[i] {
+        Value::Regex(r) => Ok(r.clone()),
+        Value::String(s) => Ok(Arc::new(new(s)?)),
+        v => Err(argument_error(function, "a regex or a string", i, v)),
+    }
+}
+
+fn compile(args: &[Value]) -> Result<Value, String> {
+    let pattern = string("regex::compile", args, 0)?;
+    Ok(Value::Regex(Arc::new(new(pattern)?)))
+}
+
+/// whether the string contains a match, anchor the pattern with `^` and `$`
+/// to match all of it
+fn matches(args: &[Value]) -> Result<Value, String> {
+    let regex = pattern("regex::matches", args, 0)?;
+    let s = string("regex::matches", args, 1)?;
+    Ok(Value::Bool(regex.is_match(s)))
+}
+
+/// the first match, or `none`
+fn find(args: &[Value]) -> Result<Value, String> {
+    let regex = pattern("regex::find", args, 0)?;
+    let s = string("regex::find", args, 1)?;
+    Ok(regex
+        .captures(s)
+        .map_or(Value::None, |c| captured(&regex, &c)))
+}
+
+/// all the matches, that don't overlap, from left to right
+fn find_all(args: &[Value]) -> Result<Value, String> {
+    let regex = pattern("regex::find_all", args, 0)?;
+    let s = string("regex::find_all", args, 1)?;
+    Ok(Value::list(
+        regex
+            .captures_iter(s)
+            .map(|c| captured(&regex, &c))
+            .collect(),
+    ))
+}
+
+/// Replace every match, `$1` or `${name}` in the replacement stand for what
+/// the group captured, and `$$` for a dollar sign. Raw strings, in single
+/// quotes, keep `${name}` from being interpolated.
+fn replace(args: &[Value]) -> Result<Value, String> {
+    let regex = pattern("regex::replace", args, 0)?;
+    let s = string("regex::replace", args, 1)?;
+    let replacement = string("regex::replace", args, 2)?;
+    Ok(Value::from(regex.replace_all(s, replacement).as_ref()))
+}
+
+fn captured(regex: &Regex, captures: &Captures) -> Value {
+    let text = |m: Option<regex::Match>| m.map_or(Value::None, |m| Value::from(m.as_str()));
+    let mut groups = IndexMap::new();
+    for (i, name) in regex.capture_names().enumerate() {
+        groups.insert(Key::Int(i as i64), text(captures.get(i)));
+        if let Some(name) = name {
+            groups.insert(Key::String(name.into()), text(captures.get(i)));
+        }
+    }
+    Value::map(groups)
+}
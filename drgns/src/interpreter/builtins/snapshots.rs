@@ -0,0 +1,121 @@
+//! Snapshots, the golden files of `drgns test`. `expect_snapshot(name,
+//! value)` compares a value with the one stored under its name for the test
+//! file, a string as its text and any other value as its `repr`, so that
+//! long outputs can be checked without writing them out in the test.
+//!
+//! The snapshots of `dir/math_test.drgns` are the files
+//! `dir/snapshots/math_test/<name>.snap`. With `drgns test --update` they
+//! are written rather than compared, to record new ones or accept changes.
+
+use std::{
+    path::PathBuf,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Mutex,
+    },
+};
+
+use crate::values::Value;
+
+use super::{fs::io_error, string};
+
+/// Where the snapshots of the test file being run are, and whether they are
+/// written rather than compared
+struct Snapshots {
+    dir: PathBuf,
+    update: bool,
+}
+
+static SNAPSHOTS: Mutex<Option<Snapshots>> = Mutex::new(None);
+
+static UPDATED: AtomicUsize = AtomicUsize::new(0);
+
+/// Keep the snapshots of the tests that follow in `dir`, or nowhere outside
+/// of a test run
+pub fn set_directory(dir: Option<PathBuf>, update: bool) {
+    *SNAPSHOTS.lock().unwrap_or_else(|e| e.into_inner()) = dir.map(|dir| Snapshots { dir, update });
+}
+
+/// the snapshots that were written since the start
+pub fn updated() -> usize {
+    UPDATED.load(Ordering::Relaxed)
+}
+
+/// `expect_snapshot(name, value)`, fails unless the value is the one of the
+/// snapshot, or writes it when updating
+pub fn expect(args: &[Value]) -> Result<Value, String> {
+    let name = string("expect_snapshot", args, 0)?;
+    if name.starts_with('.')
+        || !name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "-_.".contains(c))
+    {
+        return Err(format!(
+            "expect_snapshot expects a name made of letters, digits, '-', '_' and '.', found '{}'",
+            name
+        ));
+    }
+    let found = match &args[1] {
+        Value::String(s) => s.to_string(),
+        v => v.repr(),
+    };
+    let snapshots = SNAPSHOTS.lock().unwrap_or_else(|e| e.into_inner());
+    let Some(snapshots) = snapshots.as_ref() else {
+        return Err("expect_snapshot can only be used in the tests of drgns test".to_string());
+    };
+    let path = snapshots.dir.join(format!("{}.snap", name));
+    let shown = path.display().to_string();
+    if snapshots.update {
+        std::fs::create_dir_all(&snapshots.dir)
+            .and_then(|_| std::fs::write(&path, &found))
+            .map_err(|e| io_error("expect_snapshot cannot write", &shown, e))?;
+        UPDATED.fetch_add(1, Ordering::Relaxed);
+        return Ok(Value::None);
+    }
+    let expected = match std::fs::read_to_string(&path) {
+        Ok(expected) => expected,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+            return Err(format!(
+                "snapshot '{}' was not recorded, drgns test --update writes it to '{}'",
+                name, shown
+            ))
+        }
+        Err(e) => return Err(io_error("expect_snapshot cannot read", &shown, e)),
+    };
+    match difference(&expected, &found) {
+        None => Ok(Value::None),
+        Some((line, expected, found)) => Err(format!(
+            "snapshot '{}' doesn't match from line {}, expected {}, found {}",
+            name,
+            line,
+            line_repr(expected),
+            line_repr(found)
+        )),
+    }
+}
+
+/// the first line the texts differ on, counting from 1, and what each has
+/// there, `None` past its end, or nothing if they are the same
+fn difference<'a>(
+    expected: &'a str,
+    found: &'a str,
+) -> Option<(usize, Option<&'a str>, Option<&'a str>)> {
+    if expected == found {
+        return None;
+    }
+    let mut expected_lines = expected.split('\n');
+    let mut found_lines = found.split('\n');
+    let mut line = 1;
+    loop {
+        match (expected_lines.next(), found_lines.next()) {
+            (Some(e), Some(f)) if e == f => line += 1,
+            (e, f) => return Some((line, e, f)),
+        }
+    }
+}
+
+fn line_repr(line: Option<&str>) -> String {
+    line.map_or("the end of the text".to_string(), |l| {
+        Value::String(l.into()).repr()
+    })
+}
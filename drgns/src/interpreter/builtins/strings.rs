@@ -0,0 +1,407 @@
+//! The `strings` module, common text operations.
+//!
+//! Like the rest of the language, the functions count in code points, the
+//! characters of a string. What a reader sees as one character may be made of
+//! several, such as a letter and a combining accent, which `graphemes` keeps
+//! together.
+
+use std::sync::{Arc, Mutex, MutexGuard};
+
+use unicode_normalization::UnicodeNormalization;
+use unicode_segmentation::UnicodeSegmentation;
+
+use crate::values::{Builtin, Value};
+
+use super::{argument_error, check_count, int, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "build",
+        arity: Some(1),
+        function: build,
+        parameters: "builder",
+        doc: "the text of a string builder so far",
+    },
+    Builtin {
+        name: "builder",
+        arity: None,
+        function: builder,
+        parameters: "text = \"\"",
+        doc: "a string builder starting with the text, to `push` strings to",
+    },
+    Builtin {
+        name: "contains",
+        arity: Some(2),
+        function: contains,
+        parameters: "s, part",
+        doc: "whether the string contains the other",
+    },
+    Builtin {
+        name: "ends_with",
+        arity: Some(2),
+        function: ends_with,
+        parameters: "s, suffix",
+        doc: "whether the string ends with the suffix",
+    },
+    Builtin {
+        name: "format",
+        arity: None,
+        function: format,
+        parameters: "template, ..arguments",
+        doc: "replaces each `{}` in the template with the next argument, `{{` and `}}` stand for braces",
+    },
+    Builtin {
+        name: "grapheme_len",
+        arity: Some(1),
+        function: grapheme_len,
+        parameters: "s",
+        doc: "the number of characters as a reader sees them, see `graphemes`",
+    },
+    Builtin {
+        name: "graphemes",
+        arity: Some(1),
+        function: graphemes,
+        parameters: "s",
+        doc: "the characters as a reader sees them, extended grapheme clusters",
+    },
+    Builtin {
+        name: "join",
+        arity: Some(2),
+        function: join,
+        parameters: "parts, separator",
+        doc: "joins a list of strings with a separator",
+    },
+    Builtin {
+        name: "normalize",
+        arity: None,
+        function: normalize,
+        parameters: "s, form = \"NFC\"",
+        doc: "the string in a Unicode normalization form, `\"NFC\"`, `\"NFD\"`, `\"NFKC\"` or `\"NFKD\"`",
+    },
+    Builtin {
+        name: "pad_end",
+        arity: None,
+        function: pad_end,
+        parameters: "s, width, fill = \" \"",
+        doc: "the string followed by the character until it is `width` characters long",
+    },
+    Builtin {
+        name: "pad_start",
+        arity: None,
+        function: pad_start,
+        parameters: "s, width, fill = \" \"",
+        doc: "the string preceded by the character until it is `width` characters long",
+    },
+    Builtin {
+        name: "replace",
+        arity: Some(3),
+        function: replace,
+        parameters: "s, from, to",
+        doc: "replaces every occurrence of a string",
+    },
+    Builtin {
+        name: "split",
+        arity: Some(2),
+        function: split,
+        parameters: "s, separator",
+        doc: "splits at every occurrence of the separator, an empty one splits the string into its characters",
+    },
+    Builtin {
+        name: "starts_with",
+        arity: Some(2),
+        function: starts_with,
+        parameters: "s, prefix",
+        doc: "whether the string starts with the prefix",
+    },
+    Builtin {
+        name: "to_lower",
+        arity: Some(1),
+        function: to_lower,
+        parameters: "s",
+        doc: "the string in lowercase",
+    },
+    Builtin {
+        name: "to_upper",
+        arity: Some(1),
+        function: to_upper,
+        parameters: "s",
+        doc: "the string in uppercase",
+    },
+    Builtin {
+        name: "trim",
+        arity: Some(1),
+        function: trim,
+        parameters: "s",
+        doc: "the string without whitespace at either end",
+    },
+    Builtin {
+        name: "trim_end",
+        arity: Some(1),
+        function: trim_end,
+        parameters: "s",
+        doc: "the string without whitespace at the end",
+    },
+    Builtin {
+        name: "trim_start",
+        arity: Some(1),
+        function: trim_start,
+        parameters: "s",
+        doc: "the string without whitespace at the start",
+    },
+];
+
+/// A string made by adding text at its end in place, with `push`. Adding
+/// takes the time of the text added, where `s ++ piece` copies both strings
+/// into a new one, which for a string built a piece at a time in a loop takes
+/// time growing with the square of its length.
+#[derive(Debug, Default)]
+pub struct StringBuilder(Mutex<String>);
+
+impl StringBuilder {
+    pub fn text(&self) -> MutexGuard<'_, String> {
+        self.0.lock().unwrap_or_else(|e| e.into_inner())
+    }
+}
+
+/// `builder()` or `builder(text)`, a string builder starting with the text
+fn builder(args: &[Value]) -> Result<Value, String> {
+    check_count("strings::builder", args, 0)?;
+    let text = match args.first() {
+        Some(_) => string("strings::builder", args, 0)?,
+        None => "",
+    };
+    let builder = StringBuilder(Mutex::new(text.to_owned()));
+    Ok(Value::StringBuilder(Arc::new(builder)))
+}
+
+/// the text of a string builder so far, which it keeps adding to
+fn build(args: &[Value]) -> Result<Value, String> {
+    let Value::StringBuilder(b) = &args[0] else {
+        return Err(argument_error(
+            "strings::build",
+            "a string builder",
+            0,
+            &args[0],
+        ));
+    };
+    Ok(Value::from(b.text().as_str()))
+}
+
+fn contains(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::contains", args, 0)?;
+    let pattern = string("strings::contains", args, 1)?;
+    Ok(Value::Bool(s.contains(pattern)))
+}
+
+fn starts_with(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::starts_with", args, 0)?;
+    let prefix = string("strings::starts_with", args, 1)?;
+    Ok(Value::Bool(s.starts_with(prefix)))
+}
+
+fn ends_with(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::ends_with", args, 0)?;
+    let suffix = string("strings::ends_with", args, 1)?;
+    Ok(Value::Bool(s.ends_with(suffix)))
+}
+
+/// split at every occurrence of the separator, an empty separator splits the
+/// string into its characters
+fn split(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::split", args, 0)?;
+    let separator = string("strings::split", args, 1)?;
+    let parts = match separator {
+        "" => s.chars().map(Value::from).collect(),
+        sep => s.split(sep).map(Value::from).collect(),
+    };
+    Ok(Value::list(parts))
+}
+
+/// the characters as a reader sees them, extended grapheme clusters
+fn graphemes(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::graphemes", args, 0)?;
+    Ok(Value::list(s.graphemes(true).map(Value::from).collect()))
+}
+
+fn grapheme_len(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::grapheme_len", args, 0)?;
+    Ok(Value::Int(s.graphemes(true).count() as i64))
+}
+
+/// `normalize(s, form)`, the string in a Unicode normalization form,
+/// `"NFC"` if it is left out
+fn normalize(args: &[Value]) -> Result<Value, String> {
+    check_count("strings::normalize", args, 1)?;
+    let s = string("strings::normalize", args, 0)?;
+    let form = match args.get(1) {
+        Some(_) => string("strings::normalize", args, 1)?,
+        None => "NFC",
+    };
+    let normalized: String = match form {
+        "NFC" => s.nfc().collect(),
+        "NFD" => s.nfd().collect(),
+        "NFKC" => s.nfkc().collect(),
+        "NFKD" => s.nfkd().collect(),
+        f => {
+            return Err(format!(
+                "strings::normalize expects the form \"NFC\", \"NFD\", \"NFKC\" or \"NFKD\", found {:?}",
+                f
+            ))
+        }
+    };
+    Ok(Value::from(normalized.as_str()))
+}
+
+/// join a list of strings with a separator
+fn join(args: &[Value]) -> Result<Value, String> {
+    let Value::List(items) = &args[0] else {
+        return Err(argument_error("strings::join", "a list", 0, &args[0]));
+    };
+    let separator = string("strings::join", args, 1)?;
+    let items = items.read().unwrap_or_else(|e| e.into_inner());
+    let mut parts = Vec::with_capacity(items.len());
+    for item in items.iter() {
+        match item {
+            Value::String(s) => parts.push(s.to_string()),
+            v => {
+                return Err(format!(
+                    "strings::join expects a list of strings, found {} in the list",
+                    v.type_name()
+                ))
+            }
+        }
+    }
+    Ok(Value::from(parts.join(separator).as_str()))
+}
+
+fn replace(args: &[Value]) -> Result<Value, String> {
+    let s = string("strings::replace", args, 0)?;
+    let from = string("strings::replace", args, 1)?;
+    let to = string("strings::replace", args, 2)?;
+    if from.is_empty() {
+        return Err("strings::replace cannot replace an empty string".to_string());
+    }
+    Ok(Value::from(s.replace(from, to).as_str()))
+}
+
+fn to_lower(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(
+        string("strings::to_lower", args, 0)?
+            .to_lowercase()
+            .as_str(),
+    ))
+}
+
+fn to_upper(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(
+        string("strings::to_upper", args, 0)?
+            .to_uppercase()
+            .as_str(),
+    ))
+}
+
+fn trim(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(string("strings::trim", args, 0)?.trim()))
+}
+
+fn trim_start(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(
+        string("strings::trim_start", args, 0)?.trim_start(),
+    ))
+}
+
+fn trim_end(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::from(
+        string("strings::trim_end", args, 0)?.trim_end(),
+    ))
+}
+
+/// the padding needed to make the string as wide as asked, `pad_start(s,
+/// width)` pads with spaces, `pad_start(s, width, fill)` with the given
+/// character
+fn padding(function: &str, args: &[Value]) -> Result<String, String> {
+    if !(2..=3).contains(&args.len()) {
+        return Err(format!(
+            "{} expects 2 or 3 arguments, found {}",
+            function,
+            args.len()
+        ));
+    }
+    let s = string(function, args, 0)?;
+    let width = int(function, args, 1)?;
+    let fill = match args.get(2) {
+        Some(_) => {
+            let fill = string(function, args, 2)?;
+            let mut chars = fill.chars();
+            match (chars.next(), chars.next()) {
+                (Some(c), None) => c,
+                _ => {
+                    return Err(format!(
+                        "{} expects a single character to pad with",
+                        function
+                    ))
+                }
+            }
+        }
+        None => ' ',
+    };
+    let missing = (width.max(0) as usize).saturating_sub(s.chars().count());
+    Ok(fill.to_string().repeat(missing))
+}
+
+fn pad_start(args: &[Value]) -> Result<Value, String> {
+    let padding = padding("strings::pad_start", args)?;
+    let s = string("strings::pad_start", args, 0)?;
+    Ok(Value::from(format!("{}{}", padding, s).as_str()))
+}
+
+fn pad_end(args: &[Value]) -> Result<Value, String> {
+    let padding = padding("strings::pad_end", args)?;
+    let s = string("strings::pad_end", args, 0)?;
+    Ok(Value::from(format!("{}{}", s, padding).as_str()))
+}
+
+/// replace each `{}` in the template with the next argument, `{{` and `}}`
+/// stand for literal braces
+fn format(args: &[Value]) -> Result<Value, String> {
+    let Some(_) = args.first() else {
+        return Err("strings::format expects at least 1 argument, found 0".to_string());
+    };
+    let template = string("strings::format", args, 0)?;
+    let mut values = args[1..].iter();
+    let mut placeholders = 0;
+    let mut out = String::with_capacity(template.len());
+    let mut chars = template.chars().peekable();
+    while let Some(c) = chars.next() {
+        match (c, chars.peek()) {
+            ('{', Some('{')) | ('}', Some('}')) => {
+                chars.next();
+                out.push(c);
+            }
+            ('{', Some('}')) => {
+                chars.next();
+                placeholders += 1;
+                if let Some(v) = values.next() {
+                    out.push_str(&v.to_string());
+                }
+            }
+            ('{', _) | ('}', _) => {
+                return Err(format!(
+                    "strings::format found an unmatched '{}' in the template, use '{}{}' for a literal one",
+                    c, c, c
+                ))
+            }
+            (c, _) => out.push(c),
+        }
+    }
+    if placeholders != args.len() - 1 {
+        return Err(format!(
+            "strings::format template has {} placeholder{}, found {} argument{}",
+            placeholders,
+            if placeholders == 1 { "" } else { "s" },
+            args.len() - 1,
+            if args.len() == 2 { "" } else { "s" },
+        ));
+    }
+    Ok(Value::from(out.as_str()))
+}
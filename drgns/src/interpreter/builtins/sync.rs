@@ -0,0 +1,365 @@
+//! The `sync` module, for tasks sharing values to coordinate.
+//!
+//! Mutexes belong to the task that locked them: relocking one is an error
+//! rather than a task waiting for itself forever, only the task holding a
+//! mutex can unlock it, and a task that ends while holding some unlocks them.
+
+use std::{
+    cell::RefCell,
+    sync::{
+        atomic::{AtomicI64, Ordering},
+        Arc, Condvar, Mutex, MutexGuard,
+    },
+    thread::{self, ThreadId},
+    time::Duration,
+};
+
+use web_time::Instant;
+
+use crate::values::{Builtin, Value};
+
+use super::{argument_error, check_count, int, number};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "add",
+        arity: None,
+        function: add,
+        parameters: "target, n = 1",
+        doc: "adds to the count of a wait group, or to an atomic, returning its old value",
+    },
+    Builtin {
+        name: "atomic",
+        arity: None,
+        function: atomic,
+        parameters: "value = 0",
+        doc: "an int that tasks can change at the same time",
+    },
+    Builtin {
+        name: "compare_swap",
+        arity: Some(3),
+        function: compare_swap,
+        parameters: "atomic, expected, new",
+        doc: "stores the new value only if the atomic holds the expected one, returns whether it did",
+    },
+    Builtin {
+        name: "done",
+        arity: Some(1),
+        function: done,
+        parameters: "group",
+        doc: "the task calling is done, the count of the wait group goes down by one",
+    },
+    Builtin {
+        name: "load",
+        arity: Some(1),
+        function: load,
+        parameters: "atomic",
+        doc: "the value of the atomic",
+    },
+    Builtin {
+        name: "lock",
+        arity: Some(1),
+        function: lock,
+        parameters: "mutex",
+        doc: "waits for the mutex to be unlocked and locks it for the task calling",
+    },
+    Builtin {
+        name: "mutex",
+        arity: Some(0),
+        function: mutex,
+        parameters: "",
+        doc: "a new mutex, unlocked",
+    },
+    Builtin {
+        name: "store",
+        arity: Some(2),
+        function: store,
+        parameters: "atomic, value",
+        doc: "sets the value of the atomic",
+    },
+    Builtin {
+        name: "swap",
+        arity: Some(2),
+        function: swap,
+        parameters: "atomic, value",
+        doc: "stores a new value and returns the old one",
+    },
+    Builtin {
+        name: "try_lock",
+        arity: Some(1),
+        function: try_lock,
+        parameters: "mutex",
+        doc: "locks the mutex if no task holds it, returns whether it did",
+    },
+    Builtin {
+        name: "unlock",
+        arity: Some(1),
+        function: unlock,
+        parameters: "mutex",
+        doc: "unlocks a mutex the task calling holds",
+    },
+    Builtin {
+        name: "wait",
+        arity: None,
+        function: wait,
+        parameters: "group, timeout = none",
+        doc: "waits until the count of the wait group is 0, returns whether it got there before the timeout in seconds",
+    },
+    Builtin {
+        name: "wait_group",
+        arity: Some(0),
+        function: wait_group,
+        parameters: "",
+        doc: "a new wait group, counting 0 tasks",
+    },
+];
+
+fn guard<T>(m: &Mutex<T>) -> MutexGuard<'_, T> {
+    m.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+/// A mutex of a script, locked and unlocked by calls rather than held for a
+/// scope
+#[derive(Debug, Default)]
+pub struct Lock {
+    /// the thread of the task holding it
+    owner: Mutex<Option<ThreadId>>,
+    unlocked: Condvar,
+}
+
+thread_local! {
+    /// the mutexes the task running on the thread holds
+    static HELD: RefCell<Vec<Arc<Lock>>> = const { RefCell::new(vec![]) };
+}
+
+impl Lock {
+    fn release(&self) {
+        *guard(&self.owner) = None;
+        self.unlocked.notify_one();
+    }
+}
+
+/// Unlock the mutexes the task running on this thread still holds, once it
+/// ends
+pub fn release_held() {
+    for lock in HELD.with(|h| h.take()) {
+        lock.release();
+    }
+}
+
+/// Waits for a number of tasks, which each call `sync::done` when they end
+#[derive(Debug, Default)]
+pub struct WaitGroup {
+    count: Mutex<i64>,
+    finished: Condvar,
+}
+
+impl WaitGroup {
+    pub fn count(&self) -> i64 {
+        *guard(&self.count)
+    }
+
+    fn add(&self, function: &str, delta: i64) -> Result<(), String> {
+        let mut count = guard(&self.count);
+        match count.checked_add(delta) {
+            Some(n) if n >= 0 => *count = n,
+            _ => {
+                return Err(format!(
+                    "{} cannot take the count of a wait group from {} to {}",
+                    function,
+                    *count,
+                    *count as i128 + delta as i128
+                ))
+            }
+        }
+        if *count == 0 {
+            self.finished.notify_all();
+        }
+        Ok(())
+    }
+}
+
+/// An int that tasks can change without a mutex, each change happens at
+/// once for all of them
+#[derive(Debug, Default)]
+pub struct Atomic(pub AtomicI64);
+
+fn lock_argument<'a>(function: &str, args: &'a [Value]) -> Result<&'a Arc<Lock>, String> {
+    match &args[0] {
+        Value::Mutex(m) => Ok(m),
+        v => Err(argument_error(function, "a mutex", 0, v)),
+    }
+}
+
+fn group<'a>(function: &str, args: &'a [Value]) -> Result<&'a Arc<WaitGroup>, String> {
+    match &args[0] {
+        Value::WaitGroup(g) => Ok(g),
+        v => Err(argument_error(function, "a wait group", 0, v)),
+    }
+}
+
+fn atomic_argument<'a>(function: &str, args: &'a [Value]) -> Result<&'a AtomicI64, String> {
+    match &args[0] {
+        Value::Atomic(a) => Ok(&a.0),
+        v => Err(argument_error(function, "an atomic", 0, v)),
+    }
+}
+
+fn mutex(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::Mutex(Arc::default()))
+}
+
+/// wait for the mutex to be unlocked and lock it for the task calling
+fn lock(args: &[Value]) -> Result<Value, String> {
+    let lock = lock_argument("sync::lock", args)?;
+    let me = thread::current().id();
+    let mut owner = guard(&lock.owner);
+    if *owner == Some(me) {
+        return Err("sync::lock expects a mutex the task doesn't hold already".to_string());
+    }
+    while owner.is_some() {
+        owner = lock.unlocked.wait(owner).unwrap_or_else(|e| e.into_inner());
+    }
+    *owner = Some(me);
+    HELD.with(|h| h.borrow_mut().push(lock.clone()));
+    Ok(Value::None)
+}
+
+/// lock the mutex if no task holds it, returns whether it did
+fn try_lock(args: &[Value]) -> Result<Value, String> {
+    let lock = lock_argument("sync::try_lock", args)?;
+    let mut owner = guard(&lock.owner);
+    if owner.is_some() {
+        return Ok(Value::Bool(false));
+    }
+    *owner = Some(thread::current().id());
+    HELD.with(|h| h.borrow_mut().push(lock.clone()));
+    Ok(Value::Bool(true))
+}
+
+fn unlock(args: &[Value]) -> Result<Value, String> {
+    let lock = lock_argument("sync::unlock", args)?;
+    if *guard(&lock.owner) != Some(thread::current().id()) {
+        return Err("sync::unlock expects a mutex the task holds".to_string());
+    }
+    HELD.with(|h| h.borrow_mut().retain(|l| !Arc::ptr_eq(l, lock)));
+    lock.release();
+    Ok(Value::None)
+}
+
+fn wait_group(_: &[Value]) -> Result<Value, String> {
+    Ok(Value::WaitGroup(Arc::default()))
+}
+
+/// the task calling is done, the count of the wait group goes down by one
+fn done(args: &[Value]) -> Result<Value, String> {
+    group("sync::done", args)?.add("sync::done", -1)?;
+    Ok(Value::None)
+}
+
+/// `wait(group)` or `wait(group, timeout)`, waits until the count of the
+/// wait group is 0, returns whether it got there before the timeout in
+/// seconds passed
+fn wait(args: &[Value]) -> Result<Value, String> {
+    check_count("sync::wait", args, 1)?;
+    let group = group("sync::wait", args)?;
+    let deadline = match args.get(1) {
+        Some(_) => {
+            let seconds = number("sync::wait", args, 1)?;
+            let timeout = Duration::try_from_secs_f64(seconds)
+                .map_err(|_| format!("sync::wait cannot wait for {} seconds", seconds))?;
+            Some(Instant::now() + timeout)
+        }
+        None => None,
+    };
+    let mut count = guard(&group.count);
+    while *count > 0 {
+        count = match deadline {
+            Some(d) => {
+                let Some(left) = d.checked_duration_since(Instant::now()) else {
+                    return Ok(Value::Bool(false));
+                };
+                group
+                    .finished
+                    .wait_timeout(count, left)
+                    .unwrap_or_else(|e| e.into_inner())
+                    .0
+            }
+            None => group
+                .finished
+                .wait(count)
+                .unwrap_or_else(|e| e.into_inner()),
+        };
+    }
+    Ok(Value::Bool(true))
+}
+
+/// `atomic()` or `atomic(value)`, an int starting at the value, or 0
+fn atomic(args: &[Value]) -> Result<Value, String> {
+    check_count("sync::atomic", args, 0)?;
+    let value = match args.first() {
+        Some(_) => int("sync::atomic", args, 0)?,
+        None => 0,
+    };
+    Ok(Value::Atomic(Arc::new(Atomic(AtomicI64::new(value)))))
+}
+
+/// `add(target)` or `add(target, n)`, adds `n`, or 1, to the count of a wait
+/// group, or to an atomic, for which it returns the new value
+fn add(args: &[Value]) -> Result<Value, String> {
+    check_count("sync::add", args, 1)?;
+    let n = match args.get(1) {
+        Some(_) => int("sync::add", args, 1)?,
+        None => 1,
+    };
+    match &args[0] {
+        Value::WaitGroup(g) => {
+            g.add("sync::add", n)?;
+            Ok(Value::None)
+        }
+        Value::Atomic(a) => {
+            let old =
+                a.0.fetch_update(Ordering::SeqCst, Ordering::SeqCst, |v| v.checked_add(n))
+                    .map_err(|v| format!("sync::add cannot add {} to {}, it overflows", n, v))?;
+            Ok(Value::Int(old + n))
+        }
+        v => Err(argument_error(
+            "sync::add",
+            "a wait group or an atomic",
+            0,
+            v,
+        )),
+    }
+}
+
+fn load(args: &[Value]) -> Result<Value, String> {
+    Ok(Value::Int(
+        atomic_argument("sync::load", args)?.load(Ordering::SeqCst),
+    ))
+}
+
+fn store(args: &[Value]) -> Result<Value, String> {
+    let a = atomic_argument("sync::store", args)?;
+    a.store(int("sync::store", args, 1)?, Ordering::SeqCst);
+    Ok(Value::None)
+}
+
+/// store a new value and return the old one
+fn swap(args: &[Value]) -> Result<Value, String> {
+    let a = atomic_argument("sync::swap", args)?;
+    Ok(Value::Int(
+        a.swap(int("sync::swap", args, 1)?, Ordering::SeqCst),
+    ))
+}
+
+/// `compare_swap(atomic, expected, new)` stores the new value only if the
+/// atomic holds the expected one, returns whether it did
+fn compare_swap(args: &[Value]) -> Result<Value, String> {
+    let a = atomic_argument("sync::compare_swap", args)?;
+    let expected = int("sync::compare_swap", args, 1)?;
+    let new = int("sync::compare_swap", args, 2)?;
+    let swapped = a
+        .compare_exchange(expected, new, Ordering::SeqCst, Ordering::SeqCst)
+        .is_ok();
+    Ok(Value::Bool(swapped))
+}
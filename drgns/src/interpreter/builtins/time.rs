@@ -0,0 +1,362 @@
+//! The `time` module, clocks, dates and durations.
+//!
+//! Times are floats of seconds since the Unix epoch, and durations floats of
+//! seconds, so they are added and compared with the usual operators:
+//! `time::now() + 2 * time::hour`. Dates only come into play to read or
+//! write a time, and are then in a time zone: `"UTC"`, `"local"`, the zone
+//! of the computer and the default, or a fixed offset such as `"+02:00"`.
+//!
+//! Layouts are the ones of `strftime`: `"%Y-%m-%d %H:%M:%S"` is a date like
+//! `2024-05-17 09:30:00`, `%z` the offset from UTC and `%%` a percent sign.
+//!
+//! In a deterministic run, the clocks start at the Unix epoch and only move
+//! forward by the time scripts sleep, and the local zone is UTC.
+
+use std::{
+    fmt::Write,
+    sync::OnceLock,
+    time::Duration,
+};
+
+use chrono::{
+    format::{Item, StrftimeItems},
+    DateTime, Datelike, FixedOffset, Local, NaiveDate, NaiveDateTime, Offset, TimeZone, Timelike,
+    Utc,
+};
+use indexmap::IndexMap;
+use web_time::{Instant, SystemTime, UNIX_EPOCH};
+
+use crate::{
+    interpreter::{deterministic, interrupt, limits},
+    values::{Builtin, Key, Value},
+};
+
+use super::{check_count, number, string};
+
+pub const FUNCTIONS: &[Builtin] = &[
+    Builtin {
+        name: "date",
+        arity: None,
+        function: date,
+        parameters: "time, zone = \"local\"",
+        doc: "the parts of the date of a time as a map of ints, `year`, `month`, `day`, `hour` and so on",
+    },
+    Builtin {
+        name: "format",
+        arity: None,
+        function: format,
+        parameters: "time, layout, zone = \"local\"",
+        doc: "the time written with a `strftime` layout, such as `\"%Y-%m-%d\"`",
+    },
+    Builtin {
+        name: "format_duration",
+        arity: Some(1),
+        function: format_duration,
+        parameters: "seconds",
+        doc: "a duration in hours, minutes and seconds, such as `1h2m3.5s`",
+    },
+    Builtin {
+        name: "monotonic",
+        arity: Some(0),
+        function: monotonic,
+        parameters: "",
+        doc: "seconds since some point in the past, which never go backwards, to measure how long things take",
+    },
+    Builtin {
+        name: "now",
+        arity: Some(0),
+        function: now,
+        parameters: "",
+        doc: "the current time, in seconds since the Unix epoch",
+    },
+    Builtin {
+        name: "parse",
+        arity: None,
+        function: parse,
+        parameters: "text, layout, zone = \"local\"",
+        doc: "the time written in the text with a `strftime` layout",
+    },
+    Builtin {
+        name: "sleep",
+        arity: Some(1),
+        function: sleep,
+        parameters: "seconds",
+        doc: "waits for that many seconds",
+    },
+];
+
+/// durations in seconds
+pub const CONSTANTS: &[(&str, f64)] = &[
+    ("day", 86400.0),
+    ("hour", 3600.0),
+    ("millisecond", 0.001),
+    ("minute", 60.0),
+    ("second", 1.0),
+];
+
+/// The time as `time::now` tells it, for the modules writing it
+pub(super) fn clock() -> DateTime<Utc> {
+    match deterministic::current() {
+        Some(run) => DateTime::from_timestamp_nanos(run.slept().as_nanos() as i64),
+        None => Utc::now(),
+    }
+}
+
+fn now(_: &[Value]) -> Result<Value, String> {
+    if let Some(run) = deterministic::current() {
+        return Ok(Value::Float(run.slept().as_secs_f64()));
+    }
+    let since_epoch = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_err(|_| "time::now found the clock set before 1970".to_string())?;
+    Ok(Value::Float(since_epoch.as_secs_f64()))
+}
+
+/// Seconds since some point in the past, which never go backwards even when
+/// the clock of the computer is changed, to measure how long things take
+fn monotonic(_: &[Value]) -> Result<Value, String> {
+    if let Some(run) = deterministic::current() {
+        return Ok(Value::Float(run.slept().as_secs_f64()));
+    }
+    static START: OnceLock<Instant> = OnceLock::new();
+    let start = START.get_or_init(Instant::now);
+    Ok(Value::Float(start.elapsed().as_secs_f64()))
+}
+
+/// how long `sleep` sleeps between looking for an interrupt
+const NAP: Duration = Duration::from_millis(50);
+
+fn sleep(args: &[Value]) -> Result<Value, String> {
+    let seconds = number("time::sleep", args, 0)?;
+    let duration = Duration::try_from_secs_f64(seconds)
+        .map_err(|_| format!("time::sleep cannot sleep for {} seconds", seconds))?;
+    if cfg!(target_arch = "wasm32") {
+        // a page can't block, the standard library panics rather than wait
+        return Err("time::sleep cannot wait in the browser".to_string());
+    }
+    // in short naps, so that an interrupt doesn't wait for the end, which
+    // is as late as the limit on time allows
+    let end = match (Instant::now().checked_add(duration), limits::deadline()) {
+        (Some(end), Some(deadline)) => Some(end.min(deadline)),
+        (end, deadline) => end.or(deadline),
+    };
+    while !interrupt::pending() {
+        let left = match end {
+            Some(end) => match end.checked_duration_since(Instant::now()) {
+                Some(left) => left,
+                None => break,
+            },
+            None => NAP,
+        };
+        std::thread::sleep(left.min(NAP));
+    }
+    if let Some(run) = deterministic::current() {
+        run.sleep(duration);
+    }
+    Ok(Value::None)
+}
+
+/// `format(time, layout)` or `format(time, layout, zone)`
+fn format(args: &[Value]) -> Result<Value, String> {
+    check_count("time::format", args, 2)?;
+    let t = datetime("time::format", args, 0, args.get(2))?;
+    let layout = string("time::format", args, 1)?;
+    let items = layout_items("time::format", layout)?;
+    let mut out = String::new();
+    write!(out, "{}", t.format_with_items(items.into_iter()))
+        .map_err(|_| format!("time::format cannot write the time with {:?}", layout))?;
+    Ok(Value::from(out.as_str()))
+}
+
+/// `parse(text, layout)` or `parse(text, layout, zone)`, the zone is only
+/// used when the layout has no offset, and the time is midnight when it has
+/// no hours
+fn parse(args: &[Value]) -> Result<Value, String> {
+    check_count("time::parse", args, 2)?;
+    let text = string("time::parse", args, 0)?;
+    let layout = string("time::parse", args, 1)?;
+    layout_items("time::parse", layout)?;
+    let zone = zone("time::parse", args.get(2))?;
+    let invalid = |e: chrono::ParseError| {
+        format!(
+            "time::parse cannot read {:?} with the layout {:?}: {}",
+            text, layout, e
+        )
+    };
+    let t = match DateTime::parse_from_str(text, layout) {
+        Ok(t) => t,
+        Err(_) => {
+            let naive = NaiveDateTime::parse_from_str(text, layout)
+                .or_else(|e| match NaiveDate::parse_from_str(text, layout) {
+                    Ok(d) => Ok(d.and_time(Default::default())),
+                    Err(_) => Err(e),
+                })
+                .map_err(invalid)?;
+            zone.local(&naive).ok_or_else(|| {
+                format!(
+                    "time::parse found {:?}, which doesn't exist in the zone",
+                    text
+                )
+            })?
+        }
+    };
+    Ok(Value::Float(
+        t.timestamp() as f64 + t.timestamp_subsec_nanos() as f64 / 1e9,
+    ))
+}
+
+/// The parts of the date of a time, `date(time)` or `date(time, zone)`, as
+/// a map of ints: `year`, `month` and `day` from 1, `hour`, `minute`,
+/// `second`, `nanosecond`, `weekday` from 1 for Monday to 7 for Sunday, and
+/// the `offset` from UTC in seconds
+fn date(args: &[Value]) -> Result<Value, String> {
+    check_count("time::date", args, 1)?;
+    let t = datetime("time::date", args, 0, args.get(1))?;
+    let parts = [
+        ("year", t.year() as i64),
+        ("month", t.month() as i64),
+        ("day", t.day() as i64),
+        ("hour", t.hour() as i64),
+        ("minute", t.minute() as i64),
+        ("second", t.second() as i64),
+        ("nanosecond", t.nanosecond() as i64),
+        ("weekday", t.weekday().number_from_monday() as i64),
+        ("offset", t.offset().local_minus_utc() as i64),
+    ];
+    Ok(Value::map(
+        parts
+            .into_iter()
+            .map(|(k, v)| (Key::String(k.into()), Value::Int(v)))
+            .collect::<IndexMap<_, _>>(),
+    ))
+}
+
+/// a duration in hours, minutes and seconds, such as `1h2m3.5s`
+fn format_duration(args: &[Value]) -> Result<Value, String> {
+    let seconds = number("time::format_duration", args, 0)?;
+    if !seconds.is_finite() {
+        return Err(format!("time::format_duration cannot write {:?}", seconds));
+    }
+    let sign = if seconds < 0.0 { "-" } else { "" };
+    let total = seconds.abs();
+    let hours = (total / 3600.0).floor();
+    let minutes = ((total - hours * 3600.0) / 60.0).floor();
+    let rest = total - hours * 3600.0 - minutes * 60.0;
+    // at most nine digits after the point, like nanoseconds
+    let rest = format!("{:.9}", rest)
+        .trim_end_matches('0')
+        .trim_end_matches('.')
+        .to_owned();
+    let text = match (hours, minutes) {
+        (0.0, 0.0) => format!("{}{}s", sign, rest),
+        (0.0, _) => format!("{}{}m{}s", sign, minutes, rest),
+        _ => format!("{}{}h{}m{}s", sign, hours, minutes, rest),
+    };
+    Ok(Value::from(text.as_str()))
+}
+
+fn layout_items<'a>(function: &str, layout: &'a str) -> Result<Vec<Item<'a>>, String> {
+    let items: Vec<Item> = StrftimeItems::new(layout).collect();
+    match items.contains(&Item::Error) {
+        true => Err(format!("{} found an invalid layout {:?}", function, layout)),
+        false => Ok(items),
+    }
+}
+
+enum Zone {
+    Local,
+    Fixed(FixedOffset),
+}
+
+impl Zone {
+    /// the time at the instant in the zone
+    fn at(&self, utc: &NaiveDateTime) -> DateTime<FixedOffset> {
+        let offset = match self {
+            Zone::Local => Local.offset_from_utc_datetime(utc).fix(),
+            Zone::Fixed(offset) => *offset,
+        };
+        offset.from_utc_datetime(utc)
+    }
+
+    /// the instant of a time in the zone, the earliest when clocks are set
+    /// back and it happens twice
+    fn local(&self, t: &NaiveDateTime) -> Option<DateTime<FixedOffset>> {
+        match self {
+            Zone::Local => Local
+                .from_local_datetime(t)
+                .earliest()
+                .map(|t| t.fixed_offset()),
+            Zone::Fixed(offset) => offset.from_local_datetime(t).single(),
+        }
+    }
+}
+
+/// the zone of the computer, UTC in deterministic runs
+fn local() -> Zone {
+    match deterministic::current() {
+        Some(_) => utc(),
+        None => Zone::Local,
+    }
+}
+
+fn utc() -> Zone {
+    Zone::Fixed(FixedOffset::east_opt(0).expect("0 is a valid offset"))
+}
+
+/// the zone given as an argument, the local one if there is none
+fn zone(function: &str, value: Option<&Value>) -> Result<Zone, String> {
+    let name = match value {
+        None => return Ok(local()),
+        Some(Value::String(name)) => name,
+        Some(v) => {
+            return Err(format!(
+                "{} expects a time zone as a string, found {}",
+                function,
+                v.type_name()
+            ))
+        }
+    };
+    match name.as_ref() {
+        "local" => Ok(local()),
+        "UTC" | "Z" => Ok(utc()),
+        offset => parse_offset(offset).map(Zone::Fixed).ok_or_else(|| {
+            format!(
+                "{} cannot find the time zone {:?}, it must be \"UTC\", \"local\" or an offset such as \"+02:00\"",
+                function, offset
+            )
+        }),
+    }
+}
+
+/// `+HH:MM`, `-HH:MM` or the same without the colon
+fn parse_offset(offset: &str) -> Option<FixedOffset> {
+    let (sign, rest) = match offset.split_at_checked(1)? {
+        ("+", rest) => (1, rest),
+        ("-", rest) => (-1, rest),
+        _ => return None,
+    };
+    let digits = rest.replacen(':', "", 1);
+    if digits.len() != 4 || !digits.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    let hours: i32 = digits[..2].parse().ok()?;
+    let minutes: i32 = digits[2..].parse().ok()?;
+    FixedOffset::east_opt(sign * (hours * 3600 + minutes * 60))
+}
+
+/// the time at the given index, in the zone
+fn datetime(
+    function: &str,
+    args: &[Value],
+    i: usize,
+    zone: Option<&Value>,
+) -> Result<DateTime<FixedOffset>, String> {
+    let seconds = number(function, args, i)?;
+    let whole = seconds.floor();
+    let nanos = ((seconds - whole) * 1e9).round().min(999_999_999.0) as u32;
+    let utc = (whole.abs() < i64::MAX as f64)
+        .then(|| DateTime::from_timestamp(whole as i64, nanos))
+        .flatten()
+        .ok_or_else(|| format!("{} cannot find the date of the time {}", function, seconds))?;
+    Ok(self::zone(function, zone)?.at(&utc.naive_utc()))
+}
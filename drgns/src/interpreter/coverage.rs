@@ -0,0 +1,92 @@
+//! The lines of code scripts ran, for the coverage reports of `drgns test`.
+//! Once recording is enabled, the tree-walker counts the line each
+//! statement and expression starts on as it evaluates them, and the VM the
+//! line of each instruction it runs, for every file. Code that isn't in a
+//! file, such as the entries of the interactive session, is left out.
+//!
+//! A line counts as run if any of what starts on it ran. Which lines can be
+//! run is taken from the statements of a file, as `executable` finds them.
+//! The times a line ran are the steps the engine took on it, so they differ
+//! between the engines, but the lines they find to have run don't.
+
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Mutex,
+    },
+};
+
+use crate::{
+    parser::{walk_statement, Program, Statement, Visitor},
+    source::SourceString,
+};
+
+/// How many times each line was run, by line, starting at 1
+pub type Lines = BTreeMap<usize, u64>;
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// the lines run in each file, by its path
+static RUN: Mutex<BTreeMap<String, Lines>> = Mutex::new(BTreeMap::new());
+
+/// Record the lines run from now on, in all threads
+pub fn enable() {
+    ENABLED.store(true, Ordering::Relaxed);
+}
+
+/// whether the lines run are recorded, the engines look before finding the
+/// span of what they run
+#[inline]
+pub fn enabled() -> bool {
+    ENABLED.load(Ordering::Relaxed)
+}
+
+/// Count the line the code of the span starts on as run
+pub fn hit(span: &SourceString) {
+    let Some(file) = span.file() else {
+        return;
+    };
+    let line = span.position().line;
+    let mut run = RUN.lock().unwrap_or_else(|e| e.into_inner());
+    match run.get_mut(file) {
+        Some(lines) => *lines.entry(line).or_default() += 1,
+        None => {
+            run.insert(file.to_string(), Lines::from([(line, 1)]));
+        }
+    }
+}
+
+/// Take the lines run since recording started, or since they were last
+/// taken
+pub fn take() -> BTreeMap<String, Lines> {
+    std::mem::take(&mut *RUN.lock().unwrap_or_else(|e| e.into_inner()))
+}
+
+/// The lines of a program that can be run: those its statements start on,
+/// in functions too. Declarations of functions, structs and enums, and
+/// imports, only name what they declare, so their lines aren't counted,
+/// unlike those of the statements inside them. Interfaces don't run at all.
+pub fn executable(program: &Program) -> BTreeSet<usize> {
+    struct Statements(BTreeSet<usize>);
+
+    impl Visitor for Statements {
+        fn visit_statement(&mut self, s: &Statement) {
+            match s {
+                Statement::Function(_)
+                | Statement::Struct(_)
+                | Statement::Enum(_)
+                | Statement::Interface(_)
+                | Statement::Import(_) => {}
+                _ => {
+                    self.0.insert(s.span().position().line);
+                }
+            }
+            walk_statement(self, s)
+        }
+    }
+
+    let mut statements = Statements(BTreeSet::new());
+    statements.visit_program(program);
+    statements.0
+}
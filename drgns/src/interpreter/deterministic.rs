@@ -0,0 +1,95 @@
+//! Deterministic runs, which are the same each time: the random generator
+//! starts from the same seed, the clocks start at the Unix epoch and only
+//! move as scripts sleep, and the local time zone is UTC.
+//!
+//! A run is deterministic for the whole process after
+//! `builtins::set_deterministic`, or for the evaluations of an interpreter
+//! after `Interpreter::set_deterministic`. Like the sandbox, it then holds
+//! for the thread running the script and the tasks and generators it
+//! starts, which share its generator and its clocks.
+
+use std::{
+    cell::RefCell,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, Mutex, MutexGuard,
+    },
+    time::Duration,
+};
+
+use rand::{rngs::StdRng, SeedableRng};
+
+/// the seed of deterministic runs
+const SEED: u64 = 0;
+
+/// What a deterministic run has drawn and slept so far
+#[derive(Debug)]
+pub struct Run {
+    generator: Mutex<StdRng>,
+    slept: AtomicU64,
+}
+
+impl Run {
+    /// the generator, as it was left by the last draw
+    pub fn generator(&self) -> MutexGuard<'_, StdRng> {
+        self.generator.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// the time the run slept, which is the time that has passed in it
+    pub fn slept(&self) -> Duration {
+        Duration::from_nanos(self.slept.load(Ordering::Relaxed))
+    }
+
+    /// Count time the run slept
+    pub fn sleep(&self, duration: Duration) {
+        let nanos = u64::try_from(duration.as_nanos()).unwrap_or(u64::MAX);
+        self.slept.fetch_add(nanos, Ordering::Relaxed);
+    }
+}
+
+/// A run from the start
+pub fn start() -> Arc<Run> {
+    Arc::new(Run {
+        generator: Mutex::new(StdRng::seed_from_u64(SEED)),
+        slept: AtomicU64::new(0),
+    })
+}
+
+/// the run of the whole process, see `builtins::set_deterministic`
+static PROCESS: Mutex<Option<Arc<Run>>> = Mutex::new(None);
+
+thread_local! {
+    static RUN: RefCell<Option<Arc<Run>>> = const { RefCell::new(None) };
+}
+
+/// Make the whole process deterministic, from the start of a run
+pub fn start_process() {
+    *PROCESS.lock().unwrap_or_else(|e| e.into_inner()) = Some(start());
+}
+
+/// Installed for as long as it lives, then the run the thread had before is
+/// back
+pub struct Installed {
+    previous: Option<Arc<Run>>,
+}
+
+impl Drop for Installed {
+    fn drop(&mut self) {
+        RUN.set(self.previous.take());
+    }
+}
+
+/// Make what runs on the thread part of a deterministic run, or of none
+/// but the one of the process, until the result is dropped
+pub fn install(run: Option<Arc<Run>>) -> Installed {
+    Installed {
+        previous: RUN.replace(run),
+    }
+}
+
+/// the deterministic run of the thread, or else of the process, if there is
+/// one
+pub fn current() -> Option<Arc<Run>> {
+    RUN.with_borrow(Clone::clone)
+        .or_else(|| PROCESS.lock().unwrap_or_else(|e| e.into_inner()).clone())
+}
@@ -0,0 +1,136 @@
+use std::{
+    collections::HashMap,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, RwLock,
+    },
+};
+
+use crate::values::{intern, Value};
+
+pub type Env = Arc<Environment>;
+
+/// A variable, shared so that the VM can keep hold of the one a name
+/// refers to, see `Environment::binding`
+#[derive(Debug)]
+pub struct Binding {
+    value: RwLock<Value>,
+    mutable: bool,
+}
+
+impl Binding {
+    pub fn get(&self) -> Value {
+        self.value.read().unwrap_or_else(|e| e.into_inner()).clone()
+    }
+
+    pub fn is_mutable(&self) -> bool {
+        self.mutable
+    }
+
+    /// update the variable, whether it is mutable is checked first
+    pub fn set(&self, value: Value) {
+        crate::assert_pre_condition!(self.mutable);
+        *self.value.write().unwrap_or_else(|e| e.into_inner()) = value;
+    }
+}
+
+/// A lexical scope, variables are looked up here first and then in the
+/// enclosing scopes
+#[derive(Debug, Default)]
+pub struct Environment {
+    /// by their interned names
+    bindings: RwLock<HashMap<Arc<str>, Arc<Binding>>>,
+    parent: Option<Env>,
+
+    /// the names declared in this scope so far
+    declared: AtomicU64,
+}
+
+#[derive(Debug, PartialEq)]
+pub enum AssignError {
+    Undefined,
+    Immutable,
+}
+
+impl Environment {
+    pub fn global() -> Env {
+        Arc::new(Self::default())
+    }
+
+    pub fn child(parent: &Env) -> Env {
+        Arc::new(Self {
+            parent: Some(parent.clone()),
+            ..Self::default()
+        })
+    }
+
+    /// declare a variable in this scope, shadowing any previous one
+    pub fn define(&self, name: &str, value: Value, mutable: bool) {
+        let binding = Binding {
+            value: RwLock::new(value),
+            mutable,
+        };
+        self.bindings
+            .write()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(intern(name), Arc::new(binding));
+        self.declared.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn get(&self, name: &str) -> Option<Value> {
+        let bindings = self.bindings.read().unwrap_or_else(|e| e.into_inner());
+        match bindings.get(name) {
+            Some(b) => Some(b.get()),
+            None => self.parent.as_ref()?.get(name),
+        }
+    }
+
+    /// The variable a name refers to, in the closest scope declaring it. It
+    /// stays the one the name refers to for as long as `version` is the same.
+    pub fn binding(&self, name: &str) -> Option<Arc<Binding>> {
+        let bindings = self.bindings.read().unwrap_or_else(|e| e.into_inner());
+        match bindings.get(name) {
+            Some(b) => Some(b.clone()),
+            None => self.parent.as_ref()?.binding(name),
+        }
+    }
+
+    /// A number that changes whenever a name is declared in this scope or an
+    /// enclosing one, which may shadow the variables found before
+    pub fn version(&self) -> u64 {
+        let declared = self.declared.load(Ordering::Relaxed);
+        match &self.parent {
+            Some(p) => declared.wrapping_add(p.version()),
+            None => declared,
+        }
+    }
+
+    /// update an existing mutable variable in the closest scope declaring it
+    pub fn assign(&self, name: &str, value: Value) -> Result<(), AssignError> {
+        let bindings = self.bindings.read().unwrap_or_else(|e| e.into_inner());
+        match bindings.get(name) {
+            Some(b) if !b.mutable => Err(AssignError::Immutable),
+            Some(b) => {
+                b.set(value);
+                Ok(())
+            }
+            None => match &self.parent {
+                Some(p) => p.assign(name, value),
+                None => Err(AssignError::Undefined),
+            },
+        }
+    }
+
+    /// the enclosing scope, `None` for the scope of the builtins
+    pub fn parent(&self) -> Option<&Env> {
+        self.parent.as_ref()
+    }
+
+    /// names declared directly in this scope
+    pub fn names(&self) -> Vec<String> {
+        let bindings = self.bindings.read().unwrap_or_else(|e| e.into_inner());
+        let mut names: Vec<String> = bindings.keys().map(|n| n.to_string()).collect();
+        names.sort();
+        names
+    }
+}
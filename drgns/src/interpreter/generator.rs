@@ -0,0 +1,145 @@
+//! Generators of the tree-walking interpreter. Evaluation can't be suspended
+//! half way through the tree, so the body of a generator runs on a thread of
+//! its own, which hands each item it yields over a channel and waits to be
+//! resumed before running on.
+
+use std::{
+    sync::{
+        mpsc::{self, Receiver, Sender},
+        Arc,
+    },
+    thread,
+};
+
+use crate::{
+    eh::DragonError,
+    modules::Loader,
+    source::SourceString,
+    values::{Function, Generator, Value},
+};
+
+use super::{deterministic, io, limits, sandbox, Halt, Interpreter, Unwind};
+
+/// What the thread of a generator hands back each time it is resumed
+enum Step {
+    Yield(Value),
+    Return,
+    Halt(Halt),
+}
+
+/// The ends of the channels kept by the thread, see `Interpreter::yielder`
+pub(super) struct Yielder {
+    steps: Sender<Step>,
+    resumes: Receiver<()>,
+}
+
+impl Yielder {
+    /// Hand over an item and wait to be resumed. Once the generator is
+    /// dropped the body is stopped with `Halt::Exit`, which no `catch` or
+    /// `finally` runs for.
+    pub(super) fn give(&self, item: Value) -> Result<(), Halt> {
+        let resumed = match self.steps.send(Step::Yield(item)) {
+            Ok(()) => self.resumes.recv().is_ok(),
+            Err(_) => false,
+        };
+        match resumed {
+            true => Ok(()),
+            false => Err(Halt::Exit(0)),
+        }
+    }
+}
+
+pub(super) struct Thread {
+    /// what the thread is started with, once the first item is asked for
+    start: Option<(Arc<Function>, Vec<Option<Value>>, Yielder)>,
+    loader: Arc<Loader>,
+    steps: Receiver<Step>,
+    resumes: Sender<()>,
+
+    /// errors show the generator as called where it was created
+    name: String,
+    span: SourceString,
+}
+
+impl Thread {
+    pub(super) fn new(
+        function: Arc<Function>,
+        arguments: Vec<Option<Value>>,
+        loader: Arc<Loader>,
+        span: SourceString,
+    ) -> Self {
+        let (steps, steps_rx) = mpsc::channel();
+        let (resumes, resumes_rx) = mpsc::channel();
+        let yielder = Yielder {
+            steps,
+            resumes: resumes_rx,
+        };
+        Self {
+            name: function.declaration.name.name.clone(),
+            start: Some((function, arguments, yielder)),
+            loader,
+            steps: steps_rx,
+            resumes,
+            span,
+        }
+    }
+
+    fn spawn(
+        &self,
+        function: Arc<Function>,
+        arguments: Vec<Option<Value>>,
+        yielder: Yielder,
+    ) -> Result<(), Halt> {
+        let loader = self.loader.clone();
+        let budget = limits::budget();
+        let stack = limits::limits().stack_size();
+        let sandbox = sandbox::current();
+        let io = io::current();
+        let run = deterministic::current();
+        let started = thread::Builder::new().stack_size(stack).spawn(move || {
+            let _limits = limits::share(budget);
+            let _sandbox = sandbox::enforce(sandbox);
+            let _io = io::install(io);
+            let _run = deterministic::install(run);
+            let mut interpreter = Interpreter::with_loader(loader);
+            interpreter.yielder = Some(yielder);
+            let step = match interpreter.function(function, arguments) {
+                Ok(_) => Step::Return,
+                Err(Unwind::Halt(h)) => Step::Halt(h),
+                // `function` turns the others into errors
+                Err(_) => crate::assert_unreachable!(),
+            };
+            if let Some(yielder) = interpreter.yielder {
+                // nobody is waiting once the generator is dropped
+                let _ = yielder.steps.send(step);
+            }
+        });
+        started.map(|_| ()).map_err(|e| {
+            Halt::Error(DragonError::runtime(
+                format!("the generator could not start: {}", e),
+                Some(self.span.clone()),
+            ))
+        })
+    }
+}
+
+impl Generator for Thread {
+    fn resume(&mut self) -> Result<Option<Value>, Halt> {
+        match self.start.take() {
+            Some((function, arguments, yielder)) => self.spawn(function, arguments, yielder)?,
+            None => {
+                if self.resumes.send(()).is_err() {
+                    return Ok(None);
+                }
+            }
+        }
+        match self.steps.recv() {
+            Ok(Step::Yield(item)) => Ok(Some(item)),
+            Ok(Step::Halt(Halt::Error(e))) => Err(Halt::Error(
+                e.with_frame(&self.name, Some(self.span.clone())),
+            )),
+            Ok(Step::Halt(h)) => Err(h),
+            Ok(Step::Return) | Err(_) => Ok(None),
+        }
+    }
+}
@@ -0,0 +1,86 @@
+//! Stopping a running script from outside of it, when the user presses
+//! Ctrl-C or once its time is up. Both engines look at the request before
+//! each step, and stop with an error that no `catch` or `finally` handles,
+//! so the stack of calls it propagates out of shows where the script was.
+//!
+//! The request holds until it is cleared, the tasks that are running stop as
+//! well. `time::sleep` stops sleeping, other steps that wait, such as
+//! reading input or receiving from a channel, only see it once they are done
+//! waiting.
+
+use std::{
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, Mutex, OnceLock,
+    },
+    time::Duration,
+};
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    source::SourceString,
+};
+
+/// Why the script is being stopped
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Reason {
+    /// the user pressed Ctrl-C
+    Interrupt,
+    /// the script ran for longer than it may
+    Timeout(Duration),
+}
+
+static REASON: Mutex<Option<Reason>> = Mutex::new(None);
+
+/// Whether a request is pending, set by signal handlers too, which can't
+/// take the lock of the reason: a request without one is an interrupt
+pub fn flag() -> &'static Arc<AtomicBool> {
+    static FLAG: OnceLock<Arc<AtomicBool>> = OnceLock::new();
+    FLAG.get_or_init(Arc::default)
+}
+
+/// Ask the running script to stop
+pub fn request(reason: Reason) {
+    *REASON.lock().unwrap_or_else(|e| e.into_inner()) = Some(reason);
+    flag().store(true, Ordering::SeqCst);
+}
+
+/// Let scripts run again, before the next one starts
+pub fn clear() {
+    flag().store(false, Ordering::SeqCst);
+    *REASON.lock().unwrap_or_else(|e| e.into_inner()) = None;
+}
+
+pub fn pending() -> bool {
+    flag().load(Ordering::Relaxed)
+}
+
+/// why the script is being stopped, `None` if it isn't
+pub fn reason() -> Option<Reason> {
+    if !pending() {
+        return None;
+    }
+    Some(
+        REASON
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .unwrap_or(Reason::Interrupt),
+    )
+}
+
+/// the error a script stops with at the step it was about to take
+pub fn error(span: Option<SourceString>) -> DragonError {
+    let msg = match reason() {
+        Some(Reason::Timeout(limit)) => format!(
+            "the script timed out after {}",
+            humantime::format_duration(limit)
+        ),
+        _ => "the script was interrupted".to_string(),
+    };
+    DragonError::new(ErrorCode::Interrupted, msg, span)
+}
+
+/// whether an error is the one of a stopped script, which isn't handled
+pub fn is_interrupt(e: &DragonError) -> bool {
+    e.code() == ErrorCode::Interrupted
+}
@@ -0,0 +1,94 @@
+//! Where the standard library writes what scripts print and log. Hosts that
+//! have no standard streams to give them, such as a page in a browser, or
+//! that run the scripts of others and show each its own output, give the
+//! interpreter an `Io` instead, see `Interpreter::set_io`.
+//!
+//! Like the sandbox, the `Io` holds for the thread running the script and
+//! the tasks and generators it starts. Without one, the lines go where
+//! `builtins::set_output` and `builtins::set_log_output` send them, and to
+//! the standard output and error otherwise.
+
+use std::{
+    cell::RefCell,
+    sync::{Arc, Mutex},
+};
+
+/// What scripts write, line by line, without the newlines
+pub trait Io: Send + Sync {
+    /// a line written by `print`
+    fn print(&self, line: &str);
+
+    /// a line written by the `log` module
+    fn log(&self, line: &str);
+}
+
+/// Keeps what the scripts write, for hosts that show it once they are done
+#[derive(Debug, Default)]
+pub struct Captured {
+    stdout: Mutex<String>,
+    stderr: Mutex<String>,
+}
+
+impl Captured {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// the lines printed, each ending with a newline
+    pub fn stdout(&self) -> String {
+        lock(&self.stdout).clone()
+    }
+
+    /// the lines logged, each ending with a newline
+    pub fn stderr(&self) -> String {
+        lock(&self.stderr).clone()
+    }
+}
+
+impl Io for Captured {
+    fn print(&self, line: &str) {
+        let mut stdout = lock(&self.stdout);
+        stdout.push_str(line);
+        stdout.push('\n');
+    }
+
+    fn log(&self, line: &str) {
+        let mut stderr = lock(&self.stderr);
+        stderr.push_str(line);
+        stderr.push('\n');
+    }
+}
+
+fn lock(text: &Mutex<String>) -> std::sync::MutexGuard<'_, String> {
+    text.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+thread_local! {
+    static IO: RefCell<Option<Arc<dyn Io>>> = const { RefCell::new(None) };
+}
+
+/// Installed for as long as it lives, then the `Io` the thread had before is
+/// back
+pub struct Installed {
+    previous: Option<Arc<dyn Io>>,
+}
+
+impl Drop for Installed {
+    fn drop(&mut self) {
+        let previous = self.previous.take();
+        IO.with(|io| *io.borrow_mut() = previous);
+    }
+}
+
+/// Send what runs on the thread writes to the `Io`, or to where it would go
+/// without one, until the result is dropped
+pub fn install(io: Option<Arc<dyn Io>>) -> Installed {
+    Installed {
+        previous: IO.with(|current| current.replace(io)),
+    }
+}
+
+/// the `Io` of the thread, if it has one
+pub fn current() -> Option<Arc<dyn Io>> {
+    IO.with(|io| io.borrow().clone())
+}
@@ -0,0 +1,232 @@
+//! Limits on how much a script may do, for hosts running scripts they don't
+//! trust and for CI jobs that must not hang or eat the machine. Going over
+//! one raises an error with the code `E04003`, which scripts can catch like
+//! any other, though for steps, values and time each step after raises it
+//! again.
+//!
+//! The limits hold for the thread running the script, and the tasks and
+//! generators it starts share them. Calls nest at most `DEFAULT_DEPTH` deep
+//! even when no limits are set, so that deep recursion is an error rather
+//! than the stack overflowing.
+
+use std::{
+    cell::{Cell, RefCell},
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
+use web_time::Instant;
+
+use super::{profile, trace};
+
+/// How deep calls can nest unless told otherwise
+pub const DEFAULT_DEPTH: usize = 1000;
+
+/// The stack each nested call may take, with some to spare for debug builds
+const STACK_PER_CALL: usize = 64 << 10;
+
+/// The limits of an evaluation, `None` for none
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Limits {
+    /// the steps it may take, instructions on the VM and expressions on the
+    /// tree-walker
+    pub steps: Option<u64>,
+
+    /// the values it may create over its run: each list, map, instance and
+    /// string, each item or field they start with or that is added to them,
+    /// and one more for every 64 bytes of a string
+    pub values: Option<u64>,
+
+    /// how deep calls to functions of scripts may nest
+    pub depth: usize,
+
+    /// how long it may run for, sleeping included
+    pub time: Option<Duration>,
+}
+
+impl Default for Limits {
+    fn default() -> Self {
+        Self {
+            steps: None,
+            values: None,
+            depth: DEFAULT_DEPTH,
+            time: None,
+        }
+    }
+}
+
+impl Limits {
+    /// The stack a thread running scripts needs for calls to nest as deep as
+    /// the limits allow
+    pub fn stack_size(&self) -> usize {
+        self.depth.saturating_mul(STACK_PER_CALL)
+    }
+}
+
+/// What an evaluation has used of its limits, shared with the tasks it
+/// starts
+#[derive(Debug)]
+pub struct Budget {
+    limits: Limits,
+    steps: AtomicU64,
+    values: AtomicU64,
+    started: Instant,
+}
+
+thread_local! {
+    static BUDGET: RefCell<Option<Arc<Budget>>> = const { RefCell::new(None) };
+
+    /// the calls running on the thread
+    static DEPTH: Cell<usize> = const { Cell::new(0) };
+
+    /// the values created on the thread, whether or not they are limited
+    static CREATED: Cell<u64> = const { Cell::new(0) };
+}
+
+/// Installed for as long as it lives, then the budget the thread had before
+/// is back
+pub struct Enforced {
+    previous: Option<Arc<Budget>>,
+}
+
+impl Drop for Enforced {
+    fn drop(&mut self) {
+        BUDGET.set(self.previous.take());
+    }
+}
+
+/// Hold what runs on the thread to fresh limits, until the result is dropped
+pub fn enforce(limits: Limits) -> Enforced {
+    share(Some(Arc::new(Budget {
+        limits,
+        steps: AtomicU64::new(0),
+        values: AtomicU64::new(0),
+        started: Instant::now(),
+    })))
+}
+
+/// Hold what runs on the thread to a budget taken from another with
+/// `budget`, such as the one that started a task
+pub fn share(budget: Option<Arc<Budget>>) -> Enforced {
+    Enforced {
+        previous: BUDGET.replace(budget),
+    }
+}
+
+/// the budget of the thread, if it has one
+pub fn budget() -> Option<Arc<Budget>> {
+    BUDGET.with_borrow(Clone::clone)
+}
+
+/// the limits of the thread
+pub fn limits() -> Limits {
+    BUDGET.with_borrow(|b| b.as_ref().map(|b| b.limits).unwrap_or_default())
+}
+
+/// when the time of the thread runs out, if it is limited
+pub fn deadline() -> Option<Instant> {
+    BUDGET.with_borrow(|b| {
+        let b = b.as_ref()?;
+        b.started.checked_add(b.limits.time?)
+    })
+}
+
+/// Count a step, and fail once there were more than the limit, more values
+/// were created than it allows or it ran for longer than it may
+pub fn step() -> Result<(), String> {
+    BUDGET.with_borrow(|budget| {
+        let Some(b) = budget else {
+            return Ok(());
+        };
+        if let Some(limit) = b.limits.steps {
+            if b.steps.fetch_add(1, Ordering::Relaxed) >= limit {
+                return Err(format!("the script took more than {} steps", limit));
+            }
+        }
+        b.check_values()?;
+        b.check_time()
+    })
+}
+
+/// Fail if more values were created than the limit allows, or the script
+/// ran for too long, for when it ends rather than taking a step
+pub fn check() -> Result<(), String> {
+    BUDGET.with_borrow(|budget| {
+        budget
+            .as_ref()
+            .map_or(Ok(()), |b| b.check_values().and_then(|_| b.check_time()))
+    })
+}
+
+impl Budget {
+    fn check_values(&self) -> Result<(), String> {
+        match self.limits.values {
+            Some(limit) if self.values.load(Ordering::Relaxed) > limit => {
+                Err(format!("the script created more than {} values", limit))
+            }
+            _ => Ok(()),
+        }
+    }
+
+    fn check_time(&self) -> Result<(), String> {
+        match self.limits.time {
+            Some(limit) if self.started.elapsed() > limit => Err(format!(
+                "the script ran for more than {}",
+                humantime::format_duration(limit)
+            )),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Count values being created, going over the limit is found at the next
+/// step
+pub fn allocate(values: usize) {
+    CREATED.set(CREATED.get().wrapping_add(values as u64));
+    BUDGET.with_borrow(|budget| {
+        if let Some(b) = budget.as_ref().filter(|b| b.limits.values.is_some()) {
+            b.values.fetch_add(values as u64, Ordering::Relaxed);
+        }
+    })
+}
+
+/// the values created on the thread since it started, as they count against
+/// the limit on values, for measuring what a script allocates
+pub fn created() -> u64 {
+    CREATED.get()
+}
+
+/// the values a string of `bytes` counts as
+pub fn string_values(bytes: usize) -> usize {
+    1 + bytes / 64
+}
+
+/// A call running on the thread, until it is dropped
+pub struct Nested {
+    _profiled: Option<profile::Call>,
+    _traced: Option<trace::Call>,
+}
+
+impl Drop for Nested {
+    fn drop(&mut self) {
+        DEPTH.set(DEPTH.get() - 1);
+    }
+}
+
+/// Enter a call to a function, unless calls are nested as deep as allowed.
+/// The call is profiled and traced under the name of the function.
+pub fn enter(function: &str) -> Result<Nested, String> {
+    let depth = DEPTH.get();
+    let limit = limits().depth;
+    if depth >= limit {
+        return Err(format!("calls are nested more than {} deep", limit));
+    }
+    DEPTH.set(depth + 1);
+    Ok(Nested {
+        _profiled: profile::call(function),
+        _traced: trace::call(function),
+    })
+}
@@ -0,0 +1,185 @@
+//! Profiles of scripts by their own functions, rather than by the functions
+//! of the interpreter running them. With `drgns run --profile cpu` each call
+//! to a function of the script is timed, with `--profile mem` the values it
+//! creates are counted, as they count against `--max-values`. Either is
+//! charged to the stack of calls it was made in, the code outside of any
+//! function to `<script>`.
+//!
+//! The profile is written as folded stacks, a line `main;parse;token 1200`
+//! for what each stack took itself, the format flame graph tools such as
+//! `inferno` and `speedscope` read. Calls in tail position replace the
+//! function they return from, as they do in the stacks of errors.
+
+use std::{
+    cell::RefCell,
+    collections::BTreeMap,
+    sync::{
+        atomic::{AtomicU8, Ordering},
+        Mutex,
+    },
+};
+
+use web_time::Instant;
+
+use super::limits;
+
+/// What a profile measures
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Profile {
+    /// the time each function took, in nanoseconds
+    Cpu,
+    /// the values each function created
+    Mem,
+}
+
+impl Profile {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Self::Cpu => "cpu",
+            Self::Mem => "mem",
+        }
+    }
+}
+
+/// the profile being taken, 0 for none and 1 more than the variant otherwise
+static PROFILE: AtomicU8 = AtomicU8::new(0);
+
+/// what each stack took itself, by its functions joined with `;`
+static STACKS: Mutex<BTreeMap<String, u64>> = Mutex::new(BTreeMap::new());
+
+/// the calls to each function, and what they took
+static FUNCTIONS: Mutex<BTreeMap<String, Function>> = Mutex::new(BTreeMap::new());
+
+/// The calls to a function and what they took
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct Function {
+    pub calls: u64,
+
+    /// what the function took itself, without the functions it called
+    pub own: u64,
+
+    /// what the function took with the functions it called, calls nested in
+    /// one to the same function counted once
+    pub total: u64,
+}
+
+thread_local! {
+    /// the calls being profiled on the thread, innermost last
+    static CALLS: RefCell<Vec<Frame>> = const { RefCell::new(vec![]) };
+}
+
+struct Frame {
+    name: String,
+    start: u64,
+    /// what the calls it made took
+    callees: u64,
+}
+
+/// Profile the calls made from now on, in all threads
+pub fn start(profile: Profile) {
+    PROFILE.store(profile as u8 + 1, Ordering::Relaxed);
+}
+
+/// the profile being taken, if one is
+pub fn current() -> Option<Profile> {
+    match PROFILE.load(Ordering::Relaxed) {
+        0 => None,
+        1 => Some(Profile::Cpu),
+        _ => Some(Profile::Mem),
+    }
+}
+
+/// the clock of the profile, nanoseconds or values created so far
+fn now(profile: Profile) -> u64 {
+    match profile {
+        Profile::Cpu => {
+            static EPOCH: std::sync::OnceLock<Instant> = std::sync::OnceLock::new();
+            EPOCH.get_or_init(Instant::now).elapsed().as_nanos() as u64
+        }
+        Profile::Mem => limits::created(),
+    }
+}
+
+/// A call being profiled, until it is dropped
+pub struct Call(());
+
+impl Drop for Call {
+    fn drop(&mut self) {
+        exit();
+    }
+}
+
+/// Profile a call to the function until the result is dropped, if a profile
+/// is being taken
+pub fn call(name: &str) -> Option<Call> {
+    let profile = current()?;
+    push(profile, name);
+    Some(Call(()))
+}
+
+/// Charge the innermost call to another function, which its call in tail
+/// position takes over from
+pub fn replace(name: &str) {
+    if let Some(profile) = current() {
+        exit();
+        push(profile, name);
+    }
+}
+
+fn push(profile: Profile, name: &str) {
+    let start = now(profile);
+    CALLS.with_borrow_mut(|calls| {
+        calls.push(Frame {
+            name: name.to_string(),
+            start,
+            callees: 0,
+        })
+    });
+}
+
+fn exit() {
+    let Some(profile) = current() else {
+        return;
+    };
+    let end = now(profile);
+    CALLS.with_borrow_mut(|calls| {
+        let Some(frame) = calls.pop() else {
+            return;
+        };
+        let total = end.saturating_sub(frame.start);
+        let own = total.saturating_sub(frame.callees);
+        if let Some(caller) = calls.last_mut() {
+            caller.callees += total;
+        }
+        let recursive = calls.iter().any(|c| c.name == frame.name);
+        let mut stack = calls.iter().map(|c| c.name.as_str()).collect::<Vec<_>>();
+        stack.push(&frame.name);
+        *lock(&STACKS).entry(stack.join(";")).or_default() += own;
+        let mut functions = lock(&FUNCTIONS);
+        let function = functions.entry(frame.name).or_default();
+        function.calls += 1;
+        function.own += own;
+        if !recursive {
+            function.total += total;
+        }
+    });
+}
+
+fn lock<T>(mutex: &Mutex<T>) -> std::sync::MutexGuard<'_, T> {
+    mutex.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+/// The profile taken so far as folded stacks, a line for each stack, in
+/// the order of the stacks
+pub fn folded() -> String {
+    lock(&STACKS)
+        .iter()
+        .filter(|(_, own)| **own > 0)
+        .map(|(stack, own)| format!("{} {}\n", stack, own))
+        .collect()
+}
+
+/// the calls to each function profiled so far, and what they took
+pub fn functions() -> BTreeMap<String, Function> {
+    lock(&FUNCTIONS).clone()
+}
@@ -0,0 +1,103 @@
+//! Running scripts that aren't trusted without them reaching outside of the
+//! interpreter. In a sandbox, the functions of the standard library that
+//! touch files, the network, other programs or the environment fail, unless
+//! the host allowed their capability.
+//!
+//! Like the limits, the sandbox holds for the thread running the script and
+//! the tasks and generators it starts. It doesn't cover imports, the modules
+//! of a script are read as usual.
+
+use std::cell::Cell;
+
+/// What a script may do outside of the interpreter
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Capability {
+    /// read and write files and directories, with the `fs` module,
+    /// `os::cwd` and `os::chdir`
+    Fs,
+    /// send requests with the `http` module
+    Net,
+    /// run other programs with `os::run`
+    Process,
+    /// read and change environment variables, with `env`, `os::set_env` and
+    /// `os::unset_env`
+    Env,
+}
+
+impl Capability {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Self::Fs => "fs",
+            Self::Net => "net",
+            Self::Process => "process",
+            Self::Env => "env",
+        }
+    }
+
+    fn bit(&self) -> u8 {
+        1 << *self as u8
+    }
+}
+
+/// The capabilities a sandboxed script still has, it has none unless they
+/// are allowed
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct Sandbox {
+    allowed: u8,
+}
+
+impl Sandbox {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn allow(mut self, capability: Capability) -> Self {
+        self.allowed |= capability.bit();
+        self
+    }
+
+    pub fn allows(&self, capability: Capability) -> bool {
+        self.allowed & capability.bit() != 0
+    }
+}
+
+thread_local! {
+    static SANDBOX: Cell<Option<Sandbox>> = const { Cell::new(None) };
+}
+
+/// Installed for as long as it lives, then the sandbox the thread had before
+/// is back
+pub struct Enforced {
+    previous: Option<Sandbox>,
+}
+
+impl Drop for Enforced {
+    fn drop(&mut self) {
+        SANDBOX.set(self.previous);
+    }
+}
+
+/// Hold what runs on the thread to a sandbox, or to none, until the result
+/// is dropped
+pub fn enforce(sandbox: Option<Sandbox>) -> Enforced {
+    Enforced {
+        previous: SANDBOX.replace(sandbox),
+    }
+}
+
+/// the sandbox of the thread, if it has one
+pub fn current() -> Option<Sandbox> {
+    SANDBOX.get()
+}
+
+/// Fail unless the function may use the capability
+pub fn require(function: &str, capability: Capability) -> Result<(), String> {
+    match current() {
+        Some(sandbox) if !sandbox.allows(capability) => Err(format!(
+            "{} is not allowed in the sandbox, it needs the {} capability",
+            function,
+            capability.name()
+        )),
+        _ => Ok(()),
+    }
+}
@@ -0,0 +1,1017 @@
+use std::sync::{Arc, Mutex};
+
+use crate::{parser::parse, source::Source, test_utils, values::Value};
+
+use super::{builtins, Halt, Interpreter};
+
+fn run(s: &str) -> Result<Value, Halt> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    Interpreter::new().eval(&program)
+}
+
+fn value(s: &str) -> Value {
+    match run(s) {
+        Ok(v) => v,
+        Err(h) => panic!("evaluating {:?} halted with {:?}", s, h),
+    }
+}
+
+fn error(s: &str) -> String {
+    match run(s) {
+        Err(Halt::Error(e)) => e.message().to_string(),
+        r => panic!("expected {:?} to fail, got {:?}", s, r),
+    }
+}
+
+#[test]
+fn eval_arithmetic() {
+    assert_eq!(value("1 + 2 * 3"), Value::Int(7));
+    assert_eq!(value("7 / 2"), Value::Int(3));
+    assert_eq!(value("7 % 2"), Value::Int(1));
+    assert_eq!(value("2 ** 10"), Value::Int(1024));
+    assert_eq!(value("1 + 0.5"), Value::Float(1.5));
+    assert_eq!(value("-(1 - 3)"), Value::Int(2));
+    assert_eq!(value("6 land 3 lor 8"), Value::Int(10));
+    assert_eq!(value("\"foo\" ++ \"bar\""), Value::from("foobar"));
+}
+
+#[test]
+fn eval_logic() {
+    assert_eq!(value("1 < 2 and 2 <= 2"), Value::Bool(true));
+    assert_eq!(value("not none"), Value::Bool(true));
+    assert_eq!(value("true xor true"), Value::Bool(false));
+    // the right hand side is never evaluated
+    assert_eq!(value("false and undefined"), Value::Bool(false));
+    assert_eq!(value("true or undefined"), Value::Bool(true));
+}
+
+#[test]
+fn eval_scopes() {
+    assert_eq!(value("x := 1\n{ x := 2 }\nx"), Value::Int(1));
+    assert_eq!(value("mut x := 1\n{ x = 2 }\nx"), Value::Int(2));
+    assert_eq!(value("mut x := 1\nx += 2\nx *= 3\nx"), Value::Int(9));
+    assert_eq!(error("{ x := 1 }\nx"), "undefined variable 'x'");
+    assert_eq!(
+        error("x := 1\nx = 2"),
+        "cannot assign twice to immutable variable 'x'"
+    );
+}
+
+#[test]
+fn eval_control_flow() {
+    assert_eq!(
+        value("if false { 1 } elif true { 2 } else { 3 }"),
+        Value::Int(2)
+    );
+    assert_eq!(value("if false { 1 }"), Value::None);
+    assert_eq!(value("{ break 42; 1 }"), Value::Int(42));
+    assert_eq!(
+        value("mut i := 0\nfor { i += 1; if i == 5 { break i } }"),
+        Value::Int(5)
+    );
+    assert_eq!(value("mut i := 0\nfor i < 3 { i += 1 }\ni"), Value::Int(3));
+    assert!(matches!(run("exit 3"), Err(Halt::Exit(3))));
+}
+
+#[test]
+fn eval_functions() {
+    assert_eq!(
+        value("function add(a, b) -> { return a + b }\nadd(1, 2)"),
+        Value::Int(3)
+    );
+    assert_eq!(
+        value("function double(x: int) -> int { x * 2 }\n21.double()"),
+        Value::Int(42)
+    );
+    assert_eq!(
+        value("function fact(n) -> { if n <= 1 { return 1 }\nn * fact(n - 1) }\nfact(10)"),
+        Value::Int(3628800)
+    );
+    // functions see the scope they were declared in
+    assert_eq!(
+        value("x := 1\nfunction f() -> { x }\n{ x := 2; f() }"),
+        Value::Int(1)
+    );
+    assert_eq!(
+        error("function f(a) -> { a }\nf()"),
+        "function 'f' expects 1 argument, found 0"
+    );
+}
+
+#[test]
+fn eval_errors() {
+    assert_eq!(error("1 / 0"), "division by zero");
+    assert_eq!(
+        error("1 + none"),
+        "unsupported operand types for +: int and none"
+    );
+    assert_eq!(error("1()"), "int is not callable");
+    assert_eq!(error("return 1"), "return outside of a function");
+    assert_eq!(error("2 ** 100000000"), "the result of ** is too large");
+}
+
+#[test]
+fn eval_strings() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(
+        s(r#"strings::split("a,b,,c", ",")"#),
+        r#"["a", "b", "", "c"]"#
+    );
+    assert_eq!(s(r#"strings::split("abc", "")"#), r#"["a", "b", "c"]"#);
+    assert_eq!(
+        s(r#"strings::join(strings::split("a b c", " "), "-")"#),
+        "a-b-c"
+    );
+    assert_eq!(s(r#"strings::trim("  x  ")"#), "x");
+    assert_eq!(s(r#"strings::trim_start("  x  ")"#), "x  ");
+    assert_eq!(s(r#"strings::replace("aXbX", "X", "-")"#), "a-b-");
+    assert_eq!(s(r#"strings::contains("drag", "ra")"#), "true");
+    assert_eq!(s(r#"strings::starts_with("drag", "dra")"#), "true");
+    assert_eq!(s(r#"strings::to_upper("Dragon")"#), "DRAGON");
+    assert_eq!(s(r#"strings::to_lower("Dragon")"#), "dragon");
+    assert_eq!(s(r#"strings::pad_start("7", 3, "0")"#), "007");
+    assert_eq!(s(r#"strings::pad_end("ab", 4)"#), "ab  ");
+    assert_eq!(
+        s(r#"strings::format("{} + {} = {{{}}}", 1, 2.5, "x")"#),
+        "1 + 2.5 = {x}"
+    );
+    assert_eq!(
+        error(r#"strings::trim(1)"#),
+        "strings::trim expects a string as argument 1, found int"
+    );
+    assert_eq!(
+        error(r#"strings::format("{}")"#),
+        "strings::format template has 1 placeholder, found 0 arguments"
+    );
+    assert_eq!(
+        error(r#"strings::join(strings::split("a", ""), 1)"#),
+        "strings::join expects a string as argument 2, found int"
+    );
+}
+
+#[test]
+fn eval_unicode_strings() {
+    let s = |src: &str| value(src).to_string();
+    // an e and a combining accent, and a thumb with a skin tone
+    let text = r#"text := "e\u{301}👍🏽!""#;
+    let eval = |body: &str| s(&format!("{}\n{}", text, body));
+    assert_eq!(eval("[len(text), byte_len(text)]"), "[5, 12]");
+    assert_eq!(
+        eval("[text[1] == \"\\u{301}\", text[-1]]"),
+        r#"[true, "!"]"#
+    );
+    assert_eq!(eval("mut n := 0\nfor c in text { n += 1 }\nn"), "5");
+    assert_eq!(eval("strings::grapheme_len(text)"), "3");
+    assert_eq!(eval("strings::graphemes(text)[1]"), "👍🏽");
+    assert_eq!(s(r#"strings::graphemes("")"#), "[]");
+
+    assert_eq!(eval(r#"strings::normalize(text) == "é👍🏽!""#), "true");
+    assert_eq!(s(r#"len(strings::normalize("é", "NFD"))"#), "2");
+    assert_eq!(s(r#"strings::normalize("ﬁ²", "NFKC")"#), "fi2");
+    assert_eq!(s(r#"strings::normalize("ﬁ", "NFC")"#), "ﬁ");
+    // strings are compared code point by code point, not normalized
+    assert_eq!(s(r#""e\u{301}" == "é""#), "false");
+    assert_eq!(
+        error(r#"strings::normalize("a", "nfc")"#),
+        r#"strings::normalize expects the form "NFC", "NFD", "NFKC" or "NFKD", found "nfc""#
+    );
+    assert_eq!(
+        error("byte_len(1)"),
+        "byte_len expects a string as argument 1, found int"
+    );
+}
+
+#[test]
+fn eval_string_builders() {
+    let s = |src: &str| value(src).to_string();
+    let built = r#"
+        b := strings::builder("<")
+        for i in [1, 2, 3] {
+            b.push("${i},")
+        }
+        b.push(">")
+        [strings::build(b), len(b), b]
+    "#;
+    assert_eq!(s(built), r#"["<1,2,3,>", 8, <string builder 8>]"#);
+    // built again, the text so far is kept
+    assert_eq!(
+        s(
+            r#"b := strings::builder(); b.push("a"); x := strings::build(b); b.push("b"); [x, strings::build(b)]"#
+        ),
+        r#"["a", "ab"]"#
+    );
+    assert_eq!(
+        error(r#"strings::builder().push(1)"#),
+        "push expects a string as argument 2, found int"
+    );
+    assert_eq!(
+        error(r#"strings::build("a")"#),
+        "strings::build expects a string builder as argument 1, found string"
+    );
+}
+
+#[test]
+fn eval_bytes() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(s(r#"b"a\x00\xff""#), r#"b"a\x00\xff""#);
+    let b = r#"b := b"drag\x00on""#;
+    assert_eq!(
+        s(&format!("{}\n[len(b), b[0], b[-1], b[1:3]]", b)),
+        r#"[7, 100, 110, b"ra"]"#
+    );
+    assert_eq!(s(&format!("{}\nb[::-3] ++ b\"!\"", b)), r#"b"ngd!""#);
+    assert_eq!(
+        s(&format!(
+            "{}\n[0 in b, 256 in b, b\"\\x00o\" in b, b < b\"e\"]",
+            b
+        )),
+        "[true, false, true, true]"
+    );
+    assert_eq!(s("mut n := 0\nfor i in b\"\\x01\\x02\" { n += i }\nn"), "3");
+    assert_eq!(value(r#"b"ab" == bytes::of([97, 98])"#), Value::Bool(true));
+    assert_eq!(value(r#"b"ab" == "ab""#), Value::Bool(false));
+
+    // text the bytes stand for, in each encoding
+    assert_eq!(s(r#"bytes::encode("dé")"#), r#"b"d\xc3\xa9""#);
+    assert_eq!(s(r#"bytes::encode("00ffA0", "hex")"#), r#"b"\x00\xff\xa0""#);
+    assert_eq!(s(r#"bytes::encode("Zm9vYg==", "base64")"#), r#"b"foob""#);
+    assert_eq!(s(r#"bytes::encode("Zm9vYg", "base64")"#), r#"b"foob""#);
+    assert_eq!(s(r#"bytes::decode(b"d\xc3\xa9")"#), "dé");
+    assert_eq!(s(r#"bytes::decode(b"\x00\xff", "hex")"#), "00ff");
+    let base64: Vec<String> = ["", "f", "fo", "foo", "foob"]
+        .iter()
+        .map(|t| s(&format!("bytes::decode(b\"{}\", \"base64\")", t)))
+        .collect();
+    assert_eq!(base64, ["", "Zg==", "Zm8=", "Zm9v", "Zm9vYg=="]);
+
+    assert_eq!(
+        error(r#"bytes::decode(b"a\xff")"#),
+        "the bytes are not valid UTF-8 text, from byte 1"
+    );
+    assert_eq!(
+        error(r#"bytes::encode("abc", "hex")"#),
+        "hex text must have an even number of digits"
+    );
+    assert_eq!(
+        error(r#"bytes::encode("Zm9*", "base64")"#),
+        "invalid base64 digit '*'"
+    );
+    assert_eq!(
+        error(r#"bytes::decode(b"", "utf-16")"#),
+        r#"bytes::decode expects the encoding "utf-8", "hex" or "base64", found "utf-16""#
+    );
+    assert_eq!(
+        error("bytes::of([1, 256])"),
+        "bytes::of expects ints from 0 to 255"
+    );
+    assert_eq!(
+        error(r#"bytes::decode("a")"#),
+        "bytes::decode expects bytes as argument 1, found string"
+    );
+    assert_eq!(
+        error(r#"b"a" ++ "b""#),
+        "unsupported operand types for ++: bytes and string"
+    );
+}
+
+#[test]
+fn eval_math() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(value("math::sqrt(16)"), Value::Float(4.0));
+    assert_eq!(value("math::sin(0)"), Value::Float(0.0));
+    assert_eq!(value("math::cos(math::pi)"), Value::Float(-1.0));
+    assert_eq!(value("math::log(math::e)"), Value::Float(1.0));
+    assert_eq!(value("math::log(8, 2)"), Value::Float(3.0));
+    assert_eq!(value("math::exp(0)"), Value::Float(1.0));
+    assert_eq!(
+        value("math::atan2(1, 0) == math::pi / 2"),
+        Value::Bool(true)
+    );
+    assert_eq!(s("math::sqrt(-1)"), "NaN");
+
+    // ints stay exact
+    assert_eq!(value("math::pow(2, 10)"), Value::Int(1024));
+    assert_eq!(
+        value("math::pow(2, 0.5) == math::sqrt(2)"),
+        Value::Bool(true)
+    );
+    assert_eq!(s("math::pow(10, 20)"), "100000000000000000000");
+    assert_eq!(value("math::abs(-3)"), Value::Int(3));
+    assert_eq!(value("math::abs(-2.5)"), Value::Float(2.5));
+    assert_eq!(
+        s("math::abs(-9223372036854775807 - 1)"),
+        "9223372036854775808"
+    );
+    assert_eq!(value("math::floor(-2.5)"), Value::Int(-3));
+    assert_eq!(value("math::ceil(2.1)"), Value::Int(3));
+    assert_eq!(value("math::round(2.5)"), Value::Int(3));
+    assert_eq!(value("math::round(7)"), Value::Int(7));
+    assert_eq!(s("math::floor(1e20)"), "100000000000000000000");
+    assert_eq!(value("math::min(3, 1.5, 2)"), Value::Float(1.5));
+    assert_eq!(value("math::max(3, 1.5, 2)"), Value::Int(3));
+    assert_eq!(value("math::max(1, 2 ** 70) == 2 ** 70"), Value::Bool(true));
+
+    assert_eq!(
+        error("math::sqrt(\"4\")"),
+        "math::sqrt expects a number as argument 1, found string"
+    );
+    assert_eq!(
+        error("math::floor(math::sqrt(-1))"),
+        "math::floor cannot turn NaN into an int"
+    );
+    assert_eq!(
+        error("math::min()"),
+        "math::min expects at least 1 argument, found 0"
+    );
+    assert_eq!(
+        error("math::log(1, 2, 3)"),
+        "math::log expects 1 or 2 arguments, found 3"
+    );
+}
+
+#[test]
+fn eval_json() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(
+        s(r#"json::parse("{\"b\": [1, 2.5, true, null], \"a\": \"x\"}")"#),
+        r#"{"b": [1, 2.5, true, none], "a": "x"}"#
+    );
+    assert_eq!(
+        s(r#"json::parse("18446744073709551615")"#),
+        "18446744073709551615"
+    );
+    assert_eq!(s(r#"json::parse("\"\\u00e9\"")"#), "é");
+    assert_eq!(
+        s(r#"json::stringify({"a": [1, 2.0, none], 2: ^b, "c": "\"q\""})"#),
+        r#"{"a":[1,2.0,null],"2":"b","c":"\"q\""}"#
+    );
+    assert_eq!(
+        s(r#"json::stringify({"a": [1, {}]}, 2)"#),
+        "{\n  \"a\": [\n    1,\n    {}\n  ]\n}"
+    );
+    assert_eq!(
+        s("struct P { x\ny }\njson::stringify([P(1, 2 ** 64)])"),
+        r#"[{"x":1,"y":18446744073709551616}]"#
+    );
+    // what is written reads back the same
+    assert_eq!(
+        value("m := {\"k\": [1, \"two\", {\"three\": 3.5}]}\njson::parse(json::stringify(m)) == m"),
+        Value::Bool(true)
+    );
+
+    assert_eq!(
+        error(r#"json::parse("[1,")"#),
+        "json::parse found invalid JSON: EOF while parsing a value at line 1 column 3"
+    );
+    assert_eq!(
+        s(r#"try { json::parse("{") } catch e { errors::code(e) }"#),
+        "E04001"
+    );
+    assert_eq!(
+        error("json::stringify([print])"),
+        "json::stringify cannot write function"
+    );
+    assert_eq!(
+        error("l := []\npush(l, l)\njson::stringify(l)"),
+        "json::stringify cannot nest values more than 128 levels deep, does a list contain itself?"
+    );
+    assert_eq!(
+        error("json::stringify(1, -1)"),
+        "json::stringify expects an indent between 0 and 64 as argument 2, found int"
+    );
+}
+
+#[test]
+fn eval_regex() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(
+        value(r#"regex::matches("^a+b$", "aaab")"#),
+        Value::Bool(true)
+    );
+    assert_eq!(
+        value(r#"regex::matches("^a+b$", "aaa")"#),
+        Value::Bool(false)
+    );
+    assert_eq!(
+        s(r#"regex::find("(\\d+)-(\\d+)", "from 10-20 to 30-40")"#),
+        r#"{0: "10-20", 1: "10", 2: "20"}"#
+    );
+    assert_eq!(s(r#"regex::find("x", "abc")"#), "none");
+    assert_eq!(
+        s(r#"regex::find_all("[a-z]+", "one, two and three")"#),
+        r#"[{0: "one"}, {0: "two"}, {0: "and"}, {0: "three"}]"#
+    );
+    assert_eq!(
+        s(
+            r#"regex::find("(?<year>\\d{4})-(?<month>\\d\\d)(-(?<day>\\d\\d))?", "on 2024-05")["year"]"#
+        ),
+        "2024"
+    );
+    assert_eq!(
+        s(
+            r#"regex::find("(?<year>\\d{4})-(?<month>\\d\\d)(-(?<day>\\d\\d))?", "on 2024-05")["day"]"#
+        ),
+        "none"
+    );
+    assert_eq!(
+        s(r#"regex::replace("(?<first>\\w+) (?<last>\\w+)", "Ada Lovelace", '${last}, $first')"#),
+        "Lovelace, Ada"
+    );
+
+    // patterns are values, compiled once
+    assert_eq!(
+        s(r#"word := regex::compile("\\w+")
+words := {^pattern: word}
+[word, len(regex::find_all(words[^pattern], "a bc d")), regex::matches(word, "!")]"#),
+        "[<regex \\w+>, 3, false]"
+    );
+    assert!(error(r#"regex::compile("(")"#).starts_with("invalid regular expression: "));
+    assert_eq!(
+        error(r#"regex::matches(1, "a")"#),
+        "regex::matches expects a regex or a string as argument 1, found int"
+    );
+}
+
+/// Answer the given number of requests on a local port with what they
+/// were, as JSON, returns the port
+fn serve(requests: usize) -> u16 {
+    use std::{
+        io::{Read, Write},
+        net::TcpListener,
+    };
+
+    let listener = TcpListener::bind("127.0.0.1:0").expect("a local port is free");
+    let port = listener
+        .local_addr()
+        .expect("the listener has an address")
+        .port();
+    std::thread::spawn(move || {
+        for stream in listener.incoming().take(requests) {
+            let Ok(mut stream) = stream else {
+                continue;
+            };
+            let mut request = vec![];
+            let mut buffer = [0; 1024];
+            let (head, body) = loop {
+                let n = stream.read(&mut buffer).expect("the request can be read");
+                request.extend_from_slice(&buffer[..n]);
+                let text = String::from_utf8_lossy(&request).to_string();
+                if let Some((head, body)) = text.split_once("\r\n\r\n") {
+                    let length = head
+                        .lines()
+                        .find_map(|l| {
+                            l.to_lowercase()
+                                .strip_prefix("content-length: ")
+                                .and_then(|n| n.parse().ok())
+                        })
+                        .unwrap_or(0);
+                    if body.len() >= length {
+                        break (head.to_owned(), body.to_owned());
+                    }
+                }
+            };
+            let mut words = head.split(' ');
+            let method = words.next().unwrap_or_default();
+            let path = words.next().unwrap_or_default();
+            let header = |name: &str| {
+                head.lines()
+                    .find_map(|l| l.to_lowercase().strip_prefix(name).map(str::to_owned))
+                    .unwrap_or_default()
+            };
+            if path == "/slow" {
+                std::thread::sleep(std::time::Duration::from_secs(2));
+            }
+            let status = match path {
+                "/missing" => "404 Not Found",
+                _ => "200 OK",
+            };
+            let echo = format!(
+                r#"{{"method": "{}", "path": "{}", "body": {:?}, "type": "{}", "token": "{}"}}"#,
+                method,
+                path,
+                body,
+                header("content-type: "),
+                header("x-token: ")
+            );
+            let _ = write!(
+                stream,
+                "HTTP/1.1 {}\r\nContent-Type: application/json\r\nX-Test: a\r\nX-Test: b\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                status,
+                echo.len(),
+                echo
+            );
+        }
+    });
+    port
+}
+
+#[test]
+fn eval_http() {
+    let port = serve(5);
+    let s =
+        |src: &str| value(&src.replace("URL", &format!("http://127.0.0.1:{}", port))).to_string();
+    assert_eq!(
+        s(
+            r#"r := http::get("URL/items?x=1", {"headers": {"x-token": "t"}})
+e := http::json(r)
+[r.status, r.headers["x-test"], e["method"], e["path"], e["token"]]"#
+        ),
+        r#"[200, "a, b", "GET", "/items?x=1", "t"]"#
+    );
+    assert_eq!(
+        s(r#"e := http::json(http::post("URL/new", "hello"))
+[e["method"], e["body"]]"#),
+        r#"["POST", "hello"]"#
+    );
+    assert_eq!(
+        s(
+            r#"e := http::json(http::request("put", "URL/", {"json": {"a": [1]}}))
+[e["method"], e["body"], e["type"]]"#
+        ),
+        r#"["PUT", "{\"a\":[1]}", "application/json"]"#
+    );
+    // statuses of errors are responses too
+    assert_eq!(s(r#"http::get("URL/missing").status"#), "404");
+    assert_eq!(
+        s(
+            r#"try { http::get("URL/slow", {"timeout": 0.2}) } catch e { strings::starts_with(errors::message(e), "http::get failed: ") }"#
+        ),
+        "true"
+    );
+
+    assert_eq!(
+        error(r#"http::get("http://localhost", {"retries": 3})"#),
+        r#"http::get has no option "retries""#
+    );
+    assert_eq!(
+        error(r#"http::get("http://localhost", {"timeout": "1s"})"#),
+        "http::get expects the timeout option to be a number, found string"
+    );
+    assert_eq!(
+        error("http::json(1)"),
+        "http::json expects a response as argument 1, found int"
+    );
+}
+
+#[test]
+fn eval_time() {
+    let s = |src: &str| value(src).to_string();
+    // 2024-05-17 09:30:15.5 UTC
+    let t = "t := 1715938215.5\n";
+    assert_eq!(
+        s(&format!(
+            r#"{}time::format(t, "%Y-%m-%d %H:%M:%S", "UTC")"#,
+            t
+        )),
+        "2024-05-17 09:30:15"
+    );
+    assert_eq!(
+        s(&format!(
+            r#"{}time::format(t, "%d/%m %H:%M %z", "+02:00")"#,
+            t
+        )),
+        "17/05 11:30 +0200"
+    );
+    assert_eq!(
+        s(&format!(
+            r#"{}time::format(t + time::day - 2 * time::hour, "%a %H:%M", "UTC")"#,
+            t
+        )),
+        "Sat 07:30"
+    );
+    assert_eq!(
+        s(&format!(r#"{}time::date(t, "-05:30")"#, t)),
+        r#"{"year": 2024, "month": 5, "day": 17, "hour": 4, "minute": 0, "second": 15, "nanosecond": 500000000, "weekday": 5, "offset": -19800}"#
+    );
+    assert_eq!(
+        value(r#"time::parse("2024-05-17 09:30:15", "%Y-%m-%d %H:%M:%S", "UTC")"#),
+        Value::Float(1715938215.0)
+    );
+    assert_eq!(
+        value(r#"time::parse("2024-05-17 11:30 +0200", "%Y-%m-%d %H:%M %z", "-10:00")"#),
+        Value::Float(1715938200.0)
+    );
+    assert_eq!(
+        value(r#"time::parse("17.05.2024", "%d.%m.%Y", "UTC")"#),
+        Value::Float(1715904000.0)
+    );
+    // a time written and read in the same zone is the same
+    assert_eq!(
+        value(
+            r#"t := math::floor(time::now())
+f := "%Y-%m-%dT%H:%M:%S"
+time::parse(time::format(t, f), f) == t"#
+        ),
+        Value::Bool(true)
+    );
+
+    assert_eq!(
+        value("a := time::monotonic()\ntime::sleep(10 * time::millisecond)\ntime::monotonic() - a >= 0.01"),
+        Value::Bool(true)
+    );
+    assert_eq!(value("time::now() > 1715938215"), Value::Bool(true));
+    assert_eq!(s("time::format_duration(3723.5)"), "1h2m3.5s");
+    assert_eq!(s("time::format_duration(90)"), "1m30s");
+    assert_eq!(s("time::format_duration(-0.25)"), "-0.25s");
+
+    assert_eq!(
+        error(r#"time::parse("May 17", "%Y-%m-%d", "UTC")"#),
+        r#"time::parse cannot read "May 17" with the layout "%Y-%m-%d": input contains invalid characters"#
+    );
+    assert_eq!(
+        error(r#"time::format(0, "%Q")"#),
+        r#"time::format found an invalid layout "%Q""#
+    );
+    assert_eq!(
+        error(r#"time::format(0, "%Y", "Mars/Olympus")"#),
+        r#"time::format cannot find the time zone "Mars/Olympus", it must be "UTC", "local" or an offset such as "+02:00""#
+    );
+    assert_eq!(
+        error("time::sleep(-1)"),
+        "time::sleep cannot sleep for -1 seconds"
+    );
+}
+
+#[test]
+fn eval_os() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(
+        s(
+            r#"o := os::run("sh", ["-c", "echo out; echo err >&2; exit 3"])
+[o.code, o.stdout, o.stderr]"#
+        ),
+        r#"[3, "out\n", "err\n"]"#
+    );
+    assert_eq!(s(r#"os::run("cat", [], {"input": "a\nb"}).stdout"#), "a\nb");
+    assert_eq!(
+        s(
+            r#"os::run("sh", ["-c", "echo $DRGNS_OS_TEST; pwd"], {"env": {"DRGNS_OS_TEST": "x"}, "dir": "/"}).stdout"#
+        ),
+        "x\n/\n"
+    );
+    assert_eq!(s("os::run(\"true\").code"), "0");
+
+    assert_eq!(
+        s(r#"os::set_env("DRGNS_OS_SET", "1")
+a := env("DRGNS_OS_SET")
+os::unset_env("DRGNS_OS_SET")
+[a, env("DRGNS_OS_SET")]"#),
+        r#"["1", none]"#
+    );
+    assert_eq!(s("d := os::cwd()\nos::chdir(d)\nos::cwd() == d"), "true");
+    assert_eq!(s("os::name()"), std::env::consts::OS);
+    assert_eq!(s("os::pid()"), std::process::id().to_string());
+
+    assert_eq!(
+        error(r#"os::run("drgns-no-such-program")"#),
+        "os::run cannot run 'drgns-no-such-program': no such file or directory"
+    );
+    assert_eq!(
+        error(r#"os::run("true", [1])"#),
+        "os::run expects arguments that are strings, found int"
+    );
+    assert_eq!(
+        error(r#"os::run("true", [], {"shell": true})"#),
+        r#"os::run has no option "shell""#
+    );
+    assert_eq!(
+        error(r#"os::set_env("A=B", "1")"#),
+        r#"os::set_env cannot use "A=B" as the name of a variable"#
+    );
+    assert_eq!(
+        error(r#"os::chdir("/drgns/no/such/dir")"#),
+        "os::chdir cannot enter '/drgns/no/such/dir': no such file or directory"
+    );
+}
+
+#[test]
+fn eval_random() {
+    let s = |src: &str| value(src).to_string();
+    // the same seed gives the same numbers
+    let draws = "random::seed(7)\n[random::int(1000), random::float(), random::choice([1, 2, 3])]";
+    assert_eq!(s(draws), s(draws));
+    let shuffled = "random::seed(1)\nl := [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]\nrandom::shuffle(l)\nl";
+    assert_eq!(s(shuffled), s(shuffled));
+    assert_ne!(s(shuffled), "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]");
+
+    assert_eq!(
+        value(
+            r#"mut ok := true
+for _ in range(200) {
+    i := random::int(-2, 3)
+    x := random::float(1.5, 2)
+    ok = ok and i >= -2 and i < 3 and x >= 1.5 and x < 2
+}
+ok"#
+        ),
+        Value::Bool(true)
+    );
+    assert_eq!(s("random::int(1)"), "0");
+    assert_eq!(
+        s("l := random::sample([1, 2, 4], 3)\n[len(l), l[0] + l[1] + l[2]]"),
+        "[3, 7]"
+    );
+    assert_eq!(s("len(random::sample([1, 2, 3], 2))"), "2");
+    assert_eq!(s("len(random::token(16))"), "32");
+    assert_eq!(s("len(random::bytes(5))"), "5");
+
+    assert_eq!(
+        error("random::int(3, 3)"),
+        "random::int expects a low bound under the high one, found 3 and 3"
+    );
+    assert_eq!(
+        error("random::choice([])"),
+        "random::choice expects a list that is not empty"
+    );
+    assert_eq!(
+        error("random::sample([1], 2)"),
+        "random::sample cannot take 2 items from a list of 1"
+    );
+    assert_eq!(
+        error("random::token(-1)"),
+        "random::token expects between 0 and 1048576 bytes, found -1"
+    );
+}
+
+#[test]
+fn eval_inspect() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(s(r#"inspect("a\"b")"#), r#""a\"b""#);
+    assert_eq!(
+        s(r#"inspect([1, "a", {"k": none}])"#),
+        r#"[1, "a", {"k": none}]"#
+    );
+    assert_eq!(
+        s(
+            r#"inspect({"names": ["aardvark", "buffalo", "chameleon", "dromedary"], "counts": [1, 2, 3]})"#
+        ),
+        r#"{
+    "names": ["aardvark", "buffalo", "chameleon", "dromedary"],
+    "counts": [1, 2, 3],
+}"#
+    );
+    assert_eq!(
+        s("struct P { x\ny }\ninspect([P(1, 2), P(\"first long string\", \"second long string\"), P([], {})])"),
+        r#"[
+    P(x: 1, y: 2),
+    P(x: "first long string", y: "second long string"),
+    P(x: [], y: {}),
+]"#
+    );
+
+    // containers inside themselves are not printed again
+    assert_eq!(s("l := [1]\nl.push(l)\n\"${l}\""), "[1, [...]]");
+    assert_eq!(
+        s("m := {\"a\": [2]}\nm[\"a\"].push(m)\ninspect(m)"),
+        r#"{"a": [2, {...}]}"#
+    );
+    // the same list twice is not a cycle
+    assert_eq!(s("l := [1]\n[l, l]"), "[[1], [1]]");
+
+    assert_eq!(
+        s("mut l := []\nfor i in range(150) { l.push(i) }\ninspect(l)")
+            .lines()
+            .last(),
+        Some("]")
+    );
+    assert!(
+        s("mut l := []\nfor i in range(150) { l.push(i) }\ninspect(l)")
+            .contains("\n    99,\n    ... 50 more,\n]")
+    );
+    assert!(s("mut l := []\nfor i in range(150) { l.push(i) }\n\"${l}\"").ends_with("148, 149]"));
+    let long = s(r#"mut t := ""
+for i in range(1005) { t = t ++ "a" }
+inspect(t)"#);
+    assert!(long.ends_with(r#"aaa"... 5 more characters"#));
+    assert_eq!(long.len(), 1023);
+}
+
+#[test]
+fn eval_log() {
+    static LINES: Mutex<Vec<String>> = Mutex::new(vec![]);
+    builtins::set_log_output(|line| LINES.lock().expect("not poisoned").push(line.to_owned()));
+    let lines = |src: &str| {
+        LINES.lock().expect("not poisoned").clear();
+        value(src);
+        std::mem::take(&mut *LINES.lock().expect("not poisoned"))
+    };
+    // the time comes first, then the level padded to the longest one
+    let logged = lines(
+        r#"log::set_level("info")
+log::set_format("text")
+log::debug("hidden")
+log::info("copied", {"files": 3, "to": "/tmp"})
+log::error([1])"#,
+    );
+    assert_eq!(logged.len(), 2);
+    assert!(logged[0].ends_with(r#"Z INFO  copied files=3 to="/tmp""#));
+    assert!(logged[1].ends_with("Z ERROR [1]"));
+    assert_eq!(logged[0].find(' '), Some(24));
+
+    let logged = lines(
+        r#"log::set_level("warn")
+log::set_format("json")
+log::info("hidden")
+log::warn("slow", {"seconds": 1.5, "level": "overridden"})
+log::set_format("text")
+log::set_level("info")"#,
+    );
+    let o = format!("o := json::parse('{}')\n", logged[0]);
+    assert_eq!(
+        value(&(o + r#"[keys(o), o["level"], o["message"], o["seconds"]]"#)),
+        value(r#"[["time", "level", "message", "seconds"], "warn", "slow", 1.5]"#)
+    );
+    assert_eq!(value("log::level()"), Value::from("info"));
+
+    assert_eq!(
+        error(r#"log::set_level("verbose")"#),
+        r#"log::set_level expects "debug", "info", "warn" or "error", found "verbose""#
+    );
+    assert_eq!(
+        error(r#"log::info("x", [1])"#),
+        "log::info expects a map of fields as argument 2, found list"
+    );
+}
+
+#[test]
+fn eval_sync() {
+    let counted = r#"counter := sync::atomic()
+mut total := 0
+m := sync::mutex()
+wg := sync::wait_group()
+function work(n) -> {
+    for _ in range(n) {
+        sync::add(counter)
+        sync::lock(m)
+        total += 1
+        sync::unlock(m)
+    }
+    sync::done(wg)
+}
+for _ in range(4) {
+    sync::add(wg)
+    spawn work(250)
+}
+"#;
+    assert_eq!(
+        value(&format!(
+            "{}[sync::wait(wg), sync::load(counter), total]",
+            counted
+        )),
+        value("[true, 1000, 1000]")
+    );
+    assert_eq!(
+        value("a := sync::atomic(1)\n[sync::add(a, 2), sync::swap(a, 7), sync::compare_swap(a, 3, 0), sync::compare_swap(a, 7, 0), sync::load(a)]"),
+        value("[3, 3, false, true, 0]")
+    );
+    assert_eq!(
+        value("g := sync::wait_group()\nsync::add(g, 2)\nsync::done(g)\n[sync::wait(g, 0.01), g]")
+            .to_string(),
+        "[false, <wait group 1>]"
+    );
+
+    // a task ending while it holds a mutex unlocks it
+    assert_eq!(
+        value("m := sync::mutex()\n(spawn ((m) -> { sync::lock(m)\nthrow \"no\" })(m)).result()\nsync::try_lock(m)"),
+        Value::Bool(true)
+    );
+    assert_eq!(
+        value("m := sync::mutex()\nsync::lock(m)\n[sync::try_lock(m), (spawn sync::try_lock(m)).await()]"),
+        value("[false, false]")
+    );
+    assert_eq!(
+        error("m := sync::mutex()\nsync::lock(m)\nsync::lock(m)"),
+        "sync::lock expects a mutex the task doesn't hold already"
+    );
+    assert_eq!(
+        error("m := sync::mutex()\nsync::lock(m)\n(spawn sync::unlock(m)).await()"),
+        "sync::unlock expects a mutex the task holds"
+    );
+    assert_eq!(
+        error("sync::done(sync::wait_group())"),
+        "sync::done cannot take the count of a wait group from 0 to -1"
+    );
+    assert_eq!(
+        error("sync::add(sync::atomic(9223372036854775807))"),
+        "sync::add cannot add 1 to 9223372036854775807, it overflows"
+    );
+    assert_eq!(
+        error("sync::add(sync::mutex())"),
+        "sync::add expects a wait group or an atomic as argument 1, found mutex"
+    );
+}
+
+#[test]
+fn eval_fs() {
+    let dir = test_utils::directory("interpreter", "fs");
+    let dir = dir.display().to_string();
+    let script = |body: &str| {
+        format!(
+            "dir := {:?}\npath := fs::join(dir, \"a.txt\")\n{}",
+            dir, body
+        )
+    };
+
+    assert_eq!(
+        value(&script(
+            "fs::write(path, \"one\")\nfs::append(path, \"two\")\nfs::read(path)"
+        )),
+        Value::from("onetwo")
+    );
+    assert_eq!(
+        value(&script(
+            "f := fs::open(path, \"w\")\nfs::write(f, \"x\")\nfs::write(f, \"y\")\nfs::close(f)\nfs::read(path)"
+        )),
+        Value::from("xy")
+    );
+    assert_eq!(value(&script("fs::exists(path)")), Value::Bool(true));
+    assert_eq!(value(&script("fs::list(dir)")).to_string(), r#"["a.txt"]"#);
+    assert_eq!(value(&script("fs::is_dir(path)")), Value::Bool(false));
+    assert!(error(&script("fs::read(fs::join(dir, \"missing\"))"))
+        .ends_with("missing': no such file or directory"));
+    assert_eq!(
+        error(&script(
+            "f := fs::open(path, \"r\")\nfs::close(f)\nfs::read(f)"
+        )),
+        format!(
+            "file '{}' is closed",
+            std::path::Path::new(&dir).join("a.txt").display()
+        )
+    );
+    assert!(error(&script("fs::write(fs::open(path, \"r\"), \"x\")"))
+        .ends_with("was not opened for writing"));
+    // bytes are written and read back as they are, whether text or not
+    assert_eq!(
+        value(&script(
+            "fs::write(path, b\"\\xff\\x00\")\nfs::append(path, \"é\")\nfs::read_bytes(path)"
+        ))
+        .to_string(),
+        r#"b"\xff\x00\xc3\xa9""#
+    );
+    assert_eq!(
+        error(&script("fs::write(path, 1)")),
+        "fs::write expects a string or bytes as argument 2, found int"
+    );
+    assert_eq!(
+        error(&script("fs::open(path, \"rw\")")),
+        r#"fs::open expects the mode "r", "w" or "a", found "rw""#
+    );
+    let _ = std::fs::remove_dir_all(dir);
+}
+
+#[test]
+fn eval_snapshots() {
+    assert_eq!(
+        error("expect_snapshot(\"a\", 1)"),
+        "expect_snapshot can only be used in the tests of drgns test"
+    );
+    let dir = test_utils::directory("interpreter", "snapshots");
+
+    builtins::snapshots::set_directory(Some(dir.clone()), false);
+    assert!(error("expect_snapshot(\"a\", 1)")
+        .starts_with("snapshot 'a' was not recorded, drgns test --update writes it to"));
+    builtins::snapshots::set_directory(Some(dir.clone()), true);
+    let record =
+        "expect_snapshot(\"out\", \"one\\ntwo\\n\")\nexpect_snapshot(\"list\", [1, \"a\"])";
+    assert_eq!(value(record), Value::None);
+    assert_eq!(
+        std::fs::read_to_string(dir.join("list.snap")).expect("the snapshot was written"),
+        r#"[1, "a"]"#
+    );
+
+    builtins::snapshots::set_directory(Some(dir.clone()), false);
+    assert_eq!(value(record), Value::None);
+    assert_eq!(
+        error("expect_snapshot(\"out\", \"one\\nthree\\n\")"),
+        r#"snapshot 'out' doesn't match from line 2, expected "two", found "three""#
+    );
+    assert_eq!(
+        error("expect_snapshot(\"out\", \"one\\ntwo\")"),
+        r#"snapshot 'out' doesn't match from line 3, expected "", found the end of the text"#
+    );
+    assert_eq!(
+        error("expect_snapshot(\"../out\", 1)"),
+        "expect_snapshot expects a name made of letters, digits, '-', '_' and '.', found '../out'"
+    );
+    builtins::snapshots::set_directory(None, false);
+    let _ = std::fs::remove_dir_all(&dir);
+}
+
+#[test]
+fn eval_environment() {
+    // tests don't pass arguments
+    assert_eq!(value("args"), Value::list(vec![]));
+    std::env::set_var("DRGNS_TEST_VARIABLE", "dragon");
+    assert_eq!(value("env(\"DRGNS_TEST_VARIABLE\")"), Value::from("dragon"));
+    assert_eq!(value("env(\"DRGNS_TEST_UNSET\")"), Value::None);
+    assert_eq!(
+        value("strings::contains(strings::join(env(), \" \"), \"DRGNS_TEST_VARIABLE\")"),
+        Value::Bool(true)
+    );
+    assert_eq!(
+        error("env(1)"),
+        "env expects a string as argument 1, found int"
+    );
+}
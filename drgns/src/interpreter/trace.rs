@@ -0,0 +1,156 @@
+//! Traces of what scripts run, for finding out what a script does, or what
+//! the interpreter does with it. With `drgns run --trace` each statement is
+//! written to the standard error as it is about to run, with the file and
+//! the line it starts on, and with `--trace=vm` each instruction the VM
+//! runs, as `--dump-bytecode` shows it. Lines are indented by how deep the
+//! calls they run in are nested.
+//!
+//! The VM doesn't keep the statements apart, so on it a statement is traced
+//! each time a function moves to another line, or goes back in it as a loop
+//! does. A trace can be kept to the calls to some functions, and the calls
+//! they make in turn.
+
+use std::{
+    cell::RefCell,
+    io::Write,
+    sync::{
+        atomic::{AtomicBool, AtomicU8, Ordering},
+        Mutex,
+    },
+};
+
+use crate::{bytecode::Chunk, source::SourceString};
+
+/// What a trace shows
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Trace {
+    /// each statement, on either engine
+    Statements,
+    /// each instruction of the VM
+    Vm,
+}
+
+/// the trace being taken, 0 for none and 1 more than the variant otherwise
+static TRACE: AtomicU8 = AtomicU8::new(0);
+
+/// the functions the trace is kept to, all of them when empty
+static FUNCTIONS: Mutex<Vec<String>> = Mutex::new(vec![]);
+
+/// whether the trace is kept to some functions, not to lock them at each
+/// statement
+static KEPT: AtomicBool = AtomicBool::new(false);
+
+/// where the trace is written
+static OUTPUT: Mutex<Option<Box<dyn Write + Send>>> = Mutex::new(None);
+
+thread_local! {
+    /// the calls running on the thread, innermost last, by whether they are
+    /// to one of the functions traced
+    static CALLS: RefCell<Vec<bool>> = const { RefCell::new(vec![]) };
+}
+
+/// Trace what runs from now on, in all threads, to `output`. When
+/// `functions` isn't empty, only what runs in calls to them is traced.
+pub fn start(trace: Trace, functions: Vec<String>, output: Box<dyn Write + Send>) {
+    KEPT.store(!functions.is_empty(), Ordering::Relaxed);
+    *lock(&FUNCTIONS) = functions;
+    *lock(&OUTPUT) = Some(output);
+    TRACE.store(trace as u8 + 1, Ordering::Relaxed);
+}
+
+/// the trace being taken, if one is, the engines look before finding what
+/// to show
+#[inline]
+pub fn current() -> Option<Trace> {
+    match TRACE.load(Ordering::Relaxed) {
+        0 => None,
+        1 => Some(Trace::Statements),
+        _ => Some(Trace::Vm),
+    }
+}
+
+/// A call being traced, until it is dropped
+pub struct Call(());
+
+impl Drop for Call {
+    fn drop(&mut self) {
+        CALLS.with_borrow_mut(|calls| calls.pop());
+    }
+}
+
+/// Count a call to the function among those traced into until the result is
+/// dropped, if a trace is being taken
+pub fn call(name: &str) -> Option<Call> {
+    current()?;
+    let traced = is_traced(name);
+    CALLS.with_borrow_mut(|calls| calls.push(traced));
+    Some(Call(()))
+}
+
+/// Make the innermost call one to another function, which its call in tail
+/// position takes over from
+pub fn replace(name: &str) {
+    if current().is_some() {
+        let traced = is_traced(name);
+        CALLS.with_borrow_mut(|calls| {
+            if let Some(last) = calls.last_mut() {
+                *last = traced;
+            }
+        });
+    }
+}
+
+fn is_traced(name: &str) -> bool {
+    lock(&FUNCTIONS).iter().any(|f| f == name)
+}
+
+/// how deep the calls running are nested, if what they run is traced
+fn depth() -> Option<usize> {
+    let all = !KEPT.load(Ordering::Relaxed);
+    CALLS.with_borrow(|calls| (all || calls.contains(&true)).then_some(calls.len()))
+}
+
+fn write(depth: usize, line: std::fmt::Arguments) {
+    if let Some(output) = lock(&OUTPUT).as_mut() {
+        let _ = writeln!(output, "{:width$}{}", "", line, width = depth * 2);
+    }
+}
+
+/// Trace a statement about to run
+pub fn statement(span: &SourceString) {
+    let Some(depth) = depth() else {
+        return;
+    };
+    let source = span.source();
+    let line = span.position().line;
+    let text = source.line(line).unwrap_or_default();
+    write(
+        depth,
+        format_args!("{}:{} {}", source.name(), line, text.trim()),
+    );
+}
+
+/// Trace an instruction of a function about to run
+pub fn instruction(function: &str, chunk: &Chunk, offset: usize) {
+    let Some(depth) = depth() else {
+        return;
+    };
+    let location = match chunk.source_map.span(offset) {
+        Some(span) => span.location(),
+        None => "-".to_string(),
+    };
+    write(
+        depth,
+        format_args!(
+            "{} {:04} {} {}",
+            function,
+            offset,
+            location,
+            chunk.instruction(offset)
+        ),
+    );
+}
+
+fn lock<T>(mutex: &Mutex<T>) -> std::sync::MutexGuard<'_, T> {
+    mutex.lock().unwrap_or_else(|e| e.into_inner())
+}
@@ -11,7 +11,8 @@ use crate::{
     assert_unreachable,
     eh::ErrorHandler,
     internal_error,
-    source::{Reader, SourceView},
+    lookahead::Cursor,
+    source::{Position, Reader, SourceString},
 };
 
 #[cfg(test)]
@@ -20,33 +21,123 @@ mod test_utils;
 #[cfg(test)]
 mod test;
 
-#[derive(Debug, Clone, Copy, PartialEq, EnumIter)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, EnumIter)]
 pub enum TokenType {
     // unambiguously single-character tokens
     Semicolon,
     LeftParen,
     RightParen,
+    LeftBracket,
+    RightBracket,
+    LeftBrace,
+    RightBrace,
     Comma,
-    Plus,
-    Percent,
-    Minus,
 
     // one or more chars
+    Pipe,
+    PipeGreater,
+    Plus,
+    PlusEquals,
+    PlusPlus,
+    PlusPlusEquals,
+    Minus,
+    MinusEquals,
+    Arrow,
     Slash, // or comment
+    SlashEquals,
     Star,
+    StarEquals,
     Pow,
-
-    // two character
+    Percent,
+    PercentEquals,
+    Equals,
+    EqualsEquals,
+    EqualsTilde,
+    BangEquals,
+    Less,
+    LessEquals,
+    LessLess,
+    Greater,
+    GreaterEquals,
+    GreaterGreater,
+    Colon,
     ColonEquals,
+    ColonColon,
+    Dot,
+    DotDot,
+    Question,
+    QuestionDot,
+    QuestionQuestion,
+    QuestionQuestionEquals,
 
     // literals
     Identifier,
     IntLit,
+    FloatLit,
+    StringLit,
+    RawStringLit,
+    BytesLit,
+    SymbolLit,
+
+    // an interpolated string is split around the expressions it contains,
+    // `"a ${x} b ${y} c"` is `"a ${`, `x`, `} b ${`, `y` and `} c"`
+    InterpolationStart,
+    InterpolationMiddle,
+    InterpolationEnd,
 
     // Keywords
+    And,
+    Asr,
+    Break,
+    Catch,
+    Const,
+    Continue,
+    Copy,
+    Defer,
+    Discard,
+    Elif,
+    Else,
+    Enum,
     Exit,
-
-    // whitespace, comments and already handled tokens
+    False,
+    Finally,
+    For,
+    Function,
+    If,
+    Import,
+    In,
+    Interface,
+    Is,
+    Land,
+    Lnot,
+    Lor,
+    Lsl,
+    Lsr,
+    Lxor,
+    Match,
+    Mod,
+    Move,
+    Mut,
+    None,
+    Not,
+    Or,
+    Return,
+    Spawn,
+    Struct,
+    Throw,
+    True,
+    Try,
+    Use,
+    Xor,
+    Yield,
+
+    // statement terminator, unless it's inside a grouping
+    NewLine,
+
+    // a line or block comment, the parser keeps them aside for tools
+    Comment,
+
+    // whitespace and already handled tokens
     Ignore,
 
     // unrecognized tokens
@@ -57,22 +148,151 @@ type OnceMap<K, V> = OnceLock<RwLock<HashMap<K, V>>>;
 
 static KEYWORDS: OnceMap<&'static str, TokenType> = OnceLock::new();
 
+const KEYWORD_LIST: &[(&str, TokenType)] = &[
+    ("and", TokenType::And),
+    ("asr", TokenType::Asr),
+    ("break", TokenType::Break),
+    ("catch", TokenType::Catch),
+    ("const", TokenType::Const),
+    ("continue", TokenType::Continue),
+    ("copy", TokenType::Copy),
+    ("defer", TokenType::Defer),
+    ("discard", TokenType::Discard),
+    ("elif", TokenType::Elif),
+    ("else", TokenType::Else),
+    ("enum", TokenType::Enum),
+    ("exit", TokenType::Exit),
+    ("false", TokenType::False),
+    ("finally", TokenType::Finally),
+    ("for", TokenType::For),
+    ("function", TokenType::Function),
+    ("if", TokenType::If),
+    ("import", TokenType::Import),
+    ("in", TokenType::In),
+    ("interface", TokenType::Interface),
+    ("is", TokenType::Is),
+    ("land", TokenType::Land),
+    ("lnot", TokenType::Lnot),
+    ("lor", TokenType::Lor),
+    ("lsl", TokenType::Lsl),
+    ("lsr", TokenType::Lsr),
+    ("lxor", TokenType::Lxor),
+    ("match", TokenType::Match),
+    ("mod", TokenType::Mod),
+    ("move", TokenType::Move),
+    ("mut", TokenType::Mut),
+    ("none", TokenType::None),
+    ("not", TokenType::Not),
+    ("or", TokenType::Or),
+    ("return", TokenType::Return),
+    ("spawn", TokenType::Spawn),
+    ("struct", TokenType::Struct),
+    ("throw", TokenType::Throw),
+    ("true", TokenType::True),
+    ("try", TokenType::Try),
+    ("use", TokenType::Use),
+    ("xor", TokenType::Xor),
+    ("yield", TokenType::Yield),
+];
+
 fn kw_2_tt(kw: &str) -> Option<TokenType> {
-    match kw {
-        "exit" => Some(TokenType::Exit),
-        _ => None,
-    }
+    init_keywords()
+        .read()
+        .unwrap_or_else(|_| internal_error!("poisoned lock"))
+        .get(kw)
+        .copied()
 }
 
-fn tt_2_kw(tt: TokenType) -> Option<String> {
-    match tt {
-        TokenType::Exit => Some("exit".to_string()),
-        _ => None,
-    }
+pub fn tt_2_kw(tt: TokenType) -> Option<&'static str> {
+    KEYWORD_LIST
+        .iter()
+        .find_map(|&(kw, t)| (t == tt).then_some(kw))
+}
+
+/// The reserved words, sorted
+pub fn keywords() -> impl Iterator<Item = &'static str> {
+    KEYWORD_LIST.iter().map(|&(kw, _)| kw)
 }
 
 fn init_keywords() -> &'static RwLock<HashMap<&'static str, TokenType>> {
-    KEYWORDS.get_or_init(|| RwLock::new([("exit", TokenType::Exit)].iter().cloned().collect()))
+    KEYWORDS.get_or_init(|| RwLock::new(KEYWORD_LIST.iter().cloned().collect()))
+}
+
+impl TokenType {
+    /// The text of punctuation tokens, which is always the same
+    pub fn symbol(self) -> Option<&'static str> {
+        use TokenType as TT;
+        match self {
+            TT::Semicolon => Some(";"),
+            TT::LeftParen => Some("("),
+            TT::RightParen => Some(")"),
+            TT::LeftBracket => Some("["),
+            TT::RightBracket => Some("]"),
+            TT::LeftBrace => Some("{"),
+            TT::RightBrace => Some("}"),
+            TT::Comma => Some(","),
+            TT::Pipe => Some("|"),
+            TT::PipeGreater => Some("|>"),
+            TT::Plus => Some("+"),
+            TT::PlusEquals => Some("+="),
+            TT::PlusPlus => Some("++"),
+            TT::PlusPlusEquals => Some("++="),
+            TT::Minus => Some("-"),
+            TT::MinusEquals => Some("-="),
+            TT::Arrow => Some("->"),
+            TT::Slash => Some("/"),
+            TT::SlashEquals => Some("/="),
+            TT::Star => Some("*"),
+            TT::StarEquals => Some("*="),
+            TT::Pow => Some("**"),
+            TT::Percent => Some("%"),
+            TT::PercentEquals => Some("%="),
+            TT::Equals => Some("="),
+            TT::EqualsEquals => Some("=="),
+            TT::EqualsTilde => Some("=~"),
+            TT::BangEquals => Some("!="),
+            TT::Less => Some("<"),
+            TT::LessEquals => Some("<="),
+            TT::LessLess => Some("<<"),
+            TT::Greater => Some(">"),
+            TT::GreaterEquals => Some(">="),
+            TT::GreaterGreater => Some(">>"),
+            TT::Colon => Some(":"),
+            TT::ColonEquals => Some(":="),
+            TT::ColonColon => Some("::"),
+            TT::Dot => Some("."),
+            TT::DotDot => Some(".."),
+            TT::Question => Some("?"),
+            TT::QuestionDot => Some("?."),
+            TT::QuestionQuestion => Some("??"),
+            TT::QuestionQuestionEquals => Some("??="),
+            _ => None,
+        }
+    }
+
+    /// A description of the token type for error messages
+    pub fn describe(self) -> String {
+        if let Some(s) = self.symbol().or_else(|| tt_2_kw(self)) {
+            return format!("'{}'", s);
+        }
+        match self {
+            TokenType::Identifier => "identifier",
+            TokenType::IntLit => "integer literal",
+            TokenType::FloatLit => "float literal",
+            TokenType::StringLit => "string literal",
+            TokenType::RawStringLit => "raw string literal",
+            TokenType::BytesLit => "bytes literal",
+            TokenType::SymbolLit => "symbol literal",
+            TokenType::InterpolationStart => "interpolated string",
+            // the brace ending the interpolated expression
+            TokenType::InterpolationMiddle | TokenType::InterpolationEnd => "'}'",
+            TokenType::NewLine => "newline",
+            TokenType::Comment => "comment",
+            TokenType::Ignore => "whitespace",
+            _ => "unknown token",
+        }
+        .to_string()
+    }
 }
 
 impl std::fmt::Display for TokenType {
@@ -84,7 +304,15 @@ impl std::fmt::Display for TokenType {
 #[derive(Clone, Debug)]
 pub struct Token {
     pub token_type: TokenType,
-    pub lexeme: SourceView,
+    pub lexeme: SourceString,
+    pub position: Position,
+}
+
+impl Token {
+    /// The file the token was read from, `None` for REPL input
+    pub fn file(&self) -> Option<&str> {
+        self.lexeme.file()
+    }
 }
 
 impl Display for Token {
@@ -93,25 +321,27 @@ impl Display for Token {
     }
 }
 
-// struct Lexer {
-//     source: String,
-//     tokens: Vec<Token>,
-//     start: usize,
-//     current: usize,
-//     line: usize,
-// }
-
 /// lexer modes let us deal with things like nested string interpolations and
-/// unpaired delimiters
+/// unpaired delimiters, the lexer is in normal mode when none is active
+#[derive(Clone, Copy)]
 enum LexerMode {
-    // starts in normal mode
-    Normal,
+    /// inside `${...}` in a string, counting the braces opened since, the
+    /// string continues at the closing brace they leave unmatched
+    Interpolation { braces: usize },
 }
 
 #[derive(Clone)]
 pub struct Lexer {
     reader: Reader,
     eh: Rc<ErrorHandler>,
+
+    /// currently open delimiters, innermost last
+    delimiters: Vec<(char, SourceString)>,
+
+    /// active modes, innermost last
+    modes: Vec<LexerMode>,
+
+    done: bool,
 }
 
 impl Lexer {
@@ -119,9 +349,17 @@ impl Lexer {
         Self {
             reader,
             eh: eh.clone(),
+            delimiters: vec![],
+            modes: vec![],
+            done: false,
         }
     }
 
+    /// how many delimiters are currently open
+    pub fn delim_depth(&self) -> usize {
+        self.delimiters.len()
+    }
+
     /// lex a group of tokens that share a common prefix, for example
     /// <= and <. Provide a list of mappings from postfixes to tokens, they
     /// are matched in order, so the most specific should be first.
@@ -131,14 +369,14 @@ impl Lexer {
     /// [=]     => <=
     /// []      => <
     /// ```
-    fn lex_postfixes(&mut self, mappings: &[(&[Option<char>], TokenType)]) -> Option<TokenType> {
+    fn lex_postfixes(&mut self, mappings: &[(&[char], TokenType)]) -> Option<TokenType> {
         mappings.iter().find_map(|(cs, tt)| {
             cs.iter()
                 .enumerate()
-                .all(|(i, &c)| self.reader.peek_n(i) == c)
+                .all(|(i, &c)| self.reader.peek_n(i) == Some(c))
                 .then(|| {
                     (0..cs.len()).for_each(|_| {
-                        self.reader.next();
+                        self.reader.advance();
                     });
                     *tt
                 })
@@ -148,102 +386,393 @@ impl Lexer {
     /// parses all tokens that start with a /
     fn lex_div_or_comment(&mut self) -> TokenType {
         use crate::lexer::TokenType as T;
-        match self.reader.peek() {
-            // comment
+        match self.reader.peek_n(0) {
+            // line comment
             Some('/') => {
-                while self.reader.peek() != Some('\n') && self.reader.peek().is_some() {
-                    self.reader.next();
+                while self.reader.peek_n(0).is_some_and(|c| c != '\n') {
+                    self.reader.advance();
                 }
-                T::Ignore
+                T::Comment
+            }
+            // block comment, these can be nested
+            Some('*') => {
+                self.reader.advance();
+                let mut depth = 1;
+                while depth > 0 {
+                    match self.reader.advance() {
+                        Some('/') if self.reader.peek_n(0) == Some('*') => {
+                            self.reader.advance();
+                            depth += 1;
+                        }
+                        Some('*') if self.reader.peek_n(0) == Some('/') => {
+                            self.reader.advance();
+                            depth -= 1;
+                        }
+                        Some(_) => {}
+                        None => {
+                            self.eh.clone().unterminated_comment(self.reader.window());
+                            break;
+                        }
+                    }
+                }
+                T::Comment
+            }
+            Some('=') => {
+                self.reader.advance();
+                T::SlashEquals
             }
             _ => T::Slash,
         }
     }
 
-    fn lex_number_literal(&mut self) -> TokenType {
+    fn lex_number_literal(&mut self, first: char) -> TokenType {
         // helper for matching digit or digit separator, e.g. 123_456_789
         let is_digit_or_sep = |c: char| c.is_ascii_digit() || c == '_';
 
+        // hex, octal and binary literals
+        if first == '0' {
+            let radix = match self.reader.peek_n(0) {
+                Some('x' | 'X') => Some(16),
+                Some('o' | 'O') => Some(8),
+                Some('b' | 'B') => Some(2),
+                _ => None,
+            };
+            if let Some(radix) = radix {
+                self.reader.advance();
+                while self
+                    .reader
+                    .peek_n(0)
+                    .is_some_and(|c| c.is_digit(radix) || c == '_')
+                {
+                    self.reader.advance();
+                }
+                return TokenType::IntLit;
+            }
+        }
+
         // match integer part
-        while self.reader.peek().is_some_and(is_digit_or_sep) {
-            self.reader.next();
+        while self.reader.peek_n(0).is_some_and(is_digit_or_sep) {
+            self.reader.advance();
+        }
+
+        let mut token_type = TokenType::IntLit;
+
+        // fractional part, a digit is required after the dot, so that `1.foo()`
+        // is still a method call on an integer
+        if self.reader.peek_n(0) == Some('.')
+            && self.reader.peek_n(1).is_some_and(|c| c.is_ascii_digit())
+        {
+            self.reader.advance();
+            while self.reader.peek_n(0).is_some_and(is_digit_or_sep) {
+                self.reader.advance();
+            }
+            token_type = TokenType::FloatLit;
+        }
+
+        // exponent
+        if matches!(self.reader.peek_n(0), Some('e' | 'E')) {
+            let signed = matches!(self.reader.peek_n(1), Some('+' | '-'));
+            let digit_at = if signed { 2 } else { 1 };
+            if self
+                .reader
+                .peek_n(digit_at)
+                .is_some_and(|c| c.is_ascii_digit())
+            {
+                (0..=digit_at).for_each(|_| {
+                    self.reader.advance();
+                });
+                while self.reader.peek_n(0).is_some_and(is_digit_or_sep) {
+                    self.reader.advance();
+                }
+                token_type = TokenType::FloatLit;
+            }
+        }
+
+        log::trace!("lexing number literal '{}'", self.reader.window());
+
+        token_type
+    }
+
+    /// lex a string literal, the opening quote has already been consumed.
+    /// Raw strings don't have escape sequences nor interpolation. `continued`
+    /// is set when lexing the rest of a string after an interpolation.
+    fn lex_string_literal(&mut self, quote: char, continued: bool) -> TokenType {
+        use TokenType as TT;
+        loop {
+            match self.reader.advance() {
+                Some('\\') if quote == '"' => {
+                    self.reader.advance();
+                }
+                Some('$') if quote == '"' && self.reader.peek_n(0) == Some('{') => {
+                    self.reader.advance();
+                    self.open_delimiter('{');
+                    self.modes.push(LexerMode::Interpolation { braces: 0 });
+                    return match continued {
+                        true => TT::InterpolationMiddle,
+                        false => TT::InterpolationStart,
+                    };
+                }
+                Some(c) if c == quote => break,
+                Some(_) => {}
+                None => {
+                    self.eh.clone().unterminated_string(self.reader.window());
+                    break;
+                }
+            }
         }
+        match (quote, continued) {
+            (_, true) => TT::InterpolationEnd,
+            ('"', false) => TT::StringLit,
+            _ => TT::RawStringLit,
+        }
+    }
 
-        log::trace!("lexing int literal '{}'", self.reader.current);
+    /// lex a bytes literal, `b"` has already been consumed. It has escape
+    /// sequences but no interpolation.
+    fn lex_bytes_literal(&mut self) -> TokenType {
+        loop {
+            match self.reader.advance() {
+                Some('\\') => {
+                    self.reader.advance();
+                }
+                Some('"') => break,
+                Some(_) => {}
+                None => {
+                    self.eh.clone().unterminated_string(self.reader.window());
+                    break;
+                }
+            }
+        }
+        TokenType::BytesLit
+    }
 
-        TokenType::IntLit
+    fn lex_symbol_literal(&mut self) -> TokenType {
+        if !self
+            .reader
+            .peek_n(0)
+            .is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+        {
+            self.eh.clone().unexpected_char(self.reader.window(), '^');
+            return TokenType::Unknown;
+        }
+        self.lex_identifier();
+        TokenType::SymbolLit
     }
 
     fn lex_identifier(&mut self) -> TokenType {
         while self
             .reader
-            .peek()
+            .peek_n(0)
             .is_some_and(|c| c.is_ascii_alphanumeric() || c == '_')
         {
-            self.reader.next();
+            self.reader.advance();
         }
 
-        let text = self.reader.current.clone().into_string();
-        if let Some(type_) = init_keywords()
-            .read()
-            .unwrap_or_else(|_| internal_error!("poisoned lock"))
-            .get(text.as_str())
-        {
-            *type_
-        } else {
-            TokenType::Identifier
+        // identifiers of functions with side-effects end with a bang, careful
+        // not to confuse it with `!=`
+        if self.reader.peek_n(0) == Some('!') && self.reader.peek_n(1) != Some('=') {
+            self.reader.advance();
+        }
+
+        let text = self.reader.window().to_string();
+        kw_2_tt(text.as_str()).unwrap_or(TokenType::Identifier)
+    }
+
+    fn in_interpolation(&self) -> bool {
+        matches!(self.modes.last(), Some(LexerMode::Interpolation { .. }))
+    }
+
+    fn open_delimiter(&mut self, c: char) {
+        self.delimiters.push((c, self.reader.window()));
+    }
+
+    fn close_delimiter(&mut self, c: char) {
+        let opening = match c {
+            ')' => '(',
+            ']' => '[',
+            _ => '{',
+        };
+        match self.delimiters.last() {
+            Some((o, _)) if *o == opening => {
+                self.delimiters.pop();
+            }
+            _ => self.eh.clone().unmatched_delimiter(self.reader.window(), c),
         }
     }
 
     fn normal_mode_next(&mut self) -> Option<Token> {
         use TokenType as TT;
-        let c = self.reader.next()?;
+        let c = match self.reader.advance() {
+            Some(c) => c,
+            None => {
+                if !self.done {
+                    self.done = true;
+                    for (c, span) in std::mem::take(&mut self.delimiters) {
+                        self.eh.clone().unclosed_delimiter(span, c);
+                    }
+                }
+                return None;
+            }
+        };
         let token_type = match c {
             // unambiguously single-character tokens
             ';' => TT::Semicolon,
-            ')' => TT::RightParen,
-            '(' => TT::LeftParen,
             ',' => TT::Comma,
-            '+' => TT::Plus,
-            '%' => TT::Percent,
-            '-' => TT::Minus,
+            '{' if self.in_interpolation() => {
+                self.open_delimiter(c);
+                if let Some(LexerMode::Interpolation { braces }) = self.modes.last_mut() {
+                    *braces += 1;
+                }
+                TT::LeftBrace
+            }
+            '}' if matches!(
+                self.modes.last(),
+                Some(LexerMode::Interpolation { braces: 0 })
+            ) =>
+            {
+                self.close_delimiter(c);
+                self.modes.pop();
+                self.lex_string_literal('"', true)
+            }
+            '}' if self.in_interpolation() => {
+                self.close_delimiter(c);
+                if let Some(LexerMode::Interpolation { braces }) = self.modes.last_mut() {
+                    *braces -= 1;
+                }
+                TT::RightBrace
+            }
+            '(' | '[' | '{' => {
+                self.open_delimiter(c);
+                match c {
+                    '(' => TT::LeftParen,
+                    '[' => TT::LeftBracket,
+                    _ => TT::LeftBrace,
+                }
+            }
+            ')' | ']' | '}' => {
+                self.close_delimiter(c);
+                match c {
+                    ')' => TT::RightParen,
+                    ']' => TT::RightBracket,
+                    _ => TT::RightBrace,
+                }
+            }
 
             // one or more chars
+            '+' => self
+                .lex_postfixes(&[
+                    (&['+', '='], TT::PlusPlusEquals),
+                    (&['+'], TT::PlusPlus),
+                    (&['='], TT::PlusEquals),
+                    (&[], TT::Plus),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '-' => self
+                .lex_postfixes(&[
+                    (&['>'], TT::Arrow),
+                    (&['='], TT::MinusEquals),
+                    (&[], TT::Minus),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '|' => self
+                .lex_postfixes(&[(&['>'], TT::PipeGreater), (&[], TT::Pipe)])
+                .unwrap_or_else(|| assert_unreachable!()),
             '/' => self.lex_div_or_comment(), // or comment
             '*' => self
-                .lex_postfixes(&[(&[Some('*')], TT::Pow), (&[], TT::Star)])
+                .lex_postfixes(&[(&['*'], TT::Pow), (&['='], TT::StarEquals), (&[], TT::Star)])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '%' => self
+                .lex_postfixes(&[(&['='], TT::PercentEquals), (&[], TT::Percent)])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '=' => self
+                .lex_postfixes(&[
+                    (&['='], TT::EqualsEquals),
+                    (&['~'], TT::EqualsTilde),
+                    (&[], TT::Equals),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '<' => self
+                .lex_postfixes(&[
+                    (&['='], TT::LessEquals),
+                    (&['<'], TT::LessLess),
+                    (&[], TT::Less),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '>' => self
+                .lex_postfixes(&[
+                    (&['='], TT::GreaterEquals),
+                    (&['>'], TT::GreaterGreater),
+                    (&[], TT::Greater),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            ':' => self
+                .lex_postfixes(&[
+                    (&['='], TT::ColonEquals),
+                    (&[':'], TT::ColonColon),
+                    (&[], TT::Colon),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '?' => self
+                .lex_postfixes(&[
+                    (&['?', '='], TT::QuestionQuestionEquals),
+                    (&['?'], TT::QuestionQuestion),
+                    (&['.'], TT::QuestionDot),
+                    (&[], TT::Question),
+                ])
+                .unwrap_or_else(|| assert_unreachable!()),
+            '.' => self
+                .lex_postfixes(&[(&['.'], TT::DotDot), (&[], TT::Dot)])
                 .unwrap_or_else(|| assert_unreachable!()),
 
             // two character
-            ':' => self
-                .lex_postfixes(&[(&[Some('=')], TT::ColonEquals)])
+            '!' => self
+                .lex_postfixes(&[(&['='], TT::BangEquals)])
                 .unwrap_or_else(|| {
-                    self.eh
-                        .clone()
-                        .unexpected_char(self.reader.current.clone(), c);
+                    self.eh.clone().unexpected_char(self.reader.window(), c);
                     TT::Unknown
                 }),
 
+            // a shebang, `#!/usr/bin/env drgns`, is a comment on the first line
+            '#' if self.reader.window().start() == 0 && self.reader.peek_n(0) == Some('!') => {
+                while self.reader.peek_n(0).is_some_and(|c| c != '\n') {
+                    self.reader.advance();
+                }
+                TT::Comment
+            }
+
+            // newlines are significant, the parser decides when to ignore them
+            '\n' => TT::NewLine,
+
             // ignore whitespace
-            ' ' | '\n' | '\r' | '\t' => TT::Ignore,
+            ' ' | '\r' | '\t' | '\u{000B}' | '\u{000C}' | '\u{200E}' | '\u{200F}' | '\u{2028}'
+            | '\u{2029}' => TT::Ignore,
 
             // numbers
-            c if c.is_ascii_digit() => self.lex_number_literal(),
+            c if c.is_ascii_digit() => self.lex_number_literal(c),
 
             // literals
+            '"' | '\'' => self.lex_string_literal(c, false),
+            '^' => self.lex_symbol_literal(),
+            'b' if self.reader.peek_n(0) == Some('"') => {
+                self.reader.advance();
+                self.lex_bytes_literal()
+            }
             c if c.is_ascii_alphabetic() || c == '_' => self.lex_identifier(),
 
             _ => {
                 log::trace!("unmatched char");
-                // self.eh
-                //     .clone()
-                //     .unexpected_char(self.reader.current.clone(), c);
+                self.eh.clone().unexpected_char(self.reader.window(), c);
                 TT::Unknown
             }
         };
+        let lexeme = self
+            .reader
+            .consume()
+            .unwrap_or_else(|| internal_error!("empty lexeme"));
         Some(Token {
             token_type,
-            lexeme: self.reader.advance_tail(),
+            position: lexeme.position(),
+            lexeme,
         })
     }
 }
@@ -251,12 +780,9 @@ impl Lexer {
 impl Iterator for Lexer {
     type Item = Token;
 
+    /// yields every token, including whitespace, so that the token stream
+    /// covers the entire source
     fn next(&mut self) -> Option<Self::Item> {
-        use TokenType as TT;
-        let ot = self.normal_mode_next();
-        if ot.clone().is_some_and(|t| t.token_type == TT::Ignore) {
-            return self.next();
-        }
-        ot
+        self.normal_mode_next()
     }
 }
@@ -1,68 +1,256 @@
-use std::rc::Rc;
+use std::{rc::Rc, sync::Arc};
 
 use strum::IntoEnumIterator;
 
 use crate::{
+    compiler::compile,
     eh::ErrorHandler,
-    source::{Reader, SourceArena},
+    interpreter::{Halt, Interpreter},
+    parser::parse,
+    source::{Position, Reader, Source},
     two_char_strings,
+    vm::Vm,
 };
 
-use super::{test_utils::tokens_2_str, Lexer, TokenType};
+use super::{test_utils::tokens_2_str, Lexer, Token, TokenType};
 
 use itertools::iproduct;
 
-fn make_context() -> (Rc<SourceArena>, Rc<ErrorHandler>, Lexer) {
-    let src = Rc::new(SourceArena::new());
-    let eh = Rc::new(ErrorHandler::new(&src));
-    let lx = Lexer::new(Reader::from_arena(&src), &eh);
-    (src, eh, lx)
+fn lex(s: &str) -> (Rc<ErrorHandler>, Vec<Token>) {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let eh = Rc::new(ErrorHandler::new());
+    let tokens = Lexer::new(Reader::new(&src), &eh).collect();
+    (eh, tokens)
+}
+
+fn token_types(s: &str) -> Vec<TokenType> {
+    lex(s).1.iter().map(|t| t.token_type).collect()
+}
+
+/// token types that can be lexed on their own, the parts of an interpolated
+/// string only appear together
+fn standalone() -> impl Iterator<Item = TokenType> + Clone {
+    use TokenType as TT;
+    TT::iter().filter(|tt| {
+        !matches!(
+            tt,
+            TT::InterpolationStart | TT::InterpolationMiddle | TT::InterpolationEnd
+        )
+    })
 }
 
 #[test]
 fn lex_single_tokens() {
-    let (src, _eh, mut lx) = make_context();
-
-    // actual test
-    for tt in TokenType::iter() {
-        src.intern(tokens_2_str(tt).to_string());
-        src.intern(" ".to_string());
-        assert_eq!(lx.next().unwrap().token_type, tt);
-        assert_eq!(lx.next().unwrap().token_type, TokenType::Ignore);
+    for tt in standalone() {
+        let s = tokens_2_str(tt).to_string() + " ";
+        assert_eq!(
+            token_types(&s),
+            vec![tt, TokenType::Ignore],
+            "lexing {:?}",
+            s
+        );
     }
 }
 
 #[test]
 fn lex_token_pairs() {
-    let (src, _eh, mut lx) = make_context();
-
-    for (tt1, tt2) in iproduct!(TokenType::iter(), TokenType::iter()) {
-        src.intern(tokens_2_str(tt1).to_string());
-        src.intern(" ".to_string());
-        src.intern(tokens_2_str(tt2).to_string());
-        src.intern(" ".to_string());
-        assert_eq!(lx.next().unwrap().token_type, tt1);
-        assert_eq!(lx.next().unwrap().token_type, TokenType::Ignore);
-        assert_eq!(lx.next().unwrap().token_type, tt2);
-        assert_eq!(lx.next().unwrap().token_type, TokenType::Ignore);
+    for (tt1, tt2) in iproduct!(standalone(), standalone()) {
+        let s = format!("{} {} ", tokens_2_str(tt1), tokens_2_str(tt2));
+        assert_eq!(
+            token_types(&s),
+            vec![tt1, TokenType::Ignore, tt2, TokenType::Ignore],
+            "lexing {:?}",
+            s
+        );
     }
 }
 
 #[test]
 fn lex_arbitrary_text() {
-    let (src, _eh, lx) = make_context();
+    // just asserting that it lexes all the way through
     for s in two_char_strings!() {
-        src.intern(s);
+        let _ = lex(&s);
     }
-    // just asserting that it lexes all the way through
-    for _ in lx {}
 }
 
 #[test]
 fn lex_int_literals() {
-    let (src, _eh, mut lx) = make_context();
-    src.intern("1234".to_string());
-    let t = lx.next().unwrap();
-    assert_eq!(t.token_type, TokenType::IntLit);
-    assert_eq!(t.lexeme.to_string(), format!("1234"));
+    let (_eh, tokens) = lex("1234");
+    assert_eq!(tokens[0].token_type, TokenType::IntLit);
+    assert_eq!(tokens[0].lexeme.to_string(), format!("1234"));
+
+    for s in ["1_234", "0xAB_CD", "0o17", "0b0101"] {
+        assert_eq!(token_types(s), vec![TokenType::IntLit], "lexing {:?}", s);
+    }
+}
+
+#[test]
+fn lex_float_literals() {
+    for s in ["3.14", "123.0E+20", "123.0E-20", "1e5"] {
+        assert_eq!(token_types(s), vec![TokenType::FloatLit], "lexing {:?}", s);
+    }
+
+    // a method call on an integer is not a float
+    assert_eq!(
+        token_types("1.print"),
+        vec![TokenType::IntLit, TokenType::Dot, TokenType::Identifier]
+    );
+    assert_eq!(
+        token_types("1..x"),
+        vec![TokenType::IntLit, TokenType::DotDot, TokenType::Identifier]
+    );
+}
+
+#[test]
+fn lex_interpolation() {
+    use TokenType as TT;
+    let (eh, tokens) = lex("\"a ${x} b ${ {y} } c\"");
+    assert!(!eh.had_error());
+    let tokens: Vec<(TokenType, String)> = tokens
+        .into_iter()
+        .filter(|t| t.token_type != TT::Ignore)
+        .map(|t| (t.token_type, t.lexeme.to_string()))
+        .collect();
+    let t = |tt, s: &str| (tt, s.to_string());
+    assert_eq!(
+        tokens,
+        vec![
+            t(TT::InterpolationStart, "\"a ${"),
+            t(TT::Identifier, "x"),
+            t(TT::InterpolationMiddle, "} b ${"),
+            t(TT::LeftBrace, "{"),
+            t(TT::Identifier, "y"),
+            t(TT::RightBrace, "}"),
+            t(TT::InterpolationEnd, "} c\""),
+        ]
+    );
+    // strings nest inside the interpolated expressions
+    assert_eq!(
+        token_types("\"${\"${1}\"}\""),
+        vec![
+            TT::InterpolationStart,
+            TT::InterpolationStart,
+            TT::IntLit,
+            TT::InterpolationEnd,
+            TT::InterpolationEnd
+        ]
+    );
+    // escaped or in raw strings, `${` is just text
+    assert_eq!(token_types("\"\\${x}\""), vec![TT::StringLit]);
+    assert_eq!(token_types("'${x}'"), vec![TT::RawStringLit]);
+}
+
+#[test]
+fn lex_bytes_literals() {
+    use TokenType as TT;
+    assert_eq!(token_types(r#"b"a\"${x}""#), vec![TT::BytesLit]);
+    // only right before a quote, `b` is a name otherwise
+    assert_eq!(
+        token_types(r#"b "a""#),
+        vec![TT::Identifier, TT::Ignore, TT::StringLit]
+    );
+    assert_eq!(token_types("ab\"a\""), vec![TT::Identifier, TT::StringLit]);
+}
+
+#[test]
+fn lex_comments() {
+    assert_eq!(
+        token_types("// hi\n"),
+        vec![TokenType::Comment, TokenType::NewLine]
+    );
+    assert_eq!(
+        token_types("/* a /* nested */ comment */1"),
+        vec![TokenType::Comment, TokenType::IntLit]
+    );
+}
+
+#[test]
+fn lex_shebang() {
+    assert_eq!(
+        token_types("#!/usr/bin/env drgns\n1"),
+        vec![TokenType::Comment, TokenType::NewLine, TokenType::IntLit]
+    );
+    // anywhere else, `#` is still not a token
+    assert!(token_types("1\n#!x").contains(&TokenType::Unknown));
+}
+
+#[test]
+fn shebang_keeps_line_numbers() {
+    let s = "#!/usr/bin/env drgns\nx := 1\nx / 0";
+    let (_eh, tokens) = lex(s);
+    let lines: Vec<usize> = tokens
+        .iter()
+        .filter(|t| t.token_type == TokenType::Identifier)
+        .map(|t| t.position.line)
+        .collect();
+    assert_eq!(lines, vec![2, 3]);
+    // and so do the errors of both engines
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    let walked = Interpreter::new().eval(&program);
+    let compiled = Vm::new().run(compile(&program));
+    for outcome in [walked, compiled] {
+        match outcome {
+            Err(Halt::Error(e)) => assert_eq!(
+                (
+                    e.message().to_string(),
+                    e.span().map(|s| s.position().to_string())
+                ),
+                ("division by zero".to_string(), Some("3:1".to_string()))
+            ),
+            _ => panic!("dividing by zero must fail"),
+        }
+    }
+}
+
+#[test]
+fn lex_bang_identifiers() {
+    assert_eq!(token_types("print!"), vec![TokenType::Identifier]);
+    assert_eq!(
+        token_types("a!=b"),
+        vec![
+            TokenType::Identifier,
+            TokenType::BangEquals,
+            TokenType::Identifier
+        ]
+    );
+}
+
+#[test]
+fn token_positions() {
+    let (_eh, tokens) = lex("foo := 1\n  \"ü\" + bar");
+    let pos: Vec<(TokenType, Position)> = tokens
+        .into_iter()
+        .filter(|t| t.token_type != TokenType::Ignore)
+        .map(|t| (t.token_type, t.position))
+        .collect();
+    let p = |line, column, offset| Position {
+        line,
+        column,
+        offset,
+    };
+    assert_eq!(
+        pos,
+        vec![
+            (TokenType::Identifier, p(1, 1, 0)),
+            (TokenType::ColonEquals, p(1, 5, 4)),
+            (TokenType::IntLit, p(1, 8, 7)),
+            (TokenType::NewLine, p(1, 9, 8)),
+            (TokenType::StringLit, p(2, 3, 11)),
+            // the ü takes 2 bytes
+            (TokenType::Plus, p(2, 7, 16)),
+            (TokenType::Identifier, p(2, 9, 18)),
+        ]
+    );
+}
+
+#[test]
+fn lex_errors() {
+    for s in ["\"unterminated", "/* unterminated", "(", ")", "(]", "`"] {
+        let (eh, _) = lex(s);
+        assert!(eh.had_error(), "lexing {:?}", s);
+    }
+    let (eh, _) = lex("([{}])");
+    assert!(!eh.had_error());
 }
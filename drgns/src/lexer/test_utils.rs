@@ -3,6 +3,8 @@ use std::{
     sync::{OnceLock, RwLock},
 };
 
+use crate::assert_unreachable;
+
 use super::{OnceMap, TokenType};
 
 static STR_2_TOKENS: OnceMap<&'static str, TokenType> = OnceLock::new();
@@ -28,7 +30,7 @@ fn init_str_2_tokens() -> &'static RwLock<HashMap<&'static str, TokenType>> {
                 (" ", TT::Ignore),
                 ("\t", TT::Ignore),
                 ("\r", TT::Ignore),
-                ("\n", TT::Ignore),
+                ("\n", TT::NewLine),
             ]
             .iter()
             .cloned()
@@ -47,23 +49,25 @@ pub fn str_2_tokens(s: &str) -> TokenType {
 
 pub fn tokens_2_str(tt: TokenType) -> &'static str {
     use TokenType as TT;
+    if let Some(kw) = super::tt_2_kw(tt) {
+        return kw;
+    }
+    if let Some(s) = tt.symbol() {
+        return s;
+    }
     match tt {
-        TT::Semicolon => ";",
-        TT::LeftParen => "(",
-        TT::RightParen => ")",
-        TT::Comma => ",",
-        TT::Plus => "+",
-        TT::Star => "*",
-        TT::Percent => "%",
-        TT::Slash => "/",
-        TT::Minus => "-",
-        TT::ColonEquals => ":=",
         TT::Identifier => "andy",
         TT::IntLit => "42",
+        TT::FloatLit => "4.2",
+        TT::StringLit => "\"hi\"",
+        TT::RawStringLit => "'hi'",
+        TT::BytesLit => "b\"hi\"",
+        TT::SymbolLit => "^hi",
+        TT::NewLine => "\n",
+        TT::Comment => "/* hi */",
         TT::Ignore => " ",
-        TT::Unknown => "?",
-        TT::Pow => "**",
-        TT::Exit => "exit",
+        TT::Unknown => "`",
+        _ => assert_unreachable!(),
     }
 }
 
@@ -0,0 +1,58 @@
+//! Dragon-script, as a library.
+//!
+//! The command line tool is a thin layer over this crate, programs that want
+//! to run scripts themselves use [`Interpreter`]:
+//!
+//! ```
+//! use drgns::{Interpreter, Value};
+//!
+//! let mut interpreter = Interpreter::new();
+//! interpreter.set_global("width", Value::Int(3));
+//! interpreter.register_func("double", |x: i64| x * 2);
+//! let area = interpreter.eval_string("double(width) * 2").unwrap();
+//! assert_eq!(area, Value::Int(12));
+//! ```
+
+#![allow(clippy::zero_prefixed_literal)]
+// TODO: remove in production
+#![allow(dead_code)]
+#![warn(clippy::unwrap_used)]
+#![feature(trait_alias)]
+#![feature(type_alias_impl_trait)]
+
+use error_handler as eh;
+
+pub mod bytecode;
+pub mod checker;
+pub mod compiler;
+mod data;
+pub mod diagnostics;
+pub mod differential;
+pub mod doc;
+mod embed;
+pub mod error_handler;
+pub mod formatter;
+pub mod highlight;
+pub mod index;
+pub mod interpreter;
+pub mod lexer;
+pub mod lint;
+mod lookahead;
+pub mod modules;
+pub mod packages;
+pub mod parser;
+pub mod playground;
+pub mod rename;
+pub mod source;
+#[cfg(test)]
+mod test_utils;
+pub mod values;
+pub mod vm;
+
+pub use eh::DragonError;
+pub use embed::{Engine, EvalError, FromValue, Interpreter, IntoValue, NativeFn};
+pub use interpreter::{
+    limits::Limits,
+    sandbox::{Capability, Sandbox},
+};
+pub use values::Value;
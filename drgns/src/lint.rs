@@ -0,0 +1,351 @@
+//! The linter of `drgns lint`, finds code that works but is likely a mistake
+//! or hard to read.
+//!
+//! Unlike the diagnostics of the checker, which are about programs that
+//! fail, each lint comes from a rule that a project can turn off or make an
+//! error, see `RULES`. They are set in the `[lint]` section of its
+//! `drgn.toml`:
+//!
+//! ```toml
+//! [lint]
+//! shadowing = "off"
+//! float-equality = "error"
+//! long-function.max-lines = 80
+//! ```
+//!
+//! Comments turn rules off for some lines, all of them or those listed
+//! after the directive:
+//!
+//! - `// lint:disable shadowing, naming` alone on its line, until a
+//!   `// lint:enable` of the same rules or the end of the file;
+//! - `// lint:disable` after code, for the line it is on;
+//! - `// lint:disable-next-line`, for the line below it.
+//!
+//! Some lints have a single fix, which `fix` applies. Fixes only change the
+//! code they are about, the comments and the layout of the rest are kept.
+
+use std::{
+    collections::HashMap,
+    ops::{Range, RangeInclusive},
+    path::Path,
+};
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    packages::{
+        self,
+        toml::{self, Value},
+    },
+    parser::{self, Program},
+    source::Source,
+};
+
+mod rules;
+#[cfg(test)]
+mod test;
+
+/// A kind of lint, which can be configured by its name
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Rule {
+    pub name: &'static str,
+    pub code: ErrorCode,
+    pub summary: &'static str,
+}
+
+pub const RULES: &[Rule] = &[
+    Rule {
+        name: "unused-variable",
+        code: ErrorCode::UnusedVariable,
+        summary: "a local variable, parameter or import is never used",
+    },
+    Rule {
+        name: "shadowing",
+        code: ErrorCode::Shadowing,
+        summary: "a name hides the one of an enclosing scope",
+    },
+    Rule {
+        name: "float-equality",
+        code: ErrorCode::FloatEquality,
+        summary: "floats are compared with `==` or `!=`",
+    },
+    Rule {
+        name: "long-function",
+        code: ErrorCode::LongFunction,
+        summary: "a function is longer than `long-function.max-lines`",
+    },
+    Rule {
+        name: "naming",
+        code: ErrorCode::Naming,
+        summary: "a struct is not named in PascalCase, or another name in snake_case",
+    },
+    Rule {
+        name: "nil-comparison",
+        code: ErrorCode::NilComparison,
+        summary: "a value is compared with `nil` or `null`, which drgns calls `none`",
+    },
+    Rule {
+        name: "trailing-comma",
+        code: ErrorCode::TrailingComma,
+        summary: "the last of items written one per line isn't followed by a comma",
+    },
+];
+
+/// The lines of a function, above which `long-function` reports it
+pub const DEFAULT_MAX_LINES: usize = 50;
+
+/// What a rule reports its lints as
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Severity {
+    Off,
+    Warning,
+    Error,
+}
+
+impl Severity {
+    fn parse(text: &str) -> Option<Self> {
+        match text {
+            "off" => Some(Self::Off),
+            "warning" => Some(Self::Warning),
+            "error" => Some(Self::Error),
+            _ => None,
+        }
+    }
+}
+
+/// How a project sets up the rules, every rule warns by default
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Config {
+    severities: HashMap<&'static str, Severity>,
+    pub max_lines: usize,
+}
+
+impl Default for Config {
+    fn default() -> Self {
+        Self {
+            severities: HashMap::new(),
+            max_lines: DEFAULT_MAX_LINES,
+        }
+    }
+}
+
+impl Config {
+    /// The configuration in the `[lint]` section of a manifest
+    pub fn parse(text: &str) -> Result<Self, String> {
+        let mut config = Self::default();
+        let sections = toml::parse(text)?;
+        let entries = sections
+            .into_iter()
+            .filter(|s| s.name == "lint")
+            .flat_map(|s| s.entries);
+        for (key, value) in entries {
+            match (key.as_str(), value) {
+                ("long-function.max-lines", Value::Integer(n)) if n > 0 => {
+                    config.max_lines = n as usize;
+                }
+                ("long-function.max-lines", _) => {
+                    return Err("`long-function.max-lines` must be a positive integer".to_owned())
+                }
+                (name, value) => {
+                    let rule = rule_named(name)
+                        .ok_or_else(|| format!("there is no lint rule '{}'", name))?;
+                    let severity = match &value {
+                        Value::String(s) => Severity::parse(s),
+                        _ => None,
+                    };
+                    let severity = severity.ok_or_else(|| {
+                        format!("`{}` must be \"off\", \"warning\" or \"error\"", rule.name)
+                    })?;
+                    config.severities.insert(rule.name, severity);
+                }
+            }
+        }
+        Ok(config)
+    }
+
+    /// The configuration of the project the directory is in, the default one
+    /// outside of projects
+    pub fn load(dir: &Path) -> Result<Self, DragonError> {
+        let Some(root) = packages::project(dir) else {
+            return Ok(Self::default());
+        };
+        let path = root.join(packages::MANIFEST);
+        let invalid = |e: String| {
+            let msg = format!("invalid lint configuration in '{}': {}", path.display(), e);
+            DragonError::new(ErrorCode::Lint, msg, None)
+        };
+        let text = std::fs::read_to_string(&path).map_err(|e| invalid(e.to_string()))?;
+        Self::parse(&text).map_err(invalid)
+    }
+
+    pub fn severity(&self, rule: &Rule) -> Severity {
+        self.severities
+            .get(rule.name)
+            .copied()
+            .unwrap_or(Severity::Warning)
+    }
+}
+
+fn rule_named(name: &str) -> Option<&'static Rule> {
+    RULES.iter().find(|r| r.name == name)
+}
+
+/// A change of the source fixing a lint, the chars in `range` are replaced
+/// with `text`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Fix {
+    pub range: Range<usize>,
+    pub text: String,
+}
+
+/// The lints of a program, in the order of the source, as the configuration
+/// and the directives of its comments set the rules
+pub fn lint(program: &Program, config: &Config) -> Vec<DragonError> {
+    lint_with_fixes(program, config)
+        .into_iter()
+        .map(|(d, _)| d)
+        .collect()
+}
+
+/// The lints of a program as `lint` finds them, each with its fix if it has
+/// one
+pub fn lint_with_fixes(program: &Program, config: &Config) -> Vec<(DragonError, Option<Fix>)> {
+    let mut lints = reported(program, config);
+    lints.sort_by_key(|(d, _)| d.span().map(|s| s.start()));
+    lints
+}
+
+/// The source of a program with the fixes of its lints applied, and the
+/// number of lints fixed. Nothing is fixed if the fixed source wouldn't
+/// parse.
+pub fn fix(program: &Program, config: &Config) -> (String, usize) {
+    let source = &program.source;
+    let mut fixes: Vec<Fix> = reported(program, config)
+        .into_iter()
+        .filter_map(|(_, fix)| fix)
+        .collect();
+    fixes.sort_by_key(|f| (f.range.start, f.range.end));
+    let mut fixed = String::new();
+    let mut at = 0;
+    let mut count = 0;
+    for f in fixes {
+        // of the same code as one applied already, the next run fixes it
+        if f.range.start < at {
+            continue;
+        }
+        fixed.push_str(&source.slice(at..f.range.start));
+        fixed.push_str(&f.text);
+        at = f.range.end;
+        count += 1;
+    }
+    fixed.push_str(&source.slice(at..source.len()));
+    let parsed = Source::new(source.path().map(str::to_owned), fixed.clone());
+    match parser::parse(&std::sync::Arc::new(parsed)).1.is_empty() {
+        true => (fixed, count),
+        false => (source.slice(0..source.len()), 0),
+    }
+}
+
+/// the lints of a program that are not turned off, the warnings about the
+/// directives included
+fn reported(program: &Program, config: &Config) -> Vec<rules::Lint> {
+    let (disabled, warnings) = directives(program);
+    let mut diagnostics: Vec<rules::Lint> = warnings.into_iter().map(|w| (w, None)).collect();
+    for (d, fix) in rules::check(program, config.max_lines) {
+        let rule = RULES
+            .iter()
+            .find(|r| r.code == d.code())
+            .expect("lints come from a rule");
+        let line = d.span().map_or(0, |s| s.position().line);
+        if disabled.contains(rule, line) {
+            continue;
+        }
+        match config.severity(rule) {
+            Severity::Off => {}
+            Severity::Warning => diagnostics.push((d.into_warning(), fix)),
+            Severity::Error => diagnostics.push((d, fix)),
+        }
+    }
+    diagnostics
+}
+
+/// The lines the directives of the comments turn rules off for
+#[derive(Debug, Default)]
+struct Disabled {
+    /// `None` for all the rules
+    ranges: Vec<(Option<&'static str>, RangeInclusive<usize>)>,
+}
+
+impl Disabled {
+    fn contains(&self, rule: &Rule, line: usize) -> bool {
+        self.ranges
+            .iter()
+            .any(|(r, lines)| r.is_none_or(|r| r == rule.name) && lines.contains(&line))
+    }
+}
+
+/// the lines disabled by the comments of a program, and the warnings about
+/// directives that are not understood
+fn directives(program: &Program) -> (Disabled, Vec<DragonError>) {
+    let mut disabled = Disabled::default();
+    let mut warnings = vec![];
+    // the rules disabled until enabled again, and the line they were on
+    let mut open: Vec<(Option<&'static str>, usize)> = vec![];
+    for c in program.comments.iter() {
+        let text = c.span.to_string();
+        let Some(directive) = text
+            .strip_prefix("//")
+            .and_then(|t| t.trim().strip_prefix("lint:"))
+        else {
+            continue;
+        };
+        let (command, names) = directive.split_once(' ').unwrap_or((directive, ""));
+        let mut rules = vec![];
+        for name in names.split([',', ' ']).filter(|n| !n.is_empty()) {
+            match rule_named(name) {
+                Some(rule) => rules.push(Some(rule.name)),
+                None => {
+                    let msg = format!("there is no lint rule '{}'", name);
+                    let e = DragonError::new(ErrorCode::Lint, msg, Some(c.span.clone()));
+                    warnings.push(e.into_warning());
+                }
+            }
+        }
+        if rules.is_empty() && names.trim().is_empty() {
+            rules.push(None);
+        }
+        let line = c.span.position().line;
+        match command {
+            "disable" if c.trailing => {
+                disabled
+                    .ranges
+                    .extend(rules.into_iter().map(|r| (r, line..=line)));
+            }
+            "disable" => open.extend(rules.into_iter().map(|r| (r, line))),
+            "disable-next-line" => {
+                let next = line + 1;
+                disabled
+                    .ranges
+                    .extend(rules.into_iter().map(|r| (r, next..=next)));
+            }
+            "enable" => {
+                let (closed, still): (Vec<_>, Vec<_>) = open
+                    .into_iter()
+                    .partition(|(r, _)| rules.contains(&None) || rules.contains(r));
+                open = still;
+                disabled
+                    .ranges
+                    .extend(closed.into_iter().map(|(r, from)| (r, from..=line)));
+            }
+            _ => {
+                let msg = format!("unknown directive `lint:{}`", command);
+                let hint = "use `lint:disable`, `lint:disable-next-line` or `lint:enable`";
+                let e = DragonError::new(ErrorCode::Lint, msg, Some(c.span.clone()));
+                warnings.push(e.with_hint(hint).into_warning());
+            }
+        }
+    }
+    disabled
+        .ranges
+        .extend(open.into_iter().map(|(r, from)| (r, from..=usize::MAX)));
+    (disabled, warnings)
+}
@@ -0,0 +1,433 @@
+//! The checks of the rules, each lint is an error with the code of its rule,
+//! and the fix of the source if there is a single one.
+
+use std::{
+    collections::{HashMap, HashSet},
+    ops::Range,
+};
+
+use super::{rule_named, Fix};
+use crate::{
+    checker::{self, types::Type, Analysis, Declared},
+    eh::DragonError,
+    parser::{
+        walk_catch, walk_declaration, walk_destructuring, walk_enum, walk_expression, walk_for_in,
+        walk_function, walk_interface, walk_match_arm, walk_struct, BinOperator, CatchClause,
+        Declaration, Destructuring, EnumDeclaration, Expression, ForInExpression,
+        FunctionDeclaration, Identifier, InterfaceDeclaration, Literal, MatchArm, NamedArgument,
+        Program, Statement, StructDeclaration, UnOperator, Visitor,
+    },
+    source::{Source, SourceString},
+};
+
+/// A lint and its fix
+pub type Lint = (DragonError, Option<Fix>);
+
+/// The names other languages give the absence of a value, which drgns calls
+/// `none`
+const NIL: &[&str] = &["nil", "null", "None", "NULL", "undefined"];
+
+/// The lints of all the rules, whatever their severity
+pub fn check(program: &Program, max_lines: usize) -> Vec<Lint> {
+    let analysis = checker::analyze(program);
+    let mut lints = vec![];
+    unused(program, &analysis, &mut lints);
+    shadowing(&analysis, &mut lints);
+    let mut rules = Rules {
+        analysis: &analysis,
+        references: analysis
+            .references
+            .iter()
+            .map(|(s, d)| (s.start(), *d))
+            .collect(),
+        max_lines,
+        source: &program.source,
+        comments: program.comments.iter().map(|c| c.span.range()).collect(),
+        lints,
+    };
+    rules.visit_program(program);
+    rules.lints
+}
+
+/// a lint of the rule, which its message names
+fn lint(rule: &str, msg: String, span: &SourceString) -> DragonError {
+    let rule = rule_named(rule).expect("the rule exists");
+    let msg = format!("{} [{}]", msg, rule.name);
+    DragonError::new(rule.code, msg, Some(span.clone()))
+}
+
+/// names starting with `_` are unused or shadow others on purpose
+fn is_private(name: &Identifier) -> bool {
+    name.name.starts_with('_') || name.name == "self"
+}
+
+/// the declarations no reference refers to, but those of the top level,
+/// which other modules may import, imports excepted
+fn unused(program: &Program, analysis: &Analysis, lints: &mut Vec<Lint>) {
+    let used: HashSet<usize> = analysis.references.iter().filter_map(|(_, d)| *d).collect();
+    let imports: HashSet<usize> = program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Import(i) => Some(i.name().span.start()),
+            _ => None,
+        })
+        .collect();
+    let top = 0..program.source.len() + 1;
+    for (i, d) in analysis.declarations.iter().enumerate() {
+        if used.contains(&i) || is_private(&d.name) {
+            continue;
+        }
+        if imports.contains(&d.name.span.start()) {
+            let msg = format!("the module '{}' is imported but never used", d.name.name);
+            let fix = Fix {
+                range: lines_of(&program.source, &d.span),
+                text: String::new(),
+            };
+            let lint = lint("unused-variable", msg, &d.span).with_hint("remove the import");
+            lints.push((lint, Some(fix)));
+        } else if d.scope != top {
+            let msg = format!("'{}' is never used", d.name.name);
+            let hint = "remove it, or start its name with `_` if it is unused on purpose";
+            lints.push((
+                lint("unused-variable", msg, &d.name.span).with_hint(hint),
+                None,
+            ));
+        }
+    }
+}
+
+/// the declarations of names visible from an enclosing scope
+fn shadowing(analysis: &Analysis, lints: &mut Vec<Lint>) {
+    let mut by_name: HashMap<&str, Vec<&Declared>> = HashMap::new();
+    for d in &analysis.declarations {
+        by_name.entry(&d.name.name).or_default().push(d);
+    }
+    for d in &analysis.declarations {
+        if is_private(&d.name) {
+            continue;
+        }
+        let shadowed = by_name[d.name.name.as_str()]
+            .iter()
+            .filter(|e| {
+                e.scope != d.scope
+                    && e.scope.start <= d.scope.start
+                    && d.scope.end <= e.scope.end
+                    && (e.function || e.name.span.end() <= d.name.span.start())
+            })
+            // the innermost one
+            .max_by_key(|e| e.scope.start);
+        if let Some(e) = shadowed {
+            let msg = format!(
+                "'{}' shadows the one declared at {}",
+                d.name.name,
+                e.name.span.position()
+            );
+            let hint = "rename one of them, so that each name stands for one thing";
+            lints.push((lint("shadowing", msg, &d.name.span).with_hint(hint), None));
+        }
+    }
+}
+
+/// the rules that look at the nodes of the program
+struct Rules<'a> {
+    analysis: &'a Analysis,
+
+    /// the declaration each use of a name refers to, by its offset
+    references: HashMap<usize, Option<usize>>,
+    max_lines: usize,
+    source: &'a Source,
+
+    /// the ranges of the comments, where commas don't count
+    comments: Vec<Range<usize>>,
+    lints: Vec<Lint>,
+}
+
+impl Rules<'_> {
+    /// whether the expression is known to be a float
+    fn is_float(&self, e: &Expression) -> bool {
+        match e {
+            Expression::Literal(l) => matches!(l.value, Literal::Float(_)),
+            Expression::Group(g) => self.is_float(&g.inner),
+            Expression::Unary(u) => u.op == UnOperator::Neg && self.is_float(&u.rhs),
+            Expression::Binary(b) => {
+                use BinOperator::*;
+                matches!(b.op, Add | Sub | Mul | Div | Mod | Pow)
+                    && (self.is_float(&b.lhs) || self.is_float(&b.rhs))
+            }
+            Expression::Variable(i) => {
+                let declaration = self.references.get(&i.span.start()).copied().flatten();
+                declaration.is_some_and(|d| self.analysis.declarations[d].t == Some(Type::Float))
+            }
+            _ => false,
+        }
+    }
+
+    /// a lint unless the name is in snake_case, or in SCREAMING_SNAKE_CASE
+    /// if `constant`
+    fn snake_case(&mut self, what: &str, name: &Identifier, constant: bool) {
+        let n = name.name.trim_start_matches('_');
+        let snake = n
+            .chars()
+            .all(|c| c.is_lowercase() || c.is_numeric() || c == '_');
+        let screaming = n
+            .chars()
+            .all(|c| c.is_uppercase() || c.is_numeric() || c == '_');
+        if snake || constant && screaming {
+            return;
+        }
+        let msg = format!("the {} '{}' is not named in snake_case", what, name.name);
+        let hint = format!("rename it `{}`", to_snake_case(&name.name));
+        self.lints
+            .push((lint("naming", msg, &name.span).with_hint(hint), None));
+    }
+
+    /// a lint unless the name is in PascalCase
+    fn pascal_case(&mut self, what: &str, name: &Identifier) {
+        let n = name.name.trim_start_matches('_');
+        if n.starts_with(char::is_uppercase) && !n.contains('_') {
+            return;
+        }
+        let msg = format!("the {} '{}' is not named in PascalCase", what, name.name);
+        let hint = format!("rename it `{}`", to_pascal_case(&name.name));
+        self.lints
+            .push((lint("naming", msg, &name.span).with_hint(hint), None));
+    }
+
+    /// a lint unless the items are on one line, or the last is followed by
+    /// a comma, as `drgns fmt` prints items one per line when the first is
+    /// on a line after `open`
+    fn trailing_comma(&mut self, open: usize, items: &[SourceString], close: usize) {
+        let (Some(first), Some(last)) = (items.first(), items.last()) else {
+            return;
+        };
+        let line = |i: usize| self.source.position(i).line;
+        if line(first.start()) <= line(open) {
+            return;
+        }
+        let comma = (last.end()..close)
+            .filter(|i| !self.comments.iter().any(|c| c.contains(i)))
+            .any(|i| self.source.get(i) == Some(','));
+        if comma {
+            return;
+        }
+        let msg = "the last item isn't followed by a comma, as the others are".to_owned();
+        let fix = Fix {
+            range: last.end()..last.end(),
+            text: ",".to_owned(),
+        };
+        let lint = lint("trailing-comma", msg, last).with_hint("add a comma after it");
+        self.lints.push((lint, Some(fix)));
+    }
+
+    /// a lint if the expression compares with a name for `none` from other
+    /// languages, which is undefined
+    fn nil_comparison(&mut self, e: &Expression) {
+        let Expression::Variable(name) = e else {
+            return;
+        };
+        let undefined = !self.references.contains_key(&name.span.start());
+        if !undefined || !NIL.contains(&name.name.as_str()) {
+            return;
+        }
+        let msg = format!(
+            "'{}' is not defined, the absence of a value is `none`",
+            name.name
+        );
+        let fix = Fix {
+            range: name.span.range(),
+            text: "none".to_owned(),
+        };
+        let lint = lint("nil-comparison", msg, &name.span).with_hint("compare with `none`");
+        self.lints.push((lint, Some(fix)));
+    }
+}
+
+impl Visitor for Rules<'_> {
+    fn visit_expression(&mut self, e: &Expression) {
+        if let Expression::Binary(b) = e {
+            let equality = matches!(b.op, BinOperator::Eq | BinOperator::Ne);
+            if equality && (self.is_float(&b.lhs) || self.is_float(&b.rhs)) {
+                let msg = format!(
+                    "floats compared with `{}`, rounding makes values that should be equal differ",
+                    b.op
+                );
+                let hint = "compare their difference with a tolerance, such as \
+                            `math::abs(a - b) < 1e-9`";
+                self.lints
+                    .push((lint("float-equality", msg, &b.span).with_hint(hint), None));
+            }
+            if equality {
+                self.nil_comparison(&b.lhs);
+                self.nil_comparison(&b.rhs);
+            }
+        }
+        let spans = |items: &[Expression]| items.iter().map(Expression::span).collect::<Vec<_>>();
+        let arguments = |items: &[Expression], named: &[NamedArgument]| {
+            let named = named.iter().map(|n| n.span.clone());
+            items
+                .iter()
+                .map(Expression::span)
+                .chain(named)
+                .collect::<Vec<_>>()
+        };
+        match e {
+            Expression::List(l) => {
+                self.trailing_comma(l.span.start(), &spans(&l.items), l.span.end())
+            }
+            Expression::Map(m) => {
+                let entries: Vec<SourceString> = m
+                    .entries
+                    .iter()
+                    .map(|(k, v)| k.span().to(&v.span()))
+                    .collect();
+                self.trailing_comma(m.span.start(), &entries, m.span.end());
+            }
+            Expression::Call(c) => {
+                let open = c.callee.span().end();
+                self.trailing_comma(open, &arguments(&c.arguments, &c.named), c.span.end());
+            }
+            Expression::Method(m) => {
+                let open = m.name.span.end();
+                self.trailing_comma(open, &arguments(&m.arguments, &m.named), m.span.end());
+            }
+            _ => {}
+        }
+        walk_expression(self, e);
+    }
+
+    fn visit_function(&mut self, f: &FunctionDeclaration) {
+        let lambda = f.name.name == "<lambda>";
+        let lines = f.span.end_position().line - f.span.position().line + 1;
+        if lines > self.max_lines {
+            let name = match lambda {
+                true => "the anonymous function".to_owned(),
+                false => format!("the function '{}'", f.name.name),
+            };
+            let msg = format!(
+                "{} is {} lines long, more than {}",
+                name, lines, self.max_lines
+            );
+            let hint = "move parts of it to functions of their own";
+            let span = match lambda {
+                true => &f.span,
+                false => &f.name.span,
+            };
+            self.lints
+                .push((lint("long-function", msg, span).with_hint(hint), None));
+        }
+        if !lambda {
+            self.snake_case("function", &f.name, false);
+        }
+        for b in f.parameters.iter().flat_map(|p| p.pattern.bindings()) {
+            self.snake_case("parameter", b, false);
+        }
+        walk_function(self, f);
+    }
+
+    fn visit_struct(&mut self, s: &StructDeclaration) {
+        self.pascal_case("struct", &s.name);
+        for field in &s.fields {
+            self.snake_case("field", &field.name, false);
+        }
+        walk_struct(self, s);
+    }
+
+    fn visit_enum(&mut self, e: &EnumDeclaration) {
+        self.pascal_case("enum", &e.name);
+        for variant in &e.variants {
+            self.pascal_case("variant", &variant.name);
+            for field in variant.fields.iter().flatten() {
+                self.snake_case("field", &field.name, false);
+            }
+        }
+        walk_enum(self, e);
+    }
+
+    fn visit_interface(&mut self, i: &InterfaceDeclaration) {
+        self.pascal_case("interface", &i.name);
+        for m in &i.methods {
+            self.snake_case("method", &m.name, false);
+        }
+        walk_interface(self, i);
+    }
+
+    fn visit_declaration(&mut self, d: &Declaration) {
+        self.snake_case("variable", &d.name, !d.mutable);
+        walk_declaration(self, d);
+    }
+
+    fn visit_destructuring(&mut self, d: &Destructuring) {
+        for b in d.pattern.bindings() {
+            self.snake_case("variable", b, !d.mutable);
+        }
+        walk_destructuring(self, d);
+    }
+
+    fn visit_for_in(&mut self, f: &ForInExpression) {
+        for b in f.binding.bindings() {
+            self.snake_case("variable", b, false);
+        }
+        walk_for_in(self, f);
+    }
+
+    fn visit_catch(&mut self, c: &CatchClause) {
+        if let Some(name) = &c.name {
+            self.snake_case("variable", name, false);
+        }
+        walk_catch(self, c);
+    }
+
+    fn visit_match_arm(&mut self, a: &MatchArm) {
+        for b in a.pattern.bindings() {
+            self.snake_case("variable", b, false);
+        }
+        walk_match_arm(self, a);
+    }
+}
+
+/// the range of the lines of the span if nothing else is on them, with the
+/// line break ending them, else the range of the span and the spaces after
+/// it, so that a comment after it takes its place without spaces before it
+fn lines_of(source: &Source, span: &SourceString) -> Range<usize> {
+    let (first, last) = (span.position().line, span.end_position().line);
+    let start = source.line_start(first).unwrap_or(span.start());
+    let end = source.line_start(last + 1).unwrap_or(source.len());
+    let alone = |range: Range<usize>| range.filter_map(|i| source.get(i)).all(char::is_whitespace);
+    if alone(start..span.start()) && alone(span.end()..end) {
+        return start..end;
+    }
+    let spaces = (span.end()..end)
+        .take_while(|&i| source.get(i).is_some_and(|c| c == ' ' || c == '\t'))
+        .count();
+    span.start()..span.end() + spaces
+}
+
+/// `do_it` for `doIt` or `DoIt`
+fn to_snake_case(name: &str) -> String {
+    let mut snake = String::new();
+    let mut previous: Option<char> = None;
+    for c in name.chars() {
+        if c.is_uppercase() && previous.is_some_and(|p| p.is_lowercase() || p.is_numeric()) {
+            snake.push('_');
+        }
+        snake.extend(c.to_lowercase());
+        previous = Some(c);
+    }
+    snake
+}
+
+/// `DoIt` for `do_it` or `doIt`
+fn to_pascal_case(name: &str) -> String {
+    let leading = name.len() - name.trim_start_matches('_').len();
+    let words = name[leading..].split('_').filter(|w| !w.is_empty());
+    let mut pascal = name[..leading].to_owned();
+    for word in words {
+        let mut chars = word.chars();
+        if let Some(first) = chars.next() {
+            pascal.extend(first.to_uppercase());
+            pascal.push_str(chars.as_str());
+        }
+    }
+    pascal
+}
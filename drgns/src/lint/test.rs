@@ -0,0 +1,220 @@
+use std::sync::Arc;
+
+use crate::{parser::parse, source::Source};
+
+use super::*;
+
+/// the lints of a program with the line they are on, errors are prefixed
+/// with "error: "
+fn lints_with(s: &str, config: &Config) -> Vec<String> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    lint(&program, config)
+        .iter()
+        .map(|d| {
+            let line = d.span().map_or(0, |s| s.position().line);
+            match d.is_warning() {
+                true => format!("{}: {}", line, d.message()),
+                false => format!("{}: error: {}", line, d.message()),
+            }
+        })
+        .collect()
+}
+
+fn lints(s: &str) -> Vec<String> {
+    lints_with(s, &Config::default())
+}
+
+#[test]
+fn unused_variables() {
+    assert_eq!(
+        lints("function f(x, _y) -> {\n  z := 1\n  1\n}"),
+        [
+            "1: 'x' is never used [unused-variable]",
+            "2: 'z' is never used [unused-variable]",
+        ]
+    );
+    assert_eq!(
+        lints("import std::math\nimport std::json\nx := 1\nprint(math::pi)"),
+        ["2: the module 'json' is imported but never used [unused-variable]"]
+    );
+    let none: Vec<String> = vec![];
+    assert_eq!(
+        lints("function f(xs) -> { for x in xs { print(x) } }"),
+        none
+    );
+}
+
+#[test]
+fn shadowing() {
+    assert_eq!(
+        lints("x := 1\nfunction f() -> {\n  x := 2\n  x\n}"),
+        ["3: 'x' shadows the one declared at 1:1 [shadowing]"]
+    );
+    assert_eq!(
+        lints("function f(n) -> {\n  print(n)\n  (n) -> n\n}"),
+        ["3: 'n' shadows the one declared at 1:12 [shadowing]"]
+    );
+    // declared after, so not visible
+    let none: Vec<String> = vec![];
+    assert_eq!(lints("function f() -> { y := 1\ny }\ny := 2"), none);
+}
+
+#[test]
+fn float_equality() {
+    assert_eq!(
+        lints("x := 0.1 + 0.2\nprint(x == 0.3)\nprint(1 == 1)\nprint(-x != 2 * x)"),
+        [
+            "2: floats compared with `==`, rounding makes values that should be equal differ \
+             [float-equality]",
+            "4: floats compared with `!=`, rounding makes values that should be equal differ \
+             [float-equality]",
+        ]
+    );
+}
+
+#[test]
+fn long_functions() {
+    let body = "  print(1)\n".repeat(DEFAULT_MAX_LINES - 2);
+    let program = format!(
+        "function ok() -> {{\n{}}}\nfunction long() -> {{\n{}\n}}",
+        body, body
+    );
+    assert_eq!(
+        lints(&program),
+        ["51: the function 'long' is 51 lines long, more than 50 [long-function]"]
+    );
+    let config = Config::parse("[lint]\nlong-function.max-lines = 60").expect("valid");
+    assert_eq!(lints_with(&program, &config), Vec::<String>::new());
+}
+
+#[test]
+fn naming() {
+    assert_eq!(
+        lints("struct my_point { X }\nfunction doIt(Arg) -> { Arg }\nmut Total := 1\nLIMIT := 2"),
+        [
+            "1: the struct 'my_point' is not named in PascalCase [naming]",
+            "1: the field 'X' is not named in snake_case [naming]",
+            "2: the function 'doIt' is not named in snake_case [naming]",
+            "2: the parameter 'Arg' is not named in snake_case [naming]",
+            "3: the variable 'Total' is not named in snake_case [naming]",
+        ]
+    );
+    let src = Arc::new(Source::from_string("function doIt() -> {}".to_string()));
+    let (program, _) = parse(&src);
+    let hints: Vec<_> = super::lint(&program, &Config::default())
+        .iter()
+        .map(|d| d.hint().map(str::to_owned))
+        .collect();
+    assert_eq!(hints, [Some("rename it `do_it`".to_owned())]);
+}
+
+#[test]
+fn configuration() {
+    let config = Config::parse(
+        "[package]\nname = \"app\"\n\n[lint]\nnaming = \"error\"\nshadowing = \"off\"\n",
+    )
+    .expect("the configuration is valid");
+    assert_eq!(
+        lints_with(
+            "function f(n) -> { print(n)\n(n) -> n }\nfunction doIt() -> {}",
+            &config
+        ),
+        ["3: error: the function 'doIt' is not named in snake_case [naming]"]
+    );
+    let fails = |text: &str| Config::parse(text).expect_err(text);
+    assert_eq!(
+        fails("[lint]\nunused = \"off\""),
+        "there is no lint rule 'unused'"
+    );
+    assert_eq!(
+        fails("[lint]\nnaming = \"deny\""),
+        "`naming` must be \"off\", \"warning\" or \"error\""
+    );
+    assert_eq!(
+        fails("[lint]\nlong-function.max-lines = 0"),
+        "`long-function.max-lines` must be a positive integer"
+    );
+}
+
+#[test]
+fn directives() {
+    let program = "\
+function doIt() -> {} // lint:disable naming
+// lint:disable-next-line
+function doThat(X) -> {}
+// lint:disable naming
+function a_B() -> {}
+function b_C() -> {}
+// lint:enable naming
+function c_D() -> {}
+// lint:disable nonsense
+// lint:silence
+";
+    assert_eq!(
+        lints(program),
+        [
+            "8: the function 'c_D' is not named in snake_case [naming]",
+            "9: there is no lint rule 'nonsense'",
+            "10: unknown directive `lint:silence`",
+        ]
+    );
+}
+
+/// the source fixed, and the number of lints fixed
+fn fixed(s: &str) -> (String, usize) {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    fix(&program, &Config::default())
+}
+
+#[test]
+fn fixes_keep_comments_and_layout() {
+    let program = "\
+import std::json // parsing
+import std::math
+// the sum
+x := [
+    1,  // one
+    math::pi // pi
+]
+if   x[0] == nil { print(x,
+    null != x) }
+";
+    assert_eq!(
+        lints(program),
+        [
+            "1: the module 'json' is imported but never used [unused-variable]",
+            "6: the last item isn't followed by a comma, as the others are [trailing-comma]",
+            "8: 'nil' is not defined, the absence of a value is `none` [nil-comparison]",
+            "9: 'null' is not defined, the absence of a value is `none` [nil-comparison]",
+        ]
+    );
+    // the comment trailing the import keeps its line, where the import was
+    let expected = "\
+// parsing
+import std::math
+// the sum
+x := [
+    1,  // one
+    math::pi, // pi
+]
+if   x[0] == none { print(x,
+    none != x) }
+";
+    assert_eq!(fixed(program), (expected.to_owned(), 4));
+    assert_eq!(fixed(expected), (expected.to_owned(), 0));
+    assert_eq!(
+        fixed("import std::json\nprint(1)\n"),
+        ("print(1)\n".to_owned(), 1)
+    );
+    assert_eq!(
+        fixed("import std::json \t  /* parsing */\nprint(1)\n"),
+        ("/* parsing */\nprint(1)\n".to_owned(), 1)
+    );
+    // items on one line need no comma, nor does a declared `nil`
+    let program = "nil := 1\nprint(f(1, 2) == nil, [\n  1,\n])\nfunction f(a, b) -> { a }";
+    assert_eq!(fixed(program), (program.to_owned(), 0));
+}
@@ -0,0 +1,854 @@
+//! The language server, `drgns lsp`, speaks the Language Server Protocol over
+//! the standard input and output.
+//!
+//! Documents are synchronized by the edits made to them, and parsed again on
+//! every change, reusing the statements an edit left alone, then checked
+//! again. The client is sent the diagnostics of `drgns check`, and can ask
+//! where a name is declared, for its type and documentation, and for the
+//! names visible at a position. The documentation of a name is made of the
+//! comments on the lines above its declaration.
+//!
+//! The uses of a name declared at the top level of a script are looked for in
+//! the whole workspace, with the index of `drgns refs`, built once the client
+//! first asks for them or for the symbols of the workspace. The open
+//! documents are indexed as they change, the others as they were when it was
+//! built.
+
+use std::{
+    collections::HashMap,
+    io::{self, BufRead, Write},
+    ops::{ControlFlow, Range},
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use drgns::{
+    checker::{self, types::Type, Analysis, Declared},
+    index::{self, Index, Kind},
+    interpreter::{builtins::VARIABLES, BUILTINS, MODULES},
+    modules::cache,
+    parser::{self, Edit, Tree},
+    rename,
+    source::{self, Source, SourceString},
+    DragonError,
+};
+use serde_json::{json, Value};
+
+/// error codes of JSON-RPC
+const METHOD_NOT_FOUND: i64 = -32601;
+const INVALID_PARAMS: i64 = -32602;
+const REQUEST_FAILED: i64 = -32803;
+
+/// kinds of completion items
+const FUNCTION: u32 = 3;
+const VARIABLE: u32 = 6;
+const MODULE: u32 = 9;
+
+/// kinds of symbols
+const SYMBOL_ENUM: u32 = 10;
+const SYMBOL_FUNCTION: u32 = 12;
+const SYMBOL_VARIABLE: u32 = 13;
+const SYMBOL_STRUCT: u32 = 23;
+
+/// Serve a client until it asks to exit, returns the exit status of the
+/// process, which is only a success if the client shut the server down first
+pub fn run() -> i32 {
+    let mut input = io::stdin().lock();
+    let mut output = io::stdout().lock();
+    let mut server = Server::default();
+    loop {
+        let message = match read_message(&mut input) {
+            Ok(Some(message)) => message,
+            Ok(None) => return 1,
+            Err(e) => {
+                log::error!("invalid message: {}", e);
+                continue;
+            }
+        };
+        match server.handle(&message) {
+            ControlFlow::Continue(replies) => {
+                for r in replies {
+                    if write_message(&mut output, &r).is_err() {
+                        return 1;
+                    }
+                }
+            }
+            ControlFlow::Break(status) => return status,
+        }
+    }
+}
+
+/// Read a message with its header, `None` at the end of the input
+pub fn read_message(input: &mut impl BufRead) -> io::Result<Option<Value>> {
+    let mut length = None;
+    loop {
+        let mut line = String::new();
+        if input.read_line(&mut line)? == 0 {
+            return Ok(None);
+        }
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        if let Some((name, value)) = line.split_once(':') {
+            if name.eq_ignore_ascii_case("Content-Length") {
+                length = value.trim().parse::<usize>().ok();
+            }
+        }
+    }
+    let Some(length) = length else {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            "missing Content-Length",
+        ));
+    };
+    let mut body = vec![0; length];
+    input.read_exact(&mut body)?;
+    Ok(Some(serde_json::from_slice(&body)?))
+}
+
+pub fn write_message(output: &mut impl Write, message: &Value) -> io::Result<()> {
+    let body = message.to_string();
+    write!(output, "Content-Length: {}\r\n\r\n{}", body.len(), body)?;
+    output.flush()
+}
+
+/// An open document, as of its last change
+struct Document {
+    tree: Tree,
+
+    /// only the syntax errors if there are some, since checking an
+    /// incomplete program reports mistakes that aren't there
+    diagnostics: Vec<DragonError>,
+    analysis: Analysis,
+}
+
+impl Document {
+    fn new(uri: &str, text: String) -> Self {
+        let source = Arc::new(Source::new(Some(path(uri).to_owned()), text));
+        Self::checked(Tree::new(&source))
+    }
+
+    fn checked(tree: Tree) -> Self {
+        let analysis = checker::analyze(&tree.program);
+        let diagnostics = match tree.errors.is_empty() {
+            true => analysis.diagnostics.clone(),
+            false => tree.errors.clone(),
+        };
+        Self {
+            tree,
+            diagnostics,
+            analysis,
+        }
+    }
+
+    /// The document after the changes of a `didChange`, in order, each
+    /// either replacing a range or the whole text
+    fn changed(self, changes: &[Value]) -> Self {
+        let mut tree = self.tree;
+        for change in changes {
+            let text = change["text"].as_str().unwrap_or_default().to_owned();
+            tree = match change.get("range") {
+                Some(range) => {
+                    let source = &tree.program.source;
+                    let range = offset(source, &range["start"])..offset(source, &range["end"]);
+                    tree.edit(&Edit { range, text })
+                }
+                None => {
+                    let path = tree.program.source.path().map(str::to_owned);
+                    Tree::new(&Arc::new(Source::new(path, text)))
+                }
+            };
+        }
+        log::debug!(
+            "{} of {} statements reused",
+            tree.reused(),
+            tree.program.statements.len()
+        );
+        Self::checked(tree)
+    }
+
+    fn source(&self) -> &Source {
+        &self.tree.program.source
+    }
+
+    fn offset(&self, position: &Value) -> usize {
+        offset(self.source(), position)
+    }
+
+    fn position(&self, i: usize) -> Value {
+        position(self.source(), i)
+    }
+
+    fn range(&self, span: &SourceString) -> Value {
+        range(self.source(), span.start()..span.end())
+    }
+
+    fn diagnostic(&self, e: &DragonError) -> Value {
+        let range = match e.span() {
+            Some(span) => self.range(span),
+            None => json!({ "start": self.position(0), "end": self.position(0) }),
+        };
+        let message = match e.hint() {
+            Some(hint) => format!("{}\nhint: {}", e.message(), hint),
+            None => e.message().to_string(),
+        };
+        json!({
+            "range": range,
+            "severity": if e.is_warning() { 2 } else { 1 },
+            "code": e.code().to_string(),
+            "source": "drgns",
+            "message": message,
+        })
+    }
+
+    /// the comments above the declaration, without their delimiters
+    fn documentation(&self, d: &Declared) -> String {
+        let lines: Vec<String> = self
+            .tree
+            .program
+            .comments
+            .leading(&d.span)
+            .iter()
+            .flat_map(|c| {
+                let text = c.span.to_string();
+                let text = match text.strip_prefix("/*") {
+                    Some(block) => block.strip_suffix("*/").unwrap_or(block).to_string(),
+                    None => text.trim_start_matches('/').to_string(),
+                };
+                text.lines()
+                    .map(|l| l.trim().to_string())
+                    .collect::<Vec<_>>()
+            })
+            .collect();
+        lines.join("\n").trim().to_string()
+    }
+}
+
+/// the char index of a position of the protocol, whose characters are UTF-16
+/// code units
+fn offset(source: &Source, position: &Value) -> usize {
+    let line = position["line"].as_u64().unwrap_or(0) as usize;
+    let character = position["character"].as_u64().unwrap_or(0) as usize;
+    let (Some(start), Some(text)) = (source.line_start(line + 1), source.line(line + 1)) else {
+        return source.len();
+    };
+    let mut column = 0;
+    let mut units = 0;
+    for c in text.chars() {
+        if units >= character {
+            break;
+        }
+        units += c.len_utf16();
+        column += 1;
+    }
+    start + column
+}
+
+/// the position of the protocol of a char index
+fn position(source: &Source, i: usize) -> Value {
+    let p = source.position(i);
+    let text = source.line(p.line).unwrap_or_default();
+    let character: usize = text.chars().take(p.column - 1).map(char::len_utf16).sum();
+    json!({ "line": p.line - 1, "character": character })
+}
+
+fn range(source: &Source, chars: Range<usize>) -> Value {
+    json!({ "start": position(source, chars.start), "end": position(source, chars.end) })
+}
+
+/// the path of a `file://` URI
+fn path(uri: &str) -> &str {
+    uri.strip_prefix("file://").unwrap_or(uri)
+}
+
+/// `mut name: type`, as it would be annotated
+fn signature(d: &Declared) -> String {
+    let mutable = if d.mutable { "mut " } else { "" };
+    match &d.t {
+        Some(t) => format!("{}{}: {}", mutable, d.name.name, t),
+        None => format!("{}{}", mutable, d.name.name),
+    }
+}
+
+#[derive(Default)]
+pub struct Server {
+    documents: HashMap<String, Document>,
+    shut_down: bool,
+
+    /// of the workspace, the working directory unless the client gives one
+    root: Option<PathBuf>,
+
+    /// `None` until the client asks for what it knows
+    index: Option<Index>,
+}
+
+impl Server {
+    /// Handle a message from the client, returns the messages to send back,
+    /// breaks with the exit status when the client asks to exit
+    pub fn handle(&mut self, message: &Value) -> ControlFlow<i32, Vec<Value>> {
+        let method = message["method"].as_str().unwrap_or_default();
+        let params = &message["params"];
+        let uri = params["textDocument"]["uri"].as_str().unwrap_or_default();
+        let Some(id) = message.get("id") else {
+            // a notification, there is no reply
+            return ControlFlow::Continue(match method {
+                "exit" => return ControlFlow::Break(if self.shut_down { 0 } else { 1 }),
+                "textDocument/didOpen" => {
+                    let text = params["textDocument"]["text"].as_str().unwrap_or_default();
+                    self.open(uri, text.to_owned())
+                }
+                "textDocument/didChange" => {
+                    let changes = params["contentChanges"].as_array();
+                    let changes = changes.map_or(&[][..], Vec::as_slice);
+                    match self.documents.remove(uri) {
+                        Some(doc) => self.update(uri, doc.changed(changes)),
+                        None => vec![],
+                    }
+                }
+                "textDocument/didClose" => {
+                    self.documents.remove(uri);
+                    // the script is what its file holds again
+                    if let Some(index) = &mut self.index {
+                        index.update_script(Path::new(path(uri)));
+                    }
+                    vec![publish(uri, vec![])]
+                }
+                _ => vec![],
+            });
+        };
+        let result = match method {
+            "initialize" => {
+                let root = params["rootUri"].as_str().map(path);
+                let root = root.or(params["rootPath"].as_str());
+                self.root = root.map(PathBuf::from);
+                Ok(json!({
+                    "capabilities": {
+                        "textDocumentSync": 2,
+                        "definitionProvider": true,
+                        "hoverProvider": true,
+                        "completionProvider": {},
+                        "referencesProvider": true,
+                        "renameProvider": true,
+                        "workspaceSymbolProvider": true,
+                    },
+                    "serverInfo": { "name": "drgns", "version": env!("CARGO_PKG_VERSION") },
+                }))
+            }
+            "shutdown" => {
+                self.shut_down = true;
+                Ok(Value::Null)
+            }
+            "textDocument/definition" | "textDocument/hover" | "textDocument/completion" => {
+                match self.documents.get(uri) {
+                    Some(doc) => {
+                        let i = doc.offset(&params["position"]);
+                        Ok(match method {
+                            "textDocument/definition" => definition(doc, uri, i),
+                            "textDocument/hover" => hover(doc, i),
+                            _ => completion(doc, i),
+                        })
+                    }
+                    None => Err((INVALID_PARAMS, format!("unknown document '{}'", uri))),
+                }
+            }
+            "textDocument/references" => match self.documents.get(uri) {
+                Some(doc) => {
+                    let i = doc.offset(&params["position"]);
+                    let declaration = params["context"]["includeDeclaration"].as_bool();
+                    Ok(self.references(uri, i, declaration.unwrap_or(false)))
+                }
+                None => Err((INVALID_PARAMS, format!("unknown document '{}'", uri))),
+            },
+            "textDocument/rename" => match self.documents.get(uri) {
+                Some(doc) => {
+                    let i = doc.offset(&params["position"]);
+                    let name = params["newName"].as_str().unwrap_or_default();
+                    self.rename(uri, i, name)
+                }
+                None => Err((INVALID_PARAMS, format!("unknown document '{}'", uri))),
+            },
+            "workspace/symbol" => {
+                let query = params["query"].as_str().unwrap_or_default();
+                let (index, documents) = self.index();
+                let symbols = index.search(query);
+                let locations = locations(documents, symbols.iter().map(|s| &s.location));
+                let symbols = symbols.iter().zip(locations).map(|(s, location)| {
+                    let kind = match s.kind {
+                        Kind::Function => SYMBOL_FUNCTION,
+                        Kind::Struct => SYMBOL_STRUCT,
+                        Kind::Enum => SYMBOL_ENUM,
+                        Kind::Variable => SYMBOL_VARIABLE,
+                    };
+                    json!({
+                        "name": s.name,
+                        "kind": kind,
+                        "location": location,
+                        "containerName": s.module,
+                    })
+                });
+                Ok(Value::Array(symbols.collect()))
+            }
+            _ => Err((METHOD_NOT_FOUND, format!("unknown method '{}'", method))),
+        };
+        let reply = match result {
+            Ok(result) => json!({ "jsonrpc": "2.0", "id": id, "result": result }),
+            Err((code, message)) => json!({
+                "jsonrpc": "2.0",
+                "id": id,
+                "error": { "code": code, "message": message },
+            }),
+        };
+        ControlFlow::Continue(vec![reply])
+    }
+
+    fn open(&mut self, uri: &str, text: String) -> Vec<Value> {
+        self.update(uri, Document::new(uri, text))
+    }
+
+    fn update(&mut self, uri: &str, doc: Document) -> Vec<Value> {
+        if let Some(index) = &mut self.index {
+            index.add(&doc.tree.program, &doc.analysis);
+        }
+        let diagnostics = doc.diagnostics.iter().map(|e| doc.diagnostic(e)).collect();
+        self.documents.insert(uri.to_owned(), doc);
+        vec![publish(uri, diagnostics)]
+    }
+
+    /// the index of the workspace, built the first time with the open
+    /// documents as they are, and the documents
+    fn index(&mut self) -> (&Index, &HashMap<String, Document>) {
+        let index = self.index.get_or_insert_with(|| {
+            let root = match &self.root {
+                Some(root) => root.clone(),
+                None => std::env::current_dir().unwrap_or_default(),
+            };
+            let mut index = Index::open(&root, cache::directory().as_deref());
+            for doc in self.documents.values() {
+                index.add(&doc.tree.program, &doc.analysis);
+            }
+            index
+        });
+        (index, &self.documents)
+    }
+
+    /// the edits of the protocol renaming the name at the char index of the
+    /// document, and its uses
+    fn rename(&mut self, uri: &str, i: usize, name: &str) -> Result<Value, (i64, String)> {
+        let (index, documents) = self.index();
+        let Some(doc) = documents.get(uri) else {
+            return Err((INVALID_PARAMS, format!("unknown document '{}'", uri)));
+        };
+        let load = |p: &Path| {
+            let source = source(documents, p);
+            Some(parser::parse(&source).0)
+        };
+        let path = Path::new(path(uri));
+        let edits = rename::rename(path, &doc.tree.program, i, name, index, load)
+            .map_err(|e| (REQUEST_FAILED, e.message().to_string()))?;
+        let changes: serde_json::Map<String, Value> = edits
+            .iter()
+            .map(|(path, ranges)| {
+                let source = source(documents, path);
+                let edits = ranges
+                    .iter()
+                    .map(|r| json!({ "range": range(&source, r.clone()), "newText": name }))
+                    .collect();
+                (self::uri(path), Value::Array(edits))
+            })
+            .collect();
+        Ok(json!({ "changes": changes }))
+    }
+
+    /// the uses of the name at the char index of the document, in the whole
+    /// workspace if it is declared at the top level of a script
+    fn references(&mut self, uri: &str, i: usize, declaration: bool) -> Value {
+        let (index, documents) = self.index();
+        if let Some(symbol) = index.at(Path::new(path(uri)), i) {
+            let uses = index.references(symbol).into_iter();
+            let locations = match declaration {
+                true => locations(documents, std::iter::once(&symbol.location).chain(uses)),
+                false => locations(documents, uses),
+            };
+            return Value::Array(locations);
+        }
+        let Some(doc) = documents.get(uri) else {
+            return Value::Null;
+        };
+        let Some(d) = doc.analysis.definition(i) else {
+            return Value::Null;
+        };
+        let declared = doc
+            .analysis
+            .declarations
+            .iter()
+            .position(|x| std::ptr::eq(x, d));
+        let uses = doc
+            .analysis
+            .references
+            .iter()
+            .filter(|(_, r)| *r == declared)
+            .map(|(span, _)| span);
+        let spans: Vec<&SourceString> = match declaration {
+            true => std::iter::once(&d.name.span).chain(uses).collect(),
+            false => uses.collect(),
+        };
+        let locations = spans
+            .iter()
+            .map(|span| json!({ "uri": uri, "range": doc.range(span) }))
+            .collect();
+        Value::Array(locations)
+    }
+}
+
+/// the locations of the protocol, from the open documents or else from the
+/// files
+fn locations<'a>(
+    documents: &HashMap<String, Document>,
+    locations: impl Iterator<Item = &'a index::Location>,
+) -> Vec<Value> {
+    let mut files: HashMap<&Path, Arc<Source>> = HashMap::new();
+    locations
+        .map(|l| {
+            let source = files
+                .entry(&l.path)
+                .or_insert_with(|| source(documents, &l.path));
+            json!({ "uri": uri(&l.path), "range": range(source, l.range.clone()) })
+        })
+        .collect()
+}
+
+/// the source of a script, its open document if there is one
+fn source(documents: &HashMap<String, Document>, path: &Path) -> Arc<Source> {
+    match documents.get(&uri(path)) {
+        Some(doc) => doc.tree.program.source.clone(),
+        None => {
+            let text = source::read_to_string(path).unwrap_or_default();
+            Arc::new(Source::new(Some(path.display().to_string()), text))
+        }
+    }
+}
+
+fn uri(path: &Path) -> String {
+    format!("file://{}", path.display())
+}
+
+fn publish(uri: &str, diagnostics: Vec<Value>) -> Value {
+    json!({
+        "jsonrpc": "2.0",
+        "method": "textDocument/publishDiagnostics",
+        "params": { "uri": uri, "diagnostics": diagnostics },
+    })
+}
+
+fn definition(doc: &Document, uri: &str, i: usize) -> Value {
+    match doc.analysis.definition(i) {
+        Some(d) => json!({ "uri": uri, "range": doc.range(&d.name.span) }),
+        None => Value::Null,
+    }
+}
+
+fn hover(doc: &Document, i: usize) -> Value {
+    let Some(d) = doc.analysis.definition(i) else {
+        // builtins have no declaration
+        let builtin = doc
+            .analysis
+            .references
+            .iter()
+            .find(|(s, d)| d.is_none() && s.start() <= i && i <= s.end());
+        return match builtin {
+            Some((s, _)) => json!({
+                "contents": { "kind": "markdown", "value": format!("builtin `{}`", s) },
+                "range": doc.range(s),
+            }),
+            None => Value::Null,
+        };
+    };
+    let mut value = format!("```drgns\n{}\n```", signature(d));
+    let documentation = doc.documentation(d);
+    if !documentation.is_empty() {
+        value.push_str("\n\n");
+        value.push_str(&documentation);
+    }
+    json!({ "contents": { "kind": "markdown", "value": value } })
+}
+
+fn completion(doc: &Document, i: usize) -> Value {
+    let visible = doc.analysis.visible(i);
+    let mut items: Vec<Value> = visible
+        .iter()
+        .map(|d| {
+            let kind = match &d.t {
+                _ if d.function => FUNCTION,
+                Some(Type::Function(..)) => FUNCTION,
+                Some(Type::Module) => MODULE,
+                _ => VARIABLE,
+            };
+            json!({ "label": d.name.name, "kind": kind, "detail": signature(d) })
+        })
+        .collect();
+    let builtins = BUILTINS
+        .iter()
+        .map(|b| (b.name, FUNCTION))
+        .chain(MODULES.iter().map(|(name, ..)| (*name, MODULE)))
+        .chain(VARIABLES.iter().map(|name| (*name, VARIABLE)));
+    for (name, kind) in builtins {
+        // unless the program shadows them
+        if !visible.iter().any(|d| d.name.name == name) {
+            items.push(json!({ "label": name, "kind": kind, "detail": "builtin" }));
+        }
+    }
+    Value::Array(items)
+}
+
+#[cfg(test)]
+mod test {
+    use std::ops::ControlFlow;
+
+    use serde_json::{json, Value};
+
+    use super::{read_message, Server};
+    use crate::test_utils;
+
+    const URI: &str = "file:///a.drgns";
+
+    fn open(server: &mut Server, text: &str) -> Value {
+        let open = json!({
+            "jsonrpc": "2.0",
+            "method": "textDocument/didOpen",
+            "params": { "textDocument": { "uri": URI, "text": text } },
+        });
+        let ControlFlow::Continue(mut replies) = server.handle(&open) else {
+            panic!("the server stopped");
+        };
+        replies.remove(0)
+    }
+
+    fn change(server: &mut Server, changes: Value) -> Value {
+        let change = json!({
+            "jsonrpc": "2.0",
+            "method": "textDocument/didChange",
+            "params": { "textDocument": { "uri": URI }, "contentChanges": changes },
+        });
+        let ControlFlow::Continue(mut replies) = server.handle(&change) else {
+            panic!("the server stopped");
+        };
+        replies.remove(0)
+    }
+
+    fn request(server: &mut Server, method: &str, line: u32, character: u32) -> Value {
+        let params = json!({
+            "textDocument": { "uri": URI },
+            "position": { "line": line, "character": character },
+        });
+        call(server, method, params)
+    }
+
+    fn call(server: &mut Server, method: &str, params: Value) -> Value {
+        let request = json!({ "jsonrpc": "2.0", "id": 1, "method": method, "params": params });
+        let ControlFlow::Continue(mut replies) = server.handle(&request) else {
+            panic!("the server stopped");
+        };
+        replies.remove(0)["result"].take()
+    }
+
+    #[test]
+    fn read_messages() {
+        let body = r#"{"jsonrpc":"2.0","method":"exit"}"#;
+        let input = format!("Content-Length: {}\r\n\r\n{}", body.len(), body);
+        let message = read_message(&mut input.as_bytes()).expect("a valid message");
+        assert_eq!(message, Some(json!({ "jsonrpc": "2.0", "method": "exit" })));
+        assert_eq!(read_message(&mut "".as_bytes()).ok(), Some(None));
+    }
+
+    #[test]
+    fn publish_diagnostics() {
+        let mut server = Server::default();
+        let published = open(&mut server, "x := 1\nprint(y)");
+        let diagnostics = &published["params"]["diagnostics"];
+        assert_eq!(diagnostics[0]["message"], "undefined variable 'y'");
+        assert_eq!(diagnostics[0]["code"], "E03001");
+        assert_eq!(
+            diagnostics[0]["range"],
+            json!({
+                "start": { "line": 1, "character": 6 },
+                "end": { "line": 1, "character": 7 },
+            })
+        );
+        // syntax errors hide the rest
+        let published = open(&mut server, "print(y\n");
+        let diagnostics = published["params"]["diagnostics"].as_array().cloned();
+        let codes: Vec<Value> = diagnostics
+            .iter()
+            .flatten()
+            .map(|d| d["code"].clone())
+            .collect();
+        assert!(!codes.is_empty());
+        assert!(codes
+            .iter()
+            .all(|c| c.as_str().is_some_and(|c| c.starts_with("E02"))));
+    }
+
+    #[test]
+    fn apply_changes() {
+        let mut server = Server::default();
+        open(&mut server, "x := 1\nprint(y)\n");
+        let range = |line, start, end| {
+            json!({
+                "start": { "line": line, "character": start },
+                "end": { "line": line, "character": end },
+            })
+        };
+        // renaming the variable, then using it before it on a line of its own
+        let published = change(
+            &mut server,
+            json!([
+                { "range": range(0, 0, 1), "text": "y" },
+                { "range": range(0, 0, 0), "text": "\"é\" ++ \"${y}\"\n" },
+            ]),
+        );
+        let diagnostics = &published["params"]["diagnostics"];
+        assert_eq!(diagnostics[0]["message"], "undefined variable 'y'");
+        assert_eq!(diagnostics[0]["range"], range(0, 10, 11));
+        assert_eq!(diagnostics.as_array().map(Vec::len), Some(1));
+        let hover = request(&mut server, "textDocument/hover", 2, 6);
+        assert_eq!(hover["contents"]["value"], "```drgns\ny: int\n```");
+
+        let published = change(&mut server, json!([{ "text": "print(z)" }]));
+        let diagnostics = &published["params"]["diagnostics"];
+        assert_eq!(diagnostics[0]["message"], "undefined variable 'z'");
+    }
+
+    #[test]
+    fn definition_and_hover() {
+        let mut server = Server::default();
+        open(
+            &mut server,
+            "// the answer\n// to everything\nanswer := 42\n\"é\" ++ \"${answer}\"",
+        );
+        let definition = request(&mut server, "textDocument/definition", 3, 10);
+        assert_eq!(
+            definition["range"]["start"],
+            json!({ "line": 2, "character": 0 })
+        );
+        let hover = request(&mut server, "textDocument/hover", 2, 3);
+        assert_eq!(
+            hover["contents"]["value"],
+            "```drgns\nanswer: int\n```\n\nthe answer\nto everything"
+        );
+        let hover = request(&mut server, "textDocument/hover", 3, 0);
+        assert_eq!(hover, Value::Null);
+    }
+
+    #[test]
+    fn complete_visible_names() {
+        let mut server = Server::default();
+        open(&mut server, "total := 0\n{ inner := 1 }\n");
+        let items = request(&mut server, "textDocument/completion", 2, 0);
+        let labels: Vec<&str> = items
+            .as_array()
+            .expect("a list of items")
+            .iter()
+            .filter_map(|i| i["label"].as_str())
+            .collect();
+        assert!(labels.contains(&"total"));
+        assert!(labels.contains(&"print"));
+        assert!(!labels.contains(&"inner"));
+    }
+
+    #[test]
+    fn references_in_the_workspace() {
+        let dir = test_utils::directory("lsp", "references");
+        let lib = dir.join("lib.drgns");
+        std::fs::write(&lib, "// twice\nfunction double(x) -> { x * 2 }\n").expect("written");
+        let root = format!("file://{}", dir.display());
+        let mut server = Server::default();
+        call(&mut server, "initialize", json!({ "rootUri": root }));
+        let main = format!("{}/main.drgns", root);
+        let text = "import lib\nprint(lib::double(1))\nfunction f(y) -> { y + y }\n";
+        let open = json!({
+            "jsonrpc": "2.0",
+            "method": "textDocument/didOpen",
+            "params": { "textDocument": { "uri": main, "text": text } },
+        });
+        assert!(server.handle(&open).is_continue());
+
+        let references = |server: &mut Server, line, character, declaration| {
+            let params = json!({
+                "textDocument": { "uri": main },
+                "position": { "line": line, "character": character },
+                "context": { "includeDeclaration": declaration },
+            });
+            let locations = call(server, "textDocument/references", params);
+            let locations = locations.as_array().cloned().unwrap_or_default();
+            locations
+                .iter()
+                .map(|l| {
+                    let file = l["uri"].as_str().and_then(|u| u.rsplit('/').next());
+                    let start = &l["range"]["start"];
+                    (
+                        file.map(str::to_owned),
+                        start["line"].clone(),
+                        start["character"].clone(),
+                    )
+                })
+                .collect::<Vec<_>>()
+        };
+        let at = |file: &str, line: u32, character: u32| {
+            (Some(file.to_owned()), json!(line), json!(character))
+        };
+        assert_eq!(
+            references(&mut server, 1, 12, true),
+            [at("lib.drgns", 1, 9), at("main.drgns", 1, 11)]
+        );
+        // the parameter is only used in its function
+        assert_eq!(
+            references(&mut server, 2, 19, false),
+            [at("main.drgns", 2, 19), at("main.drgns", 2, 23)]
+        );
+
+        let symbols = call(&mut server, "workspace/symbol", json!({ "query": "doub" }));
+        assert_eq!(symbols[0]["name"], "double");
+        assert_eq!(symbols[0]["containerName"], "lib");
+        assert_eq!(symbols[0]["location"]["range"]["start"]["line"], 1);
+        assert_eq!(symbols.as_array().map(Vec::len), Some(1));
+
+        let rename = |server: &mut Server, name| {
+            let params = json!({
+                "textDocument": { "uri": main },
+                "position": { "line": 1, "character": 12 },
+                "newName": name,
+            });
+            let request = json!({
+                "jsonrpc": "2.0",
+                "id": 1,
+                "method": "textDocument/rename",
+                "params": params,
+            });
+            let ControlFlow::Continue(mut replies) = server.handle(&request) else {
+                panic!("the server stopped");
+            };
+            replies.remove(0)
+        };
+        let renamed = rename(&mut server, "twice");
+        let changes = &renamed["result"]["changes"];
+        assert_eq!(changes[&main][0]["newText"], "twice");
+        assert_eq!(
+            changes[&format!("{}/lib.drgns", root)][0]["range"]["start"],
+            json!({ "line": 1, "character": 9 })
+        );
+        let refused = rename(&mut server, "if");
+        assert_eq!(refused["error"]["code"], super::REQUEST_FAILED);
+        let _ = std::fs::remove_dir_all(dir);
+    }
+
+    #[test]
+    fn exit_after_shutdown() {
+        let mut server = Server::default();
+        let exit = json!({ "jsonrpc": "2.0", "method": "exit" });
+        assert_eq!(server.handle(&exit), ControlFlow::Break(1));
+        let shutdown = json!({ "jsonrpc": "2.0", "id": 1, "method": "shutdown" });
+        assert!(server.handle(&shutdown).is_continue());
+        assert_eq!(server.handle(&exit), ControlFlow::Break(0));
+    }
+}
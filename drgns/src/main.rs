@@ -1,157 +1,2140 @@
-#![allow(clippy::zero_prefixed_literal)]
 // TODO: remove in production
 #![allow(dead_code)]
 #![warn(clippy::unwrap_used)]
-#![feature(trait_alias)]
-#![feature(type_alias_impl_trait)]
 
 use clap::Subcommand;
-use error_handler as eh;
+use drgns::{
+    checker,
+    compiler::{self, OptLevel},
+    diagnostics::{self, ColorChoice},
+    doc,
+    error_handler::{DragonError, ErrorCode},
+    fatal, formatter, highlight,
+    index::{self, Index},
+    internal_error,
+    interpreter::{
+        self,
+        builtins::{
+            self,
+            logging::{self, Level},
+        },
+        interrupt::{self, Reason},
+        limits::DEFAULT_DEPTH,
+        profile::{self, Profile},
+        trace::{self, Trace},
+        Halt,
+    },
+    lint,
+    modules::{
+        bundle::{self, Bundle},
+        cache,
+    },
+    packages::{self, Requirement, Update},
+    parser,
+    source::{self, Source},
+    Capability, Engine, Interpreter, Limits, Sandbox, Value,
+};
+use std::{
+    collections::HashMap,
+    ffi::OsString,
+    io::IsTerminal,
+    ops::ControlFlow,
+    path::{Path, PathBuf},
+    process::exit,
+    sync::{
+        mpsc::{self, RecvTimeoutError},
+        Arc,
+    },
+    thread,
+    time::Duration,
+};
+
+mod bench;
+mod coverage;
+mod dap;
+mod debug;
+mod lsp;
+mod repl;
+mod serve;
+mod testing;
+// the fixtures of the tests of the library, for those of the commands
+#[cfg(test)]
+#[path = "test_utils.rs"]
+mod test_utils;
+mod version;
+mod watch;
 
-use log::debug;
-use parser::Parser;
-use source::SourceArena;
-use std::{io::Write, process::exit, rc::Rc};
+/// Exit status of the process, besides the one given by `exit` in scripts
+const SUCCESS: i32 = 0;
+/// the script failed with an uncaught error
+const RUNTIME_ERROR: i32 = 1;
+/// the script could not be read, parsed or checked, so it didn't run
+const INVALID_PROGRAM: i32 = 2;
+/// the script ran for longer than `--timeout`, as with the `timeout` command
+const TIMED_OUT: i32 = 124;
+/// the script was stopped with Ctrl-C, as shells report a process that
+/// SIGINT ended
+const INTERRUPTED: i32 = 130;
 
-use crate::lexer::Lexer;
+/// How long a script that timed out has to stop before the process ends,
+/// such as one waiting for input that never comes
+const GRACE: Duration = Duration::from_secs(1);
 
-mod data;
-mod error_handler;
-use error_handler::ErrorHandler;
-mod eval;
-mod lexer;
-mod lookahead;
-mod parser;
-mod source;
-mod values;
+/// How many of the functions that took the most a profile prints
+const PROFILE_TOP: usize = 10;
 
 // TODO: overwrite built-in error handling for consistent style
 #[derive(clap::Parser, Debug)]
 #[command(author, version, about, long_about = None)]
-#[deprecated]
-struct Args {
+#[command(args_conflicts_with_subcommands = true)]
+#[command(group = clap::ArgGroup::new("script").args(["input", "file"]).multiple(true))]
+struct Cli {
+    /// Runs a file, same as the `run` subcommand, `-` reads the program from
+    /// the standard input
     #[arg(short, long)]
     input: Option<String>,
 
-    #[arg(short, long, action, default_value_t = false, required = false)]
+    /// Evaluates a program given on the command line and prints its value,
+    /// same as the `eval` subcommand, the positional arguments are passed to
+    /// it as `args`
+    #[arg(
+        short,
+        long = "eval",
+        value_name = "CODE",
+        conflicts_with_all = ["input", "check", "dump_ast", "dump_bytecode", "no_init", "plain"]
+    )]
+    eval: Option<String>,
+
+    /// Checks the input file instead of running it, same as the `check`
+    /// subcommand
+    #[arg(short, long, requires = "script")]
     check: bool,
-}
 
-#[derive(clap::Parser, Debug)]
-#[command(author, version, about, long_about = None)]
-struct Cli {
+    /// Prints the syntax tree of the input file instead of running it, as
+    /// JSON or as S-expressions
+    #[arg(
+        long,
+        value_enum,
+        value_name = "FORMAT",
+        num_args = 0..=1,
+        default_missing_value = "json",
+        requires = "script",
+        conflicts_with = "check"
+    )]
+    dump_ast: Option<AstFormat>,
+
+    /// Prints the bytecode the input file compiles to instead of running it
+    #[arg(long, requires = "script", conflicts_with_all = ["check", "dump_ast"])]
+    dump_bytecode: bool,
+
+    #[command(flatten)]
+    flags: RunFlags,
+
+    /// Starts the interactive session without running `~/.drgnsrc`, or the
+    /// file `DRGNS_INIT` names
+    #[arg(long, conflicts_with = "script")]
+    no_init: bool,
+
+    /// Starts the interactive session without highlighting the input, for
+    /// terminals without colors
+    #[arg(long, conflicts_with = "script")]
+    plain: bool,
+
+    /// When errors and warnings are colored, `auto` colors them on a
+    /// terminal unless `NO_COLOR` is set
+    #[arg(
+        long,
+        value_enum,
+        value_name = "WHEN",
+        default_value = "auto",
+        global = true
+    )]
+    color: ColorChoice,
+
+    /// The file to run when `--input` isn't given, followed by the arguments
+    /// passed to the script as `args`, even those that look like flags
+    #[arg(
+        value_names = ["FILE", "ARGS"],
+        num_args = 0..,
+        trailing_var_arg = true,
+        allow_hyphen_values = true
+    )]
+    file: Vec<String>,
+
     #[command(subcommand)]
     command: Option<Commands>,
 }
 
+/// Flags of the commands that can run again as files change
+#[derive(clap::Args, Debug, Default)]
+struct WatchFlags {
+    /// Runs again each time the file or a module it imports changes, until
+    /// Ctrl-C
+    #[arg(long)]
+    watch: bool,
+
+    /// Clears the terminal before each run of `--watch`
+    #[arg(long, requires = "watch")]
+    clear: bool,
+}
+
+/// Flags of the commands that run scripts
+#[derive(clap::Args, Debug)]
+struct RunFlags {
+    /// The execution engine, the tree-walker is slower but easier to debug
+    #[arg(long, value_enum, default_value_t = Engine::Vm)]
+    engine: Engine,
+
+    /// The minimum level of the messages written with the `log` module, over
+    /// the one `DRGNS_LOG_LEVEL` sets, `info` by default
+    #[arg(long, value_enum, value_name = "LEVEL")]
+    log_level: Option<Level>,
+
+    /// How errors and warnings are written, `json` writes each as a JSON
+    /// object on its own line, for editors and CI
+    #[arg(long, value_enum, value_name = "FORMAT", default_value_t)]
+    format: diagnostics::Format,
+
+    /// Stops the script with an error once it has run for this long, such as
+    /// `30s` or `1m 30s`. In the interactive session, each entry may run for
+    /// this long
+    #[arg(long, value_name = "DURATION", value_parser = humantime::parse_duration)]
+    timeout: Option<Duration>,
+
+    /// Stops the script with an error once it has taken this many steps,
+    /// instructions on the VM and expressions on the tree-walker
+    #[arg(long, value_name = "N")]
+    max_steps: Option<u64>,
+
+    /// Stops the script with an error once it has created this many values,
+    /// counting each list, map, instance and string, and the items in them
+    #[arg(long, value_name = "N")]
+    max_values: Option<u64>,
+
+    /// How deep calls to functions can nest before it is an error
+    #[arg(long, value_name = "N", default_value_t = DEFAULT_DEPTH)]
+    max_depth: usize,
+
+    /// Runs the script in a sandbox, where the standard library can't reach
+    /// files, the network, other programs or the environment
+    #[arg(long)]
+    sandbox: bool,
+
+    /// Gives the sandboxed script back a capability, can be repeated or take
+    /// a list separated by commas
+    #[arg(
+        long,
+        value_enum,
+        value_name = "CAPABILITY",
+        value_delimiter = ',',
+        requires = "sandbox"
+    )]
+    allow: Vec<Capability>,
+
+    /// How much the VM optimizes the script as it compiles it, `0` runs it
+    /// as it is written, for debugging
+    #[arg(
+        short = 'O',
+        long,
+        value_enum,
+        value_name = "LEVEL",
+        default_value = "1"
+    )]
+    opt_level: OptLevel,
+
+    /// Profiles the functions of the script, `cpu` for the time they take
+    /// and `mem` for the values they create, and writes the profile as
+    /// folded stacks for flame graph tools
+    #[arg(long, value_enum, value_name = "KIND")]
+    profile: Option<Profile>,
+
+    /// The file the profile is written to, `drgns-cpu.folded` or
+    /// `drgns-mem.folded` unless set
+    #[arg(long, value_name = "FILE", requires = "profile")]
+    profile_output: Option<String>,
+
+    /// Writes each statement to the standard error as it runs, or each
+    /// instruction with `--trace=vm`, indented by how deep the calls are
+    #[arg(
+        long,
+        value_enum,
+        value_name = "KIND",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "statements"
+    )]
+    trace: Option<Trace>,
+
+    /// Traces only what runs in calls to a function, and the calls it makes,
+    /// can be repeated or take a list separated by commas
+    #[arg(long, value_name = "NAME", value_delimiter = ',', requires = "trace")]
+    trace_function: Vec<String>,
+
+    /// Makes each run the same as the last: the random numbers are the same,
+    /// the clocks start at the Unix epoch and only move when the script
+    /// sleeps, and the local time zone is UTC
+    #[arg(long)]
+    deterministic: bool,
+
+    /// Compiles the modules the script imports again, rather than loading
+    /// the bytecode earlier runs cached
+    #[arg(long)]
+    no_cache: bool,
+}
+
+/// Flags of `drgns test`
+#[derive(clap::Args, Debug, PartialEq)]
+struct TestFlags {
+    /// Write the snapshots of `expect_snapshot` rather than comparing
+    /// values with them, to record new ones or accept the changes
+    #[arg(long)]
+    update: bool,
+
+    /// Writes a report of the lines the tests ran to a file, in the lcov
+    /// format, or as HTML if the file ends with `.html`
+    #[arg(long, value_name = "FILE")]
+    coverage: Option<String>,
+}
+
+/// Flags of `drgns bench`
+#[derive(clap::Args, Debug, PartialEq)]
+struct BenchFlags {
+    /// How long the calls of each benchmark must take for them to be timed,
+    /// the more the steadier the results
+    #[arg(
+        long,
+        value_name = "DURATION",
+        value_parser = humantime::parse_duration,
+        default_value = "1s"
+    )]
+    bench_time: Duration,
+
+    /// Saves the results to a file, a baseline to compare later runs with
+    #[arg(long, value_name = "FILE")]
+    save: Option<String>,
+
+    /// Compares the results with the baseline saved to a file, the exit
+    /// status is 1 if a benchmark regressed
+    #[arg(long, value_name = "FILE")]
+    compare: Option<String>,
+
+    /// How much, in percent, the time or allocations of a benchmark may grow
+    /// over the baseline before it regressed
+    #[arg(long, value_name = "PERCENT", default_value_t = 10.0)]
+    threshold: f64,
+}
+
+/// Flags of `drgns serve`, the code submitted always runs in a sandbox and
+/// held to limits
+#[derive(clap::Args, Debug, PartialEq)]
+struct ServeFlags {
+    /// The address to listen on, a port of the local machine unless set
+    #[arg(long, value_name = "ADDRESS", default_value = "127.0.0.1:8000")]
+    address: String,
+
+    /// The execution engine running the code
+    #[arg(long, value_enum, default_value_t = Engine::Vm)]
+    engine: Engine,
+
+    /// Gives the code a capability of the sandbox back, can be repeated or
+    /// take a list separated by commas
+    #[arg(long, value_enum, value_name = "CAPABILITY", value_delimiter = ',')]
+    allow: Vec<Capability>,
+
+    /// Stops each run with an error once it has run for this long
+    #[arg(
+        long,
+        value_name = "DURATION",
+        value_parser = humantime::parse_duration,
+        default_value = "5s"
+    )]
+    timeout: Duration,
+
+    /// Stops each run with an error once it has taken this many steps
+    #[arg(long, value_name = "N", default_value_t = 10_000_000)]
+    max_steps: u64,
+
+    /// Stops each run with an error once it has created this many values
+    #[arg(long, value_name = "N", default_value_t = 1_000_000)]
+    max_values: u64,
+}
+
+impl ServeFlags {
+    fn limits(&self) -> Limits {
+        Limits {
+            steps: Some(self.max_steps),
+            values: Some(self.max_values),
+            depth: DEFAULT_DEPTH,
+            time: None,
+        }
+    }
+
+    fn sandbox(&self) -> Sandbox {
+        self.allow.iter().fold(Sandbox::new(), |s, c| s.allow(*c))
+    }
+}
+
+impl RunFlags {
+    /// the limits the flags set, `None` if they are the default ones
+    fn limits(&self) -> Option<Limits> {
+        let limits = Limits {
+            steps: self.max_steps,
+            values: self.max_values,
+            depth: self.max_depth,
+            time: None,
+        };
+        (limits != Limits::default()).then_some(limits)
+    }
+
+    /// the sandbox the flags set, `None` without `--sandbox`
+    fn sandbox(&self) -> Option<Sandbox> {
+        let sandbox = self.allow.iter().fold(Sandbox::new(), |s, c| s.allow(*c));
+        self.sandbox.then_some(sandbox)
+    }
+}
+
+/// What the command line asks for, once the subcommand, the flags and the
+/// positional arguments are put together
+#[derive(Debug, PartialEq)]
+enum Action<'a> {
+    Run(&'a str, Engine),
+    Eval(&'a str, Engine),
+    Check(&'a str),
+    Lint {
+        path: &'a str,
+        fix: bool,
+    },
+    Refs(&'a str),
+    Rename {
+        position: &'a str,
+        name: &'a str,
+        diff: bool,
+    },
+    DumpAst(&'a str, AstFormat),
+    DumpBytecode(&'a str),
+    Debug(&'a str),
+    Fmt {
+        input: &'a str,
+        write: bool,
+        diff: bool,
+    },
+    Tokens {
+        input: &'a str,
+        json: bool,
+    },
+    Build {
+        input: &'a str,
+        output: Option<&'a str>,
+        standalone: bool,
+    },
+    Doc {
+        path: &'a str,
+        format: doc::Format,
+        output: &'a str,
+    },
+    Dap,
+    Lsp,
+    Repl {
+        engine: Engine,
+        init: bool,
+        plain: bool,
+    },
+    Test {
+        path: &'a str,
+        engine: Engine,
+        flags: &'a TestFlags,
+    },
+    Bench {
+        path: &'a str,
+        engine: Engine,
+        flags: &'a BenchFlags,
+    },
+    Serve(&'a ServeFlags),
+    Version {
+        verbose: bool,
+        format: version::Format,
+    },
+    ClearCache,
+    AddPackage {
+        name: &'a str,
+        git: Option<&'a str>,
+        version: Option<&'a str>,
+    },
+    Install(Update),
+}
+
+impl Cli {
+    /// the file to read without a subcommand, given with `--input` or first
+    fn input(&self) -> Option<&str> {
+        self.input
+            .as_deref()
+            .or(self.file.first().map(String::as_str))
+    }
+
+    /// the arguments of the script, with `--input` all the positional ones
+    /// are, the file is the first otherwise
+    fn script_args(&self) -> Vec<String> {
+        let after_file = |positional: &[String]| positional.iter().skip(1).cloned().collect();
+        match &self.command {
+            Some(Commands::Run { input, .. }) => after_file(input),
+            Some(Commands::Eval { code, .. }) => after_file(code),
+            Some(Commands::Debug { args, .. }) => args.clone(),
+            Some(_) => vec![],
+            None if self.input.is_some() || self.eval.is_some() => self.file.clone(),
+            None => after_file(&self.file),
+        }
+    }
+
+    /// how diagnostics are written
+    fn format(&self) -> diagnostics::Format {
+        match &self.command {
+            Some(Commands::Check { format, .. }) | Some(Commands::Lint { format, .. }) => *format,
+            _ => self.run_flags().format,
+        }
+    }
+
+    /// whether to run again as files change, and how
+    fn watch_flags(&self) -> Option<&WatchFlags> {
+        match &self.command {
+            Some(Commands::Run { watch, .. }) | Some(Commands::Check { watch, .. }) => Some(watch),
+            _ => None,
+        }
+    }
+
+    /// the flags for running scripts, of the subcommand if it has them
+    fn run_flags(&self) -> &RunFlags {
+        match &self.command {
+            Some(Commands::Run { flags, .. })
+            | Some(Commands::Eval { flags, .. })
+            | Some(Commands::Repl { flags, .. })
+            | Some(Commands::Test { flags, .. })
+            | Some(Commands::Bench { flags, .. }) => flags,
+            _ => &self.flags,
+        }
+    }
+
+    /// what to do, `piped` is whether the standard input is not a terminal,
+    /// without arguments a program is then read from it
+    fn action(&self, piped: bool) -> Action<'_> {
+        if let (None, Some(code)) = (&self.command, &self.eval) {
+            return Action::Eval(code, self.flags.engine);
+        }
+        match (&self.command, self.input()) {
+            (Some(Commands::Run { input, flags, .. }), _) => Action::Run(&input[0], flags.engine),
+            (Some(Commands::Eval { code, flags }), _) => Action::Eval(&code[0], flags.engine),
+            (
+                Some(Commands::Build {
+                    input,
+                    output,
+                    standalone,
+                }),
+                _,
+            ) => Action::Build {
+                input,
+                output: output.as_deref(),
+                standalone: *standalone,
+            },
+            (
+                Some(Commands::Doc {
+                    path,
+                    format,
+                    output,
+                }),
+                _,
+            ) => Action::Doc {
+                path,
+                format: *format,
+                output,
+            },
+            (Some(Commands::Check { input, .. }), _) => Action::Check(input),
+            (Some(Commands::Lint { path, fix, .. }), _) => Action::Lint { path, fix: *fix },
+            (Some(Commands::Refs { symbol }), _) => Action::Refs(symbol),
+            (
+                Some(Commands::Rename {
+                    position,
+                    name,
+                    diff,
+                }),
+                _,
+            ) => Action::Rename {
+                position,
+                name,
+                diff: *diff,
+            },
+            (Some(Commands::Debug { input, .. }), _) => Action::Debug(input),
+            (Some(Commands::Fmt { input, write, diff }), _) => Action::Fmt {
+                input,
+                write: *write,
+                diff: *diff,
+            },
+            (Some(Commands::Tokens { input, json }), _) => Action::Tokens { input, json: *json },
+            (Some(Commands::Dap), _) => Action::Dap,
+            (Some(Commands::Lsp), _) => Action::Lsp,
+            (Some(Commands::Serve(flags)), _) => Action::Serve(flags),
+            (
+                Some(Commands::Repl {
+                    flags,
+                    no_init,
+                    plain,
+                }),
+                _,
+            ) => Action::Repl {
+                engine: flags.engine,
+                init: !no_init,
+                plain: *plain,
+            },
+            (Some(Commands::Test { path, flags, test }), _) => Action::Test {
+                path,
+                engine: flags.engine,
+                flags: test,
+            },
+            (Some(Commands::Bench { path, flags, bench }), _) => Action::Bench {
+                path,
+                engine: flags.engine,
+                flags: bench,
+            },
+            (Some(Commands::Version { verbose, format }), _) => Action::Version {
+                verbose: *verbose,
+                format: *format,
+            },
+            (Some(Commands::Cache { command }), _) => match command {
+                CacheCommand::Clear => Action::ClearCache,
+            },
+            (Some(Commands::Pkg { command }), _) => match command {
+                PkgCommand::Add { name, git, version } => Action::AddPackage {
+                    name,
+                    git: git.as_deref(),
+                    version: version.as_deref(),
+                },
+                PkgCommand::Install => Action::Install(Update::None),
+                PkgCommand::Update { names } if names.is_empty() => Action::Install(Update::All),
+                PkgCommand::Update { names } => Action::Install(Update::Only(names.clone())),
+            },
+            (None, Some(input)) if self.check => Action::Check(input),
+            (None, Some(input)) if self.dump_bytecode => Action::DumpBytecode(input),
+            (None, Some(input)) => match self.dump_ast {
+                Some(format) => Action::DumpAst(input, format),
+                None => Action::Run(input, self.flags.engine),
+            },
+            // piped input is a program, not a session
+            (None, None) if piped => Action::Run(source::STDIN, self.flags.engine),
+            (None, None) => Action::Repl {
+                engine: self.flags.engine,
+                init: !self.no_init,
+                plain: self.plain,
+            },
+        }
+    }
+}
+
+/// How `--dump-ast` prints the syntax tree
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq)]
+enum AstFormat {
+    /// nodes as objects named after their kind, with the spans they cover
+    Json,
+    /// the form used by the parser tests
+    Sexp,
+}
+
+#[derive(Subcommand, Debug)]
+enum CacheCommand {
+    /// Removes the cached bytecode of all modules
+    Clear,
+}
+
+#[derive(Subcommand, Debug)]
+enum PkgCommand {
+    /// Adds a dependency to the manifest and installs it
+    ///
+    /// Without `--version`, the dependency requires the newest version, or
+    /// follows the default branch of a repository without versions.
+    Add {
+        name: String,
+
+        /// The repository of the package, rather than the registry
+        #[arg(long, value_name = "URL")]
+        git: Option<String>,
+
+        /// The versions allowed, such as `1.2`, `~1.2.3` or `=1.2.3`
+        #[arg(long, value_name = "REQUIREMENT")]
+        version: Option<String>,
+    },
+
+    /// Installs the dependencies, at the commits of the lockfile while the
+    /// manifest allows them
+    Install,
+
+    /// Updates the packages given, or all of them, to the newest versions
+    /// the manifest allows
+    Update { names: Vec<String> },
+}
+
 #[derive(Subcommand, Debug)]
 enum Commands {
     /// Builds and runs a file
+    ///
+    /// The arguments after the file are passed to the script as `args`, even
+    /// those that look like flags. `drgns <FILE>` does the same.
+    #[command(override_usage = "drgns run [OPTIONS] <INPUT> [ARGS]...")]
     Run {
-        /// The input file path
-        input: Option<String>
+        #[command(flatten)]
+        flags: RunFlags,
+
+        #[command(flatten)]
+        watch: WatchFlags,
+
+        /// The input file path, `-` reads the program from the standard
+        /// input, followed by the arguments passed to the script as `args`
+        #[arg(
+            value_names = ["INPUT", "ARGS"],
+            required = true,
+            num_args = 1..,
+            trailing_var_arg = true,
+            allow_hyphen_values = true
+        )]
+        input: Vec<String>,
     },
 
-    /// Builds a file only
+    /// Evaluates a program given on the command line and prints its value
+    ///
+    /// The value is printed as `print` would, unless it is `none`, so that
+    /// `drgns eval '2 ** 10'` prints `1024`, and the exit status is the one
+    /// of running a file. The arguments after the program are passed to it
+    /// as `args`. `drgns -e <CODE>` does the same.
+    #[command(override_usage = "drgns eval [OPTIONS] <CODE> [ARGS]...")]
+    Eval {
+        #[command(flatten)]
+        flags: RunFlags,
+
+        /// The program, a single expression or statements separated by `;`,
+        /// followed by the arguments passed to it as `args`
+        #[arg(
+            value_names = ["CODE", "ARGS"],
+            required = true,
+            num_args = 1..,
+            trailing_var_arg = true,
+            allow_hyphen_values = true
+        )]
+        code: Vec<String>,
+    },
+
+    /// Builds a file and the modules it imports to a bundle
+    ///
+    /// The bundle holds their bytecode rather than their source, and runs
+    /// with `drgns <BUNDLE>` on the VM, or directly as it starts with a
+    /// `#!/usr/bin/env drgns` line.
     Build {
-        input: Option<String>
+        input: String,
+
+        /// The bundle written, the input without its extension by default
+        #[arg(short, long, value_name = "FILE")]
+        output: Option<String>,
+
+        /// Writes a copy of drgns carrying the bundle instead, which runs it
+        /// with the arguments it is given on machines without drgns
+        #[arg(long)]
+        standalone: bool,
+    },
+
+    /// Writes the documentation of a directory of scripts, or of a file
+    ///
+    /// The comments starting with `///` document the function, the struct or
+    /// the field below them, those starting with `//!` at the top of a file
+    /// document the module. Each module gets a page with the signatures of
+    /// what it declares and links to the modules it imports, the test files
+    /// are left out. `drgns test` runs the code blocks of the comments.
+    Doc {
+        /// The directory of the scripts, the ones below it included, or a
+        /// script
+        #[arg(default_value = ".")]
+        path: String,
+
+        #[arg(long, value_enum, default_value_t)]
+        format: doc::Format,
+
+        /// The directory the pages are written to
+        #[arg(short, long, value_name = "DIR", default_value = "doc")]
+        output: String,
     },
 
     /// Checks syntax and some semantics, without fully building
+    ///
+    /// Errors and warnings are reported as for a run, the exit status is 2 if
+    /// there is any error.
     Check {
-        input: Option<String>
+        input: String,
+
+        /// How errors and warnings are written, `json` writes each as a JSON
+        /// object on its own line, for editors and CI
+        #[arg(long, value_enum, value_name = "FORMAT", default_value_t)]
+        format: diagnostics::Format,
+
+        #[command(flatten)]
+        watch: WatchFlags,
+    },
+
+    /// Reports code that works but is likely a mistake or hard to read
+    ///
+    /// The rules are `unused-variable`, `shadowing`, `float-equality`,
+    /// `long-function`, `naming`, `nil-comparison` and `trailing-comma`. The
+    /// `[lint]` section of the `drgn.toml` of the project turns them `off` or
+    /// makes them an `error`, and comments such as `// lint:disable naming`
+    /// turn them off for some lines. The exit status is 2 if there is any
+    /// error.
+    Lint {
+        /// The directory of the scripts, the ones below it included, or a
+        /// script
+        #[arg(default_value = ".")]
+        path: String,
+
+        /// Rewrites the scripts with the fixes of the lints that have one,
+        /// such as removing the imports that are never used
+        #[arg(long)]
+        fix: bool,
+
+        /// How the lints are written, `json` writes each as a JSON object on
+        /// its own line, with its fix
+        #[arg(long, value_enum, value_name = "FORMAT", default_value_t)]
+        format: diagnostics::Format,
+    },
+
+    /// Lists where a name declared at the top level of a script is used, in
+    /// the scripts of the project
+    ///
+    /// The name can be given with its module, `a::b::f` for the `f` of
+    /// `a/b.drgns`. The project is the directory of the `drgn.toml` above the
+    /// working directory, or else the working directory, with the scripts
+    /// below it. Its symbols are indexed in the cache, so that only the
+    /// scripts changed since the last time are parsed again.
+    Refs { symbol: String },
+
+    /// Renames the name at a position of a script, and its uses
+    ///
+    /// The position is `FILE:LINE:COLUMN`, of the name in its declaration or
+    /// in one of its uses. A name declared at the top level of a script is
+    /// renamed in the scripts of the project using it too, the project being
+    /// the one `drgns refs` looks in. The rename is refused if a name would
+    /// then refer to another declaration than it does.
+    Rename {
+        position: String,
+        name: String,
+
+        /// Prints the changes the rename would make, as a unified diff,
+        /// instead of writing them
+        #[arg(long)]
+        diff: bool,
+    },
+
+    /// Runs a file in the debugger, on the tree-walker, stopping before the
+    /// first statement
+    Debug {
+        input: String,
+
+        /// Arguments passed to the script as `args`, after `--`
+        #[arg(last = true)]
+        args: Vec<String>,
+    },
+
+    /// Prints a file in the canonical style, keeping its comments
+    Fmt {
+        input: String,
+
+        /// Rewrites the file instead of printing it
+        #[arg(long)]
+        write: bool,
+
+        /// Prints the changes the formatting would make, as a unified diff
+        #[arg(long, conflicts_with = "write")]
+        diff: bool,
+    },
+
+    /// Starts an interactive session, where each line is run as it is
+    /// entered
+    ///
+    /// Lines starting with `:` are commands of the session, `:help` lists
+    /// them. The script `~/.drgnsrc`, or the one the environment variable
+    /// `DRGNS_INIT` names, is run first, to define what every session needs.
+    Repl {
+        #[command(flatten)]
+        flags: RunFlags,
+
+        /// Doesn't run `~/.drgnsrc`, or the file `DRGNS_INIT` names, first
+        #[arg(long)]
+        no_init: bool,
+
+        /// Doesn't highlight the input, for terminals without colors, as
+        /// when `NO_COLOR` is set
+        #[arg(long)]
+        plain: bool,
+    },
+
+    /// Runs the tests of a directory, or of a single file
+    ///
+    /// Tests are the functions whose names start with `test_` in the files
+    /// whose names end with `_test.drgns`, and the examples of the comments
+    /// of the scripts, see `drgns doc`. Each runs on its own, after the
+    /// statements of its file, and fails if it raises an error. The exit
+    /// status is 1 if any test failed.
+    Test {
+        #[command(flatten)]
+        flags: RunFlags,
+
+        #[command(flatten)]
+        test: TestFlags,
+
+        /// The directory to look for test files in, the ones below it
+        /// included, or a test file
+        #[arg(default_value = ".")]
+        path: String,
+    },
+
+    /// Runs the benchmarks of a directory, or of a single file
+    ///
+    /// Benchmarks are the functions whose names start with `bench_` in the
+    /// test files. Each is called again and again, for about `--bench-time`,
+    /// and the time and the values created per call are printed.
+    Bench {
+        #[command(flatten)]
+        flags: RunFlags,
+
+        #[command(flatten)]
+        bench: BenchFlags,
+
+        /// The directory to look for test files in, the ones below it
+        /// included, or a test file
+        #[arg(default_value = ".")]
+        path: String,
+    },
+
+    /// Serves a playground, a page to run code on from a browser, over HTTP
+    ///
+    /// `GET /` is the page, and `POST /run` runs the code of a JSON object
+    /// such as `{"code": "print(1)"}`, answering with what it printed and
+    /// logged, its errors and its value as JSON. Each run starts afresh, in
+    /// a sandbox, held to the limits and stopped after the timeout.
+    Serve(ServeFlags),
+
+    /// Prints the version of drgns
+    ///
+    /// With `--verbose`, also the commit and the compiler it was built with,
+    /// its engines, the modules of its standard library and the limits
+    /// scripts run with by default. `--format json` prints all of it as a
+    /// JSON object, for tools to check what an installation can do.
+    Version {
+        /// Prints what drgns was built from and what it has
+        #[arg(short, long)]
+        verbose: bool,
+
+        #[arg(long, value_enum, value_name = "FORMAT", default_value_t)]
+        format: version::Format,
+    },
+
+    /// Manages the bytecode of imported modules, cached by earlier runs
+    Cache {
+        #[command(subcommand)]
+        command: CacheCommand,
+    },
+
+    /// Manages the packages a project depends on, declared in `drgn.toml`
+    Pkg {
+        #[command(subcommand)]
+        command: PkgCommand,
+    },
+
+    /// Runs the debug adapter, over the standard input and output
+    Dap,
+
+    /// Runs the language server, over the standard input and output
+    Lsp,
+
+    /// Prints the tokens of a file classified for syntax highlighting
+    Tokens {
+        input: String,
+
+        /// Prints a JSON array of tokens with their class and span
+        #[arg(long)]
+        json: bool,
     },
 }
 
 fn main() {
-    let cli = <Cli as clap::Parser>::parse();
-    match &cli.command {
-        Some(Commands::Run{input: _}) => todo!(),
-        Some(Commands::Build{input: _}) => todo!(),
-        Some(Commands::Check{input: _}) => todo!(),
-        None => repl(),
+    let cli = match standalone() {
+        Some(args) => <Cli as clap::Parser>::parse_from(args),
+        None => <Cli as clap::Parser>::parse(),
+    };
+    // scripts run on a thread with the stack their calls can take
+    let stack = cli.run_flags().limits().unwrap_or_default().stack_size();
+    let started = thread::Builder::new()
+        .name("main".to_string())
+        .stack_size(stack)
+        .spawn(move || start(cli));
+    match started.map(thread::JoinHandle::join) {
+        Ok(Ok(())) => {}
+        Ok(Err(panic)) => std::panic::resume_unwind(panic),
+        Err(_) => {
+            fatal!("the thread running scripts cannot be started");
+        }
     }
 }
 
-fn repl() {
-    let eh = Arc::new(ErrorHandler::new())
+/// The command line running the bundle the binary carries, if it is one
+/// `drgns build --standalone` wrote, all the arguments go to the script
+fn standalone() -> Option<Vec<OsString>> {
+    let exe = std::env::current_exe().ok()?;
+    bundle::embedded(&exe).ok()??;
+    let run = ["drgns".into(), "run".into(), exe.into_os_string()];
+    Some(run.into_iter().chain(std::env::args_os().skip(1)).collect())
 }
 
-#[deprecated]
-struct Interpreter {
-    args: Args,
-    src: Rc<SourceArena>,
-    pr: Parser,
-    eh: Rc<ErrorHandler>,
+fn start(cli: Cli) {
+    diagnostics::set_color(cli.color);
+    diagnostics::set_format(cli.format());
+    let action = cli.action(!std::io::stdin().is_terminal());
+    // the client passes the arguments of the script when launching it
+    if action != Action::Dap {
+        builtins::set_args(cli.script_args());
+    }
+    if let Some(level) = cli.run_flags().log_level {
+        logging::set_minimum_level(level);
+    }
+    if cli.run_flags().deterministic {
+        builtins::set_deterministic();
+    }
+    compiler::set_opt_level(cli.run_flags().opt_level);
+    if !cli.run_flags().no_cache {
+        if let Some(directory) = cache::default_directory() {
+            cache::enable(directory);
+        }
+    }
+    if let Some(kind) = cli.run_flags().trace {
+        if kind == Trace::Vm && cli.run_flags().engine == Engine::Walk {
+            let msg = "--trace=vm traces the instructions of the VM, not of --engine walk";
+            <Cli as clap::CommandFactory>::command()
+                .error(clap::error::ErrorKind::ArgumentConflict, msg)
+                .exit();
+        }
+        let functions = cli.run_flags().trace_function.clone();
+        trace::start(kind, functions, Box::new(std::io::stderr()));
+    }
+    let flags = cli.run_flags();
+    let watch = cli.watch_flags();
+    match action {
+        Action::Run(input, engine) => exit(watched(watch, input, || run(input, engine, flags))),
+        Action::Eval(code, engine) => exit(eval(code, engine, flags)),
+        Action::Check(input) => exit(watched(watch, input, || check(input))),
+        Action::Lint { path, fix } => exit(lint(path, fix)),
+        Action::Refs(symbol) => exit(refs(symbol)),
+        Action::Rename {
+            position,
+            name,
+            diff,
+        } => exit(rename(position, name, diff)),
+        Action::DumpAst(input, format) => exit(dump_ast(input, format)),
+        Action::DumpBytecode(input) => exit(dump_bytecode(input)),
+        Action::Debug(input) => exit(debug(input)),
+        Action::Fmt { input, write, diff } => exit(fmt(input, write, diff)),
+        Action::Tokens { input, json } => exit(tokens(input, json)),
+        Action::Build {
+            input,
+            output,
+            standalone,
+        } => exit(build(input, output, standalone)),
+        Action::Doc {
+            path,
+            format,
+            output,
+        } => exit(doc(path, format, output)),
+        Action::Dap => exit(dap::run()),
+        Action::Lsp => exit(lsp::run()),
+        Action::Repl {
+            engine,
+            init,
+            plain,
+        } => repl(engine, init, plain, flags),
+        Action::Test {
+            path,
+            engine,
+            flags: test,
+        } => exit(testing::run(path, test, flags.timeout, || {
+            interpreter(engine, flags)
+        })),
+        Action::Bench {
+            path,
+            engine,
+            flags: bench,
+        } => exit(bench::run(path, bench, flags.timeout, || {
+            interpreter(engine, flags)
+        })),
+        Action::Serve(serve) => {
+            let (engine, limits, sandbox) = (serve.engine, serve.limits(), serve.sandbox());
+            let stack = limits.stack_size();
+            exit(serve::run(
+                &serve.address,
+                serve.timeout,
+                stack,
+                move || {
+                    let mut interpreter = Interpreter::with_engine(engine);
+                    interpreter.set_limits(limits);
+                    interpreter.set_sandbox(sandbox);
+                    interpreter
+                },
+            ))
+        }
+        Action::Version { verbose, format } => println!("{}", version::render(verbose, format)),
+        Action::ClearCache => exit(clear_cache()),
+        Action::AddPackage { name, git, version } => exit(add_package(name, git, version)),
+        Action::Install(update) => exit(install(&update)),
+    }
 }
 
-impl Interpreter {
-    fn start(&mut self) -> ! {
-        if let Some(path) = self.args.input.clone().as_deref() {
-            debug!("running in batch mode");
-            self.run_file(path);
-        } else {
-            debug!("running in REPL mode");
-            self.run_prompt();
-        }
+fn report(errors: &[DragonError]) {
+    for e in errors {
+        e.report().unwrap_or_else(|_| {
+            internal_error!("stderr cannot be written to");
+        });
     }
+}
 
-    fn run_file(&mut self, path: &str) -> ! {
-        // define an error handler here for convenience
-        let errexit = || -> ! {
-            std::process::exit(eh::display_errors());
+fn read(path: &str) -> Arc<Source> {
+    source::load(path).unwrap_or_else(|e| {
+        let code = match e.kind() {
+            std::io::ErrorKind::NotFound => ErrorCode::IoNotFound,
+            _ => ErrorCode::Io,
+        };
+        let error = DragonError::new(code, format!("cannot read '{}': {}", path, e), None);
+        let error = match e.kind() {
+            std::io::ErrorKind::InvalidData => {
+                error.with_hint("scripts are UTF-8, save the file in that encoding")
+            }
+            _ => error,
         };
+        report(&[error]);
+        exit(INVALID_PROGRAM);
+    })
+}
+
+fn load(path: &str) -> Option<parser::Program> {
+    let src = read(path);
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        report(&errors);
+        return None;
+    }
+    Some(program)
+}
+
+/// The exit status of `run`, which runs again as the files of the script at
+/// `path` change if the flags ask to watch them
+fn watched(flags: Option<&WatchFlags>, path: &str, mut run: impl FnMut() -> i32) -> i32 {
+    match flags {
+        Some(flags) if flags.watch => watch::watch(path, flags.clear, run),
+        _ => run(),
+    }
+}
 
-        let source = match std::fs::read_to_string(path) {
-            Ok(src) => src,
-            Err(err) => match err.kind() {
-                std::io::ErrorKind::NotFound => {
-                    fatal!(format!("path '{}' does not exist", path));
+/// Check a script without running it, returns the exit status of the process
+fn check(path: &str) -> i32 {
+    let Some(program) = load(path) else {
+        return INVALID_PROGRAM;
+    };
+    let diagnostics = checker::check(&program);
+    report(&diagnostics);
+    if diagnostics.iter().any(|d| !d.is_warning()) {
+        INVALID_PROGRAM
+    } else {
+        SUCCESS
+    }
+}
+
+/// Report the lints of the scripts at a path, fixing those that can be first
+/// if `fix`, returns the exit status of the process
+fn lint(path: &str, fix: bool) -> i32 {
+    let Some(files) = scripts(path, "lint") else {
+        return INVALID_PROGRAM;
+    };
+    let dir = match Path::new(path).is_dir() {
+        true => Path::new(path),
+        false => Path::new(path).parent().unwrap_or(Path::new("")),
+    };
+    let config = match lint::Config::load(&std::path::absolute(dir).unwrap_or_default()) {
+        Ok(config) => config,
+        Err(e) => {
+            report(&[e]);
+            return INVALID_PROGRAM;
+        }
+    };
+    let mut status = SUCCESS;
+    for file in &files {
+        let Some(mut program) = load(file) else {
+            status = INVALID_PROGRAM;
+            continue;
+        };
+        if fix {
+            let (fixed, count) = lint::fix(&program, &config);
+            if count > 0 {
+                // saved the way the file was
+                let encoding = source::read_with_encoding(file)
+                    .map(|(_, e)| e)
+                    .unwrap_or_default();
+                if let Err(e) = std::fs::write(file, encoding.encode(&fixed)) {
+                    let msg = format!("cannot write '{}': {}", file, e);
+                    report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+                    return INVALID_PROGRAM;
                 }
-                _ => assert_unreachable!(),
-            },
+                eprintln!("fixed {} lints in '{}'", count, file);
+                let src = Arc::new(Source::new(Some(file.clone()), fixed));
+                program = parser::parse(&src).0;
+            }
+        }
+        let lints = lint::lint_with_fixes(&program, &config);
+        for (d, fix) in &lints {
+            diagnostics::report(d, fix.as_slice()).unwrap_or_else(|_| {
+                internal_error!("stderr cannot be written to");
+            });
+        }
+        if lints.iter().any(|(d, _)| !d.is_warning()) {
+            status = INVALID_PROGRAM;
+        }
+    }
+    status
+}
+
+/// Print the declarations of a symbol in the project of the working
+/// directory, each followed by the lines using it, returns the exit status
+/// of the process
+fn refs(symbol: &str) -> i32 {
+    let dir = std::env::current_dir().unwrap_or_default();
+    let root = packages::project(&dir).unwrap_or(dir.clone());
+    let index = Index::open(&root, cache::directory().as_deref());
+    let definitions = index.definitions(symbol);
+    if definitions.is_empty() {
+        let msg = format!("no script of the project declares '{}'", symbol);
+        report(&[DragonError::new(ErrorCode::UndefinedVariable, msg, None)]);
+        return INVALID_PROGRAM;
+    }
+    let mut texts: HashMap<PathBuf, String> = HashMap::new();
+    let mut place = |l: &index::Location| {
+        let text = texts
+            .entry(l.path.clone())
+            .or_insert_with(|| std::fs::read_to_string(&l.path).unwrap_or_default());
+        let line = text.lines().nth(l.line - 1).unwrap_or_default().trim();
+        let path = l.path.strip_prefix(&dir).unwrap_or(&l.path);
+        let at = format!("{}:{}:{}", path.display(), l.line, l.column);
+        (at, line.to_owned())
+    };
+    for (i, d) in definitions.iter().enumerate() {
+        if i > 0 {
+            println!();
+        }
+        let (at, _) = place(&d.location);
+        println!("{}: {} {}::{}", at, d.kind, d.module, d.name);
+        for r in index.references(d) {
+            let (at, line) = place(r);
+            println!("{}: {}", at, line);
+        }
+    }
+    SUCCESS
+}
+
+/// Rename the name at `FILE:LINE:COLUMN` and its uses, or print the changes
+/// as a diff if `diff`, returns the exit status of the process. The files
+/// are renamed as they are read, see `source::decode`, so that the ranges
+/// found in them are the ones replaced, and saved the way they were.
+fn rename(position: &str, name: &str, diff: bool) -> i32 {
+    let mut parts = position.rsplitn(3, ':');
+    let (Some(column), Some(line), Some(file)) = (parts.next(), parts.next(), parts.next()) else {
+        let msg = format!(
+            "'{}' is not a position, give it as FILE:LINE:COLUMN",
+            position
+        );
+        report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+        return INVALID_PROGRAM;
+    };
+    let path = std::path::absolute(file).unwrap_or_else(|_| PathBuf::from(file));
+    let text = read(file).to_string();
+    let src = Arc::new(Source::new(Some(path.display().to_string()), text));
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        report(&errors);
+        return INVALID_PROGRAM;
+    }
+    let start = line.parse().ok().and_then(|l| src.line_start(l));
+    let Some(i) = start
+        .zip(column.parse::<usize>().ok())
+        .map(|(s, c)| s + c.max(1) - 1)
+    else {
+        let msg = format!("'{}' has no line {}", file, line);
+        report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+        return INVALID_PROGRAM;
+    };
+    let dir = std::env::current_dir().unwrap_or_default();
+    let root = packages::project(&dir).unwrap_or(dir.clone());
+    let index = Index::open(&root, cache::directory().as_deref());
+    let load = |p: &Path| {
+        let text = source::read_to_string(p).ok()?;
+        let src = Arc::new(Source::new(Some(p.display().to_string()), text));
+        Some(parser::parse(&src).0)
+    };
+    let edits = match drgns::rename::rename(&path, &program, i, name, &index, load) {
+        Ok(edits) => edits,
+        Err(e) => {
+            report(&[e]);
+            return INVALID_PROGRAM;
+        }
+    };
+    for (path, ranges) in &edits {
+        let shown = path.strip_prefix(&dir).unwrap_or(path).display();
+        let shown = shown.to_string();
+        let (text, encoding) = match source::read_with_encoding(path) {
+            Ok(read) => read,
+            Err(e) => {
+                let msg = format!("cannot read '{}': {}", shown, e);
+                report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+                return INVALID_PROGRAM;
+            }
         };
-        self.run(source);
-        errexit();
+        let renamed = drgns::rename::apply(&text, ranges, name);
+        if diff {
+            print!("{}", formatter::diff(&shown, &text, &renamed));
+        } else if let Err(e) = std::fs::write(path, encoding.encode(&renamed)) {
+            let msg = format!("cannot write '{}': {}", shown, e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            return INVALID_PROGRAM;
+        } else {
+            eprintln!("renamed {} names in '{}'", ranges.len(), shown);
+        }
     }
+    SUCCESS
+}
 
-    fn run_prompt(&mut self) -> ! {
-        loop {
-            // TODO: fancy prompt
-            //print!("{}> ", lx.delim_depth() - 1);
-            print!("> ");
-            std::io::stdout().flush().unwrap_or_else(|_| {
-                fatal!("stdout cannot be written to");
-            });
-            let mut input = String::new();
-            std::io::stdin().read_line(&mut input).unwrap_or_else(|_| {
-                fatal!("stdout cannot be read");
-            });
-            self.run(input);
-            self.eh.report_all();
+/// The scripts at a path, the ones in the directory and those below it, or
+/// the file. Reports it and returns `None` if there is nothing at the path.
+fn scripts(path: &str, action: &str) -> Option<Vec<String>> {
+    let root = Path::new(path);
+    match root.is_dir() {
+        true => Some(testing::scripts(root)),
+        false if root.exists() => Some(vec![path.to_owned()]),
+        false => {
+            let msg = format!("cannot {} '{}': it doesn't exist", action, path);
+            report(&[DragonError::new(ErrorCode::IoNotFound, msg, None)]);
+            None
         }
     }
+}
 
-    fn run(&mut self, input: String) {
-        self.src.intern(input);
-        let mut eval = eval::ExpressionEval::new();
-        self.pr.parse_expression().unwrap().walk(&mut eval);
-        println!("{:?}", eval);
+/// Print the syntax tree of a script, returns the exit status of the process
+fn dump_ast(path: &str, format: AstFormat) -> i32 {
+    let Some(program) = load(path) else {
+        return INVALID_PROGRAM;
+    };
+    match format {
+        AstFormat::Sexp => print!("{}", program),
+        AstFormat::Json => match serde_json::to_string_pretty(&program) {
+            Ok(json) => println!("{}", json),
+            Err(_) => internal_error!("the syntax tree cannot be serialized"),
+        },
     }
+    SUCCESS
 }
 
-#[deprecated]
-fn old_main() -> ! {
-    std::env::set_var("RUST_LOG", "trace");
-    env_logger::builder().format_timestamp(None).init();
-    let src = Rc::new(SourceArena::new());
-    let eh = Rc::new(ErrorHandler::new(&src));
-    let mut i = Interpreter {
-        args: <Args as clap::Parser>::parse(),
-        src: src.clone(),
-        pr: Parser::new(Lexer::new(source::Reader::from_arena(&src), &eh), &eh),
-        eh: eh.clone(),
+/// Print the disassembled bytecode of a script, returns the exit status of
+/// the process
+fn dump_bytecode(path: &str) -> i32 {
+    let Some(program) = load(path) else {
+        return INVALID_PROGRAM;
     };
+    print!("{}", compiler::compile(&program).disassemble());
+    SUCCESS
+}
 
-    i.start();
+/// Format a script, returns the exit status of the process
+fn fmt(path: &str, write: bool, diff: bool) -> i32 {
+    let src = read(path);
+    let formatted = match formatter::format(&src) {
+        Ok(formatted) => formatted,
+        Err(errors) => {
+            report(&errors);
+            return INVALID_PROGRAM;
+        }
+    };
+    let original = src.slice(0..src.len());
+    if diff {
+        print!("{}", formatter::diff(path, &original, &formatted));
+    } else if !write {
+        print!("{}", formatted);
+    } else if formatted != original {
+        if let Err(e) = std::fs::write(path, formatted) {
+            report(&[DragonError::new(
+                ErrorCode::Io,
+                format!("cannot write '{}': {}", path, e),
+                None,
+            )]);
+            return INVALID_PROGRAM;
+        }
+    }
+    SUCCESS
+}
+
+/// Build a script and the modules it imports to a bundle, or to a copy of
+/// drgns carrying it if `standalone`, returns the exit status of the process
+fn build(path: &str, output: Option<&str>, standalone: bool) -> i32 {
+    let output = match output {
+        Some(output) => output.into(),
+        None if standalone => Path::new(path).with_extension(std::env::consts::EXE_EXTENSION),
+        None => Path::new(path).with_extension(""),
+    };
+    if output == Path::new(path) {
+        let msg = format!("'{}' has no extension, give the bundle `--output`", path);
+        report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+        return INVALID_PROGRAM;
+    }
+    let bytes = match bundle::build(Path::new(path)) {
+        Ok(bytes) => bytes,
+        Err(Halt::Error(e)) => {
+            report(&[e]);
+            return INVALID_PROGRAM;
+        }
+        Err(Halt::Exit(code)) => return code,
+    };
+    let bytes = match standalone {
+        true => match std::env::current_exe().and_then(std::fs::read) {
+            Ok(runtime) => bundle::standalone(&runtime, &bytes),
+            Err(e) => {
+                let msg = format!("cannot read the binary of drgns: {}", e);
+                report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+                return INVALID_PROGRAM;
+            }
+        },
+        false => bytes,
+    };
+    if let Err(e) = std::fs::write(&output, bytes) {
+        let msg = format!("cannot write '{}': {}", output.display(), e);
+        report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+        return INVALID_PROGRAM;
+    }
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+
+        // the bundle runs as a program, through its first line
+        let executable = std::fs::Permissions::from_mode(0o755);
+        if let Err(e) = std::fs::set_permissions(&output, executable) {
+            log::warn!("'{}' cannot be made executable: {}", output.display(), e);
+        }
+    }
+    SUCCESS
+}
+
+/// Write the documentation of the scripts at a path to pages in `output`,
+/// returns the exit status of the process
+fn doc(path: &str, format: doc::Format, output: &str) -> i32 {
+    let Some(files) = scripts(path, "document") else {
+        return INVALID_PROGRAM;
+    };
+    let root = Path::new(path);
+    let root = match root.is_dir() {
+        true => root,
+        false => root.parent().unwrap_or(Path::new("")),
+    };
+    let mut broken = 0;
+    let mut modules = vec![];
+    for file in files.iter().filter(|f| !f.ends_with(testing::FILE_SUFFIX)) {
+        let Some(program) = load(file) else {
+            broken += 1;
+            continue;
+        };
+        let file = Path::new(file);
+        let relative = file.strip_prefix(root).unwrap_or(file);
+        modules.push(doc::module(&program, &doc::module_name(relative)));
+    }
+    let extension = format.extension();
+    let mut pages = vec![(format!("index.{}", extension), doc::index(&modules, format))];
+    for m in &modules {
+        let file = format!("{}.{}", m.name.replace("::", "/"), extension);
+        pages.push((file, doc::page(m, &modules, format)));
+    }
+    for (file, text) in pages {
+        let file = Path::new(output).join(file);
+        let written = file
+            .parent()
+            .map_or(Ok(()), std::fs::create_dir_all)
+            .and_then(|_| std::fs::write(&file, text));
+        if let Err(e) = written {
+            let msg = format!("cannot write '{}': {}", file.display(), e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            return INVALID_PROGRAM;
+        }
+    }
+    println!("documented {} modules in '{}'", modules.len(), output);
+    match broken {
+        0 => SUCCESS,
+        _ => INVALID_PROGRAM,
+    }
+}
+
+/// Add a dependency to the project in the working directory and install the
+/// packages, returns the exit status of the process
+fn add_package(name: &str, git: Option<&str>, version: Option<&str>) -> i32 {
+    let version = match version.map(|v| (v, Requirement::parse(v))) {
+        Some((v, None)) => {
+            let msg = format!("'{}' is not a version requirement", v);
+            report(&[DragonError::new(ErrorCode::Package, msg, None)]);
+            return INVALID_PROGRAM;
+        }
+        Some((_, requirement)) => requirement,
+        None => None,
+    };
+    let dir = std::env::current_dir().unwrap_or_default();
+    let root = packages::project(&dir).unwrap_or(dir);
+    installed(packages::add(&root, name, git.map(str::to_owned), version))
+}
+
+/// Install the packages of the project in the working directory, returns the
+/// exit status of the process
+fn install(update: &Update) -> i32 {
+    let dir = std::env::current_dir().unwrap_or_default();
+    let Some(root) = packages::project(&dir) else {
+        let msg = format!("no {} in this directory or above", packages::MANIFEST);
+        report(&[DragonError::new(ErrorCode::Package, msg, None)]);
+        return INVALID_PROGRAM;
+    };
+    installed(packages::install(&root, update))
+}
+
+/// print the packages installed, returns the exit status of the process
+fn installed(result: Result<Vec<packages::Locked>, DragonError>) -> i32 {
+    match result {
+        Ok(packages) => {
+            for p in &packages {
+                println!("{} {}", p.name, packages::described(p));
+            }
+            SUCCESS
+        }
+        Err(e) => {
+            report(&[e]);
+            RUNTIME_ERROR
+        }
+    }
+}
+
+/// Remove the bytecode cached for modules, returns the exit status of the
+/// process
+fn clear_cache() -> i32 {
+    let Some(directory) = cache::default_directory() else {
+        let msg = "there is no cache directory, neither DRGNS_CACHE_DIR nor HOME is set";
+        report(&[DragonError::new(ErrorCode::Io, msg.to_string(), None)]);
+        return RUNTIME_ERROR;
+    };
+    match cache::clear(&directory) {
+        Ok(removed) => {
+            let files = if removed == 1 { "file" } else { "files" };
+            println!(
+                "removed {} {} from '{}'",
+                removed,
+                files,
+                directory.display()
+            );
+            SUCCESS
+        }
+        Err(e) => {
+            let msg = format!("cannot clear '{}': {}", directory.display(), e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            RUNTIME_ERROR
+        }
+    }
+}
+
+/// Print the highlighting classes of the tokens of a script, returns the exit
+/// status of the process
+fn tokens(path: &str, json: bool) -> i32 {
+    let src = read(path);
+    let highlights = highlight::highlight(&src);
+    if !json {
+        for h in highlights {
+            let (start, end) = (h.span.position(), h.span.end_position());
+            println!(
+                "{}:{}-{}:{}\t{}\t{:?}",
+                start.line,
+                start.column,
+                end.line,
+                end.column,
+                h.class,
+                h.span.to_string()
+            );
+        }
+        return SUCCESS;
+    }
+    let position = |p: source::Position| serde_json::json!({"line": p.line, "column": p.column, "offset": p.offset});
+    let tokens: Vec<serde_json::Value> = highlights
+        .iter()
+        .map(|h| {
+            serde_json::json!({
+                "class": h.class.to_string(),
+                "text": h.span.to_string(),
+                "start": position(h.span.position()),
+                "end": position(h.span.end_position()),
+            })
+        })
+        .collect();
+    println!("{}", serde_json::Value::Array(tokens));
+    SUCCESS
+}
+
+/// Run a script, stopping it once the timeout of the flags passes, returns
+/// the exit status of the process
+fn run(path: &str, engine: Engine, flags: &RunFlags) -> i32 {
+    let Some(script) = script(path) else {
+        return INVALID_PROGRAM;
+    };
+    execute(&script, engine, flags, false)
+}
+
+/// Run a program given on the command line and print its value, unless it
+/// is `none`, returns the exit status of the process as `run` does
+fn eval(code: &str, engine: Engine, flags: &RunFlags) -> i32 {
+    // imports are resolved relative to the working directory, as for the
+    // standard input
+    let src = Arc::new(Source::new(Some("<eval>".to_owned()), code.to_owned()));
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        report(&errors);
+        return INVALID_PROGRAM;
+    }
+    execute(&Script::Program(program), engine, flags, true)
+}
+
+/// Run a script with the flags, printing its value if `show` is true and it
+/// isn't `none`, returns the exit status of the process
+fn execute(script: &Script, engine: Engine, flags: &RunFlags, show: bool) -> i32 {
+    handle_interrupts();
+    let _watchdog = flags.timeout.map(Watchdog::start);
+    let evaluate = || {
+        let result = script.eval(&mut interpreter(engine, flags));
+        match &result {
+            Ok(Value::None) => {}
+            Ok(v) if show => println!("{}", v),
+            _ => {}
+        }
+        result
+    };
+    let Some(kind) = flags.profile else {
+        return status(evaluate());
+    };
+    profile::start(kind);
+    let result = {
+        let _script = profile::call("<script>");
+        evaluate()
+    };
+    let output = match &flags.profile_output {
+        Some(output) => output.clone(),
+        None => format!("drgns-{}.folded", kind.name()),
+    };
+    match (status(result), write_profile(kind, &output)) {
+        (SUCCESS, false) => RUNTIME_ERROR,
+        (status, _) => status,
+    }
+}
+
+/// What a file run holds
+enum Script {
+    Program(parser::Program),
+    Bundle(Arc<Bundle>),
+}
+
+impl Script {
+    fn eval(&self, interpreter: &mut Interpreter) -> Result<Value, Halt> {
+        match self {
+            Script::Program(program) => interpreter.eval(program),
+            Script::Bundle(bundle) => interpreter.eval_bundle(bundle),
+        }
+    }
+}
+
+/// The script of a file, which is a bundle if `drgns build` wrote it, or a
+/// binary carrying one. `None` once the errors why it cannot run are
+/// reported.
+fn script(path: &str) -> Option<Script> {
+    let bytes = match path {
+        source::STDIN => None,
+        _ => match bundle::embedded(Path::new(path)) {
+            Ok(Some(bytes)) => Some(bytes),
+            _ => std::fs::read(path).ok(),
+        },
+    };
+    let Some(bytes) = bytes.filter(|b| bundle::is_bundle(b)) else {
+        return load(path).map(Script::Program);
+    };
+    match Bundle::decode(&bytes) {
+        Some(bundle) => Some(Script::Bundle(Arc::new(bundle))),
+        None => {
+            let msg = format!("'{}' is a bundle another version of drgns built", path);
+            let e = DragonError::new(ErrorCode::Io, msg, None);
+            report(&[e.with_hint("build it again with `drgns build`")]);
+            None
+        }
+    }
+}
+
+/// Write the profile taken to a file, and print the functions that took the
+/// most. Returns whether it could be written.
+fn write_profile(kind: Profile, output: &str) -> bool {
+    if let Err(e) = std::fs::write(output, profile::folded()) {
+        let msg = format!("cannot write the profile '{}': {}", output, e);
+        report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+        return false;
+    }
+    let measure = |n: u64| match kind {
+        Profile::Cpu => format!("{:.2}ms", n as f64 / 1e6),
+        Profile::Mem => n.to_string(),
+    };
+    let mut functions: Vec<_> = profile::functions().into_iter().collect();
+    functions.sort_by(|(a, f), (b, g)| g.own.cmp(&f.own).then(a.cmp(b)));
+    eprintln!("profile: {}, written to {}", kind.name(), output);
+    eprintln!("{:>10} {:>12} {:>12}  function", "calls", "own", "total");
+    for (name, f) in functions.iter().take(PROFILE_TOP) {
+        eprintln!(
+            "{:>10} {:>12} {:>12}  {}",
+            f.calls,
+            measure(f.own),
+            measure(f.total),
+            name
+        );
+    }
+    true
+}
+
+/// an interpreter held to the limits and the sandbox of the flags
+fn interpreter(engine: Engine, flags: &RunFlags) -> Interpreter {
+    let mut interpreter = Interpreter::with_engine(engine);
+    if let Some(limits) = flags.limits() {
+        interpreter.set_limits(limits);
+    }
+    if let Some(sandbox) = flags.sandbox() {
+        interpreter.set_sandbox(sandbox);
+    }
+    interpreter
+}
+
+/// Make Ctrl-C interrupt the script, a second one before the script stops
+/// ends the process. Calls after the first do nothing, more handlers would
+/// end the process on the first Ctrl-C.
+fn handle_interrupts() {
+    static HANDLED: std::sync::Once = std::sync::Once::new();
+    HANDLED.call_once(register_interrupts);
+}
+
+fn register_interrupts() {
+    use signal_hook::{consts::SIGINT, flag};
+
+    // the handler ending the process runs first, so the first Ctrl-C only
+    // raises the flag
+    let raised = interrupt::flag();
+    let registered = flag::register_conditional_shutdown(SIGINT, INTERRUPTED, raised.clone())
+        .and_then(|_| flag::register(SIGINT, raised.clone()));
+    if let Err(e) = registered {
+        log::warn!("Ctrl-C cannot be handled: {}", e);
+    }
+}
+
+/// Stops the script once its time is up, unless it is dropped first
+struct Watchdog {
+    _cancel: mpsc::Sender<()>,
+}
+
+impl Watchdog {
+    /// Interrupt the script after `timeout`, and end the process if it still
+    /// runs `GRACE` later
+    fn start(timeout: Duration) -> Self {
+        let (cancel, cancelled) = mpsc::channel::<()>();
+        thread::spawn(move || {
+            if cancelled.recv_timeout(timeout) != Err(RecvTimeoutError::Timeout) {
+                return;
+            }
+            interrupt::request(Reason::Timeout(timeout));
+            if cancelled.recv_timeout(GRACE) == Err(RecvTimeoutError::Timeout) {
+                report(&[interrupt::error(None)]);
+                exit(TIMED_OUT);
+            }
+        });
+        Self { _cancel: cancel }
+    }
+}
+
+/// Run a script in the debugger, reading commands from the standard input,
+/// returns the exit status of the process
+fn debug(path: &str) -> i32 {
+    let Some(program) = load(path) else {
+        return INVALID_PROGRAM;
+    };
+    let debugger = debug::Debugger::new(std::io::stdin().lock(), std::io::stdout(), path);
+    let mut interpreter = interpreter::Interpreter::new();
+    interpreter.set_hook(Box::new(debugger));
+    status(interpreter.eval(&program))
+}
+
+/// the exit status of a script that ran, reporting its uncaught error
+fn status(result: Result<Value, Halt>) -> i32 {
+    match result {
+        Ok(_) => SUCCESS,
+        Err(Halt::Exit(code)) => code,
+        Err(Halt::Error(e)) => {
+            let code = match interrupt::reason() {
+                _ if !interrupt::is_interrupt(&e) => RUNTIME_ERROR,
+                Some(Reason::Timeout(_)) => TIMED_OUT,
+                _ => INTERRUPTED,
+            };
+            report(&[e]);
+            code
+        }
+    }
+}
+
+/// Run the interactive session, after the init file unless `init` is false,
+/// highlighting the input unless `plain`. Ctrl-C and the timeout stop the
+/// entry running, and the session goes on. The limits and the sandbox hold
+/// for each entry.
+fn repl(engine: Engine, init: bool, plain: bool, flags: &RunFlags) {
+    let mut repl = repl::Repl::new(plain).unwrap_or_else(|_| {
+        fatal!("terminal cannot be initialized");
+    });
+    handle_interrupts();
+    let mut session = interpreter(engine, flags);
+    if let Some(path) = repl::init_path().filter(|_| init) {
+        // as with `:load`, the session starts even if the script fails
+        let _ = repl::Command::Load(path.to_string_lossy().into_owned()).execute(&mut session);
+        interrupt::clear();
+    }
+    let mut status = SUCCESS;
+    repl.run(&mut session, |session, input| {
+        let watchdog = flags.timeout.map(Watchdog::start);
+        let flow = entry(session, input, &mut status);
+        drop(watchdog);
+        interrupt::clear();
+        flow
+    });
+    exit(status);
+}
+
+/// Run a line of the interactive session, `status` is set when it ends the
+/// session
+fn entry(session: &mut Interpreter, input: String, status: &mut i32) -> ControlFlow<()> {
+    match repl::Command::parse(&input) {
+        Some(Ok(command)) => return command.execute(session),
+        Some(Err(msg)) => {
+            report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+            return ControlFlow::Continue(());
+        }
+        None => {}
+    }
+    let src = Arc::new(Source::from_string(input));
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        report(&errors);
+        return ControlFlow::Continue(());
+    }
+    match session.eval(&program) {
+        Ok(Value::None) => {}
+        Ok(v) => println!("{}", v.inspect()),
+        Err(Halt::Exit(code)) => {
+            *status = code;
+            return ControlFlow::Break(());
+        }
+        Err(Halt::Error(e)) => report(&[e]),
+    }
+    ControlFlow::Continue(())
+}
+
+#[cfg(test)]
+mod test {
+    use std::time::Duration;
+
+    use drgns::{
+        diagnostics::{self, ColorChoice},
+        doc, Capability, Engine, Limits, Sandbox,
+    };
+
+    use super::{
+        version, Action, AstFormat, BenchFlags, Cli, Level, OptLevel, Profile, TestFlags, Trace,
+        Update,
+    };
+
+    fn cli(args: &[&str]) -> Cli {
+        let args = std::iter::once("drgns").chain(args.iter().copied());
+        <Cli as clap::Parser>::try_parse_from(args).expect("the arguments are valid")
+    }
+
+    #[test]
+    fn positional_file() {
+        let c = cli(&["a.drgns", "--check", "x", "-i"]);
+        assert_eq!(c.action(false), Action::Run("a.drgns", Engine::Vm));
+        assert_eq!(c.script_args(), ["--check", "x", "-i"]);
+
+        let c = cli(&["--check", "a.drgns"]);
+        assert_eq!(c.action(false), Action::Check("a.drgns"));
+        let c = cli(&["--dump-ast=sexp", "a.drgns"]);
+        assert_eq!(c.action(false), Action::DumpAst("a.drgns", AstFormat::Sexp));
+    }
+
+    #[test]
+    fn input_flag() {
+        let c = cli(&["-i", "a.drgns", "--", "x", "y"]);
+        assert_eq!(c.action(false), Action::Run("a.drgns", Engine::Vm));
+        assert_eq!(c.script_args(), ["x", "y"]);
+
+        let c = cli(&["run", "a.drgns", "x", "--y"]);
+        assert_eq!(c.action(false), Action::Run("a.drgns", Engine::Vm));
+        assert_eq!(c.script_args(), ["x", "--y"]);
+    }
+
+    #[test]
+    fn code_on_the_command_line() {
+        let c = cli(&["-e", "len(args)", "x", "--y"]);
+        assert_eq!(c.action(true), Action::Eval("len(args)", Engine::Vm));
+        assert_eq!(c.script_args(), ["x", "--y"]);
+
+        let c = cli(&["--engine", "walk", "--eval=1 + 2"]);
+        assert_eq!(c.action(false), Action::Eval("1 + 2", Engine::Walk));
+        assert!(c.script_args().is_empty());
+
+        let c = cli(&["eval", "--max-steps", "10", "2 ** 10", "-x"]);
+        assert_eq!(c.action(false), Action::Eval("2 ** 10", Engine::Vm));
+        assert_eq!(c.run_flags().max_steps, Some(10));
+        assert_eq!(c.script_args(), ["-x"]);
+
+        let conflicts = ["drgns", "-e", "1", "--input", "a.drgns"];
+        assert!(<Cli as clap::Parser>::try_parse_from(conflicts).is_err());
+        assert!(<Cli as clap::Parser>::try_parse_from(["drgns", "eval"]).is_err());
+    }
+
+    #[test]
+    fn serve_flags() {
+        let c = cli(&["serve", "--allow", "net", "--max-steps", "1000"]);
+        let Action::Serve(flags) = c.action(false) else {
+            panic!("expected to serve, found {:?}", c.action(false));
+        };
+        assert_eq!(flags.address, "127.0.0.1:8000");
+        assert_eq!(flags.timeout, Duration::from_secs(5));
+        let limits = Limits {
+            steps: Some(1000),
+            values: Some(1_000_000),
+            depth: Limits::default().depth,
+            time: None,
+        };
+        assert_eq!(flags.limits(), limits);
+        assert_eq!(flags.sandbox(), Sandbox::new().allow(Capability::Net));
+        let c = cli(&["serve", "--address", "0.0.0.0:80", "--timeout", "1s"]);
+        let Action::Serve(flags) = c.action(false) else {
+            panic!("expected to serve, found {:?}", c.action(false));
+        };
+        assert_eq!(flags.address, "0.0.0.0:80");
+        assert_eq!(flags.sandbox(), Sandbox::new());
+    }
+
+    #[test]
+    fn no_file() {
+        let repl = Action::Repl {
+            engine: Engine::Vm,
+            init: true,
+            plain: false,
+        };
+        assert_eq!(cli(&[]).action(false), repl);
+        assert_eq!(cli(&[]).action(true), Action::Run("-", Engine::Vm));
+        assert!(<Cli as clap::Parser>::try_parse_from(["drgns", "--check"]).is_err());
+    }
+
+    #[test]
+    fn subcommands() {
+        let c = cli(&["run", "--engine", "walk", "a.drgns", "--engine"]);
+        assert_eq!(c.action(false), Action::Run("a.drgns", Engine::Walk));
+        assert_eq!(c.script_args(), ["--engine"]);
+        let c = cli(&["run", "--log-level", "warn", "a.drgns"]);
+        assert_eq!(c.run_flags().log_level, Some(Level::Warn));
+        let c = cli(&["--log-level", "debug", "a.drgns", "--log-level", "error"]);
+        assert_eq!(c.run_flags().log_level, Some(Level::Debug));
+        let c = cli(&["run", "--timeout", "1m 30s", "a.drgns"]);
+        assert_eq!(c.run_flags().timeout, Some(Duration::from_secs(90)));
+        assert_eq!(c.run_flags().limits(), None);
+        let c = cli(&["--max-steps", "100", "--max-depth", "50", "a.drgns"]);
+        let limits = Limits {
+            steps: Some(100),
+            values: None,
+            depth: 50,
+            time: None,
+        };
+        assert_eq!(c.run_flags().limits(), Some(limits));
+        assert_eq!(c.run_flags().sandbox(), None);
+        let c = cli(&["--sandbox", "--allow=fs,env", "--allow=net", "a.drgns"]);
+        let sandbox = Sandbox::new()
+            .allow(Capability::Fs)
+            .allow(Capability::Env)
+            .allow(Capability::Net);
+        assert_eq!(c.run_flags().sandbox(), Some(sandbox));
+        assert!(<Cli as clap::Parser>::try_parse_from(["drgns", "--allow", "fs", "a"]).is_err());
+        assert!(cli(&["repl", "--deterministic"]).run_flags().deterministic);
+        let c = cli(&["run", "--profile", "mem", "a.drgns"]);
+        assert_eq!(c.run_flags().profile, Some(Profile::Mem));
+        let output = ["drgns", "--profile-output", "p.folded", "a"];
+        assert!(<Cli as clap::Parser>::try_parse_from(output).is_err());
+        let c = cli(&["run", "--trace", "a.drgns"]);
+        assert_eq!(c.run_flags().trace, Some(Trace::Statements));
+        assert_eq!(c.action(false), Action::Run("a.drgns", Engine::Vm));
+        let c = cli(&["--trace=vm", "--trace-function", "f,g", "a.drgns"]);
+        assert_eq!(c.run_flags().trace, Some(Trace::Vm));
+        assert_eq!(c.run_flags().trace_function, ["f", "g"]);
+        assert_eq!(c.run_flags().opt_level, OptLevel::Basic);
+        let c = cli(&["-O", "0", "a.drgns"]);
+        assert_eq!(c.run_flags().opt_level, OptLevel::None);
+        assert!(<Cli as clap::Parser>::try_parse_from(["drgns", "--timeout", "10", "a"]).is_err());
+        let repl = Action::Repl {
+            engine: Engine::Walk,
+            init: false,
+            plain: true,
+        };
+        let c = cli(&["repl", "--no-init", "--plain", "--engine", "walk"]);
+        assert_eq!(c.action(true), repl);
+        assert_eq!(c.color, ColorChoice::Auto);
+        assert_eq!(cli(&["--color=never", "a.drgns"]).color, ColorChoice::Never);
+        let c = cli(&["check", "--color", "always", "a.drgns"]);
+        assert_eq!(c.color, ColorChoice::Always);
+        assert_eq!(c.format(), diagnostics::Format::Human);
+        let c = cli(&["lint", "--format=json"]);
+        assert_eq!(c.format(), diagnostics::Format::Json);
+        let c = cli(&["--format", "json", "a.drgns"]);
+        assert_eq!(c.format(), diagnostics::Format::Json);
+        assert_eq!(
+            cli(&["check", "a.drgns"]).action(false),
+            Action::Check("a.drgns")
+        );
+        let watch = |c: &Cli| c.watch_flags().map(|w| (w.watch, w.clear));
+        assert_eq!(watch(&cli(&["check", "a.drgns"])), Some((false, false)));
+        let c = cli(&["run", "--watch", "--clear", "a.drgns", "--watch"]);
+        assert_eq!(watch(&c), Some((true, true)));
+        assert_eq!(c.script_args(), ["--watch"]);
+        assert_eq!(watch(&cli(&["a.drgns", "--watch"])), None);
+        let clear = ["drgns", "check", "--clear", "a.drgns"];
+        assert!(<Cli as clap::Parser>::try_parse_from(clear).is_err());
+        let lint = Action::Lint {
+            path: ".",
+            fix: false,
+        };
+        assert_eq!(cli(&["lint"]).action(false), lint);
+        assert_eq!(cli(&["refs", "a::f"]).action(false), Action::Refs("a::f"));
+        let rename = Action::Rename {
+            position: "a.drgns:3:5",
+            name: "b",
+            diff: true,
+        };
+        let c = cli(&["rename", "a.drgns:3:5", "b", "--diff"]);
+        assert_eq!(c.action(false), rename);
+        let lint = Action::Lint {
+            path: "a.drgns",
+            fix: true,
+        };
+        assert_eq!(cli(&["lint", "--fix", "a.drgns"]).action(false), lint);
+        let short = Action::Version {
+            verbose: false,
+            format: version::Format::Text,
+        };
+        assert_eq!(cli(&["version"]).action(false), short);
+        let verbose = Action::Version {
+            verbose: true,
+            format: version::Format::Json,
+        };
+        let c = cli(&["version", "--verbose", "--format=json"]);
+        assert_eq!(c.action(false), verbose);
+        assert_eq!(cli(&["cache", "clear"]).action(false), Action::ClearCache);
+        let add = Action::AddPackage {
+            name: "json",
+            git: Some("https://x.org/json"),
+            version: None,
+        };
+        let c = cli(&["pkg", "add", "json", "--git", "https://x.org/json"]);
+        assert_eq!(c.action(false), add);
+        let c = cli(&["pkg", "install"]);
+        assert_eq!(c.action(false), Action::Install(Update::None));
+        let c = cli(&["pkg", "update"]);
+        assert_eq!(c.action(false), Action::Install(Update::All));
+        let c = cli(&["pkg", "update", "json"]);
+        let update = Update::Only(vec!["json".to_string()]);
+        assert_eq!(c.action(false), Action::Install(update));
+        assert!(cli(&["run", "--no-cache", "a.drgns"]).run_flags().no_cache);
+        let build = Action::Build {
+            input: "a.drgns",
+            output: Some("app"),
+            standalone: false,
+        };
+        assert_eq!(cli(&["build", "a.drgns", "-o", "app"]).action(false), build);
+        let build = Action::Build {
+            input: "a.drgns",
+            output: None,
+            standalone: true,
+        };
+        let c = cli(&["build", "--standalone", "a.drgns"]);
+        assert_eq!(c.action(false), build);
+        let doc = Action::Doc {
+            path: ".",
+            format: doc::Format::Markdown,
+            output: "doc",
+        };
+        assert_eq!(cli(&["doc"]).action(false), doc);
+        let doc = Action::Doc {
+            path: "lib",
+            format: doc::Format::Html,
+            output: "site",
+        };
+        let c = cli(&["doc", "lib", "--format", "html", "-o", "site"]);
+        assert_eq!(c.action(false), doc);
+        let mut flags = TestFlags {
+            update: false,
+            coverage: None,
+        };
+        let test = Action::Test {
+            path: ".",
+            engine: Engine::Vm,
+            flags: &flags,
+        };
+        assert_eq!(cli(&["test"]).action(false), test);
+        let c = cli(&["test", "--engine", "walk", "--timeout", "5s", "tests"]);
+        let test = Action::Test {
+            path: "tests",
+            engine: Engine::Walk,
+            flags: &flags,
+        };
+        assert_eq!(c.action(false), test);
+        flags.update = true;
+        let test = Action::Test {
+            path: "tests",
+            engine: Engine::Vm,
+            flags: &flags,
+        };
+        assert_eq!(cli(&["test", "--update", "tests"]).action(false), test);
+        assert_eq!(c.run_flags().timeout, Some(Duration::from_secs(5)));
+        let flags = TestFlags {
+            update: false,
+            coverage: Some("lcov.info".to_string()),
+        };
+        let test = Action::Test {
+            path: ".",
+            engine: Engine::Vm,
+            flags: &flags,
+        };
+        let c = cli(&["test", "--coverage", "lcov.info"]);
+        assert_eq!(c.action(false), test);
+        let c = cli(&["bench", "--compare=base.json", "--threshold=5", "benches"]);
+        let bench = BenchFlags {
+            bench_time: Duration::from_secs(1),
+            save: None,
+            compare: Some("base.json".to_string()),
+            threshold: 5.0,
+        };
+        let action = Action::Bench {
+            path: "benches",
+            engine: Engine::Vm,
+            flags: &bench,
+        };
+        assert_eq!(c.action(false), action);
+        // flags belong to the subcommands that take them
+        let fmt = ["drgns", "fmt", "--engine", "vm", "a.drgns"];
+        assert!(<Cli as clap::Parser>::try_parse_from(fmt).is_err());
+    }
 }
@@ -0,0 +1,396 @@
+//! Loading of imported modules.
+//!
+//! Modules are resolved relative to the file importing them, `import a::b` in
+//! `src/main.drgns` loads `src/a/b.drgns`, the REPL resolves them relative to
+//! the working directory. Each module is evaluated once, in its own global
+//! scope, and all later imports share the same module object. Top-level names
+//! are exported, unless they start with `_`. An import finding no file looks
+//! for a package, see `packages`.
+
+use std::{
+    collections::{BTreeMap, HashMap},
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+};
+
+use crate::{
+    bytecode::Prototype,
+    doc,
+    eh::{DragonError, ErrorCode},
+    interpreter::{Env, Halt, MODULES},
+    packages,
+    parser::{self, walk_statement, Import, Program, Statement, Visitor},
+    source::{read_to_string, Source, SourceString},
+    values::{Builtin, Value},
+};
+
+pub mod bundle;
+pub mod cache;
+#[cfg(test)]
+mod test;
+
+pub use bundle::Bundle;
+
+pub const EXTENSION: &str = "drgns";
+
+/// An evaluated module
+#[derive(Debug)]
+pub struct Module {
+    /// the path of the import, such as `a::b`
+    pub name: String,
+
+    /// `None` for native modules
+    pub path: Option<PathBuf>,
+    exports: BTreeMap<String, Value>,
+}
+
+impl Module {
+    /// a module implemented by the interpreter
+    pub fn native(name: &str, functions: &'static [Builtin], constants: &[(&str, f64)]) -> Self {
+        Self {
+            name: name.to_owned(),
+            path: None,
+            exports: functions
+                .iter()
+                .map(|f| (f.name.to_owned(), Value::Builtin(f)))
+                .chain(
+                    constants
+                        .iter()
+                        .map(|(n, x)| (n.to_string(), Value::Float(*x))),
+                )
+                .collect(),
+        }
+    }
+
+    pub fn get(&self, name: &str) -> Option<Value> {
+        self.exports.get(name).cloned()
+    }
+
+    /// exported names, sorted
+    pub fn exports(&self) -> impl Iterator<Item = &str> {
+        self.exports.keys().map(|k| k.as_str())
+    }
+
+    /// What the module is for: the comments documenting its file, as `drgns
+    /// doc` reads them, or the line of a native module. The file is read
+    /// again, empty if it is gone or no longer parses.
+    pub fn doc(&self) -> String {
+        let Some(path) = &self.path else {
+            return MODULES
+                .iter()
+                .find(|(name, ..)| *name == self.name)
+                .map_or(String::new(), |(.., doc)| doc.to_string());
+        };
+        let Ok(text) = read_to_string(path) else {
+            return String::new();
+        };
+        let source = Arc::new(Source::new(Some(path.display().to_string()), text));
+        match parse(&source) {
+            Ok(program) => doc::module(&program, &self.name).doc,
+            Err(_) => String::new(),
+        }
+    }
+}
+
+/// Evaluates the source of a module with the loader, returns its globals.
+/// Each engine provides its own, so that modules run on the same engine as
+/// the script importing them.
+pub type Evaluator = fn(&Arc<Source>, &Arc<Loader>) -> Result<Env, Halt>;
+
+/// Keeps track of loaded modules, shared by everything a script imports
+pub struct Loader {
+    evaluate: Evaluator,
+    state: Mutex<State>,
+
+    /// where the modules are found rather than in files, see `bundle`
+    bundle: Option<Arc<Bundle>>,
+}
+
+#[derive(Default)]
+struct State {
+    cache: HashMap<PathBuf, Arc<Module>>,
+
+    /// modules being evaluated, with the name shown in errors, the importing
+    /// module comes before the imported one
+    loading: Vec<(PathBuf, String)>,
+}
+
+impl Loader {
+    pub fn new(evaluate: Evaluator) -> Arc<Self> {
+        Arc::new(Self {
+            evaluate,
+            state: Mutex::default(),
+            bundle: None,
+        })
+    }
+
+    /// a loader finding the modules in a bundle
+    pub fn bundled(evaluate: Evaluator, bundle: Arc<Bundle>) -> Arc<Self> {
+        Arc::new(Self {
+            evaluate,
+            state: Mutex::default(),
+            bundle: Some(bundle),
+        })
+    }
+
+    fn state(&self) -> std::sync::MutexGuard<'_, State> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Load the module, evaluating it unless it was loaded before
+    pub fn import(self: &Arc<Self>, import: &Import) -> Result<Value, Halt> {
+        let name = import
+            .path
+            .iter()
+            .map(|i| i.name.as_str())
+            .collect::<Vec<_>>()
+            .join("::");
+        let exists = |p: &Path| match &self.bundle {
+            Some(bundle) => bundle.source(p).is_some(),
+            None => p.is_file(),
+        };
+        let mut file = resolve(import);
+        if !exists(&file) {
+            let base = match &self.bundle {
+                Some(_) => base(import),
+                None => absolute(&base(import)),
+            };
+            file = package(import, &base, exists).unwrap_or(file);
+        }
+        let display = file.display().to_string();
+        let found = match &self.bundle {
+            Some(_) => exists(&file).then(|| file.clone()),
+            None => file.canonicalize().ok(),
+        };
+        let Some(path) = found else {
+            return Err(not_found(import, &file));
+        };
+        if let Some(module) = self.state().cache.get(&path) {
+            return Ok(Value::Module(module.clone()));
+        }
+        let module = self.load(name, path, display, Some(import.span.clone()))?;
+        Ok(Value::Module(module))
+    }
+
+    /// Evaluate a module again, the modules importing it next get the new
+    /// one. The modules it imports are not evaluated again.
+    pub fn reload(self: &Arc<Self>, module: &Module) -> Result<Arc<Module>, Halt> {
+        let Some(path) = module.path.clone() else {
+            return Err(Halt::Error(DragonError::runtime(
+                format!("'{}' is a native module, it has no file", module.name),
+                None,
+            )));
+        };
+        // shown as when it was imported from the working directory
+        let cwd = std::env::current_dir().unwrap_or_default();
+        let display = path
+            .strip_prefix(&cwd)
+            .unwrap_or(&path)
+            .display()
+            .to_string();
+        self.load(module.name.clone(), path, display, None)
+    }
+
+    /// evaluate the module in the file, `span` is the one of the import
+    fn load(
+        self: &Arc<Self>,
+        name: String,
+        path: PathBuf,
+        display: String,
+        span: Option<SourceString>,
+    ) -> Result<Arc<Module>, Halt> {
+        let error = |code, msg| Halt::Error(DragonError::new(code, msg, span.clone()));
+        {
+            let mut state = self.state();
+            if let Some(i) = state.loading.iter().position(|(p, _)| *p == path) {
+                let cycle: Vec<&str> = state.loading[i..]
+                    .iter()
+                    .map(|(_, d)| d.as_str())
+                    .chain([display.as_str()])
+                    .collect();
+                return Err(error(
+                    ErrorCode::ImportCycle,
+                    format!("import cycle: {}", cycle.join(" -> ")),
+                ));
+            }
+            state.loading.push((path.clone(), display.clone()));
+        }
+        let result = self.evaluate(&path, &display);
+        self.state().loading.pop();
+
+        let globals = match result {
+            Ok(globals) => globals,
+            Err(Halt::Error(e)) if e.span().is_none() => {
+                return Err(error(
+                    e.code(),
+                    format!("cannot load module '{}': {}", name, e.message()),
+                ))
+            }
+            Err(h) => return Err(h),
+        };
+        let exports = globals
+            .names()
+            .into_iter()
+            .filter(|n| !n.starts_with('_'))
+            .filter_map(|n| Some((n.clone(), globals.get(&n)?)))
+            .collect();
+        let module = Arc::new(Module {
+            name,
+            path: Some(path.clone()),
+            exports,
+        });
+        self.state().cache.insert(path, module.clone());
+        Ok(module)
+    }
+
+    fn evaluate(self: &Arc<Self>, path: &Path, display: &str) -> Result<Env, Halt> {
+        if let Some(src) = self.bundle.as_ref().and_then(|b| b.source(path)) {
+            return (self.evaluate)(src, self);
+        }
+        let text = read_to_string(path).map_err(|e| {
+            let msg = format!("cannot read '{}': {}", display, e);
+            Halt::Error(DragonError::new(ErrorCode::Io, msg, None))
+        })?;
+        let src = Arc::new(Source::new(Some(display.to_owned()), text));
+        (self.evaluate)(&src, self)
+    }
+
+    /// the bytecode of a module of the bundle running, for the VM
+    pub fn compiled(&self, source: &Arc<Source>) -> Option<Arc<Prototype>> {
+        self.bundle.as_ref()?.compiled(source)
+    }
+}
+
+/// the error of an import that found no module in the file
+fn not_found(import: &Import, file: &Path) -> Halt {
+    let name: Vec<&str> = import.path.iter().map(|i| i.name.as_str()).collect();
+    let e = DragonError::new(
+        ErrorCode::ModuleNotFound,
+        format!("cannot find module '{}'", name.join("::")),
+        Some(import.span.clone()),
+    );
+    let root = packages::project(&absolute(&base(import)));
+    let hint = match root {
+        Some(root) if packages::is_declared(&root, name[0]) => {
+            format!(
+                "the package '{}' is not installed, run `drgns pkg install`",
+                name[0]
+            )
+        }
+        _ => format!("no file at '{}'", file.display()),
+    };
+    Halt::Error(e.with_hint(hint))
+}
+
+/// The file and the files of the modules it imports, then of those they
+/// import, for `--watch`. Imports are followed as far as the files are found
+/// and parse, the files of imports that find none are included, as they may
+/// appear.
+pub fn imported(path: &Path) -> Vec<PathBuf> {
+    #[derive(Default)]
+    struct Imports(Vec<Import>);
+    impl Visitor for Imports {
+        fn visit_statement(&mut self, s: &Statement) {
+            match s {
+                Statement::Import(i) => self.0.push(i.clone()),
+                s => walk_statement(self, s),
+            }
+        }
+    }
+
+    let mut files: Vec<PathBuf> = vec![];
+    let mut pending = vec![std::path::absolute(path).unwrap_or_else(|_| path.to_path_buf())];
+    while let Some(file) = pending.pop() {
+        if files.contains(&file) {
+            continue;
+        }
+        files.push(file.clone());
+        let Ok(text) = read_to_string(&file) else {
+            continue;
+        };
+        let src = Arc::new(Source::new(Some(file.display().to_string()), text));
+        let mut imports = Imports::default();
+        imports.visit_program(&parser::parse(&src).0);
+        pending.extend(imports.0.iter().map(self::file));
+    }
+    files
+}
+
+/// The file of the module an import refers to, the one of a package if there
+/// is none next to the importing file, and the one next to it if there is no
+/// package either
+pub fn file(import: &Import) -> PathBuf {
+    let file = resolve(import);
+    match file.is_file() {
+        true => file,
+        false => package(import, &base(import), Path::is_file).unwrap_or(file),
+    }
+}
+
+/// Parse the source of a module, for the evaluators
+pub fn parse(source: &Arc<Source>) -> Result<Program, Halt> {
+    let (program, errors) = parser::parse(source);
+    // the first error is enough to tell that the module is broken
+    match errors.into_iter().next() {
+        Some(e) => Err(Halt::Error(e)),
+        None => Ok(program),
+    }
+}
+
+/// the directory of the importing file
+fn base(import: &Import) -> PathBuf {
+    let source = import.span.source();
+    let base = source.path().and_then(|p| Path::new(p).parent());
+    base.unwrap_or(Path::new("")).to_path_buf()
+}
+
+/// the file an import refers to, relative to the importing file
+fn resolve(import: &Import) -> PathBuf {
+    let mut file = base(import);
+    for i in &import.path {
+        file.push(&i.name);
+    }
+    file.set_extension(EXTENSION);
+    file
+}
+
+/// the file of the package an import refers to, see `packages::resolve`
+fn package(import: &Import, base: &Path, exists: impl Fn(&Path) -> bool) -> Option<PathBuf> {
+    let path: Vec<&str> = import.path.iter().map(|i| i.name.as_str()).collect();
+    packages::resolve(base, &path, exists)
+}
+
+/// the directory made absolute, so that packages are looked for above the
+/// working directory too
+fn absolute(dir: &Path) -> PathBuf {
+    let dir = match dir.as_os_str().is_empty() {
+        true => Path::new("."),
+        false => dir,
+    };
+    std::path::absolute(dir).unwrap_or_else(|_| dir.to_path_buf())
+}
+
+/// `module::name`, or `Enum::Variant`, the span is the one of the name
+pub fn member(module: Value, name: &str, span: Option<SourceString>) -> Result<Value, DragonError> {
+    if let Value::Enum(e) = &module {
+        let variant = e.variant(name);
+        return variant.map_err(|msg| DragonError::new(ErrorCode::UnknownField, msg, span));
+    }
+    let Value::Module(m) = module else {
+        return Err(DragonError::runtime(
+            format!("{} is not a module", module.type_name()),
+            span,
+        ));
+    };
+    m.get(name).ok_or_else(|| {
+        let e = DragonError::new(
+            ErrorCode::MissingExport,
+            format!("module '{}' has no export '{}'", m.name, name),
+            span,
+        );
+        match name.starts_with('_') {
+            true => e.with_hint("names starting with `_` are private to their module"),
+            false => e,
+        }
+    })
+}
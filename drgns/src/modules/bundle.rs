@@ -0,0 +1,256 @@
+//! Bundles, a program and the modules it imports compiled to bytecode in a
+//! single file, which runs without their sources.
+//!
+//! `drgns build` writes them, starting with a `#!/usr/bin/env drgns` line so
+//! that they can be made executable, and `drgns` runs a file that is a bundle
+//! on the VM. The modules are kept by their path relative to the root of the
+//! project, or to the directory of the program outside of one, and imports
+//! are resolved among them as they would be among the files. The packages
+//! the program imports are bundled as well.
+//!
+//! The text of the sources is left out, only the length of their lines is
+//! kept, so that errors still point at the line and column of the code
+//! raising them. Each module is held as `cache::encode` writes it.
+//!
+//! `drgns build --standalone` appends the bundle to a copy of the drgns
+//! binary, followed by its length and `TRAILER`, and a binary carrying a
+//! bundle runs it rather than taking commands.
+
+use std::{
+    fs,
+    io::{self, Read, Seek, SeekFrom},
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use indexmap::IndexMap;
+
+use super::{cache, resolve};
+use crate::{
+    bytecode::{Chunk, Prototype},
+    compiler,
+    eh::{DragonError, ErrorCode},
+    interpreter::Halt,
+    packages,
+    parser::Import,
+    source::{self, Source},
+};
+
+/// The first line of a bundle
+pub const SHEBANG: &[u8] = b"#!/usr/bin/env drgns\n";
+
+/// after the first line, followed by the version of the format of bundles
+const MAGIC: &[u8] = b"drgns bundle\0";
+const FORMAT: u32 = 1;
+
+/// The end of a binary carrying a bundle, after the length of the bundle
+const TRAILER: &[u8] = b"drgns standalone";
+
+/// A program and the modules it imports, compiled
+#[derive(Debug)]
+pub struct Bundle {
+    /// by their path relative to the program, which comes first
+    modules: IndexMap<PathBuf, (Arc<Source>, Arc<Prototype>)>,
+}
+
+/// Whether the contents of a file are a bundle, rather than a script
+pub fn is_bundle(bytes: &[u8]) -> bool {
+    bytes
+        .strip_prefix(SHEBANG)
+        .unwrap_or(bytes)
+        .starts_with(MAGIC)
+}
+
+/// Compile the program of the file, the modules it imports and the ones
+/// they import, to the contents of a bundle. Each module must be found, even
+/// those imported by code that may never run.
+pub fn build(path: &Path) -> Result<Vec<u8>, Halt> {
+    let path = super::absolute(path);
+    let dir = path.parent().unwrap_or(Path::new("/"));
+    // the packages are bundled too, as the modules of the project
+    let root = packages::project(dir).unwrap_or(dir.to_path_buf());
+    let program = path.strip_prefix(&root).unwrap_or(&path).to_path_buf();
+    let mut modules: IndexMap<PathBuf, Vec<u8>> = IndexMap::new();
+    let mut pending = vec![(program, None)];
+    while let Some((relative, import)) = pending.pop() {
+        if modules.contains_key(&relative) {
+            continue;
+        }
+        let file = root.join(&relative);
+        let text = source::read_to_string(&file).map_err(|e| match &import {
+            Some(import) => super::not_found(import, &file),
+            None => {
+                let code = match e.kind() {
+                    io::ErrorKind::NotFound => ErrorCode::IoNotFound,
+                    _ => ErrorCode::Io,
+                };
+                let msg = format!("cannot read '{}': {}", file.display(), e);
+                Halt::Error(DragonError::new(code, msg, None))
+            }
+        })?;
+        let src = Arc::new(Source::new(Some(relative.display().to_string()), text));
+        let script = compiler::compile(&super::parse(&src)?);
+        for import in imports(&script.chunk) {
+            let exists = |p: &Path| root.join(p).is_file();
+            let relative = resolve(&import);
+            let relative = match exists(&relative) {
+                true => relative,
+                false => super::package(&import, &super::base(&import), exists).unwrap_or(relative),
+            };
+            pending.push((relative, Some(import)));
+        }
+        let Some(bytecode) = cache::encode(&script, &src) else {
+            crate::assert_unreachable!();
+        };
+        let lines = lines(&src);
+        let mut module = (lines.len() as u64).to_le_bytes().to_vec();
+        for n in lines {
+            module.extend((n as u64).to_le_bytes());
+        }
+        module.extend(bytecode);
+        modules.insert(relative, module);
+    }
+
+    let mut bytes = [SHEBANG, MAGIC].concat();
+    bytes.extend(FORMAT.to_le_bytes());
+    bytes.extend((modules.len() as u64).to_le_bytes());
+    for (relative, module) in &modules {
+        write(&mut bytes, relative.to_string_lossy().as_bytes());
+        write(&mut bytes, module);
+    }
+    Ok(bytes)
+}
+
+/// A copy of the binary of drgns carrying the bundle, replacing the one it
+/// may carry already
+pub fn standalone(runtime: &[u8], bundle: &[u8]) -> Vec<u8> {
+    let end = TRAILER.len() + 8;
+    let runtime = match length(runtime) {
+        Some(n) if n <= (runtime.len() - end) as u64 => {
+            &runtime[..runtime.len() - end - n as usize]
+        }
+        _ => runtime,
+    };
+    let mut bytes = [runtime, bundle].concat();
+    bytes.extend((bundle.len() as u64).to_le_bytes());
+    bytes.extend(TRAILER);
+    bytes
+}
+
+/// The bundle the binary at the path carries, `None` if it carries none.
+/// Only its end is read unless it does.
+pub fn embedded(path: &Path) -> io::Result<Option<Vec<u8>>> {
+    let mut file = fs::File::open(path)?;
+    let len = file.metadata()?.len();
+    let end = TRAILER.len() as u64 + 8;
+    if len < end {
+        return Ok(None);
+    }
+    let mut last = vec![0; end as usize];
+    file.seek(SeekFrom::End(-(end as i64)))?;
+    file.read_exact(&mut last)?;
+    let Some(n) = length(&last).filter(|n| *n <= len - end) else {
+        return Ok(None);
+    };
+    let mut bundle = vec![0; n as usize];
+    file.seek(SeekFrom::Start(len - end - n))?;
+    file.read_exact(&mut bundle)?;
+    Ok(Some(bundle))
+}
+
+/// the length of the bundle before the end of the bytes, if they end with
+/// `TRAILER`
+fn length(bytes: &[u8]) -> Option<u64> {
+    let rest = bytes.strip_suffix(TRAILER)?;
+    let n = rest.get(rest.len().checked_sub(8)?..)?;
+    n.try_into().ok().map(u64::from_le_bytes)
+}
+
+impl Bundle {
+    /// The bundle held by the contents of a file, `None` unless it is one
+    /// this version of drgns wrote
+    pub fn decode(bytes: &[u8]) -> Option<Self> {
+        let bytes = bytes.strip_prefix(SHEBANG).unwrap_or(bytes);
+        let mut rest = bytes.strip_prefix(MAGIC)?;
+        let format = u32::from_le_bytes(take(&mut rest, 4)?.try_into().ok()?);
+        if format != FORMAT {
+            return None;
+        }
+        let count = number(&mut rest)?;
+        let mut modules = IndexMap::new();
+        for _ in 0..count {
+            let relative = String::from_utf8(read(&mut rest)?.to_vec()).ok()?;
+            let mut module = read(&mut rest)?;
+            let lines = (0..number(&mut module)?)
+                .map(|_| number(&mut module).and_then(|n| usize::try_from(n).ok()))
+                .collect::<Option<Vec<usize>>>()?;
+            let src = Arc::new(Source::new(Some(relative.clone()), blank(&lines)));
+            let script = cache::decode(module, &src)?;
+            modules.insert(PathBuf::from(relative), (src, Arc::new(script)));
+        }
+        (rest.is_empty() && !modules.is_empty()).then_some(Self { modules })
+    }
+
+    /// the program, run first
+    pub fn program(&self) -> Arc<Prototype> {
+        let (_, (_, script)) = self.modules.first().expect("bundles hold their program");
+        script.clone()
+    }
+
+    /// the source of the module at a path relative to the program, without
+    /// its text
+    pub fn source(&self, path: &Path) -> Option<&Arc<Source>> {
+        self.modules.get(path).map(|(src, _)| src)
+    }
+
+    /// the bytecode of the module of the source `source` returned
+    pub fn compiled(&self, source: &Arc<Source>) -> Option<Arc<Prototype>> {
+        self.modules
+            .values()
+            .find(|(src, _)| Arc::ptr_eq(src, source))
+            .map(|(_, script)| script.clone())
+    }
+}
+
+/// the imports of the chunk and of the functions it creates
+fn imports(chunk: &Chunk) -> Vec<Import> {
+    let nested = chunk.functions.iter().flat_map(|f| imports(&f.chunk));
+    chunk.imports.iter().cloned().chain(nested).collect()
+}
+
+/// the length in characters of each line
+fn lines(src: &Source) -> Vec<usize> {
+    src.to_string()
+        .split('\n')
+        .map(|l| l.chars().count())
+        .collect()
+}
+
+/// a text of blank lines as long as the ones of a source
+fn blank(lines: &[usize]) -> String {
+    let lines: Vec<String> = lines.iter().map(|n| " ".repeat(*n)).collect();
+    lines.join("\n")
+}
+
+fn write(bytes: &mut Vec<u8>, part: &[u8]) {
+    bytes.extend((part.len() as u64).to_le_bytes());
+    bytes.extend(part);
+}
+
+fn take<'a>(bytes: &mut &'a [u8], n: usize) -> Option<&'a [u8]> {
+    if n > bytes.len() {
+        return None;
+    }
+    let (taken, rest) = bytes.split_at(n);
+    *bytes = rest;
+    Some(taken)
+}
+
+fn number(bytes: &mut &[u8]) -> Option<u64> {
+    take(bytes, 8)?.try_into().ok().map(u64::from_le_bytes)
+}
+
+fn read<'a>(bytes: &mut &'a [u8]) -> Option<&'a [u8]> {
+    let len = usize::try_from(number(bytes)?).ok()?;
+    take(bytes, len)
+}
@@ -0,0 +1,931 @@
+//! The bytecode of imported modules, cached on disk so that later runs load
+//! it rather than parsing and compiling the modules again.
+//!
+//! A module is cached in a file named after a hash of its text, of the
+//! version of drgns and of the level it is optimized at, so editing the
+//! module, upgrading or changing `--opt-level` compiles it again. The spans
+//! of the instructions are kept as ranges of the text, they point into the
+//! source read by the run loading them.
+//!
+//! A file that can't be read, or doesn't hold what it should, is compiled
+//! again and overwritten. Files are written under another name first, and
+//! then renamed, so that runs at the same time never read half of one.
+//!
+//! The cache is off unless `enable` is called, `drgns` turns it on in the
+//! directory `default_directory` gives, unless `--no-cache` is set.
+
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, RwLock,
+    },
+};
+
+use crate::{
+    bytecode::{Capture, Chunk, Layout, Op, Prototype, SourceMap},
+    compiler::{self, OptLevel},
+    eh::ErrorCode,
+    interpreter::{self, Halt},
+    parser::{
+        Arity, BinOperator, Identifier, Import, ListPattern, LitExpression, Literal, MapPattern,
+        Pattern, Rest, UnOperator, VariantPattern,
+    },
+    source::{Source, SourceString},
+    values::{self, Value},
+};
+
+/// The extension of the files holding the bytecode of a module
+pub const EXTENSION: &str = "drgnsc";
+
+/// the extension of the files being written
+const PARTIAL: &str = "partial";
+
+/// names the directory of the cache, rather than the one of the user
+const DIRECTORY_VARIABLE: &str = "DRGNS_CACHE_DIR";
+
+/// The files start with these bytes, then the version of their format,
+/// which changes whenever the bytecode or the way it is written does
+const MAGIC: &[u8] = b"drgns\0";
+const FORMAT: u32 = 4;
+
+static DIRECTORY: RwLock<Option<PathBuf>> = RwLock::new(None);
+
+/// Cache the modules compiled from now on in the directory, in all threads
+pub fn enable(directory: PathBuf) {
+    *DIRECTORY.write().unwrap_or_else(|e| e.into_inner()) = Some(directory);
+}
+
+/// the directory `enable` set, `None` while the cache is off
+pub fn directory() -> Option<PathBuf> {
+    DIRECTORY.read().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+/// The directory `DRGNS_CACHE_DIR` names, or else `drgns` in the cache
+/// directory of the user, `$XDG_CACHE_HOME` or `~/.cache`
+pub fn default_directory() -> Option<PathBuf> {
+    let var = |name| {
+        std::env::var_os(name)
+            .filter(|v| !v.is_empty())
+            .map(PathBuf::from)
+    };
+    var(DIRECTORY_VARIABLE)
+        .or_else(|| var("XDG_CACHE_HOME").map(|d| d.join("drgns")))
+        .or_else(|| {
+            let home = var("HOME").or_else(|| var("USERPROFILE"))?;
+            Some(home.join(".cache").join("drgns"))
+        })
+}
+
+/// Compile the source of a module, loading its bytecode from the cache in
+/// the directory if it is there, and storing it there otherwise. Without a
+/// directory it is only compiled.
+pub fn compile(source: &Arc<Source>, directory: Option<&Path>) -> Result<Arc<Prototype>, Halt> {
+    let Some(directory) = directory else {
+        return Ok(compiler::compile(&super::parse(source)?));
+    };
+    let level = compiler::opt_level();
+    let key = key(env!("CARGO_PKG_VERSION"), &source.to_string(), level);
+    let key = format!("{:016x}", key);
+    let path = directory.join(format!("{}.{}", key, EXTENSION));
+    if let Some(script) = fs::read(&path).ok().and_then(|b| decode(&b, source)) {
+        return Ok(Arc::new(script));
+    }
+    let script = compiler::compile_at(&super::parse(source)?, level);
+    if let Some(bytes) = encode(&script, source) {
+        if let Err(e) = store(directory, &key, &bytes) {
+            log::warn!(
+                "cannot cache module '{}' in '{}': {}",
+                source.name(),
+                directory.display(),
+                e
+            );
+        }
+    }
+    Ok(script)
+}
+
+/// Remove the files of the cache in the directory, returns how many there
+/// were
+pub fn clear(directory: &Path) -> io::Result<usize> {
+    let entries = match fs::read_dir(directory) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(0),
+        Err(e) => return Err(e),
+    };
+    let mut removed = 0;
+    for entry in entries {
+        let path = entry?.path();
+        // the directory may be shared with other files, only ours go
+        if let Some(EXTENSION | PARTIAL) = path.extension().and_then(|e| e.to_str()) {
+            fs::remove_file(&path)?;
+            removed += 1;
+        }
+    }
+    Ok(removed)
+}
+
+/// what the file of a module is named after, for the version of drgns
+pub(super) fn key(version: &str, text: &str, level: OptLevel) -> u64 {
+    let mut bytes = vec![];
+    let parts: [&[u8]; 4] = [
+        version.as_bytes(),
+        &FORMAT.to_le_bytes(),
+        &[level as u8],
+        text.as_bytes(),
+    ];
+    // each after its length, so that they can't run into each other
+    for part in parts {
+        bytes.extend((part.len() as u64).to_le_bytes());
+        bytes.extend(part);
+    }
+    fnv(&bytes)
+}
+
+fn checksum(bytes: &[u8]) -> u64 {
+    fnv(bytes)
+}
+
+/// The FNV-1a hash of the bytes, which is the same on every build, unlike
+/// the hasher of the standard library, so that the files cached before an
+/// upgrade of the compiler are still found
+pub(super) fn fnv(bytes: &[u8]) -> u64 {
+    const OFFSET: u64 = 0xcbf2_9ce4_8422_2325;
+    const PRIME: u64 = 0x0100_0000_01b3;
+    bytes
+        .iter()
+        .fold(OFFSET, |h, b| (h ^ *b as u64).wrapping_mul(PRIME))
+}
+
+fn store(directory: &Path, key: &str, bytes: &[u8]) -> io::Result<()> {
+    // threads and processes writing the same module each use their own file
+    static WRITTEN: AtomicU64 = AtomicU64::new(0);
+    let written = WRITTEN.fetch_add(1, Ordering::Relaxed);
+    let partial = format!("{}.{}-{}.{}", key, std::process::id(), written, PARTIAL);
+    let partial = directory.join(partial);
+    fs::create_dir_all(directory)?;
+    fs::write(&partial, bytes)?;
+    fs::rename(&partial, directory.join(format!("{}.{}", key, EXTENSION))).inspect_err(|_| {
+        let _ = fs::remove_file(&partial);
+    })
+}
+
+/// The contents of the file caching a compiled module, `None` if it holds
+/// what the cache can't, such as spans of other sources
+pub fn encode(script: &Prototype, source: &Arc<Source>) -> Option<Vec<u8>> {
+    let mut e = Encoder {
+        bytes: vec![],
+        source,
+    };
+    script.encode(&mut e)?;
+    let mut bytes = MAGIC.to_vec();
+    bytes.extend(FORMAT.to_le_bytes());
+    bytes.extend(checksum(&e.bytes).to_le_bytes());
+    bytes.extend(e.bytes);
+    Some(bytes)
+}
+
+/// The module a file of the cache holds, its spans pointing into the
+/// source, `None` unless the file is one `encode` wrote
+pub fn decode(bytes: &[u8], source: &Arc<Source>) -> Option<Prototype> {
+    let header = MAGIC.len() + 4 + 8;
+    if bytes.len() < header || !bytes.starts_with(MAGIC) {
+        return None;
+    }
+    let (format, sum) = bytes[MAGIC.len()..header].split_at(4);
+    let format = u32::from_le_bytes(format.try_into().ok()?);
+    let sum = u64::from_le_bytes(sum.try_into().ok()?);
+    if format != FORMAT || sum != checksum(&bytes[header..]) {
+        return None;
+    }
+    let mut d = Decoder {
+        bytes: &bytes[header..],
+        source,
+    };
+    let script = Prototype::decode(&mut d)?;
+    d.bytes.is_empty().then_some(script)
+}
+
+struct Encoder<'a> {
+    bytes: Vec<u8>,
+    source: &'a Arc<Source>,
+}
+
+impl Encoder<'_> {
+    fn byte(&mut self, b: u8) {
+        self.bytes.push(b);
+    }
+
+    /// seven bits at a time, the lowest first, the top bit is set on all the
+    /// bytes but the last
+    fn number(&mut self, mut n: u64) {
+        while n >= 0x80 {
+            self.byte(n as u8 | 0x80);
+            n >>= 7;
+        }
+        self.byte(n as u8);
+    }
+}
+
+struct Decoder<'a> {
+    bytes: &'a [u8],
+    source: &'a Arc<Source>,
+}
+
+impl<'a> Decoder<'a> {
+    fn take(&mut self, n: usize) -> Option<&'a [u8]> {
+        if n > self.bytes.len() {
+            return None;
+        }
+        let (taken, rest) = self.bytes.split_at(n);
+        self.bytes = rest;
+        Some(taken)
+    }
+
+    fn byte(&mut self) -> Option<u8> {
+        self.take(1).map(|b| b[0])
+    }
+
+    fn number(&mut self) -> Option<u64> {
+        let mut n = 0;
+        for shift in (0..64).step_by(7) {
+            let b = self.byte()?;
+            n |= ((b & 0x7f) as u64) << shift;
+            if b < 0x80 {
+                return Some(n);
+            }
+        }
+        None
+    }
+}
+
+/// What the files of the cache hold, encoded in the same order as it is
+/// decoded
+trait Cached: Sized {
+    fn encode(&self, e: &mut Encoder) -> Option<()>;
+    fn decode(d: &mut Decoder) -> Option<Self>;
+}
+
+impl Cached for u64 {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        e.number(*self);
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        d.number()
+    }
+}
+
+impl Cached for u32 {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        e.number(*self as u64);
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        d.number()?.try_into().ok()
+    }
+}
+
+impl Cached for usize {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        e.number(*self as u64);
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        d.number()?.try_into().ok()
+    }
+}
+
+impl Cached for bool {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        e.byte(*self as u8);
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        match d.byte()? {
+            0 => Some(false),
+            1 => Some(true),
+            _ => None,
+        }
+    }
+}
+
+impl Cached for String {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.len().encode(e)?;
+        e.bytes.extend(self.as_bytes());
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let len = usize::decode(d)?;
+        String::from_utf8(d.take(len)?.to_vec()).ok()
+    }
+}
+
+/// names are interned, as the compiler does
+impl Cached for Arc<str> {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.to_string().encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        String::decode(d).map(|s| values::intern(&s))
+    }
+}
+
+impl<T: Cached> Cached for Arc<T> {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        (**self).encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        T::decode(d).map(Arc::new)
+    }
+}
+
+impl<T: Cached> Cached for Vec<T> {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.len().encode(e)?;
+        self.iter().try_for_each(|item| item.encode(e))
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        // the items run out with the bytes, however many the length says
+        let len = usize::decode(d)?;
+        (0..len).map(|_| T::decode(d)).collect()
+    }
+}
+
+impl<T: Cached> Cached for Option<T> {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.is_some().encode(e)?;
+        match self {
+            Some(x) => x.encode(e),
+            None => Some(()),
+        }
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        match bool::decode(d)? {
+            true => T::decode(d).map(Some),
+            false => Some(None),
+        }
+    }
+}
+
+impl<A: Cached, B: Cached> Cached for (A, B) {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.0.encode(e)?;
+        self.1.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some((A::decode(d)?, B::decode(d)?))
+    }
+}
+
+impl Cached for SourceString {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        if !Arc::ptr_eq(self.source(), e.source) {
+            return None;
+        }
+        self.start().encode(e)?;
+        self.end().encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let (start, end) = (usize::decode(d)?, usize::decode(d)?);
+        (start <= end && end <= d.source.len()).then(|| SourceString::new(d.source, start..end))
+    }
+}
+
+impl Cached for ErrorCode {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        (*self as u32).encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        ErrorCode::from_number(u32::decode(d)?)
+    }
+}
+
+/// operators are written as their position here
+const BINARY: [BinOperator; 23] = {
+    use BinOperator::*;
+    [
+        Pow, Mul, Div, Mod, Add, Sub, Concat, BitAnd, BitOr, BitXor, Shl, Lsr, Asr, Eq, Ne, Lt, Le,
+        Gt, Ge, And, Or, Xor, In,
+    ]
+};
+
+const UNARY: [UnOperator; 4] = [
+    UnOperator::Neg,
+    UnOperator::Not,
+    UnOperator::BitNot,
+    UnOperator::Str,
+];
+
+impl Cached for BinOperator {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        BINARY.iter().position(|o| o == self)?.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        BINARY.get(usize::decode(d)?).copied()
+    }
+}
+
+impl Cached for UnOperator {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        UNARY.iter().position(|o| o == self)?.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        UNARY.get(usize::decode(d)?).copied()
+    }
+}
+
+impl Cached for Literal {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        match self {
+            Literal::None => e.byte(0),
+            Literal::Bool(b) => {
+                e.byte(1);
+                b.encode(e)?;
+            }
+            Literal::Int(i) => {
+                e.byte(2);
+                (*i as u64).encode(e)?;
+            }
+            Literal::Float(x) => {
+                e.byte(3);
+                x.to_bits().encode(e)?;
+            }
+            Literal::String(s) => {
+                e.byte(4);
+                s.encode(e)?;
+            }
+            Literal::Symbol(s) => {
+                e.byte(5);
+                s.encode(e)?;
+            }
+            Literal::Bytes(b) => {
+                e.byte(6);
+                b.len().encode(e)?;
+                e.bytes.extend(b);
+            }
+        }
+        Some(())
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(match d.byte()? {
+            0 => Literal::None,
+            1 => Literal::Bool(bool::decode(d)?),
+            2 => Literal::Int(u64::decode(d)? as i64),
+            3 => Literal::Float(f64::from_bits(u64::decode(d)?)),
+            4 => Literal::String(String::decode(d)?),
+            5 => Literal::Symbol(String::decode(d)?),
+            6 => {
+                let len = usize::decode(d)?;
+                Literal::Bytes(d.take(len)?.to_vec())
+            }
+            _ => return None,
+        })
+    }
+}
+
+/// constants are the values of literals
+impl Cached for Value {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        let literal = match self {
+            Value::None => Literal::None,
+            Value::Bool(b) => Literal::Bool(*b),
+            Value::Int(i) => Literal::Int(*i),
+            Value::Float(x) => Literal::Float(*x),
+            Value::String(s) => Literal::String(s.to_string()),
+            Value::Symbol(s) => Literal::Symbol(s.to_string()),
+            Value::Bytes(b) => Literal::Bytes(b.to_vec()),
+            _ => return None,
+        };
+        literal.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Literal::decode(d).map(|l| interpreter::literal(&l))
+    }
+}
+
+impl Cached for Identifier {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.name.encode(e)?;
+        self.span.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(Identifier {
+            name: String::decode(d)?,
+            span: SourceString::decode(d)?,
+        })
+    }
+}
+
+impl Cached for Import {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.path.encode(e)?;
+        self.span.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let path: Vec<Identifier> = Vec::decode(d)?;
+        // the parser rejects empty paths
+        if path.is_empty() {
+            return None;
+        }
+        Some(Import {
+            path,
+            span: SourceString::decode(d)?,
+        })
+    }
+}
+
+impl Cached for LitExpression {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.value.encode(e)?;
+        self.span.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(LitExpression {
+            value: Literal::decode(d)?,
+            span: SourceString::decode(d)?,
+        })
+    }
+}
+
+impl Cached for Pattern {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        match self {
+            Pattern::Wildcard(span) => {
+                e.byte(0);
+                span.encode(e)
+            }
+            Pattern::Literal(l) => {
+                e.byte(1);
+                l.encode(e)
+            }
+            Pattern::Binding(name) => {
+                e.byte(2);
+                name.encode(e)
+            }
+            Pattern::List(l) => {
+                e.byte(3);
+                l.items.encode(e)?;
+                l.rest
+                    .as_ref()
+                    .map(|r| (r.position, r.binding.clone()))
+                    .encode(e)?;
+                l.span.encode(e)
+            }
+            Pattern::Map(m) => {
+                e.byte(4);
+                m.entries.encode(e)?;
+                m.span.encode(e)
+            }
+            Pattern::Variant(v) => {
+                e.byte(5);
+                v.path.encode(e)?;
+                v.fields.encode(e)?;
+                v.span.encode(e)
+            }
+        }
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(match d.byte()? {
+            0 => Pattern::Wildcard(SourceString::decode(d)?),
+            1 => Pattern::Literal(LitExpression::decode(d)?),
+            2 => Pattern::Binding(Identifier::decode(d)?),
+            3 => {
+                let items: Vec<Pattern> = Vec::decode(d)?;
+                let rest = Option::<(usize, Option<Identifier>)>::decode(d)?;
+                if rest
+                    .as_ref()
+                    .is_some_and(|(position, _)| *position > items.len())
+                {
+                    return None;
+                }
+                Pattern::List(ListPattern {
+                    items,
+                    rest: rest.map(|(position, binding)| Rest { position, binding }),
+                    span: SourceString::decode(d)?,
+                })
+            }
+            4 => Pattern::Map(MapPattern {
+                entries: Vec::decode(d)?,
+                span: SourceString::decode(d)?,
+            }),
+            5 => {
+                let path: Vec<Identifier> = Vec::decode(d)?;
+                if path.len() < 2 {
+                    return None;
+                }
+                Pattern::Variant(VariantPattern {
+                    path,
+                    fields: Option::decode(d)?,
+                    span: SourceString::decode(d)?,
+                })
+            }
+            _ => return None,
+        })
+    }
+}
+
+impl Cached for Op {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        let (tag, a, b) = match *self {
+            Op::Constant(i) => (0, i, 0),
+            Op::None => (1, 0, 0),
+            Op::True => (2, 0, 0),
+            Op::False => (3, 0, 0),
+            Op::Pop => (4, 0, 0),
+            Op::PopN(n) => (5, n, 0),
+            Op::Slide(n) => (6, n, 0),
+            Op::Duplicate(n) => (7, n, 0),
+            Op::GetLocal(i) => (8, i, 0),
+            Op::SetLocal(i) => (9, i, 0),
+            Op::NewCell(i) => (10, i, 0),
+            Op::MakeCell(i) => (11, i, 0),
+            Op::GetCell(i) => (12, i, 0),
+            Op::SetCell(i) => (13, i, 0),
+            Op::GetFree(i) => (14, i, 0),
+            Op::SetFree(i) => (15, i, 0),
+            Op::GetGlobal(n) => (16, n, 0),
+            Op::SetGlobal(n) => (17, n, 0),
+            Op::DefineGlobal(n, mutable) => (18, n, mutable as u32),
+            Op::Import(i) => (19, i, 0),
+            Op::Member(n) => (20, n, 0),
+            Op::GetField(n) => (21, n, 0),
+            Op::SetField(n) => (22, n, 0),
+            Op::Method(n, fallback) => (23, n, fallback as u32),
+            Op::Binary(op) => (24, BINARY.iter().position(|o| *o == op)? as u32, 0),
+            Op::Unary(op) => (25, UNARY.iter().position(|o| *o == op)? as u32, 0),
+            Op::ToBool => (26, 0, 0),
+            Op::List(n) => (27, n, 0),
+            Op::Map(n) => (28, n, 0),
+            Op::Index => (29, 0, 0),
+            Op::Slice => (30, 0, 0),
+            Op::SetIndex => (31, 0, 0),
+            Op::Iter => (32, 0, 0),
+            Op::Iterate(t) => (33, t, 0),
+            Op::Match(p, t) => (34, p, t),
+            Op::Unpack(n) => (35, n, 0),
+            Op::Unmatched => (36, 0, 0),
+            Op::Jump(t) => (37, t, 0),
+            Op::JumpIfFalse(t) => (38, t, 0),
+            Op::JumpIfTrue(t) => (39, t, 0),
+            Op::Closure(i) => (40, i, 0),
+            Op::Struct(i, n) => (41, i, n),
+            Op::Enum(i, n) => (60, i, n),
+            Op::Call(argc) => (42, argc, 0),
+            Op::TailCall(argc) => (43, argc, 0),
+            Op::Spawn(argc) => (44, argc, 0),
+            Op::Return => (45, 0, 0),
+            Op::Yield => (46, 0, 0),
+            Op::Exit => (47, 0, 0),
+            Op::Fail(i) => (48, i, 0),
+            Op::Throw => (49, 0, 0),
+            Op::Try(t) => (50, t, 0),
+            Op::EndTry => (51, 0, 0),
+            Op::Defer => (52, 0, 0),
+            Op::Destructure(p) => (53, p, 0),
+            Op::CallNamed(argc, i) => (54, argc, i),
+            Op::SpawnNamed(argc, i) => (55, argc, i),
+            Op::Given(slot, t) => (56, slot, t),
+            Op::TailCallNamed(argc, i) => (57, argc, i),
+            Op::JumpIfNone(t) => (58, t, 0),
+            Op::JumpIfNotNone(t) => (59, t, 0),
+        };
+        e.byte(tag);
+        a.encode(e)?;
+        b.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let tag = d.byte()?;
+        let (a, b) = (u32::decode(d)?, u32::decode(d)?);
+        let flag = || match b {
+            0 => Some(false),
+            1 => Some(true),
+            _ => None,
+        };
+        Some(match tag {
+            0 => Op::Constant(a),
+            1 => Op::None,
+            2 => Op::True,
+            3 => Op::False,
+            4 => Op::Pop,
+            5 => Op::PopN(a),
+            6 => Op::Slide(a),
+            7 => Op::Duplicate(a),
+            8 => Op::GetLocal(a),
+            9 => Op::SetLocal(a),
+            10 => Op::NewCell(a),
+            11 => Op::MakeCell(a),
+            12 => Op::GetCell(a),
+            13 => Op::SetCell(a),
+            14 => Op::GetFree(a),
+            15 => Op::SetFree(a),
+            16 => Op::GetGlobal(a),
+            17 => Op::SetGlobal(a),
+            18 => Op::DefineGlobal(a, flag()?),
+            19 => Op::Import(a),
+            20 => Op::Member(a),
+            21 => Op::GetField(a),
+            22 => Op::SetField(a),
+            23 => Op::Method(a, flag()?),
+            24 => Op::Binary(*BINARY.get(a as usize)?),
+            25 => Op::Unary(*UNARY.get(a as usize)?),
+            26 => Op::ToBool,
+            27 => Op::List(a),
+            28 => Op::Map(a),
+            29 => Op::Index,
+            30 => Op::Slice,
+            31 => Op::SetIndex,
+            32 => Op::Iter,
+            33 => Op::Iterate(a),
+            34 => Op::Match(a, b),
+            35 => Op::Unpack(a),
+            36 => Op::Unmatched,
+            37 => Op::Jump(a),
+            38 => Op::JumpIfFalse(a),
+            39 => Op::JumpIfTrue(a),
+            40 => Op::Closure(a),
+            41 => Op::Struct(a, b),
+            42 => Op::Call(a),
+            43 => Op::TailCall(a),
+            44 => Op::Spawn(a),
+            45 => Op::Return,
+            46 => Op::Yield,
+            47 => Op::Exit,
+            48 => Op::Fail(a),
+            49 => Op::Throw,
+            50 => Op::Try(a),
+            51 => Op::EndTry,
+            52 => Op::Defer,
+            53 => Op::Destructure(a),
+            54 => Op::CallNamed(a, b),
+            55 => Op::SpawnNamed(a, b),
+            56 => Op::Given(a, b),
+            57 => Op::TailCallNamed(a, b),
+            58 => Op::JumpIfNone(a),
+            59 => Op::JumpIfNotNone(a),
+            60 => Op::Enum(a, b),
+            _ => return None,
+        })
+    }
+}
+
+impl Cached for Capture {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        let (tag, i) = match *self {
+            Capture::Cell(i) => (0, i),
+            Capture::Free(i) => (1, i),
+        };
+        e.byte(tag);
+        i.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        match d.byte()? {
+            0 => u32::decode(d).map(Capture::Cell),
+            1 => u32::decode(d).map(Capture::Free),
+            _ => None,
+        }
+    }
+}
+
+impl Cached for Layout {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.name.encode(e)?;
+        self.fields.encode(e)?;
+        self.methods.encode(e)?;
+        self.variants.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(Layout {
+            name: String::decode(d)?,
+            fields: Vec::decode(d)?,
+            methods: Vec::decode(d)?,
+            variants: Vec::decode(d)?,
+        })
+    }
+}
+
+/// the map is written as its runs, the number of instructions each covers
+/// and their span
+impl Cached for SourceMap {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        let runs: Vec<(usize, Option<SourceString>)> = self
+            .runs()
+            .map(|(range, span)| (range.len(), span.cloned()))
+            .collect();
+        runs.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let runs: Vec<(usize, Option<SourceString>)> = Vec::decode(d)?;
+        let mut map = SourceMap::default();
+        for (len, span) in runs {
+            for _ in 0..len {
+                map.push(span.as_ref());
+            }
+        }
+        Some(map)
+    }
+}
+
+impl Cached for Chunk {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.code.encode(e)?;
+        self.source_map.encode(e)?;
+        self.constants.encode(e)?;
+        self.names.encode(e)?;
+        self.functions.encode(e)?;
+        self.imports.encode(e)?;
+        self.patterns.encode(e)?;
+        self.named.encode(e)?;
+        self.structs.encode(e)?;
+        self.errors.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        let chunk = Chunk {
+            code: Vec::decode(d)?,
+            source_map: SourceMap::decode(d)?,
+            constants: Vec::decode(d)?,
+            names: Vec::decode(d)?,
+            functions: Vec::decode(d)?,
+            imports: Vec::decode(d)?,
+            patterns: Vec::decode(d)?,
+            named: Vec::decode(d)?,
+            structs: Vec::decode(d)?,
+            errors: Vec::decode(d)?,
+            caches: Default::default(),
+        };
+        (chunk.source_map.len() == chunk.code.len()).then_some(chunk)
+    }
+}
+
+impl Cached for Arity {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.required.encode(e)?;
+        self.optional.encode(e)?;
+        self.variadic.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(Arity {
+            required: usize::decode(d)?,
+            optional: usize::decode(d)?,
+            variadic: bool::decode(d)?,
+        })
+    }
+}
+
+impl Cached for Prototype {
+    fn encode(&self, e: &mut Encoder) -> Option<()> {
+        self.name.encode(e)?;
+        self.arity.encode(e)?;
+        self.parameters.encode(e)?;
+        self.chunk.encode(e)?;
+        self.slots.encode(e)?;
+        self.cells.encode(e)?;
+        self.captures.encode(e)?;
+        self.generator.encode(e)?;
+        self.signature.encode(e)?;
+        self.doc.encode(e)
+    }
+
+    fn decode(d: &mut Decoder) -> Option<Self> {
+        Some(Prototype {
+            name: String::decode(d)?,
+            arity: Arity::decode(d)?,
+            parameters: Vec::decode(d)?,
+            chunk: Chunk::decode(d)?,
+            slots: usize::decode(d)?,
+            cells: usize::decode(d)?,
+            captures: Vec::decode(d)?,
+            generator: bool::decode(d)?,
+            signature: String::decode(d)?,
+            doc: String::decode(d)?,
+        })
+    }
+}
@@ -0,0 +1,353 @@
+use std::{fs, path::PathBuf, sync::Arc};
+
+use super::{bundle, cache, Bundle};
+use crate::{
+    compiler::{compile, OptLevel},
+    interpreter::{Halt, Interpreter},
+    parser::parse,
+    source::{read_to_string, Source},
+    test_utils,
+    values::Value,
+    vm::Vm,
+};
+
+/// write the files in a fresh directory, returns the path of the first one
+fn project(name: &str, files: &[(&str, &str)]) -> PathBuf {
+    test_utils::project("modules", name, files).join(files[0].0)
+}
+
+/// run the script with both engines, they must agree
+fn run(main: &PathBuf) -> Result<Value, String> {
+    let text = read_to_string(main).expect("the script was written");
+    let src = Arc::new(Source::new(Some(main.display().to_string()), text));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", main);
+    let outcome = |r: Result<Value, Halt>| match r {
+        Ok(v) => Ok(v),
+        Err(Halt::Exit(code)) => Err(format!("exit {}", code)),
+        Err(Halt::Error(e)) => Err(e.message().to_string()),
+    };
+    let walked = outcome(Interpreter::new().eval(&program));
+    let compiled = outcome(Vm::new().run(compile(&program)));
+    assert_eq!(walked, compiled, "the engines disagree on {:?}", main);
+    compiled
+}
+
+#[test]
+fn import_relative_to_the_importing_file() {
+    let main = project(
+        "relative",
+        &[
+            ("main.drgns", "import lib::math\nmath::square(math::base)"),
+            (
+                "lib/math.drgns",
+                "import helpers\nbase := helpers::three()\nfunction square(x) -> { x * x }",
+            ),
+            ("lib/helpers.drgns", "function three() -> { 3 }"),
+        ],
+    );
+    assert_eq!(run(&main), Ok(Value::Int(9)));
+}
+
+#[test]
+fn import_evaluates_modules_once() {
+    let main = project(
+        "cached",
+        &[
+            (
+                "main.drgns",
+                "import a\nimport b\na::counter == b::a::counter",
+            ),
+            ("a.drgns", "function counter() -> { 1 }"),
+            ("b.drgns", "import a"),
+        ],
+    );
+    assert_eq!(run(&main), Ok(Value::Bool(true)));
+}
+
+#[test]
+fn import_errors() {
+    let main = project("missing", &[("main.drgns", "import nowhere")]);
+    assert_eq!(run(&main), Err("cannot find module 'nowhere'".to_string()));
+
+    let main = project(
+        "cycle",
+        &[
+            ("main.drgns", "import a"),
+            ("a.drgns", "import b"),
+            ("b.drgns", "import a"),
+        ],
+    );
+    assert_eq!(
+        run(&main).map_err(|e| e.starts_with("import cycle: ") && e.ends_with("a.drgns")),
+        Err(true)
+    );
+
+    let main = project(
+        "private",
+        &[
+            ("main.drgns", "import a\na::_secret"),
+            ("a.drgns", "_secret := 1"),
+        ],
+    );
+    assert_eq!(
+        run(&main),
+        Err("module 'a' has no export '_secret'".to_string())
+    );
+
+    let main = project("not_a_module", &[("main.drgns", "x := 1\nx::y")]);
+    assert_eq!(run(&main), Err("int is not a module".to_string()));
+}
+
+#[test]
+fn import_files_saved_on_windows() {
+    let main = project(
+        "windows",
+        &[
+            ("main.drgns", "\u{FEFF}import a\r\na::x + 1\r\n"),
+            ("a.drgns", "\u{FEFF}// the answer\r\nx := 41\r\n"),
+        ],
+    );
+    assert_eq!(run(&main), Ok(Value::Int(42)));
+
+    let main = project("latin1", &[("main.drgns", "import a"), ("a.drgns", "")]);
+    let module = main.with_file_name("a.drgns");
+    fs::write(&module, b"x := \"caf\xe9\"").expect("temporary file can be written");
+    let error = run(&main).expect_err("the module is not UTF-8");
+    assert!(
+        error.ends_with("it is not valid UTF-8, byte 9 (on line 1) is 0xe9"),
+        "{}",
+        error
+    );
+}
+
+fn source(text: &str) -> Arc<Source> {
+    Arc::new(Source::new(
+        Some("module.drgns".to_string()),
+        text.to_string(),
+    ))
+}
+
+#[test]
+fn cache_encodes_all_of_the_bytecode() {
+    let src = source(
+        "import lib::helpers
+struct Point {
+    x, y
+    function sum(self) -> { self.x + self.y }
+}
+function first(v) -> {
+    match v {
+        [a, ..rest] -> a
+        {\"key\": ^symbol} -> 1.5
+        _ -> none
+    }
+}
+function counter() -> {
+    c := 0
+    mut n := 0
+    inc := () -> { n += 1 }
+    c = 2
+}",
+    );
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty());
+    let script = compile(&program);
+    let bytes = cache::encode(&script, &src).expect("the bytecode of a module can be cached");
+    let decoded = cache::decode(&bytes, &src).expect("the bytecode was encoded");
+    assert_eq!(decoded.disassemble(), script.disassemble());
+
+    // files cut short or changed are compiled again
+    assert!(cache::decode(&bytes[..bytes.len() - 1], &src).is_none());
+    let mut changed = bytes.clone();
+    changed[bytes.len() / 2] ^= 1;
+    assert!(cache::decode(&changed, &src).is_none());
+}
+
+#[test]
+fn cache_keys_are_the_same_on_every_build() {
+    // the FNV-1a of the specification
+    assert_eq!(cache::fnv(b""), 0xcbf29ce484222325);
+    assert_eq!(cache::fnv(b"foobar"), 0x85944171f73967e8);
+    assert_eq!(
+        cache::key("0.1.0", "x := 1\n", OptLevel::Basic),
+        0x50c1ffd32e6454e2
+    );
+    assert_ne!(
+        cache::key("0.1.0", "x := 1\n", OptLevel::None),
+        cache::key("0.1.0", "x := 1\n", OptLevel::Basic)
+    );
+}
+
+#[test]
+fn cache_loads_modules_compiled_before() {
+    let dir = test_utils::directory("modules", "cache");
+    let src = source("x := 1 + 2\nfunction f() -> { x }");
+    let script = cache::compile(&src, Some(&dir)).expect("the module compiles");
+    let files: Vec<PathBuf> = fs::read_dir(&dir)
+        .expect("the cache directory was made")
+        .map(|e| e.expect("the directory can be read").path())
+        .collect();
+    assert_eq!(files.len(), 1);
+    assert_eq!(files[0].extension(), Some(cache::EXTENSION.as_ref()));
+
+    // what the file holds is run, rather than compiling the module
+    let other = source("y := 4");
+    let (program, _) = parse(&other);
+    let bytes = cache::encode(&compile(&program), &other).expect("it can be cached");
+    fs::write(&files[0], bytes).expect("the file can be written");
+    let loaded = cache::compile(&src, Some(&dir)).expect("the module compiles");
+    assert_eq!(loaded.disassemble(), compile(&program).disassemble());
+
+    fs::write(&files[0], "not bytecode").expect("the file can be written");
+    let compiled = cache::compile(&src, Some(&dir)).expect("the module compiles");
+    assert_eq!(compiled.disassemble(), script.disassemble());
+    let bytes = fs::read(&files[0]).expect("the file was written again");
+    assert!(cache::decode(&bytes, &src).is_some());
+
+    assert_eq!(cache::clear(&dir).expect("the cache can be cleared"), 1);
+    assert_eq!(
+        fs::read_dir(&dir).expect("the directory is kept").count(),
+        0
+    );
+    let _ = fs::remove_dir_all(&dir);
+}
+
+#[test]
+fn bundles_run_without_their_sources() {
+    let main = project(
+        "bundle",
+        &[
+            ("main.drgns", "import lib::math\nmath::square(math::base)"),
+            (
+                "lib/math.drgns",
+                "import helpers\nbase := helpers::three()\nfunction square(x) -> { x * x }",
+            ),
+            ("lib/helpers.drgns", "function three() -> { 3 }"),
+        ],
+    );
+    let bytes = bundle::build(&main).expect("the program builds");
+    assert!(bundle::is_bundle(&bytes));
+    let dir = main.parent().expect("the program is in the directory");
+    fs::remove_dir_all(dir).expect("the sources can be removed");
+
+    let bundle = Bundle::decode(&bytes).expect("the bundle is read back");
+    assert_eq!(
+        Vm::new().run_bundle(Arc::new(bundle)).ok(),
+        Some(Value::Int(9))
+    );
+    assert!(Bundle::decode(&bytes[..bytes.len() - 1]).is_none());
+    assert!(Bundle::decode(b"x := 1").is_none());
+}
+
+#[test]
+fn bundles_keep_where_errors_are() {
+    let main = project(
+        "bundle-errors",
+        &[
+            ("main.drgns", "import failing\n\nfailing::f()"),
+            ("failing.drgns", "function f() -> {\n  1 + \"one\"\n}"),
+        ],
+    );
+    let bundle = Bundle::decode(&bundle::build(&main).expect("the program builds"))
+        .expect("the bundle is read back");
+    let Err(Halt::Error(e)) = Vm::new().run_bundle(Arc::new(bundle)) else {
+        panic!("the bundle fails");
+    };
+    let span = e.span().expect("the error has a location");
+    assert_eq!(span.source().name(), "failing.drgns");
+    assert_eq!(span.position().line, 2);
+    assert_eq!(span.position().column, 3);
+
+    let main = project("bundle-missing", &[("main.drgns", "import nowhere")]);
+    let Err(Halt::Error(e)) = bundle::build(&main) else {
+        panic!("the import is missing");
+    };
+    assert_eq!(e.message(), "cannot find module 'nowhere'");
+    let _ = fs::remove_dir_all(main.parent().expect("the program is in the directory"));
+}
+
+#[test]
+fn standalone_binaries_carry_their_bundle() {
+    let main = project("standalone", &[("main.drgns", "1 + 2")]);
+    let bytes = bundle::build(&main).expect("the program builds");
+    let binary = main.with_extension("");
+    let none = b"the binary of drgns".to_vec();
+    fs::write(&binary, &none).expect("the binary can be written");
+    assert_eq!(bundle::embedded(&binary).ok(), Some(None));
+
+    // building from a binary carrying a bundle replaces it
+    let carrying = bundle::standalone(&none, b"an older bundle");
+    let standalone = bundle::standalone(&carrying, &bytes);
+    assert_eq!(standalone, bundle::standalone(&none, &bytes));
+    fs::write(&binary, standalone).expect("the binary can be written");
+    let embedded = bundle::embedded(&binary).expect("the binary can be read");
+    assert_eq!(embedded.as_ref(), Some(&bytes));
+    let bundle = Bundle::decode(&bytes).expect("the bundle is read back");
+    assert_eq!(
+        Vm::new().run_bundle(Arc::new(bundle)).ok(),
+        Some(Value::Int(3))
+    );
+    let _ = fs::remove_dir_all(main.parent().expect("the program is in the directory"));
+}
+
+#[test]
+fn imports_find_packages_in_enclosing_directories() {
+    let main = project(
+        "packages",
+        &[
+            (
+                "src/main.drgns",
+                "import json\nimport json::parse\n\"${json::name}${parse::run()}\"",
+            ),
+            ("drgn.toml", "[dependencies]\njson = \"1\""),
+            (
+                ".drgns/packages/json/lib.drgns",
+                "import helpers\nname := helpers::name",
+            ),
+            (".drgns/packages/json/helpers.drgns", "name := \"json \""),
+            (
+                ".drgns/packages/json/parse.drgns",
+                "function run() -> { \"parsed\" }",
+            ),
+        ],
+    );
+    assert_eq!(run(&main), Ok(Value::from("json parsed")));
+
+    // the packages are in the bundle too, relative to the root of the project
+    let bundle = Bundle::decode(&bundle::build(&main).expect("the program builds"))
+        .expect("the bundle is read back");
+    let lib = PathBuf::from(".drgns/packages/json/lib.drgns");
+    assert!(bundle.source(&lib).is_some());
+    let ran = Vm::new().run_bundle(Arc::new(bundle));
+    assert_eq!(ran.ok(), Some(Value::from("json parsed")));
+    let _ = fs::remove_dir_all(
+        main.parent()
+            .and_then(|d| d.parent())
+            .expect("in the project"),
+    );
+}
+
+#[test]
+fn imported_files() {
+    let main = project(
+        "imported",
+        &[
+            (
+                "main.drgns",
+                "import lib::a\nfunction f() -> {\n  import lib::missing\n}",
+            ),
+            ("lib/a.drgns", "import b"),
+            ("lib/b.drgns", "import a"),
+        ],
+    );
+    let dir = main.parent().expect("in the project").to_path_buf();
+    let files: Vec<PathBuf> = ["lib/a", "lib/b", "lib/missing", "main"]
+        .iter()
+        .map(|f| dir.join(f).with_extension("drgns"))
+        .collect();
+    let mut imported = super::imported(&main);
+    imported.sort();
+    assert_eq!(imported, files);
+    let _ = fs::remove_dir_all(dir);
+}
@@ -0,0 +1,379 @@
+//! Packages, the dependencies of a project declared in its `drgn.toml`.
+//!
+//! `drgns pkg install` clones each dependency, and the ones they declare in
+//! turn, from its git repository into `.drgns/packages/<name>` next to the
+//! manifest, at the newest tag matching its version requirement. The commits
+//! are written to `drgn.lock` and installing again checks out the same ones,
+//! unless the manifest no longer allows them or `drgns pkg update` is asked
+//! for.
+//!
+//! An import that finds no file relative to the importing one looks in the
+//! packages of the enclosing directories: `import json` loads `lib.drgns` of
+//! the package `json`, and `import json::parser` loads its `parser.drgns`.
+
+use std::{
+    collections::VecDeque,
+    fs,
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use indexmap::IndexMap;
+
+use crate::{
+    eh::{DragonError, ErrorCode},
+    modules::EXTENSION,
+};
+
+pub mod lock;
+pub mod manifest;
+#[cfg(test)]
+mod test;
+pub(crate) mod toml;
+pub mod version;
+
+pub use lock::{Lock, Locked};
+pub use manifest::{Dependency, Manifest};
+pub use version::{Requirement, Version};
+
+pub const MANIFEST: &str = "drgn.toml";
+pub const LOCKFILE: &str = "drgn.lock";
+
+/// where the packages of a project are installed, relative to its manifest
+pub const DIRECTORY: &str = ".drgns/packages";
+
+/// the module of a package that importing its name loads
+pub const ENTRY: &str = "lib";
+
+/// where dependencies given only by a version are found, unless the
+/// environment variable `DRGNS_REGISTRY` or the manifest gives another
+pub const REGISTRY: &str = "https://github.com/drgns-packages";
+pub const DRGNS_REGISTRY: &str = "DRGNS_REGISTRY";
+
+/// Which of the packages locked are updated
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Update {
+    None,
+    All,
+    Only(Vec<String>),
+}
+
+impl Update {
+    fn covers(&self, name: &str) -> bool {
+        match self {
+            Update::None => false,
+            Update::All => true,
+            Update::Only(names) => names.iter().any(|n| n == name),
+        }
+    }
+}
+
+/// The root of the project the directory is in, the closest one with a
+/// manifest
+pub fn project(dir: &Path) -> Option<PathBuf> {
+    dir.ancestors()
+        .find(|d| d.join(MANIFEST).is_file())
+        .map(Path::to_path_buf)
+}
+
+/// The file of a package an import refers to, looking for the package in
+/// the directory of the importing file and then in the enclosing ones, as
+/// far up as `base` goes. `exists` tells whether there is a module at a path.
+pub fn resolve(base: &Path, path: &[&str], exists: impl Fn(&Path) -> bool) -> Option<PathBuf> {
+    let (name, rest) = path.split_first()?;
+    base.ancestors().find_map(|dir| {
+        let mut file = dir.join(DIRECTORY).join(name);
+        match rest {
+            [] => file.push(ENTRY),
+            rest => file.extend(rest),
+        }
+        file.set_extension(EXTENSION);
+        exists(&file).then_some(file)
+    })
+}
+
+/// Whether the package is a dependency of the project, though it isn't
+/// installed
+pub fn is_declared(root: &Path, name: &str) -> bool {
+    let text = fs::read_to_string(root.join(MANIFEST)).unwrap_or_default();
+    Manifest::parse(&text).is_ok_and(|m| m.dependencies.contains_key(name))
+}
+
+/// Add a dependency to the manifest of the project, creating the manifest if
+/// there is none, and install the packages. Without a version requirement,
+/// the one of the newest version is written, unless the repository has none.
+pub fn add(
+    root: &Path,
+    name: &str,
+    git: Option<String>,
+    version: Option<Requirement>,
+) -> Result<Vec<Locked>, DragonError> {
+    if !manifest::is_name(name) {
+        let msg = format!("'{}' cannot be imported, it is not a name", name);
+        return Err(error(msg));
+    }
+    let path = root.join(MANIFEST);
+    let before = match fs::read_to_string(&path) {
+        Ok(text) => Some(text),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+        Err(e) => return Err(io(&path, e)),
+    };
+    let text = before.clone().unwrap_or_else(|| {
+        let name = root.file_name().unwrap_or_default().to_string_lossy();
+        format!(
+            "[package]\nname = {}\nversion = \"0.1.0\"\n",
+            toml::quote(&name)
+        )
+    });
+    let manifest = Manifest::parse(&text).map_err(|e| invalid(&path, e))?;
+    let mut dependency = Dependency { git, version };
+    if dependency.version.is_none() {
+        let origin = manifest.origin(name, &dependency);
+        let newest = tags(&origin)?.into_iter().map(|(v, _)| v).max();
+        dependency.version = newest.map(Requirement::compatible);
+        if dependency.version.is_none() && dependency.git.is_none() {
+            return Err(error(format!("'{}' has no version in the registry", name)));
+        }
+    }
+    let text = manifest::add(&text, name, &dependency);
+    fs::write(&path, text).map_err(|e| io(&path, e))?;
+    let installed = install(root, &Update::Only(vec![name.to_owned()]));
+    if installed.is_err() {
+        // the manifest is left as it was, rather than with a dependency that
+        // cannot be installed
+        let _ = match before {
+            Some(text) => fs::write(&path, text),
+            None => fs::remove_file(&path),
+        };
+    }
+    installed
+}
+
+/// Install the dependencies of the project and theirs, at the commits of the
+/// lockfile unless they are updated, and write the lockfile. Packages no
+/// longer needed are removed. Returns the packages installed.
+pub fn install(root: &Path, update: &Update) -> Result<Vec<Locked>, DragonError> {
+    let path = root.join(MANIFEST);
+    let text = fs::read_to_string(&path).map_err(|e| io(&path, e))?;
+    let manifest = Manifest::parse(&text).map_err(|e| invalid(&path, e))?;
+    let lockfile = root.join(LOCKFILE);
+    let lock = match fs::read_to_string(&lockfile) {
+        Ok(text) => Lock::parse(&text).map_err(|e| invalid(&lockfile, e))?,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Lock::default(),
+        Err(e) => return Err(io(&lockfile, e)),
+    };
+    if let Update::Only(names) = update {
+        let known =
+            |n: &String| manifest.dependencies.contains_key(n) || lock.packages.contains_key(n);
+        if let Some(name) = names.iter().find(|n| !known(n)) {
+            return Err(error(format!(
+                "'{}' is not a dependency of the project",
+                name
+            )));
+        }
+    }
+
+    let packages = root.join(DIRECTORY);
+    // each package, with the one requiring it first
+    let mut installed: IndexMap<String, (Locked, String)> = IndexMap::new();
+    let by = manifest.name.clone().unwrap_or_else(|| MANIFEST.to_owned());
+    let mut pending: VecDeque<_> = manifest
+        .dependencies
+        .iter()
+        .map(|(n, d)| (n.clone(), d.clone(), manifest.origin(n, d), by.clone()))
+        .collect();
+    while let Some((name, dependency, origin, by)) = pending.pop_front() {
+        let allows = |l: &Locked| match (&dependency.version, l.version) {
+            (None, _) => true,
+            (Some(requirement), Some(version)) => requirement.matches(&version),
+            (Some(_), None) => false,
+        };
+        if let Some((locked, first)) = installed.get(&name) {
+            if locked.git != origin {
+                let msg = format!(
+                    "'{}' comes from '{}' for '{}' and from '{}' for '{}'",
+                    name, locked.git, first, origin, by
+                );
+                return Err(error(msg));
+            }
+            if !allows(locked) {
+                let msg = format!(
+                    "'{}' requires {} {}, but {} {} is installed for '{}'",
+                    by,
+                    name,
+                    dependency
+                        .version
+                        .as_ref()
+                        .map_or("*".to_owned(), |r| r.to_string()),
+                    name,
+                    described(locked),
+                    first
+                );
+                return Err(error(msg));
+            }
+            continue;
+        }
+        let kept = lock
+            .packages
+            .get(&name)
+            .filter(|l| l.git == origin && allows(l) && !update.covers(&name));
+        let locked = match kept {
+            Some(locked) => locked.clone(),
+            None => newest(&name, &origin, dependency.version.as_ref())?,
+        };
+        let dir = packages.join(&name);
+        checkout(&dir, &locked)?;
+
+        if let Ok(text) = fs::read_to_string(dir.join(MANIFEST)) {
+            let theirs = Manifest::parse(&text).map_err(|e| invalid(&dir.join(MANIFEST), e))?;
+            for (n, d) in &theirs.dependencies {
+                pending.push_back((n.clone(), d.clone(), theirs.origin(n, d), name.clone()));
+            }
+        }
+        installed.insert(name, (locked, by));
+    }
+
+    let lock = Lock {
+        packages: installed
+            .into_iter()
+            .map(|(name, (locked, _))| (name, locked))
+            .collect(),
+    };
+    fs::write(&lockfile, lock.to_string()).map_err(|e| io(&lockfile, e))?;
+    if let Ok(entries) = fs::read_dir(&packages) {
+        for entry in entries.flatten() {
+            let name = entry.file_name().to_string_lossy().into_owned();
+            if !lock.packages.contains_key(&name) && entry.path().is_dir() {
+                fs::remove_dir_all(entry.path()).map_err(|e| io(&entry.path(), e))?;
+            }
+        }
+    }
+    Ok(lock.packages.into_values().collect())
+}
+
+/// the version of a package installed, or the commit if it has none
+pub fn described(locked: &Locked) -> String {
+    match locked.version {
+        Some(version) => version.to_string(),
+        None => locked.commit.chars().take(7).collect(),
+    }
+}
+
+/// the newest version of the package the requirement allows, or the latest
+/// commit of the default branch without one
+fn newest(
+    name: &str,
+    origin: &str,
+    requirement: Option<&Requirement>,
+) -> Result<Locked, DragonError> {
+    let Some(requirement) = requirement else {
+        let head = git(&["ls-remote", origin, "HEAD"], None)?;
+        let Some(commit) = head.split_whitespace().next() else {
+            return Err(error(format!("'{}' has no commits", origin)));
+        };
+        return Ok(Locked {
+            name: name.to_owned(),
+            git: origin.to_owned(),
+            version: None,
+            commit: commit.to_owned(),
+        });
+    };
+    let tags = tags(origin)?;
+    let Some((version, commit)) = tags
+        .into_iter()
+        .filter(|(v, _)| requirement.matches(v))
+        .max()
+    else {
+        return Err(error(format!(
+            "no version of '{}' matches {}, in '{}'",
+            name, requirement, origin
+        )));
+    };
+    Ok(Locked {
+        name: name.to_owned(),
+        git: origin.to_owned(),
+        version: Some(version),
+        commit,
+    })
+}
+
+/// the versions the tags of the repository name, with their commits
+fn tags(origin: &str) -> Result<Vec<(Version, String)>, DragonError> {
+    let listed = git(&["ls-remote", "--tags", origin], None)?;
+    let mut tags: IndexMap<Version, String> = IndexMap::new();
+    for line in listed.lines() {
+        let Some((commit, tag)) = line.split_once('\t') else {
+            continue;
+        };
+        let tag = tag.trim_start_matches("refs/tags/");
+        // annotated tags are listed again with `^{}`, for their commit
+        let (tag, peeled) = match tag.strip_suffix("^{}") {
+            Some(tag) => (tag, true),
+            None => (tag, false),
+        };
+        if let Some(version) = Version::parse(tag) {
+            if peeled || !tags.contains_key(&version) {
+                tags.insert(version, commit.to_owned());
+            }
+        }
+    }
+    Ok(tags.into_iter().collect())
+}
+
+/// clone the package into the directory at its commit, unless it already is
+fn checkout(dir: &Path, locked: &Locked) -> Result<(), DragonError> {
+    let cloned = dir.join(".git").exists();
+    if cloned && git(&["rev-parse", "HEAD"], Some(dir)).is_ok_and(|h| h.trim() == locked.commit) {
+        return Ok(());
+    }
+    if cloned {
+        git(&["fetch", "--quiet", "--tags", &locked.git], Some(dir))?;
+    } else {
+        if dir.exists() {
+            fs::remove_dir_all(dir).map_err(|e| io(dir, e))?;
+        }
+        let parent = dir.parent().unwrap_or(dir);
+        fs::create_dir_all(parent).map_err(|e| io(parent, e))?;
+        let path = dir.to_string_lossy();
+        git(
+            &["clone", "--quiet", "--no-checkout", &locked.git, &path],
+            None,
+        )?;
+    }
+    git(
+        &["checkout", "--quiet", "--detach", &locked.commit],
+        Some(dir),
+    )?;
+    Ok(())
+}
+
+/// run git, in the directory if there is one, returns what it prints
+fn git(args: &[&str], dir: Option<&Path>) -> Result<String, DragonError> {
+    let mut command = Command::new("git");
+    if let Some(dir) = dir {
+        command.current_dir(dir);
+    }
+    // a repository asking for credentials fails rather than waiting for them
+    command.args(args).env("GIT_TERMINAL_PROMPT", "0");
+    let output = command
+        .output()
+        .map_err(|e| error(format!("cannot run git: {}", e)))?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        return Err(error(format!("git {} failed: {}", args[0], stderr.trim())));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+fn error(msg: String) -> DragonError {
+    DragonError::new(ErrorCode::Package, msg, None)
+}
+
+fn invalid(path: &Path, msg: String) -> DragonError {
+    error(format!("'{}' is invalid, {}", path.display(), msg))
+}
+
+fn io(path: &Path, e: std::io::Error) -> DragonError {
+    let msg = format!("cannot access '{}': {}", path.display(), e);
+    DragonError::new(ErrorCode::Io, msg, None)
+}
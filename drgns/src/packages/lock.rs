@@ -0,0 +1,76 @@
+//! `drgn.lock`, the commit of each package installed, so that installing
+//! again gets the same code until the dependencies are updated.
+
+use std::fmt::Display;
+
+use indexmap::IndexMap;
+
+use super::{
+    toml::{self, Value},
+    version::Version,
+};
+
+/// A package as it was installed
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Locked {
+    pub name: String,
+    pub git: String,
+
+    /// the one of the tag of the commit, `None` if it follows a branch
+    pub version: Option<Version>,
+    pub commit: String,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Default)]
+pub struct Lock {
+    pub packages: IndexMap<String, Locked>,
+}
+
+impl Lock {
+    pub fn parse(text: &str) -> Result<Self, String> {
+        let mut packages = IndexMap::new();
+        for section in toml::parse(text)? {
+            if section.name.is_empty() && section.entries.is_empty() {
+                continue;
+            }
+            let get = |key: &str| {
+                section.entries.iter().find_map(|(k, v)| match v {
+                    Value::String(s) if k == key => Some(s.clone()),
+                    _ => None,
+                })
+            };
+            let missing = |key| format!("the package '{}' has no `{}`", section.name, key);
+            let version = match get("version") {
+                Some(v) => {
+                    Some(Version::parse(&v).ok_or_else(|| format!("'{}' is not a version", v))?)
+                }
+                None => None,
+            };
+            let locked = Locked {
+                name: section.name.clone(),
+                git: get("git").ok_or_else(|| missing("git"))?,
+                version,
+                commit: get("commit").ok_or_else(|| missing("commit"))?,
+            };
+            packages.insert(section.name, locked);
+        }
+        Ok(Self { packages })
+    }
+}
+
+impl Display for Lock {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(f, "# Written by `drgns pkg`, not meant to be edited.")?;
+        let mut packages: Vec<&Locked> = self.packages.values().collect();
+        packages.sort_by(|a, b| a.name.cmp(&b.name));
+        for p in packages {
+            writeln!(f, "\n[{}]", p.name)?;
+            writeln!(f, "git = {}", toml::quote(&p.git))?;
+            if let Some(version) = p.version {
+                writeln!(f, "version = {}", toml::quote(&version.to_string()))?;
+            }
+            writeln!(f, "commit = {}", toml::quote(&p.commit))?;
+        }
+        Ok(())
+    }
+}
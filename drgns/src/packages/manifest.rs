@@ -0,0 +1,201 @@
+//! `drgn.toml`, the manifest declaring a project and its dependencies:
+//!
+//! ```toml
+//! [package]
+//! name = "app"
+//! version = "0.1.0"
+//!
+//! [dependencies]
+//! colors = "1.2"
+//! json = { git = "https://example.com/json.git", version = "0.3" }
+//! ```
+//!
+//! A dependency given only by a version comes from the registry, see
+//! `Manifest::origin`. One from git without a version follows the default
+//! branch of the repository.
+
+use indexmap::IndexMap;
+
+use super::{
+    toml::{self, Value},
+    version::{Requirement, Version},
+    DRGNS_REGISTRY, REGISTRY,
+};
+
+#[derive(Debug, Clone, PartialEq, Eq, Default)]
+pub struct Manifest {
+    pub name: Option<String>,
+    pub version: Option<Version>,
+
+    /// where the dependencies without `git` are found, see `origin`
+    pub registry: Option<String>,
+    pub dependencies: IndexMap<String, Dependency>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Dependency {
+    pub git: Option<String>,
+
+    /// `None` for the latest commit of the default branch
+    pub version: Option<Requirement>,
+}
+
+impl Manifest {
+    pub fn parse(text: &str) -> Result<Self, String> {
+        let mut manifest = Self::default();
+        for section in toml::parse(text)? {
+            match section.name.as_str() {
+                "package" => {
+                    for (key, value) in section.entries {
+                        let value = match value {
+                            Value::String(s) => s,
+                            _ => return Err(format!("`{}` must be a string", key)),
+                        };
+                        match key.as_str() {
+                            "name" => manifest.name = Some(value),
+                            "version" => {
+                                let version = Version::parse(&value)
+                                    .ok_or_else(|| format!("'{}' is not a version", value))?;
+                                manifest.version = Some(version);
+                            }
+                            "registry" => manifest.registry = Some(value),
+                            // such as a description, which drgns has no use for
+                            _ => {}
+                        }
+                    }
+                }
+                "dependencies" => {
+                    for (name, value) in section.entries {
+                        let dependency = dependency(&name, value)?;
+                        manifest.dependencies.insert(name, dependency);
+                    }
+                }
+                "" if section.entries.is_empty() => {}
+                "" => return Err("keys must be in a section, such as `[package]`".to_owned()),
+                _ => {}
+            }
+        }
+        Ok(manifest)
+    }
+
+    /// The repository the dependency is cloned from, the registry is a URL
+    /// under which each package is a repository named after it. It is the
+    /// one of the manifest, or else the one of `DRGNS_REGISTRY` or
+    /// `REGISTRY`.
+    pub fn origin(&self, name: &str, dependency: &Dependency) -> String {
+        if let Some(git) = &dependency.git {
+            return git.clone();
+        }
+        let registry = match &self.registry {
+            Some(registry) => registry.clone(),
+            None => std::env::var(DRGNS_REGISTRY).unwrap_or_else(|_| REGISTRY.to_owned()),
+        };
+        format!("{}/{}", registry.trim_end_matches('/'), name)
+    }
+}
+
+/// whether a package can be named so, as each is imported by its name
+pub fn is_name(name: &str) -> bool {
+    let mut chars = name.chars();
+    chars.next().is_some_and(|c| c.is_alphabetic() || c == '_')
+        && chars.all(|c| c.is_alphanumeric() || c == '_')
+}
+
+fn dependency(name: &str, value: Value) -> Result<Dependency, String> {
+    if !is_name(name) {
+        return Err(format!("'{}' cannot be imported, it is not a name", name));
+    }
+    let requirement = |text: &str| {
+        Requirement::parse(text)
+            .ok_or_else(|| format!("'{}' is not a version requirement of '{}'", text, name))
+    };
+    let entries = match value {
+        Value::String(text) => {
+            return Ok(Dependency {
+                git: None,
+                version: Some(requirement(&text)?),
+            })
+        }
+        Value::Table(entries) => entries,
+        Value::Integer(_) => {
+            return Err(format!(
+                "the dependency '{}' must be a version requirement or a table",
+                name
+            ))
+        }
+    };
+    let mut dependency = Dependency {
+        git: None,
+        version: None,
+    };
+    for (key, value) in entries {
+        match key.as_str() {
+            "git" => dependency.git = Some(value),
+            "version" => dependency.version = Some(requirement(&value)?),
+            _ => {
+                return Err(format!(
+                    "unknown key `{}` in the dependency '{}'",
+                    key, name
+                ))
+            }
+        }
+    }
+    if dependency.git.is_none() && dependency.version.is_none() {
+        return Err(format!(
+            "the dependency '{}' needs a `git` or a `version`",
+            name
+        ));
+    }
+    Ok(dependency)
+}
+
+/// The text of a manifest with the dependency set, as `drgns pkg add` does,
+/// the rest of the text is kept as it is
+pub fn add(text: &str, name: &str, dependency: &Dependency) -> String {
+    let value = match (&dependency.git, &dependency.version) {
+        (None, Some(version)) => toml::quote(&version.to_string()),
+        (git, version) => {
+            let git = git.iter().map(|g| format!("git = {}", toml::quote(g)));
+            let version = version
+                .iter()
+                .map(|v| format!("version = {}", toml::quote(&v.to_string())));
+            format!(
+                "{{ {} }}",
+                git.chain(version).collect::<Vec<_>>().join(", ")
+            )
+        }
+    };
+    let line = format!("{} = {}", name, value);
+
+    let mut lines: Vec<String> = text.lines().map(str::to_owned).collect();
+    let header = |l: &str| l.trim_start().starts_with('[');
+    let Some(start) = lines.iter().position(|l| l.trim() == "[dependencies]") else {
+        if lines.last().is_some_and(|l| !l.trim().is_empty()) {
+            lines.push(String::new());
+        }
+        lines.extend(["[dependencies]".to_owned(), line]);
+        return lines.join("\n") + "\n";
+    };
+    let end = lines[start + 1..]
+        .iter()
+        .position(|l| header(l))
+        .map_or(lines.len(), |i| start + 1 + i);
+    let key = |l: &str| {
+        toml::parse(l)
+            .ok()
+            .and_then(|s| Some(s.first()?.entries.first()?.0.clone()))
+    };
+    match (start + 1..end).find(|&i| key(&lines[i]).as_deref() == Some(name)) {
+        Some(i) => lines[i] = line,
+        None => {
+            // after the last dependency, before the blank lines ending the
+            // section
+            let last = (start..end)
+                .rev()
+                .find(|&i| !lines[i].trim().is_empty())
+                .unwrap_or(start);
+            lines.insert(last + 1, line);
+        }
+    }
+    lines.join("\n") + "\n"
+}
@@ -0,0 +1,276 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use super::{manifest, *};
+use crate::test_utils;
+
+fn git(dir: &Path, args: &[&str]) {
+    let status = Command::new("git")
+        .args([
+            "-c",
+            "user.name=drgns",
+            "-c",
+            "user.email=drgns@example.com",
+        ])
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .expect("git runs");
+    assert!(status.status.success(), "git {:?} failed", args);
+}
+
+/// a repository with a commit tagged with each version in turn, setting
+/// `version` to it
+fn repository(dir: &Path, versions: &[&str]) -> String {
+    fs::create_dir_all(dir).expect("the repository can be created");
+    git(dir, &["init", "--quiet"]);
+    for v in versions {
+        fs::write(dir.join("lib.drgns"), format!("version := \"{}\"", v))
+            .expect("the file can be written");
+        git(dir, &["add", "."]);
+        git(dir, &["commit", "--quiet", "-m", v]);
+        git(dir, &["tag", v]);
+    }
+    dir.display().to_string()
+}
+
+#[test]
+fn requirements() {
+    let v = |s: &str| Version::parse(s).expect("a version");
+    let allows = |r: &str, versions: &[&str]| {
+        let r = Requirement::parse(r).expect("a requirement");
+        versions
+            .iter()
+            .map(|s| r.matches(&v(s)))
+            .collect::<Vec<_>>()
+    };
+    let versions = ["1.1.9", "1.2.0", "1.2.7", "1.9.0", "2.0.0"];
+    assert_eq!(allows("1.2", &versions), [false, true, true, true, false]);
+    assert_eq!(
+        allows("^1.2.3", &versions),
+        [false, false, true, true, false]
+    );
+    assert_eq!(allows("~1.2", &versions), [false, true, true, false, false]);
+    assert_eq!(
+        allows("=1.2.7", &versions),
+        [false, false, true, false, false]
+    );
+    assert_eq!(allows("*", &versions), [true; 5]);
+    let versions = ["0.2.9", "0.3.0", "0.3.4", "0.4.0"];
+    assert_eq!(allows("0.3", &versions), [false, true, true, false]);
+    assert_eq!(allows("0.0.3", &["0.0.3", "0.0.4"]), [true, false]);
+
+    assert_eq!(v("v1.2.3"), Version::new(1, 2, 3));
+    assert_eq!(Version::parse("1.2"), None);
+    assert_eq!(Requirement::parse("1.x"), None);
+    assert_eq!(
+        Requirement::parse("~1.2").map(|r| r.to_string()).as_deref(),
+        Some("~1.2")
+    );
+}
+
+#[test]
+fn manifests() {
+    let text = "[package]\nname = \"app\" # the name\nversion = \"0.1.0\"\n\n[dependencies]\n\
+                colors = \"1.2\"\njson = { git = \"https://x.org/json\", version = \"~0.3\" }\n";
+    let m = Manifest::parse(text).expect("the manifest is valid");
+    assert_eq!(m.name.as_deref(), Some("app"));
+    assert_eq!(m.version, Some(Version::new(0, 1, 0)));
+    let names: Vec<&String> = m.dependencies.keys().collect();
+    assert_eq!(names, ["colors", "json"]);
+    let json = &m.dependencies["json"];
+    assert_eq!(m.origin("json", json), "https://x.org/json");
+    let colors = &m.dependencies["colors"];
+    assert_eq!(m.origin("colors", colors), format!("{}/colors", REGISTRY));
+
+    let fails = |text: &str| Manifest::parse(text).expect_err(text);
+    assert_eq!(
+        fails("name = \"app\""),
+        "keys must be in a section, such as `[package]`"
+    );
+    assert_eq!(
+        fails("[package]\nname = \"app"),
+        "line 2: the string is not closed"
+    );
+    assert_eq!(
+        fails("[dependencies]\njson = { got = \"x\" }"),
+        "unknown key `got` in the dependency 'json'"
+    );
+    assert_eq!(
+        fails("[dependencies]\njson = \"one\""),
+        "'one' is not a version requirement of 'json'"
+    );
+    assert_eq!(fails("[package]\nname = 1"), "`name` must be a string");
+    assert_eq!(
+        fails("[dependencies]\njson = 1"),
+        "the dependency 'json' must be a version requirement or a table"
+    );
+    assert_eq!(
+        fails("[dependencies]\na-b = \"1\""),
+        "'a-b' cannot be imported, it is not a name"
+    );
+}
+
+#[test]
+fn adding_keeps_the_rest_of_the_manifest() {
+    let text =
+        "[package]\nname = \"app\"\n\n[dependencies]\n# colors\ncolors = \"1.2\"\n\n[other]\n";
+    let json = Dependency {
+        git: Some("https://x.org/json".to_owned()),
+        version: Requirement::parse("0.3"),
+    };
+    let added = manifest::add(text, "json", &json);
+    assert_eq!(
+        added,
+        "[package]\nname = \"app\"\n\n[dependencies]\n# colors\ncolors = \"1.2\"\n\
+         json = { git = \"https://x.org/json\", version = \"0.3\" }\n\n[other]\n"
+    );
+    let colors = Dependency {
+        git: None,
+        version: Requirement::parse("2"),
+    };
+    let replaced = manifest::add(&added, "colors", &colors);
+    assert!(replaced.contains("# colors\ncolors = \"2\"\njson"));
+    let m = Manifest::parse(&replaced).expect("the manifest is valid");
+    assert_eq!(m.dependencies["colors"], colors);
+    assert_eq!(m.dependencies["json"], json);
+
+    let created = manifest::add("[package]\nname = \"app\"", "colors", &colors);
+    assert_eq!(
+        created,
+        "[package]\nname = \"app\"\n\n[dependencies]\ncolors = \"2\"\n"
+    );
+}
+
+#[test]
+fn lockfiles() {
+    let lock = Lock {
+        packages: [("json", Some(Version::new(0, 3, 1))), ("colors", None)]
+            .into_iter()
+            .map(|(name, version)| {
+                let locked = Locked {
+                    name: name.to_owned(),
+                    git: format!("https://x.org/{}", name),
+                    version,
+                    commit: "0123abc".to_owned(),
+                };
+                (name.to_owned(), locked)
+            })
+            .collect(),
+    };
+    let text = lock.to_string();
+    assert!(text.find("[colors]") < text.find("[json]"));
+    let read = Lock::parse(&text).expect("the lockfile is valid");
+    assert_eq!(read.packages["json"], lock.packages["json"]);
+    assert_eq!(read.packages["colors"], lock.packages["colors"]);
+    assert_eq!(
+        Lock::parse("[json]\ngit = \"x\"").expect_err("no commit"),
+        "the package 'json' has no `commit`"
+    );
+}
+
+#[test]
+fn packages_are_found_in_the_enclosing_directories() {
+    let installed = [
+        ".drgns/packages/json/lib.drgns",
+        ".drgns/packages/json/parser.drgns",
+        "src/.drgns/packages/colors/lib.drgns",
+    ];
+    let exists = |p: &Path| installed.iter().any(|i| Path::new(i) == p);
+    let found = |base: &str, path: &[&str]| resolve(Path::new(base), path, exists);
+    let json = Some(PathBuf::from(".drgns/packages/json/lib.drgns"));
+    assert_eq!(found("src/app", &["json"]), json);
+    assert_eq!(
+        found("", &["json", "parser"]),
+        Some(PathBuf::from(".drgns/packages/json/parser.drgns"))
+    );
+    assert_eq!(
+        found("src", &["colors"]),
+        Some(PathBuf::from("src/.drgns/packages/colors/lib.drgns"))
+    );
+    assert_eq!(found("", &["colors"]), None);
+    assert_eq!(found("", &["json", "lexer"]), None);
+}
+
+#[test]
+fn install_locks_the_newest_version_allowed() {
+    let dir = test_utils::directory("packages", "install");
+    let json = repository(&dir.join("json"), &["v0.3.0", "v0.3.2", "v0.4.0"]);
+    let colors = repository(&dir.join("colors"), &["1.0.0"]);
+    let project = dir.join("app");
+    fs::create_dir_all(&project).expect("the project can be created");
+    let text = format!(
+        "[package]\nname = \"app\"\n\n[dependencies]\njson = {{ git = {:?}, version = \"0.3\" }}\n",
+        json
+    );
+    fs::write(project.join(MANIFEST), text).expect("the manifest can be written");
+
+    let installed = install(&project, &Update::None).expect("the packages install");
+    assert_eq!(installed.len(), 1);
+    assert_eq!(installed[0].version, Some(Version::new(0, 3, 2)));
+    let lib = project.join(DIRECTORY).join("json").join("lib.drgns");
+    assert_eq!(
+        fs::read_to_string(&lib).ok().as_deref(),
+        Some("version := \"v0.3.2\"")
+    );
+
+    // a newer version is only taken once updated
+    let json_dir = dir.join("json");
+    fs::write(json_dir.join("lib.drgns"), "version := \"v0.3.5\"").expect("the file is written");
+    git(&json_dir, &["commit", "--quiet", "-am", "v0.3.5"]);
+    git(&json_dir, &["tag", "v0.3.5"]);
+    let installed = install(&project, &Update::None).expect("the packages install");
+    assert_eq!(installed[0].version, Some(Version::new(0, 3, 2)));
+    let installed = install(&project, &Update::All).expect("the packages update");
+    assert_eq!(installed[0].version, Some(Version::new(0, 3, 5)));
+    assert_eq!(
+        fs::read_to_string(&lib).ok().as_deref(),
+        Some("version := \"v0.3.5\"")
+    );
+    let lock = fs::read_to_string(project.join(LOCKFILE)).expect("the lockfile is written");
+    assert!(lock.contains("version = \"0.3.5\""));
+
+    // the dependencies of the packages are installed too
+    let manifest = format!("[dependencies]\ncolors = {{ git = {:?} }}\n", colors);
+    fs::write(json_dir.join(MANIFEST), manifest).expect("the manifest can be written");
+    fs::write(json_dir.join("lib.drgns"), "version := \"v0.3.6\"").expect("the file is written");
+    git(&json_dir, &["add", "."]);
+    git(&json_dir, &["commit", "--quiet", "-m", "v0.3.6"]);
+    git(&json_dir, &["tag", "v0.3.6"]);
+    let installed =
+        install(&project, &Update::Only(vec!["json".to_owned()])).expect("the packages update");
+    let names: Vec<&str> = installed.iter().map(|p| p.name.as_str()).collect();
+    assert_eq!(names, ["json", "colors"]);
+    assert_eq!(installed[1].version, None);
+    assert!(project
+        .join(DIRECTORY)
+        .join("colors")
+        .join("lib.drgns")
+        .is_file());
+
+    // and removed once no longer needed
+    fs::write(project.join(MANIFEST), "[package]\nname = \"app\"\n")
+        .expect("the manifest is written");
+    assert_eq!(
+        install(&project, &Update::None).map(|p| p.len()).ok(),
+        Some(0)
+    );
+    assert!(!project.join(DIRECTORY).join("json").exists());
+
+    let e = add(
+        &project,
+        "json",
+        Some(json.clone()),
+        Requirement::parse("2"),
+    )
+    .expect_err("there is no version 2");
+    assert!(e.message().starts_with("no version of 'json' matches 2"));
+    let installed = add(&project, "json", Some(json), None).expect("the package is added");
+    assert_eq!(installed[0].version, Some(Version::new(0, 4, 0)));
+    let manifest = fs::read_to_string(project.join(MANIFEST)).expect("the manifest is written");
+    assert!(manifest.contains("version = \"0.4.0\""));
+    let _ = fs::remove_dir_all(&dir);
+}
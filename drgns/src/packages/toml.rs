@@ -0,0 +1,163 @@
+//! The part of TOML that manifests, lockfiles and the configuration of the
+//! linter need: sections of keys set to strings, integers or inline tables
+//! of strings, and comments.
+
+/// What a key is set to
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Value {
+    String(String),
+    Integer(i64),
+    Table(Vec<(String, String)>),
+}
+
+/// The keys under a `[name]` header, the ones before any header are in a
+/// section named ``
+#[derive(Debug, Clone, PartialEq, Eq, Default)]
+pub struct Section {
+    pub name: String,
+    pub entries: Vec<(String, Value)>,
+}
+
+/// The sections of a document, the errors name the line they are on
+pub fn parse(text: &str) -> Result<Vec<Section>, String> {
+    let mut sections = vec![Section::default()];
+    for (i, line) in text.lines().enumerate() {
+        let at = |msg: &str| format!("line {}: {}", i + 1, msg);
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        if let Some(header) = line.strip_prefix('[') {
+            let Some((name, rest)) = header.split_once(']') else {
+                return Err(at("expected `]` after the name of the section"));
+            };
+            end(rest).map_err(|e| at(&e))?;
+            sections.push(Section {
+                name: name.trim().to_owned(),
+                entries: vec![],
+            });
+            continue;
+        }
+        let entry = entry(line).map_err(|e| at(&e))?;
+        let section = sections.last_mut().expect("there is always a section");
+        if section.entries.iter().any(|(k, _)| *k == entry.0) {
+            return Err(at(&format!("`{}` is set twice", entry.0)));
+        }
+        section.entries.push(entry);
+    }
+    Ok(sections)
+}
+
+/// the text of a string, quoted and escaped
+pub fn quote(text: &str) -> String {
+    let mut quoted = String::from('"');
+    for c in text.chars() {
+        match c {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            '\n' => quoted.push_str("\\n"),
+            '\t' => quoted.push_str("\\t"),
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+/// `key = value`, alone on its line
+fn entry(line: &str) -> Result<(String, Value), String> {
+    let (key, rest) = key(line)?;
+    let Some(rest) = rest.trim_start().strip_prefix('=') else {
+        return Err(format!("expected `=` after `{}`", key));
+    };
+    let rest = rest.trim_start();
+    let digits = rest
+        .find(|c: char| !(c.is_ascii_digit() || c == '-' || c == '_'))
+        .unwrap_or(rest.len());
+    let (value, rest) = match rest.strip_prefix('{') {
+        Some(table) => self::table(table)?,
+        None if digits > 0 => {
+            let integer = rest[..digits].replace('_', "");
+            let integer = integer
+                .parse()
+                .map_err(|_| format!("'{}' is not an integer", &rest[..digits]))?;
+            (Value::Integer(integer), &rest[digits..])
+        }
+        None => {
+            let (s, rest) = string(rest)?;
+            (Value::String(s), rest)
+        }
+    };
+    end(rest)?;
+    Ok((key, value))
+}
+
+/// the entries of an inline table, after its `{`
+fn table(mut rest: &str) -> Result<(Value, &str), String> {
+    let mut entries = vec![];
+    loop {
+        rest = rest.trim_start();
+        if let Some(after) = rest.strip_prefix('}') {
+            return Ok((Value::Table(entries), after));
+        }
+        if !entries.is_empty() {
+            let Some(after) = rest.strip_prefix(',') else {
+                return Err("expected `,` or `}` in the table".to_owned());
+            };
+            rest = after.trim_start();
+        }
+        let (key, after) = key(rest)?;
+        let Some(after) = after.trim_start().strip_prefix('=') else {
+            return Err(format!("expected `=` after `{}`", key));
+        };
+        let (value, after) = string(after.trim_start())?;
+        entries.push((key, value));
+        rest = after;
+    }
+}
+
+/// a bare or a quoted key, and what follows it
+fn key(text: &str) -> Result<(String, &str), String> {
+    if text.starts_with('"') {
+        return string(text);
+    }
+    let len = text
+        .find(|c: char| !(c.is_ascii_alphanumeric() || c == '_' || c == '-' || c == '.'))
+        .unwrap_or(text.len());
+    match len {
+        0 => Err("expected a key".to_owned()),
+        _ => Ok((text[..len].to_owned(), &text[len..])),
+    }
+}
+
+/// a quoted string, and what follows it
+fn string(text: &str) -> Result<(String, &str), String> {
+    let Some(rest) = text.strip_prefix('"') else {
+        return Err("expected a string".to_owned());
+    };
+    let mut value = String::new();
+    let mut chars = rest.char_indices();
+    while let Some((i, c)) = chars.next() {
+        match c {
+            '"' => return Ok((value, &rest[i + 1..])),
+            '\\' => match chars.next().map(|(_, c)| c) {
+                Some('"') => value.push('"'),
+                Some('\\') => value.push('\\'),
+                Some('n') => value.push('\n'),
+                Some('t') => value.push('\t'),
+                _ => return Err("invalid escape in the string".to_owned()),
+            },
+            c => value.push(c),
+        }
+    }
+    Err("the string is not closed".to_owned())
+}
+
+/// nothing but a comment is left on the line
+fn end(rest: &str) -> Result<(), String> {
+    let rest = rest.trim_start();
+    match rest.is_empty() || rest.starts_with('#') {
+        true => Ok(()),
+        false => Err(format!("unexpected `{}`", rest)),
+    }
+}
@@ -0,0 +1,140 @@
+//! Versions of packages, and the requirements dependencies put on them.
+//!
+//! Requirements are the ones of Cargo: `1.2` is `^1.2`, any version up to the
+//! next one changing the first number that isn't 0, `~1.2` allows only newer
+//! patches, `=1.2.3` is that version only and `*` is any.
+
+use std::fmt::Display;
+
+/// A version, the tags of git repositories name them, with or without a `v`
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub struct Version {
+    pub major: u64,
+    pub minor: u64,
+    pub patch: u64,
+}
+
+impl Version {
+    pub fn new(major: u64, minor: u64, patch: u64) -> Self {
+        Self {
+            major,
+            minor,
+            patch,
+        }
+    }
+
+    /// `1.2.3` or `v1.2.3`, `None` for anything else
+    pub fn parse(text: &str) -> Option<Self> {
+        let (numbers, 3) = numbers(text.strip_prefix('v').unwrap_or(text))? else {
+            return None;
+        };
+        Some(numbers)
+    }
+}
+
+impl Display for Version {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}.{}.{}", self.major, self.minor, self.patch)
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Operator {
+    Caret,
+    Tilde,
+    Exact,
+    Any,
+}
+
+/// The versions a dependency allows
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Requirement {
+    operator: Operator,
+    version: Version,
+
+    /// how many of the numbers of the version were given
+    given: usize,
+}
+
+impl Requirement {
+    /// such as `1.2`, `^1.2.3`, `~1.2`, `=1.2.3` or `*`
+    pub fn parse(text: &str) -> Option<Self> {
+        let text = text.trim();
+        if text == "*" {
+            return Some(Self {
+                operator: Operator::Any,
+                version: Version::new(0, 0, 0),
+                given: 0,
+            });
+        }
+        let (operator, rest) = match text.chars().next()? {
+            '^' => (Operator::Caret, &text[1..]),
+            '~' => (Operator::Tilde, &text[1..]),
+            '=' => (Operator::Exact, &text[1..]),
+            _ => (Operator::Caret, text),
+        };
+        let (version, given) = numbers(rest.trim())?;
+        Some(Self {
+            operator,
+            version,
+            given,
+        })
+    }
+
+    /// the requirement `drgns pkg add` writes for a dependency at the version
+    pub fn compatible(version: Version) -> Self {
+        Self {
+            operator: Operator::Caret,
+            version,
+            given: 3,
+        }
+    }
+
+    pub fn matches(&self, version: &Version) -> bool {
+        let low = self.version;
+        let (major, minor, patch) = (low.major, low.minor, low.patch);
+        let high = match (self.operator, self.given) {
+            (Operator::Any, _) => return true,
+            (Operator::Exact, 3) => return *version == low,
+            (Operator::Caret, _) if major > 0 || self.given == 1 => Version::new(major + 1, 0, 0),
+            (Operator::Caret, _) if minor > 0 || self.given == 2 => Version::new(0, minor + 1, 0),
+            (Operator::Caret, _) => Version::new(0, 0, patch + 1),
+            (_, 1) => Version::new(major + 1, 0, 0),
+            (_, 2) => Version::new(major, minor + 1, 0),
+            (_, _) => Version::new(major, minor, patch + 1),
+        };
+        low <= *version && *version < high
+    }
+}
+
+impl Display for Requirement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let prefix = match self.operator {
+            Operator::Any => return write!(f, "*"),
+            Operator::Caret => "",
+            Operator::Tilde => "~",
+            Operator::Exact => "=",
+        };
+        let v = self.version;
+        let numbers = [v.major, v.minor, v.patch].map(|n| n.to_string());
+        write!(f, "{}{}", prefix, numbers[..self.given].join("."))
+    }
+}
+
+/// the version of one to three numbers, the ones missing are 0, and how many
+/// were given
+fn numbers(text: &str) -> Option<(Version, usize)> {
+    let parts: Vec<&str> = text.split('.').collect();
+    if parts.len() > 3 {
+        return None;
+    }
+    let mut numbers = [0; 3];
+    for (n, part) in numbers.iter_mut().zip(&parts) {
+        if part.is_empty() || !part.chars().all(|c| c.is_ascii_digit()) {
+            return None;
+        }
+        *n = part.parse().ok()?;
+    }
+    let [major, minor, patch] = numbers;
+    Some((Version::new(major, minor, patch), parts.len()))
+}
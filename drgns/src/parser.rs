@@ -1,223 +1,1941 @@
 use crate::{
-    eh::ErrorHandler,
+    doc,
+    eh::{DragonError, ErrorHandler},
     lexer::{Lexer, Token, TokenType as TT},
-    lookahead::{lookahead, Lookahead},
-    values::Value, source::{Source, Reader},
+    source::{Reader, Source, SourceString},
 };
 
-use std::rc::Rc;
+use std::{rc::Rc, sync::Arc};
 
 mod ast;
 pub use ast::*;
+mod incremental;
+pub use incremental::{Edit, Tree};
 
-trait TokenStream = Iterator<Item = Token>;
+#[cfg(test)]
+mod test;
 
+/// Parse a whole source, this is the entry point shared by batch mode and
+/// the REPL. The program is always returned, even if it's incomplete because
+/// of errors.
+pub fn parse(src: &Arc<Source>) -> (Program, Vec<DragonError>) {
+    let eh = Rc::new(ErrorHandler::new());
+    let program = Parser::from_source(src, &eh).parse_program();
+    (program, eh.take_errors())
+}
+
+/// The significant tokens, without whitespace and comments, and the comments
+/// attached to them
+fn split_comments(lx: Lexer, source: &Arc<Source>) -> (Vec<Token>, Comments) {
+    let mut tokens: Vec<Token> = vec![];
+    let mut comments = Comments::default();
+    // the comments on their own lines, until the token they lead
+    let mut leading = vec![];
+    let lead = |comments: &mut Comments, offset, leading: &mut Vec<SourceString>| {
+        for span in leading.drain(..) {
+            let trailing = false;
+            comments.attach(offset, Comment { span, trailing });
+        }
+    };
+    for t in lx {
+        match t.token_type {
+            TT::Ignore => {}
+            TT::Comment => match tokens.last().filter(|p| p.token_type != TT::NewLine) {
+                Some(p) => {
+                    let (span, trailing) = (t.lexeme, true);
+                    comments.attach(p.lexeme.end(), Comment { span, trailing });
+                }
+                None => leading.push(t.lexeme),
+            },
+            TT::NewLine => tokens.push(t),
+            _ => {
+                lead(&mut comments, t.lexeme.start(), &mut leading);
+                tokens.push(t);
+            }
+        }
+    }
+    lead(&mut comments, source.len(), &mut leading);
+    (tokens, comments)
+}
+
+/// Recursive descent parser, newlines terminate statements, except inside
+/// of parentheses and brackets, or right after a binary operator.
 ///
 /// # Method Naming Convention:
-/// - `parse`: on fail doesn't consume tokens and returns error with context
-/// - `match`: never consumes tokens, only advances lookahead, returns option
-#[deprecated]
+/// - `parse`: on fail reports an error with context and returns `None`
+/// - `match`: consumes the token only if it matches, never reports errors
+/// - `check`: never consumes tokens
 pub struct Parser {
-    lx: Lookahead<Lexer>,
+    tokens: Vec<Token>,
+    current: usize,
+    comments: Comments,
+    source: Arc<Source>,
     eh: Rc<ErrorHandler>,
+
+    /// whether newlines are significant in the current grouping, innermost
+    /// last, they are significant at the top level
+    newlines: Vec<bool>,
+
+    /// the index past the last token looked at, the parse of a statement
+    /// depends on the tokens from its first to there
+    reach: usize,
+
+    /// what the top-level statements were parsed from, and those of the
+    /// parse before an edit that can be reused, see `Tree`
+    parsed: Vec<incremental::Parsed>,
+    previous: Option<incremental::Previous>,
 }
 
 impl Parser {
-    pub fn new(lx: Lexer, eh: &Rc<ErrorHandler>) -> Self {
+    pub fn new(lx: Lexer, source: &Arc<Source>, eh: &Rc<ErrorHandler>) -> Self {
+        let (tokens, comments) = split_comments(lx, source);
         Self {
-            lx: lookahead(lx),
+            tokens,
+            current: 0,
+            comments,
+            source: source.clone(),
             eh: eh.clone(),
+            newlines: vec![],
+            reach: 0,
+            parsed: vec![],
+            previous: None,
         }
     }
 
-    pub fn from_source(src: Source, eh: &Rc<ErrorHandler>) -> Self {
-        todo!()
+    pub fn from_source(src: &Arc<Source>, eh: &Rc<ErrorHandler>) -> Self {
+        Self::new(Lexer::new(Reader::new(src), eh), src, eh)
+    }
+
+    pub fn parse_program(&mut self) -> Program {
+        let mut statements = vec![];
+        loop {
+            self.skip_terminators();
+            if self.is_at_end() {
+                break;
+            }
+            if let Some(s) = self.reuse() {
+                statements.push(s);
+                self.parse_terminator();
+                continue;
+            }
+            let (first, errors) = (self.current, self.eh.error_count());
+            self.reach = first;
+            match self.parse_statement() {
+                Some(s) => {
+                    self.parsed.push(incremental::Parsed {
+                        tokens: first..self.current,
+                        reach: self.reach,
+                        clean: self.eh.error_count() == errors,
+                    });
+                    statements.push(s);
+                    self.parse_terminator();
+                }
+                None => {
+                    self.synchronize();
+                    // there is no enclosing block to close at the top level
+                    self.match_one(TT::RightBrace);
+                }
+            }
+        }
+        Program {
+            statements,
+            source: self.source.clone(),
+            comments: std::mem::take(&mut self.comments),
+        }
     }
 
+    /// skip ahead to the next statement after an error, to avoid reporting
+    /// the same error several times
     pub fn synchronize(&mut self) {
-        self.lx.commit();
-        for t in self.lx.by_ref() {
-            if t.token_type == TT::Semicolon {
-                return;
+        let mut depth = 0_usize;
+        while let Some(t) = self.tokens.get(self.current) {
+            match t.token_type {
+                TT::LeftParen | TT::LeftBracket | TT::LeftBrace => depth += 1,
+                TT::RightParen | TT::RightBracket | TT::RightBrace if depth > 0 => depth -= 1,
+                // let the enclosing block deal with its closing brace
+                TT::RightBrace => return,
+                TT::NewLine | TT::Semicolon if depth == 0 => {
+                    self.current += 1;
+                    return;
+                }
+                _ => {}
+            }
+            self.current += 1;
+        }
+    }
+
+    pub fn parse_statement(&mut self) -> Option<Statement> {
+        let start = self.peek()?;
+        match start.token_type {
+            TT::Mut => self.parse_declaration(),
+            TT::Identifier if self.check_nth(1, &[TT::ColonEquals, TT::Colon]) => {
+                self.parse_declaration()
+            }
+            TT::LeftBracket | TT::LeftBrace
+                if self.closes_before(&[TT::ColonEquals, TT::Colon]) =>
+            {
+                self.parse_declaration()
+            }
+            TT::Function => self
+                .parse_function()
+                .map(|f| Statement::Function(Arc::new(f))),
+            TT::Struct => self.parse_struct().map(|s| Statement::Struct(Arc::new(s))),
+            TT::Enum => self.parse_enum().map(|e| Statement::Enum(Arc::new(e))),
+            TT::Interface => self
+                .parse_interface()
+                .map(|i| Statement::Interface(Arc::new(i))),
+            TT::Exit => {
+                self.advance();
+                let code = self.parse_expression()?;
+                let span = start.lexeme.to(&code.span());
+                Some(Statement::Exit(ExitStatement { code, span }))
+            }
+            TT::Throw => {
+                self.advance();
+                let value = self.parse_expression()?;
+                let span = start.lexeme.to(&value.span());
+                Some(Statement::Throw(ThrowStatement { value, span }))
+            }
+            TT::Defer => self.parse_defer(),
+            TT::Import => self.parse_import().map(Statement::Import),
+            TT::Return => {
+                self.advance();
+                let value = self.parse_optional_expression()?;
+                let span = self.span_from(&start.lexeme);
+                Some(Statement::Return(ReturnStatement { value, span }))
+            }
+            TT::Yield => {
+                self.advance();
+                let value = self.parse_optional_expression()?;
+                let span = self.span_from(&start.lexeme);
+                Some(Statement::Yield(YieldStatement { value, span }))
+            }
+            TT::Break => {
+                self.advance();
+                let value = self.parse_optional_expression()?;
+                let span = self.span_from(&start.lexeme);
+                Some(Statement::Break(BreakStatement { value, span }))
+            }
+            TT::Continue => {
+                self.advance();
+                let value = self.parse_optional_expression()?;
+                let span = self.span_from(&start.lexeme);
+                Some(Statement::Continue(ContinueStatement { value, span }))
+            }
+            _ => self.parse_expression_statement(),
+        }
+    }
+
+    fn parse_declaration(&mut self) -> Option<Statement> {
+        let first = self.peek()?;
+        let mutable = self.match_one(TT::Mut).is_some();
+        let target = self.parse_binding()?;
+        let type_annotation = if self.match_one(TT::Colon).is_some() {
+            let t = self.parse_type()?;
+            // a type annotation makes the declaration unambiguous, so `=` is
+            // accepted in place of `:=`
+            self.parse_one_of(&[TT::ColonEquals, TT::Equals])?;
+            Some(t)
+        } else {
+            self.parse_one(TT::ColonEquals)?;
+            None
+        };
+        self.skip_newlines();
+        let mut value = self.parse_expression()?;
+        let span = first.lexeme.to(&value.span());
+        let Pattern::Binding(name) = target else {
+            return Some(Statement::Destructuring(Destructuring {
+                mutable,
+                pattern: target,
+                type_annotation,
+                value,
+                span,
+            }));
+        };
+        if let Expression::Lambda(l) = &mut value {
+            Arc::make_mut(&mut l.function).name.name = name.name.clone();
+        }
+        Some(Statement::Declaration(Declaration {
+            mutable,
+            name,
+            type_annotation,
+            value,
+            span,
+        }))
+    }
+
+    /// `defer` takes an expression or an assignment, kept as the body of a
+    /// function that the enclosing one calls on its way out
+    fn parse_defer(&mut self) -> Option<Statement> {
+        let start = self.parse_one(TT::Defer)?;
+        let value = self.parse_expression_statement()?;
+        let body = BlockExpression {
+            span: value.span(),
+            statements: vec![value],
+        };
+        if yields(&body) {
+            self.eh
+                .clone()
+                .syntax_error(body.span, "cannot yield in deferred code".to_string());
+            return None;
+        }
+        let span = start.lexeme.to(&body.span);
+        let function = FunctionDeclaration {
+            name: Identifier {
+                name: "<defer>".to_string(),
+                span: start.lexeme,
+            },
+            parameters: vec![],
+            return_type: None,
+            body,
+            span: span.clone(),
+            generator: false,
+            doc: String::new(),
+        };
+        Some(Statement::Defer(DeferStatement {
+            function: Arc::new(function),
+            span,
+        }))
+    }
+
+    fn parse_import(&mut self) -> Option<Import> {
+        let start = self.parse_one(TT::Import)?;
+        let mut path = vec![self.parse_identifier()?];
+        while self.match_one(TT::ColonColon).is_some() {
+            path.push(self.parse_identifier()?);
+        }
+        let span = self.span_from(&start.lexeme);
+        Some(Import { path, span })
+    }
+
+    fn parse_function(&mut self) -> Option<FunctionDeclaration> {
+        let start = self.parse_one(TT::Function)?;
+        let name = self.parse_identifier()?;
+        let parameters = self.parse_parameters()?;
+        self.parse_one(TT::Arrow)?;
+        let return_type = if self.check(TT::LeftBrace) {
+            None
+        } else {
+            Some(self.parse_type()?)
+        };
+        let body = self.parse_block()?;
+        let span = start.lexeme.to(&body.span);
+        Some(FunctionDeclaration {
+            name,
+            parameters,
+            return_type,
+            generator: yields(&body),
+            body,
+            doc: doc::comment(&self.comments, &span),
+            span,
+        })
+    }
+
+    /// fields are separated by newlines or commas, methods by newlines
+    fn parse_struct(&mut self) -> Option<StructDeclaration> {
+        let start = self.parse_one(TT::Struct)?;
+        let name = self.parse_identifier()?;
+        self.parse_one(TT::LeftBrace)?;
+        self.newlines.push(true);
+        let mut fields = vec![];
+        let mut methods = vec![];
+        loop {
+            self.skip_terminators();
+            if self.check(TT::RightBrace) || self.is_at_end() {
+                break;
+            }
+            if self.check(TT::Function) {
+                match self.parse_function() {
+                    Some(f) => methods.push(Arc::new(f)),
+                    None => {
+                        self.synchronize();
+                        continue;
+                    }
+                }
+            } else {
+                match self.parse_field() {
+                    Some(f) => fields.push(f),
+                    None => {
+                        self.synchronize();
+                        continue;
+                    }
+                }
+                if self.match_one(TT::Comma).is_some() {
+                    continue;
+                }
+            }
+            if !self.check(TT::RightBrace) {
+                self.parse_terminator();
+            }
+        }
+        self.newlines.pop();
+        self.parse_one(TT::RightBrace)?;
+        Some(StructDeclaration {
+            name,
+            fields,
+            methods,
+            span: self.span_from(&start.lexeme),
+        })
+    }
+
+    /// variants are separated by newlines or commas, methods by newlines
+    fn parse_enum(&mut self) -> Option<EnumDeclaration> {
+        let start = self.parse_one(TT::Enum)?;
+        let name = self.parse_identifier()?;
+        self.parse_one(TT::LeftBrace)?;
+        self.newlines.push(true);
+        let mut variants = vec![];
+        let mut methods = vec![];
+        loop {
+            self.skip_terminators();
+            if self.check(TT::RightBrace) || self.is_at_end() {
+                break;
+            }
+            if self.check(TT::Function) {
+                match self.parse_function() {
+                    Some(f) => methods.push(Arc::new(f)),
+                    None => {
+                        self.synchronize();
+                        continue;
+                    }
+                }
+            } else {
+                match self.parse_variant() {
+                    Some(v) => variants.push(v),
+                    None => {
+                        self.synchronize();
+                        continue;
+                    }
+                }
+                if self.match_one(TT::Comma).is_some() {
+                    continue;
+                }
+            }
+            if !self.check(TT::RightBrace) {
+                self.parse_terminator();
+            }
+        }
+        self.newlines.pop();
+        self.parse_one(TT::RightBrace)?;
+        Some(EnumDeclaration {
+            name,
+            variants,
+            methods,
+            span: self.span_from(&start.lexeme),
+        })
+    }
+
+    /// methods are separated by newlines
+    fn parse_interface(&mut self) -> Option<InterfaceDeclaration> {
+        let start = self.parse_one(TT::Interface)?;
+        let name = self.parse_identifier()?;
+        self.parse_one(TT::LeftBrace)?;
+        self.newlines.push(true);
+        let mut methods = vec![];
+        loop {
+            self.skip_terminators();
+            if self.check(TT::RightBrace) || self.is_at_end() {
+                break;
+            }
+            match self.parse_method_signature() {
+                Some(m) => methods.push(m),
+                None => {
+                    self.synchronize();
+                    continue;
+                }
+            }
+            if !self.check(TT::RightBrace) {
+                self.parse_terminator();
+            }
+        }
+        self.newlines.pop();
+        self.parse_one(TT::RightBrace)?;
+        Some(InterfaceDeclaration {
+            name,
+            methods,
+            span: self.span_from(&start.lexeme),
+        })
+    }
+
+    /// `function name(parameters)`, then `-> type` if it has a return type
+    fn parse_method_signature(&mut self) -> Option<MethodSignature> {
+        let start = self.parse_one(TT::Function)?;
+        let name = self.parse_identifier()?;
+        let parameters = self.parse_parameters()?;
+        let return_type = match self.match_one(TT::Arrow) {
+            Some(_) => Some(self.parse_type()?),
+            None => None,
+        };
+        if self.check(TT::LeftBrace) {
+            let brace = self.peek()?;
+            self.eh.clone().syntax_error(
+                brace.lexeme,
+                "the methods of an interface have no body".to_string(),
+            );
+            return None;
+        }
+        Some(MethodSignature {
+            name,
+            parameters,
+            return_type,
+            span: self.span_from(&start.lexeme),
+        })
+    }
+
+    fn parse_variant(&mut self) -> Option<Variant> {
+        let name = self.parse_identifier()?;
+        let fields = match self.match_one(TT::LeftParen) {
+            Some(_) => {
+                let fields = self.grouped(false, |p| {
+                    let mut fields = vec![];
+                    while !p.check(TT::RightParen) {
+                        fields.push(p.parse_field()?);
+                        if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                            break;
+                        }
+                    }
+                    Some(fields)
+                })?;
+                self.parse_one(TT::RightParen)?;
+                Some(fields)
+            }
+            None => None,
+        };
+        Some(Variant {
+            span: self.span_from(&name.span),
+            name,
+            fields,
+        })
+    }
+
+    fn parse_field(&mut self) -> Option<Field> {
+        let name = self.parse_identifier()?;
+        let type_annotation = if self.match_one(TT::Colon).is_some() {
+            Some(self.parse_type()?)
+        } else {
+            None
+        };
+        let span = self.span_from(&name.span);
+        Some(Field {
+            name,
+            type_annotation,
+            span,
+        })
+    }
+
+    /// `(a, b: int = 2, ..rest)`, the parameters with a default come after
+    /// the others, and the variadic one is last
+    fn parse_parameters(&mut self) -> Option<Vec<Parameter>> {
+        self.parse_one(TT::LeftParen)?;
+        let parameters = self.grouped(false, |p| {
+            let mut parameters: Vec<Parameter> = vec![];
+            while !p.check(TT::RightParen) {
+                let first = p.peek();
+                let mutable = p.match_one(TT::Mut).is_some();
+                let variadic = p.match_one(TT::DotDot).is_some();
+                let pattern = match variadic {
+                    true => Pattern::Binding(p.parse_identifier()?),
+                    false => p.parse_binding()?,
+                };
+                let type_annotation = if p.match_one(TT::Colon).is_some() {
+                    Some(p.parse_type()?)
+                } else {
+                    None
+                };
+                let default = match p.match_one(TT::Equals) {
+                    Some(_) => Some(p.parse_expression()?),
+                    None => None,
+                };
+                let span = p.span_from(&first.map(|t| t.lexeme).unwrap_or(pattern.span()));
+                let misplaced = if parameters.last().is_some_and(|p| p.variadic) {
+                    Some("the variadic parameter must be the last one")
+                } else if variadic && default.is_some() {
+                    Some("a variadic parameter cannot have a default")
+                } else if !variadic
+                    && default.is_none()
+                    && parameters.iter().any(|p| p.default.is_some())
+                {
+                    Some("a parameter without a default cannot follow one with a default")
+                } else {
+                    None
+                };
+                if let Some(msg) = misplaced {
+                    p.eh.clone().syntax_error(span.clone(), msg.to_string());
+                }
+                parameters.push(Parameter {
+                    mutable,
+                    pattern,
+                    type_annotation,
+                    default,
+                    variadic,
+                    span,
+                });
+                if p.match_one(TT::Comma).is_none() {
+                    break;
+                }
             }
+            Some(parameters)
+        })?;
+        self.parse_one(TT::RightParen)?;
+        Some(parameters)
+    }
+
+    fn parse_expression_statement(&mut self) -> Option<Statement> {
+        let target = self.parse_expression()?;
+        let op = match self.peek().map(|t| t.token_type) {
+            Some(TT::Equals) => AssignOperator::Assign,
+            Some(TT::PlusEquals) => AssignOperator::Add,
+            Some(TT::MinusEquals) => AssignOperator::Sub,
+            Some(TT::StarEquals) => AssignOperator::Mul,
+            Some(TT::SlashEquals) => AssignOperator::Div,
+            Some(TT::PercentEquals) => AssignOperator::Mod,
+            Some(TT::PlusPlusEquals) => AssignOperator::Concat,
+            _ => return Some(Statement::Expression(target)),
+        };
+        let op_token = self.advance()?;
+        if !target.is_assignable() {
+            self.eh.clone().invalid_assignment(op_token.lexeme);
+            return None;
         }
+        self.skip_newlines();
+        let value = self.parse_expression()?;
+        let span = target.span().to(&value.span());
+        Some(Statement::Assignment(Assignment {
+            target,
+            op,
+            value,
+            span,
+        }))
     }
 
-    pub fn drop_all(&mut self) {
-        self.eh.clone().unexpected_end_of_input();
-        for _ in self.lx.by_ref() {}
+    /// the expression after `return`, `break` and `continue` can be omitted
+    fn parse_optional_expression(&mut self) -> Option<Option<Expression>> {
+        if self.is_at_end() || self.check_terminator() || self.check(TT::RightBrace) {
+            return Some(None);
+        }
+        self.parse_expression().map(Some)
     }
 
     pub fn parse_expression(&mut self) -> Option<Expression> {
-        self.parse_term()
+        self.parse_coalesce()
     }
 
-    pub fn parse_term(&mut self) -> Option<Expression> {
-        let mut exp = self.parse_factor()?;
-        while let Some(t) = self.match_one_of(&[TT::Plus, TT::Minus]) {
-            self.lx.commit();
-            let rhs = self.parse_factor()?;
-            exp = Expression::BE(BinExpression {
+    /// parse a left-associative level of binary operators
+    fn parse_binary(
+        &mut self,
+        operators: &[(TT, BinOperator)],
+        next: fn(&mut Self) -> Option<Expression>,
+    ) -> Option<Expression> {
+        let mut exp = next(self)?;
+        while let Some(op) = self.peek().and_then(|t| {
+            operators
+                .iter()
+                .find_map(|(tt, op)| (*tt == t.token_type).then_some(*op))
+        }) {
+            self.advance();
+            // a binary operator at the end of a line continues the expression
+            self.skip_newlines();
+            let rhs = next(self)?;
+            let span = exp.span().to(&rhs.span());
+            exp = Expression::Binary(BinExpression {
                 lhs: Box::new(exp),
-                op: match t.token_type {
-                    TT::Plus => BinOperator::Add,
-                    TT::Minus => BinOperator::Sub,
-                    _ => unreachable!(),
-                },
+                op,
                 rhs: Box::new(rhs),
+                span,
             });
         }
         Some(exp)
     }
 
-    pub fn parse_factor(&mut self) -> Option<Expression> {
-        let mut exp = self.parse_power()?;
-        while let Some(t) = self.match_one_of(&[TT::Star, TT::Slash, TT::Percent]) {
-            self.lx.commit();
-            let rhs = self.parse_power()?;
-            exp = Expression::BE(BinExpression {
-                lhs: Box::new(exp),
-                op: match t.token_type {
-                    TT::Percent => BinOperator::Mod,
-                    TT::Slash => BinOperator::Div,
-                    TT::Star => BinOperator::Mul,
-                    _ => unreachable!(),
-                },
+    fn parse_coalesce(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[(TT::QuestionQuestion, BinOperator::Coalesce)],
+            Self::parse_or,
+        )
+    }
+
+    fn parse_or(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[(TT::Or, BinOperator::Or), (TT::Xor, BinOperator::Xor)],
+            Self::parse_and,
+        )
+    }
+
+    fn parse_and(&mut self) -> Option<Expression> {
+        self.parse_binary(&[(TT::And, BinOperator::And)], Self::parse_not)
+    }
+
+    fn parse_not(&mut self) -> Option<Expression> {
+        if let Some(t) = self.match_one(TT::Not) {
+            let rhs = self.parse_not()?;
+            let span = t.lexeme.to(&rhs.span());
+            return Some(Expression::Unary(UnExpression {
+                op: UnOperator::Not,
                 rhs: Box::new(rhs),
-            });
+                span,
+            }));
         }
-        Some(exp)
+        self.parse_comparison()
     }
 
-    pub fn parse_power(&mut self) -> Option<Expression> {
-        let mut exp = self.parse_unary()?;
-        while self.match_one(TT::Pow).is_some() {
-            self.lx.commit();
-            let rhs = self.parse_unary()?;
-            exp = Expression::BE(BinExpression {
-                lhs: Box::new(exp),
-                op: BinOperator::Pow,
-                rhs: Box::new(rhs),
-            });
+    fn parse_comparison(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[
+                (TT::EqualsEquals, BinOperator::Eq),
+                (TT::BangEquals, BinOperator::Ne),
+                (TT::Less, BinOperator::Lt),
+                (TT::LessEquals, BinOperator::Le),
+                (TT::Greater, BinOperator::Gt),
+                (TT::GreaterEquals, BinOperator::Ge),
+                (TT::In, BinOperator::In),
+            ],
+            Self::parse_pipe,
+        )
+    }
+
+    /// `value |> f(a)` is the call `f(value, a)`, like binary operators a
+    /// `|>` at the end of a line continues the expression
+    fn parse_pipe(&mut self) -> Option<Expression> {
+        let mut exp = self.parse_concat()?;
+        while self.match_one(TT::PipeGreater).is_some() {
+            self.skip_newlines();
+            let call = self.parse_concat()?;
+            let Expression::Call(mut call) = call else {
+                self.eh
+                    .clone()
+                    .syntax_error(call.span(), "|> expects a call on its right".to_string());
+                return None;
+            };
+            call.span = exp.span().to(&call.span);
+            call.arguments.insert(0, exp);
+            call.piped = true;
+            exp = Expression::Call(call);
         }
         Some(exp)
     }
 
+    fn parse_concat(&mut self) -> Option<Expression> {
+        self.parse_binary(&[(TT::PlusPlus, BinOperator::Concat)], Self::parse_bitwise)
+    }
+
+    fn parse_bitwise(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[
+                (TT::Land, BinOperator::BitAnd),
+                (TT::Lor, BinOperator::BitOr),
+                (TT::Lxor, BinOperator::BitXor),
+                (TT::Lsl, BinOperator::Shl),
+                (TT::Lsr, BinOperator::Lsr),
+                (TT::Asr, BinOperator::Asr),
+            ],
+            Self::parse_term,
+        )
+    }
+
+    pub fn parse_term(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[(TT::Plus, BinOperator::Add), (TT::Minus, BinOperator::Sub)],
+            Self::parse_factor,
+        )
+    }
+
+    pub fn parse_factor(&mut self) -> Option<Expression> {
+        self.parse_binary(
+            &[
+                (TT::Star, BinOperator::Mul),
+                (TT::Slash, BinOperator::Div),
+                (TT::Percent, BinOperator::Mod),
+            ],
+            Self::parse_unary,
+        )
+    }
+
     pub fn parse_unary(&mut self) -> Option<Expression> {
-        if self.match_one(TT::Minus).is_some() {
-            self.lx.commit();
-            let rhs = self.parse_unary()?;
-            return Some(Expression::UE(UnExpression {
-                op: UnOperator::Neg,
-                rhs: Box::new(rhs),
-            }));
+        let op = match self.peek().map(|t| t.token_type) {
+            Some(TT::Minus) => UnOperator::Neg,
+            Some(TT::Lnot) => UnOperator::BitNot,
+            _ => return self.parse_power(),
+        };
+        let t = self.advance()?;
+        let rhs = self.parse_unary()?;
+        let span = t.lexeme.to(&rhs.span());
+        Some(Expression::Unary(UnExpression {
+            op,
+            rhs: Box::new(rhs),
+            span,
+        }))
+    }
+
+    /// exponentiation is right-associative and binds tighter than negation,
+    /// so `-2 ** 2` is `-4`
+    pub fn parse_power(&mut self) -> Option<Expression> {
+        let exp = self.parse_postfix()?;
+        if self.match_one(TT::Pow).is_none() {
+            return Some(exp);
+        }
+        self.skip_newlines();
+        let rhs = self.parse_unary()?;
+        let span = exp.span().to(&rhs.span());
+        Some(Expression::Binary(BinExpression {
+            lhs: Box::new(exp),
+            op: BinOperator::Pow,
+            rhs: Box::new(rhs),
+            span,
+        }))
+    }
+
+    /// calls and indexing must start on the line of their target, so that
+    /// items of a list on separate lines stay separate
+    fn parse_postfix(&mut self) -> Option<Expression> {
+        let mut exp = self.parse_primary()?;
+        loop {
+            let same_line = !self.follows_newline();
+            if same_line && self.check(TT::LeftParen) {
+                let (arguments, named) = self.parse_arguments()?;
+                let span = self.span_from(&exp.span());
+                exp = Expression::Call(CallExpression {
+                    callee: Box::new(exp),
+                    arguments,
+                    named,
+                    span,
+                    piped: false,
+                });
+            } else if same_line && self.check(TT::LeftBracket) {
+                let index = self.parse_index()?;
+                let span = self.span_from(&exp.span());
+                exp = Expression::Index(IndexExpression {
+                    target: Box::new(exp),
+                    index,
+                    span,
+                });
+            } else if self.match_one(TT::ColonColon).is_some() {
+                let name = self.parse_identifier()?;
+                let span = self.span_from(&exp.span());
+                exp = Expression::Member(MemberExpression {
+                    module: Box::new(exp),
+                    name,
+                    span,
+                });
+            } else if let Some(dot) = self.match_one_of(&[TT::Dot, TT::QuestionDot]) {
+                let optional = dot.token_type == TT::QuestionDot;
+                let name = self.parse_identifier()?;
+                // like calls, the arguments start on the line of the name
+                if self.follows_newline() || !self.check(TT::LeftParen) {
+                    let span = self.span_from(&exp.span());
+                    exp = Expression::Field(FieldExpression {
+                        target: Box::new(exp),
+                        name,
+                        optional,
+                        span,
+                    });
+                    continue;
+                }
+                let (arguments, named) = self.parse_arguments()?;
+                let span = self.span_from(&exp.span());
+                exp = Expression::Method(MethodExpression {
+                    receiver: Box::new(exp),
+                    name,
+                    arguments,
+                    named,
+                    optional,
+                    span,
+                });
+            } else {
+                return Some(exp);
+            }
+        }
+    }
+
+    /// the arguments given by position, then those given by name, as in
+    /// `f(1, b = 2)`
+    fn parse_arguments(&mut self) -> Option<(Vec<Expression>, Vec<NamedArgument>)> {
+        self.parse_one(TT::LeftParen)?;
+        let (arguments, named) = self.grouped(false, |p| {
+            let mut arguments = vec![];
+            let mut named: Vec<NamedArgument> = vec![];
+            while !p.check(TT::RightParen) {
+                if p.check(TT::Identifier) && p.check_nth(1, &[TT::Equals]) {
+                    let name = p.parse_identifier()?;
+                    p.parse_one(TT::Equals)?;
+                    let value = p.parse_expression()?;
+                    let span = p.span_from(&name.span);
+                    named.push(NamedArgument { name, value, span });
+                } else {
+                    let argument = p.parse_expression()?;
+                    if let Some(n) = named.last() {
+                        let msg = format!(
+                            "an argument given by position cannot follow '{}', given by name",
+                            n.name.name
+                        );
+                        p.eh.clone().syntax_error(argument.span(), msg);
+                    }
+                    arguments.push(argument);
+                }
+                if p.match_one(TT::Comma).is_none() {
+                    break;
+                }
+            }
+            Some((arguments, named))
+        })?;
+        self.parse_one(TT::RightParen)?;
+        Some((arguments, named))
+    }
+
+    /// `[index]` or `[start:end:step]`, where every part of the slice is
+    /// optional, so `[::2]` takes every other item
+    fn parse_index(&mut self) -> Option<Index> {
+        self.parse_one(TT::LeftBracket)?;
+        let index = self.grouped(false, Self::parse_index_parts)?;
+        self.parse_one(TT::RightBracket)?;
+        Some(index)
+    }
+
+    fn parse_index_parts(&mut self) -> Option<Index> {
+        let part = |p: &mut Self, ends: &[TT]| match ends.iter().any(|&tt| p.check(tt)) {
+            true => Some(None),
+            false => p.parse_expression().map(|e| Some(Box::new(e))),
+        };
+        let start = part(self, &[TT::Colon, TT::ColonColon])?;
+        // `::` is lexed as a single token, it is a slice without an end
+        let end = if self.match_one(TT::ColonColon).is_some() {
+            None
+        } else if self.match_one(TT::Colon).is_some() {
+            let end = part(self, &[TT::Colon, TT::RightBracket])?;
+            if self.match_one(TT::Colon).is_none() {
+                return Some(Index::Slice {
+                    start,
+                    end,
+                    step: None,
+                });
+            }
+            end
+        } else {
+            return match start {
+                Some(i) => Some(Index::Single(i)),
+                None => crate::assert_unreachable!(),
+            };
+        };
+        let step = part(self, &[TT::RightBracket])?;
+        Some(Index::Slice { start, end, step })
+    }
+
+    /// `[a, b, c]`, items are separated by commas or newlines, and a trailing
+    /// comma is allowed
+    fn parse_list(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::LeftBracket)?;
+        let items = self.grouped(false, |p| {
+            let mut items = vec![];
+            while !p.check(TT::RightBracket) {
+                items.push(p.parse_expression()?);
+                if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                    break;
+                }
+            }
+            Some(items)
+        })?;
+        self.parse_one(TT::RightBracket)?;
+        Some(Expression::List(ListExpression {
+            items,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    /// `{key: value}`, the entries are separated like the items of lists
+    fn parse_map(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::LeftBrace)?;
+        let entries = self.grouped(false, |p| {
+            let mut entries = vec![];
+            while !p.check(TT::RightBrace) {
+                let key = p.parse_expression()?;
+                p.parse_one(TT::Colon)?;
+                let value = p.parse_expression()?;
+                entries.push((key, value));
+                if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                    break;
+                }
+            }
+            Some(entries)
+        })?;
+        self.parse_one(TT::RightBrace)?;
+        Some(Expression::Map(MapExpression {
+            entries,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    /// Whether the brace starts a map rather than a block, that is it's
+    /// empty, or a `:` follows the first expression. A name directly
+    /// followed by `:` starts a declaration, so variables used as keys must
+    /// be in parentheses.
+    fn is_map(&mut self) -> bool {
+        self.skip_insignificant();
+        let mut i = self.current + 1;
+        while self.look(i).is_some_and(|t| t.token_type == TT::NewLine) {
+            i += 1;
+        }
+        match self.look(i).map(|t| t.token_type) {
+            Some(TT::RightBrace) => return true,
+            Some(TT::Identifier) if self.look(i + 1).is_some_and(|t| t.token_type == TT::Colon) => {
+                return false
+            }
+            _ => {}
         }
-        self.parse_primary()
+        let mut depth = 0;
+        while let Some(t) = self.look(i) {
+            i += 1;
+            match t.token_type {
+                TT::LeftParen | TT::LeftBracket | TT::LeftBrace | TT::InterpolationStart => {
+                    depth += 1
+                }
+                TT::RightParen | TT::RightBracket | TT::InterpolationEnd => depth -= 1,
+                TT::RightBrace if depth == 0 => return false,
+                TT::RightBrace => depth -= 1,
+                TT::Colon if depth == 0 => return true,
+                TT::NewLine | TT::Semicolon | TT::ColonEquals | TT::Equals | TT::Comma
+                    if depth == 0 =>
+                {
+                    return false
+                }
+                _ => {}
+            }
+        }
+        false
     }
 
     pub fn parse_primary(&mut self) -> Option<Expression> {
-        if let Some(e) = self.match_int_literal() {
-            self.lx.commit();
-            return Some(e);
+        let Some(t) = self.peek() else {
+            self.eh
+                .clone()
+                .unexpected_end_of_input(Some(self.end_span()));
+            return None;
+        };
+        match t.token_type {
+            TT::IntLit
+            | TT::FloatLit
+            | TT::StringLit
+            | TT::RawStringLit
+            | TT::BytesLit
+            | TT::SymbolLit
+            | TT::True
+            | TT::False
+            | TT::None => {
+                self.advance();
+                let value = self.literal_value(&t)?;
+                Some(Expression::Literal(LitExpression {
+                    value,
+                    span: t.lexeme,
+                }))
+            }
+            TT::InterpolationStart => self.parse_interpolation(),
+            TT::Identifier => {
+                self.advance();
+                Some(Expression::Variable(Identifier {
+                    name: t.lexeme.to_string(),
+                    span: t.lexeme,
+                }))
+            }
+            TT::LeftParen if self.is_lambda() => self.parse_lambda(),
+            TT::LeftParen => self.parse_grouping(),
+            TT::LeftBracket => self.parse_list(),
+            TT::LeftBrace if self.is_map() => self.parse_map(),
+            TT::LeftBrace => self.parse_block().map(Expression::Block),
+            TT::If => self.parse_if(),
+            TT::For => self.parse_for(),
+            TT::Match => self.parse_match(),
+            TT::Try => self.parse_try(),
+            TT::Spawn => self.parse_spawn(),
+            _ => {
+                // TODO: cascade errors instead of reporting multiple times
+                self.eh.clone().expect_expression(Some(t.lexeme));
+                None
+            }
+        }
+    }
+
+    /// An interpolated string is desugared into a concatenation, so
+    /// `"a ${x} b"` becomes `"a " ++ (str x) ++ " b"`
+    fn parse_interpolation(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::InterpolationStart)?;
+        let mut parts = vec![];
+        let mut t = start.clone();
+        loop {
+            let text = t.lexeme.to_string();
+            // strip the quote or brace before, and `${` or the quote after
+            let body = match t.token_type {
+                TT::InterpolationEnd => &text[1..text.len().max(2) - 1],
+                _ => &text[1..text.len() - 2],
+            };
+            match unescape(body) {
+                Ok(s) if s.is_empty() => {}
+                Ok(s) => parts.push(Expression::Literal(LitExpression {
+                    value: Literal::String(s),
+                    span: t.lexeme.clone(),
+                })),
+                Err(msg) => self.eh.clone().invalid_escape(t.lexeme.clone(), msg),
+            }
+            if t.token_type == TT::InterpolationEnd {
+                break;
+            }
+            let value = self.grouped(false, Self::parse_expression)?;
+            parts.push(Expression::Unary(UnExpression {
+                op: UnOperator::Str,
+                span: value.span(),
+                rhs: Box::new(value),
+            }));
+            t = match self.check(TT::InterpolationMiddle) {
+                true => self.parse_one(TT::InterpolationMiddle)?,
+                false => self.parse_one(TT::InterpolationEnd)?,
+            };
         }
+        let span = start.lexeme.to(&t.lexeme);
+        let mut parts = parts.into_iter();
+        let Some(first) = parts.next() else {
+            return Some(Expression::Literal(LitExpression {
+                value: Literal::String(String::new()),
+                span,
+            }));
+        };
+        Some(parts.fold(first, |lhs, rhs| {
+            Expression::Binary(BinExpression {
+                span: lhs.span().to(&rhs.span()),
+                lhs: Box::new(lhs),
+                op: BinOperator::Concat,
+                rhs: Box::new(rhs),
+            })
+        }))
+    }
 
-        // TODO: cascade errors instead of reporting multiple times
-        self.parse_grouping()
+    /// whether the parenthesis starts the parameters of a lambda, that is
+    /// the matching one is followed by an arrow
+    fn is_lambda(&mut self) -> bool {
+        self.skip_insignificant();
+        let mut depth = 0;
+        let mut i = 0;
+        while let Some(t) = self.look(self.current + i) {
+            i += 1;
+            match t.token_type {
+                TT::LeftParen => depth += 1,
+                TT::RightParen if depth == 1 => {
+                    return self.check_nth(i, &[TT::Arrow]);
+                }
+                TT::RightParen => depth -= 1,
+                _ => {}
+            }
+        }
+        false
+    }
+
+    /// whether the tokens after the arrow of a lambda are a return type
+    /// followed by a block, rather than an expression
+    fn is_typed_body(&mut self) -> bool {
+        self.skip_insignificant();
+        let mut i = self.current;
+        while let Some(t) = self.look(i) {
+            i += 1;
+            match t.token_type {
+                TT::LeftBrace => return true,
+                TT::Identifier
+                | TT::None
+                | TT::Pipe
+                | TT::LeftBracket
+                | TT::RightBracket
+                | TT::LeftParen
+                | TT::RightParen
+                | TT::Comma => {}
+                _ => return false,
+            }
+        }
+        false
+    }
+
+    fn parse_lambda(&mut self) -> Option<Expression> {
+        let start = self.peek()?;
+        let parameters = self.parse_parameters()?;
+        let arrow = self.parse_one(TT::Arrow)?;
+        let return_type = match !self.check(TT::LeftBrace) && self.is_typed_body() {
+            true => Some(self.parse_type()?),
+            false => None,
+        };
+        let body = if self.check(TT::LeftBrace) {
+            self.parse_block()?
+        } else {
+            let statement = self.parse_expression_statement()?;
+            let span = statement.span();
+            BlockExpression {
+                statements: vec![statement],
+                span,
+            }
+        };
+        let span = start.lexeme.to(&body.span);
+        let function = FunctionDeclaration {
+            name: Identifier {
+                name: "<lambda>".to_string(),
+                span: arrow.lexeme,
+            },
+            parameters,
+            return_type,
+            generator: yields(&body),
+            body,
+            span,
+            doc: String::new(),
+        };
+        Some(Expression::Lambda(LambdaExpression {
+            function: Arc::new(function),
+        }))
     }
 
     pub fn parse_grouping(&mut self) -> Option<Expression> {
-        if self.match_one(TT::LeftParen).is_some() {
-            self.lx.commit();
-            let e = self.parse_expression()?;
-            self.parse_one(TT::RightParen)?;
-            return Some(e);
+        let start = self.parse_one(TT::LeftParen)?;
+        let inner = self.grouped(false, Self::parse_expression)?;
+        self.parse_one(TT::RightParen)?;
+        Some(Expression::Group(GroupExpression {
+            inner: Box::new(inner),
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    pub fn parse_block(&mut self) -> Option<BlockExpression> {
+        let start = self.parse_one(TT::LeftBrace)?;
+        self.newlines.push(true);
+        let mut statements = vec![];
+        loop {
+            self.skip_terminators();
+            if self.check(TT::RightBrace) || self.is_at_end() {
+                break;
+            }
+            match self.parse_statement() {
+                Some(s) => {
+                    statements.push(s);
+                    if !self.check(TT::RightBrace) {
+                        self.parse_terminator();
+                    }
+                }
+                None => self.synchronize(),
+            }
         }
+        self.newlines.pop();
+        self.parse_one(TT::RightBrace)?;
+        Some(BlockExpression {
+            statements,
+            span: self.span_from(&start.lexeme),
+        })
+    }
 
-        self.eh
-            .clone()
-            .expect_expression(self.lx.current.as_ref().map(|t| t.lexeme.clone()));
-        None
+    fn parse_if(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::If)?;
+        let mut branches = vec![];
+        let condition = self.parse_expression()?;
+        branches.push((condition, self.parse_block()?));
+        let mut otherwise = None;
+        loop {
+            // `elif` and `else` may start on the next line
+            let before = self.current;
+            self.skip_newlines();
+            if self.match_one(TT::Elif).is_some() {
+                let condition = self.parse_expression()?;
+                branches.push((condition, self.parse_block()?));
+            } else if self.match_one(TT::Else).is_some() {
+                otherwise = Some(self.parse_block()?);
+                break;
+            } else {
+                self.current = before;
+                break;
+            }
+        }
+        Some(Expression::If(IfExpression {
+            branches,
+            otherwise,
+            span: self.span_from(&start.lexeme),
+        }))
     }
 
-    pub fn match_int_literal(&mut self) -> Option<Expression> {
-        let t = self.match_one(TT::IntLit)?;
-        let si = t.lexeme.to_string();
-        log::trace!("matching int literal '{}'", si);
-        let ri = t.lexeme.to_string().parse::<i64>();
-        if let Ok(i) = ri {
-            Some(Expression::LE(LitExpression(Value::Int(i))))
-        } else {
-            // NOTE: this is technically a semantic error, but to keep evaluator
-            //       clean it is here
-            self.eh.clone().int_parse_error(Some(t.lexeme));
-            Some(Expression::LE(LitExpression(Value::Int(1))))
+    fn parse_for(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::For)?;
+        let destructures = (self.check(TT::LeftBracket) || self.check(TT::LeftBrace))
+            && self.closes_before(&[TT::In]);
+        if destructures || (self.check(TT::Identifier) && self.check_nth(1, &[TT::In])) {
+            let binding = self.parse_binding()?;
+            self.parse_one(TT::In)?;
+            let iterable = self.parse_expression()?;
+            let body = self.parse_block()?;
+            return Some(Expression::ForIn(ForInExpression {
+                binding,
+                iterable: Box::new(iterable),
+                body,
+                span: self.span_from(&start.lexeme),
+            }));
         }
+        let condition = if self.check(TT::LeftBrace) {
+            None
+        } else {
+            Some(Box::new(self.parse_expression()?))
+        };
+        let body = self.parse_block()?;
+        Some(Expression::For(ForExpression {
+            condition,
+            body,
+            span: self.span_from(&start.lexeme),
+        }))
     }
 
-    pub fn parse_one(&mut self, tt: TT) -> Option<Token> {
-        let t = self.match_one(tt);
-        match (t, self.lx.current.clone()) {
-            (None, None) => {
-                self.eh.clone().unexpected_end_of_input();
-                None
+    /// `match subject { pattern -> value }`, arms are separated by commas or
+    /// newlines, a value starting with a brace is a block rather than a map
+    fn parse_match(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::Match)?;
+        let subject = self.parse_expression()?;
+        self.parse_one(TT::LeftBrace)?;
+        // newlines end the value of an arm, so that the next arm can start
+        // with a negative number
+        let arms = self.grouped(true, |p| {
+            let mut arms = vec![];
+            loop {
+                p.skip_newlines();
+                if p.check(TT::RightBrace) || p.is_at_end() {
+                    break;
+                }
+                arms.push(p.parse_match_arm()?);
+                if p.match_one(TT::Comma).is_none() && !p.check(TT::NewLine) {
+                    break;
+                }
             }
-            (None, Some(c)) => {
-                self.eh
-                    .clone()
-                    .unexpected_token(c.lexeme, &[tt], c.token_type);
+            p.skip_newlines();
+            Some(arms)
+        })?;
+        self.parse_one(TT::RightBrace)?;
+        Some(Expression::Match(MatchExpression {
+            subject: Box::new(subject),
+            arms,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    fn parse_match_arm(&mut self) -> Option<MatchArm> {
+        let pattern = self.parse_pattern()?;
+        let guard = match self.match_one(TT::If) {
+            Some(_) => Some(self.parse_expression()?),
+            None => None,
+        };
+        self.parse_one(TT::Arrow)?;
+        let body = match self.check(TT::LeftBrace) {
+            true => Expression::Block(self.parse_block()?),
+            false => self.parse_expression()?,
+        };
+        Some(MatchArm {
+            span: pattern.span().to(&body.span()),
+            pattern,
+            guard,
+            body,
+        })
+    }
+
+    /// literals, `_`, names, and lists and maps of patterns
+    fn parse_pattern(&mut self) -> Option<Pattern> {
+        let Some(t) = self.peek() else {
+            self.eh
+                .clone()
+                .unexpected_end_of_input(Some(self.end_span()));
+            return None;
+        };
+        match t.token_type {
+            TT::IntLit
+            | TT::FloatLit
+            | TT::StringLit
+            | TT::RawStringLit
+            | TT::BytesLit
+            | TT::SymbolLit
+            | TT::True
+            | TT::False
+            | TT::None => {
+                self.advance();
+                let value = self.literal_value(&t)?;
+                Some(Pattern::Literal(LitExpression {
+                    value,
+                    span: t.lexeme,
+                }))
+            }
+            TT::Minus if self.check_nth(1, &[TT::IntLit, TT::FloatLit]) => {
+                self.advance();
+                let n = self.advance()?;
+                let value = match self.literal_value(&n)? {
+                    Literal::Int(i) => Literal::Int(-i),
+                    Literal::Float(x) => Literal::Float(-x),
+                    _ => crate::assert_unreachable!(),
+                };
+                Some(Pattern::Literal(LitExpression {
+                    value,
+                    span: t.lexeme.to(&n.lexeme),
+                }))
+            }
+            TT::Identifier if t.lexeme.to_string() == "_" => {
+                self.advance();
+                Some(Pattern::Wildcard(t.lexeme))
+            }
+            TT::Identifier if self.check_nth(1, &[TT::ColonColon]) => self.parse_variant_pattern(),
+            TT::Identifier => self.parse_identifier().map(Pattern::Binding),
+            TT::LeftBracket => self.parse_list_pattern(),
+            TT::LeftBrace => self.parse_map_pattern(),
+            tt => {
+                self.eh.clone().syntax_error(
+                    t.lexeme,
+                    format!("expected a pattern, found {}", tt.describe()),
+                );
                 None
             }
-            (Some(t), _) => {
-                self.lx.commit();
-                Some(t)
+        }
+    }
+
+    /// `[first, ..rest]`, there is at most one `..`, binding the items it
+    /// matches if followed by a name
+    fn parse_list_pattern(&mut self) -> Option<Pattern> {
+        let start = self.parse_one(TT::LeftBracket)?;
+        let (items, rest) = self.grouped(false, |p| {
+            let mut items = vec![];
+            let mut rest = None;
+            while !p.check(TT::RightBracket) {
+                if let Some(dots) = p.match_one(TT::DotDot) {
+                    let binding = match p.check(TT::Identifier) {
+                        true => Some(p.parse_identifier()?).filter(|i| i.name != "_"),
+                        false => None,
+                    };
+                    if rest.is_some() {
+                        p.eh.clone().syntax_error(
+                            dots.lexeme,
+                            "a list pattern can only have one `..`".to_string(),
+                        );
+                    }
+                    rest = Some(Rest {
+                        position: items.len(),
+                        binding,
+                    });
+                } else {
+                    items.push(p.parse_pattern()?);
+                }
+                if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                    break;
+                }
+            }
+            Some((items, rest))
+        })?;
+        self.parse_one(TT::RightBracket)?;
+        Some(Pattern::List(ListPattern {
+            items,
+            rest,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    /// `Result::Ok(value)`, the fields are matched in the order they are
+    /// declared
+    fn parse_variant_pattern(&mut self) -> Option<Pattern> {
+        let mut path = vec![self.parse_identifier()?];
+        while self.match_one(TT::ColonColon).is_some() {
+            path.push(self.parse_identifier()?);
+        }
+        let fields = match self.match_one(TT::LeftParen) {
+            Some(_) => {
+                let fields = self.grouped(false, |p| {
+                    let mut fields = vec![];
+                    while !p.check(TT::RightParen) {
+                        fields.push(p.parse_pattern()?);
+                        if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                            break;
+                        }
+                    }
+                    Some(fields)
+                })?;
+                self.parse_one(TT::RightParen)?;
+                Some(fields)
+            }
+            None => None,
+        };
+        Some(Pattern::Variant(VariantPattern {
+            span: self.span_from(&path[0].span),
+            path,
+            fields,
+        }))
+    }
+
+    /// a name, or a list or map pattern destructuring the value bound to it
+    fn parse_binding(&mut self) -> Option<Pattern> {
+        match self.check(TT::LeftBracket) || self.check(TT::LeftBrace) {
+            true => self.parse_pattern(),
+            false => self.parse_identifier().map(Pattern::Binding),
+        }
+    }
+
+    /// `{key: pattern}`, the keys are literals, as in maps. `{name}` is
+    /// short for `{"name": name}`.
+    fn parse_map_pattern(&mut self) -> Option<Pattern> {
+        let start = self.parse_one(TT::LeftBrace)?;
+        let entries = self.grouped(false, |p| {
+            let mut entries = vec![];
+            while !p.check(TT::RightBrace) {
+                let key = p.parse_pattern()?;
+                if let Pattern::Binding(name) = &key {
+                    if !p.check(TT::Colon) {
+                        let key = LitExpression {
+                            value: Literal::String(name.name.clone()),
+                            span: name.span.clone(),
+                        };
+                        entries.push((key, Pattern::Binding(name.clone())));
+                        if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                            break;
+                        }
+                        continue;
+                    }
+                }
+                p.parse_one(TT::Colon)?;
+                let value = p.parse_pattern()?;
+                match key {
+                    Pattern::Literal(
+                        l @ LitExpression {
+                            value: Literal::Int(_) | Literal::String(_) | Literal::Symbol(_),
+                            ..
+                        },
+                    ) => entries.push((l, value)),
+                    p => p.eh.clone().syntax_error(
+                        p.span(),
+                        "the keys of a map pattern must be int, string or symbol literals"
+                            .to_string(),
+                    ),
+                }
+                if p.match_one(TT::Comma).is_none() && !p.follows_newline() {
+                    break;
+                }
+            }
+            Some(entries)
+        })?;
+        self.parse_one(TT::RightBrace)?;
+        Some(Pattern::Map(MapPattern {
+            entries,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    fn parse_try(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::Try)?;
+        let body = self.parse_block()?;
+        // `catch` and `finally` may start on the next line
+        let mut before = self.current;
+        self.skip_newlines();
+        let catch = if self.match_one(TT::Catch).is_some() {
+            let name = match self.check(TT::Identifier) {
+                true => Some(self.parse_identifier()?),
+                false => None,
+            };
+            let body = self.parse_block()?;
+            before = self.current;
+            self.skip_newlines();
+            Some(CatchClause { name, body })
+        } else {
+            None
+        };
+        let finally = if catch.is_none() {
+            // a `try` needs at least one of the two
+            self.parse_one_of(&[TT::Catch, TT::Finally])?;
+            Some(self.parse_block()?)
+        } else if self.match_one(TT::Finally).is_some() {
+            Some(self.parse_block()?)
+        } else {
+            self.current = before;
+            None
+        };
+        Some(Expression::Try(TryExpression {
+            body,
+            catch,
+            finally,
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    /// `spawn` takes the call with all that follows it, so `spawn f().g()`
+    /// runs `g` on the task, on what `f` returns
+    fn parse_spawn(&mut self) -> Option<Expression> {
+        let start = self.parse_one(TT::Spawn)?;
+        let call = self.parse_postfix()?;
+        if !matches!(call, Expression::Call(_) | Expression::Method(_)) {
+            self.eh
+                .clone()
+                .syntax_error(call.span(), "spawn expects a call".to_string());
+            return None;
+        }
+        if matches!(&call, Expression::Method(m) if m.optional) {
+            let msg = "spawn expects a call that is always made, not one with '?.'";
+            self.eh.clone().syntax_error(call.span(), msg.to_string());
+            return None;
+        }
+        Some(Expression::Spawn(SpawnExpression {
+            call: Box::new(call),
+            span: self.span_from(&start.lexeme),
+        }))
+    }
+
+    pub fn parse_type(&mut self) -> Option<TypeExpression> {
+        let first = self.parse_type_primary()?;
+        if !self.check(TT::Pipe) {
+            return Some(first);
+        }
+        let mut members = vec![first];
+        while self.match_one(TT::Pipe).is_some() {
+            members.push(self.parse_type_primary()?);
+        }
+        let span = members[0].span().to(&members[members.len() - 1].span());
+        Some(TypeExpression::Union(members, span))
+    }
+
+    fn parse_type_primary(&mut self) -> Option<TypeExpression> {
+        if let Some(t) = self.match_one(TT::None) {
+            return Some(TypeExpression::Name(Identifier {
+                name: "none".to_string(),
+                span: t.lexeme,
+            }));
+        }
+        if let Some(start) = self.match_one(TT::LeftParen) {
+            let members = self.grouped(false, |p| {
+                let mut members = vec![];
+                while !p.check(TT::RightParen) {
+                    members.push(p.parse_type()?);
+                    if p.match_one(TT::Comma).is_none() {
+                        break;
+                    }
+                }
+                Some(members)
+            })?;
+            self.parse_one(TT::RightParen)?;
+            return Some(TypeExpression::Tuple(
+                members,
+                self.span_from(&start.lexeme),
+            ));
+        }
+        let name = self.parse_identifier()?;
+        if self.match_one(TT::LeftBracket).is_none() {
+            return Some(TypeExpression::Name(name));
+        }
+        let arguments = self.grouped(false, |p| {
+            let mut arguments = vec![];
+            while !p.check(TT::RightBracket) {
+                arguments.push(p.parse_type()?);
+                if p.match_one(TT::Comma).is_none() {
+                    break;
+                }
+            }
+            Some(arguments)
+        })?;
+        self.parse_one(TT::RightBracket)?;
+        let span = self.span_from(&name.span);
+        Some(TypeExpression::Generic(name, arguments, span))
+    }
+
+    fn parse_identifier(&mut self) -> Option<Identifier> {
+        let t = self.parse_one(TT::Identifier)?;
+        Some(Identifier {
+            name: t.lexeme.to_string(),
+            span: t.lexeme,
+        })
+    }
+
+    fn literal_value(&mut self, t: &Token) -> Option<Literal> {
+        let text = t.lexeme.to_string();
+        match t.token_type {
+            TT::IntLit => Some(Literal::Int(self.int_value(t, &text))),
+            TT::FloatLit => match text.replace('_', "").parse::<f64>() {
+                Ok(f) => Some(Literal::Float(f)),
+                Err(_) => {
+                    self.eh
+                        .clone()
+                        .syntax_error(t.lexeme.clone(), "invalid float literal".to_string());
+                    Some(Literal::Float(0.0))
+                }
+            },
+            TT::StringLit => unescape(&text[1..text.len().max(2) - 1])
+                .map(Literal::String)
+                .or_else(|msg| {
+                    self.eh.clone().invalid_escape(t.lexeme.clone(), msg);
+                    Err(())
+                })
+                .ok(),
+            TT::RawStringLit => Some(Literal::String(text[1..text.len().max(2) - 1].to_string())),
+            TT::BytesLit => unescape_bytes(&text[2..text.len().max(3) - 1])
+                .map(Literal::Bytes)
+                .map_err(|msg| self.eh.clone().invalid_bytes_escape(t.lexeme.clone(), msg))
+                .ok(),
+            TT::SymbolLit => Some(Literal::Symbol(text[1..].to_string())),
+            TT::True => Some(Literal::Bool(true)),
+            TT::False => Some(Literal::Bool(false)),
+            TT::None => Some(Literal::None),
+            _ => crate::assert_unreachable!(),
+        }
+    }
+
+    fn int_value(&mut self, t: &Token, text: &str) -> i64 {
+        let digits = text.replace('_', "");
+        let (digits, radix) = match digits.get(..2) {
+            Some("0x" | "0X") => (&digits[2..], 16),
+            Some("0o" | "0O") => (&digits[2..], 8),
+            Some("0b" | "0B") => (&digits[2..], 2),
+            _ => (&digits[..], 10),
+        };
+        log::trace!("matching int literal '{}'", text);
+        i64::from_str_radix(digits, radix).unwrap_or_else(|_| {
+            // NOTE: this is technically a semantic error, but to keep evaluator
+            //       clean it is here
+            self.eh.clone().int_parse_error(Some(t.lexeme.clone()));
+            1
+        })
+    }
+
+    /// statements end with a newline or a semicolon, or at the end of input
+    fn parse_terminator(&mut self) {
+        if self.is_at_end() || self.match_one_of(&[TT::NewLine, TT::Semicolon]).is_some() {
+            return;
+        }
+        if let Some(t) = self.peek() {
+            self.eh
+                .clone()
+                .unexpected_token(t.lexeme, &[TT::NewLine, TT::Semicolon], t.token_type);
+            self.synchronize();
+        }
+    }
+
+    fn check_terminator(&mut self) -> bool {
+        self.check(TT::NewLine) || self.check(TT::Semicolon)
+    }
+
+    fn skip_terminators(&mut self) {
+        while self.match_one_of(&[TT::NewLine, TT::Semicolon]).is_some() {}
+    }
+
+    fn skip_newlines(&mut self) {
+        while self
+            .look(self.current)
+            .is_some_and(|t| t.token_type == TT::NewLine)
+        {
+            self.current += 1;
+        }
+    }
+
+    /// parse with newlines significant in the grouping or not, they are as
+    /// they were after it, whether it parses or not
+    fn grouped<T>(
+        &mut self,
+        newlines: bool,
+        parse: impl FnOnce(&mut Self) -> Option<T>,
+    ) -> Option<T> {
+        self.newlines.push(newlines);
+        let parsed = parse(self);
+        self.newlines.pop();
+        parsed
+    }
+
+    /// newlines are skipped when they are not significant in the current
+    /// grouping
+    fn skip_insignificant(&mut self) {
+        if self.newlines.last() == Some(&false) {
+            self.skip_newlines();
+        }
+    }
+
+    /// whether insignificant newlines were skipped before the next token
+    fn follows_newline(&mut self) -> bool {
+        self.skip_insignificant();
+        self.current
+            .checked_sub(1)
+            .and_then(|i| self.tokens.get(i))
+            .is_some_and(|t| t.token_type == TT::NewLine)
+    }
+
+    fn is_at_end(&mut self) -> bool {
+        self.peek().is_none()
+    }
+
+    fn peek(&mut self) -> Option<Token> {
+        self.skip_insignificant();
+        self.look(self.current).cloned()
+    }
+
+    fn advance(&mut self) -> Option<Token> {
+        let t = self.peek()?;
+        self.current += 1;
+        Some(t)
+    }
+
+    fn check(&mut self, tt: TT) -> bool {
+        self.peek().is_some_and(|t| t.token_type == tt)
+    }
+
+    /// check the token n positions ahead, newlines count as tokens here
+    fn check_nth(&mut self, n: usize, tts: &[TT]) -> bool {
+        self.skip_insignificant();
+        self.look(self.current + n)
+            .is_some_and(|t| tts.contains(&t.token_type))
+    }
+
+    /// whether the brackets opening at the next token close right before one
+    /// of the tokens, as those of a pattern do before the `:=` declaring it
+    fn closes_before(&mut self, tts: &[TT]) -> bool {
+        self.skip_insignificant();
+        let mut depth = 0_usize;
+        let mut i = self.current;
+        while let Some(t) = self.look(i) {
+            match t.token_type {
+                TT::LeftParen | TT::LeftBracket | TT::LeftBrace => depth += 1,
+                TT::RightParen | TT::RightBracket | TT::RightBrace => {
+                    depth = depth.saturating_sub(1);
+                    if depth == 0 {
+                        return self.check_nth(i + 1 - self.current, tts);
+                    }
+                }
+                _ => {}
             }
+            i += 1;
+        }
+        false
+    }
+
+    /// the token at an index, which the statement being parsed then depends
+    /// on, as it does on the end of the input if there is none
+    fn look(&mut self, i: usize) -> Option<&Token> {
+        self.reach = self.reach.max(i.min(self.tokens.len()) + 1);
+        self.tokens.get(i)
+    }
+
+    /// an empty span at the end of the input
+    fn end_span(&self) -> SourceString {
+        let last = self
+            .tokens
+            .iter()
+            .rev()
+            .find(|t| t.token_type != TT::NewLine);
+        match last {
+            Some(t) => t.lexeme.after(),
+            None => SourceString::new(&self.source, 0..0),
         }
     }
 
+    /// span from the start of the given span to the end of the last consumed
+    /// token
+    fn span_from(&self, start: &SourceString) -> SourceString {
+        match self.current.checked_sub(1).and_then(|i| self.tokens.get(i)) {
+            Some(t) => start.to(&t.lexeme),
+            None => start.clone(),
+        }
+    }
+
+    pub fn parse_one(&mut self, tt: TT) -> Option<Token> {
+        self.parse_one_of(&[tt])
+    }
+
     fn parse_one_of(&mut self, tts: &[TT]) -> Option<Token> {
-        let t = self.match_one_of(tts);
-        match (t, self.lx.current.clone()) {
-            (None, None) => {
-                self.eh.clone().unexpected_end_of_input();
+        match self.peek() {
+            None => {
+                self.eh
+                    .clone()
+                    .unexpected_end_of_input(Some(self.end_span()));
                 None
             }
-            (None, Some(c)) => {
+            Some(c) if !tts.contains(&c.token_type) => {
                 self.eh
                     .clone()
                     .unexpected_token(c.lexeme, tts, c.token_type);
                 None
             }
-            (Some(t), _) => {
-                self.lx.commit();
-                Some(t)
-            }
+            Some(_) => self.advance(),
         }
     }
 
     fn match_one(&mut self, tt: TT) -> Option<Token> {
-        match self.lx.peek() {
-            Some(ref t) if t.token_type == tt => Some(t.clone()),
-            _ => {
-                self.lx.reset();
-                None
-            }
+        if self.check(tt) {
+            self.advance()
+        } else {
+            None
         }
     }
 
     fn match_one_of(&mut self, tts: &[TT]) -> Option<Token> {
-        for &tt in tts {
-            if let o @ Some(_) = self.match_one(tt) {
-                return o;
+        tts.iter().find_map(|&tt| self.match_one(tt))
+    }
+}
+
+/// process the escape sequences in the body of a string literal
+pub fn unescape(s: &str) -> Result<String, String> {
+    let mut ret = String::with_capacity(s.len());
+    let mut chars = s.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            ret.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('n') => ret.push('\n'),
+            Some('t') => ret.push('\t'),
+            Some('r') => ret.push('\r'),
+            Some('0') => ret.push('\0'),
+            Some(c @ ('\\' | '"' | '\'' | '$' | '{' | '}')) => ret.push(c),
+            Some('u') => {
+                let hex: String = match chars.next() {
+                    Some('{') => chars.by_ref().take_while(|&c| c != '}').collect(),
+                    _ => return Err("expected '{' after '\\u'".to_string()),
+                };
+                let c = u32::from_str_radix(&hex, 16)
+                    .ok()
+                    .and_then(char::from_u32)
+                    .ok_or_else(|| format!("invalid unicode escape '\\u{{{}}}'", hex))?;
+                ret.push(c);
+            }
+            Some(c) => return Err(format!("unknown escape sequence '\\{}'", c)),
+            None => return Err("unexpected end of string in escape sequence".to_string()),
+        }
+    }
+    Ok(ret)
+}
+
+/// process the escape sequences in the body of a bytes literal, the other
+/// characters must be ASCII
+pub fn unescape_bytes(s: &str) -> Result<Vec<u8>, String> {
+    let mut ret = Vec::with_capacity(s.len());
+    let mut chars = s.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            if !c.is_ascii() {
+                return Err(format!("'{}' is not an ASCII character", c));
             }
+            ret.push(c as u8);
+            continue;
+        }
+        match chars.next() {
+            Some('n') => ret.push(b'\n'),
+            Some('t') => ret.push(b'\t'),
+            Some('r') => ret.push(b'\r'),
+            Some('0') => ret.push(0),
+            Some(c @ ('\\' | '"' | '\'')) => ret.push(c as u8),
+            Some('x') => {
+                let hex: String = chars.by_ref().take(2).collect();
+                let b = match hex.len() == 2 && hex.chars().all(|c| c.is_ascii_hexdigit()) {
+                    true => u8::from_str_radix(&hex, 16).ok(),
+                    false => None,
+                };
+                ret.push(b.ok_or_else(|| format!("invalid byte escape '\\x{}'", hex))?);
+            }
+            Some(c) => return Err(format!("unknown escape sequence '\\{}'", c)),
+            None => return Err("unexpected end of bytes in escape sequence".to_string()),
         }
-        None
     }
+    Ok(ret)
 }
 
-// impl std::fmt::Display for ParseTreeNodeType {
-//     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
-//         let Self::Token(t) = self;
-//         write!(f, "{}", t)?;
-//         Ok(())
-//     }
-// }
+/// the body of the bytes literal of the bytes, the inverse of `unescape_bytes`
+pub fn escape_bytes(b: &[u8]) -> String {
+    let mut ret = String::with_capacity(b.len());
+    for &b in b {
+        match b {
+            b'\n' => ret.push_str("\\n"),
+            b'\t' => ret.push_str("\\t"),
+            b'\r' => ret.push_str("\\r"),
+            b'\\' => ret.push_str("\\\\"),
+            b'"' => ret.push_str("\\\""),
+            b' '..=b'~' => ret.push(b as char),
+            b => ret.push_str(&format!("\\x{:02x}", b)),
+        }
+    }
+    ret
+}
@@ -1,42 +1,751 @@
-use std::fmt::Display;
+use std::{collections::HashMap, fmt::Display, ops::Range, sync::Arc};
 
-use crate::values::Value;
+use crate::source::{Source, SourceString};
 
-#[derive(Debug, Clone, derive_more::Display)]
+/// A whole source file, or a logical line in the REPL
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Program {
+    pub statements: Vec<Statement>,
+    #[serde(skip)]
+    pub source: Arc<Source>,
+
+    /// the comments, attached to the tokens around them
+    pub comments: Comments,
+}
+
+impl Display for Program {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        for s in &self.statements {
+            writeln!(f, "{}", s)?;
+        }
+        Ok(())
+    }
+}
+
+/// `// comment` or `/* comment */`, with its delimiters
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Comment {
+    pub span: SourceString,
+
+    /// whether it follows other code on the line where it starts
+    pub trailing: bool,
+}
+
+/// The comments of a program, so that tools can put them back. A comment
+/// following a token on the same line trails that token, the others lead
+/// the next token, not counting newlines. Comments lead or trail the nodes
+/// starting or ending with their token.
+#[derive(Debug, Clone, Default)]
+pub struct Comments {
+    /// in the order of the source
+    comments: Vec<Comment>,
+
+    /// the comments before the token starting at an offset
+    leading: HashMap<usize, Range<usize>>,
+
+    /// the comments after the token ending at an offset
+    trailing: HashMap<usize, Range<usize>>,
+}
+
+impl Comments {
+    /// attach a comment to the token starting at the offset, or to the one
+    /// ending at it if the comment trails it, in the order of the source
+    pub(crate) fn attach(&mut self, offset: usize, comment: Comment) {
+        let attached = match comment.trailing {
+            true => &mut self.trailing,
+            false => &mut self.leading,
+        };
+        let i = self.comments.len();
+        attached.entry(offset).or_insert(i..i).end = i + 1;
+        self.comments.push(comment);
+    }
+
+    /// the comments before the token starting at the offset, the end of the
+    /// source for the comments after the last token
+    pub fn before(&self, offset: usize) -> &[Comment] {
+        self.leading
+            .get(&offset)
+            .map_or(&[], |r| &self.comments[r.clone()])
+    }
+
+    /// the comments after the token ending at the offset, on the same line
+    pub fn after(&self, offset: usize) -> &[Comment] {
+        self.trailing
+            .get(&offset)
+            .map_or(&[], |r| &self.comments[r.clone()])
+    }
+
+    /// the comments on the lines above a node, such as the documentation of
+    /// a function
+    pub fn leading(&self, node: &SourceString) -> &[Comment] {
+        self.before(node.start())
+    }
+
+    /// the comments at the end of the last line of a node
+    pub fn trailing(&self, node: &SourceString) -> &[Comment] {
+        self.after(node.end())
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Comment> {
+        self.comments.iter()
+    }
+
+    pub fn len(&self) -> usize {
+        self.comments.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.comments.is_empty()
+    }
+}
+
+/// the comments in the order of the source, what they are attached to
+/// follows from their spans
+impl serde::Serialize for Comments {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        self.comments.serialize(serializer)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Identifier {
+    pub name: String,
+    pub span: SourceString,
+}
+
+impl Display for Identifier {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.name)
+    }
+}
+
+#[derive(Debug, Clone, derive_more::Display, serde::Serialize)]
+pub enum Statement {
+    Declaration(Declaration),
+    Destructuring(Destructuring),
+    Function(Arc<FunctionDeclaration>),
+    Struct(Arc<StructDeclaration>),
+    Enum(Arc<EnumDeclaration>),
+    Interface(Arc<InterfaceDeclaration>),
+    Assignment(Assignment),
+    Expression(Expression),
+    Exit(ExitStatement),
+    Throw(ThrowStatement),
+    Defer(DeferStatement),
+    Import(Import),
+    Return(ReturnStatement),
+    Yield(YieldStatement),
+    Break(BreakStatement),
+    Continue(ContinueStatement),
+}
+
+impl Statement {
+    pub fn span(&self) -> SourceString {
+        match self {
+            Self::Declaration(d) => d.span.clone(),
+            Self::Destructuring(d) => d.span.clone(),
+            Self::Function(f) => f.span.clone(),
+            Self::Struct(s) => s.span.clone(),
+            Self::Enum(e) => e.span.clone(),
+            Self::Interface(i) => i.span.clone(),
+            Self::Assignment(a) => a.span.clone(),
+            Self::Expression(e) => e.span(),
+            Self::Exit(e) => e.span.clone(),
+            Self::Throw(t) => t.span.clone(),
+            Self::Defer(d) => d.span.clone(),
+            Self::Import(i) => i.span.clone(),
+            Self::Return(r) => r.span.clone(),
+            Self::Yield(y) => y.span.clone(),
+            Self::Break(b) => b.span.clone(),
+            Self::Continue(c) => c.span.clone(),
+        }
+    }
+}
+
+/// `name := value`, `mut name := value` or `name: type := value`
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Declaration {
+    pub mutable: bool,
+    pub name: Identifier,
+    pub type_annotation: Option<TypeExpression>,
+    pub value: Expression,
+    pub span: SourceString,
+}
+
+impl Display for Declaration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(:= ")?;
+        if self.mutable {
+            write!(f, "mut ")?;
+        }
+        write!(f, "{}", self.name)?;
+        if let Some(t) = &self.type_annotation {
+            write!(f, ": {}", t)?;
+        }
+        write!(f, " {})", self.value)
+    }
+}
+
+/// `[first, ..rest] := value` or `{x, y} := value`, declaring the names
+/// bound by the pattern, it is an error if the value doesn't match it
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Destructuring {
+    pub mutable: bool,
+    pub pattern: Pattern,
+    pub type_annotation: Option<TypeExpression>,
+    pub value: Expression,
+    pub span: SourceString,
+}
+
+impl Display for Destructuring {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(:= ")?;
+        if self.mutable {
+            write!(f, "mut ")?;
+        }
+        write!(f, "{}", self.pattern)?;
+        if let Some(t) = &self.type_annotation {
+            write!(f, ": {}", t)?;
+        }
+        write!(f, " {})", self.value)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct FunctionDeclaration {
+    pub name: Identifier,
+    pub parameters: Vec<Parameter>,
+    pub return_type: Option<TypeExpression>,
+    pub body: BlockExpression,
+    pub span: SourceString,
+
+    /// whether the body yields, calling the function then returns an
+    /// iterator over what it yields instead of running it, see `yields`
+    pub generator: bool,
+
+    /// the text of the `///` comments right above it, see `doc`
+    pub doc: String,
+}
+
+impl Display for FunctionDeclaration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(function {} (", self.name)?;
+        for (i, p) in self.parameters.iter().enumerate() {
+            if i > 0 {
+                write!(f, " ")?;
+            }
+            write!(f, "{}", p)?;
+        }
+        write!(f, ")")?;
+        if let Some(t) = &self.return_type {
+            write!(f, " -> {}", t)?;
+        }
+        write!(f, " {})", self.body)
+    }
+}
+
+impl FunctionDeclaration {
+    /// the parameters with a default come after the others, and before the
+    /// variadic one, which is last
+    pub fn arity(&self) -> Arity {
+        Arity::of(&self.parameters)
+    }
+}
+
+/// the pattern is a name, or destructures the argument as in `[a, b] :=`.
+/// The default is evaluated when a call leaves the parameter out, after the
+/// parameters before it are bound.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Parameter {
+    pub mutable: bool,
+    pub pattern: Pattern,
+    pub type_annotation: Option<TypeExpression>,
+    pub default: Option<Expression>,
+
+    /// whether it is written `..name`, taking the arguments given by
+    /// position past the others, as a list
+    pub variadic: bool,
+    pub span: SourceString,
+}
+
+impl Parameter {
+    /// the name an argument can be given by, parameters destructuring their
+    /// argument have none
+    pub fn name(&self) -> Option<&str> {
+        match &self.pattern {
+            Pattern::Binding(b) => Some(&b.name),
+            _ => None,
+        }
+    }
+}
+
+impl Display for Parameter {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        if self.mutable {
+            write!(f, "mut ")?;
+        }
+        if self.variadic {
+            write!(f, "..")?;
+        }
+        write!(f, "{}", self.pattern.written())?;
+        if let Some(t) = &self.type_annotation {
+            write!(f, ": {}", t)?;
+        }
+        if let Some(d) = &self.default {
+            write!(f, " = {}", d)?;
+        }
+        Ok(())
+    }
+}
+
+/// How many arguments a function takes
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct Arity {
+    /// the parameters without a default
+    pub required: usize,
+    pub optional: usize,
+
+    /// whether a last parameter takes any number of arguments
+    pub variadic: bool,
+}
+
+impl Arity {
+    fn of(parameters: &[Parameter]) -> Self {
+        let variadic = parameters.last().is_some_and(|p| p.variadic);
+        let optional = parameters.iter().filter(|p| p.default.is_some()).count();
+        Self {
+            required: parameters.len() - optional - variadic as usize,
+            optional,
+            variadic,
+        }
+    }
+
+    pub fn exactly(n: usize) -> Self {
+        Self {
+            required: n,
+            ..Self::default()
+        }
+    }
+
+    /// the number of parameters, the variadic one included
+    pub fn parameters(&self) -> usize {
+        self.required + self.optional + self.variadic as usize
+    }
+}
+
+/// as in `expects 1 to 3 arguments`
+impl Display for Arity {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let most = self.required + self.optional;
+        let plural = if most == 1 { "" } else { "s" };
+        if self.variadic {
+            let plural = if self.required == 1 { "" } else { "s" };
+            write!(f, "at least {} argument{}", self.required, plural)
+        } else if self.optional > 0 {
+            write!(f, "{} to {} arguments", self.required, most)
+        } else {
+            write!(f, "{} argument{}", most, plural)
+        }
+    }
+}
+
+/// `struct Point { x: int, y: int }`, a record type with named fields. The
+/// functions declared in its body are its methods, they take the instance
+/// as their first argument.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct StructDeclaration {
+    pub name: Identifier,
+    pub fields: Vec<Field>,
+    pub methods: Vec<Arc<FunctionDeclaration>>,
+    pub span: SourceString,
+}
+
+impl Display for StructDeclaration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(struct {} (", self.name)?;
+        for (i, field) in self.fields.iter().enumerate() {
+            if i > 0 {
+                write!(f, " ")?;
+            }
+            write!(f, "{}", field)?;
+        }
+        write!(f, ")")?;
+        for m in &self.methods {
+            write!(f, " {}", m)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `enum Result { Ok(value), Err(msg) }`, a type whose values are one of
+/// its variants. Each variant is a struct named `Result::Ok`, called with
+/// its fields, a variant without fields is a single value. The functions
+/// declared in its body are the methods of all its variants.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct EnumDeclaration {
+    pub name: Identifier,
+    pub variants: Vec<Variant>,
+    pub methods: Vec<Arc<FunctionDeclaration>>,
+    pub span: SourceString,
+}
+
+impl Display for EnumDeclaration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(enum {} (", self.name)?;
+        for (i, variant) in self.variants.iter().enumerate() {
+            if i > 0 {
+                write!(f, " ")?;
+            }
+            write!(f, "{}", variant)?;
+        }
+        write!(f, ")")?;
+        for m in &self.methods {
+            write!(f, " {}", m)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `Ok(value)`, or `None` without parentheses for one without fields
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Variant {
+    pub name: Identifier,
+    pub fields: Option<Vec<Field>>,
+    pub span: SourceString,
+}
+
+impl Display for Variant {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Some(fields) = &self.fields else {
+            return write!(f, "{}", self.name);
+        };
+        write!(f, "({}", self.name)?;
+        for field in fields {
+            write!(f, " {}", field)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `interface Shape { function area(self) -> float }`, the methods a value
+/// must have to be used where the interface is its type. Structs and enums
+/// have them without saying so, if they declare methods with those names
+/// and compatible types. An interface is only a type, for annotations, it is
+/// not a value.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct InterfaceDeclaration {
+    pub name: Identifier,
+    pub methods: Vec<MethodSignature>,
+    pub span: SourceString,
+}
+
+impl Display for InterfaceDeclaration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(interface {}", self.name)?;
+        for m in &self.methods {
+            write!(f, " {}", m)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `function area(self) -> float`, a method of an interface, which has no
+/// body. The first parameter is the receiver.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MethodSignature {
+    pub name: Identifier,
+    pub parameters: Vec<Parameter>,
+    pub return_type: Option<TypeExpression>,
+    pub span: SourceString,
+}
+
+impl Display for MethodSignature {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(function {} (", self.name)?;
+        for (i, p) in self.parameters.iter().enumerate() {
+            if i > 0 {
+                write!(f, " ")?;
+            }
+            write!(f, "{}", p)?;
+        }
+        write!(f, ")")?;
+        if let Some(t) = &self.return_type {
+            write!(f, " -> {}", t)?;
+        }
+        write!(f, ")")
+    }
+}
+
+impl MethodSignature {
+    pub fn arity(&self) -> Arity {
+        Arity::of(&self.parameters)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Field {
+    pub name: Identifier,
+    pub type_annotation: Option<TypeExpression>,
+    pub span: SourceString,
+}
+
+impl Display for Field {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.name)?;
+        if let Some(t) = &self.type_annotation {
+            write!(f, ": {}", t)?;
+        }
+        Ok(())
+    }
+}
+
+/// `target = value` or a compound assignment such as `target += value`
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Assignment {
+    pub target: Expression,
+    pub op: AssignOperator,
+    pub value: Expression,
+    pub span: SourceString,
+}
+
+impl Display for Assignment {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "({} {} {})", self.op, self.target, self.value)
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, serde::Serialize)]
+pub enum AssignOperator {
+    Assign,
+    Add,
+    Sub,
+    Mul,
+    Div,
+    Mod,
+    Concat,
+}
+
+impl AssignOperator {
+    /// the binary operator a compound assignment applies, if any
+    pub fn bin_operator(&self) -> Option<BinOperator> {
+        match self {
+            Self::Assign => None,
+            Self::Add => Some(BinOperator::Add),
+            Self::Sub => Some(BinOperator::Sub),
+            Self::Mul => Some(BinOperator::Mul),
+            Self::Div => Some(BinOperator::Div),
+            Self::Mod => Some(BinOperator::Mod),
+            Self::Concat => Some(BinOperator::Concat),
+        }
+    }
+}
+
+impl Display for AssignOperator {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self.bin_operator() {
+            Some(op) => write!(f, "{}=", op),
+            None => write!(f, "="),
+        }
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ExitStatement {
+    pub code: Expression,
+    pub span: SourceString,
+}
+
+impl Display for ExitStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(exit {})", self.code)
+    }
+}
+
+/// `throw value`, raises an error, or a new one with the value as message
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ThrowStatement {
+    pub value: Expression,
+    pub span: SourceString,
+}
+
+impl Display for ThrowStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(throw {})", self.value)
+    }
+}
+
+/// `defer value`, runs the value when the function it is in returns or
+/// raises an error, last deferred first. It is kept as a function without
+/// parameters, whose body is the value.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct DeferStatement {
+    pub function: Arc<FunctionDeclaration>,
+    pub span: SourceString,
+}
+
+impl DeferStatement {
+    /// the statement deferred
+    pub fn value(&self) -> &Statement {
+        &self.function.body.statements[0]
+    }
+}
+
+impl Display for DeferStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(defer {})", self.value())
+    }
+}
+
+/// `import a::b`, loads the module in `a/b.drgns` and binds it to `b`
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Import {
+    pub path: Vec<Identifier>,
+    pub span: SourceString,
+}
+
+impl Import {
+    /// the name the module is bound to
+    pub fn name(&self) -> &Identifier {
+        self.path.last().expect("the parser rejects empty paths")
+    }
+}
+
+impl Display for Import {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let path: Vec<&str> = self.path.iter().map(|i| i.name.as_str()).collect();
+        write!(f, "(import {})", path.join("::"))
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ReturnStatement {
+    pub value: Option<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for ReturnStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.value {
+            Some(v) => write!(f, "(return {})", v),
+            None => write!(f, "(return)"),
+        }
+    }
+}
+
+/// `yield value`, hands an item to whoever goes through the generator the
+/// function it is in returns
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct YieldStatement {
+    pub value: Option<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for YieldStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.value {
+            Some(v) => write!(f, "(yield {})", v),
+            None => write!(f, "(yield)"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct BreakStatement {
+    pub value: Option<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for BreakStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.value {
+            Some(v) => write!(f, "(break {})", v),
+            None => write!(f, "(break)"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ContinueStatement {
+    pub value: Option<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for ContinueStatement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.value {
+            Some(v) => write!(f, "(continue {})", v),
+            None => write!(f, "(continue)"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, derive_more::Display, serde::Serialize)]
 pub enum Expression {
-    BE(BinExpression),
-    UE(UnExpression),
-    LE(LitExpression),
+    Binary(BinExpression),
+    Unary(UnExpression),
+    Literal(LitExpression),
+    Variable(Identifier),
+    Group(GroupExpression),
+    Call(CallExpression),
+    Method(MethodExpression),
+    Field(FieldExpression),
+    Member(MemberExpression),
+    Lambda(LambdaExpression),
+    List(ListExpression),
+    Map(MapExpression),
+    Index(IndexExpression),
+    Block(BlockExpression),
+    If(IfExpression),
+    For(ForExpression),
+    ForIn(ForInExpression),
+    Match(MatchExpression),
+    Try(TryExpression),
+    Spawn(SpawnExpression),
 }
 
 impl Expression {
-    /// walk the expression tree, applying the visitor to each node. Nodes are
-    /// visited in postfix order, so evaluation can be implemented with a simple
-    /// stack machine
-    pub fn walk(&self, v: &mut impl Visitor<()>) {
-        match &self {
-            Self::BE(be) => be.walk(v),
-            Self::UE(ue) => ue.walk(v),
-            Self::LE(le) => le.walk(v),
+    pub fn span(&self) -> SourceString {
+        match self {
+            Self::Binary(e) => e.span.clone(),
+            Self::Unary(e) => e.span.clone(),
+            Self::Literal(e) => e.span.clone(),
+            Self::Variable(e) => e.span.clone(),
+            Self::Group(e) => e.span.clone(),
+            Self::Call(e) => e.span.clone(),
+            Self::Method(e) => e.span.clone(),
+            Self::Field(e) => e.span.clone(),
+            Self::Member(e) => e.span.clone(),
+            Self::Lambda(e) => e.function.span.clone(),
+            Self::List(e) => e.span.clone(),
+            Self::Map(e) => e.span.clone(),
+            Self::Index(e) => e.span.clone(),
+            Self::Block(e) => e.span.clone(),
+            Self::If(e) => e.span.clone(),
+            Self::For(e) => e.span.clone(),
+            Self::ForIn(e) => e.span.clone(),
+            Self::Match(e) => e.span.clone(),
+            Self::Try(e) => e.span.clone(),
+            Self::Spawn(e) => e.span.clone(),
+        }
+    }
+
+    /// whether the expression can appear on the left of an assignment
+    pub fn is_assignable(&self) -> bool {
+        match self {
+            Self::Variable(_) => true,
+            Self::Field(f) => !f.optional,
+            Self::Index(i) => matches!(i.index, Index::Single(_)),
+            _ => false,
         }
-        v.visit_expression(self);
     }
 }
 
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, serde::Serialize)]
 pub struct BinExpression {
     pub lhs: Box<Expression>,
     pub op: BinOperator,
     pub rhs: Box<Expression>,
-}
-
-impl BinExpression {
-    fn walk(&self, v: &mut impl Visitor<()>) {
-        self.rhs.walk(v);
-        self.lhs.walk(v);
-        self.op.walk(v);
-        v.visit_bin_expression(self);
-    }
+    pub span: SourceString,
 }
 
 impl Display for BinExpression {
@@ -45,7 +754,7 @@ impl Display for BinExpression {
     }
 }
 
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, Copy, PartialEq, serde::Serialize)]
 pub enum BinOperator {
     Pow,
     Mul,
@@ -53,11 +762,31 @@ pub enum BinOperator {
     Mod,
     Add,
     Sub,
+    Concat,
+    BitAnd,
+    BitOr,
+    BitXor,
+    Shl,
+    Lsr,
+    Asr,
+    Eq,
+    Ne,
+    Lt,
+    Le,
+    Gt,
+    Ge,
+    And,
+    Or,
+    Xor,
+    In,
+    /// `??`, the value on the right if the one on the left is `none`
+    Coalesce,
 }
 
 impl BinOperator {
-    fn walk(&self, v: &mut impl Visitor<()>) {
-        v.visit_bin_operator(self);
+    /// `and` and `or` only evaluate their right hand side when needed
+    pub fn is_short_circuit(&self) -> bool {
+        matches!(self, Self::And | Self::Or)
     }
 }
 
@@ -70,22 +799,33 @@ impl Display for BinOperator {
             Self::Mod => write!(f, "%"),
             Self::Add => write!(f, "+"),
             Self::Sub => write!(f, "-"),
+            Self::Concat => write!(f, "++"),
+            Self::BitAnd => write!(f, "land"),
+            Self::BitOr => write!(f, "lor"),
+            Self::BitXor => write!(f, "lxor"),
+            Self::Shl => write!(f, "lsl"),
+            Self::Lsr => write!(f, "lsr"),
+            Self::Asr => write!(f, "asr"),
+            Self::Eq => write!(f, "=="),
+            Self::Ne => write!(f, "!="),
+            Self::Lt => write!(f, "<"),
+            Self::Le => write!(f, "<="),
+            Self::Gt => write!(f, ">"),
+            Self::Ge => write!(f, ">="),
+            Self::And => write!(f, "and"),
+            Self::Or => write!(f, "or"),
+            Self::Xor => write!(f, "xor"),
+            Self::Coalesce => write!(f, "??"),
+            Self::In => write!(f, "in"),
         }
     }
 }
 
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, serde::Serialize)]
 pub struct UnExpression {
     pub op: UnOperator,
     pub rhs: Box<Expression>,
-}
-
-impl UnExpression {
-    fn walk(&self, v: &mut impl Visitor<()>) {
-        self.rhs.walk(v);
-        self.op.walk(v);
-        v.visit_un_expression(self);
-    }
+    pub span: SourceString,
 }
 
 impl Display for UnExpression {
@@ -94,39 +834,1031 @@ impl Display for UnExpression {
     }
 }
 
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, Copy, PartialEq, serde::Serialize)]
 pub enum UnOperator {
     Neg,
-}
+    Not,
+    BitNot,
 
-impl UnOperator {
-    fn walk(&self, v: &mut impl Visitor<()>) {
-        v.visit_un_operator(self);
-    }
+    /// conversion to a string, there is no syntax for it, string
+    /// interpolation produces it
+    Str,
 }
 
 impl Display for UnOperator {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         match self {
             Self::Neg => write!(f, "-"),
+            Self::Not => write!(f, "not"),
+            Self::BitNot => write!(f, "lnot"),
+            Self::Str => write!(f, "str"),
         }
     }
 }
 
-#[derive(Debug, Clone, derive_more::Display)]
-pub struct LitExpression(pub Value);
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct LitExpression {
+    pub value: Literal,
+    pub span: SourceString,
+}
 
-impl LitExpression {
-    fn walk(&self, v: &mut impl Visitor<()>) {
-        v.visit_lit_expression(self)
+impl Display for LitExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.value)
     }
 }
 
-pub trait Visitor<T> {
-    fn visit_expression(&mut self, e: &Expression) -> T;
-    fn visit_bin_expression(&mut self, be: &BinExpression) -> T;
-    fn visit_bin_operator(&mut self, bo: &BinOperator) -> T;
-    fn visit_un_expression(&mut self, ue: &UnExpression) -> T;
-    fn visit_un_operator(&mut self, uo: &UnOperator) -> T;
-    fn visit_lit_expression(&mut self, le: &LitExpression) -> T;
+#[derive(Debug, Clone, PartialEq, serde::Serialize)]
+pub enum Literal {
+    None,
+    Bool(bool),
+    Int(i64),
+    Float(f64),
+    String(String),
+    Symbol(String),
+    Bytes(Vec<u8>),
+}
+
+impl Display for Literal {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::None => write!(f, "none"),
+            Self::Bool(b) => write!(f, "{}", b),
+            Self::Int(i) => write!(f, "{}", i),
+            Self::Float(x) => write!(f, "{:?}", x),
+            Self::String(s) => write!(f, "{:?}", s),
+            Self::Symbol(s) => write!(f, "^{}", s),
+            Self::Bytes(b) => write!(f, "b\"{}\"", super::escape_bytes(b)),
+        }
+    }
+}
+
+/// A parenthesized expression, kept in the tree so that tools can reproduce
+/// the source faithfully
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct GroupExpression {
+    pub inner: Box<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for GroupExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.inner)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct CallExpression {
+    pub callee: Box<Expression>,
+    pub arguments: Vec<Expression>,
+    pub named: Vec<NamedArgument>,
+    pub span: SourceString,
+
+    /// whether it is written `first |> callee(rest)`, which is only kept for
+    /// printing it back
+    pub piped: bool,
+}
+
+impl Display for CallExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(call {}", self.callee)?;
+        for a in &self.arguments {
+            write!(f, " {}", a)?;
+        }
+        for n in &self.named {
+            write!(f, " {}", n)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `name = value` in the arguments of a call, after those given by position
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct NamedArgument {
+    pub name: Identifier,
+    pub value: Expression,
+    pub span: SourceString,
+}
+
+impl Display for NamedArgument {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(= {} {})", self.name, self.value)
+    }
+}
+
+/// An application such as `receiver.name(arguments)`, which calls `name`
+/// with the receiver as the first argument
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MethodExpression {
+    pub receiver: Box<Expression>,
+    pub name: Identifier,
+    pub arguments: Vec<Expression>,
+    pub named: Vec<NamedArgument>,
+
+    /// `receiver?.name()`, the call is only made if the receiver isn't
+    /// `none`, which is the value otherwise
+    pub optional: bool,
+    pub span: SourceString,
+}
+
+impl Display for MethodExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let apply = if self.optional { "?apply" } else { "apply" };
+        write!(f, "({} {} {}", apply, self.name, self.receiver)?;
+        for a in &self.arguments {
+            write!(f, " {}", a)?;
+        }
+        for n in &self.named {
+            write!(f, " {}", n)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `module::name`, an exported symbol of a module
+/// `target.name`, a field of an instance of a struct
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct FieldExpression {
+    pub target: Box<Expression>,
+    pub name: Identifier,
+
+    /// `target?.name`, `none` if the target is
+    pub optional: bool,
+    pub span: SourceString,
+}
+
+impl Display for FieldExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let dot = if self.optional { "?." } else { "." };
+        write!(f, "({} {} {})", dot, self.target, self.name)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MemberExpression {
+    pub module: Box<Expression>,
+    pub name: Identifier,
+    pub span: SourceString,
+}
+
+impl Display for MemberExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(:: {} {})", self.module, self.name)
+    }
+}
+
+/// An anonymous function, `(x) -> x + 1` or `(x: int) -> int { x + 1 }`.
+/// Bodies made of a single statement are wrapped in a block, and
+/// declarations such as `f := (x) -> x` name the function after the variable.
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct LambdaExpression {
+    pub function: Arc<FunctionDeclaration>,
+}
+
+impl Display for LambdaExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let function = &self.function;
+        write!(f, "(-> (")?;
+        for (i, p) in function.parameters.iter().enumerate() {
+            if i > 0 {
+                write!(f, " ")?;
+            }
+            write!(f, "{}", p)?;
+        }
+        write!(f, ")")?;
+        if let Some(t) = &function.return_type {
+            write!(f, " {}", t)?;
+        }
+        write!(f, " {})", function.body)
+    }
+}
+
+/// `[1, 2, 3]`, items may also be separated by newlines
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ListExpression {
+    pub items: Vec<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for ListExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(list")?;
+        for i in &self.items {
+            write!(f, " {}", i)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `{key: value}`, entries are separated like the items of lists
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MapExpression {
+    pub entries: Vec<(Expression, Expression)>,
+    pub span: SourceString,
+}
+
+impl Display for MapExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(map")?;
+        for (k, v) in &self.entries {
+            write!(f, " ({} {})", k, v)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `target[index]` or a slice such as `target[start:end:step]`
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct IndexExpression {
+    pub target: Box<Expression>,
+    pub index: Index,
+    pub span: SourceString,
+}
+
+impl Display for IndexExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.index {
+            Index::Single(i) => write!(f, "([] {} {})", self.target, i),
+            Index::Slice { start, end, step } => {
+                write!(f, "([:] {}", self.target)?;
+                for part in [start, end, step] {
+                    match part {
+                        Some(e) => write!(f, " {}", e)?,
+                        None => write!(f, " _")?,
+                    }
+                }
+                write!(f, ")")
+            }
+        }
+    }
+}
+
+/// Negative indices count from the end, the parts of a slice can be omitted
+#[derive(Debug, Clone, serde::Serialize)]
+pub enum Index {
+    Single(Box<Expression>),
+    Slice {
+        start: Option<Box<Expression>>,
+        end: Option<Box<Expression>>,
+        step: Option<Box<Expression>>,
+    },
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct BlockExpression {
+    pub statements: Vec<Statement>,
+    pub span: SourceString,
+}
+
+impl Display for BlockExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(block")?;
+        for s in &self.statements {
+            write!(f, " {}", s)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `if` with any number of `elif` branches and an optional `else`
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct IfExpression {
+    pub branches: Vec<(Expression, BlockExpression)>,
+    pub otherwise: Option<BlockExpression>,
+    pub span: SourceString,
+}
+
+impl Display for IfExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(if")?;
+        for (c, b) in &self.branches {
+            write!(f, " {} {}", c, b)?;
+        }
+        if let Some(b) = &self.otherwise {
+            write!(f, " else {}", b)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// A loop, without a condition it runs until it's broken out of
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ForExpression {
+    pub condition: Option<Box<Expression>>,
+    pub body: BlockExpression,
+    pub span: SourceString,
+}
+
+impl Display for ForExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.condition {
+            Some(c) => write!(f, "(for {} {})", c, self.body),
+            None => write!(f, "(for {})", self.body),
+        }
+    }
+}
+
+/// `for item in iterable { ... }`, the item is bound anew in each iteration,
+/// to a name or the names of a pattern destructuring it
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ForInExpression {
+    pub binding: Pattern,
+    pub iterable: Box<Expression>,
+    pub body: BlockExpression,
+    pub span: SourceString,
+}
+
+impl Display for ForInExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "(for {} in {} {})",
+            self.binding, self.iterable, self.body
+        )
+    }
+}
+
+/// `match subject { pattern -> value ... }`, evaluates the first arm whose
+/// pattern matches the subject and whose guard, if any, holds
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MatchExpression {
+    pub subject: Box<Expression>,
+    pub arms: Vec<MatchArm>,
+    pub span: SourceString,
+}
+
+impl Display for MatchExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(match {}", self.subject)?;
+        for a in &self.arms {
+            write!(f, " {}", a)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `pattern if guard -> value`, the names bound by the pattern are only
+/// visible in the guard and the value
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MatchArm {
+    pub pattern: Pattern,
+    pub guard: Option<Expression>,
+    pub body: Expression,
+    pub span: SourceString,
+}
+
+impl Display for MatchArm {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.guard {
+            Some(g) => write!(f, "({} if {} {})", self.pattern, g, self.body),
+            None => write!(f, "({} {})", self.pattern, self.body),
+        }
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub enum Pattern {
+    /// `_`, matches anything
+    Wildcard(SourceString),
+
+    /// matches values equal to the literal
+    Literal(LitExpression),
+
+    /// a name, matches anything and binds it to the name
+    Binding(Identifier),
+
+    /// `[first, ..rest]`
+    List(ListPattern),
+
+    /// `{"key": pattern}`, matches maps having at least these keys
+    Map(MapPattern),
+
+    /// `Result::Ok(value)`, matches the values of a variant of an enum
+    Variant(VariantPattern),
+}
+
+impl Pattern {
+    pub fn span(&self) -> SourceString {
+        match self {
+            Self::Wildcard(s) => s.clone(),
+            Self::Literal(l) => l.span.clone(),
+            Self::Binding(i) => i.span.clone(),
+            Self::List(l) => l.span.clone(),
+            Self::Map(m) => m.span.clone(),
+            Self::Variant(v) => v.span.clone(),
+        }
+    }
+
+    /// the names bound by the pattern, from left to right
+    pub fn bindings(&self) -> Vec<&Identifier> {
+        let mut bindings = vec![];
+        self.collect_bindings(&mut bindings);
+        bindings
+    }
+
+    fn collect_bindings<'a>(&'a self, bindings: &mut Vec<&'a Identifier>) {
+        match self {
+            Self::Wildcard(_) | Self::Literal(_) => {}
+            Self::Binding(i) => bindings.push(i),
+            Self::List(l) => {
+                let (before, after) = l.split();
+                for p in before {
+                    p.collect_bindings(bindings);
+                }
+                if let Some(b) = l.rest.as_ref().and_then(|r| r.binding.as_ref()) {
+                    bindings.push(b);
+                }
+                for p in after {
+                    p.collect_bindings(bindings);
+                }
+            }
+            Self::Map(m) => {
+                for (_, p) in &m.entries {
+                    p.collect_bindings(bindings);
+                }
+            }
+            Self::Variant(v) => {
+                for p in v.fields.iter().flatten() {
+                    p.collect_bindings(bindings);
+                }
+            }
+        }
+    }
+
+    /// whether the pattern matches every value
+    pub fn is_irrefutable(&self) -> bool {
+        matches!(self, Self::Wildcard(_) | Self::Binding(_))
+    }
+
+    /// the pattern as it is written, an entry of a map pattern whose key is
+    /// the name it binds is written as the name alone
+    pub fn written(&self) -> String {
+        let join = |items: Vec<String>| items.join(", ");
+        match self {
+            Self::Wildcard(_) => "_".to_owned(),
+            Self::Literal(l) => l.span.to_string(),
+            Self::Binding(i) => i.name.clone(),
+            Self::List(l) => {
+                let (before, after) = l.split();
+                let rest = l.rest.as_ref().map(|r| match &r.binding {
+                    Some(b) => format!("..{}", b.name),
+                    None => "..".to_owned(),
+                });
+                let items = before
+                    .iter()
+                    .map(Self::written)
+                    .chain(rest)
+                    .chain(after.iter().map(Self::written));
+                format!("[{}]", join(items.collect()))
+            }
+            Self::Map(m) => {
+                let entries = m.entries.iter().map(|(key, value)| match value {
+                    Self::Binding(b) if b.span.start() == key.span.start() => b.name.clone(),
+                    value => format!("{}: {}", key.span, value.written()),
+                });
+                format!("{{{}}}", join(entries.collect()))
+            }
+            Self::Variant(v) => match &v.fields {
+                Some(fields) => {
+                    let fields = fields.iter().map(Self::written);
+                    format!("{}({})", v.name(), join(fields.collect()))
+                }
+                None => v.name(),
+            },
+        }
+    }
+}
+
+impl Display for Pattern {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Wildcard(_) => write!(f, "_"),
+            Self::Literal(l) => write!(f, "{}", l),
+            Self::Binding(i) => write!(f, "{}", i),
+            Self::List(l) => write!(f, "{}", l),
+            Self::Map(m) => write!(f, "{}", m),
+            Self::Variant(v) => write!(f, "{}", v),
+        }
+    }
+}
+
+/// the items before the rest must match the first items of the list, the
+/// ones after it the last ones
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct ListPattern {
+    pub items: Vec<Pattern>,
+    pub rest: Option<Rest>,
+    pub span: SourceString,
+}
+
+impl ListPattern {
+    /// the patterns of the items before and after the rest
+    pub fn split(&self) -> (&[Pattern], &[Pattern]) {
+        let position = self.rest.as_ref().map_or(self.items.len(), |r| r.position);
+        self.items.split_at(position)
+    }
+}
+
+impl Display for ListPattern {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let (before, after) = self.split();
+        write!(f, "(list")?;
+        for p in before {
+            write!(f, " {}", p)?;
+        }
+        if let Some(r) = &self.rest {
+            match &r.binding {
+                Some(b) => write!(f, " ..{}", b)?,
+                None => write!(f, " ..")?,
+            }
+        }
+        for p in after {
+            write!(f, " {}", p)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `..` or `..name` in a list pattern, matches any number of items
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct Rest {
+    /// the number of item patterns before it
+    pub position: usize,
+
+    /// bound to a list of the items it matches
+    pub binding: Option<Identifier>,
+}
+
+/// the keys are literal ints, strings or symbols
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct MapPattern {
+    pub entries: Vec<(LitExpression, Pattern)>,
+    pub span: SourceString,
+}
+
+impl Display for MapPattern {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(map")?;
+        for (k, p) in &self.entries {
+            write!(f, " ({} {})", k, p)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// the path is the one of the variant, `Result::Ok` or `module::Result::Ok`,
+/// without fields it matches every value of the variant, with them the
+/// values whose fields match them, in the order they are declared
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct VariantPattern {
+    pub path: Vec<Identifier>,
+    pub fields: Option<Vec<Pattern>>,
+    pub span: SourceString,
+}
+
+impl VariantPattern {
+    /// the name of the struct of the variant, `Result::Ok`; values match by
+    /// it, whatever module declares the enum
+    pub fn variant(&self) -> String {
+        let n = self.path.len();
+        format!("{}::{}", self.path[n - 2].name, self.path[n - 1].name)
+    }
+
+    /// the path as it is written
+    pub fn name(&self) -> String {
+        let path: Vec<&str> = self.path.iter().map(|i| i.name.as_str()).collect();
+        path.join("::")
+    }
+}
+
+impl Display for VariantPattern {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Some(fields) = &self.fields else {
+            return write!(f, "{}", self.name());
+        };
+        write!(f, "({}", self.name())?;
+        for p in fields {
+            write!(f, " {}", p)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `try` followed by a `catch`, a `finally` or both
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct TryExpression {
+    pub body: BlockExpression,
+    pub catch: Option<CatchClause>,
+    pub finally: Option<BlockExpression>,
+    pub span: SourceString,
+}
+
+impl Display for TryExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(try {}", self.body)?;
+        if let Some(c) = &self.catch {
+            write!(f, " {}", c)?;
+        }
+        if let Some(b) = &self.finally {
+            write!(f, " finally {}", b)?;
+        }
+        write!(f, ")")
+    }
+}
+
+/// `catch e { ... }`, the name of the error is optional
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct CatchClause {
+    pub name: Option<Identifier>,
+    pub body: BlockExpression,
+}
+
+impl Display for CatchClause {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.name {
+            Some(n) => write!(f, "catch {} {}", n, self.body),
+            None => write!(f, "catch {}", self.body),
+        }
+    }
+}
+
+/// `spawn f(arguments)`, runs the call on a task of its own and is the task,
+/// the callee and the arguments are evaluated before it starts
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct SpawnExpression {
+    /// a call or a method call, see `Parser::parse_spawn`
+    pub call: Box<Expression>,
+    pub span: SourceString,
+}
+
+impl Display for SpawnExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "(spawn {})", self.call)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize)]
+pub enum TypeExpression {
+    /// a named type such as `int`, or `none`
+    Name(Identifier),
+
+    /// a generic type such as `list[int]`
+    Generic(Identifier, Vec<TypeExpression>, SourceString),
+
+    /// a sum type, such as `int | none`
+    Union(Vec<TypeExpression>, SourceString),
+
+    /// a product type, such as `(int, int)`
+    Tuple(Vec<TypeExpression>, SourceString),
+}
+
+impl TypeExpression {
+    pub fn span(&self) -> SourceString {
+        match self {
+            Self::Name(i) => i.span.clone(),
+            Self::Generic(_, _, s) | Self::Union(_, s) | Self::Tuple(_, s) => s.clone(),
+        }
+    }
+}
+
+impl Display for TypeExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let join = |ts: &[TypeExpression], sep: &str| {
+            ts.iter()
+                .map(|t| t.to_string())
+                .collect::<Vec<_>>()
+                .join(sep)
+        };
+        match self {
+            Self::Name(i) => write!(f, "{}", i),
+            Self::Generic(i, args, _) => write!(f, "{}[{}]", i, join(args, ", ")),
+            Self::Union(ts, _) => write!(f, "{}", join(ts, " | ")),
+            Self::Tuple(ts, _) => write!(f, "({})", join(ts, ", ")),
+        }
+    }
+}
+
+/// Traverses the syntax tree. Every method defaults to visiting the children
+/// of the node, so implementors only override the nodes they care about, and
+/// can call the matching `walk_*` function to keep descending.
+pub trait Visitor: Sized {
+    fn visit_program(&mut self, p: &Program) {
+        walk_program(self, p)
+    }
+
+    fn visit_statement(&mut self, s: &Statement) {
+        walk_statement(self, s)
+    }
+
+    fn visit_declaration(&mut self, d: &Declaration) {
+        walk_declaration(self, d)
+    }
+
+    fn visit_destructuring(&mut self, d: &Destructuring) {
+        walk_destructuring(self, d)
+    }
+
+    fn visit_function(&mut self, f: &FunctionDeclaration) {
+        walk_function(self, f)
+    }
+
+    fn visit_struct(&mut self, s: &StructDeclaration) {
+        walk_struct(self, s)
+    }
+
+    fn visit_enum(&mut self, e: &EnumDeclaration) {
+        walk_enum(self, e)
+    }
+
+    fn visit_interface(&mut self, i: &InterfaceDeclaration) {
+        walk_interface(self, i)
+    }
+
+    fn visit_expression(&mut self, e: &Expression) {
+        walk_expression(self, e)
+    }
+
+    fn visit_block(&mut self, b: &BlockExpression) {
+        walk_block(self, b)
+    }
+
+    fn visit_catch(&mut self, c: &CatchClause) {
+        walk_catch(self, c)
+    }
+
+    fn visit_for_in(&mut self, f: &ForInExpression) {
+        walk_for_in(self, f)
+    }
+
+    fn visit_match_arm(&mut self, a: &MatchArm) {
+        walk_match_arm(self, a)
+    }
+
+    fn visit_identifier(&mut self, _i: &Identifier) {}
+
+    fn visit_type(&mut self, _t: &TypeExpression) {}
+}
+
+pub fn walk_program(v: &mut impl Visitor, p: &Program) {
+    for s in &p.statements {
+        v.visit_statement(s);
+    }
+}
+
+pub fn walk_statement(v: &mut impl Visitor, s: &Statement) {
+    match s {
+        Statement::Declaration(d) => v.visit_declaration(d),
+        Statement::Destructuring(d) => v.visit_destructuring(d),
+        Statement::Function(f) => v.visit_function(f),
+        Statement::Struct(s) => v.visit_struct(s),
+        Statement::Enum(e) => v.visit_enum(e),
+        Statement::Interface(i) => v.visit_interface(i),
+        Statement::Assignment(a) => {
+            v.visit_expression(&a.target);
+            v.visit_expression(&a.value);
+        }
+        Statement::Expression(e) => v.visit_expression(e),
+        Statement::Exit(e) => v.visit_expression(&e.code),
+        Statement::Throw(t) => v.visit_expression(&t.value),
+        Statement::Defer(d) => v.visit_function(&d.function),
+        Statement::Import(i) => v.visit_identifier(i.name()),
+        Statement::Return(ReturnStatement { value, .. })
+        | Statement::Yield(YieldStatement { value, .. })
+        | Statement::Break(BreakStatement { value, .. })
+        | Statement::Continue(ContinueStatement { value, .. }) => {
+            if let Some(e) = value {
+                v.visit_expression(e);
+            }
+        }
+    }
+}
+
+pub fn walk_declaration(v: &mut impl Visitor, d: &Declaration) {
+    if let Some(t) = &d.type_annotation {
+        v.visit_type(t);
+    }
+    v.visit_expression(&d.value);
+    v.visit_identifier(&d.name);
+}
+
+pub fn walk_destructuring(v: &mut impl Visitor, d: &Destructuring) {
+    if let Some(t) = &d.type_annotation {
+        v.visit_type(t);
+    }
+    v.visit_expression(&d.value);
+    for b in d.pattern.bindings() {
+        v.visit_identifier(b);
+    }
+}
+
+pub fn walk_function(v: &mut impl Visitor, f: &FunctionDeclaration) {
+    v.visit_identifier(&f.name);
+    walk_signature(v, &f.parameters, &f.return_type);
+    v.visit_block(&f.body);
+}
+
+fn walk_signature(
+    v: &mut impl Visitor,
+    parameters: &[Parameter],
+    return_type: &Option<TypeExpression>,
+) {
+    for p in parameters {
+        for b in p.pattern.bindings() {
+            v.visit_identifier(b);
+        }
+        if let Some(t) = &p.type_annotation {
+            v.visit_type(t);
+        }
+        if let Some(d) = &p.default {
+            v.visit_expression(d);
+        }
+    }
+    if let Some(t) = return_type {
+        v.visit_type(t);
+    }
+}
+
+pub fn walk_struct(v: &mut impl Visitor, s: &StructDeclaration) {
+    v.visit_identifier(&s.name);
+    for f in &s.fields {
+        v.visit_identifier(&f.name);
+        if let Some(t) = &f.type_annotation {
+            v.visit_type(t);
+        }
+    }
+    for m in &s.methods {
+        v.visit_function(m);
+    }
+}
+
+pub fn walk_enum(v: &mut impl Visitor, e: &EnumDeclaration) {
+    v.visit_identifier(&e.name);
+    for variant in &e.variants {
+        v.visit_identifier(&variant.name);
+        for f in variant.fields.iter().flatten() {
+            v.visit_identifier(&f.name);
+            if let Some(t) = &f.type_annotation {
+                v.visit_type(t);
+            }
+        }
+    }
+    for m in &e.methods {
+        v.visit_function(m);
+    }
+}
+
+pub fn walk_interface(v: &mut impl Visitor, i: &InterfaceDeclaration) {
+    v.visit_identifier(&i.name);
+    for m in &i.methods {
+        v.visit_identifier(&m.name);
+        walk_signature(v, &m.parameters, &m.return_type);
+    }
+}
+
+pub fn walk_block(v: &mut impl Visitor, b: &BlockExpression) {
+    for s in &b.statements {
+        v.visit_statement(s);
+    }
+}
+
+pub fn walk_catch(v: &mut impl Visitor, c: &CatchClause) {
+    if let Some(n) = &c.name {
+        v.visit_identifier(n);
+    }
+    v.visit_block(&c.body);
+}
+
+pub fn walk_for_in(v: &mut impl Visitor, f: &ForInExpression) {
+    v.visit_expression(&f.iterable);
+    for b in f.binding.bindings() {
+        v.visit_identifier(b);
+    }
+    v.visit_block(&f.body);
+}
+
+pub fn walk_match_arm(v: &mut impl Visitor, a: &MatchArm) {
+    for b in a.pattern.bindings() {
+        v.visit_identifier(b);
+    }
+    if let Some(g) = &a.guard {
+        v.visit_expression(g);
+    }
+    v.visit_expression(&a.body);
+}
+
+pub fn walk_expression(v: &mut impl Visitor, e: &Expression) {
+    match e {
+        Expression::Binary(be) => {
+            v.visit_expression(&be.lhs);
+            v.visit_expression(&be.rhs);
+        }
+        Expression::Unary(ue) => v.visit_expression(&ue.rhs),
+        Expression::Literal(_) => {}
+        Expression::Variable(i) => v.visit_identifier(i),
+        Expression::Group(g) => v.visit_expression(&g.inner),
+        Expression::Call(c) => {
+            v.visit_expression(&c.callee);
+            for a in &c.arguments {
+                v.visit_expression(a);
+            }
+            for n in &c.named {
+                v.visit_expression(&n.value);
+            }
+        }
+        Expression::Method(m) => {
+            v.visit_expression(&m.receiver);
+            v.visit_identifier(&m.name);
+            for a in &m.arguments {
+                v.visit_expression(a);
+            }
+            for n in &m.named {
+                v.visit_expression(&n.value);
+            }
+        }
+        Expression::Field(f) => {
+            v.visit_expression(&f.target);
+            v.visit_identifier(&f.name);
+        }
+        Expression::Member(m) => {
+            v.visit_expression(&m.module);
+            v.visit_identifier(&m.name);
+        }
+        Expression::Lambda(l) => v.visit_function(&l.function),
+        Expression::List(l) => {
+            for i in &l.items {
+                v.visit_expression(i);
+            }
+        }
+        Expression::Map(m) => {
+            for (k, value) in &m.entries {
+                v.visit_expression(k);
+                v.visit_expression(value);
+            }
+        }
+        Expression::Index(i) => {
+            v.visit_expression(&i.target);
+            match &i.index {
+                Index::Single(e) => v.visit_expression(e),
+                Index::Slice { start, end, step } => {
+                    for e in [start, end, step].into_iter().flatten() {
+                        v.visit_expression(e);
+                    }
+                }
+            }
+        }
+        Expression::Block(b) => v.visit_block(b),
+        Expression::If(i) => {
+            for (c, b) in &i.branches {
+                v.visit_expression(c);
+                v.visit_block(b);
+            }
+            if let Some(b) = &i.otherwise {
+                v.visit_block(b);
+            }
+        }
+        Expression::For(f) => {
+            if let Some(c) = &f.condition {
+                v.visit_expression(c);
+            }
+            v.visit_block(&f.body);
+        }
+        Expression::ForIn(f) => v.visit_for_in(f),
+        Expression::Match(m) => {
+            v.visit_expression(&m.subject);
+            for a in &m.arms {
+                v.visit_match_arm(a);
+            }
+        }
+        Expression::Try(t) => {
+            v.visit_block(&t.body);
+            if let Some(c) = &t.catch {
+                v.visit_catch(c);
+            }
+            if let Some(b) = &t.finally {
+                v.visit_block(b);
+            }
+        }
+        Expression::Spawn(s) => v.visit_expression(&s.call),
+    }
+}
+
+/// Whether a body yields, not counting the functions declared in it, which
+/// are generators of their own
+pub fn yields(body: &BlockExpression) -> bool {
+    struct Yields(bool);
+
+    impl Visitor for Yields {
+        fn visit_statement(&mut self, s: &Statement) {
+            match s {
+                Statement::Yield(_) => self.0 = true,
+                _ => walk_statement(self, s),
+            }
+        }
+
+        fn visit_function(&mut self, _f: &FunctionDeclaration) {}
+    }
+
+    let mut v = Yields(false);
+    v.visit_block(body);
+    v.0
 }
@@ -0,0 +1,569 @@
+//! Parsing again after an edit, reusing the statements it left alone.
+//!
+//! The source edited is lexed again in full, which is cheap next to parsing,
+//! and so that a string or a comment the edit opens or closes changes the
+//! tokens after it. The parse of a top-level statement only depends on the
+//! tokens from its first to the last one the parser looked at, its lookahead
+//! included. Where the new tokens are the same as those, with the same text
+//! and each moved by the same number of characters, the statement parsed
+//! before is taken instead of parsing it again, its spans moved along. The
+//! statements the parser reported errors in are always parsed again, as
+//! their errors would have to be too.
+
+use std::{collections::HashMap, ops::Range, rc::Rc, sync::Arc};
+
+use crate::{
+    doc,
+    eh::{DragonError, ErrorHandler},
+    lexer::Token,
+    source::{Source, SourceString},
+};
+
+use super::*;
+
+/// A change to a source, replacing the characters in the range with the text
+#[derive(Debug, Clone, PartialEq)]
+pub struct Edit {
+    /// the char indices of the characters replaced, past the end of the
+    /// source they are taken to be at its end
+    pub range: Range<usize>,
+    pub text: String,
+}
+
+/// A parsed source, which can be edited and parsed again faster than the
+/// edited source could be, for the language server
+pub struct Tree {
+    pub program: Program,
+
+    /// the errors of the lexer and the parser, as `parse` returns them
+    pub errors: Vec<DragonError>,
+
+    tokens: Vec<Token>,
+
+    /// for each of the statements of the program
+    parsed: Vec<Parsed>,
+
+    /// how many statements were taken from the tree before the edit
+    reused: usize,
+}
+
+/// What a top-level statement was parsed from
+#[derive(Debug, Clone)]
+pub(super) struct Parsed {
+    /// the indices of the tokens it was parsed from
+    pub tokens: Range<usize>,
+
+    /// the index past the last token the parser looked at, the one past the
+    /// last token if it looked for the end of the input
+    pub reach: usize,
+
+    /// whether the parser reported no errors in it
+    pub clean: bool,
+}
+
+/// The statements of the parse before an edit, until reused
+pub(super) struct Previous {
+    statements: Vec<Option<Statement>>,
+    parsed: Vec<Parsed>,
+    tokens: Vec<Token>,
+
+    /// the statement starting at each char index
+    starts: HashMap<usize, usize>,
+
+    /// how many characters the edit added, or removed if negative
+    shift: isize,
+    reused: usize,
+}
+
+impl Tree {
+    pub fn new(source: &Arc<Source>) -> Self {
+        Self::parse(source, None)
+    }
+
+    fn parse(source: &Arc<Source>, previous: Option<Previous>) -> Self {
+        let eh = Rc::new(ErrorHandler::new());
+        let mut parser = Parser::from_source(source, &eh);
+        parser.previous = previous;
+        let program = parser.parse_program();
+        Self {
+            program,
+            errors: eh.take_errors(),
+            tokens: parser.tokens,
+            parsed: parser.parsed,
+            reused: parser.previous.map_or(0, |p| p.reused),
+        }
+    }
+
+    /// Apply the edit to the source and parse it again, the tree of the
+    /// edited source is the same as `parse` would return
+    pub fn edit(self, edit: &Edit) -> Self {
+        let old = &self.program.source;
+        let start = edit.range.start.min(old.len());
+        let end = edit.range.end.clamp(start, old.len());
+        let text = format!(
+            "{}{}{}",
+            old.slice(0..start),
+            edit.text,
+            old.slice(end..old.len())
+        );
+        let source = Arc::new(Source::new(old.path().map(str::to_owned), text));
+        let shift = edit.text.chars().count() as isize - (end - start) as isize;
+        let starts = self
+            .program
+            .statements
+            .iter()
+            .enumerate()
+            .map(|(i, s)| (s.span().start(), i))
+            .collect();
+        let previous = Previous {
+            statements: self.program.statements.into_iter().map(Some).collect(),
+            parsed: self.parsed,
+            tokens: self.tokens,
+            starts,
+            shift,
+            reused: 0,
+        };
+        Self::parse(&source, Some(previous))
+    }
+
+    /// how many statements were taken from the tree before the last edit
+    /// rather than parsed again
+    pub fn reused(&self) -> usize {
+        self.reused
+    }
+}
+
+impl Parser {
+    /// The statement of the parse before the edit that starts at the current
+    /// token, if its tokens are still the same
+    pub(super) fn reuse(&mut self) -> Option<Statement> {
+        let previous = self.previous.as_mut()?;
+        let first = self.current;
+        let start = self.tokens.get(first)?.lexeme.start() as isize;
+        // unmoved before the edit, moved by the edit after it
+        let shifts = match previous.shift {
+            0 => vec![0],
+            shift => vec![0, shift],
+        };
+        let (i, by) = shifts.into_iter().find_map(|by| {
+            let i = *previous.starts.get(&usize::try_from(start - by).ok()?)?;
+            let same = previous.statements[i].is_some()
+                && previous.parsed[i].clean
+                && same_tokens(
+                    &previous.tokens,
+                    &previous.parsed[i],
+                    &self.tokens[first..],
+                    by,
+                );
+            same.then_some((i, by))
+        })?;
+        let mut statement = previous.statements[i].take()?;
+        previous.reused += 1;
+        let parsed = &previous.parsed[i];
+        let consumed = parsed.tokens.len();
+        self.parsed.push(Parsed {
+            tokens: first..first + consumed,
+            reach: first + parsed.reach - parsed.tokens.start,
+            clean: true,
+        });
+        self.current = first + consumed;
+        statement.rebase(&Shift {
+            source: &self.source,
+            by,
+            comments: &self.comments,
+        });
+        Some(statement)
+    }
+}
+
+/// whether the tokens a statement was parsed from start the new tokens, as
+/// far as the parser looked, each moved by `by` characters
+fn same_tokens(old: &[Token], parsed: &Parsed, new: &[Token], by: isize) -> bool {
+    (parsed.tokens.start..parsed.reach)
+        .enumerate()
+        .all(|(j, o)| match (old.get(o), new.get(j)) {
+            // both end there
+            (None, None) => true,
+            (Some(a), Some(b)) => {
+                a.token_type == b.token_type
+                    && b.lexeme.start() as isize - a.lexeme.start() as isize == by
+                    && a.lexeme.len() == b.lexeme.len()
+                    && a.lexeme.to_string() == b.lexeme.to_string()
+            }
+            _ => false,
+        })
+}
+
+/// moves spans to the source edited
+struct Shift<'a> {
+    source: &'a Arc<Source>,
+    by: isize,
+
+    /// of the source edited, the documentation of a function may have
+    /// changed even if its tokens didn't
+    comments: &'a Comments,
+}
+
+/// nodes whose spans can be moved to another source
+trait Rebase {
+    fn rebase(&mut self, shift: &Shift);
+}
+
+impl Rebase for SourceString {
+    fn rebase(&mut self, shift: &Shift) {
+        let moved = |i: usize| (i as isize + shift.by) as usize;
+        self.source = shift.source.clone();
+        self.pos = moved(self.pos.start)..moved(self.pos.end);
+    }
+}
+
+impl<T: Rebase> Rebase for Option<T> {
+    fn rebase(&mut self, shift: &Shift) {
+        if let Some(t) = self {
+            t.rebase(shift);
+        }
+    }
+}
+
+impl<T: Rebase> Rebase for Vec<T> {
+    fn rebase(&mut self, shift: &Shift) {
+        for t in self {
+            t.rebase(shift);
+        }
+    }
+}
+
+impl<T: Rebase> Rebase for Box<T> {
+    fn rebase(&mut self, shift: &Shift) {
+        self.as_mut().rebase(shift);
+    }
+}
+
+/// functions and structs are only copied if they are shared
+impl<T: Rebase + Clone> Rebase for Arc<T> {
+    fn rebase(&mut self, shift: &Shift) {
+        Arc::make_mut(self).rebase(shift);
+    }
+}
+
+impl<A: Rebase, B: Rebase> Rebase for (A, B) {
+    fn rebase(&mut self, shift: &Shift) {
+        self.0.rebase(shift);
+        self.1.rebase(shift);
+    }
+}
+
+impl Rebase for Identifier {
+    fn rebase(&mut self, shift: &Shift) {
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for Statement {
+    fn rebase(&mut self, shift: &Shift) {
+        match self {
+            Self::Declaration(d) => {
+                d.name.rebase(shift);
+                d.type_annotation.rebase(shift);
+                d.value.rebase(shift);
+                d.span.rebase(shift);
+            }
+            Self::Destructuring(d) => {
+                d.pattern.rebase(shift);
+                d.type_annotation.rebase(shift);
+                d.value.rebase(shift);
+                d.span.rebase(shift);
+            }
+            Self::Function(f) => f.rebase(shift),
+            Self::Struct(s) => s.rebase(shift),
+            Self::Enum(e) => e.rebase(shift),
+            Self::Interface(i) => i.rebase(shift),
+            Self::Assignment(a) => {
+                a.target.rebase(shift);
+                a.value.rebase(shift);
+                a.span.rebase(shift);
+            }
+            Self::Expression(e) => e.rebase(shift),
+            Self::Exit(e) => {
+                e.code.rebase(shift);
+                e.span.rebase(shift);
+            }
+            Self::Throw(t) => {
+                t.value.rebase(shift);
+                t.span.rebase(shift);
+            }
+            Self::Defer(d) => {
+                d.function.rebase(shift);
+                d.span.rebase(shift);
+            }
+            Self::Import(i) => {
+                i.path.rebase(shift);
+                i.span.rebase(shift);
+            }
+            Self::Return(r) => {
+                r.value.rebase(shift);
+                r.span.rebase(shift);
+            }
+            Self::Yield(y) => {
+                y.value.rebase(shift);
+                y.span.rebase(shift);
+            }
+            Self::Break(b) => {
+                b.value.rebase(shift);
+                b.span.rebase(shift);
+            }
+            Self::Continue(c) => {
+                c.value.rebase(shift);
+                c.span.rebase(shift);
+            }
+        }
+    }
+}
+
+impl Rebase for FunctionDeclaration {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.parameters.rebase(shift);
+        self.return_type.rebase(shift);
+        self.body.rebase(shift);
+        self.span.rebase(shift);
+        // lambdas and deferred code have none
+        if !self.name.name.starts_with('<') {
+            self.doc = doc::comment(shift.comments, &self.span);
+        }
+    }
+}
+
+impl Rebase for Parameter {
+    fn rebase(&mut self, shift: &Shift) {
+        self.pattern.rebase(shift);
+        self.type_annotation.rebase(shift);
+        self.default.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for NamedArgument {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.value.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for StructDeclaration {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.fields.rebase(shift);
+        self.methods.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for EnumDeclaration {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.variants.rebase(shift);
+        self.methods.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for InterfaceDeclaration {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.methods.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for MethodSignature {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.parameters.rebase(shift);
+        self.return_type.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for Variant {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.fields.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for Field {
+    fn rebase(&mut self, shift: &Shift) {
+        self.name.rebase(shift);
+        self.type_annotation.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for TypeExpression {
+    fn rebase(&mut self, shift: &Shift) {
+        match self {
+            Self::Name(i) => i.rebase(shift),
+            Self::Generic(i, args, span) => {
+                i.rebase(shift);
+                args.rebase(shift);
+                span.rebase(shift);
+            }
+            Self::Union(ts, span) | Self::Tuple(ts, span) => {
+                ts.rebase(shift);
+                span.rebase(shift);
+            }
+        }
+    }
+}
+
+impl Rebase for BlockExpression {
+    fn rebase(&mut self, shift: &Shift) {
+        self.statements.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for LitExpression {
+    fn rebase(&mut self, shift: &Shift) {
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for Expression {
+    fn rebase(&mut self, shift: &Shift) {
+        match self {
+            Self::Binary(b) => {
+                b.lhs.rebase(shift);
+                b.rhs.rebase(shift);
+                b.span.rebase(shift);
+            }
+            Self::Unary(u) => {
+                u.rhs.rebase(shift);
+                u.span.rebase(shift);
+            }
+            Self::Literal(l) => l.rebase(shift),
+            Self::Variable(v) => v.rebase(shift),
+            Self::Group(g) => {
+                g.inner.rebase(shift);
+                g.span.rebase(shift);
+            }
+            Self::Call(c) => {
+                c.callee.rebase(shift);
+                c.arguments.rebase(shift);
+                c.named.rebase(shift);
+                c.span.rebase(shift);
+            }
+            Self::Method(m) => {
+                m.receiver.rebase(shift);
+                m.name.rebase(shift);
+                m.arguments.rebase(shift);
+                m.named.rebase(shift);
+                m.span.rebase(shift);
+            }
+            Self::Field(f) => {
+                f.target.rebase(shift);
+                f.name.rebase(shift);
+                f.span.rebase(shift);
+            }
+            Self::Member(m) => {
+                m.module.rebase(shift);
+                m.name.rebase(shift);
+                m.span.rebase(shift);
+            }
+            Self::Lambda(l) => l.function.rebase(shift),
+            Self::List(l) => {
+                l.items.rebase(shift);
+                l.span.rebase(shift);
+            }
+            Self::Map(m) => {
+                m.entries.rebase(shift);
+                m.span.rebase(shift);
+            }
+            Self::Index(i) => {
+                i.target.rebase(shift);
+                match &mut i.index {
+                    Index::Single(e) => e.rebase(shift),
+                    Index::Slice { start, end, step } => {
+                        start.rebase(shift);
+                        end.rebase(shift);
+                        step.rebase(shift);
+                    }
+                }
+                i.span.rebase(shift);
+            }
+            Self::Block(b) => b.rebase(shift),
+            Self::If(i) => {
+                i.branches.rebase(shift);
+                i.otherwise.rebase(shift);
+                i.span.rebase(shift);
+            }
+            Self::For(f) => {
+                f.condition.rebase(shift);
+                f.body.rebase(shift);
+                f.span.rebase(shift);
+            }
+            Self::ForIn(f) => {
+                f.binding.rebase(shift);
+                f.iterable.rebase(shift);
+                f.body.rebase(shift);
+                f.span.rebase(shift);
+            }
+            Self::Match(m) => {
+                m.subject.rebase(shift);
+                m.arms.rebase(shift);
+                m.span.rebase(shift);
+            }
+            Self::Try(t) => {
+                t.body.rebase(shift);
+                if let Some(c) = &mut t.catch {
+                    c.name.rebase(shift);
+                    c.body.rebase(shift);
+                }
+                t.finally.rebase(shift);
+                t.span.rebase(shift);
+            }
+            Self::Spawn(s) => {
+                s.call.rebase(shift);
+                s.span.rebase(shift);
+            }
+        }
+    }
+}
+
+impl Rebase for MatchArm {
+    fn rebase(&mut self, shift: &Shift) {
+        self.pattern.rebase(shift);
+        self.guard.rebase(shift);
+        self.body.rebase(shift);
+        self.span.rebase(shift);
+    }
+}
+
+impl Rebase for Pattern {
+    fn rebase(&mut self, shift: &Shift) {
+        match self {
+            Self::Wildcard(span) => span.rebase(shift),
+            Self::Literal(l) => l.rebase(shift),
+            Self::Binding(i) => i.rebase(shift),
+            Self::List(l) => {
+                l.items.rebase(shift);
+                if let Some(rest) = &mut l.rest {
+                    rest.binding.rebase(shift);
+                }
+                l.span.rebase(shift);
+            }
+            Self::Map(m) => {
+                m.entries.rebase(shift);
+                m.span.rebase(shift);
+            }
+            Self::Variant(v) => {
+                v.path.rebase(shift);
+                v.fields.rebase(shift);
+                v.span.rebase(shift);
+            }
+        }
+    }
+}
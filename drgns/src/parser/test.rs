@@ -0,0 +1,591 @@
+use std::sync::Arc;
+
+use crate::source::Source;
+
+use super::{parse, Comment, Edit, Expression, Statement, Tree};
+
+fn sexp(s: &str) -> String {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(
+        errors.is_empty(),
+        "unexpected errors parsing {:?}: {:?}",
+        s,
+        errors.iter().map(|e| e.message()).collect::<Vec<_>>()
+    );
+    program
+        .statements
+        .iter()
+        .map(|s| s.to_string())
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+fn errors(s: &str) -> Vec<String> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    parse(&src)
+        .1
+        .iter()
+        .map(|e| e.message().to_string())
+        .collect()
+}
+
+#[test]
+fn parse_precedence() {
+    assert_eq!(sexp("1 + 2 * 3"), "(+ 1 (* 2 3))");
+    assert_eq!(sexp("(1 + 2) * 3"), "(* (+ 1 2) 3)");
+    assert_eq!(sexp("1 - 2 - 3"), "(- (- 1 2) 3)");
+    assert_eq!(sexp("2 ** 3 ** 2"), "(** 2 (** 3 2))");
+    assert_eq!(sexp("-2 ** 2"), "(- (** 2 2))");
+    assert_eq!(sexp("a ++ b + c"), "(++ a (+ b c))");
+    assert_eq!(sexp("a < b and not c or d"), "(or (and (< a b) (not c)) d)");
+    assert_eq!(sexp("a land b + c"), "(land a (+ b c))");
+}
+
+#[test]
+fn parse_literals() {
+    assert_eq!(sexp("0xff"), "255");
+    assert_eq!(sexp("1_000"), "1000");
+    assert_eq!(sexp("1.5e3"), "1500.0");
+    assert_eq!(sexp(r#""a\tb""#), r#""a\tb""#);
+    assert_eq!(sexp(r"'a\tb'"), r#""a\\tb""#);
+    assert_eq!(sexp("^foo"), "^foo");
+    assert_eq!(sexp("none; true; false"), "none\ntrue\nfalse");
+    assert_eq!(sexp(r#"b"a\x00\xFF\n""#), r#"b"a\x00\xff\n""#);
+    assert_eq!(sexp(r#"b"""#), r#"b"""#);
+}
+
+#[test]
+fn parse_interpolation() {
+    assert_eq!(sexp(r#""a ${x} b""#), r#"(++ (++ "a " (str x)) " b")"#);
+    assert_eq!(sexp(r#""${x}${y + 1}""#), "(++ (str x) (str (+ y 1)))");
+    assert_eq!(sexp(r#""${"${x}"}""#), "(str (str x))");
+    assert_eq!(sexp(r#""\${x}""#), r#""${x}""#);
+    assert_eq!(sexp("\"${\n  x\n}\""), "(str x)");
+    assert_eq!(errors(r#""${}""#), ["expected expression"]);
+    assert_eq!(errors(r#""${x y}""#), ["expected '}', found identifier"]);
+}
+
+#[test]
+fn parse_declarations() {
+    assert_eq!(sexp("x := 1"), "(:= x 1)");
+    assert_eq!(sexp("mut x := 1"), "(:= mut x 1)");
+    assert_eq!(sexp("x: int = 1"), "(:= x: int 1)");
+    assert_eq!(
+        sexp("x: list[int] | none := none"),
+        "(:= x: list[int] | none none)"
+    );
+    assert_eq!(sexp("x = 2"), "(= x 2)");
+    assert_eq!(sexp("x += 2"), "(+= x 2)");
+    assert_eq!(sexp("s ++= \"!\""), "(++= s \"!\")");
+}
+
+#[test]
+fn parse_functions() {
+    assert_eq!(
+        sexp("function add(a: int, b: int) -> int {\n    return a + b\n}"),
+        "(function add (a: int b: int) -> int (block (return (+ a b))))"
+    );
+    assert_eq!(sexp("function f() -> { }"), "(function f () (block))");
+    assert_eq!(sexp("f(1,\n  2)"), "(call f 1 2)");
+    assert_eq!(sexp("a.f(b).g()"), "(apply g (apply f a b))");
+    assert_eq!(sexp("f := (x) -> x + 1"), "(:= f (-> (x) (block (+ x 1))))");
+    assert_eq!(
+        sexp("(x: int, y: int) -> int { x * y }"),
+        "(-> (x: int y: int) int (block (* x y)))"
+    );
+    assert_eq!(sexp("() -> { }"), "(-> () (block))");
+    assert_eq!(sexp("(a + b) - c"), "(- (+ a b) c)");
+}
+
+#[test]
+fn parse_generators() {
+    assert_eq!(
+        sexp("function f() -> { yield 1\nyield }"),
+        "(function f () (block (yield 1) (yield)))"
+    );
+    let generator = |s: &str| {
+        let src = Arc::new(Source::from_string(s.to_string()));
+        match &parse(&src).0.statements[0] {
+            Statement::Function(f) => f.generator,
+            s => panic!("expected a function, found {}", s),
+        }
+    };
+    assert!(generator("function f() -> { if true { yield } }"));
+    assert!(!generator("function f() -> { return 1 }"));
+    // functions declared inside yield for themselves
+    assert!(!generator("function f() -> { g := () -> { yield 1 } }"));
+}
+
+#[test]
+fn parse_structs() {
+    assert_eq!(
+        sexp("struct P { x: int, y\nfunction m(self) -> { self.x } }"),
+        "(struct P (x: int y) (function m (self) (block (. self x))))"
+    );
+    assert_eq!(sexp("struct E {}"), "(struct E ())");
+    assert_eq!(sexp("p.x.y = 1"), "(= (. (. p x) y) 1)");
+    // arguments on the next line are not those of a method call
+    assert_eq!(sexp("p.x\n(1)"), "(. p x)\n1");
+}
+
+#[test]
+fn parse_imports() {
+    assert_eq!(sexp("import a"), "(import a)");
+    assert_eq!(sexp("import a::b::c"), "(import a::b::c)");
+    assert_eq!(sexp("m::x"), "(:: m x)");
+    assert_eq!(sexp("m::f(1).g()"), "(apply g (call (:: m f) 1))");
+}
+
+#[test]
+fn parse_control_flow() {
+    assert_eq!(
+        sexp("if a { 1 }\nelif b { 2 }\nelse { 3 }"),
+        "(if a (block 1) b (block 2) else (block 3))"
+    );
+    assert_eq!(sexp("if a { 1 }\n2"), "(if a (block 1))\n2");
+    assert_eq!(sexp("for { break 1 }"), "(for (block (break 1)))");
+    assert_eq!(
+        sexp("for x < 3 { x += 1; continue }"),
+        "(for (< x 3) (block (+= x 1) (continue)))"
+    );
+    assert_eq!(sexp("exit 0"), "(exit 0)");
+}
+
+#[test]
+fn parse_lists() {
+    assert_eq!(sexp("[1, 2, 3]"), "(list 1 2 3)");
+    assert_eq!(sexp("[]"), "(list)");
+    assert_eq!(sexp("[\n  1,\n  [2],\n]"), "(list 1 (list 2))");
+    assert_eq!(sexp("[\n  1\n  2\n]"), "(list 1 2)");
+    assert_eq!(sexp("xs[0][-1]"), "([] ([] xs 0) (- 1))");
+    assert_eq!(sexp("xs[1:]"), "([:] xs 1 _ _)");
+    assert_eq!(sexp("xs[:-1]"), "([:] xs _ (- 1) _)");
+    assert_eq!(sexp("xs[::2]"), "([:] xs _ _ 2)");
+    assert_eq!(sexp("xs[a:b:c]"), "([:] xs a b c)");
+    assert_eq!(sexp("xs[i] += 1"), "(+= ([] xs i) 1)");
+    assert_eq!(sexp("x\n[1]"), "x\n(list 1)");
+    assert_eq!(sexp("[1\n(2)]"), "(list 1 2)");
+    assert_eq!(
+        sexp("for x in xs { print(x) }"),
+        "(for x in xs (block (call print x)))"
+    );
+    assert_eq!(errors("xs[1:2] = 3").len(), 1);
+    assert_eq!(errors("[1 2]"), ["expected ']', found integer literal"]);
+    // a stray brace at the top level doesn't stop the recovery
+    assert_eq!(
+        errors("{^a: 1 : 2}\nx := 1 }"),
+        [
+            "expected '}', found ':'",
+            "expected newline or ';', found '}'",
+            "expected expression",
+        ]
+    );
+}
+
+#[test]
+fn parse_match() {
+    assert_eq!(
+        sexp("match x {\n  0 -> \"zero\"\n  -1 -> none\n  n if n > 1 -> { n }\n  _ -> 1\n}"),
+        "(match x (0 \"zero\") (-1 none) (n if (> n 1) (block n)) (_ 1))"
+    );
+    assert_eq!(
+        sexp("match xs { [a, ..rest] -> a, [..] -> 0, [.._, b] -> b }"),
+        "(match xs ((list a ..rest) a) ((list ..) 0) ((list .. b) b))"
+    );
+    assert_eq!(
+        sexp(r#"match m { {"a": [x], ^b: _} -> x }"#),
+        r#"(match m ((map ("a" (list x)) (^b _)) x))"#
+    );
+    assert_eq!(
+        errors("match xs { [.., a, ..] -> a }"),
+        ["a list pattern can only have one `..`"]
+    );
+    assert_eq!(
+        errors("match m { {k: 1} -> 1 }"),
+        ["the keys of a map pattern must be int, string or symbol literals"]
+    );
+}
+
+#[test]
+fn parse_destructuring() {
+    assert_eq!(
+        sexp("[a, ..rest] := xs\nmut {x, \"y\": y}: map = m"),
+        "(:= (list a ..rest) xs)\n(:= mut (map (\"x\" x) (\"y\" y)): map m)"
+    );
+    assert_eq!(
+        sexp("function f([a, b], mut {k}: map) -> { a }"),
+        "(function f ([a, b] mut {k}: map) (block a))"
+    );
+    assert_eq!(
+        sexp("for [k, v] in pairs { k }\nfor {} in maps { }\nfor { }"),
+        "(for (list k v) in pairs (block k))\n(for (map) in maps (block))\n(for (block))"
+    );
+    // a list or a block is not a declaration unless `:=` follows it
+    assert_eq!(sexp("[a, b]\n{ a }"), "(list a b)\n(block a)");
+}
+
+#[test]
+fn parse_parameters() {
+    assert_eq!(
+        sexp("function f(a, mut b: int = 1, ..rest) -> { }\n(x = 2) -> x"),
+        "(function f (a mut b: int = 1 ..rest) (block))\n(-> (x = 2) (block x))"
+    );
+    assert_eq!(
+        sexp("f(1, b = 2, c = g(d = 3))\no.m(k = 1)"),
+        "(call f 1 (= b 2) (= c (call g (= d 3))))\n(apply m o (= k 1))"
+    );
+    // `=` in an argument is a name only after an identifier
+    assert_eq!(sexp("f(a == 1)"), "(call f (== a 1))");
+    assert_eq!(
+        errors("function f(..a, b) -> { }"),
+        ["the variadic parameter must be the last one"]
+    );
+    assert_eq!(
+        errors("function f(..a = []) -> { }"),
+        ["a variadic parameter cannot have a default"]
+    );
+    assert_eq!(
+        errors("function f(a = 1, b) -> { }"),
+        ["a parameter without a default cannot follow one with a default"]
+    );
+    assert_eq!(
+        errors("f(a = 1, 2)"),
+        ["an argument given by position cannot follow 'a', given by name"]
+    );
+}
+
+#[test]
+fn parse_null_safety() {
+    assert_eq!(
+        sexp("a?.b.c?.d()\nx ?? y ?? 0"),
+        "(?apply d (. (?. a b) c))\n(?? (?? x y) 0)"
+    );
+    // `??` binds more loosely than `or`
+    assert_eq!(sexp("a ?? b or c"), "(?? a (or b c))");
+    assert_eq!(errors("a?.b = 1"), ["cannot assign to this expression"]);
+    assert_eq!(
+        errors("spawn a?.m()"),
+        ["spawn expects a call that is always made, not one with '?.'"]
+    );
+}
+
+#[test]
+fn parse_enums() {
+    assert_eq!(
+        sexp(
+            "enum Result {\n  Ok(value)\n  Err(msg: string), None\n  function f(self) -> { 1 }\n}"
+        ),
+        "(enum Result ((Ok value) (Err msg: string) None) (function f (self) (block 1)))"
+    );
+    assert_eq!(
+        sexp("match r {\n  Result::Ok([x, _]) -> x\n  m::Result::Err -> 0\n}"),
+        "(match r ((Result::Ok (list x _)) x) (m::Result::Err 0))"
+    );
+    assert_eq!(
+        errors("enum E { A(1) }"),
+        ["expected identifier, found integer literal"]
+    );
+}
+
+#[test]
+fn parse_interfaces() {
+    assert_eq!(
+        sexp("interface Shape {\n  function area(self) -> float\n  function scale(self, by)\n}"),
+        "(interface Shape (function area (self) -> float) (function scale (self by)))"
+    );
+    assert_eq!(
+        errors("interface Shape { function area(self) -> float { 1.0 } }"),
+        ["the methods of an interface have no body"]
+    );
+}
+
+#[test]
+fn parse_maps() {
+    assert_eq!(sexp(r#"{"a": 1, 2: b}"#), r#"(map ("a" 1) (2 b))"#);
+    assert_eq!(sexp("{}"), "(map)");
+    assert_eq!(
+        sexp("{\n  ^a: 1\n  (k): [2]\n}"),
+        "(map (^a 1) (k (list 2)))"
+    );
+    assert_eq!(sexp("m[\"a\"] = 1"), r#"(= ([] m "a") 1)"#);
+    assert_eq!(
+        sexp("k in m and not x in xs"),
+        "(and (in k m) (not (in x xs)))"
+    );
+    // blocks are still blocks
+    assert_eq!(sexp("{ x: int = 1 }"), "(block (:= x: int 1))");
+    assert_eq!(
+        sexp("{ f(a)\nxs[1:] }"),
+        "(block (call f a) ([:] xs 1 _ _))"
+    );
+    assert_eq!(sexp("for k in m { }"), "(for k in m (block))");
+}
+
+#[test]
+fn parse_try() {
+    assert_eq!(
+        sexp("try { f() } catch e { 1 }"),
+        "(try (block (call f)) catch e (block 1))"
+    );
+    assert_eq!(
+        sexp("try { }\ncatch { }\nfinally { 2 }"),
+        "(try (block) catch (block) finally (block 2))"
+    );
+    assert_eq!(sexp("try { } finally { }"), "(try (block) finally (block))");
+    assert_eq!(sexp("throw \"oops\""), "(throw \"oops\")");
+    assert_eq!(sexp("defer fs::close(f)"), "(defer (call (:: fs close) f))");
+    assert_eq!(sexp("defer n += 1"), "(defer (+= n 1))");
+    assert_eq!(
+        errors("function f() -> { defer { yield 1 } }"),
+        vec!["cannot yield in deferred code"]
+    );
+    assert_eq!(
+        errors("try { } x"),
+        vec!["expected 'catch' or 'finally', found identifier"]
+    );
+}
+
+#[test]
+fn parse_pipes() {
+    assert_eq!(sexp("xs |> f()"), "(call f xs)");
+    assert_eq!(
+        sexp("xs |> filter(p) |> strings::join(\",\")"),
+        "(call (:: strings join) (call filter xs p) \",\")"
+    );
+    // looser than arithmetic, tighter than comparisons
+    assert_eq!(sexp("a + b |> f() == c"), "(== (call f (+ a b)) c)");
+    // continued on the next line
+    assert_eq!(sexp("x := xs |>\n  f()\ny"), "(:= x (call f xs))\ny");
+    assert_eq!(errors("xs |> f"), vec!["|> expects a call on its right"]);
+}
+
+#[test]
+fn parse_spawn() {
+    assert_eq!(sexp("t := spawn f(1)"), "(:= t (spawn (call f 1)))");
+    // the whole chain is the call run by the task
+    assert_eq!(
+        sexp("spawn xs.map(g).len()"),
+        "(spawn (apply len (apply map xs g)))"
+    );
+    assert_eq!(
+        sexp("(spawn f()).await()"),
+        "(apply await (spawn (call f)))"
+    );
+    assert_eq!(errors("spawn f"), vec!["spawn expects a call"]);
+}
+
+#[test]
+fn parse_newlines() {
+    assert_eq!(sexp("1 +\n2"), "(+ 1 2)");
+    assert_eq!(sexp("(1\n+ 2)"), "(+ 1 2)");
+    assert_eq!(sexp("1\n\n2"), "1\n2");
+    assert_eq!(sexp("{\n  x := 1\n  x\n}"), "(block (:= x 1) x)");
+}
+
+#[test]
+fn parse_spans() {
+    let src = Arc::new(Source::from_string("x := 1 + 2".to_string()));
+    let (program, _) = parse(&src);
+    let Statement::Declaration(d) = &program.statements[0] else {
+        panic!("expected a declaration");
+    };
+    assert_eq!(d.span.to_string(), "x := 1 + 2");
+    let Expression::Binary(be) = &d.value else {
+        panic!("expected a binary expression");
+    };
+    assert_eq!(be.span.to_string(), "1 + 2");
+    assert_eq!(be.rhs.span().position().column, 10);
+}
+
+#[test]
+fn parse_errors() {
+    assert_eq!(errors("1 +"), vec!["unexpected end of input"]);
+    assert_eq!(errors("1 = 2").len(), 1);
+    assert_eq!(errors(r#""\q""#), vec!["unknown escape sequence '\\q'"]);
+    assert_eq!(errors(r#"b"é""#), vec!["'é' is not an ASCII character"]);
+    assert_eq!(errors(r#"b"\x1""#), vec!["invalid byte escape '\\x1'"]);
+    assert_eq!(
+        errors(r#"b"\u{41}""#),
+        vec!["unknown escape sequence '\\u'"]
+    );
+    assert_eq!(errors("0x1_0000_0000_0000_0000").len(), 1);
+
+    // each broken statement is reported once, and parsing continues
+    assert_eq!(errors("1 + *\n2 +\n3\n* 4").len(), 2);
+
+    // newlines inside the brackets an error stops in are skipped, those
+    // after them still end statements
+    for code in [
+        "print((1 +))\nx := 1\ny := 2",
+        "f(a, [1 +])\nx := 1\ny := 2",
+        "function f(a: ) -> {}\nx := 1\ny := 2",
+    ] {
+        let src = Arc::new(Source::from_string(code.to_string()));
+        let (program, errors) = parse(&src);
+        assert_eq!(errors.len(), 1, "{:?}", code);
+        let statements: Vec<String> = program.statements.iter().map(|s| s.to_string()).collect();
+        assert_eq!(statements, ["(:= x 1)", "(:= y 2)"], "{:?}", code);
+    }
+}
+
+#[test]
+fn parse_comments() {
+    let src = Arc::new(Source::from_string(
+        "// doc\n/* more */\nx := 1 // one\nfunction f() -> { // open\n}\n// end".to_string(),
+    ));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty());
+    let text = |cs: &[Comment]| cs.iter().map(|c| c.span.to_string()).collect::<Vec<_>>();
+    let (x, f) = (program.statements[0].span(), program.statements[1].span());
+    assert_eq!(text(program.comments.leading(&x)), ["// doc", "/* more */"]);
+    assert_eq!(text(program.comments.trailing(&x)), ["// one"]);
+    assert!(program.comments.leading(&f).is_empty());
+    // the brace opening the body
+    let Statement::Function(function) = &program.statements[1] else {
+        panic!("expected a function");
+    };
+    let open = function.body.span.start() + 1;
+    assert_eq!(text(program.comments.after(open)), ["// open"]);
+    assert_eq!(text(program.comments.before(src.len())), ["// end"]);
+    assert_eq!(program.comments.len(), 5);
+}
+
+#[test]
+fn serialize_ast() {
+    let src = Arc::new(Source::from_string("x := 1 + y // why".to_string()));
+    let (program, _) = parse(&src);
+    let json = serde_json::to_value(&program).expect("the syntax tree serializes");
+    let declaration = &json["statements"][0]["Declaration"];
+    assert_eq!(declaration["name"]["name"], "x");
+    assert_eq!(declaration["mutable"], false);
+    let sum = &declaration["value"]["Binary"];
+    assert_eq!(sum["op"], "Add");
+    assert_eq!(sum["lhs"]["Literal"]["value"]["Int"], 1);
+    assert_eq!(sum["rhs"]["Variable"]["name"], "y");
+    let p = |line: usize, column: usize, offset: usize| serde_json::json!({"line": line, "column": column, "offset": offset});
+    assert_eq!(sum["span"]["start"], p(1, 6, 5));
+    assert_eq!(sum["span"]["end"], p(1, 11, 10));
+    assert_eq!(json["comments"][0]["trailing"], true);
+    assert_eq!(json["comments"][0]["span"]["start"], p(1, 12, 11));
+}
+
+/// the tree of the source edited, which must be the one of parsing the
+/// edited source, and how many statements it reused
+fn edited(s: &str, range: std::ops::Range<usize>, text: &str) -> (Tree, usize) {
+    let src = Arc::new(Source::new(Some("a.drgns".to_owned()), s.to_string()));
+    let edit = Edit {
+        range,
+        text: text.to_owned(),
+    };
+    let tree = Tree::new(&src).edit(&edit);
+    let (program, errors) = parse(&tree.program.source);
+    let json = |p| serde_json::to_value(p).expect("the syntax tree serializes");
+    let source = tree.program.source.to_string();
+    assert_eq!(
+        json(&tree.program),
+        json(&program),
+        "after {:?} in {:?}",
+        edit,
+        s
+    );
+    let located = |errors: &[crate::eh::DragonError]| -> Vec<String> {
+        let located = errors.iter().map(|e| {
+            let at = e.span().map(|s| s.location()).unwrap_or_default();
+            format!("{}: {}", at, e.message())
+        });
+        located.collect()
+    };
+    assert_eq!(located(&tree.errors), located(&errors), "in {:?}", source);
+    for statement in &tree.program.statements {
+        assert!(Arc::ptr_eq(statement.span().source(), &tree.program.source));
+    }
+    let reused = tree.reused();
+    (tree, reused)
+}
+
+#[test]
+fn reparse_reuses_the_statements_left_alone() {
+    let program = "\
+import lib::util
+function area(r) -> {
+    f := (x: int) -> int { x * r }
+    3 * r * r
+}
+struct Point { x, y
+    function norm(self) -> { self.x }
+}
+xs := [1, 2, 3] // three
+m := {\"a\": 1}
+if area(1) > 2 { print(\"${xs[0]} big\") }
+else { print(m) }
+";
+    let at = |s: &str| {
+        let i = program.find(s).expect("the text is in the program");
+        i..i
+    };
+    // in the body of the function, the others are kept
+    let (_, reused) = edited(program, at("3 * r"), "4 * r * ");
+    assert_eq!(reused, 5);
+    let (tree, reused) = edited(program, at("xs"), "\n\n");
+    assert_eq!(reused, 6);
+    assert_eq!(tree.program.statements[3].span().position().line, 11);
+    // a string opened changes the tokens up to the end
+    let (_, reused) = edited(program, at("m :="), "\"");
+    assert_eq!(reused, 4);
+    // what follows a statement can change it
+    let (_, reused) = edited(program, at("else").start - 1..at("else").start - 1, "\n1");
+    assert_eq!(reused, 5);
+    // the statements after an error are taken again once the parser
+    // recovers from it
+    let (tree, reused) = edited(program, at("struct"), "x := (");
+    assert!(!tree.errors.is_empty());
+    assert_eq!(reused, 4);
+    // again, once the error is fixed
+    let edit = Edit {
+        range: at("struct").start..at("struct").start + 6,
+        text: String::new(),
+    };
+    let tree = tree.edit(&edit);
+    assert!(tree.errors.is_empty());
+
+    // any edit gives the tree of the edited source
+    for i in 0..=program.chars().count() {
+        for text in ["", "x", "\n", "{", "\"", "/*", " + "] {
+            let end = match text {
+                "" => i + 1,
+                _ => i,
+            };
+            edited(program, i..end, text);
+        }
+    }
+}
+
+#[test]
+fn functions_keep_their_documentation() {
+    let src = Arc::new(Source::from_string(
+        "/// the area\n/// of a circle\nfunction area(r) -> { r * r }\n\n// not this one\n\nfunction f() -> {}\ng := (x) -> x\n"
+            .to_string(),
+    ));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty());
+    let docs: Vec<&str> = program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Function(f) => Some(f.doc.as_str()),
+            _ => None,
+        })
+        .collect();
+    assert_eq!(docs, ["the area\nof a circle", ""]);
+
+    // the comment changes, the statement is reused and its documentation
+    // read again
+    let program = "/// the area\nfunction area(r) -> { r * r }\nx := 1\n";
+    let i = program.find("area\n").expect("the text is in the program");
+    let (tree, _) = edited(program, i..i + 4, "surface");
+    let Statement::Function(f) = &tree.program.statements[0] else {
+        panic!("the first statement declares a function");
+    };
+    assert_eq!(f.doc, "the surface");
+}
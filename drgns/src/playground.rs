@@ -0,0 +1,149 @@
+//! Running a program given as text and reporting everything it did at once,
+//! for playgrounds: what it printed and logged, the errors stopping it and
+//! its value, see `Outcome`.
+//!
+//! The crate builds to WebAssembly for playgrounds running in a browser,
+//! where `evaluate` is the function JavaScript calls:
+//!
+//! ```sh
+//! cargo build --lib --release --target wasm32-unknown-unknown
+//! wasm-bindgen --target web --out-dir pkg target/wasm32-unknown-unknown/release/drgns.wasm
+//! ```
+//!
+//! ```js
+//! import init, { evaluate } from "./pkg/drgns.js";
+//! await init();
+//! const { value, stdout, stderr, diagnostics } = JSON.parse(evaluate("print(40); 40 + 2"));
+//! ```
+//!
+//! A browser has no files, programs, environment or threads to give
+//! scripts, so there the functions of the `fs` and `http` modules,
+//! `os::run`, `time::sleep`, tasks and generators fail with an error.
+
+use std::sync::Arc;
+
+use serde::Serialize;
+
+use crate::{
+    diagnostics,
+    interpreter::{io::Captured, Halt},
+    parser,
+    source::Source,
+    values::Value,
+    Interpreter,
+};
+
+/// The name of the program in diagnostics
+pub const NAME: &str = "<playground>";
+
+/// What running a program did
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Outcome {
+    /// the value of the last statement as `repr` writes it, `None` when it
+    /// is `none` or the program failed
+    pub value: Option<String>,
+
+    /// the lines printed
+    pub stdout: String,
+
+    /// the lines logged, then the errors as the command line writes them
+    pub stderr: String,
+
+    /// the errors stopping the program, as `diagnostics::json` writes them
+    pub diagnostics: Vec<serde_json::Value>,
+
+    /// the exit status running it as a file would have, 2 when it doesn't
+    /// parse, 1 when it fails and the code given to `exit`
+    pub status: i32,
+}
+
+/// Run the program with the interpreter, which keeps its globals, limits
+/// and sandbox, capturing what it writes
+pub fn run(interpreter: &mut Interpreter, code: &str) -> Outcome {
+    let captured = Arc::new(Captured::new());
+    interpreter.set_io(captured.clone());
+    let src = Arc::new(Source::new(Some(NAME.to_owned()), code.to_owned()));
+    let (program, errors) = parser::parse(&src);
+    let (value, errors, status) = match errors.is_empty() {
+        false => (None, errors, 2),
+        true => match interpreter.eval(&program) {
+            Ok(Value::None) => (None, vec![], 0),
+            Ok(v) => (Some(v.repr()), vec![], 0),
+            Err(Halt::Exit(code)) => (None, vec![], code),
+            Err(Halt::Error(e)) => (None, vec![e], 1),
+        },
+    };
+    let mut stderr = captured.stderr();
+    stderr.extend(errors.iter().map(diagnostics::render));
+    Outcome {
+        value,
+        stdout: captured.stdout(),
+        stderr,
+        diagnostics: errors.iter().map(|e| diagnostics::json(e, &[])).collect(),
+        status,
+    }
+}
+
+/// Run the program on a new VM and return its `Outcome` as JSON, the entry
+/// point of the WebAssembly build
+#[cfg_attr(target_arch = "wasm32", wasm_bindgen::prelude::wasm_bindgen)]
+pub fn evaluate(code: &str) -> String {
+    let outcome = run(&mut Interpreter::new(), code);
+    // the outcome only holds strings, numbers and JSON values
+    serde_json::to_string(&outcome).unwrap_or_default()
+}
+
+#[cfg(test)]
+mod test {
+    use crate::{Engine, Interpreter, Limits};
+
+    use super::{evaluate, run, Outcome};
+
+    #[test]
+    fn outcomes() {
+        for engine in [Engine::Vm, Engine::Walk] {
+            let mut i = Interpreter::with_engine(engine);
+            let outcome = run(&mut i, "print(\"hi\"); log::warn(\"careful\"); [1, 2]");
+            assert_eq!(outcome.value.as_deref(), Some("[1, 2]"));
+            assert_eq!(outcome.stdout, "hi\n");
+            assert!(outcome.stderr.trim_end().ends_with("careful"));
+            assert!(outcome.diagnostics.is_empty());
+            assert_eq!(outcome.status, 0);
+
+            // the globals stay, each run has its own output
+            let outcome = run(&mut i, "x := 1\nprint(x)\nx + none");
+            assert_eq!(outcome.stdout, "1\n");
+            assert_eq!(outcome.status, 1);
+            assert_eq!(outcome.diagnostics[0]["range"]["start"]["line"], 3);
+            assert!(outcome.stderr.contains(" --> <playground>:3:"));
+            assert_eq!(run(&mut i, "exit 3").status, 3);
+
+            i.set_limits(Limits {
+                steps: Some(100),
+                ..Limits::default()
+            });
+            let outcome = run(&mut i, "for {}");
+            assert_eq!(outcome.diagnostics[0]["code"], "E04003");
+        }
+    }
+
+    #[test]
+    fn json() {
+        let outcome: serde_json::Value =
+            serde_json::from_str(&evaluate("x := (")).expect("the outcome is JSON");
+        assert_eq!(outcome["status"], 2);
+        assert_eq!(outcome["value"], serde_json::Value::Null);
+        assert_eq!(outcome["diagnostics"][0]["file"], "<playground>");
+        let outcome = Outcome {
+            value: None,
+            stdout: String::new(),
+            stderr: String::new(),
+            diagnostics: vec![],
+            status: 0,
+        };
+        assert_eq!(
+            serde_json::to_string(&outcome).expect("the outcome is JSON"),
+            r#"{"value":null,"stdout":"","stderr":"","diagnostics":[],"status":0}"#
+        );
+    }
+}
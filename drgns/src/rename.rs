@@ -0,0 +1,234 @@
+//! Renaming a name and its uses, for `drgns rename` and the language server.
+//!
+//! The name is resolved as the checker resolves it. A name declared at the
+//! top level of a script is renamed in the other scripts of the project too,
+//! where they use it as `module::name`, which the index of `drgns refs`
+//! finds. A rename is refused if it would change what a name refers to: if
+//! the new name is already declared in the same scope, if a use of the name
+//! is in the scope of an inner declaration of the new one, or if a use of the
+//! new name would then refer to the declaration renamed.
+
+use std::{
+    collections::BTreeMap,
+    ops::Range,
+    path::{Path, PathBuf},
+};
+
+use crate::{
+    checker::{self, Analysis, Declared},
+    eh::{DragonError, ErrorCode},
+    index::Index,
+    lexer,
+    parser::{walk_statement, Program, Statement, Visitor},
+    source::SourceString,
+};
+
+#[cfg(test)]
+mod test;
+
+/// The char ranges to replace with the new name, in each script
+pub type Edits = BTreeMap<PathBuf, Vec<Range<usize>>>;
+
+/// The edits renaming the name at the char index of the program to `name`.
+/// The program is the one of the script at `path`, which is absolute, the
+/// other scripts of the project are found with the index and `load`.
+pub fn rename(
+    path: &Path,
+    program: &Program,
+    i: usize,
+    name: &str,
+    index: &Index,
+    load: impl Fn(&Path) -> Option<Program>,
+) -> Result<Edits, DragonError> {
+    let error = |msg: String, span: Option<&SourceString>| {
+        DragonError::new(ErrorCode::Generic, msg, span.cloned())
+    };
+    if !is_name(name) {
+        return Err(error(format!("'{}' is not a name", name), None));
+    }
+    if lexer::keywords().any(|k| k == name) {
+        return Err(error(format!("'{}' is a keyword", name), None));
+    }
+
+    let symbol = index.at(path, i);
+    // the script declaring a name of the top level, which may be another one
+    let declaring = match symbol {
+        Some(s) if s.location.path != path => load(&s.location.path).ok_or_else(|| {
+            let msg = format!(
+                "cannot read '{}', which declares it",
+                s.location.path.display()
+            );
+            error(msg, None)
+        })?,
+        _ => program.clone(),
+    };
+    let analysis = checker::analyze(&declaring);
+    let declared = match symbol {
+        Some(s) => analysis
+            .declarations
+            .iter()
+            .position(|d| d.name.span.start() == s.location.range.start),
+        None => analysis.definition(i).and_then(|d| {
+            analysis
+                .declarations
+                .iter()
+                .position(|x| std::ptr::eq(x, d))
+        }),
+    };
+    let Some(declared) = declared else {
+        let builtin = analysis
+            .references
+            .iter()
+            .find(|(s, d)| d.is_none() && s.start() <= i && i <= s.end());
+        let msg = match builtin {
+            Some((s, _)) => format!("'{}' is a builtin, it cannot be renamed", s),
+            None => format!("there is no name at {}", program.source.position(i)),
+        };
+        return Err(error(msg, None));
+    };
+    let d = &analysis.declarations[declared];
+    if imports(&declaring).contains(&d.name.span.start()) {
+        let msg = format!("'{}' is named after the module it imports", d.name.name);
+        return Err(error(msg, Some(&d.name.span)));
+    }
+    conflicts(&analysis, declared, name)?;
+
+    let uses = analysis
+        .references
+        .iter()
+        .filter(|(_, r)| *r == Some(declared));
+    let mut edits = Edits::new();
+    let declaring_path = PathBuf::from(declaring.source.path().unwrap_or_default());
+    edits.insert(
+        declaring_path.clone(),
+        std::iter::once(&d.name.span)
+            .chain(uses.map(|(s, _)| s))
+            .map(|s| s.start()..s.end())
+            .collect(),
+    );
+    // the uses of the other scripts, as `module::name`
+    let others = symbol.map_or(vec![], |s| index.references(s));
+    if let Some(other) = others.iter().find(|l| l.path != declaring_path) {
+        if name.starts_with('_') {
+            let msg = format!(
+                "'{}' would not be exported, and '{}' uses it",
+                name,
+                other.path.display()
+            );
+            return Err(error(msg, None));
+        }
+    }
+    for l in others.into_iter().filter(|l| l.path != declaring_path) {
+        edits
+            .entry(l.path.clone())
+            .or_default()
+            .push(l.range.clone());
+    }
+    for ranges in edits.values_mut() {
+        ranges.sort_by_key(|r| r.start);
+        ranges.dedup();
+    }
+    Ok(edits)
+}
+
+/// The text with the ranges, sorted and apart, replaced with the name
+pub fn apply(text: &str, ranges: &[Range<usize>], name: &str) -> String {
+    let chars: Vec<char> = text.chars().collect();
+    let mut renamed = String::new();
+    let mut at = 0;
+    for r in ranges {
+        renamed.extend(&chars[at..r.start.min(chars.len())]);
+        renamed.push_str(name);
+        at = r.end.min(chars.len());
+    }
+    renamed.extend(&chars[at..]);
+    renamed
+}
+
+fn is_name(name: &str) -> bool {
+    let mut chars = name.chars();
+    chars
+        .next()
+        .is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+        && chars.all(|c| c.is_ascii_alphanumeric() || c == '_')
+}
+
+/// why renaming the declaration would change what a name refers to, if it
+/// would
+fn conflicts(analysis: &Analysis, declared: usize, name: &str) -> Result<(), DragonError> {
+    let d = &analysis.declarations[declared];
+    let conflict = |msg: String, span: &SourceString| {
+        Err(DragonError::new(
+            ErrorCode::DuplicateDeclaration,
+            msg,
+            Some(span.clone()),
+        ))
+    };
+    let inner = |o: &Declared| {
+        o.scope != d.scope && d.scope.start <= o.scope.start && o.scope.end <= d.scope.end
+    };
+    if let Some(o) = analysis
+        .declarations
+        .iter()
+        .find(|o| o.name.name == name && o.scope == d.scope)
+    {
+        let at = o.name.span.position();
+        let msg = format!("'{}' is already declared in this scope, at {}", name, at);
+        return conflict(msg, &d.name.span);
+    }
+    for (use_, _) in analysis
+        .references
+        .iter()
+        .filter(|(_, r)| *r == Some(declared))
+    {
+        let visible = analysis.visible(use_.start());
+        if let Some(o) = visible.iter().find(|o| o.name.name == name && inner(o)) {
+            let msg = format!(
+                "this use of '{}' would refer to the '{}' declared at {}",
+                d.name.name,
+                name,
+                o.name.span.position()
+            );
+            return conflict(msg, use_);
+        }
+    }
+    let in_scope = |s: &SourceString| {
+        d.scope.contains(&s.start()) && (d.function || d.name.span.end() <= s.start())
+    };
+    let outer = |o: &Declared| {
+        o.scope != d.scope && o.scope.start <= d.scope.start && d.scope.end <= o.scope.end
+    };
+    for (use_, r) in &analysis.references {
+        let captured = match r {
+            Some(r) => outer(&analysis.declarations[*r]),
+            // builtins are declared around everything
+            None => true,
+        };
+        if use_.to_string() == name && in_scope(use_) && captured {
+            let msg = format!(
+                "this use of '{}' would refer to the '{}' renamed",
+                name, d.name.name
+            );
+            return conflict(msg, use_);
+        }
+    }
+    Ok(())
+}
+
+/// the starts of the names of the imports of a program
+fn imports(program: &Program) -> Vec<usize> {
+    #[derive(Default)]
+    struct Imports(Vec<usize>);
+    impl Visitor for Imports {
+        fn visit_statement(&mut self, s: &Statement) {
+            match s {
+                Statement::Import(i) => self.0.push(i.name().span.start()),
+                s => walk_statement(self, s),
+            }
+        }
+    }
+
+    let mut imports = Imports::default();
+    imports.visit_program(program);
+    imports.0
+}
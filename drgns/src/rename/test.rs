@@ -0,0 +1,159 @@
+use std::{fs, path::Path, sync::Arc};
+
+use super::{apply, rename};
+use crate::{
+    index::Index,
+    parser::parse,
+    source::{read_to_string, read_with_encoding, Source},
+    test_utils,
+};
+
+fn load(path: &Path) -> Option<crate::parser::Program> {
+    let text = read_to_string(path).ok()?;
+    Some(
+        parse(&Arc::new(Source::new(
+            Some(path.display().to_string()),
+            text,
+        )))
+        .0,
+    )
+}
+
+/// the texts of the files of the project after renaming the name at the
+/// first occurrence of `at` in the file, saved the way they were, or why it
+/// can't be
+fn renamed(dir: &Path, file: &str, at: &str, name: &str) -> Result<Vec<String>, String> {
+    let path = dir.join(file);
+    let program = load(&path).expect("the file is written");
+    let text = read_to_string(&path).expect("the file is written");
+    let i = text[..text.find(at).expect("the name is in the file")]
+        .chars()
+        .count();
+    let index = Index::open(dir, None);
+    let edits =
+        rename(&path, &program, i, name, &index, load).map_err(|e| e.message().to_string())?;
+    Ok(edits
+        .iter()
+        .map(|(path, ranges)| {
+            let (text, encoding) = read_with_encoding(path).expect("the file is written");
+            encoding.encode(&apply(&text, ranges, name))
+        })
+        .collect())
+}
+
+#[test]
+fn rename_across_the_project() {
+    let dir = test_utils::project(
+        "rename",
+        "project",
+        &[
+            ("lib.drgns", "function double(x) -> { x * 2 }\ndouble(1)\n"),
+            (
+                "main.drgns",
+                "import lib\nprint(lib::double(1), \"${lib::double(2)}\")\ndouble := 3\n",
+            ),
+        ],
+    );
+    // from a use in another script, the one in main declaring its own is
+    // left alone
+    assert_eq!(
+        renamed(&dir, "main.drgns", "double(1)", "twice"),
+        Ok(vec![
+            "function twice(x) -> { x * 2 }\ntwice(1)\n".to_owned(),
+            "import lib\nprint(lib::twice(1), \"${lib::twice(2)}\")\ndouble := 3\n".to_owned(),
+        ])
+    );
+    assert_eq!(
+        renamed(&dir, "lib.drgns", "x * 2", "n"),
+        Ok(vec![
+            "function double(n) -> { n * 2 }\ndouble(1)\n".to_owned()
+        ])
+    );
+    let _ = fs::remove_dir_all(dir);
+}
+
+#[test]
+fn rename_files_saved_on_windows() {
+    let dir = test_utils::project(
+        "rename",
+        "windows",
+        &[
+            (
+                "lib.drgns",
+                "\u{FEFF}// doubles\r\nfunction double(x) -> {\r\n    x * 2\r\n}\r\n",
+            ),
+            (
+                "main.drgns",
+                "\u{FEFF}import lib\r\nlib::double(1)\r\nlib::double(2)\r\n",
+            ),
+        ],
+    );
+    // the ranges are in the text as read, the mark and the line endings are
+    // put back around the names replaced
+    assert_eq!(
+        renamed(&dir, "main.drgns", "double(2)", "twice"),
+        Ok(vec![
+            "\u{FEFF}// doubles\r\nfunction twice(x) -> {\r\n    x * 2\r\n}\r\n".to_owned(),
+            "\u{FEFF}import lib\r\nlib::twice(1)\r\nlib::twice(2)\r\n".to_owned(),
+        ])
+    );
+    let _ = fs::remove_dir_all(dir);
+}
+
+#[test]
+fn refuse_conflicts() {
+    let dir = test_utils::project(
+        "rename",
+        "conflicts",
+        &[
+            (
+                "a.drgns",
+                "import lib\nx := 1\ny := 2\nfunction f() -> {\n  z := 3\n  x + z + print(0)\n}\n",
+            ),
+            ("lib.drgns", "n := 1"),
+            ("b.drgns", "import lib\nlib::n"),
+        ],
+    );
+    let refused = |file, at, name| renamed(&dir, file, at, name).err();
+    assert_eq!(
+        refused("a.drgns", "x :=", "y").as_deref(),
+        Some("'y' is already declared in this scope, at 3:1")
+    );
+    assert_eq!(
+        refused("a.drgns", "x :=", "z").as_deref(),
+        Some("this use of 'x' would refer to the 'z' declared at 5:3")
+    );
+    assert_eq!(
+        refused("a.drgns", "z :=", "x").as_deref(),
+        Some("this use of 'x' would refer to the 'z' renamed")
+    );
+    assert_eq!(
+        refused("a.drgns", "x :=", "print").as_deref(),
+        Some("this use of 'print' would refer to the 'x' renamed")
+    );
+    assert_eq!(
+        refused("a.drgns", "print", "p").as_deref(),
+        Some("'print' is a builtin, it cannot be renamed")
+    );
+    assert_eq!(
+        refused("a.drgns", "lib", "m").as_deref(),
+        Some("'lib' is named after the module it imports")
+    );
+    assert_eq!(
+        refused("a.drgns", "x", "if").as_deref(),
+        Some("'if' is a keyword")
+    );
+    assert_eq!(
+        refused("a.drgns", "x", "a b").as_deref(),
+        Some("'a b' is not a name")
+    );
+    let private = refused("lib.drgns", "n", "_n").expect("refused");
+    assert!(
+        private.starts_with("'_n' would not be exported"),
+        "{}",
+        private
+    );
+    // renamed where no other name is in the way
+    assert!(renamed(&dir, "a.drgns", "z :=", "w").is_ok());
+    let _ = fs::remove_dir_all(dir);
+}
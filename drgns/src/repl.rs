@@ -0,0 +1,314 @@
+//! Interactive read-eval-print loop.
+//!
+//! The REPL is fed one physical line at a time and buffers them until a full
+//! logical line is available, which is then handed to the interpreter. See
+//! the "Interactive Evaluation" chapter of the language reference.
+
+use std::{borrow::Cow, ops::ControlFlow, path::PathBuf};
+
+use drgns::{diagnostics, Interpreter};
+use rustyline::{
+    completion::Completer, error::ReadlineError, highlight::Highlighter, hint::Hinter,
+    history::DefaultHistory, validate::Validator, Context, Editor,
+};
+
+mod commands;
+mod completion;
+mod highlight;
+pub use commands::*;
+use completion::Completion;
+
+const PROMPT: &str = "> ";
+const CONTINUATION_PROMPT: &str = "... ";
+const HISTORY_FILE: &str = ".drgns_history";
+/// run at the start of each session, in the home directory
+const INIT_FILE: &str = ".drgnsrc";
+/// names a file to run instead of the one in the home directory
+const INIT_VARIABLE: &str = "DRGNS_INIT";
+
+pub struct Repl {
+    editor: Editor<Helper, DefaultHistory>,
+    history: Option<PathBuf>,
+}
+
+impl Repl {
+    /// A session highlighting the input as it is typed, unless `plain` or the
+    /// terminal doesn't support colors
+    pub fn new(plain: bool) -> rustyline::Result<Self> {
+        let mut editor = Editor::new()?;
+        editor.set_helper(Some(Helper {
+            completion: Completion::default(),
+            color: colored(plain),
+        }));
+        let history = history_path();
+        if let Some(path) = &history {
+            // a missing history file is normal on the first run
+            if editor.load_history(path).is_err() {
+                log::debug!("no history loaded from '{}'", path.display());
+            }
+        }
+        Ok(Self { editor, history })
+    }
+
+    /// Read logical lines until the end of input, passing each one to `eval`
+    /// with the session, which can also end it early. Tab completes the names
+    /// of the session.
+    pub fn run(
+        &mut self,
+        session: &mut Interpreter,
+        mut eval: impl FnMut(&mut Interpreter, String) -> ControlFlow<()>,
+    ) {
+        loop {
+            if let Some(helper) = self.editor.helper_mut() {
+                helper.completion.update(session);
+            }
+            let Some(input) = self.read_logical_line() else {
+                break;
+            };
+            if input.trim().is_empty() {
+                continue;
+            }
+            if let Err(err) = self.editor.add_history_entry(input.as_str()) {
+                log::warn!("could not add history entry: {}", err);
+            }
+            if eval(session, input).is_break() {
+                break;
+            }
+        }
+        self.save_history();
+    }
+
+    /// Buffer physical lines until they form a complete logical line, returns
+    /// `None` on end of input.
+    fn read_logical_line(&mut self) -> Option<String> {
+        let mut buffer = String::new();
+        loop {
+            let prompt = if buffer.is_empty() {
+                PROMPT
+            } else {
+                CONTINUATION_PROMPT
+            };
+            if let Some(helper) = self.editor.helper_mut() {
+                helper.completion.pending.clone_from(&buffer);
+            }
+            match self.editor.readline(prompt) {
+                Ok(line) => {
+                    buffer.push_str(&line);
+                    buffer.push('\n');
+                    if !is_incomplete(&buffer) {
+                        return Some(buffer);
+                    }
+                }
+                // ^C abandons a partial logical line, otherwise it ends the session
+                Err(ReadlineError::Interrupted) if !buffer.is_empty() => buffer.clear(),
+                Err(ReadlineError::Interrupted) | Err(ReadlineError::Eof) => return None,
+                Err(err) => {
+                    log::error!("cannot read from terminal: {}", err);
+                    return None;
+                }
+            }
+        }
+    }
+
+    fn save_history(&mut self) {
+        if let Some(path) = &self.history {
+            if let Err(err) = self.editor.save_history(path) {
+                log::warn!("could not save history to '{}': {}", path.display(), err);
+            }
+        }
+    }
+}
+
+/// Helps typing in the editor, with what it knows of the session
+struct Helper {
+    completion: Completion,
+
+    /// whether the input is highlighted
+    color: bool,
+}
+
+impl Completer for Helper {
+    type Candidate = String;
+
+    fn complete(
+        &self,
+        line: &str,
+        pos: usize,
+        _: &Context<'_>,
+    ) -> rustyline::Result<(usize, Vec<String>)> {
+        Ok(self.completion.candidates(line, pos))
+    }
+}
+
+impl Highlighter for Helper {
+    fn highlight<'l>(&self, line: &'l str, pos: usize) -> Cow<'l, str> {
+        match self.color {
+            true => Cow::Owned(highlight::line(&self.completion.pending, line, pos)),
+            false => Cow::Borrowed(line),
+        }
+    }
+
+    // the brackets matching depends on where the cursor is, so the line is
+    // drawn again whenever it moves
+    fn highlight_char(&self, _: &str, _: usize) -> bool {
+        self.color
+    }
+}
+
+impl Hinter for Helper {
+    type Hint = String;
+}
+
+impl Validator for Helper {}
+
+impl rustyline::Helper for Helper {}
+
+/// whether the input is highlighted, as the diagnostics are colored unless
+/// `plain`
+fn colored(plain: bool) -> bool {
+    !plain && diagnostics::colored()
+}
+
+fn home() -> Option<PathBuf> {
+    std::env::var_os("HOME")
+        .or_else(|| std::env::var_os("USERPROFILE"))
+        .map(PathBuf::from)
+}
+
+fn history_path() -> Option<PathBuf> {
+    home().map(|home| home.join(HISTORY_FILE))
+}
+
+/// The script to run at the start of a session, the one `DRGNS_INIT` names,
+/// or `~/.drgnsrc` if it exists. `DRGNS_INIT` set to nothing runs none.
+pub fn init_path() -> Option<PathBuf> {
+    match std::env::var_os(INIT_VARIABLE) {
+        Some(path) if path.is_empty() => None,
+        Some(path) => Some(PathBuf::from(path)),
+        None => home()
+            .map(|home| home.join(INIT_FILE))
+            .filter(|path| path.exists()),
+    }
+}
+
+/// Check whether the input needs more physical lines before it forms a
+/// logical line, i.e. it has unclosed delimiters, an unterminated string or
+/// block comment, or ends with a binary operator, such as `|>` or `and`.
+pub fn is_incomplete(input: &str) -> bool {
+    let chars: Vec<char> = input.chars().collect();
+    let mut depth = 0_i32;
+    let mut comment_depth = 0_u32;
+    let mut quote: Option<char> = None;
+    let mut last_significant: Option<char> = None;
+    // the word the input ends with, if it ends with one
+    let mut last_word = String::new();
+    let is_word = |c: char| c.is_alphanumeric() || c == '_';
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        let next = chars.get(i + 1).copied();
+        if comment_depth > 0 {
+            match (c, next) {
+                ('/', Some('*')) => {
+                    comment_depth += 1;
+                    i += 1;
+                }
+                ('*', Some('/')) => {
+                    comment_depth -= 1;
+                    i += 1;
+                }
+                _ => {}
+            }
+        } else if let Some(q) = quote {
+            if c == '\\' && q == '"' {
+                i += 1;
+            } else if c == q {
+                quote = None;
+                last_significant = Some(c);
+                last_word.clear();
+            }
+        } else {
+            match (c, next) {
+                ('/', Some('/')) => {
+                    while i < chars.len() && chars[i] != '\n' {
+                        i += 1;
+                    }
+                    continue;
+                }
+                ('/', Some('*')) => {
+                    comment_depth += 1;
+                    i += 1;
+                }
+                ('"' | '\'', _) => quote = Some(c),
+                ('(' | '[' | '{', _) => depth += 1,
+                (')' | ']' | '}', _) => depth -= 1,
+                _ => {}
+            }
+            if !c.is_whitespace() {
+                last_significant = Some(c);
+                match is_word(c) {
+                    true if i > 0 && is_word(chars[i - 1]) => last_word.push(c),
+                    true => last_word = c.to_string(),
+                    false => last_word.clear(),
+                }
+            }
+        }
+        i += 1;
+    }
+
+    // unmatched closing delimiters are a syntax error, there is no point in
+    // waiting for more input
+    if depth < 0 {
+        return false;
+    }
+    depth > 0
+        || comment_depth > 0
+        || quote.is_some()
+        || matches!(
+            last_significant,
+            Some('+' | '-' | '*' | '/' | '%' | '=' | '<' | '>' | '|' | '~' | ',' | '\\')
+        )
+        || matches!(last_word.as_str(), "and" | "or" | "not" | "in")
+}
+
+#[cfg(test)]
+mod test {
+    use std::path::PathBuf;
+
+    use super::{init_path, is_incomplete, INIT_VARIABLE};
+
+    #[test]
+    fn complete_lines() {
+        assert!(!is_incomplete("1 + 2\n"));
+        assert!(!is_incomplete("(1 + 2) * 3\n"));
+        assert!(!is_incomplete("foo := 1; bar := 2\n"));
+        assert!(!is_incomplete("1 // trailing comment (\n"));
+        assert!(!is_incomplete("\"(\"\n"));
+        assert!(!is_incomplete(")\n"));
+        assert!(!is_incomplete("brand\n"));
+        assert!(!is_incomplete("\"a or\"\n"));
+        assert!(!is_incomplete("x := 1 // this or that\n"));
+    }
+
+    #[test]
+    fn incomplete_lines() {
+        assert!(is_incomplete("(1 + 2\n"));
+        assert!(is_incomplete("{\n    foo := 1\n"));
+        assert!(is_incomplete("1 +\n"));
+        assert!(is_incomplete("[1, 2] |>\n"));
+        assert!(is_incomplete("a and\n"));
+        assert!(is_incomplete("a or // the other\n"));
+        assert!(is_incomplete("1 <\n"));
+        assert!(is_incomplete("\"unterminated\n"));
+        assert!(is_incomplete("/* a /* nested */ comment\n"));
+    }
+
+    #[test]
+    fn init_file() {
+        std::env::set_var(INIT_VARIABLE, "/etc/drgns/init.drgns");
+        assert_eq!(init_path(), Some(PathBuf::from("/etc/drgns/init.drgns")));
+        std::env::set_var(INIT_VARIABLE, "");
+        assert_eq!(init_path(), None);
+        std::env::remove_var(INIT_VARIABLE);
+    }
+}
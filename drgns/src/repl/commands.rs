@@ -0,0 +1,462 @@
+//! Meta-commands of the REPL, lines starting with `:` such as `:load`.
+//!
+//! They are recognized before the input reaches the parser, so they don't
+//! have to be valid code, and they control the session rather than being
+//! evaluated in it.
+
+use std::{ops::ControlFlow, sync::Arc};
+
+use drgns::{
+    doc,
+    error_handler::{DragonError, ErrorCode},
+    interpreter::{Halt, BUILTINS, MODULES},
+    modules::Module,
+    parser::{self, BinOperator, Expression, Literal, Statement, UnOperator},
+    source::Source,
+    Interpreter, Value,
+};
+
+use crate::report;
+
+pub const PREFIX: char = ':';
+
+/// name, arguments and description, in the order shown by `:help`
+pub(super) const COMMANDS: &[(&str, &str, &str)] = &[
+    ("help", "", "show this help"),
+    ("load", "<file>", "run a script in the session"),
+    (
+        "reload",
+        "<module>",
+        "evaluate an imported module again from its file",
+    ),
+    (
+        "type",
+        "<expr>",
+        "show the type of an expression without evaluating it",
+    ),
+    (
+        "doc",
+        "<name>",
+        "show the signature and documentation of a function or a module",
+    ),
+    ("env", "", "list the variables of the session"),
+    ("reset", "", "forget all variables"),
+    ("quit", "", "end the session"),
+];
+
+#[derive(Debug, PartialEq)]
+pub enum Command {
+    Help,
+    Load(String),
+    Reload(String),
+    Type(String),
+    Doc(String),
+    Env,
+    Reset,
+    Quit,
+}
+
+impl Command {
+    /// `None` if the input is code rather than a command, an `Err` if the
+    /// command is unknown or its arguments are wrong
+    pub fn parse(input: &str) -> Option<Result<Self, String>> {
+        let line = input.trim().strip_prefix(PREFIX)?;
+        let (name, argument) = match line.split_once(char::is_whitespace) {
+            Some((name, argument)) => (name, argument.trim()),
+            None => (line, ""),
+        };
+        let expects_argument = |command: fn(String) -> Self| match argument {
+            "" => Err(format!(":{} expects an argument, see :help", name)),
+            a => Ok(command(a.to_owned())),
+        };
+        let no_argument = |command: Self| match argument {
+            "" => Ok(command),
+            _ => Err(format!(":{} takes no arguments", name)),
+        };
+        Some(match name {
+            "help" | "h" | "?" => no_argument(Self::Help),
+            "load" | "l" => expects_argument(Self::Load),
+            "reload" | "r" => expects_argument(Self::Reload),
+            "type" | "t" => expects_argument(Self::Type),
+            "doc" | "d" => expects_argument(Self::Doc),
+            "env" => no_argument(Self::Env),
+            "reset" => no_argument(Self::Reset),
+            "quit" | "q" => no_argument(Self::Quit),
+            _ => Err(format!("unknown command ':{}', see :help", name)),
+        })
+    }
+
+    /// Run the command in the session, breaks to end it
+    pub fn execute(self, session: &mut Interpreter) -> ControlFlow<()> {
+        match self {
+            Self::Help => help(),
+            Self::Load(path) => load(session, &path),
+            Self::Reload(module) => reload(session, &module),
+            Self::Type(expr) => show_type(session, expr),
+            Self::Doc(name) => show_doc(session, &name),
+            Self::Env => {
+                for name in session.global_names() {
+                    if let Some(v) = session.get_global(&name) {
+                        println!("{}: {} = {}", name, v.type_name(), v.inspect());
+                    }
+                }
+            }
+            Self::Reset => session.reset(),
+            Self::Quit => return ControlFlow::Break(()),
+        }
+        ControlFlow::Continue(())
+    }
+}
+
+fn help() {
+    println!("Enter code to evaluate it, or one of these commands:");
+    for (name, argument, description) in COMMANDS {
+        let usage = format!(":{} {}", name, argument);
+        println!("  {:<16}{}", usage, description);
+    }
+}
+
+fn load(session: &mut Interpreter, path: &str) {
+    let src = match drgns::source::load(path) {
+        Ok(src) => src,
+        Err(e) => {
+            let code = match e.kind() {
+                std::io::ErrorKind::NotFound => ErrorCode::IoNotFound,
+                _ => ErrorCode::Io,
+            };
+            let msg = format!("cannot read '{}': {}", path, e);
+            return report(&[DragonError::new(code, msg, None)]);
+        }
+    };
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        return report(&errors);
+    }
+    match session.eval(&program) {
+        Ok(_) => {}
+        // the script is done, the session isn't
+        Err(Halt::Exit(code)) => println!("'{}' exited with code {}", path, code),
+        Err(Halt::Error(e)) => report(&[e]),
+    }
+}
+
+/// Evaluate again the module a global holds, or the one imported with the
+/// path, such as `lib::util`, the globals holding it get the new one
+fn reload(session: &mut Interpreter, name: &str) {
+    let modules: Vec<(String, _)> = session
+        .global_names()
+        .into_iter()
+        .filter_map(|global| match session.get_global(&global) {
+            Some(Value::Module(m)) => Some((global, m)),
+            _ => None,
+        })
+        .collect();
+    let module = modules
+        .iter()
+        .find(|(global, _)| global == name)
+        .or_else(|| modules.iter().find(|(_, m)| m.name == name));
+    let Some((_, module)) = module else {
+        let msg = format!("no global holds the module '{}', see :env", name);
+        return report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+    };
+    match session.reload(module) {
+        Ok(_) => {}
+        Err(Halt::Exit(code)) => println!("'{}' exited with code {}", name, code),
+        Err(Halt::Error(e)) => report(&[e]),
+    }
+}
+
+fn show_type(session: &Interpreter, expr: String) {
+    let src = Arc::new(Source::from_string(expr));
+    let (program, errors) = parser::parse(&src);
+    if !errors.is_empty() {
+        return report(&errors);
+    }
+    match program.statements.as_slice() {
+        [Statement::Expression(e)] => println!("{}", infer(e, session)),
+        _ => report(&[DragonError::new(
+            ErrorCode::Generic,
+            ":type expects a single expression".to_string(),
+            None,
+        )]),
+    }
+}
+
+/// Print the signature of a function and its documentation, as `drgns doc`
+/// writes it, or what a module is for and what it exports. The name is a
+/// global of the session, a builtin or a native module, or an export of one
+/// of those modules, such as `json::parse`.
+fn show_doc(session: &Interpreter, name: &str) {
+    let Some(value) = lookup(session, name) else {
+        let msg = format!("'{}' is not defined, see :env", name);
+        return report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+    };
+    match describe(name, &value) {
+        Some(text) => println!("{}", text),
+        None => report(&[DragonError::new(
+            ErrorCode::Generic,
+            format!(
+                ":doc expects a function or a module, found {}",
+                value.type_name()
+            ),
+            None,
+        )]),
+    }
+}
+
+/// the value a name documented with `:doc` stands for
+fn lookup(session: &Interpreter, name: &str) -> Option<Value> {
+    if let Some((module, export)) = name.rsplit_once("::") {
+        return match lookup(session, module)? {
+            Value::Module(m) => m.get(export),
+            _ => None,
+        };
+    }
+    let builtin = || BUILTINS.iter().find(|b| b.name == name).map(Value::Builtin);
+    let native = || {
+        MODULES.iter().find(|(module, ..)| *module == name).map(
+            |(module, functions, constants, _)| {
+                Value::Module(Arc::new(Module::native(module, functions, constants)))
+            },
+        )
+    };
+    session.get_global(name).or_else(builtin).or_else(native)
+}
+
+/// the signature and the documentation of a function, or those of a
+/// module, `None` for other values
+fn describe(name: &str, value: &Value) -> Option<String> {
+    let (signature, documentation) = match value {
+        Value::Function(f) => (
+            doc::function_signature(&f.declaration),
+            f.declaration.doc.clone(),
+        ),
+        Value::Closure(c) => (c.prototype.signature.clone(), c.prototype.doc.clone()),
+        Value::Builtin(b) => (
+            format!("builtin {}({})", name, b.parameters),
+            b.doc.to_owned(),
+        ),
+        // registered by the host, which tells nothing about them
+        Value::Native(_) => (format!("builtin {}", name), String::new()),
+        Value::Module(m) => {
+            let exports: Vec<&str> = m.exports().collect();
+            let mut documentation = m.doc();
+            if !exports.is_empty() {
+                if !documentation.is_empty() {
+                    documentation.push_str("\n\n");
+                }
+                documentation.push_str(&format!("exports: {}", exports.join(", ")));
+            }
+            (format!("module {}", m.name), documentation)
+        }
+        _ => return None,
+    };
+    Some(match documentation.is_empty() {
+        true => signature,
+        false => format!("{}\n\n{}", signature, documentation),
+    })
+}
+
+/// The type an expression evaluates to, as far as it can be told without
+/// evaluating it, `any` otherwise. Variables have the type of their current
+/// value.
+pub fn infer(e: &Expression, session: &Interpreter) -> String {
+    let numeric = |lhs: &Expression, rhs: &Expression| {
+        match (infer(lhs, session).as_str(), infer(rhs, session).as_str()) {
+            ("int", "int") => "int",
+            ("int" | "float", "int" | "float") => "float",
+            _ => "any",
+        }
+        .to_string()
+    };
+    match e {
+        Expression::Literal(l) => match l.value {
+            Literal::None => "none",
+            Literal::Bool(_) => "bool",
+            Literal::Int(_) => "int",
+            Literal::Float(_) => "float",
+            Literal::String(_) => "string",
+            Literal::Symbol(_) => "symbol",
+            Literal::Bytes(_) => "bytes",
+        }
+        .to_string(),
+        Expression::Variable(v) => session
+            .get_global(&v.name)
+            .map_or("any".to_string(), |v| v.type_name().into_owned()),
+        Expression::Group(g) => infer(&g.inner, session),
+        Expression::Unary(u) => match u.op {
+            UnOperator::Not => "bool".to_string(),
+            UnOperator::BitNot => "int".to_string(),
+            UnOperator::Str => "string".to_string(),
+            UnOperator::Neg => match infer(&u.rhs, session).as_str() {
+                t @ ("int" | "float") => t.to_string(),
+                _ => "any".to_string(),
+            },
+        },
+        Expression::Binary(b) => {
+            use BinOperator as Op;
+            match b.op {
+                Op::Pow | Op::Mul | Op::Div | Op::Mod | Op::Add | Op::Sub => {
+                    numeric(&b.lhs, &b.rhs)
+                }
+                Op::Concat => match infer(&b.lhs, session).as_str() {
+                    t @ ("string" | "list") => t.to_string(),
+                    _ => "any".to_string(),
+                },
+                Op::BitAnd | Op::BitOr | Op::BitXor | Op::Shl | Op::Lsr | Op::Asr => {
+                    "int".to_string()
+                }
+                Op::Eq
+                | Op::Ne
+                | Op::Lt
+                | Op::Le
+                | Op::Gt
+                | Op::Ge
+                | Op::And
+                | Op::Or
+                | Op::Xor
+                | Op::In => "bool".to_string(),
+                // the right is only the value if the left may be none
+                Op::Coalesce => {
+                    let lhs = infer(&b.lhs, session);
+                    let present: Vec<&str> = lhs.split(" | ").filter(|t| *t != "none").collect();
+                    if present.len() == lhs.split(" | ").count() {
+                        return lhs;
+                    }
+                    let rhs = infer(&b.rhs, session);
+                    union(present.into_iter().map(str::to_string).chain([rhs]))
+                }
+            }
+        }
+        Expression::Lambda(_) => "function".to_string(),
+        Expression::List(_) => "list".to_string(),
+        Expression::Map(_) => "map".to_string(),
+        Expression::If(i) => {
+            let branches = i.branches.iter().map(|(_, b)| Some(b));
+            union(branches.chain([i.otherwise.as_ref()]).map(|block| {
+                match block.and_then(|b| b.statements.last()) {
+                    Some(Statement::Expression(e)) => infer(e, session),
+                    Some(_) => "any".to_string(),
+                    None => "none".to_string(),
+                }
+            }))
+        }
+        Expression::Match(m) => union(m.arms.iter().map(|a| infer(&a.body, session))),
+        Expression::Block(b) => match b.statements.last() {
+            Some(Statement::Expression(e)) => infer(e, session),
+            None => "none".to_string(),
+            Some(_) => "any".to_string(),
+        },
+        _ => "any".to_string(),
+    }
+}
+
+/// the distinct types, `any` if one of them is
+fn union(types: impl Iterator<Item = String>) -> String {
+    let mut distinct: Vec<String> = vec![];
+    for t in types {
+        if !distinct.contains(&t) {
+            distinct.push(t);
+        }
+    }
+    match distinct.iter().any(|t| t == "any") {
+        true => "any".to_string(),
+        false => distinct.join(" | "),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+
+    use drgns::{
+        parser::{parse, Statement},
+        source::Source,
+        Interpreter, Value,
+    };
+
+    use super::{describe, infer, lookup, Command};
+
+    #[test]
+    fn parse_commands() {
+        assert_eq!(Command::parse("1 + 2\n"), None);
+        assert_eq!(Command::parse(":quit\n"), Some(Ok(Command::Quit)));
+        assert_eq!(
+            Command::parse(":load  lib/a.drgns \n"),
+            Some(Ok(Command::Load("lib/a.drgns".to_string())))
+        );
+        assert_eq!(
+            Command::parse(":t 1 + 2"),
+            Some(Ok(Command::Type("1 + 2".to_string())))
+        );
+        assert_eq!(
+            Command::parse(":r lib::util"),
+            Some(Ok(Command::Reload("lib::util".to_string())))
+        );
+        assert_eq!(
+            Command::parse(":doc json::parse"),
+            Some(Ok(Command::Doc("json::parse".to_string())))
+        );
+        assert!(matches!(Command::parse(":load"), Some(Err(_))));
+        assert!(matches!(Command::parse(":doc"), Some(Err(_))));
+        assert!(matches!(Command::parse(":reload"), Some(Err(_))));
+        assert!(matches!(Command::parse(":env x"), Some(Err(_))));
+        assert!(matches!(Command::parse(":nope"), Some(Err(_))));
+    }
+
+    #[test]
+    fn infer_types() {
+        let mut session = Interpreter::new();
+        session.set_global("x", Value::Float(1.5));
+        let type_of = |s: &str| {
+            let (program, _) = parse(&Arc::new(Source::from_string(s.to_string())));
+            let Some(Statement::Expression(e)) = program.statements.first() else {
+                panic!("{:?} is not an expression", s);
+            };
+            infer(e, &session)
+        };
+        assert_eq!(type_of("1 + 2 * 3"), "int");
+        assert_eq!(type_of("-(x + 1)"), "float");
+        assert_eq!(type_of("1 < 2 and true"), "bool");
+        assert_eq!(type_of("if x { 1 }"), "int | none");
+        assert_eq!(type_of("(y) -> y"), "function");
+        assert_eq!(
+            type_of("match x { 1 -> \"one\", _ -> x }"),
+            "string | float"
+        );
+        assert_eq!(type_of("[1] ++ [x]"), "list");
+        assert_eq!(type_of("undefined + 1"), "any");
+    }
+
+    #[test]
+    fn documentation() {
+        let mut session = Interpreter::new();
+        let source = "/// the area of a rectangle\n\
+                      ///\n\
+                      /// in square units\n\
+                      function area(w: float, h: float) -> float { w * h }\n\
+                      x := 1";
+        let (program, _) = parse(&Arc::new(Source::from_string(source.to_string())));
+        session.eval(&program).expect("the program runs");
+        let doc_of = |name: &str| describe(name, &lookup(&session, name)?);
+        let area = doc_of("area").expect("area is a function");
+        assert!(
+            area.starts_with("function area(w: float, h: float) -> float\n\n"),
+            "{}",
+            area
+        );
+        assert!(area.ends_with("the area of a rectangle\n\nin square units"));
+        assert_eq!(
+            doc_of("len").as_deref().and_then(|d| d.lines().next()),
+            Some("builtin len(value)")
+        );
+        let parse_doc = doc_of("json::parse").expect("json::parse is a builtin");
+        assert!(parse_doc.starts_with("builtin json::parse(text)\n\n"));
+        let json = doc_of("json").expect("json is a module");
+        assert!(json.starts_with("module json\n\n"));
+        assert!(json.ends_with("exports: parse, stringify"));
+        assert_eq!(doc_of("x"), None);
+        assert!(lookup(&session, "missing").is_none());
+        assert!(lookup(&session, "json::missing").is_none());
+    }
+}
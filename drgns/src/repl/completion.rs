@@ -0,0 +1,338 @@
+//! Tab completion of the REPL.
+//!
+//! What is completed depends on what comes before the cursor: the name of a
+//! command after `:`, a path in the argument of `:load` or in a string, a
+//! module of the session after `:reload`, code after `:type` and `:doc`, an
+//! export of a module after `::`, a field or a method of an instance after
+//! `.`, and otherwise a keyword, a builtin, a global of the session or a name
+//! the checker finds visible in the lines typed so far.
+
+use std::{fs, path::Path, sync::Arc};
+
+use drgns::{
+    checker,
+    interpreter::{builtins::VARIABLES, BUILTINS, MODULES},
+    lexer, parser,
+    source::Source,
+    Interpreter, Value,
+};
+
+use super::{commands::COMMANDS, PREFIX};
+
+/// Completes the input of the REPL, from the session as it was before the
+/// logical line being typed
+#[derive(Default)]
+pub struct Completion {
+    /// the globals of the session, with their values
+    globals: Vec<(String, Value)>,
+
+    /// the physical lines of the logical line typed before the current one
+    pub pending: String,
+}
+
+/// what the text before the cursor ends in
+enum Lexical {
+    Code,
+
+    /// a string whose contents start at the byte offset
+    String(usize),
+    Comment,
+}
+
+impl Completion {
+    /// Take the globals of the session, for the lines typed next
+    pub fn update(&mut self, session: &Interpreter) {
+        self.globals = session
+            .global_names()
+            .into_iter()
+            .filter_map(|name| session.get_global(&name).map(|v| (name, v)))
+            .collect();
+    }
+
+    /// The byte offset where the text to complete starts in the line, and
+    /// what it can be replaced with, sorted
+    pub fn candidates(&self, line: &str, pos: usize) -> (usize, Vec<String>) {
+        let before = &line[..pos];
+        let trimmed = before.trim_start();
+        if let Some(command) = trimmed
+            .strip_prefix(PREFIX)
+            .filter(|_| self.pending.is_empty())
+        {
+            let Some((name, argument)) = command.split_once(char::is_whitespace) else {
+                let names = COMMANDS.iter().map(|(name, ..)| name.to_string());
+                return (pos - command.len(), matching(names, command));
+            };
+            let argument = argument.trim_start();
+            let start = pos - argument.len();
+            return match name {
+                "load" | "l" => (start, paths(argument)),
+                "reload" | "r" => (start, matching(self.modules(), argument)),
+                "type" | "t" | "doc" | "d" => offset(start, self.code(argument)),
+                _ => (pos, vec![]),
+            };
+        }
+        match lexical(before) {
+            Lexical::Code => self.code(before),
+            Lexical::String(start) => (start, paths(&before[start..])),
+            Lexical::Comment => (pos, vec![]),
+        }
+    }
+
+    /// the completions of the word the code ends in
+    fn code(&self, before: &str) -> (usize, Vec<String>) {
+        let start = before.trim_end_matches(is_identifier).len();
+        let (head, word) = before.split_at(start);
+        let names: Vec<String> = if let Some(module) = head.strip_suffix("::") {
+            self.exports(last_identifier(module))
+        } else if let Some(target) = head.strip_suffix('.') {
+            self.members(last_identifier(target))
+        } else {
+            self.identifiers(before)
+        };
+        (start, matching(names.into_iter(), word))
+    }
+
+    /// the exports of a module of the session, or of a native one, or the
+    /// variants of an enum
+    fn exports(&self, name: &str) -> Vec<String> {
+        match self.global(name) {
+            Some(Value::Module(m)) => m.exports().map(str::to_owned).collect(),
+            Some(Value::Enum(e)) => e.variants.keys().cloned().collect(),
+            Some(_) => vec![],
+            None => MODULES
+                .iter()
+                .filter(|(module, ..)| *module == name)
+                .flat_map(|(_, functions, constants, _)| {
+                    let functions = functions.iter().map(|f| f.name);
+                    functions.chain(constants.iter().map(|(c, _)| *c))
+                })
+                .map(str::to_owned)
+                .collect(),
+        }
+    }
+
+    /// the fields and the methods of an instance of the session
+    fn members(&self, name: &str) -> Vec<String> {
+        match self.global(name) {
+            Some(Value::Instance(i)) => {
+                let methods = i.of.methods.keys();
+                i.of.fields.iter().chain(methods).cloned().collect()
+            }
+            _ => vec![],
+        }
+    }
+
+    /// the globals holding modules loaded from files
+    fn modules(&self) -> impl Iterator<Item = String> + '_ {
+        self.globals.iter().filter_map(|(name, v)| match v {
+            Value::Module(m) if m.path.is_some() => Some(name.clone()),
+            _ => None,
+        })
+    }
+
+    /// the names in scope at the end of the code, which is the rest of the
+    /// logical line
+    fn identifiers(&self, before: &str) -> Vec<String> {
+        let mut code = format!("{}{}", self.pending, before);
+        let end = code.chars().count();
+        // the scopes being typed are closed, for the parser to see them
+        code.push_str(&closing(&code));
+        let (program, _) = parser::parse(&Arc::new(Source::from_string(code)));
+        let analysis = checker::analyze(&program);
+        let locals = analysis
+            .visible(end)
+            .into_iter()
+            .map(|d| d.name.name.clone());
+        let builtins = BUILTINS
+            .iter()
+            .map(|b| b.name)
+            .chain(MODULES.iter().map(|(name, ..)| *name))
+            .chain(VARIABLES.iter().copied())
+            .chain(lexer::keywords());
+        let globals = self.globals.iter().map(|(name, _)| name.clone());
+        locals
+            .chain(globals)
+            .chain(builtins.map(str::to_owned))
+            .collect()
+    }
+
+    fn global(&self, name: &str) -> Option<&Value> {
+        self.globals.iter().find(|(n, _)| n == name).map(|(_, v)| v)
+    }
+}
+
+fn is_identifier(c: char) -> bool {
+    c.is_alphanumeric() || c == '_'
+}
+
+/// the identifier the text ends in, empty if there is none
+fn last_identifier(text: &str) -> &str {
+    &text[text.trim_end_matches(is_identifier).len()..]
+}
+
+/// the names starting with the prefix, sorted and without duplicates
+fn matching(names: impl Iterator<Item = String>, prefix: &str) -> Vec<String> {
+    let mut names: Vec<String> = names.filter(|n| n.starts_with(prefix)).collect();
+    names.sort();
+    names.dedup();
+    names
+}
+
+fn offset(by: usize, (start, names): (usize, Vec<String>)) -> (usize, Vec<String>) {
+    (by + start, names)
+}
+
+/// whether a line ends in code, a string or a comment, strings and comments
+/// spanning several lines are not told apart from code
+fn lexical(line: &str) -> Lexical {
+    let mut chars = line.char_indices().peekable();
+    let mut quote = None;
+    while let Some((i, c)) = chars.next() {
+        match quote {
+            Some(_) if c == '\\' => {
+                chars.next();
+            }
+            Some((q, _)) if c == q => quote = None,
+            Some(_) => {}
+            None if c == '/' && chars.peek().is_some_and(|&(_, next)| next == '/') => {
+                return Lexical::Comment;
+            }
+            None if c == '"' || c == '\'' => quote = Some((c, i + 1)),
+            None => {}
+        }
+    }
+    match quote {
+        Some((_, start)) => Lexical::String(start),
+        None => Lexical::Code,
+    }
+}
+
+/// the delimiters closing those the code leaves open, innermost first
+fn closing(code: &str) -> String {
+    let mut open = vec![];
+    let mut chars = code.chars().peekable();
+    let mut quote = None;
+    while let Some(c) = chars.next() {
+        match (quote, c) {
+            (Some(_), '\\') => {
+                chars.next();
+            }
+            (Some(q), _) if c == q => quote = None,
+            (Some(_), _) => {}
+            (None, '/') if chars.peek() == Some(&'/') => {
+                chars.find(|&c| c == '\n');
+            }
+            (None, '"' | '\'') => quote = Some(c),
+            (None, '(') => open.push(')'),
+            (None, '[') => open.push(']'),
+            (None, '{') => open.push('}'),
+            (None, ')' | ']' | '}') => {
+                open.pop();
+            }
+            (None, _) => {}
+        }
+    }
+    quote.into_iter().chain(open.into_iter().rev()).collect()
+}
+
+/// the paths starting with the prefix, relative to the current directory
+/// unless it is absolute, directories end in `/`
+fn paths(prefix: &str) -> Vec<String> {
+    let (dir, file) = match prefix.rfind('/') {
+        Some(i) => prefix.split_at(i + 1),
+        None => ("", prefix),
+    };
+    let Ok(entries) = fs::read_dir(if dir.is_empty() {
+        Path::new(".")
+    } else {
+        Path::new(dir)
+    }) else {
+        return vec![];
+    };
+    let paths = entries.flatten().filter_map(|e| {
+        let name = e.file_name().into_string().ok()?;
+        // hidden files only if asked for
+        if name.starts_with('.') && !file.starts_with('.') {
+            return None;
+        }
+        let slash = if e.path().is_dir() { "/" } else { "" };
+        Some(format!("{}{}{}", dir, name, slash))
+    });
+    matching(paths, prefix)
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+
+    use drgns::{parser::parse, source::Source, Interpreter};
+
+    use super::Completion;
+    use crate::test_utils;
+
+    fn completion(globals: &str) -> Completion {
+        let mut session = Interpreter::new();
+        let (program, errors) = parse(&Arc::new(Source::from_string(globals.to_owned())));
+        assert!(
+            errors.is_empty(),
+            "unexpected parse errors in {:?}",
+            globals
+        );
+        session.eval(&program).expect("the globals are declared");
+        let mut completion = Completion::default();
+        completion.update(&session);
+        completion
+    }
+
+    fn complete(completion: &Completion, line: &str) -> (usize, Vec<String>) {
+        completion.candidates(line, line.len())
+    }
+
+    #[test]
+    fn names_in_scope() {
+        let mut c = completion("count := 1\nmut counter := 2");
+        let (start, names) = complete(&c, "print(cou");
+        assert_eq!((start, names), (6, vec!["count".into(), "counter".into()]));
+        assert_eq!(complete(&c, "con").1, ["const", "continue"]);
+        assert_eq!(complete(&c, "ma").1, ["match", "math"]);
+
+        // the parameters of the function being typed, on the lines before
+        c.pending = "function f(width, height) -> {\n".to_owned();
+        assert_eq!(complete(&c, "  wi").1, ["width"]);
+        assert!(complete(&c, "  // wi").1.is_empty());
+    }
+
+    #[test]
+    fn members() {
+        let struct_point = "struct Point {\nx, y\nfunction norm(self) -> { 0 }\n}\n";
+        let c = completion(&format!("{}p := Point(1, 2)\nm := math", struct_point));
+        assert_eq!(complete(&c, "p.").1, ["norm", "x", "y"]);
+        assert_eq!(complete(&c, "1 + p.n"), (6, vec!["norm".into()]));
+        assert_eq!(complete(&c, "math::ab").1, ["abs"]);
+        assert_eq!(complete(&c, "m::p").1, ["pi", "pow"]);
+        assert!(complete(&c, "nothing::").1.is_empty());
+    }
+
+    #[test]
+    fn commands_and_paths() {
+        let c = completion("");
+        assert_eq!(complete(&c, ":re").1, ["reload", "reset"]);
+        assert_eq!(complete(&c, ":res"), (1, vec!["reset".into()]));
+        assert_eq!(complete(&c, ":t cou").0, 3);
+        let dir = test_utils::directory("repl", "completion");
+        std::fs::create_dir_all(dir.join("lib")).expect("the directory is created");
+        std::fs::write(dir.join("lib.drgns"), "").expect("the file is written");
+        let prefix = format!("{}/li", dir.display());
+        let paths = vec![
+            format!("{}/lib.drgns", dir.display()),
+            format!("{}/lib/", dir.display()),
+        ];
+        assert_eq!(
+            complete(&c, &format!(":load {}", prefix)),
+            (6, paths.clone())
+        );
+        let line = format!("fs::read(\"{}", prefix);
+        assert_eq!(complete(&c, &line), (10, paths));
+        let _ = std::fs::remove_dir_all(dir);
+    }
+}
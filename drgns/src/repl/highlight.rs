@@ -0,0 +1,126 @@
+//! Highlighting of the line being typed in the REPL.
+//!
+//! The line is lexed again on each keystroke, after the physical lines typed
+//! before it so that a string or a comment they leave open is still told
+//! apart. The bracket at the cursor and the one matching it are emphasized.
+
+use std::sync::Arc;
+
+use drgns::{
+    highlight::{self, Class, Highlight},
+    source::Source,
+};
+
+/// the escape codes of the classes, `None` for the default color
+fn style(class: Class) -> Option<&'static str> {
+    match class {
+        Class::Keyword => Some("\x1b[35m"),
+        Class::String => Some("\x1b[32m"),
+        Class::Number | Class::Symbol => Some("\x1b[33m"),
+        Class::Function => Some("\x1b[34m"),
+        Class::Type => Some("\x1b[36m"),
+        Class::Comment => Some("\x1b[90m"),
+        Class::Operator | Class::Punctuation | Class::Identifier => None,
+    }
+}
+
+const MATCHING: &str = "\x1b[1;4m";
+const RESET: &str = "\x1b[0m";
+
+/// The line with escape codes coloring its tokens, `pending` being the
+/// physical lines typed before it and `pos` the byte offset of the cursor
+pub fn line(pending: &str, line: &str, pos: usize) -> String {
+    let src = Arc::new(Source::from_string(format!("{}{}", pending, line)));
+    let tokens = highlight::tokens(&src);
+    let offset = pending.chars().count();
+    let cursor = offset + line[..pos].chars().count();
+    let matching = matching(&tokens, cursor);
+    let chars: Vec<char> = line.chars().collect();
+    let mut highlighted = String::new();
+    let mut at = 0;
+    for t in tokens.iter().filter(|t| t.span.end() > offset) {
+        let start = t.span.start().max(offset) - offset;
+        let end = (t.span.end() - offset).min(chars.len());
+        highlighted.extend(&chars[at..start]);
+        let style = match matching.contains(&t.span.start()) {
+            true => Some(MATCHING),
+            false => style(t.class),
+        };
+        match style {
+            Some(style) => {
+                highlighted.push_str(style);
+                highlighted.extend(&chars[start..end]);
+                highlighted.push_str(RESET);
+            }
+            None => highlighted.extend(&chars[start..end]),
+        }
+        at = end;
+    }
+    highlighted.extend(&chars[at..]);
+    highlighted
+}
+
+/// the starts of the bracket just before the cursor, or else the one at it,
+/// and of the one matching it, if there is one
+fn matching(tokens: &[Highlight], cursor: usize) -> Vec<usize> {
+    let bracket = |t: &Highlight| match t.span.to_string().as_str() {
+        "(" | "[" | "{" => Some(1),
+        ")" | "]" | "}" => Some(-1),
+        _ => None,
+    };
+    let brackets: Vec<(usize, i32)> = tokens
+        .iter()
+        .filter(|t| t.class == Class::Punctuation)
+        .filter_map(|t| bracket(t).map(|depth| (t.span.start(), depth)))
+        .collect();
+    let Some(i) = brackets
+        .iter()
+        .position(|&(start, _)| start + 1 == cursor)
+        .or_else(|| brackets.iter().position(|&(start, _)| start == cursor))
+    else {
+        return vec![];
+    };
+    let (start, direction) = brackets[i];
+    let mut depth = 0;
+    let mut scan = |(other, d): &(usize, i32)| {
+        depth += d;
+        (depth == 0).then_some(*other)
+    };
+    let other = match direction {
+        1 => brackets[i..].iter().find_map(&mut scan),
+        _ => brackets[..=i].iter().rev().find_map(&mut scan),
+    };
+    other.map_or(vec![], |other| vec![start, other])
+}
+
+#[cfg(test)]
+mod test {
+    use super::line;
+
+    #[test]
+    fn tokens_are_colored() {
+        assert_eq!(
+            line("", "if x { \"a\" } // b", 0),
+            "\x1b[35mif\x1b[0m x { \x1b[32m\"a\"\x1b[0m } \x1b[90m// b\x1b[0m"
+        );
+        // the string opened on the line before goes on
+        assert_eq!(
+            line("x := \"a\n", "b\" + 1", 0),
+            "\x1b[32mb\"\x1b[0m + \x1b[33m1\x1b[0m"
+        );
+    }
+
+    #[test]
+    fn brackets_at_the_cursor_are_matched() {
+        let matched = "f\x1b[1;4m(\x1b[0m[x]\x1b[1;4m)\x1b[0m";
+        assert_eq!(line("", "f([x])", 6), matched);
+        assert_eq!(line("", "f([x])", 1), matched);
+        assert_eq!(
+            line("", "f([x])", 3),
+            "f(\x1b[1;4m[\x1b[0mx\x1b[1;4m]\x1b[0m)"
+        );
+        // the one on the line before is not drawn again
+        assert_eq!(line("{\n", "}", 1), "\x1b[1;4m}\x1b[0m");
+        assert_eq!(line("", "f(\")\"", 2), "f(\x1b[32m\")\"\x1b[0m");
+    }
+}
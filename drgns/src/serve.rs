@@ -0,0 +1,528 @@
+//! The playground server of `drgns serve`, for demos and tools: a page to
+//! write code on and run it from a browser, and the endpoint the page posts
+//! it to.
+//!
+//! - `GET /` is the page
+//! - `POST /run` runs the code of the body, a JSON object such as
+//!   `{"code": "print(1 + 2)"}`, and answers with what it did as a JSON
+//!   object, see `playground::Outcome`
+//!
+//! Each run starts from a new interpreter, which the caller makes in a
+//! sandbox and held to limits, on a thread of its own, and stops after the
+//! timeout. A run still going a second later, such as one waiting on a
+//! channel nobody sends to, is left behind on its thread and answered with
+//! the timeout, what it printed lost. Past `MAX_STUCK` runs left behind the
+//! server takes no more code, rather than piling up threads. Since stopping
+//! a script stops whatever runs, the requests are served one at a time.
+//!
+//! HTTP is only spoken as far as browsers and `curl` need: a request for
+//! each connection, with a body of `Content-Length` bytes.
+
+use std::{
+    io::{self, BufRead, BufReader, Read, Write},
+    net::TcpListener,
+    sync::{
+        atomic::{AtomicBool, AtomicUsize, Ordering},
+        mpsc::{self, RecvTimeoutError},
+        Arc,
+    },
+    thread,
+    time::Duration,
+};
+
+use drgns::{
+    diagnostics,
+    error_handler::{DragonError, ErrorCode},
+    interpreter::interrupt::{self, Reason},
+    playground::{self, Outcome},
+    Interpreter,
+};
+use serde_json::{json, Value as Json};
+
+use crate::{report, GRACE, INVALID_PROGRAM, TIMED_OUT};
+
+/// How long a client may take to send its request
+const READ_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// The most bytes of a request line and its headers
+const MAX_HEAD: usize = 16 * 1024;
+
+/// The most bytes of code a run takes
+const MAX_BODY: usize = 1024 * 1024;
+
+/// The most runs left behind on their threads at once
+const MAX_STUCK: usize = 8;
+
+/// Serve the playground at the address until the process is stopped, each
+/// run in an interpreter `interpreter` makes, on a thread with `stack`
+/// bytes of stack and for at most `timeout`. Returns the exit status of the
+/// process if the address can't be listened on.
+pub fn run(
+    address: &str,
+    timeout: Duration,
+    stack: usize,
+    interpreter: impl Fn() -> Interpreter + Send + Sync + 'static,
+) -> i32 {
+    let listener = match TcpListener::bind(address) {
+        Ok(listener) => listener,
+        Err(e) => {
+            let msg = format!("cannot listen on {}: {}", address, e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            return INVALID_PROGRAM;
+        }
+    };
+    let address = listener
+        .local_addr()
+        .map_or(address.to_owned(), |a| a.to_string());
+    eprintln!("the playground is at http://{}", address);
+    let runner = Runner {
+        run: Arc::new(move |code: &str| playground::run(&mut interpreter(), code)),
+        timeout,
+        grace: GRACE,
+        stack,
+        stop: |timeout| interrupt::request(Reason::Timeout(timeout)),
+        resume: interrupt::clear,
+        stuck: Arc::default(),
+    };
+    for stream in listener.incoming() {
+        let Ok(stream) = stream else {
+            continue;
+        };
+        let _ = stream.set_read_timeout(Some(READ_TIMEOUT));
+        if let Err(e) = exchange(BufReader::new(&stream), &stream, |code| {
+            runner.execute(code)
+        }) {
+            log::warn!("the playground could not answer a request: {}", e);
+        }
+    }
+    // the listener only stops handing out connections on errors
+    INVALID_PROGRAM
+}
+
+/// Runs code on threads of their own, so that the server can leave behind
+/// the runs that don't stop
+struct Runner {
+    run: Arc<dyn Fn(&str) -> Outcome + Send + Sync>,
+    timeout: Duration,
+
+    /// how long a run has to stop once asked to
+    grace: Duration,
+
+    /// the bytes of stack of each thread
+    stack: usize,
+
+    /// ask the run to stop after the timeout, and let the next ones run
+    stop: fn(Duration),
+    resume: fn(),
+
+    /// the runs left behind, still going
+    stuck: Arc<AtomicUsize>,
+}
+
+impl Runner {
+    /// what running the code did, or the response refusing to run it
+    fn execute(&self, code: &str) -> Result<Outcome, Response> {
+        if self.stuck.load(Ordering::SeqCst) >= MAX_STUCK {
+            let msg = "too many runs are stuck, try again later";
+            return Err(Response::error(503, msg));
+        }
+        let (send, outcome) = mpsc::channel();
+        // set by the first of the run and the server to be done with the
+        // other, the run ending after the server left it stops counting
+        let over = Arc::new(AtomicBool::new(false));
+        let (run, code) = (self.run.clone(), code.to_owned());
+        let (stuck, ended) = (self.stuck.clone(), over.clone());
+        thread::Builder::new()
+            .name("playground".to_string())
+            .stack_size(self.stack)
+            .spawn(move || {
+                let _ = send.send(run(&code));
+                if ended.swap(true, Ordering::SeqCst) {
+                    stuck.fetch_sub(1, Ordering::SeqCst);
+                }
+            })
+            .map_err(|e| Response::error(500, &e.to_string()))?;
+        let result = match outcome.recv_timeout(self.timeout) {
+            Err(RecvTimeoutError::Timeout) => {
+                (self.stop)(self.timeout);
+                outcome.recv_timeout(self.grace)
+            }
+            result => result,
+        };
+        let result = match result {
+            Ok(outcome) => Ok(outcome),
+            Err(RecvTimeoutError::Timeout) => {
+                self.stuck.fetch_add(1, Ordering::SeqCst);
+                match over.swap(true, Ordering::SeqCst) {
+                    // it ended since, its outcome was sent first
+                    true => {
+                        self.stuck.fetch_sub(1, Ordering::SeqCst);
+                        outcome
+                            .recv()
+                            .map_err(|_| Response::error(500, "the run failed"))
+                    }
+                    false => Ok(timed_out(&interrupt::error(None))),
+                }
+            }
+            Err(RecvTimeoutError::Disconnected) => Err(Response::error(500, "the run failed")),
+        };
+        (self.resume)();
+        result
+    }
+}
+
+/// The outcome of a run left behind
+fn timed_out(error: &DragonError) -> Outcome {
+    Outcome {
+        value: None,
+        stdout: String::new(),
+        stderr: diagnostics::render(error),
+        diagnostics: vec![diagnostics::json(error, &[])],
+        status: TIMED_OUT,
+    }
+}
+
+/// A request the playground understood enough to answer
+#[derive(Debug, PartialEq)]
+struct Request {
+    method: String,
+    path: String,
+    body: Vec<u8>,
+}
+
+/// A response, `body` is HTML or JSON
+#[derive(Debug, PartialEq)]
+struct Response {
+    status: u16,
+    content_type: &'static str,
+    body: String,
+}
+
+impl Response {
+    fn json(status: u16, body: &Json) -> Self {
+        Self {
+            status,
+            content_type: "application/json",
+            body: body.to_string(),
+        }
+    }
+
+    fn error(status: u16, message: &str) -> Self {
+        Self::json(status, &json!({ "error": message }))
+    }
+
+    fn write(&self, output: &mut impl Write) -> io::Result<()> {
+        write!(
+            output,
+            "HTTP/1.1 {} {}\r\nContent-Type: {}; charset=utf-8\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+            self.status,
+            reason(self.status),
+            self.content_type,
+            self.body.len(),
+            self.body
+        )?;
+        output.flush()
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        400 => "Bad Request",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        411 => "Length Required",
+        413 => "Content Too Large",
+        431 => "Request Header Fields Too Large",
+        503 => "Service Unavailable",
+        _ => "Internal Server Error",
+    }
+}
+
+/// Read a request and write the response to it
+fn exchange(
+    mut input: impl BufRead,
+    mut output: impl Write,
+    execute: impl FnOnce(&str) -> Result<Outcome, Response>,
+) -> io::Result<()> {
+    let response = match read_request(&mut input)? {
+        Ok(request) => respond(&request, execute),
+        Err(response) => response,
+    };
+    response.write(&mut output)
+}
+
+/// the request, or the response refusing it
+fn read_request(input: &mut impl BufRead) -> io::Result<Result<Request, Response>> {
+    let mut head = 0;
+    let mut line = String::new();
+    let mut next_line = |input: &mut dyn BufRead, line: &mut String| -> io::Result<bool> {
+        line.clear();
+        head += input.take((MAX_HEAD - head) as u64).read_line(line)?;
+        Ok(head < MAX_HEAD)
+    };
+    if !next_line(input, &mut line)? {
+        return Ok(Err(Response::error(431, "the request is too large")));
+    }
+    let mut parts = line.split_whitespace();
+    let (Some(method), Some(path)) = (parts.next(), parts.next()) else {
+        return Ok(Err(Response::error(400, "the request line is malformed")));
+    };
+    let (method, path) = (method.to_owned(), path.to_owned());
+    let mut length = None;
+    loop {
+        if !next_line(input, &mut line)? {
+            return Ok(Err(Response::error(431, "the headers are too large")));
+        }
+        let header = line.trim_end();
+        if header.is_empty() {
+            break;
+        }
+        if let Some((name, value)) = header.split_once(':') {
+            if name.eq_ignore_ascii_case("content-length") {
+                match value.trim().parse::<usize>() {
+                    Ok(n) => length = Some(n),
+                    Err(_) => return Ok(Err(Response::error(400, "the length is not a number"))),
+                }
+            }
+        }
+    }
+    let body = match (method.as_str(), length) {
+        ("POST", None) => return Ok(Err(Response::error(411, "the body needs a length"))),
+        (_, Some(n)) if n > MAX_BODY => {
+            let msg = format!("the code is over {} bytes", MAX_BODY);
+            return Ok(Err(Response::error(413, &msg)));
+        }
+        (_, n) => {
+            let mut body = vec![0; n.unwrap_or(0)];
+            input.read_exact(&mut body)?;
+            body
+        }
+    };
+    Ok(Ok(Request { method, path, body }))
+}
+
+fn respond(request: &Request, execute: impl FnOnce(&str) -> Result<Outcome, Response>) -> Response {
+    // the query doesn't matter
+    let path = request.path.split('?').next().unwrap_or_default();
+    match (request.method.as_str(), path) {
+        ("GET", "/") => Response {
+            status: 200,
+            content_type: "text/html",
+            body: PAGE.to_owned(),
+        },
+        ("POST", "/run") => {
+            let code = serde_json::from_slice::<Json>(&request.body)
+                .ok()
+                .and_then(|body| body.get("code")?.as_str().map(str::to_owned));
+            match code {
+                Some(code) => match execute(&code).map(serde_json::to_value) {
+                    Ok(Ok(outcome)) => Response::json(200, &outcome),
+                    Ok(Err(e)) => Response::error(500, &e.to_string()),
+                    Err(response) => response,
+                },
+                None => Response::error(400, "the body must be a JSON object with the code"),
+            }
+        }
+        (_, "/") | (_, "/run") => Response::error(405, "the method is not allowed"),
+        _ => Response::error(404, "there is nothing here"),
+    }
+}
+
+/// The page of the playground, the code is run as it is submitted with
+/// Ctrl-Enter or the button
+const PAGE: &str = r#"<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Dragon-script playground</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; }
+textarea, pre { font-family: monospace; font-size: 14px; width: 100%; box-sizing: border-box; }
+textarea { height: 20em; }
+pre { background: #f4f4f4; padding: 0.5em; min-height: 2em; white-space: pre-wrap; }
+.stderr { color: #b00; }
+.status { color: #888; }
+</style>
+</head>
+<body>
+<h1>Dragon-script playground</h1>
+<textarea id="code" spellcheck="false">function greet(name) -> string {
+    "hello, ${name}"
+}
+print(greet("dragon"))
+</textarea>
+<p><button id="run">Run</button> <span class="status" id="status"></span></p>
+<pre id="stdout"></pre>
+<pre id="stderr" class="stderr"></pre>
+<script>
+const $ = (id) => document.getElementById(id);
+async function run() {
+    $("status").textContent = "running...";
+    try {
+        const response = await fetch("/run", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ code: $("code").value }),
+        });
+        const outcome = await response.json();
+        if (outcome.error) {
+            throw new Error(outcome.error);
+        }
+        const value = outcome.value === null ? "" : outcome.value + "\n";
+        $("stdout").textContent = outcome.stdout + value;
+        $("stderr").textContent = outcome.stderr;
+        $("status").textContent = "exited with status " + outcome.status;
+    } catch (e) {
+        $("status").textContent = e.message;
+    }
+}
+$("run").onclick = run;
+$("code").onkeydown = (e) => {
+    if (e.key === "Enter" && (e.ctrlKey || e.metaKey)) {
+        e.preventDefault();
+        run();
+    }
+};
+</script>
+</body>
+</html>
+"#;
+
+#[cfg(test)]
+mod test {
+    use std::{
+        sync::{atomic::Ordering, mpsc, Arc, Mutex},
+        thread,
+        time::Duration,
+    };
+
+    use drgns::playground::Outcome;
+    use serde_json::{json, Value as Json};
+
+    use super::{exchange, Runner, MAX_BODY, MAX_STUCK};
+    use crate::TIMED_OUT;
+
+    fn ran(code: &str) -> Outcome {
+        Outcome {
+            value: None,
+            stdout: format!("ran {}\n", code),
+            stderr: String::new(),
+            diagnostics: vec![],
+            status: 0,
+        }
+    }
+
+    /// the status and the body of the response to the request
+    fn answer(request: &str) -> (u16, String) {
+        let mut output = vec![];
+        exchange(request.as_bytes(), &mut output, |code| Ok(ran(code)))
+            .expect("the output is writable");
+        let response = String::from_utf8(output).expect("the response is UTF-8");
+        let (head, body) = response.split_once("\r\n\r\n").expect("a head and a body");
+        let status = head.split(' ').nth(1).and_then(|s| s.parse().ok());
+        let length = format!("Content-Length: {}\r\n", body.len());
+        assert!(head.contains(&length), "{:?} has the wrong length", head);
+        (status.expect("a status"), body.to_owned())
+    }
+
+    fn post(path: &str, body: &str) -> String {
+        format!(
+            "POST {} HTTP/1.1\r\nHost: localhost\r\ncontent-length: {}\r\n\r\n{}",
+            path,
+            body.len(),
+            body
+        )
+    }
+
+    fn json(body: &str) -> Json {
+        serde_json::from_str(body).expect("the body is JSON")
+    }
+
+    #[test]
+    fn page() {
+        let (status, body) = answer("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n");
+        assert_eq!(status, 200);
+        assert!(body.contains("fetch(\"/run\""));
+        assert_eq!(answer("GET /?x=1 HTTP/1.1\r\n\r\n").0, 200);
+        assert_eq!(answer("GET /elsewhere HTTP/1.1\r\n\r\n").0, 404);
+        assert_eq!(answer("DELETE / HTTP/1.1\r\n\r\n").0, 405);
+        assert_eq!(answer("nonsense\r\n\r\n").0, 400);
+    }
+
+    #[test]
+    fn runs() {
+        let (status, body) = answer(&post("/run", r#"{"code": "print(1)"}"#));
+        assert_eq!(status, 200);
+        assert_eq!(
+            json(&body),
+            json!({
+                "value": null,
+                "stdout": "ran print(1)\n",
+                "stderr": "",
+                "diagnostics": [],
+                "status": 0,
+            })
+        );
+
+        let (status, body) = answer(&post("/run", "print(1)"));
+        assert_eq!(status, 400);
+        assert!(json(&body)["error"].is_string());
+        assert_eq!(answer(&post("/run", r#"{"code": 1}"#)).0, 400);
+        assert_eq!(answer("GET /run HTTP/1.1\r\n\r\n").0, 405);
+        assert_eq!(answer("POST /run HTTP/1.1\r\n\r\n").0, 411);
+        let large = format!(
+            "POST /run HTTP/1.1\r\nContent-Length: {}\r\n\r\n",
+            MAX_BODY + 1
+        );
+        assert_eq!(answer(&large).0, 413);
+        let long = format!("GET /{} HTTP/1.1\r\n\r\n", "a".repeat(super::MAX_HEAD));
+        assert_eq!(answer(&long).0, 431);
+    }
+
+    #[test]
+    fn runs_left_behind() {
+        // the runs of "wait" wait until the sender is dropped
+        let (release, released) = mpsc::channel::<()>();
+        let released = Mutex::new(released);
+        let runner = Runner {
+            run: Arc::new(move |code: &str| {
+                if code == "wait" {
+                    let _ = released.lock().map(|r| r.recv());
+                }
+                ran(code)
+            }),
+            timeout: Duration::from_millis(50),
+            grace: Duration::from_millis(50),
+            stack: 1 << 20,
+            stop: |_| {},
+            resume: || {},
+            stuck: Arc::default(),
+        };
+        let outcome = runner.execute("wait").expect("the run is answered");
+        assert_eq!(outcome.status, TIMED_OUT);
+        assert_eq!(outcome.diagnostics[0]["code"], "E04002");
+        // the server goes on
+        let outcome = runner.execute("print(1)").expect("the run is answered");
+        assert_eq!(outcome.stdout, "ran print(1)\n");
+        assert_eq!(runner.stuck.load(Ordering::SeqCst), 1);
+
+        for _ in 1..MAX_STUCK {
+            runner.execute("wait").expect("the run is answered");
+        }
+        let refused = runner
+            .execute("print(1)")
+            .expect_err("too many runs are stuck");
+        assert_eq!(refused.status, 503);
+        // the runs left behind stop counting once they end
+        drop(release);
+        for _ in 0..100 {
+            if runner.stuck.load(Ordering::SeqCst) == 0 {
+                break;
+            }
+            thread::sleep(Duration::from_millis(10));
+        }
+        assert_eq!(runner.stuck.load(Ordering::SeqCst), 0);
+        assert!(runner.execute("print(1)").is_ok());
+    }
+}
@@ -1,34 +1,330 @@
-use std::{fs::read_to_string, io::Result, ops::Range, rc};
+use std::{
+    fmt::Display,
+    io::{Error, ErrorKind, Read, Result},
+    ops::Range,
+    path::Path,
+    sync::Arc,
+};
 
-mod arena;
-pub use arena::*;
-mod view;
-pub use view::*;
-mod string;
-pub use string::*;
 mod reader;
 pub use reader::*;
+mod string;
+pub use string::*;
 
 /// A piece of source code, either a file or a REPL logical line
 pub struct Source {
     name: Option<String>,
     src: Vec<char>,
+
+    /// char index of the first character of each line
+    line_starts: Vec<usize>,
+
+    /// byte offset of the first character of each line
+    line_byte_starts: Vec<usize>,
+}
+
+impl std::fmt::Debug for Source {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Source({})", self.name())
+    }
 }
 
 impl Source {
     pub fn from_path(p: &str) -> Result<Self> {
-        let mut ret = Self {
-            name: Some(p.to_owned()),
-            src: vec![],
-        };
-        ret.src = read_to_string(p)?.chars().collect();
-        Ok(ret)
+        Ok(Self::new(Some(p.to_owned()), read_to_string(p)?))
     }
 
     pub fn from_string(s: String) -> Self {
+        Self::new(None, s)
+    }
+
+    pub fn new(name: Option<String>, s: String) -> Self {
+        let src: Vec<char> = s.chars().collect();
+        let mut line_starts = vec![0];
+        let mut line_byte_starts = vec![0];
+        let mut bytes = 0;
+        for (i, c) in src.iter().enumerate() {
+            bytes += c.len_utf8();
+            if *c == '\n' {
+                line_starts.push(i + 1);
+                line_byte_starts.push(bytes);
+            }
+        }
         Self {
-            name: None,
-            src: s.chars().collect(),
+            name,
+            src,
+            line_starts,
+            line_byte_starts,
         }
     }
+
+    /// The name shown in diagnostics, files use their path
+    pub fn name(&self) -> &str {
+        self.name.as_deref().unwrap_or("<repl>")
+    }
+
+    pub fn path(&self) -> Option<&str> {
+        self.name.as_deref()
+    }
+
+    pub fn len(&self) -> usize {
+        self.src.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.src.is_empty()
+    }
+
+    pub fn get(&self, i: usize) -> Option<char> {
+        self.src.get(i).copied()
+    }
+
+    pub fn slice(&self, r: Range<usize>) -> String {
+        let end = r.end.min(self.src.len());
+        let start = r.start.min(end);
+        self.src[start..end].iter().collect()
+    }
+
+    /// The text of a line, without the line terminator, lines start at 1
+    pub fn line(&self, line: usize) -> Option<String> {
+        let start = *self.line_starts.get(line.checked_sub(1)?)?;
+        let end = self
+            .line_starts
+            .get(line)
+            .map(|&e| e - 1)
+            .unwrap_or(self.src.len());
+        Some(self.slice(start..end).trim_end_matches('\r').to_owned())
+    }
+
+    /// The char index of the first character of a line, lines start at 1
+    pub fn line_start(&self, line: usize) -> Option<usize> {
+        self.line_starts.get(line.checked_sub(1)?).copied()
+    }
+
+    pub fn line_count(&self) -> usize {
+        self.line_starts.len()
+    }
+
+    /// Resolve a char index into a human readable position
+    pub fn position(&self, i: usize) -> Position {
+        let i = i.min(self.src.len());
+        let line_idx = match self.line_starts.binary_search(&i) {
+            Ok(l) => l,
+            Err(l) => l - 1,
+        };
+        let line_start = self.line_starts[line_idx];
+        let offset = self.line_byte_starts[line_idx]
+            + self.src[line_start..i]
+                .iter()
+                .map(|c| c.len_utf8())
+                .sum::<usize>();
+        Position {
+            line: line_idx + 1,
+            column: i - line_start + 1,
+            offset,
+        }
+    }
+}
+
+impl Display for Source {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let s: String = self.src.iter().collect();
+        write!(f, "{}", s)
+    }
+}
+
+/// A location in a source, lines and columns start at 1, columns count
+/// characters, the offset counts bytes from the start of the source.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Default, serde::Serialize)]
+pub struct Position {
+    pub line: usize,
+    pub column: usize,
+    pub offset: usize,
+}
+
+impl Display for Position {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}:{}", self.line, self.column)
+    }
+}
+
+/// The byte order mark some editors start UTF-8 files with
+const BOM: &[u8] = b"\xEF\xBB\xBF";
+
+/// How a source file was saved, what `decode` undoes, to save edits the way
+/// the file was
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct Encoding {
+    /// the file starts with a byte order mark
+    pub bom: bool,
+    /// its lines end with `\r\n`
+    pub crlf: bool,
+}
+
+impl Encoding {
+    /// The text as a file saved this way, the inverse of `decode`
+    pub fn encode(&self, text: &str) -> String {
+        let mut encoded = String::with_capacity(text.len());
+        if self.bom {
+            encoded.push('\u{FEFF}');
+        }
+        match self.crlf {
+            true => encoded.push_str(&text.replace('\n', "\r\n")),
+            false => encoded.push_str(text),
+        }
+        encoded
+    }
+}
+
+/// Decode the bytes of a source file. They must be UTF-8, a byte order mark
+/// at the start is dropped and `\r\n` line endings are read as `\n`. Bytes
+/// that aren't UTF-8 are an error of kind `InvalidData` telling the offset
+/// of the first one in the file.
+pub fn decode(bytes: Vec<u8>) -> Result<String> {
+    decode_with_encoding(bytes).map(|(text, _)| text)
+}
+
+/// Decode the bytes of a source file as `decode` does, along with how they
+/// were saved
+pub fn decode_with_encoding(mut bytes: Vec<u8>) -> Result<(String, Encoding)> {
+    let bom = match bytes.starts_with(BOM) {
+        true => BOM.len(),
+        false => 0,
+    };
+    bytes.drain(..bom);
+    let text = String::from_utf8(bytes).map_err(|e| {
+        let valid = e.utf8_error().valid_up_to();
+        let bytes = e.as_bytes();
+        let line = bytes[..valid].iter().filter(|b| **b == b'\n').count() + 1;
+        let msg = format!(
+            "it is not valid UTF-8, byte {} (on line {}) is {:#04x}",
+            bom + valid,
+            line,
+            bytes[valid]
+        );
+        Error::new(ErrorKind::InvalidData, msg)
+    })?;
+    let encoding = Encoding {
+        bom: bom > 0,
+        crlf: text.contains("\r\n"),
+    };
+    let text = match encoding.crlf {
+        true => text.replace("\r\n", "\n"),
+        false => text,
+    };
+    Ok((text, encoding))
+}
+
+/// Read a source file to a string, see `decode`
+pub fn read_to_string(path: impl AsRef<Path>) -> Result<String> {
+    decode(std::fs::read(path)?)
+}
+
+/// Read a source file to a string along with how it was saved, for the
+/// commands editing it, see `Encoding::encode`
+pub fn read_with_encoding(path: impl AsRef<Path>) -> Result<(String, Encoding)> {
+    decode_with_encoding(std::fs::read(path)?)
+}
+
+/// The path that stands for the standard input
+pub const STDIN: &str = "-";
+
+/// Read a source file into a shared source, `-` reads the standard input
+/// until its end
+pub fn load(path: &str) -> Result<Arc<Source>> {
+    if path == STDIN {
+        return read_input(std::io::stdin());
+    }
+    Ok(Arc::new(Source::from_path(path)?))
+}
+
+/// Read the standard input, or what stands for it, until its end
+fn read_input(mut input: impl Read) -> Result<Arc<Source>> {
+    let mut bytes = vec![];
+    input.read_to_end(&mut bytes)?;
+    let text = decode(bytes)?;
+    // imports are resolved relative to the working directory
+    Ok(Arc::new(Source::new(Some("<stdin>".to_owned()), text)))
+}
+
+#[cfg(test)]
+mod test {
+    use std::io::{ErrorKind, Read};
+
+    use super::{decode, decode_with_encoding, read_input, Encoding};
+
+    /// A pipe that hands over the bytes a few at a time, then its end
+    struct Pipe<'a>(&'a [u8]);
+
+    impl Read for Pipe<'_> {
+        fn read(&mut self, buf: &mut [u8]) -> std::io::Result<usize> {
+            let n = buf.len().min(self.0.len()).min(3);
+            buf[..n].copy_from_slice(&self.0[..n]);
+            self.0 = &self.0[n..];
+            Ok(n)
+        }
+    }
+
+    #[test]
+    fn decoding() {
+        let decoded = |bytes: &[u8]| decode(bytes.to_vec()).expect("the bytes are UTF-8");
+        assert_eq!(decoded(b"x := 1\n"), "x := 1\n");
+        assert_eq!(
+            decoded(b"\xEF\xBB\xBFx := 1\r\ny := 2\r\n"),
+            "x := 1\ny := 2\n"
+        );
+        // only a mark at the start is dropped, and lone carriage returns are kept
+        assert_eq!(decoded(b"x\r\xEF\xBB\xBF"), "x\r\u{FEFF}");
+        assert_eq!(decoded("d\u{e9}j\u{e0}".as_bytes()), "d\u{e9}j\u{e0}");
+
+        let error =
+            decode(b"\xEF\xBB\xBFx := 1\n\"caf\xe9\"".to_vec()).expect_err("latin-1 is not UTF-8");
+        assert_eq!(error.kind(), ErrorKind::InvalidData);
+        assert_eq!(
+            error.to_string(),
+            "it is not valid UTF-8, byte 14 (on line 2) is 0xe9"
+        );
+        // a character cut short at the end
+        let error = decode(b"x := \xE2\x82".to_vec()).expect_err("the file is cut short");
+        assert_eq!(
+            error.to_string(),
+            "it is not valid UTF-8, byte 5 (on line 1) is 0xe2"
+        );
+    }
+
+    #[test]
+    fn encoding() {
+        let saved = b"\xEF\xBB\xBFx := 1\r\ny := 2\r\n";
+        let (text, encoding) = decode_with_encoding(saved.to_vec()).expect("the bytes are UTF-8");
+        assert_eq!(
+            encoding,
+            Encoding {
+                bom: true,
+                crlf: true
+            }
+        );
+        assert_eq!(encoding.encode(&text).as_bytes(), saved);
+        let (text, encoding) = decode_with_encoding(b"x := 1\n".to_vec()).expect("UTF-8");
+        assert_eq!(encoding, Encoding::default());
+        assert_eq!(encoding.encode(&text), "x := 1\n");
+    }
+
+    #[test]
+    fn reading_the_standard_input() {
+        let source = read_input(Pipe(b"x := 1\r\nprint(x)")).expect("the program is read");
+        assert_eq!(source.name(), "<stdin>");
+        assert_eq!(source.line_count(), 2);
+        assert_eq!(source.line(1).as_deref(), Some("x := 1"));
+        // the last line is read up to the end, without a newline
+        assert_eq!(source.line(2).as_deref(), Some("print(x)"));
+        assert_eq!(source.slice(0..source.len()), "x := 1\nprint(x)");
+
+        // an input that ends at once is an empty program
+        let source = read_input(Pipe(b"")).expect("nothing is a program");
+        assert!(source.is_empty());
+        assert_eq!(source.line_count(), 1);
+
+        let error = read_input(Pipe(b"x := \xff\n")).expect_err("the input is not UTF-8");
+        assert_eq!(error.kind(), ErrorKind::InvalidData);
+    }
 }
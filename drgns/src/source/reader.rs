@@ -1,42 +1,51 @@
-use std::rc::Weak;
+use std::sync::Arc;
 
 use crate::lookahead::Cursor;
 
 use super::*;
 
+/// Character cursor over a source, the window between the back and front
+/// indexes is the lexeme currently being built.
 #[derive(Clone)]
 pub struct Reader {
-    pub source: Weak<Source>,
+    pub source: Arc<Source>,
     back: usize,
     front: usize,
 }
 
 impl Reader {
-    fn inner_len(&self) -> Option<usize> {
-        Some(self.source.upgrade()?.src.len())
+    pub fn new(source: &Arc<Source>) -> Self {
+        Self {
+            source: source.clone(),
+            back: 0,
+            front: 0,
+        }
     }
 
     fn exhausted(&self) -> bool {
-        if self.inner_len().is_none() {
-            return true;
-        }
-
-        let len = self.inner_len().expect("infallible");
-        self.front >= len
+        self.front >= self.source.len()
     }
 
     fn get_from_inner(&self, i: usize) -> Option<char> {
-        self.source.upgrade()?.src.get(i).copied()
+        self.source.get(i)
+    }
+
+    /// The lexeme built so far, without consuming it
+    pub fn window(&self) -> SourceString {
+        SourceString {
+            source: self.source.clone(),
+            pos: self.back..self.front,
+        }
     }
 }
 
 impl Cursor<char, SourceString> for Reader {
     fn peek_n(&mut self, i: usize) -> Option<char> {
-       self.get_from_inner(self.front + i)
+        self.get_from_inner(self.front + i)
     }
 
     fn previous(&self) -> Option<char> {
-        self.get_from_inner(self.front - 1)
+        self.get_from_inner(self.front.checked_sub(1)?)
     }
 
     fn peek_back_n(&self, i: usize) -> Option<char> {
@@ -63,15 +72,13 @@ impl Cursor<char, SourceString> for Reader {
     }
 
     fn consume(&mut self) -> Option<SourceString> {
-        let ret = Some(SourceString{source: self.source.clone(), pos: self.back..self.front});
-
-        self.back = self.front;
-
-        if self.exhausted() {
+        if self.window_is_empty() {
             return None;
         }
 
-        ret
+        let ret = self.window();
+        self.back = self.front;
+        Some(ret)
     }
 
     fn reset(&mut self) {
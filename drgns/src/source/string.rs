@@ -1,117 +1,137 @@
-use std::rc;
+use std::fmt::{Debug, Display};
+use std::sync::Arc;
 
 use super::*;
 
+/// A span of source code, mostly used as the lexeme of a token or the
+/// location of a node in the syntax tree.
 #[derive(Clone)]
 pub struct SourceString {
-    pub(crate) source: rc::Weak<Source>,
+    pub(crate) source: Arc<Source>,
     pub(crate) pos: Range<usize>,
 }
 
+impl SourceString {
+    pub fn new(source: &Arc<Source>, pos: Range<usize>) -> Self {
+        Self {
+            source: source.clone(),
+            pos,
+        }
+    }
+
+    /// A span covering the whole source
+    pub fn from_source(source: &Arc<Source>) -> Self {
+        Self::new(source, 0..source.len())
+    }
+
+    pub fn source(&self) -> &Arc<Source> {
+        &self.source
+    }
+
+    pub fn start(&self) -> usize {
+        self.pos.start
+    }
+
+    pub fn end(&self) -> usize {
+        self.pos.end
+    }
+
+    pub fn len(&self) -> usize {
+        self.pos.end - self.pos.start
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    pub fn range(&self) -> Range<usize> {
+        self.pos.clone()
+    }
+
+    /// Position of the first character of the span
+    pub fn position(&self) -> Position {
+        self.source.position(self.pos.start)
+    }
+
+    /// Position just past the last character of the span
+    pub fn end_position(&self) -> Position {
+        self.source.position(self.pos.end)
+    }
+
+    /// Name of the file this span comes from, `None` for REPL input
+    pub fn file(&self) -> Option<&str> {
+        self.source.path()
+    }
+
+    /// The smallest span covering both spans, they must come from the same
+    /// source
+    pub fn to(&self, other: &SourceString) -> SourceString {
+        crate::assert_pre_condition!(Arc::ptr_eq(&self.source, &other.source));
+        Self {
+            source: self.source.clone(),
+            pos: self.pos.start.min(other.pos.start)..self.pos.end.max(other.pos.end),
+        }
+    }
+
+    /// An empty span right after this one, useful for pointing at something
+    /// missing
+    pub fn after(&self) -> SourceString {
+        Self {
+            source: self.source.clone(),
+            pos: self.pos.end..self.pos.end,
+        }
+    }
+
+    /// a human readable location, such as `foo.drgns:12:5`
+    pub fn location(&self) -> String {
+        format!("{}:{}", self.source.name(), self.position())
+    }
+}
+
+/// spans are equal when they cover the same characters of the same source
+impl PartialEq for SourceString {
+    fn eq(&self, other: &Self) -> bool {
+        Arc::ptr_eq(&self.source, &other.source) && self.pos == other.pos
+    }
+}
+
+impl Eq for SourceString {}
+
+impl Debug for SourceString {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("SourceString")
+            .field("source", &self.source.name())
+            .field("start", &self.start())
+            .field("length", &self.len())
+            .finish()
+    }
+}
+
+impl Display for SourceString {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.source.slice(self.pos.clone()))
+    }
+}
+
+/// a span serializes as its start and end positions, without its text
+impl serde::Serialize for SourceString {
+    fn serialize<S: serde::Serializer>(
+        &self,
+        serializer: S,
+    ) -> std::result::Result<S::Ok, S::Error> {
+        use serde::ser::SerializeStruct;
+        let mut span = serializer.serialize_struct("SourceString", 2)?;
+        span.serialize_field("start", &self.position())?;
+        span.serialize_field("end", &self.end_position())?;
+        span.end()
+    }
+}
+
 #[derive(Clone)]
 pub enum Production {
     /// A raw string segment directly from the source
     Atom(SourceString),
 
     /// A production made of several disjoint segments
-    Fused(Vec<SourceString>)
+    Fused(Vec<SourceString>),
 }
-
-
-
-// impl SourceString {
-//     pub fn from_source(source: &Rc<Source>) -> Self {
-//         Self {
-//             source: Rc::downgrade(source),
-//             pos: 0..arena.len(),
-//         }
-//     }
-
-//     pub fn grow(&mut self) {
-//         self.span = self.span.start..(self.span.end + 1); //SourceSpan::from((self.span.offset(), self.span.len() + 1));
-//     }
-
-//     /// Increment offset up to current end, and reset length to 0
-//     pub fn pull_tail(&mut self) {
-//         self.span = self.span.end..self.span.end; //SourceSpan::from((self.end(), 0));
-//     }
-
-//     pub fn start(&self) -> usize {
-//         self.span.start
-//     }
-
-//     pub fn len(&self) -> usize {
-//         self.span.end - self.span.start
-//     }
-
-//     pub fn end(&self) -> usize {
-//         self.span.end
-//     }
-
-//     pub fn into_string(self) -> String {
-//         self.arena
-//             .upgrade()
-//             .unwrap()
-//             .inner()
-//             .iter()
-//             .skip(self.start())
-//             .take(self.len())
-//             .collect()
-//     }
-
-//     /// get a char from the span given index
-//     pub fn get(&self, i: usize) -> char {
-//         // pre-condition: index in range
-//         crate::assert_pre_condition!(i < self.len());
-
-//         self.arena.upgrade().unwrap().get(i - self.len()).unwrap()
-//     }
-
-//     /// get a char from the span indexing from the end
-//     pub fn get_back(&self, i: usize) -> char {
-//         // pre-condition: index in range
-//         crate::assert_pre_condition!(self.start() + self.len() - i < self.len());
-
-//         self.arena
-//             .upgrade()
-//             .unwrap()
-//             .get(self.start() + self.len() - 1)
-//             .unwrap()
-//     }
-// }
-
-// impl Debug for SourceView {
-//     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
-//         f.debug_struct("Span")
-//             .field("arena", &"omitted")
-//             .field("start", &self.start())
-//             .field("length", &self.len())
-//             .finish()
-//     }
-// }
-
-// impl Display for SourceView {
-//     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
-//         let slice = self.clone().into_string();
-//         write!(f, "{}", slice)
-//     }
-// }
-
-// impl Add for SourceView {
-//     type Output = Self;
-
-//     fn add(self, rhs: Self) -> Self::Output {
-//         assert_pre_condition!(self.start() <= rhs.start() && self.end() <= rhs.end());
-//         Self {
-//             arena: self.arena,
-//             span: self.span.start..rhs.span.end,
-//             source_id: todo!(),
-//         }
-//     }
-// }
-
-// impl From<SourceView> for Range<usize> {
-//     fn from(val: SourceView) -> Self {
-//         (val.span.start + 1)..(val.span.end + 1)
-//     }
-// }
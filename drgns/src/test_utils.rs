@@ -0,0 +1,26 @@
+//! Fixtures shared by the tests of the modules working on files
+
+use std::{fs, path::PathBuf};
+
+/// a fresh directory for the test `name` of the module, named after both so
+/// that tests running at once don't share one
+pub fn directory(module: &str, name: &str) -> PathBuf {
+    let dir =
+        std::env::temp_dir().join(format!("drgns-{}-{}-{}", module, name, std::process::id()));
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).expect("temporary directory can be created");
+    dir
+}
+
+/// write the files, given by their path in a fresh directory and their
+/// text, returns the directory
+pub fn project(module: &str, name: &str, files: &[(&str, &str)]) -> PathBuf {
+    let dir = directory(module, name);
+    for (path, text) in files {
+        let path = dir.join(path);
+        fs::create_dir_all(path.parent().expect("files are in the directory"))
+            .expect("temporary directory can be created");
+        fs::write(path, text).expect("temporary file can be written");
+    }
+    dir
+}
@@ -0,0 +1,283 @@
+//! The test runner of `drgns test`.
+//!
+//! Tests are the functions whose names start with `test_`, in the files whose
+//! names end with `_test.drgns`. Each test runs in an interpreter of its own,
+//! after the statements of its file, so that it doesn't see what the others
+//! did. It passes if it returns, and fails with the error it raises, such as
+//! the one of a failed `assert`.
+//!
+//! The examples of the doc comments of the scripts, see `doc`, are tests too,
+//! each runs after the statements of its file and passes if it doesn't raise
+//! an error.
+//!
+//! The snapshots of `expect_snapshot` are kept next to the test files, see
+//! `builtins::snapshots`, and the lines the tests ran can be reported, see
+//! `coverage`.
+
+use std::{
+    fmt::Display,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+use drgns::{
+    doc::{self, Example},
+    error_handler::{DragonError, ErrorCode},
+    interpreter::{
+        self,
+        builtins::snapshots,
+        interrupt::{self, Reason},
+        Halt,
+    },
+    parser::{self, Program, Statement},
+    Interpreter,
+};
+
+use crate::{
+    coverage, handle_interrupts, load, report, TestFlags, Watchdog, INTERRUPTED, INVALID_PROGRAM,
+    RUNTIME_ERROR, SUCCESS,
+};
+
+#[cfg(test)]
+mod test;
+
+pub const FILE_SUFFIX: &str = "_test.drgns";
+const TEST_PREFIX: &str = "test_";
+
+/// Run the tests of a file, or of the test files in a directory and those
+/// below it and the examples of the scripts there, each in an interpreter
+/// `interpreter` makes and for at most `timeout`. Returns the exit status of
+/// the process.
+pub fn run(
+    path: &str,
+    flags: &TestFlags,
+    timeout: Option<Duration>,
+    interpreter: impl Fn() -> Interpreter,
+) -> i32 {
+    let Some(mut files) = files(path) else {
+        return INVALID_PROGRAM;
+    };
+    // the other scripts, for their examples
+    if Path::new(path).is_dir() {
+        let documented = scripts(Path::new(path))
+            .into_iter()
+            .filter(|f| !f.ends_with(FILE_SUFFIX) && has_examples(f));
+        files.extend(documented);
+    }
+    if flags.coverage.is_some() {
+        interpreter::coverage::enable();
+    }
+    handle_interrupts();
+    let (summary, stopped) = tests(files, flags, timeout, interpreter);
+    summary.print();
+    if stopped {
+        return INTERRUPTED;
+    }
+    if let Some(output) = &flags.coverage {
+        if !coverage::write(path, output) {
+            return RUNTIME_ERROR;
+        }
+    }
+    summary.status()
+}
+
+/// Run the tests of the files, each in an interpreter `interpreter` makes,
+/// returns how they went and whether Ctrl-C stopped them
+fn tests(
+    files: Vec<String>,
+    flags: &TestFlags,
+    timeout: Option<Duration>,
+    interpreter: impl Fn() -> Interpreter,
+) -> (Summary, bool) {
+    let mut summary = Summary::default();
+    for file in files {
+        let Some(program) = load(&file) else {
+            summary.broken += 1;
+            continue;
+        };
+        println!("{}", file);
+        snapshots::set_directory(Some(snapshot_directory(&file)), flags.update);
+        let tests = functions(&program, TEST_PREFIX)
+            .into_iter()
+            .map(Test::Function);
+        let examples = doc::examples(&program).into_iter().map(Test::Example);
+        for t in tests.chain(examples) {
+            let name = t.to_string();
+            let _watchdog = timeout.map(Watchdog::start);
+            let outcome = test(&program, &t, interpreter());
+            let stopped = interrupt::reason() == Some(Reason::Interrupt);
+            interrupt::clear();
+            match outcome {
+                Ok(()) => {
+                    println!("  {} ... ok", name);
+                    summary.passed += 1;
+                }
+                Err(e) => {
+                    println!("  {} ... FAILED", name);
+                    report(&[e]);
+                    summary.failed += 1;
+                }
+            }
+            // Ctrl-C stops the whole run, a timeout only the test
+            if stopped {
+                return (summary, true);
+            }
+        }
+    }
+    (summary, false)
+}
+
+#[derive(Debug, Default, PartialEq)]
+struct Summary {
+    passed: usize,
+    failed: usize,
+
+    /// the files that could not be parsed, whose tests didn't run
+    broken: usize,
+}
+
+impl Summary {
+    /// the exit status of the process, failing if a test failed or a file
+    /// could not be parsed
+    fn status(&self) -> i32 {
+        match self.failed + self.broken {
+            0 => SUCCESS,
+            _ => RUNTIME_ERROR,
+        }
+    }
+
+    fn print(&self) {
+        let result = match self.failed + self.broken {
+            0 => "ok",
+            _ => "FAILED",
+        };
+        print!(
+            "\ntest result: {}. {} passed, {} failed",
+            result, self.passed, self.failed
+        );
+        match snapshots::updated() {
+            0 => {}
+            n => print!(", snapshots written: {}", n),
+        }
+        match self.broken {
+            0 => println!(),
+            n => println!(", files that could not be parsed: {}", n),
+        }
+    }
+}
+
+/// The test file at a path, or the ones in the directory and those below it.
+/// Reports it and returns `None` if there is nothing at the path.
+pub fn files(path: &str) -> Option<Vec<String>> {
+    let path = Path::new(path);
+    if !path.exists() {
+        let msg = format!(
+            "cannot find tests in '{}': it doesn't exist",
+            path.display()
+        );
+        report(&[DragonError::new(ErrorCode::IoNotFound, msg, None)]);
+        return None;
+    }
+    let mut files = vec![];
+    if path.is_dir() {
+        find(path, FILE_SUFFIX, &mut files);
+    } else {
+        files.push(path.display().to_string());
+    }
+    Some(files)
+}
+
+/// the scripts in a directory and those below it, the test files included
+pub fn scripts(dir: &Path) -> Vec<String> {
+    let mut files = vec![];
+    find(dir, ".drgns", &mut files);
+    files
+}
+
+/// the files in a directory and those below it whose names end with
+/// `suffix`, in the order of their paths, hidden directories are left out
+fn find(dir: &Path, suffix: &str, files: &mut Vec<String>) {
+    let Ok(entries) = dir.read_dir() else {
+        log::warn!("cannot look for tests in '{}'", dir.display());
+        return;
+    };
+    let mut paths: Vec<_> = entries.filter_map(|e| e.ok()).map(|e| e.path()).collect();
+    paths.sort();
+    for path in paths {
+        let name = path.file_name().map_or("".into(), |n| n.to_string_lossy());
+        if path.is_dir() && !name.starts_with('.') {
+            find(&path, suffix, files);
+        } else if name.ends_with(suffix) {
+            files.push(path.display().to_string());
+        }
+    }
+}
+
+/// whether the comments of a script may have examples, without parsing it
+fn has_examples(file: &str) -> bool {
+    std::fs::read_to_string(file).is_ok_and(|s| s.contains("///") && s.contains("```"))
+}
+
+/// where the snapshots of a test file are kept, `snapshots/math_test` for
+/// `math_test.drgns`
+fn snapshot_directory(file: &str) -> PathBuf {
+    let file = Path::new(file);
+    let name = file.file_name().map_or("".into(), |n| n.to_string_lossy());
+    let name = name.strip_suffix(".drgns").unwrap_or(&name);
+    file.with_file_name("snapshots").join(name)
+}
+
+/// the names of the functions of a file starting with `prefix`, in the
+/// order they are declared
+pub fn functions<'a>(program: &'a Program, prefix: &str) -> Vec<&'a str> {
+    program
+        .statements
+        .iter()
+        .filter_map(|s| match s {
+            Statement::Function(f) if f.name.name.starts_with(prefix) => Some(f.name.name.as_str()),
+            _ => None,
+        })
+        .collect()
+}
+
+/// A test function of a file, or an example of its comments
+enum Test<'a> {
+    Function(&'a str),
+    Example(Example),
+}
+
+impl Display for Test<'_> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Test::Function(name) => write!(f, "{}", name),
+            Test::Example(e) => write!(f, "{} (example, line {})", e.item, e.line),
+        }
+    }
+}
+
+/// Run the statements of the file, then the test
+fn test(program: &Program, test: &Test, mut interpreter: Interpreter) -> Result<(), DragonError> {
+    let outcome = interpreter.eval(program).and_then(|_| match test {
+        Test::Function(name) => {
+            let function = interpreter
+                .get_global(name)
+                .expect("the file declares the test");
+            interpreter.call(&function, vec![])
+        }
+        Test::Example(e) => {
+            let (example, mut errors) = parser::parse(&e.source);
+            match errors.is_empty() {
+                true => interpreter.eval(&example),
+                false => Err(Halt::Error(errors.remove(0))),
+            }
+        }
+    });
+    match outcome {
+        Ok(_) => Ok(()),
+        Err(Halt::Error(e)) => Err(e),
+        Err(Halt::Exit(code)) => Err(DragonError::runtime(
+            format!("the test exited with code {}", code),
+            None,
+        )),
+    }
+}
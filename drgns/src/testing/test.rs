@@ -0,0 +1,84 @@
+use std::fs;
+
+use drgns::Interpreter;
+
+use super::{files, run, tests, Summary};
+use crate::{test_utils, TestFlags, RUNTIME_ERROR, SUCCESS};
+
+fn flags() -> TestFlags {
+    TestFlags {
+        update: false,
+        coverage: None,
+    }
+}
+
+#[test]
+fn testing_runs_each_test_on_its_own() {
+    let dir = test_utils::project(
+        "testing",
+        "suite",
+        &[
+            (
+                "math_test.drgns",
+                "mut seen := 0
+function test_sets() -> {
+    seen = 1
+    assert(seen == 1)
+}
+function test_fresh() -> {
+    assert(seen == 0)
+}
+function test_fails() -> {
+    assert(1 == 2)
+}
+function helper() -> { 1 }
+",
+            ),
+            ("broken_test.drgns", "function test_broken() -> {\n"),
+            (
+                "nested/list_test.drgns",
+                "function test_len() -> { assert(len([1, 2]) == 2) }\n",
+            ),
+            (
+                "lib.drgns",
+                "function test_not_a_test() -> { assert(false) }\n",
+            ),
+        ],
+    );
+    let path = dir.display().to_string();
+    let found = files(&path).expect("the directory exists");
+    let name = |file: &str| dir.join(file).display().to_string();
+    assert_eq!(
+        found,
+        [
+            name("broken_test.drgns"),
+            name("math_test.drgns"),
+            name("nested/list_test.drgns")
+        ]
+    );
+    // the global the first test sets is not seen by the next
+    let (summary, stopped) = tests(found, &flags(), None, Interpreter::new);
+    assert!(!stopped);
+    assert_eq!(
+        summary,
+        Summary {
+            passed: 3,
+            failed: 1,
+            broken: 1
+        }
+    );
+    assert_eq!(run(&path, &flags(), None, Interpreter::new), RUNTIME_ERROR);
+    let _ = fs::remove_dir_all(dir);
+
+    let dir = test_utils::project(
+        "testing",
+        "passing",
+        &[(
+            "math_test.drgns",
+            "function test_add() -> { assert(1 + 1 == 2) }\n",
+        )],
+    );
+    let path = dir.display().to_string();
+    assert_eq!(run(&path, &flags(), None, Interpreter::new), SUCCESS);
+    let _ = fs::remove_dir_all(dir);
+}
@@ -1,65 +1,796 @@
-#[derive(Debug, Clone, derive_more::Display)]
+//! Run-time values, shared by all execution engines.
+//!
+//! Operations return a plain message on type errors, it is up to the engine
+//! to attach a location to it.
+
+use std::{
+    borrow::Cow,
+    fmt::Display,
+    sync::{atomic::Ordering, Arc, RwLock},
+};
+
+use indexmap::IndexMap;
+
+mod bigint;
+pub use bigint::*;
+mod channel;
+pub use channel::*;
+mod inspect;
+pub mod intern;
+pub use intern::intern;
+mod iter;
+pub use iter::*;
+mod structs;
+pub use structs::*;
+mod task;
+pub use task::*;
+
+use crate::{
+    bytecode::Closure,
+    eh::DragonError,
+    interpreter::{
+        builtins::{
+            fs::File,
+            strings::StringBuilder,
+            sync::{Atomic, Lock, WaitGroup},
+        },
+        limits, Env,
+    },
+    modules::Module,
+    parser::{escape_bytes, BinOperator, FunctionDeclaration, UnOperator},
+};
+
+/// A value is a tag and at most two words, 24 bytes: `none`, booleans, ints
+/// and floats are held in the value itself, strings and symbols are a
+/// pointer and a length, and the others a pointer to what they are made of.
+/// Stacks, lists and maps hold values inline, keeping them small keeps more
+/// of them in the cache, and copying one never allocates.
+#[derive(Debug, Clone)]
 pub enum Value {
+    None,
+    Bool(bool),
+    Int(i64),
+
+    /// only for ints that don't fit in an `Int`, see `BigInt`
+    BigInt(Arc<BigInt>),
+    Float(f64),
+    String(Arc<str>),
+    Symbol(Arc<str>),
+
+    /// binary data, which unlike a string needs not be text
+    Bytes(Arc<[u8]>),
+    List(List),
+    Map(Map),
+    Function(Arc<Function>),
+    Closure(Arc<Closure>),
+
+    /// builtins are declared in the tables of the interpreter, which live
+    /// as long as the program
+    Builtin(&'static Builtin),
+    Native(Arc<Native>),
+    Module(Arc<Module>),
+    File(Arc<File>),
+    Regex(Arc<regex::Regex>),
+    Iterator(Arc<Iter>),
+    Task(Arc<Task>),
+    Channel(Arc<Channel>),
+    Mutex(Arc<Lock>),
+    WaitGroup(Arc<WaitGroup>),
+    Atomic(Arc<Atomic>),
+    StringBuilder(Arc<StringBuilder>),
+    Struct(Arc<Struct>),
+    Instance(Arc<Instance>),
+    Enum(Arc<Enum>),
+
+    /// an error caught by `try`, it can be thrown again
+    Error(Arc<DragonError>),
+}
+
+/// Lists are shared, a change made through one reference to a list is seen
+/// through all others
+pub type List = Arc<RwLock<Vec<Value>>>;
+
+/// Maps are shared like lists, and keep their entries in insertion order
+pub type Map = Arc<RwLock<IndexMap<Key, Value>>>;
+
+/// The values that can be keys of a map
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub enum Key {
     Int(i64),
+    BigInt(Arc<BigInt>),
+    String(Arc<str>),
+    Symbol(Arc<str>),
+}
+
+impl TryFrom<&Value> for Key {
+    type Error = String;
+
+    fn try_from(value: &Value) -> Result<Self, Self::Error> {
+        match value {
+            Value::Int(i) => Ok(Key::Int(*i)),
+            Value::BigInt(i) => Ok(Key::BigInt(i.clone())),
+            Value::String(s) => Ok(Key::String(s.clone())),
+            Value::Symbol(s) => Ok(Key::Symbol(s.clone())),
+            v => Err(format!(
+                "map keys must be ints, strings or symbols, found {}",
+                v.type_name()
+            )),
+        }
+    }
+}
+
+impl From<Key> for Value {
+    fn from(key: Key) -> Self {
+        match key {
+            Key::Int(i) => Value::Int(i),
+            Key::BigInt(i) => Value::BigInt(i),
+            Key::String(s) => Value::String(s),
+            Key::Symbol(s) => Value::Symbol(s),
+        }
+    }
+}
+
+/// A user-defined function, together with the environment it was declared in
+#[derive(Debug)]
+pub struct Function {
+    pub declaration: Arc<FunctionDeclaration>,
+    pub closure: Env,
+}
+
+pub type BuiltinFn = fn(&[Value]) -> Result<Value, String>;
+
+/// A function implemented by the interpreter
+#[derive(Clone)]
+pub struct Builtin {
+    pub name: &'static str,
+
+    /// `None` for variadic functions
+    pub arity: Option<usize>,
+    pub function: BuiltinFn,
+
+    /// as they would be declared, such as `s, width, fill = " "`, and what
+    /// the function does, which `:doc` shows in the REPL
+    pub parameters: &'static str,
+    pub doc: &'static str,
+}
+
+impl std::fmt::Debug for Builtin {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Builtin({})", self.name)
+    }
+}
+
+/// A function registered by the program embedding the interpreter, unlike
+/// builtins it can capture state of the host
+pub struct Native {
+    pub name: String,
+
+    /// `None` for variadic functions
+    pub arity: Option<usize>,
+    pub function: Box<dyn Fn(&[Value]) -> Result<Value, String> + Send + Sync>,
+}
+
+impl std::fmt::Debug for Native {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Native({})", self.name)
+    }
+}
+
+impl Display for Value {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Value::None => write!(f, "none"),
+            Value::Bool(b) => write!(f, "{}", b),
+            Value::Int(i) => write!(f, "{}", i),
+            Value::BigInt(i) => write!(f, "{}", i),
+            Value::Float(x) => write!(f, "{:?}", x),
+            Value::String(s) => write!(f, "{}", s),
+            Value::Symbol(s) => write!(f, "^{}", s),
+            Value::Bytes(b) => write!(f, "b\"{}\"", escape_bytes(b)),
+            Value::List(_) | Value::Map(_) | Value::Instance(_) => write!(f, "{}", self.repr()),
+            Value::Function(func) => write!(f, "<function {}>", func.declaration.name),
+            Value::Closure(c) => write!(f, "<function {}>", c.prototype.name),
+            Value::Builtin(b) => write!(f, "<builtin {}>", b.name),
+            Value::Native(n) => write!(f, "<builtin {}>", n.name),
+            Value::Module(m) => write!(f, "<module {}>", m.name),
+            Value::File(file) => write!(f, "<file {}>", file.path),
+            Value::Regex(r) => write!(f, "<regex {}>", r.as_str()),
+            Value::Iterator(_) => write!(f, "<iterator>"),
+            Value::Task(_) => write!(f, "<task>"),
+            Value::Channel(c) => write!(f, "<channel {}>", c.capacity),
+            Value::Mutex(_) => write!(f, "<mutex>"),
+            Value::WaitGroup(g) => write!(f, "<wait group {}>", g.count()),
+            Value::Atomic(a) => write!(f, "<atomic {}>", a.0.load(Ordering::SeqCst)),
+            Value::StringBuilder(b) => write!(f, "<string builder {}>", b.text().chars().count()),
+            Value::Struct(s) => write!(f, "<struct {}>", s.name),
+            Value::Enum(e) => write!(f, "<enum {}>", e.name),
+            Value::Error(e) => write!(f, "<error {}>", e.message()),
+        }
+    }
+}
+
+impl PartialEq for Value {
+    fn eq(&self, other: &Self) -> bool {
+        match (self, other) {
+            (Value::None, Value::None) => true,
+            (Value::Bool(x), Value::Bool(y)) => x == y,
+            (Value::Int(x), Value::Int(y)) => x == y,
+            (Value::Float(x), Value::Float(y)) => x == y,
+            (Value::Int(x), Value::Float(y)) | (Value::Float(y), Value::Int(x)) => *x as f64 == *y,
+            (Value::BigInt(x), Value::BigInt(y)) => x == y,
+            (Value::BigInt(x), Value::Float(y)) | (Value::Float(y), Value::BigInt(x)) => {
+                x.to_f64() == *y
+            }
+            // interned strings are the same copy
+            (Value::String(x), Value::String(y)) | (Value::Symbol(x), Value::Symbol(y)) => {
+                Arc::ptr_eq(x, y) || x == y
+            }
+            (Value::Bytes(x), Value::Bytes(y)) => x == y,
+            (Value::List(x), Value::List(y)) => {
+                Arc::ptr_eq(x, y)
+                    || *x.read().unwrap_or_else(|e| e.into_inner())
+                        == *y.read().unwrap_or_else(|e| e.into_inner())
+            }
+            (Value::Map(x), Value::Map(y)) => {
+                Arc::ptr_eq(x, y)
+                    || *x.read().unwrap_or_else(|e| e.into_inner())
+                        == *y.read().unwrap_or_else(|e| e.into_inner())
+            }
+            (Value::Function(x), Value::Function(y)) => Arc::ptr_eq(x, y),
+            (Value::Closure(x), Value::Closure(y)) => Arc::ptr_eq(x, y),
+            (Value::Builtin(x), Value::Builtin(y)) => x.name == y.name,
+            (Value::Native(x), Value::Native(y)) => Arc::ptr_eq(x, y),
+            (Value::Module(x), Value::Module(y)) => Arc::ptr_eq(x, y),
+            (Value::File(x), Value::File(y)) => Arc::ptr_eq(x, y),
+            (Value::Regex(x), Value::Regex(y)) => Arc::ptr_eq(x, y),
+            (Value::Iterator(x), Value::Iterator(y)) => Arc::ptr_eq(x, y),
+            (Value::Task(x), Value::Task(y)) => Arc::ptr_eq(x, y),
+            (Value::Channel(x), Value::Channel(y)) => Arc::ptr_eq(x, y),
+            (Value::Mutex(x), Value::Mutex(y)) => Arc::ptr_eq(x, y),
+            (Value::WaitGroup(x), Value::WaitGroup(y)) => Arc::ptr_eq(x, y),
+            (Value::Atomic(x), Value::Atomic(y)) => Arc::ptr_eq(x, y),
+            (Value::StringBuilder(x), Value::StringBuilder(y)) => Arc::ptr_eq(x, y),
+            (Value::Struct(x), Value::Struct(y)) => Arc::ptr_eq(x, y),
+            (Value::Enum(x), Value::Enum(y)) => Arc::ptr_eq(x, y),
+            (Value::Instance(x), Value::Instance(y)) => {
+                Arc::ptr_eq(x, y) || (Arc::ptr_eq(&x.of, &y.of) && *x.fields() == *y.fields())
+            }
+            (Value::Error(x), Value::Error(y)) => Arc::ptr_eq(x, y),
+            _ => false,
+        }
+    }
+}
+
+/// ints that fit in 64 bits are always an `Int`
+impl From<BigInt> for Value {
+    fn from(i: BigInt) -> Self {
+        match i.to_i64() {
+            Some(i) => Value::Int(i),
+            None => Value::BigInt(Arc::new(i)),
+        }
+    }
+}
+
+impl From<&str> for Value {
+    fn from(s: &str) -> Self {
+        Value::String(intern::string(s))
+    }
+}
+
+impl From<&[u8]> for Value {
+    fn from(b: &[u8]) -> Self {
+        limits::allocate(limits::string_values(b.len()));
+        Value::Bytes(b.into())
+    }
+}
+
+impl From<char> for Value {
+    fn from(c: char) -> Self {
+        Value::from(&*c.encode_utf8(&mut [0; 4]))
+    }
 }
 
 impl Value {
-    pub fn neg(self) -> Option<Value> {
+    /// the name of the type of the value, as used in error messages,
+    /// instances go by the name of their struct
+    pub fn type_name(&self) -> Cow<'static, str> {
+        let name = match self {
+            Value::None => "none",
+            Value::Bool(_) => "bool",
+            Value::Int(_) | Value::BigInt(_) => "int",
+            Value::Float(_) => "float",
+            Value::String(_) => "string",
+            Value::Symbol(_) => "symbol",
+            Value::Bytes(_) => "bytes",
+            Value::List(_) => "list",
+            Value::Map(_) => "map",
+            Value::Function(_) | Value::Closure(_) | Value::Builtin(_) | Value::Native(_) => {
+                "function"
+            }
+            Value::Module(_) => "module",
+            Value::File(_) => "file",
+            Value::Regex(_) => "regex",
+            Value::Iterator(_) => "iterator",
+            Value::Task(_) => "task",
+            Value::Channel(_) => "channel",
+            Value::Mutex(_) => "mutex",
+            Value::WaitGroup(_) => "wait_group",
+            Value::Atomic(_) => "atomic",
+            Value::StringBuilder(_) => "string_builder",
+            Value::Struct(_) => "struct",
+            Value::Enum(_) => "enum",
+            Value::Instance(i) => return Cow::Owned(i.of.name.clone()),
+            Value::Error(_) => "error",
+        };
+        Cow::Borrowed(name)
+    }
+
+    pub fn list(items: Vec<Value>) -> Self {
+        limits::allocate(1 + items.len());
+        Value::List(Arc::new(RwLock::new(items)))
+    }
+
+    pub fn symbol(name: &str) -> Self {
+        Value::Symbol(intern(name))
+    }
+
+    pub fn map(entries: IndexMap<Key, Value>) -> Self {
+        limits::allocate(1 + entries.len());
+        Value::Map(Arc::new(RwLock::new(entries)))
+    }
+
+    /// `none` and `false` are falsy, everything else is truthy
+    pub fn is_truthy(&self) -> bool {
+        !matches!(self, Value::None | Value::Bool(false))
+    }
+
+    pub fn neg(self) -> Result<Value, String> {
+        match self {
+            Value::Int(i) => Ok(i
+                .checked_neg()
+                .map_or_else(|| Value::from(-&BigInt::from(i)), Value::Int)),
+            Value::BigInt(i) => Ok(Value::from(-&*i)),
+            Value::Float(x) => Ok(Value::Float(-x)),
+            v => Err(unary_type_error("-", &v)),
+        }
+    }
+
+    pub fn not(self) -> Result<Value, String> {
+        Ok(Value::Bool(!self.is_truthy()))
+    }
+
+    pub fn bit_not(self) -> Result<Value, String> {
         match self {
-            Value::Int(i) => Some(Value::Int(-i)),
-            _ => todo!("type error handling"),
+            Value::Int(i) => Ok(Value::Int(!i)),
+            Value::BigInt(_) => Err(big_bitwise_error("lnot")),
+            v => Err(unary_type_error("lnot", &v)),
         }
     }
 
-    pub fn pow(self, rhs: Value) -> Option<Value> {
+    pub fn pow(self, rhs: Value) -> Result<Value, String> {
+        if let (Value::Int(x), Value::Int(y)) = (&self, &rhs) {
+            if let Some(i) = u32::try_from(*y).ok().and_then(|y| x.checked_pow(y)) {
+                return Ok(Value::Int(i));
+            }
+        }
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => Some(Value::Int(x.pow(y as u32))),
-            _ => todo!("type error handling"),
+            (x, y) if x.is_int() && y.is_int() && !y.is_negative() => {
+                big_pow(&x.to_big(), &y.to_big())
+            }
+            (x, y) => float_op("**", x, y, f64::powf),
         }
     }
 
-    pub fn mul(self, rhs: Value) -> Option<Value> {
+    pub fn mul(self, rhs: Value) -> Result<Value, String> {
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => Some(Value::Int(x * y)),
-            _ => todo!("type error handling"),
+            (x, y) if x.is_int() && y.is_int() => Ok(int_op(x, y, i64::checked_mul, |x, y| x * y)),
+            (x, y) => float_op("*", x, y, |x, y| x * y),
         }
     }
 
-    pub fn div(self, rhs: Value) -> Option<Value> {
+    pub fn div(self, rhs: Value) -> Result<Value, String> {
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => {
-                if y == 0 {
-                    todo!("handle runtime errors");
-                }
-                Some(Value::Int(x / y))
+            (x, Value::Int(0)) if x.is_int() => Err("division by zero".to_string()),
+            (x, y) if x.is_int() && y.is_int() => {
+                Ok(int_op(x, y, i64::checked_div, |x, y| big_div_rem(x, y).0))
             }
-            _ => todo!("type error handling"),
+            (x, y) => float_op("/", x, y, |x, y| x / y),
         }
     }
 
-    pub fn rem(self, rhs: Value) -> Option<Value> {
+    pub fn rem(self, rhs: Value) -> Result<Value, String> {
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => {
-                if y == 0 {
-                    todo!("handle runtime errors");
-                }
-                Some(Value::Int(x % y))
+            (x, Value::Int(0)) if x.is_int() => Err("division by zero".to_string()),
+            (x, y) if x.is_int() && y.is_int() => {
+                Ok(int_op(x, y, i64::checked_rem, |x, y| big_div_rem(x, y).1))
             }
-            _ => todo!("type error handling"),
+            (x, y) => float_op("%", x, y, |x, y| x % y),
         }
     }
 
-    pub fn add(self, rhs: Value) -> Option<Value> {
+    pub fn add(self, rhs: Value) -> Result<Value, String> {
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => Some(Value::Int(x + y)),
-            _ => todo!("type error handling"),
+            (x, y) if x.is_int() && y.is_int() => Ok(int_op(x, y, i64::checked_add, |x, y| x + y)),
+            (x, y) => float_op("+", x, y, |x, y| x + y),
         }
     }
 
-    pub fn sub(self, rhs: Value) -> Option<Value> {
+    pub fn sub(self, rhs: Value) -> Result<Value, String> {
         match (self, rhs) {
-            (Value::Int(x), Value::Int(y)) => Some(Value::Int(x - y)),
-            _ => todo!("type error handling"),
+            (x, y) if x.is_int() && y.is_int() => Ok(int_op(x, y, i64::checked_sub, |x, y| x - y)),
+            (x, y) => float_op("-", x, y, |x, y| x - y),
+        }
+    }
+
+    pub fn concat(self, rhs: Value) -> Result<Value, String> {
+        match (self, rhs) {
+            (Value::String(x), Value::String(y)) if y.is_empty() => Ok(Value::String(x)),
+            (Value::String(x), Value::String(y)) if x.is_empty() => Ok(Value::String(y)),
+            (Value::String(x), Value::String(y)) => Ok(Value::from([&*x, &*y].concat().as_str())),
+            (Value::Bytes(x), Value::Bytes(y)) => Ok(Value::from([&*x, &*y].concat().as_slice())),
+            (Value::List(x), Value::List(y)) => {
+                let mut items = x.read().unwrap_or_else(|e| e.into_inner()).clone();
+                items.extend(y.read().unwrap_or_else(|e| e.into_inner()).iter().cloned());
+                Ok(Value::list(items))
+            }
+            (x, y) => Err(binary_type_error("++", &x, &y)),
+        }
+    }
+
+    pub fn compare(&self, rhs: &Value) -> Result<std::cmp::Ordering, String> {
+        let ordering = match (self, rhs) {
+            (Value::Int(x), Value::Int(y)) => Some(x.cmp(y)),
+            (x, y) if x.is_int() && y.is_int() => Some(x.to_big().cmp(&y.to_big())),
+            (Value::String(x), Value::String(y)) => Some(x.cmp(y)),
+            (Value::Bytes(x), Value::Bytes(y)) => Some(x.cmp(y)),
+            (x, y) => match (x.as_float(), y.as_float()) {
+                (Some(x), Some(y)) => x.partial_cmp(&y),
+                _ => {
+                    return Err(format!(
+                        "cannot compare {} with {}",
+                        x.type_name(),
+                        y.type_name()
+                    ))
+                }
+            },
+        };
+        ordering.ok_or_else(|| "cannot compare NaN".to_string())
+    }
+
+    /// `item in self`, for lists, the keys of maps, substrings, and bytes
+    /// and runs of them
+    pub fn contains(&self, item: &Value) -> Result<bool, String> {
+        match (self, item) {
+            (Value::List(l), item) => {
+                Ok(l.read().unwrap_or_else(|e| e.into_inner()).contains(item))
+            }
+            (Value::Map(m), item) => Ok(Key::try_from(item)
+                .is_ok_and(|k| m.read().unwrap_or_else(|e| e.into_inner()).contains_key(&k))),
+            (Value::String(s), Value::String(sub)) => Ok(s.contains(sub.as_ref())),
+            (Value::Bytes(b), Value::Int(i)) => Ok(u8::try_from(*i).is_ok_and(|i| b.contains(&i))),
+            (Value::Bytes(b), Value::Bytes(sub)) => {
+                Ok(sub.is_empty() || b.windows(sub.len()).any(|w| w == &**sub))
+            }
+            (x, y) => Err(binary_type_error("in", y, x)),
+        }
+    }
+
+    fn bitwise(
+        self,
+        name: &str,
+        rhs: Value,
+        op: fn(i64, i64) -> Option<i64>,
+    ) -> Result<Value, String> {
+        match (self, rhs) {
+            (Value::Int(x), Value::Int(y)) => op(x, y)
+                .map(Value::Int)
+                .ok_or_else(|| "shift amount out of range".to_string()),
+            (x, y) if x.is_int() && y.is_int() => Err(big_bitwise_error(name)),
+            (x, y) => Err(binary_type_error(name, &x, &y)),
+        }
+    }
+
+    fn as_float(&self) -> Option<f64> {
+        match self {
+            Value::Int(i) => Some(*i as f64),
+            Value::BigInt(i) => Some(i.to_f64()),
+            Value::Float(x) => Some(*x),
+            _ => None,
+        }
+    }
+
+    fn is_int(&self) -> bool {
+        matches!(self, Value::Int(_) | Value::BigInt(_))
+    }
+
+    fn is_negative(&self) -> bool {
+        match self {
+            Value::Int(i) => *i < 0,
+            Value::BigInt(i) => i.is_negative(),
+            _ => false,
+        }
+    }
+
+    /// only for ints
+    fn to_big(&self) -> BigInt {
+        match self {
+            Value::Int(i) => BigInt::from(*i),
+            Value::BigInt(i) => (**i).clone(),
+            _ => crate::assert_unreachable!(),
+        }
+    }
+}
+
+/// apply a binary operator, except for the short-circuiting ones
+pub fn binary(op: BinOperator, lhs: Value, rhs: Value) -> Result<Value, String> {
+    use std::cmp::Ordering::*;
+    match op {
+        BinOperator::Pow => lhs.pow(rhs),
+        BinOperator::Mul => lhs.mul(rhs),
+        BinOperator::Div => lhs.div(rhs),
+        BinOperator::Mod => lhs.rem(rhs),
+        BinOperator::Add => lhs.add(rhs),
+        BinOperator::Sub => lhs.sub(rhs),
+        BinOperator::Concat => lhs.concat(rhs),
+        BinOperator::BitAnd => lhs.bitwise("land", rhs, |x, y| Some(x & y)),
+        BinOperator::BitOr => lhs.bitwise("lor", rhs, |x, y| Some(x | y)),
+        BinOperator::BitXor => lhs.bitwise("lxor", rhs, |x, y| Some(x ^ y)),
+        BinOperator::Shl => lhs.bitwise("lsl", rhs, |x, y| shift(y).map(|y| x << y)),
+        BinOperator::Lsr => lhs.bitwise("lsr", rhs, |x, y| {
+            shift(y).map(|y| ((x as u64) >> y) as i64)
+        }),
+        BinOperator::Asr => lhs.bitwise("asr", rhs, |x, y| shift(y).map(|y| x >> y)),
+        BinOperator::Eq => Ok(Value::Bool(lhs == rhs)),
+        BinOperator::Ne => Ok(Value::Bool(lhs != rhs)),
+        BinOperator::Lt => Ok(Value::Bool(lhs.compare(&rhs)? == Less)),
+        BinOperator::Le => Ok(Value::Bool(lhs.compare(&rhs)? != Greater)),
+        BinOperator::Gt => Ok(Value::Bool(lhs.compare(&rhs)? == Greater)),
+        BinOperator::Ge => Ok(Value::Bool(lhs.compare(&rhs)? != Less)),
+        BinOperator::Xor => Ok(Value::Bool(lhs.is_truthy() != rhs.is_truthy())),
+        BinOperator::In => Ok(Value::Bool(rhs.contains(&lhs)?)),
+        BinOperator::And | BinOperator::Or | BinOperator::Coalesce => crate::assert_unreachable!(),
+    }
+}
+
+pub fn unary(op: UnOperator, rhs: Value) -> Result<Value, String> {
+    match op {
+        UnOperator::Neg => rhs.neg(),
+        UnOperator::Not => rhs.not(),
+        UnOperator::BitNot => rhs.bit_not(),
+        UnOperator::Str => match rhs {
+            Value::String(s) => Ok(Value::String(s)),
+            rhs => Ok(Value::from(rhs.to_string().as_str())),
+        },
+    }
+}
+
+/// `target[index]`, the items of strings are their characters and those of
+/// bytes are ints, missing keys of maps are `none`
+pub fn index(target: &Value, index: &Value) -> Result<Value, String> {
+    if let Value::Map(m) = target {
+        let key = Key::try_from(index)?;
+        let entries = m.read().unwrap_or_else(|e| e.into_inner());
+        return Ok(entries.get(&key).cloned().unwrap_or(Value::None));
+    }
+    let i = index_value(target, index)?;
+    match target {
+        Value::List(l) => {
+            let items = l.read().unwrap_or_else(|e| e.into_inner());
+            let i = position(i, items.len(), target)?;
+            Ok(items[i].clone())
+        }
+        Value::String(s) => {
+            let i = position(i, s.chars().count(), target)?;
+            Ok(Value::from(
+                s.chars().nth(i).expect("the position is in bounds"),
+            ))
+        }
+        Value::Bytes(b) => {
+            let i = position(i, b.len(), target)?;
+            Ok(Value::Int(b[i] as i64))
+        }
+        v => Err(format!("{} is not indexable", v.type_name())),
+    }
+}
+
+/// `target[index] = value`, only lists and maps can be changed, assigning to
+/// a missing key adds it to the map
+pub fn set_index(target: &Value, index: &Value, value: Value) -> Result<(), String> {
+    if let Value::Map(m) = target {
+        let key = Key::try_from(index)?;
+        let replaced = m
+            .write()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(key, value);
+        if replaced.is_none() {
+            limits::allocate(1);
+        }
+        return Ok(());
+    }
+    let Value::List(l) = target else {
+        return Err(format!(
+            "cannot assign to an item of {}",
+            target.type_name()
+        ));
+    };
+    let i = index_value(target, index)?;
+    let mut items = l.write().unwrap_or_else(|e| e.into_inner());
+    let i = position(i, items.len(), target)?;
+    items[i] = value;
+    Ok(())
+}
+
+/// `target[start:end:step]`, a new list, string or bytes. The parts that are
+/// `none` take their default, a negative step goes backwards from the end.
+pub fn slice(target: &Value, start: Value, end: Value, step: Value) -> Result<Value, String> {
+    let bound = |v: Value| match v {
+        Value::None => Ok(None),
+        Value::Int(i) => Ok(Some(i)),
+        // past the end either way, whatever the length
+        Value::BigInt(i) => Ok(Some(match i.is_negative() {
+            true => i64::MIN,
+            false => i64::MAX,
+        })),
+        v => Err(format!(
+            "slice bounds must be ints, found {}",
+            v.type_name()
+        )),
+    };
+    let (start, end) = (bound(start)?, bound(end)?);
+    let step = bound(step)?.unwrap_or(1);
+    let select = |len: usize| -> Result<Vec<usize>, String> {
+        let len = len as i64;
+        let clamp = |i: i64, min: i64, max: i64| match i < 0 {
+            true => (i + len).clamp(min, max),
+            false => i.clamp(min, max),
+        };
+        let (mut i, end) = match step {
+            0 => return Err("slice step cannot be zero".to_string()),
+            1.. => (
+                start.map_or(0, |i| clamp(i, 0, len)),
+                end.map_or(len, |i| clamp(i, 0, len)),
+            ),
+            _ => (
+                start.map_or(len - 1, |i| clamp(i, -1, len - 1)),
+                end.map_or(-1, |i| clamp(i, -1, len - 1)),
+            ),
+        };
+        let mut positions = vec![];
+        while (step > 0 && i < end) || (step < 0 && i > end) {
+            positions.push(i as usize);
+            i += step;
+        }
+        Ok(positions)
+    };
+    match target {
+        Value::List(l) => {
+            let items = l.read().unwrap_or_else(|e| e.into_inner());
+            let positions = select(items.len())?;
+            Ok(Value::list(
+                positions.into_iter().map(|i| items[i].clone()).collect(),
+            ))
+        }
+        Value::String(s) => {
+            let chars: Vec<char> = s.chars().collect();
+            let positions = select(chars.len())?;
+            let s: String = positions.into_iter().map(|i| chars[i]).collect();
+            Ok(Value::from(s.as_str()))
+        }
+        Value::Bytes(b) => {
+            let positions = select(b.len())?;
+            let b: Vec<u8> = positions.into_iter().map(|i| b[i]).collect();
+            Ok(Value::from(b.as_slice()))
+        }
+        v => Err(format!("cannot slice {}", v.type_name())),
+    }
+}
+
+fn index_value(target: &Value, index: &Value) -> Result<i64, String> {
+    match index {
+        Value::Int(i) => Ok(*i),
+        Value::BigInt(i) => Err(format!(
+            "index {} is out of range for a {}",
+            i,
+            target.type_name()
+        )),
+        v => Err(format!(
+            "{} indices must be ints, found {}",
+            target.type_name(),
+            v.type_name()
+        )),
+    }
+}
+
+/// the position of an index, negative indices count from the end
+fn position(i: i64, len: usize, target: &Value) -> Result<usize, String> {
+    let position = match i < 0 {
+        true => i.checked_add(len as i64),
+        false => Some(i),
+    };
+    position
+        .and_then(|p| usize::try_from(p).ok())
+        .filter(|&p| p < len)
+        .ok_or_else(|| {
+            format!(
+                "index {} is out of range for a {} of length {}",
+                i,
+                target.type_name(),
+                len
+            )
+        })
+}
+
+/// shift amounts must be in `0..64`
+fn shift(y: i64) -> Option<u32> {
+    u32::try_from(y).ok().filter(|&y| y < 64)
+}
+
+/// An operation on two ints, done again on big ints when the result doesn't
+/// fit in 64 bits or an operand is already big
+fn int_op(
+    x: Value,
+    y: Value,
+    small: fn(i64, i64) -> Option<i64>,
+    big: fn(&BigInt, &BigInt) -> BigInt,
+) -> Value {
+    if let (Value::Int(a), Value::Int(b)) = (&x, &y) {
+        if let Some(i) = small(*a, *b) {
+            return Value::Int(i);
         }
     }
+    Value::from(big(&x.to_big(), &y.to_big()))
+}
+
+/// the divisor is never zero, `div` and `rem` check it first
+fn big_div_rem(x: &BigInt, y: &BigInt) -> (BigInt, BigInt) {
+    x.div_rem(y).unwrap_or_else(|| crate::assert_unreachable!())
+}
+
+/// The most bits the result of `**` can have, past it working out the
+/// digits takes too long to be what the script meant
+const MAX_POW_BITS: u64 = 1 << 24;
+
+/// `x ** y` for a non-negative exponent
+fn big_pow(x: &BigInt, y: &BigInt) -> Result<Value, String> {
+    // 0, 1 and -1 stay small, only the parity of the exponent matters
+    if x.bits() <= 1 {
+        let exponent = match (y.bits(), y.is_odd()) {
+            (0, _) => 0,
+            (_, true) => 1,
+            (_, false) => 2,
+        };
+        return Ok(Value::from(x.pow(exponent)));
+    }
+    y.to_i64()
+        .filter(|&y| {
+            (x.bits() - 1)
+                .checked_mul(y as u64)
+                .is_some_and(|b| b <= MAX_POW_BITS)
+        })
+        .map(|y| Value::from(x.pow(y as u64)))
+        .ok_or_else(|| "the result of ** is too large".to_string())
+}
+
+fn float_op(name: &str, x: Value, y: Value, op: fn(f64, f64) -> f64) -> Result<Value, String> {
+    match (x.as_float(), y.as_float()) {
+        (Some(a), Some(b)) => Ok(Value::Float(op(a, b))),
+        _ => Err(binary_type_error(name, &x, &y)),
+    }
+}
+
+fn big_bitwise_error(op: &str) -> String {
+    format!("{} only supports ints of at most 64 bits", op)
+}
+
+fn unary_type_error(op: &str, v: &Value) -> String {
+    format!("unsupported operand type for {}: {}", op, v.type_name())
+}
+
+fn binary_type_error(op: &str, x: &Value, y: &Value) -> String {
+    format!(
+        "unsupported operand types for {}: {} and {}",
+        op,
+        x.type_name(),
+        y.type_name()
+    )
 }
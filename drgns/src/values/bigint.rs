@@ -0,0 +1,360 @@
+//! Integers of any size, what ints become once they don't fit in 64 bits.
+//!
+//! A value only holds a big int when it doesn't fit in an `i64`, results
+//! that fit again go back to `Value::Int`, see `Value::from(BigInt)`. So the
+//! two are never equal, and scripts can't tell them apart: both are `int`.
+
+use std::{
+    cmp::Ordering,
+    fmt::Display,
+    ops::{Add, Mul, Neg, Sub},
+};
+
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct BigInt {
+    /// never set for zero
+    negative: bool,
+
+    /// the magnitude in base 2^32, least significant digit first, without
+    /// leading zeros
+    digits: Vec<u32>,
+}
+
+impl From<i64> for BigInt {
+    fn from(i: i64) -> Self {
+        Self::from(i as i128)
+    }
+}
+
+impl From<i128> for BigInt {
+    fn from(i: i128) -> Self {
+        let mut magnitude = i.unsigned_abs();
+        let mut digits = vec![];
+        while magnitude > 0 {
+            digits.push(magnitude as u32);
+            magnitude >>= 32;
+        }
+        Self::new(i < 0, digits)
+    }
+}
+
+impl BigInt {
+    fn new(negative: bool, mut digits: Vec<u32>) -> Self {
+        while digits.last() == Some(&0) {
+            digits.pop();
+        }
+        Self {
+            negative: negative && !digits.is_empty(),
+            digits,
+        }
+    }
+
+    /// the integer part of a float, `None` for infinities and NaN
+    pub fn from_f64(x: f64) -> Option<Self> {
+        if !x.is_finite() {
+            return None;
+        }
+        let x = x.trunc();
+        if x.abs() < 9223372036854775808.0 {
+            return Some(Self::from(x as i64));
+        }
+        // the float is its 53 bits of mantissa shifted left
+        let bits = x.to_bits();
+        let exponent = ((bits >> 52) & 0x7ff) - 1075;
+        let mantissa = (bits & ((1 << 52) - 1)) | (1 << 52);
+        let magnitude = &Self::from(mantissa as i64) * &Self::from(2i64).pow(exponent);
+        Some(match x < 0.0 {
+            true => -&magnitude,
+            false => magnitude,
+        })
+    }
+
+    pub fn to_i128(&self) -> Option<i128> {
+        if self.digits.len() > 4 {
+            return None;
+        }
+        let magnitude = self
+            .digits
+            .iter()
+            .rev()
+            .fold(0u128, |m, d| (m << 32) | *d as u128);
+        match self.negative {
+            true => 0i128.checked_sub_unsigned(magnitude),
+            false => i128::try_from(magnitude).ok(),
+        }
+    }
+
+    pub fn to_i64(&self) -> Option<i64> {
+        self.to_i128().and_then(|i| i64::try_from(i).ok())
+    }
+
+    pub fn to_f64(&self) -> f64 {
+        let magnitude = self
+            .digits
+            .iter()
+            .rev()
+            .fold(0.0, |m, d| m * 4294967296.0 + *d as f64);
+        match self.negative {
+            true => -magnitude,
+            false => magnitude,
+        }
+    }
+
+    pub fn is_negative(&self) -> bool {
+        self.negative
+    }
+
+    pub fn is_odd(&self) -> bool {
+        self.digits.first().is_some_and(|d| d & 1 == 1)
+    }
+
+    /// the number of bits of the magnitude
+    pub fn bits(&self) -> u64 {
+        match self.digits.last() {
+            Some(last) => 32 * self.digits.len() as u64 - last.leading_zeros() as u64,
+            None => 0,
+        }
+    }
+
+    /// the quotient rounded towards zero and the remainder, which has the
+    /// sign of `self` like for `i64`, `None` when dividing by zero
+    pub fn div_rem(&self, divisor: &BigInt) -> Option<(BigInt, BigInt)> {
+        if divisor.digits.is_empty() {
+            return None;
+        }
+        let (q, r) = div_rem_magnitudes(&self.digits, &divisor.digits);
+        Some((
+            Self::new(self.negative != divisor.negative, q),
+            Self::new(self.negative, r),
+        ))
+    }
+
+    pub fn pow(&self, mut exponent: u64) -> BigInt {
+        let mut base = self.clone();
+        let mut result = BigInt::from(1i64);
+        while exponent > 0 {
+            if exponent & 1 == 1 {
+                result = &result * &base;
+            }
+            exponent >>= 1;
+            if exponent > 0 {
+                base = &base * &base;
+            }
+        }
+        result
+    }
+}
+
+impl Ord for BigInt {
+    fn cmp(&self, other: &Self) -> Ordering {
+        match (self.negative, other.negative) {
+            (false, true) => Ordering::Greater,
+            (true, false) => Ordering::Less,
+            (false, false) => compare_magnitudes(&self.digits, &other.digits),
+            (true, true) => compare_magnitudes(&other.digits, &self.digits),
+        }
+    }
+}
+
+impl PartialOrd for BigInt {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Neg for &BigInt {
+    type Output = BigInt;
+
+    fn neg(self) -> BigInt {
+        BigInt::new(!self.negative, self.digits.clone())
+    }
+}
+
+impl Add for &BigInt {
+    type Output = BigInt;
+
+    fn add(self, other: &BigInt) -> BigInt {
+        if self.negative == other.negative {
+            return BigInt::new(self.negative, add_magnitudes(&self.digits, &other.digits));
+        }
+        // the sign is the one of the larger magnitude
+        match compare_magnitudes(&self.digits, &other.digits) {
+            Ordering::Less => {
+                BigInt::new(other.negative, sub_magnitudes(&other.digits, &self.digits))
+            }
+            _ => BigInt::new(self.negative, sub_magnitudes(&self.digits, &other.digits)),
+        }
+    }
+}
+
+impl Sub for &BigInt {
+    type Output = BigInt;
+
+    fn sub(self, other: &BigInt) -> BigInt {
+        self + &-other
+    }
+}
+
+impl Mul for &BigInt {
+    type Output = BigInt;
+
+    fn mul(self, other: &BigInt) -> BigInt {
+        let mut digits = vec![0u32; self.digits.len() + other.digits.len()];
+        for (i, &x) in self.digits.iter().enumerate() {
+            let mut carry = 0u64;
+            for (j, &y) in other.digits.iter().enumerate() {
+                let t = x as u64 * y as u64 + digits[i + j] as u64 + carry;
+                digits[i + j] = t as u32;
+                carry = t >> 32;
+            }
+            digits[i + other.digits.len()] = carry as u32;
+        }
+        BigInt::new(self.negative != other.negative, digits)
+    }
+}
+
+/// in decimal, nine digits at a time
+impl Display for BigInt {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        if self.digits.is_empty() {
+            return write!(f, "0");
+        }
+        let mut magnitude = self.digits.clone();
+        let mut chunks = vec![];
+        while !magnitude.is_empty() {
+            chunks.push(div_rem_digit(&mut magnitude, 1_000_000_000));
+        }
+        if self.negative {
+            write!(f, "-")?;
+        }
+        let mut chunks = chunks.iter().rev();
+        if let Some(first) = chunks.next() {
+            write!(f, "{}", first)?;
+        }
+        for c in chunks {
+            write!(f, "{:09}", c)?;
+        }
+        Ok(())
+    }
+}
+
+fn compare_magnitudes(a: &[u32], b: &[u32]) -> Ordering {
+    a.len()
+        .cmp(&b.len())
+        .then_with(|| a.iter().rev().cmp(b.iter().rev()))
+}
+
+fn add_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+    let (long, short) = if a.len() >= b.len() { (a, b) } else { (b, a) };
+    let mut digits = Vec::with_capacity(long.len() + 1);
+    let mut carry = 0u64;
+    for (i, &x) in long.iter().enumerate() {
+        let t = x as u64 + *short.get(i).unwrap_or(&0) as u64 + carry;
+        digits.push(t as u32);
+        carry = t >> 32;
+    }
+    digits.push(carry as u32);
+    digits
+}
+
+/// `a - b`, where `a` is at least `b`
+fn sub_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+    let mut digits = Vec::with_capacity(a.len());
+    let mut borrow = 0i64;
+    for (i, &x) in a.iter().enumerate() {
+        let t = x as i64 - *b.get(i).unwrap_or(&0) as i64 - borrow;
+        digits.push(t as u32);
+        borrow = (t < 0) as i64;
+    }
+    digits
+}
+
+/// divide the magnitude in place by a single digit, returns the remainder
+fn div_rem_digit(digits: &mut Vec<u32>, divisor: u32) -> u32 {
+    let mut remainder = 0u64;
+    for d in digits.iter_mut().rev() {
+        let t = (remainder << 32) | *d as u64;
+        *d = (t / divisor as u64) as u32;
+        remainder = t % divisor as u64;
+    }
+    while digits.last() == Some(&0) {
+        digits.pop();
+    }
+    remainder as u32
+}
+
+/// long division of magnitudes, as in Knuth's algorithm D: each digit of the
+/// quotient is estimated from the leading digits, and corrected at most
+/// twice, once the divisor is shifted to have its top bit set
+fn div_rem_magnitudes(u: &[u32], v: &[u32]) -> (Vec<u32>, Vec<u32>) {
+    crate::assert_pre_condition!(!v.is_empty());
+    if compare_magnitudes(u, v) == Ordering::Less {
+        return (vec![], u.to_vec());
+    }
+    if let [d] = v {
+        let mut q = u.to_vec();
+        let r = div_rem_digit(&mut q, *d);
+        return (q, vec![r]);
+    }
+    let (n, m) = (v.len(), u.len());
+    let shift = v[n - 1].leading_zeros();
+    let vn = shift_left(v, shift, n);
+    let mut un = shift_left(u, shift, m + 1);
+    let base = 1u64 << 32;
+    let mut q = vec![0u32; m - n + 1];
+    for j in (0..=m - n).rev() {
+        let top = ((un[j + n] as u64) << 32) | un[j + n - 1] as u64;
+        let mut qhat = top / vn[n - 1] as u64;
+        let mut rhat = top % vn[n - 1] as u64;
+        while qhat >= base || qhat * vn[n - 2] as u64 > ((rhat << 32) | un[j + n - 2] as u64) {
+            qhat -= 1;
+            rhat += vn[n - 1] as u64;
+            if rhat >= base {
+                break;
+            }
+        }
+        // subtract qhat times the divisor from the current digits
+        let mut borrow = 0i64;
+        let mut carry = 0u64;
+        for i in 0..n {
+            let p = qhat * vn[i] as u64 + carry;
+            carry = p >> 32;
+            let t = un[i + j] as i64 - borrow - (p & 0xffff_ffff) as i64;
+            un[i + j] = t as u32;
+            borrow = (t < 0) as i64;
+        }
+        let t = un[j + n] as i64 - borrow - carry as i64;
+        un[j + n] = t as u32;
+        q[j] = qhat as u32;
+        // the estimate was one too many, add the divisor back
+        if t < 0 {
+            q[j] -= 1;
+            let mut carry = 0u64;
+            for i in 0..n {
+                let s = un[i + j] as u64 + vn[i] as u64 + carry;
+                un[i + j] = s as u32;
+                carry = s >> 32;
+            }
+            un[j + n] = un[j + n].wrapping_add(carry as u32);
+        }
+    }
+    let r = (0..n)
+        .map(|i| match shift {
+            0 => un[i],
+            s => (un[i] >> s) | (un[i + 1] << (32 - s)),
+        })
+        .collect();
+    (q, r)
+}
+
+/// the digits shifted left by less than a digit, padded to the length
+fn shift_left(digits: &[u32], shift: u32, len: usize) -> Vec<u32> {
+    let mut shifted = vec![0u32; len];
+    for (i, &d) in digits.iter().enumerate() {
+        shifted[i] |= d << shift;
+        if shift > 0 && i + 1 < len {
+            shifted[i + 1] = d >> (32 - shift);
+        }
+    }
+    shifted
+}
@@ -0,0 +1,238 @@
+//! Channels, queues of values that tasks hand each other. Receiving waits
+//! for an item, and sending waits while the channel is full, so tasks can
+//! pace each other without sharing anything else.
+//!
+//! A channel with a capacity of 0 holds no items: each send waits until a
+//! receiver takes its item. Once a channel is closed sending is an error, and
+//! receiving gives `^done` after the items left in it.
+
+use std::{
+    collections::VecDeque,
+    sync::{Arc, Condvar, Mutex, MutexGuard},
+    time::Duration,
+};
+
+use web_time::Instant;
+
+use super::{done, Value};
+
+/// The symbol returned by `try_recv` when a channel that is still open has
+/// no items
+pub const EMPTY: &str = "empty";
+
+pub struct Channel {
+    pub capacity: usize,
+    state: Mutex<State>,
+
+    /// signalled whenever an item is added or taken, or the channel is closed
+    changed: Condvar,
+}
+
+#[derive(Default)]
+struct State {
+    items: VecDeque<Value>,
+    closed: bool,
+
+    /// the items sent and taken so far, a send along a channel without
+    /// capacity waits until its item is taken
+    sent: u64,
+    taken: u64,
+
+    /// receivers waiting for an item, a send that can't wait hands its item
+    /// to one of them, or to a select
+    receivers: usize,
+
+    /// the selects waiting on the channel, among others
+    selects: Vec<Arc<Signal>>,
+}
+
+/// Wakes up a select, see `select`
+#[derive(Default)]
+struct Signal {
+    fired: Mutex<bool>,
+    woken: Condvar,
+}
+
+impl Signal {
+    fn fire(&self) {
+        *self.fired.lock().unwrap_or_else(|e| e.into_inner()) = true;
+        self.woken.notify_all();
+    }
+
+    /// wait until the signal fires or the deadline passes, and reset it
+    fn wait(&self, deadline: Option<Instant>) {
+        let mut fired = self.fired.lock().unwrap_or_else(|e| e.into_inner());
+        while !*fired {
+            fired = match deadline {
+                Some(d) => {
+                    let Some(left) = d.checked_duration_since(Instant::now()) else {
+                        break;
+                    };
+                    self.woken
+                        .wait_timeout(fired, left)
+                        .unwrap_or_else(|e| e.into_inner())
+                        .0
+                }
+                None => self.woken.wait(fired).unwrap_or_else(|e| e.into_inner()),
+            };
+        }
+        *fired = false;
+    }
+}
+
+impl std::fmt::Debug for Channel {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Channel({})", self.capacity)
+    }
+}
+
+impl Channel {
+    pub fn new(capacity: usize) -> Arc<Self> {
+        Arc::new(Self {
+            capacity,
+            state: Mutex::new(State::default()),
+            changed: Condvar::new(),
+        })
+    }
+
+    fn lock(&self) -> MutexGuard<'_, State> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    fn wait<'a>(&self, state: MutexGuard<'a, State>) -> MutexGuard<'a, State> {
+        self.changed.wait(state).unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// add the item and wake up whoever waits on the channel
+    fn push(&self, state: &mut State, item: Value) -> u64 {
+        state.items.push_back(item);
+        state.sent += 1;
+        self.notify(state);
+        state.sent
+    }
+
+    fn notify(&self, state: &State) {
+        self.changed.notify_all();
+        for s in &state.selects {
+            s.fire();
+        }
+    }
+
+    /// Add an item, waiting while the channel is full, and until the item is
+    /// taken if the channel has no capacity
+    pub fn send(&self, item: Value) -> Result<(), String> {
+        let mut state = self.lock();
+        loop {
+            if state.closed {
+                return Err("send expects a channel that is open".to_owned());
+            }
+            if state.items.len() < self.capacity.max(1) {
+                break;
+            }
+            state = self.wait(state);
+        }
+        let ticket = self.push(&mut state, item);
+        if self.capacity == 0 {
+            while state.taken < ticket && !state.closed {
+                state = self.wait(state);
+            }
+        }
+        Ok(())
+    }
+
+    /// Add an item if it can be without waiting, that is if the channel has
+    /// room, or if a receiver is waiting for it when it has no capacity
+    pub fn try_send(&self, item: Value) -> Result<bool, String> {
+        let mut state = self.lock();
+        if state.closed {
+            return Err("try_send expects a channel that is open".to_owned());
+        }
+        let room = match self.capacity {
+            0 => state.receivers + state.selects.len() > state.items.len(),
+            capacity => state.items.len() < capacity,
+        };
+        if room {
+            self.push(&mut state, item);
+        }
+        Ok(room)
+    }
+
+    fn take(&self, state: &mut State) -> Option<Value> {
+        let item = state.items.pop_front()?;
+        state.taken += 1;
+        self.notify(state);
+        Some(item)
+    }
+
+    /// The next item, waiting for one, or `^done` once the channel is closed
+    /// and has none left
+    pub fn recv(&self) -> Value {
+        let mut state = self.lock();
+        state.receivers += 1;
+        loop {
+            if let Some(item) = self.take(&mut state) {
+                state.receivers -= 1;
+                return item;
+            }
+            if state.closed {
+                state.receivers -= 1;
+                return done();
+            }
+            state = self.wait(state);
+        }
+    }
+
+    /// The next item if there is one, `^done` if the channel is closed and
+    /// has none left, otherwise `^empty`
+    pub fn try_recv(&self) -> Value {
+        self.ready().unwrap_or_else(|| Value::symbol(EMPTY))
+    }
+
+    /// Stop the channel taking items, those waiting to receive are woken up
+    pub fn close(&self) -> Result<(), String> {
+        let mut state = self.lock();
+        if state.closed {
+            return Err("close expects a channel that is open".to_owned());
+        }
+        state.closed = true;
+        self.notify(&state);
+        Ok(())
+    }
+
+    /// the next item, or `^done` if the channel is closed and has none
+    /// left, `None` if it is open and empty
+    fn ready(&self) -> Option<Value> {
+        let mut state = self.lock();
+        match self.take(&mut state) {
+            Some(item) => Some(item),
+            None => state.closed.then(done),
+        }
+    }
+}
+
+/// Wait for the first of the channels to have an item or be closed, the
+/// index of the channel and what it gave, or `None` once the timeout passes.
+/// Channels earlier in the list are tried first.
+pub fn select(channels: &[Arc<Channel>], timeout: Option<Duration>) -> Option<(usize, Value)> {
+    let deadline = timeout.map(|t| Instant::now() + t);
+    let signal = Arc::new(Signal::default());
+    // watch the channels before looking at them, so that an item sent in
+    // between wakes the select up
+    for c in channels {
+        c.lock().selects.push(signal.clone());
+    }
+    let selected = loop {
+        let ready = channels
+            .iter()
+            .enumerate()
+            .find_map(|(i, c)| c.ready().map(|item| (i, item)));
+        if ready.is_some() || deadline.is_some_and(|d| Instant::now() >= d) {
+            break ready;
+        }
+        signal.wait(deadline);
+    };
+    for c in channels {
+        c.lock().selects.retain(|s| !Arc::ptr_eq(s, &signal));
+    }
+    selected
+}
@@ -0,0 +1,242 @@
+//! Printing values that contain others, on one line or over several.
+//!
+//! Lists, maps and instances are shared, so they can contain themselves,
+//! directly or not. When one is met again inside itself it is printed as
+//! `[...]`, `{...}` or `Name(...)`, rather than being printed forever.
+//!
+//! `inspect` is meant for people reading values at the REPL or in the
+//! debugger: a value that doesn't fit on a line gets one item per line,
+//! indented, and huge values are cut short. Printing a value in any other
+//! way gives all of it, on one line.
+
+use std::sync::Arc;
+
+use super::Value;
+
+/// lines `inspect` tries to keep under
+const WIDTH: usize = 80;
+const INDENT: usize = 4;
+
+/// items of a list, entries of a map, shown by `inspect`, the others are
+/// counted instead
+const MAX_ITEMS: usize = 100;
+
+/// characters of a string shown by `inspect`
+const MAX_CHARS: usize = 1000;
+
+/// values shown by `inspect` in all, so that a list of long lists is cut
+/// short too
+const MAX_VALUES: usize = 2000;
+
+/// A value laid out for printing
+enum Layout {
+    Text(String),
+
+    /// a map entry or a field, the value follows its name
+    Entry(String, Box<Layout>),
+
+    /// the items of a container, separated by commas between delimiters
+    Group {
+        open: String,
+        items: Vec<Layout>,
+        close: &'static str,
+    },
+}
+
+impl Layout {
+    /// the length of the layout printed on one line
+    fn width(&self) -> usize {
+        match self {
+            Layout::Text(t) => t.chars().count(),
+            Layout::Entry(name, value) => name.chars().count() + value.width(),
+            Layout::Group { open, items, close } => {
+                let items: usize = items.iter().map(|i| i.width() + 2).sum();
+                open.chars().count() + items.saturating_sub(2) + close.len()
+            }
+        }
+    }
+
+    fn flat(&self, out: &mut String) {
+        match self {
+            Layout::Text(t) => out.push_str(t),
+            Layout::Entry(name, value) => {
+                out.push_str(name);
+                value.flat(out);
+            }
+            Layout::Group { open, items, close } => {
+                out.push_str(open);
+                for (i, item) in items.iter().enumerate() {
+                    if i > 0 {
+                        out.push_str(", ");
+                    }
+                    item.flat(out);
+                }
+                out.push_str(close);
+            }
+        }
+    }
+
+    /// print the layout from the column, on one line if it fits, otherwise
+    /// with one item per line, indented one level more than `indent`
+    fn pretty(&self, out: &mut String, column: usize, indent: usize) {
+        if column + self.width() <= WIDTH {
+            return self.flat(out);
+        }
+        match self {
+            Layout::Text(t) => out.push_str(t),
+            Layout::Entry(name, value) => {
+                out.push_str(name);
+                value.pretty(out, column + name.chars().count(), indent);
+            }
+            Layout::Group { open, items, close } => {
+                out.push_str(open);
+                let inner = indent + INDENT;
+                for item in items {
+                    out.push('\n');
+                    out.push_str(&" ".repeat(inner));
+                    item.pretty(out, inner, inner);
+                    out.push(',');
+                }
+                out.push('\n');
+                out.push_str(&" ".repeat(indent));
+                out.push_str(close);
+            }
+        }
+    }
+}
+
+/// Lays out values, keeping track of the containers it is inside of
+struct Printer {
+    /// the addresses of the containers being laid out, outermost first
+    inside: Vec<usize>,
+
+    /// whether to cut huge values short
+    truncate: bool,
+
+    /// values that can still be shown when truncating
+    budget: usize,
+}
+
+impl Printer {
+    fn new(truncate: bool) -> Self {
+        Self {
+            inside: vec![],
+            truncate,
+            budget: MAX_VALUES,
+        }
+    }
+
+    fn layout(&mut self, v: &Value) -> Layout {
+        self.budget = self.budget.saturating_sub(1);
+        match v {
+            Value::String(s) => Layout::Text(self.quoted(s)),
+            Value::List(l) => self.group(Arc::as_ptr(l) as usize, "[", "]", |p| {
+                let items = l.read().unwrap_or_else(|e| e.into_inner());
+                p.items(items.iter(), |p, v| p.layout(v))
+            }),
+            Value::Map(m) => self.group(Arc::as_ptr(m) as usize, "{", "}", |p| {
+                let entries = m.read().unwrap_or_else(|e| e.into_inner());
+                p.items(entries.iter(), |p, (k, v)| {
+                    let key = Value::from(k.clone()).repr();
+                    Layout::Entry(format!("{}: ", key), Box::new(p.layout(v)))
+                })
+            }),
+            // variants are shown as they are made, without the names of
+            // their fields
+            Value::Instance(i) if i.of.is_variant() && i.of.fields.is_empty() => {
+                Layout::Text(i.of.name.clone())
+            }
+            Value::Instance(i) if i.of.is_variant() => {
+                let open = format!("{}(", i.of.name);
+                self.group(Arc::as_ptr(i) as usize, &open, ")", |p| {
+                    let fields = i.fields();
+                    p.items(fields.iter(), |p, v| p.layout(v))
+                })
+            }
+            Value::Instance(i) => {
+                let open = format!("{}(", i.of.name);
+                self.group(Arc::as_ptr(i) as usize, &open, ")", |p| {
+                    let fields = i.fields();
+                    p.items(i.of.fields.iter().zip(fields.iter()), |p, (name, v)| {
+                        Layout::Entry(format!("{}: ", name), Box::new(p.layout(v)))
+                    })
+                })
+            }
+            v => Layout::Text(v.to_string()),
+        }
+    }
+
+    /// a container, unless it is one of those being laid out
+    fn group(
+        &mut self,
+        address: usize,
+        open: &str,
+        close: &'static str,
+        items: impl FnOnce(&mut Self) -> Vec<Layout>,
+    ) -> Layout {
+        if self.inside.contains(&address) {
+            return Layout::Text(format!("{}...{}", open, close));
+        }
+        self.inside.push(address);
+        let items = items(self);
+        self.inside.pop();
+        Layout::Group {
+            open: open.to_owned(),
+            items,
+            close,
+        }
+    }
+
+    /// the items laid out, and how many others there are when truncating
+    fn items<T>(
+        &mut self,
+        items: impl ExactSizeIterator<Item = T>,
+        mut layout: impl FnMut(&mut Self, T) -> Layout,
+    ) -> Vec<Layout> {
+        let count = items.len();
+        let mut laid = vec![];
+        for item in items {
+            if self.truncate && (laid.len() == MAX_ITEMS || self.budget == 0) {
+                laid.push(Layout::Text(format!("... {} more", count - laid.len())));
+                break;
+            }
+            laid.push(layout(self, item));
+        }
+        laid
+    }
+
+    fn quoted(&self, s: &str) -> String {
+        match s.char_indices().nth(MAX_CHARS) {
+            Some((end, _)) if self.truncate => format!(
+                "{:?}... {} more characters",
+                &s[..end],
+                s[end..].chars().count()
+            ),
+            _ => format!("{:?}", s),
+        }
+    }
+}
+
+impl Value {
+    /// the representation used when echoing values, on one line, strings
+    /// are quoted
+    pub fn repr(&self) -> String {
+        match self {
+            Value::String(s) => format!("{:?}", s),
+            Value::List(_) | Value::Map(_) | Value::Instance(_) => {
+                let mut out = String::new();
+                Printer::new(false).layout(self).flat(&mut out);
+                out
+            }
+            v => v.to_string(),
+        }
+    }
+
+    /// the value written as in code, for people to read: spread over lines
+    /// when it doesn't fit on one, and cut short when it is huge
+    pub fn inspect(&self) -> String {
+        let mut out = String::new();
+        Printer::new(true).layout(self).pretty(&mut out, 0, 0);
+        out
+    }
+}
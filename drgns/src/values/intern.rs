@@ -0,0 +1,58 @@
+//! Interning of identifiers and short strings.
+//!
+//! Each thread keeps one copy of the short strings it made, and hands out
+//! that copy when the same text is made again, rather than allocating a new
+//! one. Names, symbols, the characters of strings and the numbers shown by
+//! interpolation are made over and over by loops, and are short. Strings
+//! made from an interned copy don't count against `--max-values`, which
+//! limits what a script allocates, only the first copy does.
+//!
+//! Ints, floats, booleans and `none` are held in the value itself, they
+//! never allocate and need no caching.
+//!
+//! The copies are kept until the thread ends, so only strings up to
+//! `MAX_LEN` bytes are interned, and no more than `MAX_STRINGS` of them,
+//! past which strings get a copy of their own again.
+
+use std::{cell::RefCell, collections::HashSet, sync::Arc};
+
+use crate::interpreter::limits;
+
+/// The longest strings interned, in bytes
+pub const MAX_LEN: usize = 32;
+
+/// The most strings a thread interns
+pub const MAX_STRINGS: usize = 1 << 16;
+
+thread_local! {
+    static INTERNED: RefCell<HashSet<Arc<str>>> = RefCell::new(HashSet::new());
+}
+
+/// The copy of a name or symbol shared by the thread
+pub fn intern(s: &str) -> Arc<str> {
+    share(s, || {})
+}
+
+/// The text of a string value, shared by the thread if it is short, a copy
+/// that is made counts as the values the string does
+pub fn string(s: &str) -> Arc<str> {
+    share(s, || limits::allocate(limits::string_values(s.len())))
+}
+
+fn share(s: &str, made: impl FnOnce()) -> Arc<str> {
+    if s.len() > MAX_LEN {
+        made();
+        return s.into();
+    }
+    INTERNED.with_borrow_mut(|interned| {
+        if let Some(shared) = interned.get(s) {
+            return shared.clone();
+        }
+        made();
+        let shared: Arc<str> = s.into();
+        if interned.len() < MAX_STRINGS {
+            interned.insert(shared.clone());
+        }
+        shared
+    })
+}
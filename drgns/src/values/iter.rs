@@ -0,0 +1,252 @@
+//! Iterators, what `for` loops go through. An iterator hands out its items
+//! one at a time, and only works them out when they are asked for, so a
+//! range of a billion ints costs no more than one of ten.
+//!
+//! Functions taking no arguments are iterators too: each call returns the
+//! next item, and `^done` once there are no more. Iterators can be called
+//! the same way, so scripts can step through either.
+//!
+//! Calling a function that yields returns a generator, an iterator running
+//! the body of the function up to each `yield` as the items are asked for.
+
+use std::sync::{Arc, Mutex, MutexGuard};
+
+use crate::{eh::DragonError, interpreter::Halt};
+
+use super::{Channel, List, Value};
+
+/// The symbol returned by an iterator that has no more items
+pub const DONE: &str = "done";
+
+pub fn done() -> Value {
+    Value::symbol(DONE)
+}
+
+pub struct Iter {
+    state: Mutex<State>,
+}
+
+/// The body of a generator, suspended at its last `yield`. Each engine
+/// suspends the functions it runs in its own way.
+pub trait Generator: Send {
+    /// run up to the next `yield`, `None` once the function returns
+    fn resume(&mut self) -> Result<Option<Value>, Halt>;
+}
+
+enum State {
+    /// the next int, the bound it stops before and how much it grows by
+    Range {
+        next: i64,
+        end: i64,
+        step: i64,
+    },
+
+    /// items added to the list while going through it are visited too
+    Items {
+        items: List,
+        index: usize,
+    },
+    Chars {
+        string: Arc<str>,
+        offset: usize,
+    },
+    Bytes {
+        bytes: Arc<[u8]>,
+        index: usize,
+    },
+
+    /// pairs of a count from 0 and the items of another iterator
+    Enumerate {
+        inner: Arc<Iter>,
+        count: i64,
+    },
+
+    /// a function of the script, returning `^done` at the end
+    Function(Value),
+
+    /// the items received until the channel is closed
+    Channel(Arc<Channel>),
+
+    /// taken out while it runs, see `Pending`
+    Generator(Box<dyn Generator>),
+    Running,
+
+    /// functions aren't called again once they are done
+    Done,
+}
+
+/// What `Iter::next` does once the state is unlocked, since calling a
+/// function may step the same iterator again
+enum Pending {
+    Enumerate(Arc<Iter>, i64),
+    Call(Value),
+    Resume(Box<dyn Generator>),
+    Receive(Arc<Channel>),
+}
+
+impl std::fmt::Debug for Iter {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Iter")
+    }
+}
+
+impl Iter {
+    fn new(state: State) -> Arc<Self> {
+        Arc::new(Self {
+            state: Mutex::new(state),
+        })
+    }
+
+    /// the ints from `start` up to, but not including, `end`, counting down
+    /// when the step is negative
+    pub fn range(start: i64, end: i64, step: i64) -> Result<Arc<Self>, String> {
+        if step == 0 {
+            return Err("the step of a range cannot be 0".to_owned());
+        }
+        Ok(Self::new(State::Range {
+            next: start,
+            end,
+            step,
+        }))
+    }
+
+    pub fn enumerate(inner: Arc<Iter>) -> Arc<Self> {
+        Self::new(State::Enumerate { inner, count: 0 })
+    }
+
+    pub fn generator(generator: Box<dyn Generator>) -> Arc<Self> {
+        Self::new(State::Generator(generator))
+    }
+
+    fn lock(&self) -> MutexGuard<'_, State> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// The next item, or `None` once there are no more. Only the engines can
+    /// run functions of the script, so they are run with `call`.
+    pub fn next(
+        &self,
+        call: &mut dyn FnMut(&Value) -> Result<Value, Halt>,
+    ) -> Result<Option<Value>, Halt> {
+        let mut state = self.lock();
+        let pending = match &mut *state {
+            State::Range { next, end, step } => {
+                let more = match *step > 0 {
+                    true => *next < *end,
+                    false => *next > *end,
+                };
+                if !more {
+                    return Ok(None);
+                }
+                let item = *next;
+                // past the largest int there is nothing left to count to
+                *next = next.checked_add(*step).unwrap_or(*end);
+                return Ok(Some(Value::Int(item)));
+            }
+            State::Items { items, index } => {
+                let item = items
+                    .read()
+                    .unwrap_or_else(|e| e.into_inner())
+                    .get(*index)
+                    .cloned();
+                if item.is_some() {
+                    *index += 1;
+                }
+                return Ok(item);
+            }
+            State::Chars { string, offset } => {
+                let Some(c) = string[*offset..].chars().next() else {
+                    return Ok(None);
+                };
+                *offset += c.len_utf8();
+                return Ok(Some(Value::from(c)));
+            }
+            State::Bytes { bytes, index } => {
+                let Some(&b) = bytes.get(*index) else {
+                    return Ok(None);
+                };
+                *index += 1;
+                return Ok(Some(Value::Int(b as i64)));
+            }
+            State::Enumerate { inner, count } => Pending::Enumerate(inner.clone(), *count),
+            State::Function(f) => Pending::Call(f.clone()),
+            State::Channel(c) => Pending::Receive(c.clone()),
+            State::Generator(_) => match std::mem::replace(&mut *state, State::Running) {
+                State::Generator(g) => Pending::Resume(g),
+                _ => crate::assert_unreachable!(),
+            },
+            State::Running => {
+                return Err(Halt::Error(DragonError::runtime(
+                    "a generator cannot go through itself".to_owned(),
+                    None,
+                )))
+            }
+            State::Done => return Ok(None),
+        };
+        drop(state);
+        match pending {
+            Pending::Enumerate(inner, count) => {
+                let Some(item) = inner.next(call)? else {
+                    return Ok(None);
+                };
+                if let State::Enumerate { count, .. } = &mut *self.lock() {
+                    *count += 1;
+                }
+                Ok(Some(Value::list(vec![Value::Int(count), item])))
+            }
+            Pending::Call(f) => {
+                let item = call(&f)?;
+                if matches!(&item, Value::Symbol(s) if &**s == DONE) {
+                    *self.lock() = State::Done;
+                    return Ok(None);
+                }
+                Ok(Some(item))
+            }
+            Pending::Receive(c) => match c.recv() {
+                Value::Symbol(s) if &*s == DONE => {
+                    *self.lock() = State::Done;
+                    Ok(None)
+                }
+                item => Ok(Some(item)),
+            },
+            Pending::Resume(mut g) => {
+                let item = g.resume();
+                *self.lock() = match item {
+                    Ok(Some(_)) => State::Generator(g),
+                    // errors end generators like returning does
+                    _ => State::Done,
+                };
+                item
+            }
+        }
+    }
+}
+
+/// The iterator a `for` loop goes through: the items of a list, the keys of
+/// a map as they were when the loop started, the characters of a string, an
+/// iterator itself, the items returned by a function, or those received
+/// along a channel
+pub fn iterable(value: Value) -> Result<Arc<Iter>, String> {
+    let state = match value {
+        Value::Iterator(i) => return Ok(i),
+        Value::List(items) => State::Items { items, index: 0 },
+        Value::Map(m) => {
+            let keys = m
+                .read()
+                .unwrap_or_else(|e| e.into_inner())
+                .keys()
+                .map(|k| Value::from(k.clone()))
+                .collect();
+            State::Items {
+                items: Arc::new(std::sync::RwLock::new(keys)),
+                index: 0,
+            }
+        }
+        Value::String(string) => State::Chars { string, offset: 0 },
+        Value::Bytes(bytes) => State::Bytes { bytes, index: 0 },
+        f @ (Value::Function(_) | Value::Closure(_) | Value::Native(_)) => State::Function(f),
+        Value::Channel(c) => State::Channel(c),
+        v => return Err(format!("cannot iterate over {}", v.type_name())),
+    };
+    Ok(Iter::new(state))
+}
@@ -0,0 +1,229 @@
+//! Record types declared with `struct`, and their instances.
+//!
+//! A struct is a value like any other: calling it creates an instance with
+//! the fields in the order they are declared. The methods of a struct are
+//! functions of the engine that declared it, they are looked up on the
+//! instance before the functions in scope when called with `.`.
+//!
+//! An enum is made of a struct for each of its variants, named after both,
+//! `Result::Ok`, sharing the methods of the enum. A variant without fields
+//! has a single instance, the enum holds it in place of its struct.
+//!
+//! Methods with some names overload operators, the engines call them when
+//! the operand on the left is an instance having one, see `operator`.
+
+use std::sync::{
+    atomic::{AtomicU64, Ordering},
+    Arc, RwLock, RwLockReadGuard,
+};
+
+use indexmap::IndexMap;
+
+use crate::{
+    interpreter::limits,
+    parser::{BinOperator, UnOperator},
+};
+
+use super::Value;
+
+#[derive(Debug)]
+pub struct Struct {
+    pub name: String,
+    pub fields: Vec<String>,
+
+    /// the functions declared in its body, taking the instance first, in
+    /// the order they are declared
+    pub methods: IndexMap<String, Value>,
+
+    /// set apart from the other structs, for the VM to tell them apart
+    /// without keeping them alive
+    id: u64,
+}
+
+impl Struct {
+    pub fn new(name: String, fields: Vec<String>, methods: IndexMap<String, Value>) -> Self {
+        static IDS: AtomicU64 = AtomicU64::new(1);
+        Self {
+            name,
+            fields,
+            methods,
+            id: IDS.fetch_add(1, Ordering::Relaxed),
+        }
+    }
+
+    /// a number no other struct has, never 0
+    pub fn id(&self) -> u64 {
+        self.id
+    }
+
+    /// whether it is the struct of a variant of an enum, no other can have
+    /// `::` in its name
+    pub fn is_variant(&self) -> bool {
+        self.name.contains("::")
+    }
+}
+
+#[derive(Debug)]
+pub struct Enum {
+    pub name: String,
+
+    /// the struct of each variant, or its instance for those without
+    /// fields, in the order they are declared
+    pub variants: IndexMap<String, Value>,
+}
+
+impl Enum {
+    /// the fields of the variants are `None` for those declared without
+    /// parentheses
+    pub fn new(
+        name: String,
+        variants: Vec<(String, Option<Vec<String>>)>,
+        methods: IndexMap<String, Value>,
+    ) -> Self {
+        let variants = variants.into_iter().map(|(variant, fields)| {
+            let of = Struct::new(
+                format!("{}::{}", name, variant),
+                fields.clone().unwrap_or_default(),
+                methods.clone(),
+            );
+            let value = match fields {
+                Some(_) => Value::Struct(Arc::new(of)),
+                None => Value::Instance(Instance::new(Arc::new(of), vec![])),
+            };
+            (variant, value)
+        });
+        Self {
+            variants: variants.collect(),
+            name,
+        }
+    }
+
+    /// `Name::variant`
+    pub fn variant(&self, name: &str) -> Result<Value, String> {
+        self.variants
+            .get(name)
+            .cloned()
+            .ok_or_else(|| format!("enum {} has no variant '{}'", self.name, name))
+    }
+}
+
+/// Instances are shared like lists, a change made to a field through one
+/// reference is seen through all others
+#[derive(Debug)]
+pub struct Instance {
+    pub of: Arc<Struct>,
+    fields: RwLock<Vec<Value>>,
+}
+
+impl Instance {
+    /// the values are the ones of the fields, in order, the engines check
+    /// that there is one for each
+    pub fn new(of: Arc<Struct>, fields: Vec<Value>) -> Arc<Self> {
+        crate::assert_pre_condition!(fields.len() == of.fields.len());
+        limits::allocate(1 + fields.len());
+        Arc::new(Self {
+            of,
+            fields: RwLock::new(fields),
+        })
+    }
+
+    pub fn fields(&self) -> RwLockReadGuard<'_, Vec<Value>> {
+        self.fields.read().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// update a field by its position among those of the struct
+    pub fn set(&self, position: usize, value: Value) {
+        self.fields.write().unwrap_or_else(|e| e.into_inner())[position] = value;
+    }
+
+    /// the position of a field among those of the struct
+    pub fn position(&self, name: &str) -> Result<usize, String> {
+        self.of
+            .fields
+            .iter()
+            .position(|f| f == name)
+            .ok_or_else(|| no_field(&self.of.name, name))
+    }
+}
+
+/// the message of the error raised for a missing field
+pub fn no_field(type_name: &str, name: &str) -> String {
+    format!("{} has no field '{}'", type_name, name)
+}
+
+/// `target.name`
+pub fn field(target: &Value, name: &str) -> Result<Value, String> {
+    match target {
+        Value::Instance(i) => {
+            let position = i.position(name)?;
+            Ok(i.fields()[position].clone())
+        }
+        v => Err(no_field(&v.type_name(), name)),
+    }
+}
+
+/// `target.name = value`
+pub fn set_field(target: &Value, name: &str, value: Value) -> Result<(), String> {
+    match target {
+        Value::Instance(i) => {
+            i.set(i.position(name)?, value);
+            Ok(())
+        }
+        v => Err(no_field(&v.type_name(), name)),
+    }
+}
+
+/// the method `receiver.name(...)` calls, if the receiver is an instance of
+/// a struct declaring one
+pub fn method(receiver: &Value, name: &str) -> Option<Value> {
+    match receiver {
+        Value::Instance(i) => i.of.methods.get(name).cloned(),
+        _ => None,
+    }
+}
+
+/// the method `target[index]` calls, and the one `target[index] = value`
+/// calls with the value
+pub const INDEX: &str = "index";
+pub const SET_INDEX: &str = "set_index";
+
+/// The name of the method overloading a binary operator, `!=` calls `eq`
+/// and negates what it returns. The short-circuiting operators, `in` and
+/// the bitwise ones can't be overloaded.
+pub fn operator(op: BinOperator) -> Option<&'static str> {
+    use BinOperator as Op;
+    Some(match op {
+        Op::Add => "add",
+        Op::Sub => "sub",
+        Op::Mul => "mul",
+        Op::Div => "div",
+        Op::Mod => "mod",
+        Op::Pow => "pow",
+        Op::Concat => "concat",
+        Op::Eq | Op::Ne => "eq",
+        Op::Lt => "lt",
+        Op::Le => "le",
+        Op::Gt => "gt",
+        Op::Ge => "ge",
+        _ => return None,
+    })
+}
+
+/// The name of the method overloading a unary operator, `to_string` is what
+/// interpolation and `print` show an instance as
+pub fn unary_operator(op: UnOperator) -> Option<&'static str> {
+    match op {
+        UnOperator::Neg => Some("neg"),
+        UnOperator::Str => Some("to_string"),
+        UnOperator::Not | UnOperator::BitNot => None,
+    }
+}
+
+/// the method overloading the binary operator for the operand on the left
+pub fn overload(op: BinOperator, lhs: &Value) -> Option<Value> {
+    method(lhs, operator(op)?)
+}
+
+pub fn unary_overload(op: UnOperator, rhs: &Value) -> Option<Value> {
+    method(rhs, unary_operator(op)?)
+}
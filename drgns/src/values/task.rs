@@ -0,0 +1,97 @@
+//! Tasks, calls running on threads of their own while the code that spawned
+//! them goes on. `spawn f(x)` starts one and is its handle, `await` waits
+//! for it to finish.
+//!
+//! Nothing waits for tasks that are still running when the script ends: the
+//! program stops with it, and so do they, wherever they are.
+
+use std::{
+    panic::{self, AssertUnwindSafe},
+    sync::{Arc, Condvar, Mutex},
+    thread,
+};
+
+use crate::{
+    eh::DragonError,
+    interpreter::{builtins::sync::release_held, deterministic, io, limits, sandbox, Halt},
+};
+
+use super::Value;
+
+pub struct Task {
+    /// what the call returned or the error it stopped with, once it is done
+    outcome: Mutex<Option<Result<Value, Halt>>>,
+    finished: Condvar,
+}
+
+impl std::fmt::Debug for Task {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "Task(done: {})", self.is_done())
+    }
+}
+
+impl Task {
+    /// Run the call on a new thread. Each engine runs it in an instance of
+    /// its own over the same modules.
+    pub fn spawn(
+        call: impl FnOnce() -> Result<Value, Halt> + Send + 'static,
+    ) -> Result<Arc<Self>, String> {
+        let task = Arc::new(Self {
+            outcome: Mutex::new(None),
+            finished: Condvar::new(),
+        });
+        let handle = task.clone();
+        // the task counts against the limits of the code that spawned it,
+        // and is in its sandbox and deterministic run, writing to its `Io`
+        let budget = limits::budget();
+        let sandbox = sandbox::current();
+        let io = io::current();
+        let run = deterministic::current();
+        thread::Builder::new()
+            .name("task".to_string())
+            .stack_size(limits::limits().stack_size())
+            .spawn(move || {
+                let _limits = limits::share(budget);
+                let _sandbox = sandbox::enforce(sandbox);
+                let _io = io::install(io);
+                let _run = deterministic::install(run);
+                // a bug of the engine must not leave those awaiting the task
+                // waiting forever
+                let outcome = panic::catch_unwind(AssertUnwindSafe(call)).unwrap_or_else(|_| {
+                    Err(Halt::Error(DragonError::runtime(
+                        "the task stopped unexpectedly".to_string(),
+                        None,
+                    )))
+                });
+                release_held();
+                *handle.lock() = Some(outcome);
+                handle.finished.notify_all();
+            })
+            .map_err(|e| format!("spawn could not start a task: {}", e))?;
+        Ok(task)
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, Option<Result<Value, Halt>>> {
+        self.outcome.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Wait for the call to finish, the same outcome is returned every time
+    pub fn join(&self) -> Result<Value, Halt> {
+        let mut outcome = self.lock();
+        loop {
+            match &*outcome {
+                Some(o) => return o.clone(),
+                None => {
+                    outcome = self
+                        .finished
+                        .wait(outcome)
+                        .unwrap_or_else(|e| e.into_inner())
+                }
+            }
+        }
+    }
+
+    pub fn is_done(&self) -> bool {
+        self.lock().is_some()
+    }
+}
@@ -0,0 +1,159 @@
+//! What `drgns version` tells about the installation: its version and, with
+//! `--verbose`, what it was built from, the engines and standard modules it
+//! has and the limits scripts run with unless told otherwise. As JSON, for
+//! tools to check what an installation can do:
+//!
+//! ```json
+//! {
+//!   "version": "0.1.0",
+//!   "commit": "34e8329a1f...",
+//!   "rustc": "rustc 1.80.0 (051478957 2024-07-21)",
+//!   "target": "x86_64-unknown-linux-gnu",
+//!   "engines": ["vm", "walk"],
+//!   "default_engine": "vm",
+//!   "modules": ["bytes", "errors", "..."],
+//!   "limits": {"steps": null, "values": null, "depth": 1000}
+//! }
+//! ```
+//!
+//! The commit, the compiler and the target are recorded by the build script,
+//! and are `null` when it couldn't tell, such as for a build outside of a
+//! git checkout.
+
+use clap::ValueEnum;
+use drgns::{interpreter::MODULES, Engine, Limits};
+use serde::Serialize;
+
+/// How the version is printed
+#[derive(ValueEnum, Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Format {
+    /// a line, or a line for each piece with `--verbose`
+    #[default]
+    Text,
+
+    /// everything as a JSON object, `--verbose` or not
+    Json,
+}
+
+/// What the installation is
+#[derive(Serialize, Debug)]
+struct Info {
+    version: &'static str,
+    commit: Option<&'static str>,
+    rustc: Option<&'static str>,
+    target: Option<&'static str>,
+    engines: Vec<String>,
+    default_engine: String,
+    modules: Vec<&'static str>,
+    limits: DefaultLimits,
+}
+
+/// The limits of `Limits::default`, `None` for none
+#[derive(Serialize, Debug)]
+struct DefaultLimits {
+    steps: Option<u64>,
+    values: Option<u64>,
+    depth: usize,
+}
+
+fn name(engine: Engine) -> String {
+    engine
+        .to_possible_value()
+        .map_or(format!("{:?}", engine), |v| v.get_name().to_owned())
+}
+
+fn info() -> Info {
+    let limits = Limits::default();
+    Info {
+        version: env!("CARGO_PKG_VERSION"),
+        commit: option_env!("DRGNS_COMMIT"),
+        rustc: option_env!("DRGNS_RUSTC"),
+        target: option_env!("DRGNS_TARGET"),
+        engines: Engine::value_variants().iter().copied().map(name).collect(),
+        default_engine: name(Engine::default()),
+        modules: MODULES.iter().map(|(name, ..)| *name).collect(),
+        limits: DefaultLimits {
+            steps: limits.steps,
+            values: limits.values,
+            depth: limits.depth,
+        },
+    }
+}
+
+/// The version as `drgns version` prints it
+pub fn render(verbose: bool, format: Format) -> String {
+    let info = info();
+    if format == Format::Json {
+        // the info only holds strings and numbers
+        return serde_json::to_string_pretty(&info).unwrap_or_default();
+    }
+    let version = format!("drgns {}", info.version);
+    if !verbose {
+        return version;
+    }
+    let unknown = |s: Option<&str>| s.unwrap_or("unknown").to_owned();
+    let limit = |l: Option<u64>| l.map_or("none".to_owned(), |l| l.to_string());
+    let engines = info
+        .engines
+        .iter()
+        .map(|e| match *e == info.default_engine {
+            true => format!("{} (default)", e),
+            false => e.clone(),
+        });
+    let lines = [
+        version,
+        format!("commit:  {}", unknown(info.commit)),
+        format!("rustc:   {}", unknown(info.rustc)),
+        format!("target:  {}", unknown(info.target)),
+        format!("engines: {}", engines.collect::<Vec<_>>().join(", ")),
+        format!("modules: {}", info.modules.join(", ")),
+        format!(
+            "limits:  {} steps, {} values, calls {} deep",
+            limit(info.limits.steps),
+            limit(info.limits.values),
+            info.limits.depth
+        ),
+    ];
+    lines.join("\n")
+}
+
+#[cfg(test)]
+mod test {
+    use serde_json::Value as Json;
+
+    use super::{render, Format};
+
+    #[test]
+    fn text() {
+        let short = render(false, Format::Text);
+        assert_eq!(short, format!("drgns {}", env!("CARGO_PKG_VERSION")));
+        let verbose = render(true, Format::Text);
+        assert!(verbose.starts_with(&format!("{}\ncommit:  ", short)));
+        assert!(verbose.contains("\nengines: vm (default), walk\n"));
+        assert!(verbose.contains("\nmodules: bytes, errors, "));
+        assert!(verbose.ends_with("\nlimits:  none steps, none values, calls 1000 deep"));
+    }
+
+    #[test]
+    fn json() {
+        let info: Json =
+            serde_json::from_str(&render(false, Format::Json)).expect("the version is JSON");
+        let verbose: Json =
+            serde_json::from_str(&render(true, Format::Json)).expect("the version is JSON");
+        assert_eq!(info, verbose);
+        assert_eq!(info["version"], env!("CARGO_PKG_VERSION"));
+        assert_eq!(info["engines"], serde_json::json!(["vm", "walk"]));
+        assert_eq!(info["default_engine"], "vm");
+        assert!(info["modules"]
+            .as_array()
+            .expect("the modules are a list")
+            .contains(&"math".into()));
+        assert_eq!(
+            info["limits"],
+            serde_json::json!({ "steps": null, "values": null, "depth": 1000 })
+        );
+        for key in ["commit", "rustc", "target"] {
+            assert!(info[key].is_string() || info[key].is_null(), "{}", key);
+        }
+    }
+}
@@ -0,0 +1,952 @@
+//! Stack-based virtual machine, executes the bytecode produced by the
+//! compiler.
+//!
+//! Errors are reported with the same messages as the tree-walking
+//! interpreter, so that the two engines can be tested against each other.
+
+use std::sync::{Arc, RwLock};
+
+use indexmap::IndexMap;
+
+use crate::{
+    bytecode::{Capture, Cell, Closure, Op, Prototype},
+    eh::{DragonError, ErrorCode},
+    interpreter::{
+        self, builtins, coverage, interrupt, limits, profile,
+        trace::{self, Trace},
+        Env, Environment, Halt,
+    },
+    modules::{self, Bundle, Loader},
+    parser::{Arity, BinOperator, Program, UnOperator},
+    source::{Source, SourceString},
+    values::{self, Generator, Iter, Key, Task, Value},
+};
+
+pub mod cache;
+#[cfg(test)]
+mod test;
+
+/// Compile and run a program in a fresh VM
+pub fn eval(program: &Program) -> Result<Value, Halt> {
+    Vm::new().run(crate::compiler::compile(program))
+}
+
+/// VM state, like the interpreter the globals persist across runs.
+pub struct Vm {
+    globals: Env,
+    loader: Arc<Loader>,
+}
+
+/// Compile and run the source of an imported module, see
+/// `modules::Evaluator`, loading its bytecode from the cache when it was
+/// compiled before
+fn module(source: &Arc<Source>, loader: &Arc<Loader>) -> Result<Env, Halt> {
+    let script = match loader.compiled(source) {
+        Some(script) => script,
+        None => modules::cache::compile(source, modules::cache::directory().as_deref())?,
+    };
+    let mut vm = Vm::with_loader(loader.clone());
+    vm.run(script)?;
+    Ok(vm.globals)
+}
+
+impl Default for Vm {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// call frames only exist while their function runs, this is the state they
+/// keep besides the stack
+struct Frame {
+    closure: Arc<Closure>,
+    slots: Vec<Value>,
+
+    /// whether the call left the parameter of each slot to its default,
+    /// empty if it left none
+    missing: Vec<bool>,
+    cells: Vec<Cell>,
+    stack: Vec<Value>,
+    ip: usize,
+    handlers: Vec<Handler>,
+
+    /// the closures of `defer`, run last first once the frame stops running
+    deferred: Vec<Arc<Closure>>,
+
+    /// counts the frame among the calls nested on the thread, the frames of
+    /// scripts and generators aren't
+    nested: Option<limits::Nested>,
+
+    /// the line and the offset of the last instruction traced, for telling
+    /// the statements apart when tracing them
+    traced: Option<(usize, usize)>,
+}
+
+/// How a frame stops running, without an error
+enum Done {
+    Return(Value),
+
+    /// only the frames of generators yield, they run again when resumed
+    Yield(Value),
+
+    /// the frame is taken over by a call, with its arguments and where it
+    /// was made
+    TailCall(Arc<Closure>, Vec<Option<Value>>, Option<SourceString>),
+}
+
+/// installed by `Op::Try`
+struct Handler {
+    /// where the code handling the error starts
+    target: usize,
+
+    /// the height of the stack when the handler was installed
+    height: usize,
+}
+
+fn new_cell(value: Value) -> Cell {
+    Arc::new(RwLock::new(value))
+}
+
+fn read(cell: &Cell) -> Value {
+    cell.read().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+fn write(cell: &Cell, value: Value) {
+    *cell.write().unwrap_or_else(|e| e.into_inner()) = value;
+}
+
+impl Vm {
+    pub fn new() -> Self {
+        Self::with_loader(Loader::new(module))
+    }
+
+    /// share the modules loaded by another VM
+    pub fn with_loader(loader: Arc<Loader>) -> Self {
+        let builtins = Environment::global();
+        builtins::register(&builtins);
+        Self {
+            globals: Environment::child(&builtins),
+            loader,
+        }
+    }
+
+    pub fn globals(&self) -> &Env {
+        &self.globals
+    }
+
+    /// the modules loaded by the scripts run
+    pub fn loader(&self) -> &Arc<Loader> {
+        &self.loader
+    }
+
+    /// Run a compiled script, the value is the one of the last statement.
+    /// Run the program of a bundle, the modules it imports are the ones of
+    /// the bundle
+    pub fn run_bundle(&mut self, bundle: Arc<Bundle>) -> Result<Value, Halt> {
+        let program = bundle.program();
+        self.loader = Loader::bundled(module, bundle);
+        self.run(program)
+    }
+
+    pub fn run(&mut self, script: Arc<Prototype>) -> Result<Value, Halt> {
+        let closure = Closure {
+            prototype: script,
+            free: vec![],
+        };
+        self.execute(Arc::new(closure), vec![], None)
+    }
+
+    /// Call a function of the scripts from outside of them, as the host does
+    pub fn call_function(
+        &mut self,
+        closure: Arc<Closure>,
+        arguments: Vec<Value>,
+    ) -> Result<Value, Halt> {
+        self.call(Value::Closure(closure), arguments, None)
+    }
+
+    /// run a closure until it returns, `nested` counts it as a call
+    fn execute(
+        &mut self,
+        closure: Arc<Closure>,
+        arguments: Vec<Option<Value>>,
+        nested: Option<limits::Nested>,
+    ) -> Result<Value, Halt> {
+        let mut frame = Frame::new(closure, arguments);
+        frame.nested = nested;
+        match self.resume(&mut frame)? {
+            Done::Return(value) => Ok(value),
+            _ => crate::assert_unreachable!(),
+        }
+    }
+
+    /// Run a frame until it yields, or until it returns or raises an error
+    /// and the code it deferred ran
+    fn resume(&mut self, frame: &mut Frame) -> Result<Done, Halt> {
+        match self.run_frame(frame) {
+            Ok(Done::Yield(item)) => Ok(Done::Yield(item)),
+            result => self.undefer(frame, result),
+        }
+    }
+
+    /// Run the closures deferred by a frame, last deferred first. An error
+    /// raised by one replaces the outcome of the frame, `exit` and
+    /// interrupts skip what is left.
+    fn undefer(&mut self, frame: &mut Frame, mut result: Result<Done, Halt>) -> Result<Done, Halt> {
+        while let Some(closure) = frame.deferred.pop() {
+            let stopped = match &result {
+                Err(Halt::Exit(_)) => true,
+                Err(Halt::Error(e)) => interrupt::is_interrupt(e),
+                _ => false,
+            };
+            if stopped {
+                break;
+            }
+            if let Err(h) = self.call(Value::Closure(closure), vec![], None) {
+                result = Err(h);
+            }
+        }
+        result
+    }
+
+    /// Run a frame until it returns, yields or raises an error. Tail calls
+    /// replace the frame, the frames they replace are left out of the stack
+    /// of errors: the function running is shown as called where the last
+    /// tail call was made.
+    fn run_frame(&mut self, frame: &mut Frame) -> Result<Done, Halt> {
+        let mut tail_call = None;
+        loop {
+            match self.dispatch(frame) {
+                Ok(Done::TailCall(closure, arguments, span)) => {
+                    // the call takes over the place of the frame, or nests
+                    // if the frame didn't count as one
+                    let nested = match frame.nested.take() {
+                        Some(nested) => {
+                            profile::replace(&closure.prototype.name);
+                            trace::replace(&closure.prototype.name);
+                            nested
+                        }
+                        None => limits::enter(&closure.prototype.name).map_err(|msg| {
+                            Halt::Error(DragonError::new(
+                                ErrorCode::LimitExceeded,
+                                msg,
+                                span.clone(),
+                            ))
+                        })?,
+                    };
+                    *frame = Frame::new(closure, arguments);
+                    frame.nested = Some(nested);
+                    tail_call = Some(span);
+                }
+                Ok(done) => return Ok(done),
+                Err(Halt::Error(e)) => {
+                    // an interrupt stops the program right away
+                    let handler = match interrupt::is_interrupt(&e) {
+                        true => None,
+                        false => frame.handlers.pop(),
+                    };
+                    let Some(handler) = handler else {
+                        let e = match tail_call {
+                            Some(span) => e.with_frame(&frame.closure.prototype.name, span),
+                            None => e,
+                        };
+                        return Err(Halt::Error(e));
+                    };
+                    frame.stack.truncate(handler.height);
+                    frame.stack.push(Value::Error(Arc::new(e)));
+                    frame.ip = handler.target;
+                }
+                Err(h) => return Err(h),
+            }
+        }
+    }
+
+    /// run the frame until it returns, yields or raises an error
+    fn dispatch(&mut self, frame: &mut Frame) -> Result<Done, Halt> {
+        let chunk = &frame.closure.prototype.chunk;
+        let stack = &mut frame.stack;
+        loop {
+            let op = chunk.code[frame.ip];
+            let at = frame.ip;
+            if interrupt::pending() {
+                return Err(Halt::Error(interrupt::error(
+                    chunk.source_map.nearest_span(at).cloned(),
+                )));
+            }
+            if let Err(msg) = limits::step() {
+                return Err(Halt::Error(DragonError::new(
+                    ErrorCode::LimitExceeded,
+                    msg,
+                    chunk.source_map.nearest_span(at).cloned(),
+                )));
+            }
+            if coverage::enabled() {
+                if let Some(span) = chunk.source_map.span(at) {
+                    coverage::hit(span);
+                }
+            }
+            match trace::current() {
+                None => {}
+                Some(Trace::Vm) => trace::instruction(&frame.closure.prototype.name, chunk, at),
+                Some(Trace::Statements) => {
+                    if let Some(span) = chunk.source_map.span(at) {
+                        let line = span.position().line;
+                        if frame.traced.is_none_or(|(l, ip)| l != line || at <= ip) {
+                            trace::statement(span);
+                        }
+                        frame.traced = Some((line, at));
+                    }
+                }
+            }
+            frame.ip += 1;
+            let error = |code, msg| {
+                Halt::Error(DragonError::new(
+                    code,
+                    msg,
+                    chunk.source_map.span(at).cloned(),
+                ))
+            };
+            match op {
+                Op::Constant(i) => stack.push(chunk.constants[i as usize].clone()),
+                Op::None => stack.push(Value::None),
+                Op::True => stack.push(Value::Bool(true)),
+                Op::False => stack.push(Value::Bool(false)),
+                Op::Pop => {
+                    stack.pop();
+                }
+                Op::PopN(n) => stack.truncate(stack.len() - n as usize),
+                Op::Slide(n) => {
+                    let top = pop(stack);
+                    stack.truncate(stack.len() - n as usize);
+                    stack.push(top);
+                }
+                Op::Duplicate(n) => stack.extend_from_within(stack.len() - n as usize..),
+                Op::GetLocal(i) => stack.push(frame.slots[i as usize].clone()),
+                Op::SetLocal(i) => frame.slots[i as usize] = pop(stack),
+                Op::NewCell(i) => frame.cells[i as usize] = new_cell(Value::None),
+                Op::MakeCell(i) => frame.cells[i as usize] = new_cell(pop(stack)),
+                Op::GetCell(i) => stack.push(read(&frame.cells[i as usize])),
+                Op::SetCell(i) => write(&frame.cells[i as usize], pop(stack)),
+                Op::GetFree(i) => stack.push(read(&frame.closure.free[i as usize])),
+                Op::SetFree(i) => write(&frame.closure.free[i as usize], pop(stack)),
+                Op::GetGlobal(n) => {
+                    let name = &chunk.names[n as usize];
+                    match cache::global(chunk, at, &self.globals, name) {
+                        Some(value) => stack.push(value),
+                        None => return Err(error(ErrorCode::UndefinedVariable, undefined(name))),
+                    }
+                }
+                Op::SetGlobal(n) => {
+                    let name = &chunk.names[n as usize];
+                    match cache::binding(chunk, at, &self.globals, name) {
+                        Some(b) if b.is_mutable() => b.set(pop(stack)),
+                        Some(_) => {
+                            return Err(error(
+                                ErrorCode::ImmutableAssignment,
+                                format!("cannot assign twice to immutable variable '{}'", name),
+                            ))
+                        }
+                        None => return Err(error(ErrorCode::UndefinedVariable, undefined(name))),
+                    }
+                }
+                Op::DefineGlobal(n, mutable) => {
+                    let value = pop(stack);
+                    self.globals
+                        .define(&chunk.names[n as usize], value, mutable);
+                }
+                Op::Import(i) => {
+                    let module = self.loader.import(&chunk.imports[i as usize])?;
+                    stack.push(module);
+                }
+                Op::Member(n) => {
+                    let module = pop(stack);
+                    let name = &chunk.names[n as usize];
+                    let value = modules::member(module, name, chunk.source_map.span(at).cloned())
+                        .map_err(Halt::Error)?;
+                    stack.push(value);
+                }
+                Op::GetField(n) => {
+                    let target = pop(stack);
+                    let name = &chunk.names[n as usize];
+                    let value = match &target {
+                        Value::Instance(i) => cache::field(chunk, at, i, name)
+                            .map(|position| i.fields()[position].clone()),
+                        target => values::field(target, name),
+                    };
+                    stack.push(value.map_err(|msg| error(ErrorCode::UnknownField, msg))?);
+                }
+                Op::SetField(n) => {
+                    let value = pop(stack);
+                    let target = pop(stack);
+                    let name = &chunk.names[n as usize];
+                    match &target {
+                        Value::Instance(i) => {
+                            cache::field(chunk, at, i, name).map(|position| i.set(position, value))
+                        }
+                        target => values::set_field(target, name, value),
+                    }
+                    .map_err(|msg| error(ErrorCode::UnknownField, msg))?;
+                }
+                Op::Method(n, fallback) => {
+                    let receiver = pop(stack);
+                    let name = &chunk.names[n as usize];
+                    let fallback = match fallback {
+                        true => Some(pop(stack)),
+                        false => None,
+                    };
+                    let method = match &receiver {
+                        Value::Instance(i) => cache::method(chunk, at, &i.of, name),
+                        _ => None,
+                    };
+                    let callee = match method.or(fallback) {
+                        Some(callee) => callee,
+                        None => match self.globals.get(name) {
+                            Some(f) => f,
+                            None => {
+                                return Err(error(ErrorCode::UndefinedVariable, undefined(name)))
+                            }
+                        },
+                    };
+                    stack.push(callee);
+                    stack.push(receiver);
+                }
+                Op::Binary(op) => {
+                    let rhs = pop(stack);
+                    let lhs = pop(stack);
+                    let value = match values::overload(op, &lhs) {
+                        Some(method) => {
+                            let span = chunk.source_map.span(at).cloned();
+                            let result = self.call(method, vec![lhs, rhs], span)?;
+                            match op {
+                                BinOperator::Ne => Value::Bool(!result.is_truthy()),
+                                _ => result,
+                            }
+                        }
+                        None => values::binary(op, lhs, rhs)
+                            .map_err(|msg| error(ErrorCode::Runtime, msg))?,
+                    };
+                    stack.push(value);
+                }
+                Op::Unary(op) => {
+                    let mut rhs = pop(stack);
+                    if let Some(method) = values::unary_overload(op, &rhs) {
+                        let span = chunk.source_map.span(at).cloned();
+                        let result = self.call(method, vec![rhs], span)?;
+                        // interpolation makes a string of whatever
+                        // `to_string` returns
+                        if op != UnOperator::Str {
+                            stack.push(result);
+                            continue;
+                        }
+                        rhs = result;
+                    }
+                    let value =
+                        values::unary(op, rhs).map_err(|msg| error(ErrorCode::Runtime, msg))?;
+                    stack.push(value);
+                }
+                Op::ToBool => {
+                    let value = pop(stack);
+                    stack.push(Value::Bool(value.is_truthy()));
+                }
+                Op::List(n) => {
+                    let items = stack.split_off(stack.len() - n as usize);
+                    stack.push(Value::list(items));
+                }
+                Op::Map(n) => {
+                    let values = stack.split_off(stack.len() - 2 * n as usize);
+                    let mut entries = IndexMap::with_capacity(n as usize);
+                    for pair in values.chunks(2) {
+                        let key = Key::try_from(&pair[0])
+                            .map_err(|msg| error(ErrorCode::Runtime, msg))?;
+                        entries.insert(key, pair[1].clone());
+                    }
+                    stack.push(Value::map(entries));
+                }
+                Op::Index => {
+                    let index = pop(stack);
+                    let target = pop(stack);
+                    let value = match values::method(&target, values::INDEX) {
+                        Some(method) => {
+                            let span = chunk.source_map.span(at).cloned();
+                            self.call(method, vec![target, index], span)?
+                        }
+                        None => values::index(&target, &index)
+                            .map_err(|msg| error(ErrorCode::Runtime, msg))?,
+                    };
+                    stack.push(value);
+                }
+                Op::Slice => {
+                    let step = pop(stack);
+                    let end = pop(stack);
+                    let start = pop(stack);
+                    let target = pop(stack);
+                    let value = values::slice(&target, start, end, step)
+                        .map_err(|msg| error(ErrorCode::Runtime, msg))?;
+                    stack.push(value);
+                }
+                Op::SetIndex => {
+                    let value = pop(stack);
+                    let index = pop(stack);
+                    let target = pop(stack);
+                    match values::method(&target, values::SET_INDEX) {
+                        Some(method) => {
+                            let span = chunk.source_map.span(at).cloned();
+                            self.call(method, vec![target, index, value], span)?;
+                        }
+                        None => values::set_index(&target, &index, value)
+                            .map_err(|msg| error(ErrorCode::Runtime, msg))?,
+                    }
+                }
+                Op::Iter => {
+                    let items = values::iterable(pop(stack))
+                        .map_err(|msg| error(ErrorCode::Runtime, msg))?;
+                    stack.push(Value::Iterator(items));
+                }
+                Op::Iterate(t) => {
+                    let Some(Value::Iterator(items)) = stack.last() else {
+                        crate::assert_unreachable!();
+                    };
+                    let items = items.clone();
+                    match self.next(&items, chunk.source_map.span(at))? {
+                        Some(item) => stack.push(item),
+                        None => frame.ip = t as usize,
+                    }
+                }
+                Op::Match(p, t) => {
+                    let mut bound = vec![];
+                    let subject = stack.last().expect("the subject is on the stack");
+                    match interpreter::destructure(&chunk.patterns[p as usize], subject, &mut bound)
+                    {
+                        true => stack.push(Value::list(bound)),
+                        false => frame.ip = t as usize,
+                    }
+                }
+                Op::Unpack(n) => {
+                    let Value::List(items) = pop(stack) else {
+                        crate::assert_unreachable!();
+                    };
+                    let items = items.read().unwrap_or_else(|e| e.into_inner());
+                    debug_assert_eq!(items.len(), n as usize);
+                    stack.extend(items.iter().cloned());
+                }
+                Op::Unmatched => {
+                    let subject = pop(stack);
+                    return Err(error(ErrorCode::Runtime, interpreter::unmatched(&subject)));
+                }
+                Op::Destructure(p) => {
+                    let pattern = &chunk.patterns[p as usize];
+                    let value = pop(stack);
+                    let mut bound = vec![];
+                    if !interpreter::destructure(pattern, &value, &mut bound) {
+                        let msg = interpreter::undestructured(pattern, &value);
+                        return Err(error(ErrorCode::Runtime, msg));
+                    }
+                    stack.push(Value::list(bound));
+                }
+                Op::Jump(t) => frame.ip = t as usize,
+                Op::JumpIfFalse(t) => {
+                    if !pop(stack).is_truthy() {
+                        frame.ip = t as usize;
+                    }
+                }
+                Op::JumpIfTrue(t) => {
+                    if pop(stack).is_truthy() {
+                        frame.ip = t as usize;
+                    }
+                }
+                Op::JumpIfNone(t) => {
+                    if matches!(stack.last(), Some(Value::None)) {
+                        frame.ip = t as usize;
+                    }
+                }
+                Op::JumpIfNotNone(t) => {
+                    if !matches!(stack.last(), Some(Value::None)) {
+                        frame.ip = t as usize;
+                    }
+                }
+                Op::Closure(i) => {
+                    let prototype = chunk.functions[i as usize].clone();
+                    let free = prototype
+                        .captures
+                        .iter()
+                        .map(|c| match c {
+                            Capture::Cell(i) => frame.cells[*i as usize].clone(),
+                            Capture::Free(i) => frame.closure.free[*i as usize].clone(),
+                        })
+                        .collect();
+                    stack.push(Value::Closure(Arc::new(Closure { prototype, free })));
+                }
+                Op::Struct(i, n) => {
+                    let layout = &chunk.structs[i as usize];
+                    let closures = stack.split_off(stack.len() - n as usize);
+                    let methods = layout.methods.iter().cloned().zip(closures);
+                    stack.push(Value::Struct(Arc::new(values::Struct::new(
+                        layout.name.clone(),
+                        layout.fields.clone(),
+                        methods.collect(),
+                    ))));
+                }
+                Op::Enum(i, n) => {
+                    let layout = &chunk.structs[i as usize];
+                    let closures = stack.split_off(stack.len() - n as usize);
+                    let methods = layout.methods.iter().cloned().zip(closures);
+                    stack.push(Value::Enum(Arc::new(values::Enum::new(
+                        layout.name.clone(),
+                        layout.variants.clone(),
+                        methods.collect(),
+                    ))));
+                }
+                Op::Call(argc) => {
+                    let arguments = stack.split_off(stack.len() - argc as usize);
+                    let callee = pop(stack);
+                    let span = chunk.source_map.span(at).cloned();
+                    stack.push(self.call(callee, arguments, span)?);
+                }
+                Op::CallNamed(argc, i) => {
+                    let (arguments, named) = named(stack, argc, &chunk.named[i as usize]);
+                    let callee = pop(stack);
+                    let span = chunk.source_map.span(at).cloned();
+                    stack.push(self.call_named(callee, arguments, named, span)?);
+                }
+                Op::TailCall(argc) | Op::TailCallNamed(argc, _) => {
+                    let names = match op {
+                        Op::TailCallNamed(_, i) => &chunk.named[i as usize][..],
+                        _ => &[],
+                    };
+                    let (arguments, named) = named(stack, argc, names);
+                    let callee = pop(stack);
+                    let span = chunk.source_map.span(at).cloned();
+                    match callee {
+                        // errors must still reach the handlers of the frame,
+                        // and the code it deferred run after the call
+                        Value::Closure(c)
+                            if frame.handlers.is_empty()
+                                && frame.deferred.is_empty()
+                                && !c.prototype.generator =>
+                        {
+                            let arguments = bound(&c.prototype, arguments, named, &span)?;
+                            return Ok(Done::TailCall(c, arguments, span));
+                        }
+                        callee => {
+                            let value = self.call_named(callee, arguments, named, span)?;
+                            return Ok(Done::Return(value));
+                        }
+                    }
+                }
+                Op::Spawn(argc) => {
+                    let arguments = stack.split_off(stack.len() - argc as usize);
+                    let callee = pop(stack);
+                    let span = chunk.source_map.span(at).cloned();
+                    stack.push(self.spawn(callee, arguments, vec![], span)?);
+                }
+                Op::SpawnNamed(argc, i) => {
+                    let (arguments, named) = named(stack, argc, &chunk.named[i as usize]);
+                    let callee = pop(stack);
+                    let span = chunk.source_map.span(at).cloned();
+                    stack.push(self.spawn(callee, arguments, named, span)?);
+                }
+                Op::Given(slot, t) => {
+                    if !frame.missing.get(slot as usize).is_some_and(|&m| m) {
+                        frame.ip = t as usize;
+                    }
+                }
+                Op::Return => return Ok(Done::Return(pop(stack))),
+                Op::Yield => {
+                    let item = pop(stack);
+                    stack.push(Value::None);
+                    return Ok(Done::Yield(item));
+                }
+                Op::Exit => {
+                    return match interpreter::exit_code(pop(stack)) {
+                        Ok(code) => Err(Halt::Exit(code)),
+                        Err(msg) => Err(error(ErrorCode::Runtime, msg)),
+                    }
+                }
+                Op::Fail(i) => {
+                    let (code, msg) = chunk.errors[i as usize].clone();
+                    return Err(error(code, msg));
+                }
+                Op::Throw => {
+                    let value = pop(stack);
+                    return Err(Halt::Error(interpreter::thrown(
+                        value,
+                        chunk.source_map.span(at).cloned(),
+                    )));
+                }
+                Op::Defer => match pop(stack) {
+                    Value::Closure(c) => frame.deferred.push(c),
+                    _ => crate::assert_unreachable!(),
+                },
+                Op::Try(target) => frame.handlers.push(Handler {
+                    target: target as usize,
+                    height: stack.len(),
+                }),
+                Op::EndTry => {
+                    frame.handlers.pop();
+                }
+            }
+        }
+    }
+
+    fn call(
+        &mut self,
+        callee: Value,
+        arguments: Vec<Value>,
+        span: Option<SourceString>,
+    ) -> Result<Value, Halt> {
+        self.call_named(callee, arguments, vec![], span)
+    }
+
+    /// call with arguments given by name too, after the others, only
+    /// closures and structs have names for their parameters
+    fn call_named(
+        &mut self,
+        callee: Value,
+        arguments: Vec<Value>,
+        named: Vec<(Arc<str>, Value)>,
+        span: Option<SourceString>,
+    ) -> Result<Value, Halt> {
+        let error = |code, msg| Halt::Error(DragonError::new(code, msg, span.clone()));
+        let unnamed = match &callee {
+            Value::Builtin(b) => Some(b.name),
+            Value::Native(n) => Some(n.name.as_str()),
+            Value::Iterator(_) => Some("iterator"),
+            _ => None,
+        };
+        if let (Some(function), Some((name, _))) = (unnamed, named.first()) {
+            let msg = interpreter::unknown_parameter(function, name);
+            return Err(error(ErrorCode::ArityMismatch, msg));
+        }
+        match callee {
+            // instances are printed as their `to_string` shows them
+            Value::Builtin(b) if matches!(b.name, "print" | "print!") => {
+                let mut shown = Vec::with_capacity(arguments.len());
+                for a in arguments {
+                    shown.push(match values::unary_overload(UnOperator::Str, &a) {
+                        Some(method) => {
+                            let s = self.call(method, vec![a], span.clone())?;
+                            Value::from(s.to_string().as_str())
+                        }
+                        None => a,
+                    });
+                }
+                (b.function)(&shown).map_err(|msg| error(ErrorCode::Runtime, msg))
+            }
+            Value::Builtin(b) if matches!(b.name, "await" | "result") => {
+                check_arity(b.name, 1, &arguments, &span)?;
+                builtins::awaited(b.name, &arguments)
+                    .map_err(|msg| error(ErrorCode::Runtime, msg))?
+            }
+            // instances are compared as their `eq` compares them
+            Value::Builtin(b) if b.name == "assert_eq" => {
+                let method = arguments
+                    .first()
+                    .and_then(|a| values::overload(BinOperator::Eq, a));
+                let equal = match (method, arguments.get(..2)) {
+                    (Some(method), Some(compared)) => Some(
+                        self.call(method, compared.to_vec(), span.clone())?
+                            .is_truthy(),
+                    ),
+                    _ => None,
+                };
+                builtins::assert_equal(&arguments, equal)
+                    .map_err(|msg| error(ErrorCode::Runtime, msg))
+            }
+            Value::Builtin(b) if b.name == "assert_raises" => {
+                check_arity(b.name, 1, &arguments, &span)?;
+                let outcome = self.call(arguments[0].clone(), vec![], span.clone());
+                builtins::raised(outcome).map_err(|msg| error(ErrorCode::Runtime, msg))?
+            }
+            Value::Builtin(b) => {
+                if let Some(arity) = b.arity {
+                    check_arity(b.name, arity, &arguments, &span)?;
+                }
+                (b.function)(&arguments).map_err(|msg| error(ErrorCode::Runtime, msg))
+            }
+            Value::Native(n) => {
+                if let Some(arity) = n.arity {
+                    check_arity(&n.name, arity, &arguments, &span)?;
+                }
+                (n.function)(&arguments).map_err(|msg| error(ErrorCode::Runtime, msg))
+            }
+            Value::Iterator(i) => {
+                check_arity("iterator", 0, &arguments, &span)?;
+                Ok(self.next(&i, span.as_ref())?.unwrap_or_else(values::done))
+            }
+            // the fields can be given by name
+            Value::Struct(s) => {
+                let arity = Arity::exactly(s.fields.len());
+                let names = |i: usize| s.fields.get(i).map(String::as_str);
+                let fields = interpreter::bind_values(&s.name, arity, arguments, named, names)
+                    .map_err(|msg| error(ErrorCode::ArityMismatch, msg))?;
+                let fields = fields.into_iter().flatten().collect();
+                Ok(Value::Instance(values::Instance::new(s, fields)))
+            }
+            Value::Closure(c) if c.prototype.generator => {
+                let arguments = bound(&c.prototype, arguments, named, &span)?;
+                let vm = Vm {
+                    globals: self.globals.clone(),
+                    loader: self.loader.clone(),
+                };
+                Ok(Value::Iterator(Iter::generator(Box::new(Suspended {
+                    vm,
+                    name: c.prototype.name.clone(),
+                    frame: Frame::new(c, arguments),
+                    span,
+                }))))
+            }
+            Value::Closure(c) => {
+                let arguments = bound(&c.prototype, arguments, named, &span)?;
+                let nested = limits::enter(&c.prototype.name)
+                    .map_err(|msg| error(ErrorCode::LimitExceeded, msg))?;
+                let prototype = c.prototype.clone();
+                self.execute(c, arguments, Some(nested))
+                    .map_err(|h| match h {
+                        Halt::Error(e) => Halt::Error(e.with_frame(&prototype.name, span.clone())),
+                        h => h,
+                    })
+            }
+            v => Err(error(
+                ErrorCode::Runtime,
+                format!("{} is not callable", v.type_name()),
+            )),
+        }
+    }
+
+    /// start the call on a task, run by a VM of its own over the same globals
+    /// and modules
+    fn spawn(
+        &mut self,
+        callee: Value,
+        arguments: Vec<Value>,
+        named: Vec<(Arc<str>, Value)>,
+        span: Option<SourceString>,
+    ) -> Result<Value, Halt> {
+        let mut vm = Vm {
+            globals: self.globals.clone(),
+            loader: self.loader.clone(),
+        };
+        let at = span.clone();
+        match Task::spawn(move || vm.call_named(callee, arguments, named, span)) {
+            Ok(task) => Ok(Value::Task(task)),
+            Err(msg) => Err(Halt::Error(DragonError::new(ErrorCode::Runtime, msg, at))),
+        }
+    }
+
+    /// step an iterator, the functions it goes through are called from the
+    /// given span
+    fn next(
+        &mut self,
+        iterator: &Iter,
+        span: Option<&SourceString>,
+    ) -> Result<Option<Value>, Halt> {
+        iterator.next(&mut |f| self.call(f.clone(), vec![], span.cloned()))
+    }
+}
+
+/// A generator of the VM, its frame is kept between the items, with a VM of
+/// its own over the same globals and modules
+struct Suspended {
+    vm: Vm,
+    frame: Frame,
+
+    /// errors show the generator as called where it was created
+    name: String,
+    span: Option<SourceString>,
+}
+
+impl Generator for Suspended {
+    fn resume(&mut self) -> Result<Option<Value>, Halt> {
+        match self.vm.resume(&mut self.frame) {
+            Ok(Done::Yield(item)) => Ok(Some(item)),
+            Ok(_) => Ok(None),
+            Err(Halt::Error(e)) => Err(Halt::Error(e.with_frame(&self.name, self.span.clone()))),
+            Err(h) => Err(h),
+        }
+    }
+}
+
+impl Frame {
+    /// the arguments are those of the parameters, see `interpreter::bind`
+    fn new(closure: Arc<Closure>, arguments: Vec<Option<Value>>) -> Self {
+        let prototype = &closure.prototype;
+        let missing = match arguments.iter().any(Option::is_none) {
+            true => arguments.iter().map(Option::is_none).collect(),
+            false => vec![],
+        };
+        let mut slots: Vec<Value> = arguments
+            .into_iter()
+            .map(|a| a.unwrap_or(Value::None))
+            .collect();
+        slots.resize(prototype.slots, Value::None);
+        Self {
+            cells: (0..prototype.cells)
+                .map(|_| new_cell(Value::None))
+                .collect(),
+            slots,
+            missing,
+            closure,
+            stack: vec![],
+            ip: 0,
+            handlers: vec![],
+            deferred: vec![],
+            nested: None,
+            traced: None,
+        }
+    }
+}
+
+fn check_arity(
+    name: &str,
+    expected: usize,
+    arguments: &[Value],
+    span: &Option<SourceString>,
+) -> Result<(), Halt> {
+    match arguments.len() {
+        found if found == expected => Ok(()),
+        found => Err(Halt::Error(DragonError::new(
+            ErrorCode::ArityMismatch,
+            interpreter::arity_message(name, Arity::exactly(expected), found),
+            span.clone(),
+        ))),
+    }
+}
+
+/// the arguments of a call to a closure, see `interpreter::bind_values`
+fn bound(
+    prototype: &Prototype,
+    arguments: Vec<Value>,
+    named: Vec<(Arc<str>, Value)>,
+    span: &Option<SourceString>,
+) -> Result<Vec<Option<Value>>, Halt> {
+    let names = |i: usize| prototype.parameters.get(i).and_then(|p| p.as_deref());
+    interpreter::bind_values(&prototype.name, prototype.arity, arguments, named, names).map_err(
+        |msg| {
+            Halt::Error(DragonError::new(
+                ErrorCode::ArityMismatch,
+                msg,
+                span.clone(),
+            ))
+        },
+    )
+}
+
+/// pop the arguments of a call giving some by name, those given by
+/// position and those given by the names
+fn named(
+    stack: &mut Vec<Value>,
+    argc: u32,
+    names: &[Arc<str>],
+) -> (Vec<Value>, Vec<(Arc<str>, Value)>) {
+    let mut arguments = stack.split_off(stack.len() - argc as usize);
+    let values = arguments.split_off(arguments.len() - names.len());
+    (arguments, names.iter().cloned().zip(values).collect())
+}
+
+fn pop(stack: &mut Vec<Value>) -> Value {
+    stack.pop().expect("the compiler keeps the stack balanced")
+}
+
+fn undefined(name: &str) -> String {
+    format!("undefined variable '{}'", name)
+}
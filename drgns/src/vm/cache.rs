@@ -0,0 +1,213 @@
+//! Inline caches, what the instructions looking up a name found the last
+//! time they ran, so that running them again skips the lookup when it would
+//! find the same thing.
+//!
+//! A field or a method is looked up among those of the struct of an
+//! instance, the cache keeps the position found for the struct of the last
+//! instance, packed in a word that is read without locking.
+//!
+//! A global is looked up in the scopes of the globals, where a name refers
+//! to the same variable until a name is declared in one of them, the cache
+//! keeps what was found until then. Immutable variables always hold the
+//! same value, which is kept rather than the variable, so reading it again
+//! takes no lock on the variable.
+//!
+//! Chunks are shared by the threads running tasks, the cache of a global is
+//! locked while it is read or updated, and a thread finding it locked looks
+//! the name up itself. The caches refer weakly to what refers to code, the
+//! functions, the structs and the scopes holding them, so that the code
+//! caching them doesn't keep them alive.
+
+use std::sync::{
+    atomic::{AtomicU64, Ordering},
+    Arc, Mutex, OnceLock, Weak,
+};
+
+use crate::{
+    bytecode::{Chunk, Closure, Op},
+    interpreter::{Binding, Env, Environment},
+    values::{self, Instance, Struct, Value},
+};
+
+/// The caches of the instructions of a chunk, made when it first runs
+#[derive(Debug, Default)]
+pub struct Caches(OnceLock<Box<[Cache]>>);
+
+#[derive(Debug)]
+enum Cache {
+    None,
+    Member(AtomicU64),
+    Global(Box<Mutex<Global>>),
+}
+
+/// The bits of a cached member holding its position, plus 1, the bits
+/// above hold the id of the struct and all of them are 0 until it is set
+const POSITION_BITS: u32 = 24;
+
+/// the position of a member the struct doesn't have
+const ABSENT: u64 = (1 << POSITION_BITS) - 1;
+
+#[derive(Debug, Default)]
+struct Global {
+    scope: Weak<Environment>,
+    version: u64,
+    found: Option<Found>,
+}
+
+#[derive(Debug)]
+enum Found {
+    /// the value of an immutable variable, of a type that can't refer to
+    /// code
+    Value(Value),
+    Closure(Weak<Closure>),
+    Struct(Weak<Struct>),
+    /// a mutable variable, or one holding a value that may refer to code,
+    /// read each time
+    Binding(Weak<Binding>),
+}
+
+impl Found {
+    fn of(binding: &Arc<Binding>, value: &Value) -> Self {
+        if binding.is_mutable() {
+            return Found::Binding(Arc::downgrade(binding));
+        }
+        match value {
+            Value::None
+            | Value::Bool(_)
+            | Value::Int(_)
+            | Value::BigInt(_)
+            | Value::Float(_)
+            | Value::String(_)
+            | Value::Symbol(_)
+            | Value::Bytes(_)
+            | Value::Builtin(_)
+            | Value::Regex(_) => Found::Value(value.clone()),
+            Value::Closure(c) => Found::Closure(Arc::downgrade(c)),
+            Value::Struct(s) => Found::Struct(Arc::downgrade(s)),
+            _ => Found::Binding(Arc::downgrade(binding)),
+        }
+    }
+
+    /// the value of the variable, unless it is gone
+    fn value(&self) -> Option<Value> {
+        match self {
+            Found::Value(v) => Some(v.clone()),
+            Found::Closure(c) => c.upgrade().map(Value::Closure),
+            Found::Struct(s) => s.upgrade().map(Value::Struct),
+            Found::Binding(b) => b.upgrade().map(|b| b.get()),
+        }
+    }
+}
+
+impl Global {
+    /// whether what was found is still what a lookup in the scope would find
+    fn holds(&self, scope: &Env, version: u64) -> bool {
+        std::ptr::eq(self.scope.as_ptr(), Arc::as_ptr(scope)) && self.version == version
+    }
+}
+
+/// the cache of the instruction at the offset
+fn at(chunk: &Chunk, offset: usize) -> &Cache {
+    let caches = chunk.caches.0.get_or_init(|| {
+        let cache = |op: &Op| match op {
+            Op::GetField(_) | Op::SetField(_) | Op::Method(..) => Cache::Member(AtomicU64::new(0)),
+            Op::GetGlobal(_) | Op::SetGlobal(_) => Cache::Global(Box::default()),
+            _ => Cache::None,
+        };
+        chunk.code.iter().map(cache).collect()
+    });
+    &caches[offset]
+}
+
+/// The value of a global, for the instruction at the offset
+pub fn global(chunk: &Chunk, offset: usize, globals: &Env, name: &str) -> Option<Value> {
+    // read first, a name declared meanwhile leaves the cache out of date
+    let version = globals.version();
+    let Cache::Global(global) = at(chunk, offset) else {
+        return globals.get(name);
+    };
+    let Ok(mut cached) = global.try_lock() else {
+        return globals.get(name);
+    };
+    if cached.holds(globals, version) {
+        if let Some(value) = cached.found.as_ref().and_then(Found::value) {
+            return Some(value);
+        }
+    }
+    let binding = globals.binding(name)?;
+    let value = binding.get();
+    *cached = Global {
+        scope: Arc::downgrade(globals),
+        version,
+        found: Some(Found::of(&binding, &value)),
+    };
+    Some(value)
+}
+
+/// The variable a global refers to, for the instruction at the offset
+pub fn binding(chunk: &Chunk, offset: usize, globals: &Env, name: &str) -> Option<Arc<Binding>> {
+    let version = globals.version();
+    let Cache::Global(global) = at(chunk, offset) else {
+        return globals.binding(name);
+    };
+    let Ok(mut cached) = global.try_lock() else {
+        return globals.binding(name);
+    };
+    if let (true, Some(Found::Binding(b))) = (cached.holds(globals, version), &cached.found) {
+        if let Some(binding) = b.upgrade() {
+            return Some(binding);
+        }
+    }
+    let binding = globals.binding(name)?;
+    *cached = Global {
+        scope: Arc::downgrade(globals),
+        version,
+        found: Some(Found::Binding(Arc::downgrade(&binding))),
+    };
+    Some(binding)
+}
+
+/// The position of a field of an instance, for the instruction at the offset
+pub fn field(
+    chunk: &Chunk,
+    offset: usize,
+    instance: &Instance,
+    name: &str,
+) -> Result<usize, String> {
+    member(chunk, offset, &instance.of, || instance.position(name).ok())
+        .ok_or_else(|| values::no_field(&instance.of.name, name))
+}
+
+/// The method of a struct, for the instruction at the offset
+pub fn method(chunk: &Chunk, offset: usize, of: &Struct, name: &str) -> Option<Value> {
+    let position = member(chunk, offset, of, || of.methods.get_index_of(name))?;
+    of.methods.get_index(position).map(|(_, m)| m.clone())
+}
+
+fn member(
+    chunk: &Chunk,
+    offset: usize,
+    of: &Struct,
+    find: impl FnOnce() -> Option<usize>,
+) -> Option<usize> {
+    let Cache::Member(cached) = at(chunk, offset) else {
+        return find();
+    };
+    let word = cached.load(Ordering::Relaxed);
+    if word >> POSITION_BITS == of.id() {
+        return match word & ABSENT {
+            ABSENT => None,
+            p => Some(p as usize - 1),
+        };
+    }
+    let position = find();
+    let packed = match position {
+        Some(p) if (p as u64) < ABSENT - 1 => p as u64 + 1,
+        Some(_) => return position,
+        None => ABSENT,
+    };
+    if of.id() < 1 << (64 - POSITION_BITS) {
+        cached.store(of.id() << POSITION_BITS | packed, Ordering::Relaxed);
+    }
+    position
+}
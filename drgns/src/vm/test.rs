@@ -0,0 +1,1498 @@
+//! Both engines must agree on every program, these run each snippet through
+//! the tree-walker and the VM and compare the outcomes.
+
+use std::{
+    collections::BTreeSet,
+    ops::Range,
+    sync::{Arc, Mutex},
+};
+
+use crate::{
+    bytecode::Op,
+    compiler::{compile, compile_at, OptLevel},
+    interpreter::{
+        coverage, limits,
+        profile::{self, Profile},
+        trace::{self, Trace},
+        Halt, Interpreter,
+    },
+    parser::{parse, BinOperator, UnOperator},
+    source::{Source, SourceString},
+    values::{intern, Value},
+};
+
+use super::Vm;
+
+/// the value, or the message and location of the error
+fn outcome(r: Result<Value, Halt>) -> Result<Value, String> {
+    match r {
+        Ok(v) => Ok(v),
+        Err(Halt::Exit(code)) => Err(format!("exit {}", code)),
+        Err(Halt::Error(e)) => Err(format!(
+            "{} at {:?}",
+            e.message(),
+            e.span().map(|s| s.position().to_string())
+        )),
+    }
+}
+
+fn run(s: &str) -> Result<Value, String> {
+    let src = Arc::new(Source::from_string(s.to_string()));
+    let (program, errors) = parse(&src);
+    assert!(errors.is_empty(), "unexpected parse errors in {:?}", s);
+    let walked = outcome(Interpreter::new().eval(&program));
+    let compiled = outcome(Vm::new().run(compile(&program)));
+    assert_eq!(walked, compiled, "the engines disagree on {:?}", s);
+    let optimized = outcome(Vm::new().run(compile_at(&program, OptLevel::Basic)));
+    assert_eq!(
+        compiled, optimized,
+        "optimizing changes the outcome of {:?}",
+        s
+    );
+    compiled
+}
+
+fn value(s: &str) -> Value {
+    run(s).unwrap_or_else(|e| panic!("evaluating {:?} failed with {}", s, e))
+}
+
+#[test]
+fn vm_expressions() {
+    assert_eq!(value("1 + 2 * 3"), Value::Int(7));
+    assert_eq!(value("2 ** 3 ** 2"), Value::Int(512));
+    assert_eq!(value("\"a\" ++ \"b\""), Value::from("ab"));
+    assert_eq!(
+        value("b\"ab\"[1:] ++ b\"\\xff\""),
+        Value::from(&b"b\xff"[..])
+    );
+    assert_eq!(value("1 < 2 and not (2 < 1)"), Value::Bool(true));
+    assert_eq!(value("none or 0"), Value::Bool(true));
+    assert_eq!(value("false and x"), Value::Bool(false));
+    assert_eq!(value(""), Value::None);
+}
+
+#[test]
+fn vm_variables() {
+    assert_eq!(value("x := 1\ny := x + 1\ny"), Value::Int(2));
+    assert_eq!(value("mut x := 1\nx += 2\nx *= 3\nx"), Value::Int(9));
+    assert_eq!(value("x := 1\n{ x := 2 }\nx"), Value::Int(1));
+    assert_eq!(value("mut x := 1\n{ x = 2 }\nx"), Value::Int(2));
+    assert_eq!(value("{ mut x := 1\n{ x := x + 1\nx } }"), Value::Int(2));
+}
+
+#[test]
+fn vm_control_flow() {
+    assert_eq!(
+        value("if false { 1 } elif true { 2 } else { 3 }"),
+        Value::Int(2)
+    );
+    assert_eq!(value("if false { 1 }"), Value::None);
+    assert_eq!(
+        value("mut i := 0\nfor i < 10 { i += 1 }\ni"),
+        Value::Int(10)
+    );
+    assert_eq!(
+        value("mut i := 0\nfor { i += 1\nif i == 5 { break i * 2 } }"),
+        Value::Int(10)
+    );
+    assert_eq!(value("1 + { break 2\n3 }"), Value::Int(3));
+    assert_eq!(
+        value(
+            "mut i := 0\nmut n := 0\nfor i < 5 { i += 1\nif i % 2 == 0 { continue }\nn += i }\nn"
+        ),
+        Value::Int(9)
+    );
+}
+
+#[test]
+fn vm_functions() {
+    assert_eq!(
+        value("function fib(n) -> { if n < 2 { return n }\nfib(n - 1) + fib(n - 2) }\nfib(15)"),
+        Value::Int(610)
+    );
+    assert_eq!(
+        value("function double(x) -> { x * 2 }\n21.double()"),
+        Value::Int(42)
+    );
+    assert_eq!(
+        value("function f() -> { g() }\nfunction g() -> { 1 }\nf()"),
+        Value::Int(1)
+    );
+}
+
+#[test]
+fn vm_tail_calls() {
+    let count = |n| {
+        format!(
+            "function count(n, total) -> {{ if n == 0 {{ total }} else {{ count(n - 1, total + 1) }} }}\ncount({}, 0)",
+            n
+        )
+    };
+    // deep enough to overflow the stack unless the frames are reused
+    assert_eq!(value(&count(100_000)), Value::Int(100_000));
+    // the tree-walker takes too long for this many calls in debug builds
+    let src = Arc::new(Source::from_string(count(10_000_000)));
+    let (program, _) = parse(&src);
+    assert_eq!(
+        Vm::new().run(compile(&program)).ok(),
+        Some(Value::Int(10_000_000))
+    );
+    assert_eq!(
+        value(concat!(
+            "function even(n) -> { match n { 0 -> true, _ -> odd(n - 1) } }\n",
+            "function odd(n) -> { if n == 0 { return false }\nreturn even(n - 1) }\n",
+            "even(100001)"
+        )),
+        Value::Bool(false)
+    );
+    // a call in a try isn't in tail position, its errors are still caught
+    assert_eq!(
+        value(concat!(
+            "function f() -> { throw \"no\" }\n",
+            "function g() -> { try { return f() } catch { 1 } }\n",
+            "g()"
+        )),
+        Value::Int(1)
+    );
+    assert_eq!(
+        run("function f(x) -> { x }\nfunction g() -> { f(1, 2) }\ng()"),
+        Err("function 'f' expects 1 argument, found 2 at Some(\"2:19\")".to_string())
+    );
+    // frames taken over are left out, the function running is the one shown
+    assert_eq!(
+        value(concat!(
+            "function f() -> { throw \"deep\" }\nfunction g() -> { f() }\n",
+            "function h() -> { g() }\n",
+            "try { h() } catch e { errors::trace(e) }"
+        )),
+        Value::list(vec![
+            Value::from("'f' called at <repl>:2:19"),
+            Value::from("'h' called at <repl>:4:7"),
+        ])
+    );
+}
+
+#[test]
+fn vm_closures() {
+    assert_eq!(
+        value(concat!(
+            "function counter() -> {\n",
+            "  mut n := 0\n",
+            "  function next() -> { n += 1\nn }\n",
+            "  next\n",
+            "}\n",
+            "c := counter()\nc()\nc()\nc()"
+        )),
+        Value::Int(3)
+    );
+    assert_eq!(
+        value(concat!(
+            "function adder(x) -> { function add(y) -> { x + y }\nadd }\n",
+            "adder(1)(2)"
+        )),
+        Value::Int(3)
+    );
+    // functions nested twice capture through the one in the middle
+    assert_eq!(
+        value(concat!(
+            "function f(a) -> { function g() -> { function h() -> { a }\nh }\ng()() }\n",
+            "f(7)"
+        )),
+        Value::Int(7)
+    );
+    // each iteration declares a new variable
+    assert_eq!(
+        value(concat!(
+            "mut fs := none\nmut i := 0\n",
+            "for i < 3 { j := i\nfunction f() -> { j }\nif i == 1 { fs = f }\ni += 1 }\n",
+            "fs()"
+        )),
+        Value::Int(1)
+    );
+    assert_eq!(
+        value("{ function even(n) -> { if n == 0 { true } else { odd(n - 1) } }\nfunction odd(n) -> { if n == 0 { false } else { even(n - 1) } }\neven(10) }"),
+        Value::Bool(true)
+    );
+}
+
+#[test]
+fn vm_lambdas() {
+    assert_eq!(
+        value("inc := (x: int) -> int { return x + 1 }\ninc(1)"),
+        Value::Int(2)
+    );
+    assert_eq!(value("((x) -> x * 2)(21)"), Value::Int(42));
+    assert_eq!(
+        value("function twice(f, x) -> { f(f(x)) }\ntwice((x) -> x + 3, 1)"),
+        Value::Int(7)
+    );
+    assert_eq!(
+        value("function adder(x) -> { (y) -> x + y }\nadd2 := adder(2)\nadd2(3)"),
+        Value::Int(5)
+    );
+    assert_eq!(
+        value("mut n := 0\nbump := () -> { n += 1 }\nbump()\nbump()\nn"),
+        Value::Int(2)
+    );
+    // lambdas see names declared after them, like functions do
+    assert_eq!(
+        value("{ f := () -> g()\nfunction g() -> { 1 }\nf() }"),
+        Value::Int(1)
+    );
+}
+
+#[test]
+fn vm_interpolation() {
+    assert_eq!(
+        value("name := \"dragon\"\n\"hi ${name}, ${1 + 2} ${none} ${1.5}\""),
+        Value::from("hi dragon, 3 none 1.5")
+    );
+    assert_eq!(
+        value("f := (x) -> \"<${x}>\"\n\"${f(\"${f(1)}\")}\""),
+        Value::from("<<1>>")
+    );
+    assert_eq!(value("\"\\${x} {}\""), Value::from("${x} {}"));
+    assert_eq!(
+        run("\"${1 / 0}\""),
+        Err("division by zero at Some(\"1:4\")".to_string())
+    );
+}
+
+#[test]
+fn vm_lists() {
+    assert_eq!(
+        value("xs := [1, 2, 3]\n[xs[0], xs[-1], len(xs)]"),
+        Value::list(vec![Value::Int(1), Value::Int(3), Value::Int(3)])
+    );
+    assert_eq!(
+        value("xs := [1, 2, 3, 4, 5]\n[xs[1:3], xs[:-3], xs[::2], xs[::-2], xs[9:]]"),
+        value("[[2, 3], [1, 2], [1, 3, 5], [5, 3, 1], []]")
+    );
+    assert_eq!(
+        value("\"dragon\"[1:-1] ++ \"é!\"[-2]"),
+        Value::from("ragoé")
+    );
+    // lists are shared, not copied
+    assert_eq!(
+        value("xs := [1]\nys := xs\nys.push(2)\nxs[0] += 10\nxs ++ [xs.pop(), len(ys)]"),
+        value("[11, 2, 1]")
+    );
+    assert_eq!(
+        value("mut n := 0\nfor x in [1, 2, 3, 4] { if x == 2 { continue }\nif x == 4 { break }\nn += x }\nn"),
+        Value::Int(4)
+    );
+    assert_eq!(
+        value("mut s := \"\"\nfor c in \"abc\" { s = c ++ s }\ns"),
+        Value::from("cba")
+    );
+    assert_eq!(
+        value("for x in [1, 2, 3] { if x == 2 { break x * 10 } }"),
+        Value::Int(20)
+    );
+    // each iteration binds a new variable
+    assert_eq!(
+        value("fs := []\nfor x in [1, 2] { fs.push(() -> x) }\nfs[0]() + fs[1]() * 10"),
+        Value::Int(21)
+    );
+    assert_eq!(
+        run("[1, 2][2]"),
+        Err("index 2 is out of range for a list of length 2 at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("xs := [1]\nxs[\"a\"] = 2"),
+        Err("list indices must be ints, found string at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("for x in 3 { }"),
+        Err("cannot iterate over int at Some(\"1:10\")".to_string())
+    );
+    assert_eq!(
+        run("[].pop()"),
+        Err("pop expects a list that is not empty at Some(\"1:1\")".to_string())
+    );
+    assert!(run("[1][::0]").is_err());
+    assert!(run("\"abc\"[0] = \"x\"").is_err());
+}
+
+#[test]
+fn vm_iterators() {
+    let collect = |iterable: &str| {
+        value(&format!(
+            "items := []\nfor x in {} {{ items.push(x) }}\nitems",
+            iterable
+        ))
+    };
+    let ints = |xs: &[i64]| Value::list(xs.iter().map(|x| Value::Int(*x)).collect());
+    assert_eq!(collect("range(4)"), ints(&[0, 1, 2, 3]));
+    assert_eq!(collect("range(2, 5)"), ints(&[2, 3, 4]));
+    assert_eq!(collect("range(10, 0, -3)"), ints(&[10, 7, 4, 1]));
+    assert_eq!(collect("range(3, 3)"), ints(&[]));
+    // ranges are worked out one item at a time
+    assert_eq!(
+        value("for i in range(1000000000000) { if i == 3 { break i } }"),
+        Value::Int(3)
+    );
+    assert_eq!(
+        collect("enumerate(\"ab\")"),
+        Value::list(vec![
+            Value::list(vec![Value::Int(0), Value::from("a")]),
+            Value::list(vec![Value::Int(1), Value::from("b")]),
+        ])
+    );
+    assert_eq!(
+        value("for p in enumerate({^a: 1, ^b: 2}) { if p[0] == 1 { break p[1] } }"),
+        Value::Symbol("b".into())
+    );
+
+    // functions are iterators, until they return `^done`
+    let counter =
+        "function counter(n) -> { mut i := 0\n() -> { if i == n { return ^done }\ni += 1\ni } }\n";
+    assert_eq!(
+        collect(&format!("{{ {}counter(3) }}", counter)),
+        ints(&[1, 2, 3])
+    );
+    assert_eq!(
+        collect(&format!("{{ {}enumerate(counter(2)) }}", counter)),
+        Value::list(vec![ints(&[0, 1]), ints(&[1, 2])])
+    );
+    // and iterators are called like them
+    assert_eq!(
+        value("r := range(2)\n[r(), r(), r()]"),
+        Value::list(vec![
+            Value::Int(0),
+            Value::Int(1),
+            Value::Symbol("done".into())
+        ])
+    );
+    // a loop stopped early leaves the rest of the items
+    assert_eq!(
+        value("r := range(5)\nfor x in r { if x == 1 { break } }\nr()"),
+        Value::Int(2)
+    );
+
+    assert_eq!(
+        run("range(1, 2, 0)"),
+        Err("the step of a range cannot be 0 at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("enumerate(1)"),
+        Err(
+            "enumerate expects something to iterate over as argument 1, found int at Some(\"1:1\")"
+                .to_string()
+        )
+    );
+    assert_eq!(
+        run("function f() -> { throw \"no\" }\nfor x in f { }"),
+        Err("no at Some(\"1:19\")".to_string())
+    );
+    assert_eq!(
+        run("range(3)(1)"),
+        Err("function 'iterator' expects 0 arguments, found 1 at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_generators() {
+    let collect = |src: &str| {
+        value(&format!(
+            "{{ {}\nitems := []\nfor x in g {{ items.push(x) }}\nitems }}",
+            src
+        ))
+    };
+    let ints = |xs: &[i64]| Value::list(xs.iter().map(|x| Value::Int(*x)).collect());
+    assert_eq!(
+        collect("function f(n) -> { for i in range(n) { yield i * i } }\ng := f(4)"),
+        ints(&[0, 1, 4, 9])
+    );
+    // generators only run as far as the items asked for
+    let naturals = "function naturals() -> { mut n := 0\nfor true { yield n\nn += 1 } }\n";
+    assert_eq!(
+        collect(&format!(
+            "{}function take(xs, n) -> {{ for x in xs {{ if x == n {{ return }}\nyield x }} }}\ng := take(naturals(), 3)",
+            naturals
+        )),
+        ints(&[0, 1, 2])
+    );
+    assert_eq!(
+        value(&format!(
+            "{{ {}g := naturals()\n[g(), g(), g()] }}",
+            naturals
+        )),
+        ints(&[0, 1, 2])
+    );
+    // the state of the body is kept between the items, handlers included
+    assert_eq!(
+        collect("g := (() -> { try { yield 1\nthrow \"no\" } catch e { yield 2 }\nyield 3 })()"),
+        ints(&[1, 2, 3])
+    );
+    // nothing runs before the first item is asked for
+    assert_eq!(
+        value("mut ran := false\nfunction f() -> { ran = true\nyield 1 }\ng := f()\nran"),
+        Value::Bool(false)
+    );
+    assert_eq!(
+        value("function f() -> { yield 1 }\ng := f()\n[g(), g(), g()]"),
+        Value::list(vec![
+            Value::Int(1),
+            Value::Symbol("done".into()),
+            Value::Symbol("done".into())
+        ])
+    );
+    // a call returning a generator is not a tail call of it
+    assert_eq!(
+        collect("function f() -> { yield 1 }\nfunction h() -> { return f() }\ng := h()"),
+        ints(&[1])
+    );
+
+    assert_eq!(
+        run("function f() -> { yield 1\nthrow \"no\" }\nfor x in f() { }"),
+        Err("no at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("function f(x) -> { yield x }\nf()"),
+        Err("function 'f' expects 1 argument, found 0 at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("yield 1"),
+        Err("yield outside of a function at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_tasks() {
+    let sum = "function sum(n) -> { mut total := 0\nfor i in range(n) { total += i }\ntotal }\n";
+    assert_eq!(
+        value(&format!(
+            "{}tasks := [spawn sum(10), spawn sum(100)]\n[tasks[0].await(), tasks[1].await()]",
+            sum
+        )),
+        Value::list(vec![Value::Int(45), Value::Int(4950)])
+    );
+    // the callee and the arguments are evaluated before the task starts, and
+    // awaiting again gives the same value
+    assert_eq!(
+        value("mut n := 1\nt := spawn ((x) -> x * 2)(n)\nn = 5\n[t.await(), t.await(), t.done()]"),
+        Value::list(vec![Value::Int(2), Value::Int(2), Value::Bool(true)])
+    );
+    assert_eq!(
+        value("t := spawn [1, 2, 3].len()\nresult(t)"),
+        Value::Int(3)
+    );
+    // the error of a task is raised where it is awaited, as it was raised
+    assert_eq!(
+        run("function f(x) -> {\nx / 0 }\nt := spawn f(1)\nt.await()"),
+        Err("division by zero at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        value(
+            "t := spawn (() -> { throw \"no\" })()\ntry { t.await() } catch e { e == t.result() }"
+        ),
+        Value::Bool(false)
+    );
+    assert_eq!(
+        value("t := spawn (() -> { throw \"no\" })()\nerrors::message(t.result())"),
+        Value::from("no")
+    );
+    assert_eq!(
+        run("t := spawn (() -> { exit 3 })()\nt.result()"),
+        Err("exit 3".to_string())
+    );
+    assert_eq!(
+        run("t := spawn (() -> 1)(2)\nt.await()"),
+        Err("function '<lambda>' expects 0 arguments, found 1 at Some(\"1:12\")".to_string())
+    );
+    assert_eq!(
+        run("await(1)"),
+        Err("await expects a task as argument 1, found int at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_channels() {
+    let ints = |xs: &[i64]| Value::list(xs.iter().map(|x| Value::Int(*x)).collect());
+    // a loop goes through the items until the channel is closed
+    assert_eq!(
+        value(
+            "c := chan(2)\nfunction produce(n) -> { for i in range(n) { c.send(i * i) }\nc.close() }\n\
+             spawn produce(4)\nitems := []\nfor x in c { items.push(x) }\nitems"
+        ),
+        ints(&[0, 1, 4, 9])
+    );
+    // a send along a channel without capacity waits for a receiver
+    assert_eq!(
+        value("c := chan()\nt := spawn c.send(1)\n[c.recv(), t.await(), c.try_send(2)]"),
+        Value::list(vec![Value::Int(1), Value::None, Value::Bool(false)])
+    );
+    assert_eq!(
+        value("c := chan(1)\n[c.try_recv(), c.try_send(1), c.try_send(2), c.try_recv()]"),
+        Value::list(vec![
+            Value::Symbol("empty".into()),
+            Value::Bool(true),
+            Value::Bool(false),
+            Value::Int(1)
+        ])
+    );
+    assert_eq!(
+        value("c := chan(1)\nc.send(1)\nc.close()\n[c.recv(), c.recv(), c.try_recv()]"),
+        Value::list(vec![
+            Value::Int(1),
+            Value::Symbol("done".into()),
+            Value::Symbol("done".into())
+        ])
+    );
+
+    assert_eq!(
+        value("a := chan()\nb := chan(1)\nspawn b.send(^b)\nselect([a, b])"),
+        Value::list(vec![Value::Int(1), Value::Symbol("b".into())])
+    );
+    assert_eq!(value("select([chan()], 0)"), Value::None);
+    assert_eq!(
+        value("c := chan()\nspawn c.close()\nselect([c], 10)"),
+        Value::list(vec![Value::Int(0), Value::Symbol("done".into())])
+    );
+
+    assert_eq!(
+        run("c := chan()\nc.close()\nc.send(1)"),
+        Err("send expects a channel that is open at Some(\"3:1\")".to_string())
+    );
+    assert_eq!(
+        run("c := chan(1)\nc.close()\nc.close()"),
+        Err("close expects a channel that is open at Some(\"3:1\")".to_string())
+    );
+    assert_eq!(
+        run("chan(-1)"),
+        Err("chan expects a capacity of at least 0, found -1 at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("select([chan(), 1])"),
+        Err("select expects a list of channels, found int in it at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_structs() {
+    let point = "struct Point {\nx: int, y: int\nfunction sum(self) -> { self.x + self.y }\n}\n";
+    let with_point = |src: &str| format!("{}{}", point, src);
+    assert_eq!(value(&with_point("p := Point(1, 2)\np.y")), Value::Int(2));
+    assert_eq!(value(&with_point("Point(3, 4).sum()")), Value::Int(7));
+    assert_eq!(
+        value(&with_point("p := Point(1, 2)\np.x += 10\np.y = 0\np.sum()")),
+        Value::Int(11)
+    );
+    // instances are shared like lists
+    assert_eq!(
+        value(&with_point(
+            "p := Point(1, 2)\nfunction f(q) -> { q.x = 5 }\nf(p)\np.x"
+        )),
+        Value::Int(5)
+    );
+    // other methods are the functions in scope, locals included
+    assert_eq!(
+        value(&with_point(
+            "{ function sum(n) -> { n + 1 }\n[Point(1, 1).sum(), 1.sum()] }"
+        )),
+        Value::list(vec![Value::Int(2), Value::Int(2)])
+    );
+    assert_eq!(
+        value(&with_point(
+            "[Point(1, 2) == Point(1, 2), Point(1, 2) == Point(2, 1)]"
+        )),
+        Value::list(vec![Value::Bool(true), Value::Bool(false)])
+    );
+    // methods close over the scope of the struct
+    assert_eq!(
+        value("{ n := 3\nstruct S { function get(self) -> { n } }\nS().get() }"),
+        Value::Int(3)
+    );
+    assert_eq!(
+        value(&with_point("\"${Point(1, [2])}\"")),
+        Value::from("Point(x: 1, y: [2])")
+    );
+
+    assert_eq!(
+        run(&with_point("Point(1, 2).z")),
+        Err("Point has no field 'z' at Some(\"5:13\")".to_string())
+    );
+    assert_eq!(
+        run("x := 1\nx.y = 2"),
+        Err("int has no field 'y' at Some(\"2:3\")".to_string())
+    );
+    assert_eq!(
+        run(&with_point("Point(1)")),
+        Err("function 'Point' expects 2 arguments, found 1 at Some(\"5:1\")".to_string())
+    );
+    assert_eq!(
+        run(&with_point("Point(1, 2).norm()")),
+        Err("undefined variable 'norm' at Some(\"5:13\")".to_string())
+    );
+}
+
+#[test]
+fn vm_inline_caches() {
+    // the same instructions look up fields and methods of other structs
+    let structs = "struct A {\nx, y\nfunction f(self) -> { 1 }\n}\n\
+        struct B {\ny, x\nfunction g(self) -> { 2 }\n}\n\
+        function get(p) -> { p.x }\n\
+        function set(p) -> { p.x = 0\np }\n\
+        function f(p) -> { 3 }\n\
+        function call(p) -> { p.f() }\n";
+    let with_structs = |src: &str| format!("{}{}", structs, src);
+    assert_eq!(
+        value(&with_structs("[get(A(1, 2)), get(B(1, 2)), get(A(3, 4))]")),
+        Value::list(vec![Value::Int(1), Value::Int(2), Value::Int(3)])
+    );
+    assert_eq!(
+        value(&with_structs(
+            "[set(A(1, 2)).y, set(B(1, 2)).y, set(A(1, 2)).x]"
+        )),
+        Value::list(vec![Value::Int(2), Value::Int(1), Value::Int(0)])
+    );
+    assert_eq!(
+        value(&with_structs(
+            "[call(A(1, 2)), call(B(1, 2)), call(A(1, 2))]"
+        )),
+        Value::list(vec![Value::Int(1), Value::Int(3), Value::Int(1)])
+    );
+    assert_eq!(
+        run(&with_structs("get(A(1, 2))\nget(1)")),
+        Err("int has no field 'x' at Some(\"9:24\")".to_string())
+    );
+
+    // a global declared again is the one found from then on
+    assert_eq!(
+        value("x := 1\nfunction f() -> { x }\na := f()\nx := 2\n[a, f()]"),
+        Value::list(vec![Value::Int(1), Value::Int(2)])
+    );
+    assert_eq!(
+        value("mut n := 0\nfunction f() -> { n += 1 }\nf()\nf()\nn"),
+        Value::Int(2)
+    );
+    assert_eq!(
+        run("mut n := 0\nfunction f() -> { n = 1 }\nf()\nn := 0\nf()"),
+        Err("cannot assign twice to immutable variable 'n' at Some(\"2:19\")".to_string())
+    );
+    // tasks share the globals and the caches of the functions they run
+    assert_eq!(
+        value(
+            "function square(x) -> { x * x }\n\
+            function f() -> { mut t := 0\nfor i in range(1000) { t += square(i) }\nt }\n\
+            tasks := [spawn f(), spawn f()]\n[tasks[0].await(), tasks[1].await()]"
+        ),
+        Value::list(vec![Value::Int(332833500), Value::Int(332833500)])
+    );
+}
+
+#[test]
+fn vm_operator_overloading() {
+    let v = "struct V {\nx, y\n\
+        function add(self, o) -> { V(self.x + o.x, self.y + o.y) }\n\
+        function neg(self) -> { V(-self.x, -self.y) }\n\
+        function eq(self, o) -> { self.x == o.x }\n\
+        function lt(self, o) -> { self.x < o.x }\n\
+        function index(self, i) -> { [self.x, self.y][i] }\n\
+        function set_index(self, i, v) -> { if i == 0 { self.x = v } else { self.y = v } }\n\
+        function to_string(self) -> { \"<${self.x}, ${self.y}>\" }\n\
+        }\n";
+    let with_v = |src: &str| format!("{}{}", v, src);
+    assert_eq!(
+        value(&with_v("\"${V(1, 2) + V(3, 4)} ${-V(1, 2)}\"")),
+        Value::from("<4, 6> <-1, -2>")
+    );
+    assert_eq!(
+        value(&with_v(
+            "[V(1, 2) == V(1, 3), V(1, 2) != V(2, 2), V(1, 2) < V(2, 0)]"
+        )),
+        Value::list(vec![Value::Bool(true); 3])
+    );
+    assert_eq!(
+        value(&with_v("a := V(1, 2)\na[1] = 5\na[0] += 1\n[a[0], a[1]]")),
+        Value::list(vec![Value::Int(2), Value::Int(5)])
+    );
+    assert_eq!(
+        value(&with_v("mut a := V(1, 1)\na += V(2, 2)\n\"${a}\"")),
+        Value::from("<3, 3>")
+    );
+    // operators without a method are not overloaded
+    assert_eq!(
+        run(&with_v("V(1, 2) * 2")),
+        Err("unsupported operand types for *: V and int at Some(\"11:1\")".to_string())
+    );
+    assert_eq!(
+        run(&with_v("1 + V(1, 2)")),
+        Err("unsupported operand types for +: int and V at Some(\"11:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_maps() {
+    assert_eq!(
+        value("m := {\"a\": 1, 2: \"b\", ^c: none}\n[m[\"a\"], m[2], m[^c], m[\"x\"], len(m)]"),
+        value("[1, \"b\", none, none, 3]")
+    );
+    // entries keep the order they were added in
+    assert_eq!(
+        value(concat!(
+            "m := {\"z\": 1, \"a\": 2}\nm[\"m\"] = 3\nm[\"z\"] += 10\n",
+            "[keys(m), values(m), m.delete(\"a\"), m.delete(\"a\"), keys(m)]"
+        )),
+        value("[[\"z\", \"a\", \"m\"], [11, 2, 3], 2, none, [\"z\", \"m\"]]")
+    );
+    assert_eq!(
+        value("mut s := \"\"\nfor k in {\"b\": 1, \"a\": 2} { s ++= k }\ns"),
+        Value::from("ba")
+    );
+    assert_eq!(
+        value("merge({\"a\": 1, \"b\": 2}, {\"b\": 3}, {})"),
+        value("{\"a\": 1, \"b\": 3}")
+    );
+    assert_eq!(
+        value(
+            "[\"a\" in {\"a\": 1}, 1 in {\"a\": 1}, 2 in [1, 2], \"ra\" in \"dragon\", 3.5 in {}]"
+        ),
+        value("[true, false, true, true, false]")
+    );
+    assert_eq!(value("{\"a\": 1} == {\"a\": 1}"), Value::Bool(true));
+    assert_eq!(value("{}").to_string(), "{}");
+    assert_eq!(
+        value("{^a: [1], 1: \"x\"}").to_string(),
+        "{^a: [1], 1: \"x\"}"
+    );
+    assert_eq!(
+        run("{1.5: 1}"),
+        Err("map keys must be ints, strings or symbols, found float at Some(\"1:1\")".to_string())
+    );
+    assert!(run("m := {}\nm[[]] = 1").is_err());
+    assert!(run("1 in 2").is_err());
+    assert!(run("keys([])").is_err());
+}
+
+#[test]
+fn vm_match() {
+    let describe = concat!(
+        "function f(v) -> {\n",
+        "  match v {\n",
+        "    0 -> \"zero\"\n",
+        "    -1.5 -> \"negative\"\n",
+        "    ^a -> \"symbol\"\n",
+        "    [] -> \"empty\"\n",
+        "    [x] if x > 9 -> \"big ${x}\"\n",
+        "    [first, ..rest] -> \"${first} then ${rest}\"\n",
+        "    {\"name\": n, \"age\": a} if a >= 18 -> \"adult ${n}\"\n",
+        "    {\"name\": n} -> n\n",
+        "    _ -> \"other\"\n",
+        "  }\n",
+        "}\n",
+    );
+    assert_eq!(
+        value(&format!(
+            "{}[f(0), f(-1.5), f(^a), f([]), f([10]), f([1]), f([1, 2, 3])]",
+            describe
+        )),
+        value(r#"["zero", "negative", "symbol", "empty", "big 10", "1 then []", "1 then [2, 3]"]"#)
+    );
+    assert_eq!(
+        value(&format!(
+            r#"{}[f({{"name": "ada", "age": 36}}), f({{"name": "bo", "age": 3}}), f({{}}), f(none)]"#,
+            describe
+        )),
+        value(r#"["adult ada", "bo", "other", "other"]"#)
+    );
+    // bindings are fresh in each match, closures keep their own
+    assert_eq!(
+        value("fs := []\nfor i in [1, 2] { match [i, i * 10] { [a, b] -> fs.push(() -> a + b) } }\n[fs[0](), fs[1]()]"),
+        value("[11, 22]")
+    );
+    assert_eq!(
+        value("match [1, 2, 3] { [.., y, z] -> y * z }"),
+        Value::Int(6)
+    );
+    // `break` in an arm leaves the enclosing loop
+    assert_eq!(value("for { match 1 { 1 -> { break 7 } } }"), Value::Int(7));
+    assert_eq!(
+        run("x := 5\nmatch x { 1 -> 1 }"),
+        Err("no arm of the match matches 5 at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        value("try { match \"x\" { 1 -> 1 } } catch e { errors::message(e) }"),
+        Value::from("no arm of the match matches \"x\"")
+    );
+}
+
+#[test]
+fn vm_try() {
+    assert_eq!(value("try { 1 / 0 } catch { 2 }"), Value::Int(2));
+    assert_eq!(value("try { 1 } catch { 2 }"), Value::Int(1));
+    assert_eq!(
+        value("try { throw \"oops\" } catch e { errors::message(e) }"),
+        Value::from("oops")
+    );
+    // errors from builtins can be caught too
+    assert_eq!(
+        value("try { fs::read(\"/no/such/file\") } catch e { errors::code(e) }"),
+        Value::from("E04001")
+    );
+    assert_eq!(
+        value("try { try { throw \"a\" } catch e { throw e } } catch e { errors::message(e) }"),
+        Value::from("a")
+    );
+    assert_eq!(
+        value(concat!(
+            "function f() -> { throw \"deep\" }\nfunction g() -> { f() }\n",
+            "try { g() } catch e { errors::trace(e) }"
+        )),
+        Value::list(vec![
+            Value::from("'f' called at <repl>:2:19"),
+            Value::from("'g' called at <repl>:3:7"),
+        ])
+    );
+}
+
+#[test]
+fn vm_finally() {
+    assert_eq!(
+        value("mut n := 0\ntry { n = 1 } finally { n *= 10 }\nn"),
+        Value::Int(10)
+    );
+    assert_eq!(
+        value("mut n := 0\ntry { try { 1 / 0 } finally { n = 1 } } catch { n += 1 }\nn"),
+        Value::Int(2)
+    );
+    assert_eq!(
+        value("mut n := 0\ntry { try { throw \"a\" } catch { 1 / 0 } finally { n = 1 } } catch { n += 1 }\nn"),
+        Value::Int(2)
+    );
+    // jumping out of a try runs its finally
+    assert_eq!(
+        value(concat!(
+            "mut log := \"\"\nmut i := 0\n",
+            "for { i += 1\ntry { if i == 3 { break }\nif i == 1 { continue }\nlog ++= \"b\" } finally { log ++= \"f\" } }\n",
+            "log"
+        )),
+        Value::from("fbff")
+    );
+    assert_eq!(
+        value(concat!(
+            "mut n := 0\n",
+            "function f() -> { try { return 1 } finally { n = 2 } }\n",
+            "f() + n"
+        )),
+        Value::Int(3)
+    );
+    assert_eq!(
+        run("mut n := 0\ntry { exit 3 } finally { n = 1 }"),
+        Err("exit 3".to_string())
+    );
+}
+
+#[test]
+fn vm_defer() {
+    // last deferred first, after the value returned is computed
+    assert_eq!(
+        value(concat!(
+            "mut log := \"\"\n",
+            "function f() -> { defer log ++= \"a\"\ndefer { log ++= \"b\" }\nlog ++= \"f\"\nlog }\n",
+            "f() ++ \" \" ++ log"
+        )),
+        Value::from("f fba")
+    );
+    // on the way out of an error, and of the calls in tail position
+    assert_eq!(
+        value(concat!(
+            "mut n := 0\n",
+            "function f() -> { defer n += 1\nthrow \"x\" }\n",
+            "function g(i) -> { defer n *= 10\nif i == 0 { 0 } else { g(i - 1) } }\n",
+            "try { f() } catch { }\ng(2)\nn"
+        )),
+        Value::Int(1000)
+    );
+    // the deferred code sees the variables as they are when it runs
+    assert_eq!(
+        value("function f() -> { mut x := 1\ndefer x = 3\nx = 2\n() -> x }\nf()()"),
+        Value::Int(3)
+    );
+    // an error in it replaces the outcome of the function, the rest still runs
+    assert_eq!(
+        value(concat!(
+            "mut n := 0\n",
+            "function f() -> { defer n = 1\ndefer { throw \"in defer\" }\n2 }\n",
+            "errors::message(try { f() } catch e { e }) ++ \" ${n}\""
+        )),
+        Value::from("in defer 1")
+    );
+    assert_eq!(
+        run("mut n := 0\nfunction f() -> { defer n = 1\nexit 3 }\nf()"),
+        Err("exit 3".to_string())
+    );
+    assert_eq!(
+        run("defer print(1)"),
+        Err("defer outside of a function at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_destructuring() {
+    assert_eq!(
+        value("[a, b, ..rest] := [1, 2, 3, 4]\n{x, \"y\": [y]} := {\"x\": 5, \"y\": [6]}\n[a, b, rest, x, y]"),
+        value("[1, 2, [3, 4], 5, 6]")
+    );
+    assert_eq!(
+        value("function f() -> { mut [a, ..] := [1, 2]\na += 1\n[_, b] := [0, a]\nb }\nf()"),
+        Value::Int(2)
+    );
+    // in parameters and loops, the names are fresh in each call and item
+    assert_eq!(
+        value(concat!(
+            "function norm([x, y], {scale}) -> { (x * x + y * y) * scale }\n",
+            "fs := []\n",
+            "for [k, v] in [[1, 2], [3, 4]] { fs.push(() -> k * v) }\n",
+            "[norm([3, 4], {\"scale\": 2}), fs[0](), fs[1]()]"
+        )),
+        value("[50, 2, 12]")
+    );
+    assert_eq!(
+        run("[a, b] := [1]"),
+        Err("[1] does not match [a, b] at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("function f({k}) -> { k }\nf({})"),
+        Err("{} does not match {k} at Some(\"1:12\")".to_string())
+    );
+}
+
+#[test]
+fn vm_parameters() {
+    assert_eq!(
+        value(concat!(
+            "function f(a, b = a * 2, ..rest) -> { [a, b, rest] }\n",
+            "[f(1), f(1, 5), f(1, 5, 6, 7), f(b = 3, a = 2)]"
+        )),
+        value("[[1, 2, []], [1, 5, []], [1, 5, [6, 7]], [2, 3, []]]")
+    );
+    // defaults are evaluated in each call, lambdas and structs take names too
+    assert_eq!(
+        value(concat!(
+            "function f(xs = []) -> { xs.push(1)\nxs }\n",
+            "g := (x, by = 10) -> x * by\n",
+            "struct P { x, y }\np := P(y = 2, x = 1)\n",
+            "[f(), f(), g(2), g(2, by = 1), p.x, p.y]"
+        )),
+        value("[[1], [1], 20, 2, 1, 2]")
+    );
+    assert_eq!(
+        value("function f(n, acc = 0) -> { if n == 0 { acc } else { f(n - 1, acc = acc + n) } }\nf(100000)"),
+        Value::Int(5000050000)
+    );
+    assert_eq!(
+        run("function f(a, b = 1) -> { a }\nf(c = 1)"),
+        Err("function 'f' has no parameter named 'c' at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("function f(a, b = 1) -> { a }\nf(b = 2)"),
+        Err("function 'f' is missing the argument 'a' at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("print(end = 1)"),
+        Err("function 'print' has no parameter named 'end' at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_null_safety() {
+    let node = "struct Node {\n  value, next\n  function get(self) -> { self.value }\n}\n";
+    assert_eq!(
+        value(&format!(
+            "{}n := Node(1, Node(2, none))\n[n?.next?.value, n.next?.next?.value, n.next?.next?.get()]",
+            node
+        )),
+        value("[2, none, none]")
+    );
+    // the right of `??` is only evaluated if the left is `none`, and so are
+    // the arguments of a call with `?.`
+    assert_eq!(
+        value(concat!(
+            "mut calls := 0\nfunction f() -> { calls += 1\n7 }\n",
+            "function first(xs) -> { xs?.first(f()) }\n",
+            "[0 ?? f(), none ?? f(), first(none), calls]"
+        )),
+        value("[0, 7, none, 1]")
+    );
+    assert_eq!(
+        run("x := none\nx.y"),
+        Err("none has no field 'y' at Some(\"2:3\")".to_string())
+    );
+}
+
+#[test]
+fn vm_enums() {
+    let result = concat!(
+        "enum Result {\n  Ok(value)\n  Err(msg)\n",
+        "  function unwrap_or(self, default) -> {\n",
+        "    match self { Result::Ok(v) -> v\nResult::Err -> default }\n  }\n}\n",
+        "function parse(s) -> { match s { \"1\" -> Result::Ok(1)\n_ -> Result::Err(s) } }\n",
+    );
+    let with_result = |src: &str| format!("{}{}", result, src);
+    assert_eq!(
+        value(&with_result(
+            "[parse(\"1\").unwrap_or(0), parse(\"x\").unwrap_or(0), parse(\"x\").msg]"
+        )),
+        value("[1, 0, \"x\"]")
+    );
+    // variants are equal if their fields are, those without fields are a
+    // single value
+    assert_eq!(
+        value(&with_result(concat!(
+            "enum Color { Red, Green }\n",
+            "[parse(\"1\") == Result::Ok(1), parse(\"1\") == parse(\"x\"), Color::Red == Color::Red, ",
+            "Color::Red == Color::Green, inspect([Result::Err(msg = none), Color::Green])]"
+        ))),
+        value("[true, false, true, false, \"[Result::Err(none), Color::Green]\"]")
+    );
+    assert_eq!(
+        value(&with_result(
+            "match [parse(\"x\")] { [Result::Ok(v)] -> v\n[Result::Err(m)] -> m ++ \"!\" }"
+        )),
+        value("\"x!\"")
+    );
+    assert_eq!(
+        run(&with_result("Result::Maybe")),
+        Err("enum Result has no variant 'Maybe' at Some(\"11:9\")".to_string())
+    );
+}
+
+#[test]
+fn vm_errors() {
+    let errors = [
+        "1 / 0",
+        "x",
+        "x = 1",
+        "x := 1\nx = 2",
+        "function f(a) -> { a = 1 }\nf(0)",
+        "{ x := 1\nx += 1 }",
+        "function f(a) -> { }\nf()",
+        "1()",
+        "break",
+        "continue",
+        "return 1",
+        "function f() -> { break }\nf()",
+        "exit \"x\"",
+        "exit 3",
+        "1 + true",
+        "1.nothing()",
+        "((x) -> x)()",
+        "throw \"x\"",
+        "try { throw \"x\" } finally { }",
+        "try { } catch e { }\ne",
+    ];
+    for s in errors {
+        assert!(run(s).is_err(), "expected {:?} to fail", s);
+    }
+    assert_eq!(run("exit(4)"), Err("exit 4".to_string()));
+    assert_eq!(
+        run("exit 256"),
+        Err("exit code must be between 0 and 255, found 256 at Some(\"1:6\")".to_string())
+    );
+}
+
+#[test]
+fn disassemble_chunks() {
+    let src = Arc::new(Source::from_string(
+        "x := \"a\"\nif x { f := (y) -> y }".to_string(),
+    ));
+    let (program, _) = parse(&src);
+    let listing = compile(&program).disassemble();
+    let lines: Vec<&str> = listing.lines().collect();
+    assert_eq!(lines[0], "== <script> ==");
+    assert_eq!(lines[2], "0000     1 Constant(0)              ; \"a\"");
+    assert_eq!(lines[3], "0001     | DefineGlobal(0, false)   ; x");
+    assert!(
+        lines
+            .iter()
+            .any(|l| l.starts_with("0005     - JumpIfFalse(10)")),
+        "{}",
+        listing
+    );
+    assert!(lines.contains(&"constants:"), "{}", listing);
+    assert!(lines.contains(&"   0 \"a\""), "{}", listing);
+    assert!(lines.contains(&"== <script>/0 f =="), "{}", listing);
+
+    let src = Arc::new(Source::from_string(
+        "function f(n) -> { if n > 0 { f(n - 1) } else { g(n) + 1 } }".to_string(),
+    ));
+    let (program, _) = parse(&src);
+    let listing = compile(&program).disassemble();
+    // only the call whose value is returned right away is a tail call
+    assert!(listing.contains("| TailCall(1)"), "{}", listing);
+    assert!(listing.contains("| Call(1)"), "{}", listing);
+}
+
+#[test]
+fn optimized_chunks() {
+    let compiled = |text: &str, level| {
+        let src = Arc::new(Source::from_string(text.to_string()));
+        let (program, _) = parse(&src);
+        compile_at(&program, level)
+    };
+    let folded = compiled("x := 2 * 3 + 1\ny := \"n = {x}\"", OptLevel::Basic);
+    assert!(!folded
+        .chunk
+        .code
+        .iter()
+        .any(|op| matches!(op, Op::Binary(_))));
+    assert_eq!(folded.chunk.constants[0], Value::Int(7));
+    // nothing pushes the value of a statement only to pop it
+    let code = &folded.chunk.code;
+    assert!(
+        !code.windows(2).any(|w| w == [Op::None, Op::Pop]),
+        "{:?}",
+        code
+    );
+    let written = compiled("x := 2 * 3 + 1", OptLevel::None);
+    assert!(written.chunk.code.contains(&Op::Binary(BinOperator::Mul)));
+
+    let f = compiled(
+        "function f(x) -> { if not x { return 1\nprint(2) }\nif false { 3 } }",
+        OptLevel::Basic,
+    );
+    let code = &f.chunk.functions[0].chunk.code;
+    assert!(!code.contains(&Op::Unary(UnOperator::Not)), "{:?}", code);
+    assert!(code.iter().any(|op| matches!(op, Op::JumpIfTrue(_))));
+    assert!(!code.iter().any(|op| matches!(op, Op::GetGlobal(_))));
+
+    assert_eq!(value("function f() -> { return 1\n2 }\nf()"), Value::Int(1));
+    assert_eq!(
+        value("if false { 1 } elif true { 2 } else { 3 }"),
+        Value::Int(2)
+    );
+    assert_eq!(
+        value("mut n := 0\nfor n < 3 { n += 1\ncontinue\nn = 100 }\nn"),
+        Value::Int(3)
+    );
+    assert_eq!(value("not not none"), Value::Bool(false));
+    // what fails at run-time is left to fail there
+    assert_eq!(
+        run("x := 1\n1 / 0"),
+        Err("division by zero at Some(\"2:1\")".to_string())
+    );
+}
+
+#[test]
+fn source_maps() {
+    let src = Arc::new(Source::from_string(
+        "function f(x) -> {\n  x + 1\n}\nprint(1)\nf(true)".to_string(),
+    ));
+    let (program, _) = parse(&src);
+    let script = compile(&program);
+    let map = &script.chunk.source_map;
+    assert_eq!(map.len(), script.chunk.code.len());
+    // consecutive instructions from the same node share a run
+    assert!(map.runs().count() < map.len());
+    let runs: Vec<Range<usize>> = map.runs().map(|(r, _)| r).collect();
+    assert_eq!(runs.first().map(|r| r.start), Some(0));
+    assert_eq!(runs.last().map(|r| r.end), Some(map.len()));
+    assert!(runs.windows(2).all(|w| w[0].end == w[1].start));
+    let position = |offset| map.position(offset).map(|p| (p.line, p.column));
+    let call = script
+        .chunk
+        .code
+        .iter()
+        .rposition(|op| matches!(op, Op::Call(1) | Op::TailCall(1)))
+        .expect("the script calls f");
+    assert_eq!(position(call), Some((5, 1)));
+
+    // errors point at the source, and so does each frame they go through
+    let Err(Halt::Error(e)) = Vm::new().run(script) else {
+        panic!("adding to a boolean fails");
+    };
+    let at = |s: Option<&SourceString>| s.map(|s| (s.position().line, s.position().column));
+    assert_eq!(at(e.span()), Some((2, 3)));
+    assert_eq!(e.trace().len(), 1);
+    assert_eq!(at(e.trace()[0].call.as_ref()), Some((5, 1)));
+}
+
+#[test]
+fn vm_big_ints() {
+    let s = |src: &str| value(src).to_string();
+    assert_eq!(s("9223372036854775807 + 1"), "9223372036854775808");
+    assert_eq!(s("-9223372036854775807 - 1"), "-9223372036854775808");
+    assert_eq!(s("-(-9223372036854775807 - 1)"), "9223372036854775808");
+    assert_eq!(s("2 ** 64"), "18446744073709551616");
+    assert_eq!(
+        s("function fact(n) -> { if n < 2 { 1 } else { n * fact(n - 1) } }\nfact(30)"),
+        "265252859812191058636308480000000"
+    );
+    assert_eq!(
+        s("3 ** 100"),
+        "515377520732011331036461129765621272702107522001"
+    );
+    assert_eq!(
+        s("(2 ** 200 + 12345) / (2 ** 70 + 3)"),
+        "1361129467683753853850039665213252304896"
+    );
+    assert_eq!(
+        s("(2 ** 200 + 12345) % (2 ** 70 + 3)"),
+        "10376293541461635129"
+    );
+    // division rounds towards zero like for small ints
+    assert_eq!(
+        s("-(2 ** 200 + 12345) / (2 ** 70 + 3)"),
+        "-1361129467683753853850039665213252304896"
+    );
+    assert_eq!(
+        s("-(2 ** 200 + 12345) % (2 ** 70 + 3)"),
+        "-10376293541461635129"
+    );
+    assert_eq!(
+        s("x := 7 ** 80\ny := 13 ** 41 + 5\n(x * y + 17) / y == x and (x * y + 17) % y == 17"),
+        "true"
+    );
+
+    // results that fit again are small ints
+    assert_eq!(value("2 ** 64 - 2 ** 64 + 1"), Value::Int(1));
+    assert_eq!(value("(2 ** 100) / (2 ** 98)"), Value::Int(4));
+    assert_eq!(value("[1, 2][2 ** 64 - 2 ** 64]"), Value::Int(1));
+
+    assert_eq!(s("2 ** 64 > 9223372036854775807"), "true");
+    assert_eq!(s("-(2 ** 64) < -(2 ** 63) - 1"), "true");
+    assert_eq!(s("2 ** 64 == 2 ** 64"), "true");
+    assert_eq!(s("2 ** 64 == 18446744073709551616.0"), "true");
+    assert_eq!(s("2 ** 64 + 0.5"), "1.8446744073709552e19");
+    assert_eq!(s("(-1) ** (2 ** 64 + 1)"), "-1");
+    assert_eq!(s("m := {(2 ** 64): 1}\nm[2 ** 32 * 2 ** 32]"), "1");
+    assert_eq!(s("\"${2 ** 70}\""), "1180591620717411303424");
+
+    assert_eq!(
+        run("1 / (2 ** 64 - 2 ** 64)"),
+        Err("division by zero at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("2 ** (2 ** 40)"),
+        Err("the result of ** is too large at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("2 ** 64 land 1"),
+        Err("land only supports ints of at most 64 bits at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("[1][2 ** 64]"),
+        Err("index 18446744073709551616 is out of range for a list at Some(\"1:1\")".to_string())
+    );
+}
+
+#[test]
+fn vm_assertions() {
+    assert_eq!(
+        value("assert(1 < 2)\nassert_eq([1, \"a\"], [1, \"a\"], \"same\")"),
+        Value::None
+    );
+    assert_eq!(
+        run("assert(len([]) > 0)"),
+        Err("assertion failed at Some(\"1:1\")".to_string())
+    );
+    assert_eq!(
+        run("x := 2\nassert(x > 2, \"x is ${x}\")"),
+        Err("assertion failed: x is 2 at Some(\"2:1\")".to_string())
+    );
+    assert_eq!(
+        run("assert_eq(\"1\", 1)"),
+        Err("assertion failed: expected 1, found \"1\" at Some(\"1:1\")".to_string())
+    );
+
+    // instances are compared with their `eq`
+    let points = "struct P {
+    x, y
+    function eq(a, b) -> { a.x == b.x }
+}
+";
+    assert_eq!(
+        value(&format!("{}assert_eq(P(1, 2), P(1, 3))", points)),
+        Value::None
+    );
+    assert_eq!(
+        run(&format!("{}assert_eq(P(1, 2), P(2, 2), \"x\")", points)),
+        Err(
+            "assertion failed: x, expected P(x: 2, y: 2), found P(x: 1, y: 2) at Some(\"5:1\")"
+                .to_string()
+        )
+    );
+
+    // what the function raised is the value, interrupts and exits go through
+    let raised = "e := assert_raises(() -> { throw \"no\" })\nerrors::message(e)";
+    assert_eq!(value(raised), Value::from("no"));
+    assert_eq!(
+        run("assert_raises(() -> { exit(4) })"),
+        Err("exit 4".to_string())
+    );
+    assert_eq!(
+        run("function f() -> { [] }\nassert_raises(f)"),
+        Err(
+            "assertion failed: expected an error, the function returned [] at Some(\"2:1\")"
+                .to_string()
+        )
+    );
+}
+
+#[test]
+fn vm_interned_strings() {
+    // the characters, the numbers interpolated and the strings concatenated
+    // in the loop are short, each is made once and then shared
+    let text = "s := \"abcdef\"
+mut i := 0
+for i < 1000 {
+    c := s[i % 6]
+    n := \"${i % 10}\"
+    m := c ++ n ++ \"\"
+    i += 1
+}
+for c in s {}
+\"${s}\"";
+    let src = Arc::new(Source::from_string(text.to_string()));
+    let (program, _) = parse(&src);
+    let created = |outcome: Result<Value, Halt>, before| {
+        assert_eq!(outcome.ok(), Some(Value::from("abcdef")));
+        limits::created() - before
+    };
+    let walked = created(Interpreter::new().eval(&program), limits::created());
+    let compiled = created(Vm::new().run(compile(&program)), limits::created());
+    assert!(walked < 100, "the tree-walker created {} values", walked);
+    assert!(compiled < 100, "the VM created {} values", compiled);
+
+    let long = Value::from("a string too long to be interned, past the limit");
+    let Value::String(shared) = Value::from("abc") else {
+        unreachable!();
+    };
+    assert!(matches!(Value::from("abc"), Value::String(s) if Arc::ptr_eq(&s, &shared)));
+    assert!(matches!(&long, Value::String(s) if s.len() > intern::MAX_LEN));
+}
+
+#[test]
+fn value_size() {
+    // stacks and lists hold values inline, see `Value`
+    let size = std::mem::size_of::<Value>();
+    assert!(size <= 24, "values take {} bytes", size);
+}
+
+#[test]
+fn vm_coverage() {
+    coverage::enable();
+    let text = "x := 1\nif x > 1 {\n    print(\"big\")\n} else {\n    x + 1\n}\nfunction f() -> {\n    2\n}\n";
+    let src = Arc::new(Source::new(
+        Some("vm_coverage.drgns".to_string()),
+        text.to_string(),
+    ));
+    let (program, _) = parse(&src);
+    let executable = coverage::executable(&program);
+    assert_eq!(executable, BTreeSet::from([1, 2, 3, 5, 8]));
+
+    // other tests may run files meanwhile, only this one is looked at
+    let run = |outcome: Result<Value, Halt>| {
+        assert!(outcome.is_ok());
+        let lines = coverage::take()
+            .remove("vm_coverage.drgns")
+            .unwrap_or_default();
+        executable
+            .iter()
+            .copied()
+            .filter(|l| lines.contains_key(l))
+            .collect::<Vec<_>>()
+    };
+    let walked = run(Interpreter::new().eval(&program));
+    let compiled = run(Vm::new().run(compile(&program)));
+    assert_eq!(walked, vec![1, 2, 5]);
+    assert_eq!(compiled, walked);
+}
+
+#[test]
+fn vm_profile() {
+    profile::start(Profile::Mem);
+    let text = "function profiled_inner() -> { [1, 2] }
+function profiled_outer(n) -> {
+    profiled_inner()
+    if n == 0 { return none }
+    return profiled_outer(n - 1)
+}
+profiled_outer(2)";
+    let src = Arc::new(Source::from_string(text.to_string()));
+    let (program, _) = parse(&src);
+    // the functions of other tests are profiled too, only these are looked at
+    let profiled = || {
+        let functions = profile::functions();
+        (functions["profiled_outer"], functions["profiled_inner"])
+    };
+
+    assert!(Interpreter::new().eval(&program).is_ok());
+    let walked = profiled();
+    // the tail calls take over the call they return from
+    let outer = profile::Function {
+        calls: 3,
+        own: 0,
+        total: 9,
+    };
+    let inner = profile::Function {
+        calls: 3,
+        own: 9,
+        total: 9,
+    };
+    assert_eq!(walked, (outer, inner));
+
+    assert!(Vm::new().run(compile(&program)).is_ok());
+    let (outer, inner) = profiled();
+    assert_eq!((outer.calls, outer.own, outer.total), (6, 0, 18));
+    assert_eq!((inner.calls, inner.own, inner.total), (6, 18, 18));
+    assert!(profile::folded().contains("profiled_outer;profiled_inner 18\n"));
+}
+
+/// a trace written to memory, taken by the test that wrote it
+#[derive(Clone, Default)]
+struct Written(Arc<Mutex<Vec<u8>>>);
+
+impl Written {
+    fn take(&self) -> String {
+        let bytes = std::mem::take(&mut *self.0.lock().expect("not poisoned"));
+        String::from_utf8(bytes).expect("traces are text")
+    }
+}
+
+impl std::io::Write for Written {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.lock().expect("not poisoned").extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+#[test]
+fn vm_trace() {
+    let written = Written::default();
+    // kept to the function, so that what other tests run isn't traced
+    trace::start(
+        Trace::Statements,
+        vec!["traced".to_string()],
+        Box::new(written.clone()),
+    );
+    let text = "function traced_inner(x) -> { x * 2 }
+function traced(n) -> {
+    mut total := 0
+    total += traced_inner(n)
+    total
+}
+traced(1)
+untraced := traced_inner(2)";
+    let src = Arc::new(Source::new(
+        Some("traced.drgns".to_string()),
+        text.to_string(),
+    ));
+    let (program, _) = parse(&src);
+    let expected = "  traced.drgns:3 mut total := 0
+  traced.drgns:4 total += traced_inner(n)
+    traced.drgns:1 function traced_inner(x) -> { x * 2 }
+  traced.drgns:5 total
+";
+
+    assert!(Interpreter::new().eval(&program).is_ok());
+    assert_eq!(written.take(), expected);
+    assert!(Vm::new().run(compile(&program)).is_ok());
+    assert_eq!(written.take(), expected);
+}
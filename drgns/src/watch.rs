@@ -0,0 +1,128 @@
+//! The `--watch` of `drgns run` and `drgns check`.
+//!
+//! The script runs again each time its file, or the file of a module it
+//! imports, directly or not, changes. The files are found again before each
+//! run, so an import added is watched from the run after it. The directories
+//! of the files are watched rather than the files, as editors often save by
+//! replacing the file. The changes coming within `DEBOUNCE` of each other,
+//! as a file written in several steps, make a single run.
+//!
+//! Ctrl-C stops the script if it runs, and the watch.
+
+use std::{
+    collections::HashSet,
+    io::Write,
+    path::{Path, PathBuf},
+    sync::mpsc::{self, Receiver, RecvTimeoutError},
+    time::Duration,
+};
+
+use drgns::{
+    diagnostics::{self, Format},
+    error_handler::{DragonError, ErrorCode},
+    interpreter::interrupt::{self, Reason},
+    modules, source,
+};
+use notify::{Event, RecursiveMode, Watcher};
+
+use crate::{handle_interrupts, report, INTERRUPTED, INVALID_PROGRAM};
+
+/// How long to wait for more changes after one, before running again
+const DEBOUNCE: Duration = Duration::from_millis(100);
+
+/// How often Ctrl-C is looked for while waiting for changes
+const POLL: Duration = Duration::from_millis(100);
+
+/// Clears the terminal and moves the cursor to its top left
+const CLEAR: &str = "\x1b[2J\x1b[H";
+
+/// Run the script at `path` with `run`, and again after each change to its
+/// files, clearing the terminal before each run if `clear`. Returns the exit
+/// status of the process once Ctrl-C stops it.
+pub fn watch(path: &str, clear: bool, mut run: impl FnMut() -> i32) -> i32 {
+    if path == source::STDIN {
+        let msg = "--watch needs a file, the standard input cannot change".to_string();
+        report(&[DragonError::new(ErrorCode::Generic, msg, None)]);
+        return INVALID_PROGRAM;
+    }
+    handle_interrupts();
+    let (sender, changes) = mpsc::channel();
+    let mut watcher = match notify::recommended_watcher(sender) {
+        Ok(watcher) => watcher,
+        Err(e) => {
+            let msg = format!("the files cannot be watched: {}", e);
+            report(&[DragonError::new(ErrorCode::Io, msg, None)]);
+            return INVALID_PROGRAM;
+        }
+    };
+    let mut directories = HashSet::new();
+    loop {
+        let files: HashSet<PathBuf> = modules::imported(Path::new(path)).into_iter().collect();
+        // watched before the run, not to miss the changes made during it
+        let wanted: HashSet<PathBuf> = files
+            .iter()
+            .filter_map(|f| f.parent())
+            .filter(|d| d.is_dir())
+            .map(Path::to_path_buf)
+            .collect();
+        for d in directories.difference(&wanted) {
+            let _ = watcher.unwatch(d);
+        }
+        for d in wanted.difference(&directories) {
+            if let Err(e) = watcher.watch(d, RecursiveMode::NonRecursive) {
+                log::warn!("'{}' cannot be watched: {}", d.display(), e);
+            }
+        }
+        directories = wanted;
+
+        if clear {
+            print!("{}", CLEAR);
+            let _ = std::io::stdout().flush();
+        }
+        let status = match Path::new(path).is_file() {
+            true => Some(run()),
+            false => {
+                let msg = format!("cannot read '{}': there is no such file", path);
+                report(&[DragonError::new(ErrorCode::IoNotFound, msg, None)]);
+                None
+            }
+        };
+        if interrupt::reason() == Some(Reason::Interrupt) {
+            return INTERRUPTED;
+        }
+        interrupt::clear();
+        // the messages of the watch would not be JSON
+        if diagnostics::format() == Format::Human {
+            match status {
+                Some(status) => eprintln!("[exited with status {}, watching for changes]", status),
+                None => eprintln!("[watching for changes]"),
+            }
+        }
+        if !changed(&changes, &files) {
+            return INTERRUPTED;
+        }
+    }
+}
+
+/// Wait for a change to one of the files, and for those following it within
+/// `DEBOUNCE`. Returns false if Ctrl-C came first.
+fn changed(changes: &Receiver<notify::Result<Event>>, files: &HashSet<PathBuf>) -> bool {
+    loop {
+        if interrupt::pending() {
+            return false;
+        }
+        match changes.recv_timeout(POLL) {
+            Ok(Ok(event)) if !event.kind.is_access() => {
+                if event.paths.iter().any(|p| files.contains(p)) {
+                    break;
+                }
+            }
+            Ok(Ok(_)) | Err(RecvTimeoutError::Timeout) => {}
+            Ok(Err(e)) => log::warn!("the files cannot be watched: {}", e),
+            // the watcher is gone, nothing will change
+            Err(RecvTimeoutError::Disconnected) => return false,
+        }
+    }
+    while changes.recv_timeout(DEBOUNCE).is_ok() {}
+    true
+}
@@ -0,0 +1,34 @@
+//! Deterministic runs, in a process of their own since `set_deterministic`
+//! holds for every script from then on.
+
+use drgns::{interpreter::builtins, playground, Interpreter};
+
+/// what a run from the start prints and logs
+fn run(code: &str) -> (String, String) {
+    builtins::set_deterministic();
+    let outcome = playground::run(&mut Interpreter::new(), code);
+    assert_eq!(outcome.status, 0, "the run failed: {}", outcome.stderr);
+    (outcome.stdout, outcome.stderr)
+}
+
+/// one test, the runs starting over must not be interleaved
+#[test]
+fn runs_are_the_same() {
+    let script = r#"print(random::int(1000000), random::float(), random::token(4))
+print(random::sample([1, 2, 3, 4, 5], 3))
+print(time::now(), time::monotonic())
+time::sleep(0.1)
+print(time::now())
+log::info("done")"#;
+    let (stdout, stderr) = run(script);
+    assert_eq!(run(script), (stdout.clone(), stderr.clone()));
+    // the clocks start at the epoch and move as the script sleeps
+    let lines: Vec<&str> = stdout.lines().collect();
+    assert_eq!(lines[2..], ["0.0 0.0", "0.1"]);
+    assert_eq!(stderr, "1970-01-01T00:00:00.100Z INFO  done\n");
+
+    // and the local zone is UTC
+    let (stdout, _) = run(r#"print(time::format(0, "%Y-%m-%d %H:%M %z"))
+print(time::format(0, "%z", "local"))"#);
+    assert_eq!(stdout, "1970-01-01 00:00 +0000\n+0000\n");
+}
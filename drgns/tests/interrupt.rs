@@ -0,0 +1,126 @@
+//! Stopping scripts from outside of them, in a process of their own since a
+//! request to stop holds for every script running in it.
+
+use std::{
+    io::{BufRead, BufReader},
+    process::{Command, Output, Stdio},
+    thread,
+    time::Duration,
+};
+
+use drgns::{
+    error_handler::ErrorCode,
+    interpreter::interrupt::{self, Reason},
+    Engine, EvalError, Interpreter,
+};
+
+const ENGINES: [(Engine, &str); 2] = [(Engine::Walk, "walk"), (Engine::Vm, "vm")];
+
+/// `drgns eval` the code on the engine, with the flags
+fn drgns(engine: &str, flags: &[&str], code: &str) -> Command {
+    let mut command = Command::new(env!("CARGO_BIN_EXE_drgns"));
+    command
+        .arg("eval")
+        .args(["--engine", engine])
+        .args(flags)
+        .arg(code)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped());
+    command
+}
+
+fn stderr(output: &Output) -> String {
+    String::from_utf8_lossy(&output.stderr).into_owned()
+}
+
+/// one test, the requests of the others would stop its loops
+#[test]
+fn requests_stop_endless_loops() {
+    let code = "mut n := 0\nfor { n += 1 }";
+    for (engine, _) in ENGINES {
+        for (reason, message) in [
+            (Reason::Interrupt, "the script was interrupted"),
+            (
+                Reason::Timeout(Duration::from_secs(1)),
+                "the script timed out after 1s",
+            ),
+        ] {
+            let mut interpreter = Interpreter::with_engine(engine);
+            let stop = thread::spawn(move || {
+                thread::sleep(Duration::from_millis(100));
+                interrupt::request(reason);
+            });
+            let outcome = interpreter.eval_string(code);
+            stop.join().expect("the request is made");
+            assert_eq!(interrupt::reason(), Some(reason));
+            interrupt::clear();
+            match outcome {
+                Err(EvalError::Runtime(e)) => {
+                    assert_eq!(e.code(), ErrorCode::Interrupted, "{:?}", engine);
+                    assert_eq!(e.message(), message, "{:?}", engine);
+                }
+                _ => panic!("the loop on {:?} ended with {:?}", engine, outcome.ok()),
+            }
+            // no `catch` handles it either
+            let stop = thread::spawn(move || {
+                thread::sleep(Duration::from_millis(100));
+                interrupt::request(reason);
+            });
+            let outcome = interpreter.eval_string("try { for {} } catch e { 1 }");
+            stop.join().expect("the request is made");
+            interrupt::clear();
+            assert!(
+                matches!(outcome, Err(EvalError::Runtime(e)) if e.code() == ErrorCode::Interrupted),
+                "a catch on {:?} handled the interrupt",
+                engine
+            );
+        }
+    }
+}
+
+#[test]
+fn timeout_exits_with_124() {
+    for (_, engine) in ENGINES {
+        let output = drgns(engine, &["--timeout", "200ms"], "for {}")
+            .output()
+            .expect("drgns runs");
+        assert_eq!(output.status.code(), Some(124), "{}", engine);
+        assert!(
+            stderr(&output).contains("the script timed out after 200ms"),
+            "{}: {}",
+            engine,
+            stderr(&output)
+        );
+    }
+}
+
+#[cfg(unix)]
+#[test]
+fn ctrl_c_exits_with_130() {
+    for (_, engine) in ENGINES {
+        let mut child = drgns(engine, &[], "print(\"started\"); for {}")
+            .spawn()
+            .expect("drgns runs");
+        // once the loop runs, Ctrl-C is handled
+        let mut line = String::new();
+        let stdout = child.stdout.take().expect("the output is piped");
+        BufReader::new(stdout)
+            .read_line(&mut line)
+            .expect("the script prints");
+        assert_eq!(line, "started\n");
+        let killed = Command::new("kill")
+            .args(["-INT", &child.id().to_string()])
+            .status()
+            .expect("kill runs");
+        assert!(killed.success());
+        let output = child.wait_with_output().expect("drgns ends");
+        assert_eq!(output.status.code(), Some(130), "{}", engine);
+        assert!(
+            stderr(&output).contains("the script was interrupted"),
+            "{}: {}",
+            engine,
+            stderr(&output)
+        );
+    }
+}